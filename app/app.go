@@ -2,13 +2,15 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/netip"
 	"path"
+	"slices"
 	"sync"
 	"time"
 
@@ -16,6 +18,8 @@ import (
 	"github.com/voidr3aper-anon/Vwarp/iputils"
 	"github.com/voidr3aper-anon/Vwarp/masque"
 	masquenoize "github.com/voidr3aper-anon/Vwarp/masque/noize"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
 	"github.com/voidr3aper-anon/Vwarp/psiphon"
 	"github.com/voidr3aper-anon/Vwarp/warp"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
@@ -29,9 +33,12 @@ const doubleMTU = 1280 // minimum mtu for IPv6, may cause frag reassembly somewh
 
 type WarpOptions struct {
 	Bind               netip.AddrPort
-	Endpoint           string
+	Endpoint           string // Empty picks a random WireGuard endpoint and lets MASQUE rotate through its stored ones
+	EndpointV4         bool   // Pick the random endpoint from IPv4 addresses, both families if neither is set
+	EndpointV6         bool   // Pick the random endpoint from IPv6 addresses
 	License            string
 	DnsAddr            netip.Addr
+	DoHURL             string // DNS-over-HTTPS endpoint for lookups inside the tunnel, plain DNS if empty
 	Psiphon            *PsiphonOptions
 	Gool               bool
 	Masque             bool
@@ -39,22 +46,128 @@ type WarpOptions struct {
 	MasqueNoize        bool   // Enable MASQUE noize obfuscation
 	MasqueNoizePreset  string // Noize preset: light, medium, heavy, stealth, gfw
 	MasqueNoizeConfig  string // Path to custom noize configuration JSON file
+	AutoNoize          bool   // Benchmark noize presets and use the lightest that reliably connects (MASQUE only)
 	Scan               *wiresocks.ScanOptions
 	CacheDir           string
 	FwMark             uint32
 	WireguardConfig    string
 	Reserved           string
 	TestURL            string
+	TestURLs           []string // Tried in rotation after TestURL by the connectivity test, defaultTestURLs if empty
+	ProbeTargets       []string // ip:port targets dialed to validate a recovered MASQUE tunnel, defaults if empty
 	AtomicNoizeConfig  *preflightbind.AtomicNoizeConfig
 	UnifiedNoizeConfig *noize.UnifiedNoizeConfig // Unified configuration for both WireGuard and MASQUE obfuscation
 	ProxyAddress       string
+	Profile            string         // Named device profile under CacheDir, holding the MASQUE config and WireGuard identities; the unnamed default if empty
+	Tun                string         // Name of an OS TUN device to route MASQUE traffic through (full VPN mode)
+	Transparent        netip.AddrPort // Bind address of the transparent (TPROXY/REDIRECT) listener, MASQUE only
+	SourcePortRange    [2]int         // Inclusive local port range for the MASQUE QUIC socket, zero for ephemeral
+	StableSourcePort   bool           // Reuse the MASQUE QUIC source port across reconnects
+	RandomFallback     bool           // Try a random address of Cloudflare's MASQUE ranges when the endpoint fails
+	HandshakeTimeout   time.Duration  // WireGuard handshake wait, DefaultHandshakeTimeout (doubled for heavy noize presets) if zero
+	SessionTickets     bool           // Persist MASQUE TLS session tickets next to the device config to resume across restarts
+	ACL                *acl.ACL       // Destinations proxy clients may connect to, nil allows all
+	MasqueALPN         []string       // TLS ALPN offered to the MASQUE server, masque.DefaultALPN if empty
+	ConnectURI         string         // Connect-IP URI template, masque.ConnectURI if empty; ConnectURIs overrides it per host:port or host
+	ConnectURIs        map[string]string
+	QUICKeepAlive      time.Duration // QUIC PING interval of an idle MASQUE tunnel, masque.DefaultKeepAlivePeriod if zero
+	RelayKeepAlive     time.Duration // Tunnel nudge interval while a proxied connection is idle, zero disables
+	StatsInterval      time.Duration // How often proxy totals are logged during a run, zero logs them only at shutdown
+	WriteQueue         int           // Packets buffered between the netstack and MASQUE writes, DefaultWriteQueueDepth if zero
+	ForwardWorkers     int           // Goroutines forwarding MASQUE packets in each direction, sharded by flow, 1 if zero
+	SkipReachability   bool          // Dial MASQUE directly instead of probing the endpoint over QUIC first
+	RequireMasque      bool          // Fail instead of falling back to WireGuard when MASQUE can't be established
+	FailClosed         bool          // Don't serve the proxy until the tunnel passes the connectivity test
+	EgressIface        string        // Network interface whose address the MASQUE socket and probe are bound to
+	CertValidity       time.Duration // Lifetime of the generated MASQUE client certificate, masque.DefaultCertValidity if zero
+	CertName           string        // Subject common name of the generated MASQUE client certificate, empty if not set
+	CertSANs           []string      // DNS subject alternative names of the generated MASQUE client certificate
+
+	RequestLog statute.RequestLog // How much of each proxied request is logged, statute.RequestLogOff by default
+
+	QUICReceiveWindows masque.ReceiveWindows // MASQUE QUIC receive windows, the quic-go defaults if zero
+	EndpointDNSTTL     time.Duration         // How long MASQUE reconnects reuse the endpoint hostname lookup, zero looks it up on every dial
+
+	DialBreaker  int           // Proxy dials in a row to a destination that may time out before new ones fail fast, zero disables
+	DialCooldown time.Duration // How long new proxy dials to a destination fail fast once its dial breaker trips
+
+	TunnelBreaker  int           // Different destinations in a row whose proxy dials may time out before all new ones fail fast, zero disables
+	TunnelCooldown time.Duration // How long all new proxy dials fail fast once the tunnel breaker trips
+
+	DNSListen netip.AddrPort // Bind address of a local DNS server resolving through the tunnel, none if zero
+
+	SourcePort int // Fixed local port of the MASQUE QUIC socket on every connect, for firewall rules; zero for none
+
+	ConnectProtocol string // Connect-IP :protocol, masque.DefaultConnectIPProtocol if empty; "connect-ip" for RFC 9484 servers
+
+	InitialPacketSize uint16 // Size MASQUE QUIC Initial datagrams are padded to, masque.DefaultInitialPacketSize if zero
+	InitialPadPattern []byte // Bytes the Initial padding is filled with, QUIC PADDING frames if empty
+
+	Tricks []string // WireGuard handshake tricks tried in order until one connects, DefaultTricks if empty
+
+	QualityHistory  string        // JSON lines file MASQUE tunnel quality samples are appended to, none if empty
+	QualityInterval time.Duration // How often the quality history is sampled, DefaultQualityInterval if zero
+
+	ProxyTLS *tls.Config // Serves the SOCKS/HTTP proxy over TLS with this config, plain TCP if nil
+
+	ProxyAdmin      netip.AddrPort // Bind address of the admin API listing and closing proxy connections, none if zero
+	ProxyAdminToken string         // Bearer token the admin API requires
+
+	AcceptTOS  bool // Accept the Cloudflare terms of service when registering a new device
+	RequireTOS bool // Fail registering a new device unless AcceptTOS is set, instead of accepting the terms implicitly
+
+	ClockCheck bool // Warn about a skewed local clock, checked with a plain HTTP request outside the tunnel
+
+	proxyConns *wiresocks.ConnTable // Set by RunWarp when ProxyAdmin is
+}
+
+// tosAccepted reports whether registering a new device accepts the Cloudflare
+// terms of service: explicitly with AcceptTOS, implicitly unless RequireTOS
+func (o WarpOptions) tosAccepted() bool {
+	return o.AcceptTOS || !o.RequireTOS
+}
+
+// wireGuardFallback reports whether a failed MASQUE tunnel falls back to
+// WireGuard, which never serves a TUN device. Only then is a QUIC failure worth recording in the block
+// detector, which exists to skip straight to that fallback.
+func (o WarpOptions) wireGuardFallback() bool {
+	return o.MasquePreferred && !o.RequireMasque && o.Tun == ""
+}
+
+// masqueEndpoint returns the endpoint of endpoints the MASQUE tunnel dials,
+// empty when none was given or scanned so the adapter rotates through the
+// endpoints stored with the device
+func (o WarpOptions) masqueEndpoint(endpoints []string) string {
+	if o.Endpoint == "" && o.Scan == nil {
+		return ""
+	}
+	return endpoints[0]
 }
 
+// ErrMasqueRequired is returned by RunWarp when WarpOptions.RequireMasque is
+// set and the MASQUE tunnel could not be established
+var ErrMasqueRequired = errors.New("MASQUE is required but could not be established")
+
+// ErrTunRequiresMasque is returned by RunWarp in MASQUE-preferred mode when
+// the MASQUE tunnel for WarpOptions.Tun could not be established, since the
+// WireGuard fallback can't serve a TUN device
+var ErrTunRequiresMasque = errors.New("TUN mode has no WireGuard fallback and MASQUE could not be established")
+
+// failClosedRetryInterval is the pause between connectivity tests while a
+// fail-closed MASQUE tunnel waits to be confirmed up
+const failClosedRetryInterval = 5 * time.Second
+
 type PsiphonOptions struct {
 	Country string
 }
 
 func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	conns, err := startProxyAdmin(ctx, l, opts)
+	if err != nil {
+		return err
+	}
+	opts.proxyConns = conns
+
 	if opts.WireguardConfig != "" {
 		if err := runWireguard(ctx, l, opts); err != nil {
 			return err
@@ -63,6 +176,81 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		return nil
 	}
 
+	if err := validateWarpOptions(opts); err != nil {
+		return err
+	}
+
+	// Registration and the tunnel handshakes fail obscurely on a badly set
+	// clock; check it alongside them rather than delaying startup. The check
+	// goes out in the clear, outside the tunnel, so it is opt-in.
+	if opts.ClockCheck {
+		go warnClockSkew(ctx, l, clockCheckURL)
+	}
+
+	endpoints, err := resolveEndpoints(ctx, l, opts)
+	if err != nil {
+		return err
+	}
+	l.Info("using warp endpoints", "endpoints", endpoints)
+
+	var warpErr error
+	switch {
+	case opts.Masque:
+		l.Info("running in MASQUE mode")
+		// run warp through MASQUE proxy
+		warpErr = runWarpWithMasque(ctx, l, opts, opts.masqueEndpoint(endpoints))
+		if warpErr != nil && opts.RequireMasque {
+			warpErr = fmt.Errorf("%w: %w", ErrMasqueRequired, warpErr)
+		}
+	case opts.MasquePreferred:
+		// Try MASQUE first, fallback to WireGuard automatically
+		l.Info("running in MASQUE-preferred mode")
+		if opts.Tun != "" {
+			l.Info("TUN mode has no WireGuard fallback, MASQUE must connect", "tun", opts.Tun)
+		}
+
+		// Skip the QUIC handshake timeout entirely on networks known to block QUIC,
+		// unless falling back is not an option
+		if network := masque.NetworkSignature(); opts.wireGuardFallback() && newQUICBlockDetector(opts).Blocked(network) {
+			l.Warn("QUIC appears to be blocked on this network, using WireGuard directly", "network", network)
+			warpErr = runWarp(ctx, l, opts, endpoints[0])
+			break
+		}
+
+		warpErr = runWarpWithMasque(ctx, l, opts, opts.masqueEndpoint(endpoints))
+
+		if warpErr != nil && opts.RequireMasque {
+			warpErr = fmt.Errorf("%w: %w", ErrMasqueRequired, warpErr)
+		} else if warpErr != nil && opts.Tun != "" {
+			warpErr = fmt.Errorf("%w: %w", ErrTunRequiresMasque, warpErr)
+		} else if warpErr != nil {
+			l.Warn("MASQUE preferred but failed, falling back to WireGuard", "error", warpErr)
+			warpErr = runWarp(ctx, l, opts, endpoints[0])
+			if warpErr == nil {
+				l.Info("WireGuard fallback successful")
+			}
+		} else {
+			l.Info("MASQUE preferred mode successful")
+		}
+	case opts.Psiphon != nil:
+		l.Info("running in Psiphon (cfon) mode")
+		// run primary warp on a random tcp port and run psiphon on bind address
+		warpErr = runWarpWithPsiphon(ctx, l, opts, endpoints[0])
+	case opts.Gool:
+		l.Info("running in warp-in-warp (gool) mode")
+		// run warp in warp
+		warpErr = runWarpInWarp(ctx, l, opts, endpoints)
+	default:
+		l.Info("running in normal warp mode")
+		// just run primary warp on bindAddress
+		warpErr = runWarp(ctx, l, opts, endpoints[0])
+	}
+
+	return warpErr
+}
+
+// validateWarpOptions rejects mode combinations RunWarp can't serve
+func validateWarpOptions(opts WarpOptions) error {
 	if opts.Psiphon != nil && opts.Gool {
 		return errors.New("can't use psiphon and gool at the same time")
 	}
@@ -79,15 +267,52 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		return errors.New("must provide country for psiphon")
 	}
 
+	// Psiphon serves the proxy on Bind itself, so destinations never reach
+	// the ACL check in wiresocks
+	if opts.Psiphon != nil && opts.ACL != nil {
+		return errors.New("can't use --allow/--deny with psiphon")
+	}
+
+	if opts.Psiphon != nil && opts.ProxyTLS != nil {
+		return errors.New("can't serve the proxy over TLS with psiphon")
+	}
+
+	return nil
+}
+
+// resolveEndpoints returns the endpoints to connect to, scanning for them
+// when opts.Scan is set
+func resolveEndpoints(ctx context.Context, l *slog.Logger, opts WarpOptions) ([]string, error) {
 	// Decide Working Scenario
 	endpoints := []string{opts.Endpoint, opts.Endpoint}
+	if opts.Endpoint == "" && opts.Scan == nil {
+		// Used by WireGuard, MASQUE rotates through its stored endpoints instead
+		v4, v6 := opts.EndpointV4, opts.EndpointV6
+		if !v4 && !v6 {
+			v4, v6 = true, true
+		}
+		addrPort, err := warp.RandomWarpEndpoint(v4, v6)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = []string{addrPort.String(), addrPort.String()}
+	}
 
-	if opts.Scan != nil {
+	if opts.Scan != nil && opts.Masque {
+		// The endpoint will be used for MASQUE, so it must answer on 443
+		scan := *opts.Scan
+		scan.Masque = true
+		opts.Scan = &scan
+	}
+
+	if opts.Scan != nil && (opts.Scan.ProbeOnly || opts.Scan.Masque) {
+		l.Info("keyless scan, skipping device registration")
+	} else if opts.Scan != nil {
 		// make primary identity
-		ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+		ident, err := warp.LoadOrCreateIdentity(l, identityPath(opts, "primary"), opts.License, opts.tosAccepted())
 		if err != nil {
 			l.Error("couldn't load primary warp identity")
-			return err
+			return nil, err
 		}
 
 		// Reading the private key from the 'Interface' section
@@ -95,10 +320,12 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 
 		// Reading the public key from the 'Peer' section
 		opts.Scan.PublicKey = ident.Config.Peers[0].PublicKey
+	}
 
+	if opts.Scan != nil {
 		res, err := wiresocks.RunScan(ctx, l, *opts.Scan)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		l.Debug("scan results", "endpoints", res)
@@ -108,43 +335,7 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 			endpoints[i] = res[i].AddrPort.String()
 		}
 	}
-	l.Info("using warp endpoints", "endpoints", endpoints)
-
-	var warpErr error
-	switch {
-	case opts.Masque:
-		l.Info("running in MASQUE mode")
-		// run warp through MASQUE proxy
-		warpErr = runWarpWithMasque(ctx, l, opts, endpoints[0])
-	case opts.MasquePreferred:
-		// Try MASQUE first, fallback to WireGuard automatically
-		l.Info("running in MASQUE-preferred mode")
-		warpErr = runWarpWithMasque(ctx, l, opts, endpoints[0])
-
-		if warpErr != nil {
-			l.Warn("MASQUE preferred but failed, falling back to WireGuard", "error", warpErr)
-			warpErr = runWarp(ctx, l, opts, endpoints[0])
-			if warpErr == nil {
-				l.Info("WireGuard fallback successful")
-			}
-		} else {
-			l.Info("MASQUE preferred mode successful")
-		}
-	case opts.Psiphon != nil:
-		l.Info("running in Psiphon (cfon) mode")
-		// run primary warp on a random tcp port and run psiphon on bind address
-		warpErr = runWarpWithPsiphon(ctx, l, opts, endpoints[0])
-	case opts.Gool:
-		l.Info("running in warp-in-warp (gool) mode")
-		// run warp in warp
-		warpErr = runWarpInWarp(ctx, l, opts, endpoints)
-	default:
-		l.Info("running in normal warp mode")
-		// just run primary warp on bindAddress
-		warpErr = runWarp(ctx, l, opts, endpoints[0])
-	}
-
-	return warpErr
+	return endpoints, nil
 }
 
 func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
@@ -160,6 +351,10 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 
 	// Enable trick and keepalive on all peers in config
 	atomicNoizeConfig := getAtomicNoizeConfig(opts)
+	if atomicNoizeConfig == nil && conf.AtomicNoize != nil {
+		l.Info("using AmneziaWG obfuscation from WireGuard config", "jc", conf.AtomicNoize.Jc, "jmin", conf.AtomicNoize.Jmin, "jmax", conf.AtomicNoize.Jmax)
+		atomicNoizeConfig = conf.AtomicNoize
+	}
 	for i, peer := range conf.Peers {
 		// Only enable old trick functionality if AtomicNoize is not being used
 		if atomicNoizeConfig == nil {
@@ -180,43 +375,49 @@ func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	var werr error
 	var tnet *netstack.Net
 	var tunDev tun.Device
-	for _, t := range []string{"t1", "t2"} {
+	// Built once so every trick continues the URL rotation
+	testURLs := newTestURLs(opts)
+	_, werr = tryTricks(l, opts.Tricks, func(t string) error {
+		var err error
 		// Create userspace tun network stack
-		tunDev, tnet, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
-		if werr != nil {
-			continue
+		tunDev, tnet, err = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+		if err != nil {
+			return err
 		}
 
-		werr = establishWireguard(l, conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress)
-		if werr != nil {
-			continue
+		if err := establishWireguard(l, conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress, HandshakeTimeout(opts)); err != nil {
+			return err
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL)
-		if werr != nil {
-			continue
-		}
-		break
-	}
+		return usermodeTunTest(ctx, l, tnet, testURLs)
+	})
 	if werr != nil {
 		return werr
 	}
 
+	if err := enableDoH(l, tnet, opts.DoHURL); err != nil {
+		return err
+	}
+
 	// Run a proxy on the userspace stack
-	actualBind, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind)
+	actualBind, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind, opts.ACL, proxyOptions(ctx, l, opts, nil)...)
 	if err != nil {
 		return err
 	}
 
 	l.Info("serving proxy", "address", actualBind)
 
+	if err := startLocalDNS(ctx, l, tnet, opts); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
 	// make primary identity
-	ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	ident, err := warp.LoadOrCreateIdentity(l, identityPath(opts, "primary"), opts.License, opts.tosAccepted())
 	if err != nil {
 		l.Error("couldn't load primary warp identity")
 		return err
@@ -254,42 +455,48 @@ func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint str
 	var werr error
 	var tnet *netstack.Net
 	var tunDev tun.Device
-	for _, t := range []string{"t1", "t2"} {
-		tunDev, tnet, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
-		if werr != nil {
-			continue
+	// Built once so every trick continues the URL rotation
+	testURLs := newTestURLs(opts)
+	_, werr = tryTricks(l, opts.Tricks, func(t string) error {
+		var err error
+		tunDev, tnet, err = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+		if err != nil {
+			return err
 		}
 
-		werr = establishWireguard(l, &conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress)
-		if werr != nil {
-			continue
+		if err := establishWireguard(l, &conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress, HandshakeTimeout(opts)); err != nil {
+			return err
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL)
-		if werr != nil {
-			continue
-		}
-		break
-	}
+		return usermodeTunTest(ctx, l, tnet, testURLs)
+	})
 	if werr != nil {
 		return werr
 	}
 
+	if err := enableDoH(l, tnet, opts.DoHURL); err != nil {
+		return err
+	}
+
 	// Run a proxy on the userspace stack
-	actualBind, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind)
+	actualBind, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind, opts.ACL, proxyOptions(ctx, l, opts, nil)...)
 	if err != nil {
 		return err
 	}
 
 	l.Info("serving proxy", "address", actualBind)
+
+	if err := startLocalDNS(ctx, l, tnet, opts); err != nil {
+		return err
+	}
 	return nil
 }
 
 func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) error {
 	atomicNoizeConfig := getAtomicNoizeConfig(opts)
 	// make primary identity
-	ident1, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	ident1, err := warp.LoadOrCreateIdentity(l, identityPath(opts, "primary"), opts.License, opts.tosAccepted())
 	if err != nil {
 		l.Error("couldn't load primary warp identity")
 		return err
@@ -326,25 +533,23 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	var werr error
 	var tnet1 *netstack.Net
 	var tunDev tun.Device
-	for _, t := range []string{"t1", "t2"} {
+	// Built once so every trick continues the URL rotation
+	testURLs := newTestURLs(opts)
+	_, werr = tryTricks(l.With("gool", "outer"), opts.Tricks, func(t string) error {
+		var err error
 		// Create userspace tun network stack
-		tunDev, tnet1, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
-		if werr != nil {
-			continue
+		tunDev, tnet1, err = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+		if err != nil {
+			return err
 		}
 
-		werr = establishWireguard(l.With("gool", "outer"), &conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress)
-		if werr != nil {
-			continue
+		if err := establishWireguard(l.With("gool", "outer"), &conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress, HandshakeTimeout(opts)); err != nil {
+			return err
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet1, opts.TestURL)
-		if werr != nil {
-			continue
-		}
-		break
-	}
+		return usermodeTunTest(ctx, l, tnet1, testURLs)
+	})
 	if werr != nil {
 		return werr
 	}
@@ -356,7 +561,7 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	}
 
 	// make secondary
-	ident2, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "secondary"), opts.License)
+	ident2, err := warp.LoadOrCreateIdentity(l, identityPath(opts, "secondary"), opts.License, opts.tosAccepted())
 	if err != nil {
 		l.Error("couldn't load secondary warp identity")
 		return err
@@ -392,27 +597,35 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 	}
 
 	// Establish wireguard on userspace stack
-	if err := establishWireguard(l.With("gool", "inner"), &conf, tunDev, opts.FwMark, "t0", nil, ""); err != nil {
+	if err := establishWireguard(l.With("gool", "inner"), &conf, tunDev, opts.FwMark, "t0", nil, "", HandshakeTimeout(opts)); err != nil {
 		return err
 	}
 
 	// Test wireguard connectivity
-	if err := usermodeTunTest(ctx, l, tnet2, opts.TestURL); err != nil {
+	if err := usermodeTunTest(ctx, l, tnet2, testURLs); err != nil {
 		return err
 	}
 
-	actualBind, err := wiresocks.StartProxy(ctx, l, tnet2, opts.Bind)
+	if err := enableDoH(l, tnet2, opts.DoHURL); err != nil {
+		return err
+	}
+
+	actualBind, err := wiresocks.StartProxy(ctx, l, tnet2, opts.Bind, opts.ACL, proxyOptions(ctx, l, opts, nil)...)
 	if err != nil {
 		return err
 	}
 
 	l.Info("serving proxy", "address", actualBind)
+
+	if err := startLocalDNS(ctx, l, tnet2, opts); err != nil {
+		return err
+	}
 	return nil
 }
 
 func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
 	// make primary identity
-	ident, err := warp.LoadOrCreateIdentity(l, path.Join(opts.CacheDir, "primary"), opts.License)
+	ident, err := warp.LoadOrCreateIdentity(l, identityPath(opts, "primary"), opts.License, opts.tosAccepted())
 	if err != nil {
 		l.Error("couldn't load primary warp identity")
 		return err
@@ -450,31 +663,31 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, e
 	var werr error
 	var tnet *netstack.Net
 	var tunDev tun.Device
-	for _, t := range []string{"t1", "t2"} {
+	// Built once so every trick continues the URL rotation
+	testURLs := newTestURLs(opts)
+	_, werr = tryTricks(l, opts.Tricks, func(t string) error {
+		var err error
 		// Create userspace tun network stack
-		tunDev, tnet, werr = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
-		if werr != nil {
-			continue
+		tunDev, tnet, err = netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+		if err != nil {
+			return err
 		}
 
-		werr = establishWireguard(l, &conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress)
-		if werr != nil {
-			continue
+		if err := establishWireguard(l, &conf, tunDev, opts.FwMark, t, atomicNoizeConfig, opts.ProxyAddress, HandshakeTimeout(opts)); err != nil {
+			return err
 		}
 
 		// Test wireguard connectivity
-		werr = usermodeTunTest(ctx, l, tnet, opts.TestURL)
-		if werr != nil {
-			continue
-		}
-		break
-	}
+		return usermodeTunTest(ctx, l, tnet, testURLs)
+	})
 	if werr != nil {
 		return werr
 	}
 
-	// Run a proxy on the userspace stack
-	warpBind, err := wiresocks.StartProxy(ctx, l, tnet, netip.MustParseAddrPort("127.0.0.1:0"))
+	// Run a proxy on the userspace stack. It only serves psiphon, so stats,
+	// request logs, the breaker and the admin API see psiphon's upstream
+	// connections
+	warpBind, err := wiresocks.StartProxy(ctx, l, tnet, netip.MustParseAddrPort("127.0.0.1:0"), nil, proxyOptions(ctx, l, opts, nil)...)
 	if err != nil {
 		return err
 	}
@@ -532,22 +745,31 @@ func runWarpWithMasque(ctx context.Context, l *slog.Logger, opts WarpOptions, en
 
 	// Convert endpoint to MASQUE endpoint (port 443)
 	// The endpoint may be from scanner (port 2408) or user-provided (any port)
-	var masqueEndpoint string
-	l.Info("using endpoint as MASQUE server", "endpoint", endpoint)
-	if host, _, err := net.SplitHostPort(endpoint); err == nil {
-		// Successfully split, use the host with port 443
-		masqueEndpoint = net.JoinHostPort(host, "443")
-		l.Debug("Converted endpoint to MASQUE endpoint", "from", endpoint, "to", masqueEndpoint)
+	masqueEndpoint := masqueEndpointFor(endpoint)
+	if masqueEndpoint == "" {
+		l.Info("no endpoint given, using the endpoints stored with the MASQUE device")
 	} else {
-		// No port specified, assume it's just a host, add port 443
-		masqueEndpoint = net.JoinHostPort(endpoint, "443")
-		l.Debug("Added MASQUE port to endpoint", "from", endpoint, "to", masqueEndpoint)
+		l.Info("using endpoint as MASQUE server", "endpoint", endpoint)
+		l.Debug("Converted endpoint to MASQUE endpoint", "from", endpoint, "to", masqueEndpoint)
 	}
 
 	// Create MASQUE adapter using usque library
-	masqueConfigPath := path.Join(opts.CacheDir, "masque_config.json")
+	masqueConfigPath, err := MasqueConfigPath(opts)
+	if err != nil {
+		return err
+	}
 	l.Debug("Creating MASQUE adapter", "masqueEndpoint", masqueEndpoint, "configPath", masqueConfigPath)
 
+	// Shared by the adapter factory so reconnects resume the TLS session
+	sessionCache := masque.NewSessionCache(sessionTicketsPath(opts, masqueConfigPath))
+	// Likewise shared so reconnects skip the endpoint lookup
+	var resolveCache *masque.ResolveCache
+	if opts.EndpointDNSTTL > 0 {
+		resolveCache = masque.NewResolveCache(opts.EndpointDNSTTL)
+	}
+	// And so reconnects don't wait for the Connect-IP assignments again
+	assignments := &masque.TunnelAssignments{}
+
 	// Configure noize obfuscation using unified configuration system
 	var noizeConfig *masquenoize.NoizeConfig
 
@@ -592,22 +814,53 @@ func runWarpWithMasque(ctx context.Context, l *slog.Logger, opts WarpOptions, en
 		}
 	}
 
+	// Pick the lightest preset that reliably connects on this network
+	if opts.AutoNoize {
+		_, preset, err := BenchmarkNoizePresets(ctx, l, opts, endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to select a noize preset: %w", err)
+		}
+		l.Info("using automatically selected MASQUE noize preset", "preset", preset)
+		noizeConfig = getMASQUEPresetConfig(preset, l)
+	}
+
+	// Fail fast when the endpoint does not answer QUIC at all, so MASQUE-preferred
+	// mode falls back to WireGuard in seconds instead of after every retry.
+	// Skipped with noize, since the plain probe bypasses the obfuscation.
+	if noizeConfig == nil {
+		probeEndpoint := masqueEndpoint
+		if probeEndpoint == "" {
+			// Probe the stored endpoint the adapter dials first
+			candidates, err := masque.EndpointCandidates(masqueAdapterConfig(l, opts, masqueConfigPath, ""))
+			if err != nil {
+				return err
+			}
+			probeEndpoint = candidates[0]
+		}
+		if err := checkMasqueReachable(ctx, l, opts, probeEndpoint); err != nil {
+			if opts.wireGuardFallback() && quicBlockError(ctx, err) {
+				newQUICBlockDetector(opts).RecordFailure(masque.NetworkSignature())
+			}
+			return err
+		}
+	}
+
+	adapterConfig := masqueAdapterConfig(l, opts, masqueConfigPath, masqueEndpoint)
+	adapterConfig.NoizeConfig = noizeConfig
+	adapterConfig.RandomFallback = opts.RandomFallback
+	adapterConfig.SessionCache = sessionCache
+	adapterConfig.ForwardWorkers = opts.ForwardWorkers
+	adapterConfig.ResolveCache = resolveCache
+	adapterConfig.Assignments = assignments
+
 	// Create MASQUE adapter with retry for Android connectivity issues
 	var adapter *masque.MasqueAdapter
-	var err error
 
 	// Try creating adapter with retries for Android initialization issues
 	for attempt := 1; attempt <= 3; attempt++ {
 		l.Debug("Creating MASQUE adapter", "attempt", attempt)
 
-		adapter, err = masque.NewMasqueAdapter(ctx, masque.AdapterConfig{
-			ConfigPath:  masqueConfigPath,
-			DeviceName:  "vwarp-masque",
-			Endpoint:    masqueEndpoint,
-			Logger:      l,
-			License:     opts.License,
-			NoizeConfig: noizeConfig,
-		})
+		adapter, err = masque.NewMasqueAdapter(ctx, adapterConfig)
 
 		if err == nil {
 			l.Info("MASQUE adapter created successfully", "attempt", attempt)
@@ -624,9 +877,15 @@ func runWarpWithMasque(ctx context.Context, l *slog.Logger, opts WarpOptions, en
 		}
 	}
 
+	quicDetector := newQUICBlockDetector(opts)
+	network := masque.NetworkSignature()
 	if err != nil {
+		if opts.wireGuardFallback() && quicBlockError(ctx, err) {
+			quicDetector.RecordFailure(network)
+		}
 		return fmt.Errorf("failed to establish MASQUE connection after retries: %w", err)
 	}
+	quicDetector.RecordSuccess(network)
 	defer adapter.Close()
 
 	l.Info("MASQUE tunnel established successfully")
@@ -636,20 +895,53 @@ func runWarpWithMasque(ctx context.Context, l *slog.Logger, opts WarpOptions, en
 	l.Info("MASQUE tunnel addresses", "ipv4", ipv4, "ipv6", ipv6)
 
 	// Create TUN device configuration for the MASQUE tunnel
-	tunAddresses := []netip.Addr{}
-	if ipv4 != "" {
-		if addr, err := netip.ParseAddr(ipv4); err == nil {
-			tunAddresses = append(tunAddresses, addr)
-		}
+	tunAddresses := masqueTunnelAddrs(l, adapter)
+	if len(tunAddresses) == 0 {
+		return errors.New("no valid tunnel addresses received from MASQUE")
 	}
-	if ipv6 != "" {
-		if addr, err := netip.ParseAddr(ipv6); err == nil {
-			tunAddresses = append(tunAddresses, addr)
-		}
+
+	history, err := openQualityHistory(l, opts.QualityHistory, opts.QualityInterval)
+	if err != nil {
+		return fmt.Errorf("failed to open quality history: %w", err)
 	}
 
-	if len(tunAddresses) == 0 {
-		return errors.New("no valid tunnel addresses received from MASQUE")
+	// Create adapter factory for reconnection
+	adapterFactory := func() (*masque.MasqueAdapter, error) {
+		l.Info("Recreating MASQUE adapter with fresh configuration")
+		return masque.NewMasqueAdapter(ctx, adapterConfig)
+	}
+
+	// Full VPN mode: attach the tunnel to an OS TUN device instead of netstack
+	if opts.Tun != "" {
+		var endpointAddr netip.Addr
+		if addrPort, err := netip.ParseAddrPort(adapter.Endpoint()); err == nil {
+			endpointAddr = addrPort.Addr().Unmap()
+		} else {
+			l.Warn("MASQUE endpoint is not an IP address, skipping endpoint bypass route", "endpoint", adapter.Endpoint())
+		}
+
+		sysTun, err := openSystemTun(ctx, l, opts.Tun, singleMTU, tunAddresses, adapter.AssignedRoutes(), endpointAddr)
+		if err != nil {
+			return err
+		}
+		defer sysTun.Close()
+
+		go maintainMasqueTunnel(ctx, l, adapter, masqueTunnelOptions{
+			factory:      adapterFactory,
+			device:       newKernelTunAdapter(sysTun.dev),
+			mtu:          singleMTU,
+			testURLs:     newTestURLs(opts),
+			probeTargets: opts.ProbeTargets,
+			queueDepth:   opts.WriteQueue,
+			stats:        newProxyStats(ctx, l, opts),
+			history:      history,
+		})
+
+		l.Info("serving MASQUE tunnel on TUN device", "name", opts.Tun)
+
+		// Keep running until context is cancelled
+		<-ctx.Done()
+		return nil
 	}
 
 	// Use multiple DNS servers for redundancy - primary and fallbacks
@@ -672,11 +964,16 @@ func runWarpWithMasque(ctx context.Context, l *slog.Logger, opts WarpOptions, en
 	l.Info("DNS servers configured", "primary", opts.DnsAddr, "fallback_count", len(dnsServers)-1)
 
 	// Create netstack TUN
-	tunDev, tnet, err := netstack.CreateNetTUN(tunAddresses, dnsServers, singleMTU)
+	tunDev, tnet, _, err := createNetstack(l, tunAddresses, dnsServers, singleMTU)
 	if err != nil {
 		return fmt.Errorf("failed to create netstack: %w", err)
 	}
 
+	if routes := adapter.AssignedRoutes(); len(routes) > 0 {
+		tnet.SetRoutes(routes)
+		l.Info("applied Connect-IP advertised routes to netstack", "routes", routes)
+	}
+
 	l.Info("netstack created on MASQUE tunnel")
 
 	// Create adapter for the netstack device
@@ -686,43 +983,238 @@ func runWarpWithMasque(ctx context.Context, l *slog.Logger, opts WarpOptions, en
 		tunnelSizesPool: &sync.Pool{New: func() interface{} { sizes := make([]int, 1); return &sizes }},
 	}
 
-	// Create adapter factory for reconnection
-	adapterFactory := func() (*masque.MasqueAdapter, error) {
-		l.Info("Recreating MASQUE adapter with fresh configuration")
-		return masque.NewMasqueAdapter(ctx, masque.AdapterConfig{
-			ConfigPath:  masqueConfigPath,
-			DeviceName:  "vwarp-masque",
-			Endpoint:    masqueEndpoint,
-			Logger:      l,
-			License:     opts.License,
-			NoizeConfig: noizeConfig,
-		})
+	// tnet is shared with the maintenance goroutine from here on
+	if err := enableDoH(l, tnet, opts.DoHURL); err != nil {
+		return err
 	}
 
+	stats := newProxyStats(ctx, l, opts)
+	testURLs := newTestURLs(opts)
+
 	// Start tunnel maintenance goroutine
-	go maintainMasqueTunnel(ctx, l, adapter, adapterFactory, tunAdapter, singleMTU, tnet, opts.TestURL)
+	go maintainMasqueTunnel(ctx, l, adapter, masqueTunnelOptions{
+		factory:      adapterFactory,
+		device:       tunAdapter,
+		mtu:          singleMTU,
+		tnet:         tnet,
+		testURLs:     testURLs,
+		probeTargets: opts.ProbeTargets,
+		queueDepth:   opts.WriteQueue,
+		stats:        stats,
+		history:      history,
+	})
 
 	// Test connectivity
-	if err := usermodeTunTest(ctx, l, tnet, opts.TestURL); err != nil {
+	if err := usermodeTunTest(ctx, l, tnet, testURLs); err == nil {
+		l.Info("MASQUE connectivity test passed")
+	} else if opts.FailClosed {
+		l.Warn("connectivity test failed, not serving the proxy until the tunnel is up", "error", err)
+		if err := awaitConnectivity(ctx, l, tnet, testURLs); err != nil {
+			return err
+		}
+	} else {
 		l.Warn("connectivity test failed", "error", err)
 		// Don't fail completely, just warn
-	} else {
-		l.Info("MASQUE connectivity test passed")
 	}
 
 	// Start SOCKS proxy on the netstack
-	actualBind, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind)
+	actualBind, err := wiresocks.StartProxy(ctx, l, tnet, opts.Bind, opts.ACL, proxyOptions(ctx, l, opts, stats)...)
 	if err != nil {
 		return fmt.Errorf("failed to start proxy: %w", err)
 	}
 
 	l.Info("serving proxy via MASQUE tunnel", "address", actualBind)
 
+	if err := startLocalDNS(ctx, l, tnet, opts); err != nil {
+		return err
+	}
+
+	if opts.Transparent.IsValid() {
+		transparentBind, err := wiresocks.StartTransparentProxy(ctx, l, tnet, opts.Transparent, opts.ACL, proxyOptions(ctx, l, opts, stats)...)
+		if err != nil {
+			return fmt.Errorf("failed to start transparent proxy: %w", err)
+		}
+		l.Info("serving transparent proxy via MASQUE tunnel", "address", transparentBind)
+	}
+
 	// Keep running until context is cancelled
 	<-ctx.Done()
 	return nil
 }
 
+// masqueTunnelAddrs returns the addresses of the MASQUE tunnel: the ones the
+// server assigned during the Connect-IP handshake, or else the ones in the config
+func masqueTunnelAddrs(l *slog.Logger, adapter *masque.MasqueAdapter) []netip.Addr {
+	var addrs []netip.Addr
+	if v4, v6, ok := adapter.LocalTunnelAddrs(); ok {
+		l.Info("using Connect-IP assigned tunnel addresses", "ipv4", v4, "ipv6", v6)
+		for _, addr := range []netip.Addr{v4, v6} {
+			if addr.IsValid() {
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs
+	}
+
+	ipv4, ipv6 := adapter.GetLocalAddresses()
+	for _, s := range []string{ipv4, ipv6} {
+		if s == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			l.Warn("dropping malformed MASQUE tunnel address", "address", s, "error", err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// awaitConnectivity repeats the connectivity test until it passes, while the
+// tunnel maintenance loop reconnects in the background, or ctx ends
+func awaitConnectivity(ctx context.Context, l *slog.Logger, tnet *netstack.Net, urls *testURLs) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("tunnel never passed the connectivity test: %w", ctx.Err())
+		case <-time.After(failClosedRetryInterval):
+		}
+		if err := usermodeTunTest(ctx, l, tnet, urls); err != nil {
+			l.Debug("connectivity test still failing", "error", err)
+			continue
+		}
+		l.Info("MASQUE connectivity test passed, serving the proxy")
+		return nil
+	}
+}
+
+// createNetstack creates a netstack TUN with addrs. An address the stack
+// rejects is logged and dropped and the stack is created again with the rest,
+// so one bad address doesn't take down an otherwise working tunnel. It returns
+// the addresses the stack was created with.
+func createNetstack(l *slog.Logger, addrs, dnsServers []netip.Addr, mtu int) (tun.Device, *netstack.Net, []netip.Addr, error) {
+	addrs = slices.Clone(addrs)
+	for {
+		tunDev, tnet, err := netstack.CreateNetTUN(addrs, dnsServers, mtu)
+		if err == nil {
+			return tunDev, tnet, addrs, nil
+		}
+
+		var addrErr *netstack.AddressError
+		if !errors.As(err, &addrErr) {
+			return nil, nil, nil, err
+		}
+		i := slices.Index(addrs, addrErr.Addr)
+		if i < 0 || len(addrs) == 1 {
+			return nil, nil, nil, err
+		}
+		l.Warn("dropping tunnel address rejected by netstack", "address", addrErr.Addr, "error", addrErr.Err)
+		addrs = slices.Delete(addrs, i, i+1)
+	}
+}
+
+// newProxyStats returns the counters shared by the proxies of a run and logs
+// them every opts.StatsInterval, at shutdown and on SIGUSR1
+func newProxyStats(ctx context.Context, l *slog.Logger, opts WarpOptions) *wiresocks.Stats {
+	stats := &wiresocks.Stats{}
+	go stats.Report(ctx, l, opts.StatsInterval)
+	go stats.DumpOnSignal(ctx, l)
+	return stats
+}
+
+// proxyOptions returns the options of the user-facing proxies of a run. A nil
+// stats starts new counters.
+func proxyOptions(ctx context.Context, l *slog.Logger, opts WarpOptions, stats *wiresocks.Stats) []wiresocks.ProxyOption {
+	if stats == nil {
+		stats = newProxyStats(ctx, l, opts)
+	}
+	return []wiresocks.ProxyOption{
+		wiresocks.WithRelayKeepAlive(opts.RelayKeepAlive),
+		wiresocks.WithStats(stats),
+		wiresocks.WithRequestLog(opts.RequestLog),
+		wiresocks.WithDialBreaker(opts.DialBreaker, opts.DialCooldown),
+		wiresocks.WithTunnelBreaker(opts.TunnelBreaker, opts.TunnelCooldown),
+		wiresocks.WithTLS(opts.ProxyTLS),
+		wiresocks.WithConnTable(opts.proxyConns),
+	}
+}
+
+// startProxyAdmin serves the admin API on opts.ProxyAdmin when it is set and
+// returns the table the proxies are to track their connections in
+func startProxyAdmin(ctx context.Context, l *slog.Logger, opts WarpOptions) (*wiresocks.ConnTable, error) {
+	if !opts.ProxyAdmin.IsValid() {
+		return nil, nil
+	}
+	conns := &wiresocks.ConnTable{}
+	addr, err := wiresocks.StartAdminServer(ctx, l, opts.ProxyAdmin, conns, opts.ProxyAdminToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start admin API: %w", err)
+	}
+	l.Info("serving the proxy admin API", "address", addr)
+	return conns, nil
+}
+
+// startLocalDNS serves DNS resolved through tnet on opts.DNSListen when it is set
+func startLocalDNS(ctx context.Context, l *slog.Logger, tnet *netstack.Net, opts WarpOptions) error {
+	if !opts.DNSListen.IsValid() {
+		return nil
+	}
+	addr, err := wiresocks.StartDNSServer(ctx, l, tnet, opts.DNSListen)
+	if err != nil {
+		return fmt.Errorf("failed to start DNS server: %w", err)
+	}
+	l.Info("serving DNS through the tunnel", "address", addr)
+	return nil
+}
+
+// MasqueConfigPath returns the MASQUE device config of opts.Profile, or the
+// default config in opts.CacheDir without a profile
+func MasqueConfigPath(opts WarpOptions) (string, error) {
+	if opts.Profile == "" {
+		return path.Join(opts.CacheDir, masque.ConfigFileName), nil
+	}
+	return masque.ProfileConfigPath(opts.CacheDir, opts.Profile)
+}
+
+// identityPath returns the directory of the WireGuard identity name (primary
+// or secondary) of opts.Profile, next to its MASQUE config, or in
+// opts.CacheDir without a profile
+func identityPath(opts WarpOptions, name string) string {
+	if opts.Profile == "" {
+		return path.Join(opts.CacheDir, name)
+	}
+	return path.Join(opts.CacheDir, masque.ProfilesDir, opts.Profile, name)
+}
+
+// sessionTicketsPath returns the file MASQUE session tickets are persisted to,
+// next to the device config so profiles never share them, or empty if
+// WarpOptions.SessionTickets is not set
+func sessionTicketsPath(opts WarpOptions, masqueConfigPath string) string {
+	if !opts.SessionTickets {
+		return ""
+	}
+	return path.Join(path.Dir(masqueConfigPath), "session_tickets.json")
+}
+
+// newQUICBlockDetector returns the QUIC block detector persisted in the cache directory
+func newQUICBlockDetector(opts WarpOptions) *masque.QUICBlockDetector {
+	if opts.CacheDir == "" {
+		return masque.NewQUICBlockDetector("")
+	}
+	return masque.NewQUICBlockDetector(path.Join(opts.CacheDir, "quic_block.json"))
+}
+
+// ResetQUICBlockState forgets every network previously detected as blocking QUIC
+func ResetQUICBlockState(opts WarpOptions) {
+	newQUICBlockDetector(opts).Reset()
+}
+
+// QUICBlocked reports whether the current network is remembered as blocking QUIC
+func QUICBlocked(opts WarpOptions) bool {
+	return newQUICBlockDetector(opts).Blocked(masque.NetworkSignature())
+}
+
 func generateWireguardConfig(i *warp.Identity) wiresocks.Configuration {
 	priv, _ := wiresocks.EncodeBase64ToHex(i.PrivateKey)
 	pub, _ := wiresocks.EncodeBase64ToHex(i.Config.Peers[0].PublicKey)
@@ -747,3 +1239,38 @@ func generateWireguardConfig(i *warp.Identity) wiresocks.Configuration {
 		}},
 	}
 }
+
+// masqueAdapterConfig returns the configuration of a MASQUE tunnel to
+// endpoint with the connection settings of opts and no noize, shared by the
+// tunnel and the preset benchmarks so both dial the same way
+func masqueAdapterConfig(l *slog.Logger, opts WarpOptions, configPath, endpoint string) masque.AdapterConfig {
+	return masque.AdapterConfig{
+		ConfigPath: configPath,
+		DeviceName: "vwarp-masque",
+		Endpoint:   endpoint,
+		Logger:     l,
+		License:    opts.License,
+		AcceptTOS:  opts.tosAccepted(),
+		RequireTOS: opts.RequireTOS,
+
+		EgressInterface:  opts.EgressIface,
+		SourcePortRange:  opts.SourcePortRange,
+		StableSourcePort: opts.StableSourcePort,
+		FixedLocalPort:   opts.SourcePort,
+		ALPN:             opts.MasqueALPN,
+		MTU:              singleMTU,
+		KeepAlivePeriod:  opts.QUICKeepAlive,
+		ReceiveWindows:   opts.QUICReceiveWindows,
+
+		CertValidity: opts.CertValidity,
+		CertSubject:  pkix.Name{CommonName: opts.CertName},
+		CertDNSNames: opts.CertSANs,
+
+		ConnectURI:          opts.ConnectURI,
+		EndpointConnectURIs: opts.ConnectURIs,
+		ConnectIPProtocol:   opts.ConnectProtocol,
+
+		InitialPacketSize: opts.InitialPacketSize,
+		InitialPadPattern: opts.InitialPadPattern,
+	}
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+)
+
+func TestCreateNetstackDropsBadAddress(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	valid := netip.MustParseAddr("172.16.0.2")
+	dns := []netip.Addr{netip.MustParseAddr("1.1.1.1")}
+
+	tunDev, tnet, addrs, err := createNetstack(l, []netip.Addr{{}, valid}, dns, singleMTU)
+	if err != nil {
+		t.Fatalf("createNetstack: %v", err)
+	}
+	defer tunDev.Close()
+	if tnet == nil {
+		t.Fatal("createNetstack returned a nil netstack")
+	}
+	if !slices.Equal(addrs, []netip.Addr{valid}) {
+		t.Fatalf("netstack created with %v, want [%v]", addrs, valid)
+	}
+}
+
+func TestCreateNetstackNeedsOneAddress(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	_, _, _, err := createNetstack(l, []netip.Addr{{}}, nil, singleMTU)
+	var addrErr *netstack.AddressError
+	if !errors.As(err, &addrErr) {
+		t.Fatalf("err = %v, want an AddressError when no address is valid", err)
+	}
+}
+
+func TestRunWarpRequireMasqueDoesNotFallBack(t *testing.T) {
+	for _, blocked := range []bool{false, true} {
+		opts := WarpOptions{
+			// Nothing answers QUIC on the loopback MASQUE port
+			Endpoint:        "127.0.0.1:443",
+			MasquePreferred: true,
+			RequireMasque:   true,
+			CacheDir:        t.TempDir(),
+		}
+		if blocked {
+			// A network remembered as blocking QUIC normally goes straight to WireGuard
+			detector := newQUICBlockDetector(opts)
+			for i := 0; i < 10 && !detector.Blocked(masque.NetworkSignature()); i++ {
+				detector.RecordFailure(masque.NetworkSignature())
+			}
+		}
+
+		var logs bytes.Buffer
+		l := slog.New(slog.NewTextHandler(&logs, nil))
+		start := time.Now()
+		err := RunWarp(t.Context(), l, opts)
+		if !errors.Is(err, ErrMasqueRequired) {
+			t.Fatalf("blocked=%v: RunWarp error = %v, want %v", blocked, err, ErrMasqueRequired)
+		}
+		if strings.Contains(logs.String(), "WireGuard") {
+			t.Fatalf("blocked=%v: RunWarp fell back to WireGuard:\n%s", blocked, logs.String())
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Fatalf("blocked=%v: failing MASQUE setup took %s", blocked, elapsed)
+		}
+		// Without a fallback there is nothing for the block detector to skip to
+		if _, err := os.Stat(filepath.Join(opts.CacheDir, "quic_block.json")); !blocked && err == nil {
+			t.Fatal("MASQUE-only failure recorded in the QUIC block detector")
+		}
+	}
+}
+
+func TestRunWarpTunDoesNotFallBack(t *testing.T) {
+	opts := WarpOptions{
+		// Nothing answers QUIC on the loopback MASQUE port, so the TUN device is never opened
+		Endpoint:        "127.0.0.1:443",
+		MasquePreferred: true,
+		Tun:             "vwarp-test0",
+		CacheDir:        t.TempDir(),
+	}
+	var logs bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&logs, nil))
+	err := RunWarp(t.Context(), l, opts)
+	if !errors.Is(err, ErrTunRequiresMasque) {
+		t.Fatalf("RunWarp error = %v, want %v", err, ErrTunRequiresMasque)
+	}
+	if strings.Contains(logs.String(), "falling back to WireGuard") {
+		t.Fatalf("RunWarp fell back to WireGuard in TUN mode:\n%s", logs.String())
+	}
+	if _, err := os.Stat(filepath.Join(opts.CacheDir, "quic_block.json")); err == nil {
+		t.Fatal("TUN mode failure recorded in the QUIC block detector")
+	}
+}
+
+func TestProfileScopesIdentities(t *testing.T) {
+	dir := t.TempDir()
+	configPath, err := MasqueConfigPath(WarpOptions{CacheDir: dir, Profile: "work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := identityPath(WarpOptions{CacheDir: dir, Profile: "work"}, "primary"), filepath.Join(filepath.Dir(configPath), "primary"); got != want {
+		t.Errorf("profile identity = %s, want %s next to its MASQUE config", got, want)
+	}
+	if got, want := identityPath(WarpOptions{CacheDir: dir}, "primary"), filepath.Join(dir, "primary"); got != want {
+		t.Errorf("default identity = %s, want %s", got, want)
+	}
+}
+
+func TestValidateWarpOptionsRejectsPsiphonACL(t *testing.T) {
+	rules, err := acl.New(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	psiphon := &PsiphonOptions{Country: "US"}
+	if err := validateWarpOptions(WarpOptions{Psiphon: psiphon}); err != nil {
+		t.Fatalf("psiphon without an ACL: %v", err)
+	}
+	if err := validateWarpOptions(WarpOptions{Psiphon: psiphon, ACL: rules}); err == nil {
+		t.Fatal("psiphon with an ACL was accepted")
+	}
+}
+
+func TestValidateWarpOptionsRejectsPsiphonTLS(t *testing.T) {
+	opts := WarpOptions{Psiphon: &PsiphonOptions{Country: "US"}, ProxyTLS: &tls.Config{}}
+	if err := validateWarpOptions(opts); err == nil {
+		t.Fatal("psiphon with a TLS proxy was accepted")
+	}
+}
+
+func TestMasqueRotatesWithoutEndpoint(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	opts := WarpOptions{EndpointV6: true}
+	endpoints, err := resolveEndpoints(t.Context(), l, opts)
+	if err != nil {
+		t.Fatalf("resolveEndpoints: %v", err)
+	}
+	// WireGuard gets a random endpoint of the requested family
+	if addrPort, err := netip.ParseAddrPort(endpoints[0]); err != nil || !addrPort.Addr().Is6() {
+		t.Fatalf("WireGuard endpoint = %q, want a random IPv6 endpoint", endpoints[0])
+	}
+	// MASQUE gets none, so the adapter rotates through its stored endpoints
+	if got := opts.masqueEndpoint(endpoints); got != "" {
+		t.Errorf("MASQUE endpoint = %q, want it left empty", got)
+	}
+
+	opts.Endpoint = "162.159.198.1:443"
+	if got := opts.masqueEndpoint([]string{opts.Endpoint}); got != opts.Endpoint {
+		t.Errorf("MASQUE endpoint = %q, want the given %s", got, opts.Endpoint)
+	}
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// clockCheckURL answers with a Date header. It is plain HTTP so the check
+	// works when the skew already breaks TLS.
+	clockCheckURL = "http://cp.cloudflare.com/generate_204"
+	// maxClockSkew is how far the local clock may be off before it is warned about
+	maxClockSkew = 5 * time.Minute
+	// clockCheckTimeout bounds the request to clockCheckURL
+	clockCheckTimeout = 5 * time.Second
+)
+
+// clockNow is the local clock checked by warnClockSkew, replaced in tests
+var clockNow = time.Now
+
+// clockSkew returns how far the local clock is ahead of the Date header url
+// answers with, negative if it is behind
+func clockSkew(ctx context.Context, client *http.Client, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := clockNow()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	end := clockNow()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no usable Date header from %s: %w", url, err)
+	}
+	// The server stamped the Date somewhere during the round trip; its one
+	// second resolution dwarfs the error of taking the midpoint
+	return start.Add(end.Sub(start) / 2).Sub(date), nil
+}
+
+// warnClockSkew warns when the local clock is off by more than maxClockSkew
+// from the Date of url. A badly set clock, common on embedded devices without
+// an RTC, makes TLS handshakes and registration fail in ways that don't point
+// at the clock. Failing to reach url is only logged at debug level.
+func warnClockSkew(ctx context.Context, l *slog.Logger, url string) {
+	ctx, cancel := context.WithTimeout(ctx, clockCheckTimeout)
+	defer cancel()
+	skew, err := clockSkew(ctx, http.DefaultClient, url)
+	if err != nil {
+		l.Debug("clock skew check failed", "error", err)
+		return
+	}
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		l.Warn("local clock appears to be off, which commonly breaks TLS and registration; sync the system time",
+			"skew", skew.Round(time.Second), "reference", url)
+	}
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarnClockSkew(t *testing.T) {
+	serverTime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", serverTime.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	defer func(now func() time.Time) { clockNow = now }(clockNow)
+
+	for _, tc := range []struct {
+		offset time.Duration
+		warn   bool
+	}{
+		{offset: 2 * time.Second},
+		{offset: -3 * time.Minute},
+		{offset: 2 * time.Hour, warn: true},
+		{offset: -400 * 24 * time.Hour, warn: true},
+	} {
+		clockNow = func() time.Time { return serverTime.Add(tc.offset) }
+		var logs strings.Builder
+		warnClockSkew(context.Background(), slog.New(slog.NewTextHandler(&logs, nil)), srv.URL)
+
+		warned := strings.Contains(logs.String(), "level=WARN")
+		if warned != tc.warn {
+			t.Errorf("clock off by %s: warned = %v, want %v\n%s", tc.offset, warned, tc.warn, logs.String())
+		}
+		if tc.warn && !strings.Contains(logs.String(), "skew="+tc.offset.String()) {
+			t.Errorf("warning doesn't report the %s skew:\n%s", tc.offset, logs.String())
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/ipscanner/ping"
+	"github.com/voidr3aper-anon/Vwarp/ipscanner/statute"
+	"github.com/voidr3aper-anon/Vwarp/iputils"
+	"github.com/voidr3aper-anon/Vwarp/masque"
+	"github.com/voidr3aper-anon/Vwarp/warp"
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+// dryRunHandshakeTimeout bounds the WireGuard handshake sent to check an endpoint
+const dryRunHandshakeTimeout = 5 * time.Second
+
+// DryRunResult summarizes what DryRun checked
+type DryRunResult struct {
+	Mode     string        // Tunnel a run would bring up: wireguard-config, masque, warp, gool or psiphon
+	Endpoint string        // Endpoint that answered the reachability check
+	RTT      time.Duration // Round trip of the reachability check, zero if it was skipped
+}
+
+// DryRun does what RunWarp does up to the tunnel: it validates opts, loads
+// or registers the device identities the run would use and checks the
+// endpoint answers, then returns without bringing up a tunnel or serving a
+// proxy. MASQUE-preferred mode falls back to checking WireGuard like a run.
+func DryRun(ctx context.Context, l *slog.Logger, opts WarpOptions) (DryRunResult, error) {
+	if opts.WireguardConfig != "" {
+		return dryRunWireguardConfig(opts)
+	}
+
+	if err := validateWarpOptions(opts); err != nil {
+		return DryRunResult{}, err
+	}
+
+	endpoints, err := resolveEndpoints(ctx, l, opts)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+	if len(endpoints) == 0 {
+		return DryRunResult{}, errors.New("no endpoint to check")
+	}
+	endpoint := endpoints[0]
+
+	switch {
+	case opts.Masque:
+		res, err := dryRunMasque(ctx, l, opts, endpoint)
+		if err != nil && opts.RequireMasque {
+			err = fmt.Errorf("%w: %w", ErrMasqueRequired, err)
+		}
+		return res, err
+	case opts.MasquePreferred:
+		res, err := dryRunMasque(ctx, l, opts, endpoint)
+		if err != nil && opts.RequireMasque {
+			return res, fmt.Errorf("%w: %w", ErrMasqueRequired, err)
+		} else if err != nil {
+			l.Warn("MASQUE check failed, checking the WireGuard fallback", "error", err)
+			return dryRunWarp(ctx, l, opts, "warp", endpoint, "primary")
+		}
+		return res, nil
+	case opts.Psiphon != nil:
+		return dryRunWarp(ctx, l, opts, "psiphon", endpoint, "primary")
+	case opts.Gool:
+		return dryRunWarp(ctx, l, opts, "gool", endpoint, "primary", "secondary")
+	default:
+		return dryRunWarp(ctx, l, opts, "warp", endpoint, "primary")
+	}
+}
+
+// dryRunWireguardConfig validates a WireGuard config file and resolves its endpoint
+func dryRunWireguardConfig(opts WarpOptions) (DryRunResult, error) {
+	res := DryRunResult{Mode: "wireguard-config"}
+	conf, err := wiresocks.ParseConfig(opts.WireguardConfig)
+	if err != nil {
+		return res, err
+	}
+	if len(conf.Peers) == 0 {
+		return res, errors.New("WireGuard config has no peers")
+	}
+	addr, err := iputils.ParseResolveAddressPort(conf.Peers[0].Endpoint, false, opts.DnsAddr.String())
+	if err != nil {
+		return res, fmt.Errorf("invalid peer endpoint: %w", err)
+	}
+	res.Endpoint = addr.String()
+	return res, nil
+}
+
+// dryRunMasque loads or registers the MASQUE device and probes the endpoint over QUIC
+func dryRunMasque(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) (DryRunResult, error) {
+	res := DryRunResult{Mode: "masque", Endpoint: masqueEndpointFor(endpoint)}
+
+	configPath, err := MasqueConfigPath(opts)
+	if err != nil {
+		return res, err
+	}
+	if err := masque.LoadOrRegister(masque.AdapterConfig{
+		ConfigPath: configPath,
+		DeviceName: "vwarp-masque",
+		Logger:     l,
+		License:    opts.License,
+		AcceptTOS:  opts.tosAccepted(),
+		RequireTOS: opts.RequireTOS,
+	}); err != nil {
+		return res, err
+	}
+
+	// The probe is the point of a dry run, so it ignores SkipReachability
+	opts.SkipReachability = false
+	start := time.Now()
+	if err := checkMasqueReachable(ctx, l, opts, res.Endpoint); err != nil {
+		return res, err
+	}
+	res.RTT = time.Since(start)
+	return res, nil
+}
+
+// dryRunWarp loads or registers the WARP identities in the cache directory
+// and sends a WireGuard handshake to endpoint with the first
+func dryRunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, mode, endpoint string, identities ...string) (DryRunResult, error) {
+	res := DryRunResult{Mode: mode, Endpoint: endpoint}
+
+	var primary *warp.Identity
+	for _, name := range identities {
+		ident, err := warp.LoadOrCreateIdentity(l, identityPath(opts, name), opts.License, opts.tosAccepted())
+		if err != nil {
+			return res, fmt.Errorf("couldn't load %s warp identity: %w", name, err)
+		}
+		if primary == nil {
+			primary = ident
+		}
+	}
+
+	addr, err := iputils.ParseResolveAddressPort(endpoint, false, opts.DnsAddr.String())
+	if err != nil {
+		return res, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	res.Endpoint = addr.String()
+
+	ctx, cancel := context.WithTimeout(ctx, dryRunHandshakeTimeout)
+	defer cancel()
+	pinger := ping.NewWarpPing(addr.Addr(), &statute.ScannerOptions{
+		WarpPrivateKey:    primary.PrivateKey,
+		WarpPeerPublicKey: primary.Config.Peers[0].PublicKey,
+		Port:              addr.Port(),
+	})
+	result := pinger.PingContext(ctx)
+	if err := result.Error(); err != nil {
+		return res, fmt.Errorf("WireGuard endpoint %s did not answer the handshake: %w", addr, err)
+	}
+	res.RTT = result.Result().RTT
+	return res, nil
+}
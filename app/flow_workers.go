@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+// IP protocol numbers whose first 4 payload bytes are the source and destination ports
+const (
+	ipProtoTCP  = 6
+	ipProtoUDP  = 17
+	ipProtoSCTP = 132
+)
+
+// flowHash hashes the addresses, protocol and ports of an IP packet, so all
+// packets of a flow hash alike. Ports are left out of fragments after the
+// first, which carry none; a packet too short to parse hashes to 0.
+func flowHash(pkt []byte) uint32 {
+	if len(pkt) < 1 {
+		return 0
+	}
+
+	var addrs, transport []byte
+	var proto byte
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || ihl < 20 || len(pkt) < ihl {
+			return 0
+		}
+		addrs, proto = pkt[12:20], pkt[9]
+		// Only the first fragment (offset 0) has the transport header
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 {
+			transport = pkt[ihl:]
+		}
+	case 6:
+		if len(pkt) < 40 {
+			return 0
+		}
+		// Extension headers are not walked, so their flows hash by address only
+		addrs, proto, transport = pkt[8:40], pkt[6], pkt[40:]
+	default:
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write(addrs)
+	h.Write([]byte{proto})
+	if (proto == ipProtoTCP || proto == ipProtoUDP || proto == ipProtoSCTP) && len(transport) >= 4 {
+		h.Write(transport[:4])
+	}
+	return h.Sum32()
+}
+
+// flowShard returns which of n workers forwards pkt
+func flowShard(pkt []byte, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return int(flowHash(pkt) % uint32(n))
+}
+
+// flowWorkers fans packets out to a fixed set of goroutines by flow hash.
+// Each worker has its own queue and forwards in queue order, so packets of
+// a flow are forwarded in the order they were pushed while different flows
+// are forwarded in parallel.
+type flowWorkers struct {
+	queues []*packetQueue
+}
+
+// startFlowWorkers starts n workers (at least 1) that run until ctx is done.
+// Every worker calls newForward once for the function it forwards its
+// packets with, so per-worker state such as error counts needs no locking.
+func startFlowWorkers(ctx context.Context, n, depth, mtu int, stats *wiresocks.Stats, newForward func() func(pkt []byte)) *flowWorkers {
+	w := &flowWorkers{queues: make([]*packetQueue, max(n, 1))}
+	for i := range w.queues {
+		queue := newPacketQueue(depth, mtu, writeQueueBlock, stats)
+		w.queues[i] = queue
+		forward := newForward()
+		go func() {
+			for {
+				pkt, ok := queue.pop(ctx)
+				if !ok {
+					return
+				}
+				forward(pkt)
+				queue.release(pkt)
+			}
+		}()
+	}
+	return w
+}
+
+// push queues a copy of pkt for the worker of its flow and reports whether it was queued
+func (w *flowWorkers) push(ctx context.Context, pkt []byte) bool {
+	return w.queues[flowShard(pkt, len(w.queues))].push(ctx, pkt)
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+// flowPackets builds perFlow TCP packets for each of flows flows, interleaved
+// round-robin, with the sequence number counting up within each flow
+func flowPackets(flows, perFlow, size int) [][]byte {
+	server := netip.MustParseAddrPort("93.184.216.34:443")
+	var pkts [][]byte
+	for seq := 0; seq < perFlow; seq++ {
+		for f := 0; f < flows; f++ {
+			client := netip.AddrPortFrom(netip.MustParseAddr("172.16.0.2"), uint16(40000+f))
+			pkts = append(pkts, tcpPacket(client, server, uint32(seq), 0, tcpACK, size))
+		}
+	}
+	return pkts
+}
+
+func TestFlowHash(t *testing.T) {
+	server := netip.MustParseAddrPort("93.184.216.34:443")
+	a := tcpPacket(netip.MustParseAddrPort("172.16.0.2:40000"), server, 1, 0, tcpACK, 100)
+	b := tcpPacket(netip.MustParseAddrPort("172.16.0.2:40001"), server, 1, 0, tcpACK, 100)
+	a2 := tcpPacket(netip.MustParseAddrPort("172.16.0.2:40000"), server, 99, 5, tcpACK, 1200)
+
+	if flowHash(a) != flowHash(a2) {
+		t.Error("packets of one flow hash differently")
+	}
+	if flowHash(a) == flowHash(b) {
+		t.Error("flows differing only in source port hash alike")
+	}
+	if got := flowHash([]byte{0x45, 0, 0}); got != 0 {
+		t.Errorf("truncated packet hashes to %d, want 0", got)
+	}
+}
+
+func TestFlowWorkersPreserveFlowOrder(t *testing.T) {
+	const flows, perFlow = 16, 200
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	seen := make(map[uint16][]uint32)
+	var wg sync.WaitGroup
+	wg.Add(flows * perFlow)
+	workers := startFlowWorkers(ctx, 4, 64, 1280, &wiresocks.Stats{}, func() func(pkt []byte) {
+		return func(pkt []byte) {
+			defer wg.Done()
+			port := binary.BigEndian.Uint16(pkt[20:22])
+			seq := binary.BigEndian.Uint32(pkt[24:28])
+			// Uneven forwarding times so workers overtake each other
+			if seq%7 == 0 {
+				time.Sleep(time.Microsecond * time.Duration(port%5))
+			}
+			mu.Lock()
+			seen[port] = append(seen[port], seq)
+			mu.Unlock()
+		}
+	})
+
+	for _, pkt := range flowPackets(flows, perFlow, 100) {
+		if !workers.push(ctx, pkt) {
+			t.Fatal("packet dropped")
+		}
+	}
+	wg.Wait()
+
+	if len(seen) != flows {
+		t.Fatalf("forwarded %d flows, want %d", len(seen), flows)
+	}
+	for port, seqs := range seen {
+		if len(seqs) != perFlow {
+			t.Fatalf("flow %d: forwarded %d packets, want %d", port, len(seqs), perFlow)
+		}
+		for i, seq := range seqs {
+			if seq != uint32(i) {
+				t.Fatalf("flow %d: packet %d has sequence %d, flow reordered", port, i, seq)
+			}
+		}
+	}
+}
+
+// BenchmarkFlowWorkers compares forwarding with one worker against several
+// when each write costs CPU, as encrypting a QUIC datagram does
+func BenchmarkFlowWorkers(b *testing.B) {
+	pkts := flowPackets(64, 16, 1280)
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var wg sync.WaitGroup
+			workers := startFlowWorkers(ctx, n, DefaultWriteQueueDepth, 1280, &wiresocks.Stats{}, func() func(pkt []byte) {
+				return func(pkt []byte) {
+					sha256.Sum256(pkt)
+					wg.Done()
+				}
+			})
+
+			b.SetBytes(1280)
+			b.ResetTimer()
+			wg.Add(b.N)
+			for i := 0; i < b.N; i++ {
+				if !workers.push(ctx, pkts[i%len(pkts)]) {
+					wg.Done()
+				}
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/netip"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/iputils"
+	"github.com/voidr3aper-anon/Vwarp/masque"
+	"github.com/voidr3aper-anon/Vwarp/preflight"
+)
+
+// masqueProbeTimeout bounds each QUIC reachability probe run before the
+// (much slower) MASQUE adapter creation
+const masqueProbeTimeout = time.Second
+
+// masqueProbeAttempts probes are sent before an endpoint counts as
+// unreachable, so a single lost datagram doesn't, waiting masqueProbeBackoff
+// after the first and twice as long after each further one
+const (
+	masqueProbeAttempts = 3
+	masqueProbeBackoff  = 250 * time.Millisecond
+)
+
+// probeMasqueEndpoint fails when endpoint does not answer a QUIC probe sent
+// from source (see preflight.ProbeQUICFrom) at all. A reply that is not
+// Version Negotiation is left for the real handshake to judge.
+func probeMasqueEndpoint(ctx context.Context, source netip.AddrPort, endpoint string, timeout time.Duration) error {
+	_, err := preflight.ProbeQUICFrom(ctx, source, endpoint, timeout)
+	if err == nil || errors.Is(err, preflight.ErrUnexpectedQUICResponse) {
+		return nil
+	}
+	return fmt.Errorf("MASQUE endpoint %s is unreachable over UDP: %w", endpoint, err)
+}
+
+// checkMasqueReachable probes endpoint before the MASQUE dial unless
+// opts.SkipReachability is set, in which case the dial itself reports it.
+// The probes leave through opts.EgressIface and from the fixed source port or
+// source port range like the tunnel would, so a firewall allowing only those
+// sees the same traffic.
+func checkMasqueReachable(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
+	if opts.SkipReachability {
+		l.Debug("skipping MASQUE reachability check", "endpoint", endpoint)
+		return nil
+	}
+	var source netip.Addr
+	if opts.EgressIface != "" {
+		addrPort, err := netip.ParseAddrPort(endpoint)
+		v6 := err == nil && addrPort.Addr().Unmap().Is6()
+		if source, err = iputils.InterfaceAddr(opts.EgressIface, v6); err != nil {
+			return fmt.Errorf("failed to bind egress interface: %w", err)
+		}
+	}
+
+	backoff := masqueProbeBackoff
+	var err error
+	for attempt := 1; attempt <= masqueProbeAttempts; attempt++ {
+		if err = probeMasqueEndpoint(ctx, netip.AddrPortFrom(source, masqueProbePort(opts)), endpoint, masqueProbeTimeout); err == nil {
+			return nil
+		}
+		if attempt == masqueProbeAttempts {
+			break
+		}
+		l.Debug("MASQUE reachability probe failed, retrying", "endpoint", endpoint, "attempt", attempt, "delay", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// masqueProbePort returns the local port to probe from: the fixed source
+// port, a random one of the source port range, or 0 for any
+func masqueProbePort(opts WarpOptions) uint16 {
+	low, high := opts.SourcePortRange[0], opts.SourcePortRange[1]
+	switch {
+	case opts.SourcePort != 0:
+		return uint16(opts.SourcePort)
+	case low > 0 && high >= low:
+		return uint16(low + rand.Intn(high-low+1))
+	}
+	return 0
+}
+
+// quicBlockError reports whether err, from the reachability probe or the
+// MASQUE dial, counts towards blocking QUIC on the network: the endpoint not
+// answering the probe or the QUIC handshake failing or timing out. Nothing
+// counts once ctx is done, since the attempt was cut short.
+func quicBlockError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return errors.Is(err, preflight.ErrNoQUICResponse) || masque.IsQUICBlockError(err)
+}
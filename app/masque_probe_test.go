@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+	"github.com/voidr3aper-anon/Vwarp/preflight"
+)
+
+func TestProbeMasqueEndpointUnreachableReturnsQuickly(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	err = probeMasqueEndpoint(t.Context(), netip.AddrPort{}, silent.LocalAddr().String(), masqueProbeTimeout)
+	if !errors.Is(err, preflight.ErrNoQUICResponse) {
+		t.Fatalf("probeMasqueEndpoint error = %v, want %v", err, preflight.ErrNoQUICResponse)
+	}
+	if elapsed := time.Since(start); elapsed > 2*masqueProbeTimeout {
+		t.Fatalf("unreachable endpoint took %s to fail", elapsed)
+	}
+}
+
+func TestCheckMasqueReachableSkipSendsNoProbe(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer silent.Close()
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	endpoint := silent.LocalAddr().String()
+
+	start := time.Now()
+	if err := checkMasqueReachable(t.Context(), l, WarpOptions{SkipReachability: true}, endpoint); err != nil {
+		t.Fatalf("checkMasqueReachable with the check skipped = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > masqueProbeTimeout/2 {
+		t.Fatalf("skipped check took %s", elapsed)
+	}
+	_ = silent.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := silent.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Fatalf("endpoint received a %d byte probe with the check skipped", n)
+	}
+
+	// Without the skip the same endpoint sees the probe and fails the check
+	if err := checkMasqueReachable(t.Context(), l, WarpOptions{}, endpoint); !errors.Is(err, preflight.ErrNoQUICResponse) {
+		t.Fatalf("checkMasqueReachable error = %v, want %v", err, preflight.ErrNoQUICResponse)
+	}
+	_ = silent.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := silent.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatalf("endpoint received no probe: %v", err)
+	}
+}
+
+func TestCheckMasqueReachableRetriesLostProbe(t *testing.T) {
+	endpoint, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer endpoint.Close()
+	source, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	sourcePort := source.LocalAddr().(*net.UDPAddr).Port
+	source.Close()
+
+	// The first probe is lost, the second gets a reply
+	probes := make(chan netip.AddrPort, masqueProbeAttempts)
+	go func() {
+		buf := make([]byte, 1500)
+		for i := 0; ; i++ {
+			_, from, err := endpoint.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			probes <- from
+			if i > 0 {
+				_, _ = endpoint.WriteToUDPAddrPort([]byte{0x40}, from)
+			}
+		}
+	}()
+
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts := WarpOptions{SourcePort: sourcePort}
+	if err := checkMasqueReachable(t.Context(), l, opts, endpoint.LocalAddr().String()); err != nil {
+		t.Fatalf("checkMasqueReachable with one lost probe = %v", err)
+	}
+	if len(probes) != 2 {
+		t.Fatalf("endpoint received %d probes, want 2", len(probes))
+	}
+	for range 2 {
+		if from := <-probes; int(from.Port()) != sourcePort {
+			t.Errorf("probe sent from port %d, want the fixed source port %d", from.Port(), sourcePort)
+		}
+	}
+}
+
+func TestMasqueProbePort(t *testing.T) {
+	if port := masqueProbePort(WarpOptions{}); port != 0 {
+		t.Errorf("port %d without a source port, want any", port)
+	}
+	if port := masqueProbePort(WarpOptions{SourcePort: 40443}); port != 40443 {
+		t.Errorf("port %d with the fixed source port 40443", port)
+	}
+	for range 20 {
+		if port := masqueProbePort(WarpOptions{SourcePortRange: [2]int{42000, 42003}}); port < 42000 || port > 42003 {
+			t.Fatalf("port %d outside the source port range 42000-42003", port)
+		}
+	}
+}
+
+func TestQUICBlockErrorCountsOnlyQUICFailures(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("MASQUE endpoint is unreachable over UDP: %w", preflight.ErrNoQUICResponse), true},
+		{fmt.Errorf("failed to establish MASQUE connection after retries: %w", &masque.HandshakeError{Err: context.DeadlineExceeded}), true},
+		{errors.New("failed to bind egress interface: no such interface"), false},
+		{fmt.Errorf("failed to load config: %w", errors.New("unexpected end of JSON input")), false},
+		{context.Canceled, false},
+	} {
+		if got := quicBlockError(ctx, tt.err); got != tt.want {
+			t.Errorf("quicBlockError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if quicBlockError(canceled, &masque.HandshakeError{Err: errors.New("timeout: no recent network activity")}) {
+		t.Error("a failure after ctx is done counts as a QUIC block")
+	}
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+	masquenoize "github.com/voidr3aper-anon/Vwarp/masque/noize"
+)
+
+// RunMasqueTestSuite brings up a MASQUE tunnel to endpoint with the
+// connection settings of opts, runs the masque connection test suite over it
+// and closes it again
+func RunMasqueTestSuite(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string, testOpts masque.TestOptions) (*masque.SuiteResult, error) {
+	var noizeConfig *masquenoize.NoizeConfig
+	if opts.MasqueNoize {
+		preset := opts.MasqueNoizePreset
+		if preset == "" {
+			preset = "medium"
+		}
+		noizeConfig = getMASQUEPresetConfig(preset, l)
+	}
+
+	configPath, err := MasqueConfigPath(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg := masqueAdapterConfig(l, opts, configPath, masqueEndpointFor(endpoint))
+	cfg.NoizeConfig = noizeConfig
+	adapter, err := masque.NewMasqueAdapter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish MASQUE connection: %w", err)
+	}
+	defer adapter.Close()
+
+	return masque.RunTestSuite(ctx, adapter, testOpts)
+}
+
+// DialMasqueTunnel brings up a MASQUE tunnel to endpoint with the connection
+// settings of opts and returns a dial function through a netstack on it and a
+// function that tears both down
+func DialMasqueTunnel(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) (func(ctx context.Context, network, address string) (net.Conn, error), func(), error) {
+	configPath, err := MasqueConfigPath(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := masqueAdapterConfig(l, opts, configPath, masqueEndpointFor(endpoint))
+	adapter, err := masque.NewMasqueAdapter(ctx, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to establish MASQUE connection: %w", err)
+	}
+	tnet, stop, err := tunnelNet(ctx, l, adapter, cfg, opts)
+	if err != nil {
+		adapter.Close()
+		return nil, nil, err
+	}
+	return tnet.DialContext, stop, nil
+}
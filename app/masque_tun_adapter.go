@@ -3,14 +3,15 @@ package app
 import (
 	"context"
 	"log/slog"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/voidr3aper-anon/Vwarp/masque"
+	"github.com/voidr3aper-anon/Vwarp/neterr"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/tun"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
 )
 
 // min returns the smaller of two integers
@@ -54,55 +55,6 @@ func (n *netstackTunAdapter) WritePacket(pkt []byte) error {
 	return err
 }
 
-// isConnectionError checks if the error indicates a closed or broken connection
-
-func isConnectionError(err error) bool {
-	if err == nil {
-		return false
-	}
-	errStr := strings.ToLower(err.Error())
-
-	// Standard network connection errors
-	connectionErrors := []string{
-		"use of closed network connection",
-		"connection reset by peer",
-		"broken pipe",
-		"network is unreachable",
-		"no route to host",
-		"connection refused",
-		"connection timed out",
-		"i/o timeout",
-		"context deadline exceeded",
-		"context canceled",
-		"connection aborted",
-		"transport endpoint is not connected",
-		"socket is not connected",
-		"network interface is down",
-		"connection reset by peer",
-		"EOF",
-		"broken pipe",
-	}
-
-	// Mobile and platform-specific errors
-	androidErrors := []string{
-		"permission denied",
-		"operation not permitted",
-		"protocol not available",
-		"address family not supported",
-		"network protocol is not available",
-	}
-
-	// Check all error patterns
-	allErrors := append(connectionErrors, androidErrors...)
-	for _, pattern := range allErrors {
-		if strings.Contains(errStr, pattern) {
-			return true
-		}
-	}
-
-	return false
-}
-
 // isPacketForwardingActive checks if packet forwarding is currently working
 func isPacketForwardingActive(lastRead, lastWrite *atomic.Int64) bool {
 	now := time.Now().Unix()
@@ -143,9 +95,23 @@ func TrackConnectionFailure() {
 	globalConnectionFailures.Add(1)
 }
 
+// masqueTunnelOptions configures the packet forwarding and reconnects of
+// maintainMasqueTunnel
+type masqueTunnelOptions struct {
+	factory      AdapterFactory   // Creates the adapter of each reconnect
+	device       packetDevice     // Packets are forwarded between it and MASQUE
+	mtu          int              // Largest packet forwarded
+	tnet         *netstack.Net    // Stack reconnects are tested through, nil skips the test (kernel TUN)
+	testURLs     *testURLs        // URLs the HTTP reconnect test fetches
+	probeTargets []string         // ip:port the DNS-independent reconnect test dials
+	queueDepth   int              // Packets each flow worker queues
+	stats        *wiresocks.Stats // Counts drops and reconnects
+	history      *qualityHistory  // Records the tunnel's quality, nothing if nil
+}
+
 // maintainMasqueTunnel continuously forwards packets between the TUN device and MASQUE
 // with automatic reconnection on connection failures
-func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.MasqueAdapter, factory AdapterFactory, device *netstackTunAdapter, mtu int, tnet *netstack.Net, testURL string) {
+func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.MasqueAdapter, opts masqueTunnelOptions) {
 	l.Info("Starting MASQUE tunnel packet forwarding with auto-reconnect")
 
 	// Connection state management - buffered channel to prevent blocking
@@ -166,12 +132,85 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 	lastSuccessfulWrite.Store(now)
 	lastFailureReset.Store(now)
 
-	// Forward packets from netstack to MASQUE
-	go func() {
-		buf := make([]byte, mtu)
-		packetCount := 0
+	// Each direction is forwarded by this many goroutines, sharded by flow
+	workers := adapter.ForwardWorkers()
+	if workers > 1 {
+		l.Info("forwarding MASQUE packets with multiple workers", "workers", workers)
+	}
+
+	blackhole := newMTUBlackholeDetector(l, opts.mtu)
+	reorder := newReorderSampler(opts.stats)
+
+	// Forward queued packets to MASQUE
+	writers := startFlowWorkers(ctx, workers, opts.queueDepth, opts.mtu, opts.stats, func() func(pkt []byte) {
 		writeErrors := 0
+		return func(pkt []byte) {
+			for ctx.Err() == nil {
+				// Wait if connection is broken
+				if connectionBroken.Load() {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+
+				// Protected adapter access
+				adapterMutex.RLock()
+				currentAdapter := adapter
+				adapterMutex.RUnlock()
+
+				// Write packet to MASQUE and handle ICMP response
+				icmp, err := currentAdapter.WriteWithICMP(pkt)
+				if err != nil {
+					if neterr.IsTransient(err) {
+						writeErrors++
+						connectionFailures.Add(1) // Track local failure
+						TrackConnectionFailure()  // Track global failure
+
+						// Be more tolerant - require multiple consecutive errors before marking as broken
+						if writeErrors >= 3 && !connectionBroken.Load() {
+							l.Warn("MASQUE connection error detected on write", "error", err, "consecutive_errors", writeErrors)
+							connectionBroken.Store(true)
+							// Signal connection down (non-blocking)
+							select {
+							case connectionDown <- true:
+							default:
+							}
+							// The tunnel is going away, drop the packet rather than replay it after recovery
+							opts.stats.AddPacketDrop()
+							return
+						}
+						// Retry the packet while the queue holds the ones behind it
+						time.Sleep(20 * time.Millisecond)
+						continue
+					}
+					l.Error("error writing to MASQUE", "error", err, "packet_size", len(pkt))
+					writeErrors++
+					opts.stats.AddPacketDrop()
+					time.Sleep(20 * time.Millisecond) // Slightly longer pause for non-connection errors
+					return
+				}
 
+				// Reset error counter on successful write
+				if writeErrors > 0 {
+					writeErrors = 0
+				}
+				lastSuccessfulWrite.Store(time.Now().Unix())
+				blackhole.outbound(pkt)
+
+				// Handle ICMP response if present
+				if len(icmp) > 0 {
+					if err := opts.device.WritePacket(icmp); err != nil {
+						l.Error("error writing ICMP to TUN device", "error", err)
+					}
+				}
+				return
+			}
+		}
+	})
+
+	// Read packets from netstack into the write queues. A full queue blocks
+	// the read briefly so short MASQUE write stalls don't drop packets.
+	go func() {
+		buf := make([]byte, opts.mtu)
 		for ctx.Err() == nil {
 			// Wait if connection is broken
 			if connectionBroken.Load() {
@@ -179,7 +218,7 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 				continue
 			}
 
-			n, err := device.ReadPacket(buf)
+			n, err := opts.device.ReadPacket(buf)
 			if err != nil {
 				if ctx.Err() != nil {
 					return
@@ -190,59 +229,28 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 				continue
 			}
 
-			packetCount++
-
-			// Protected adapter access
-			adapterMutex.RLock()
-			currentAdapter := adapter
-			adapterMutex.RUnlock()
-
-			// Write packet to MASQUE and handle ICMP response
-			icmp, err := currentAdapter.WriteWithICMP(buf[:n])
-			if err != nil {
-				if isConnectionError(err) {
-					writeErrors++
-					connectionFailures.Add(1) // Track local failure
-					TrackConnectionFailure()  // Track global failure
-
-					// Be more tolerant - require multiple consecutive errors before marking as broken
-					if writeErrors >= 3 && !connectionBroken.Load() {
-						l.Warn("MASQUE connection error detected on write", "error", err, "consecutive_errors", writeErrors)
-						connectionBroken.Store(true)
-						// Signal connection down (non-blocking)
-						select {
-						case connectionDown <- true:
-						default:
-						}
-					}
-					// Drop this packet and continue - don't queue failed writes
-					continue
-				} else {
-					l.Error("error writing to MASQUE", "error", err, "packet_size", n)
-					writeErrors++
-					time.Sleep(20 * time.Millisecond) // Slightly longer pause for non-connection errors
-				}
-				continue
-			}
-
-			// Reset error counter on successful write
-			if writeErrors > 0 {
-				writeErrors = 0
-			}
-			lastSuccessfulWrite.Store(time.Now().Unix())
-
-			// Handle ICMP response if present
-			if len(icmp) > 0 {
-				if err := device.WritePacket(icmp); err != nil {
-					l.Error("error writing ICMP to TUN device", "error", err)
-				}
-			}
+			writers.push(ctx, buf[:n])
 		}
 	}()
 
+	// Deliver packets from MASQUE to netstack, through flow workers when
+	// there are several and directly from the reader otherwise
+	writeTUN := func(pkt []byte) {
+		if err := opts.device.WritePacket(pkt); err != nil {
+			l.Error("error writing to TUN device", "error", err, "packet_size", len(pkt))
+			// Brief pause to avoid flooding TUN device with failed writes
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	deliver := writeTUN
+	if workers > 1 {
+		readers := startFlowWorkers(ctx, workers, opts.queueDepth, opts.mtu, opts.stats, func() func(pkt []byte) { return writeTUN })
+		deliver = func(pkt []byte) { readers.push(ctx, pkt) }
+	}
+
 	// Forward packets from MASQUE to netstack
 	go func() {
-		buf := make([]byte, mtu)
+		buf := make([]byte, opts.mtu)
 		packetCount := 0
 		consecutiveErrors := 0
 		readTimeouts := 0
@@ -264,14 +272,13 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 					return
 				}
 
-				if isConnectionError(err) {
+				if neterr.IsTransient(err) {
 					consecutiveErrors++
 					connectionFailures.Add(1) // Track local failure
 					TrackConnectionFailure()  // Track global failure
 
 					// Categorize error types for better handling
-					errStr := err.Error()
-					isTimeout := strings.Contains(errStr, "timeout") || strings.Contains(errStr, "deadline")
+					isTimeout := neterr.IsTimeout(err)
 
 					if isTimeout {
 						readTimeouts++
@@ -313,17 +320,21 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 				readTimeouts = 0
 			}
 			lastSuccessfulRead.Store(time.Now().Unix())
+			blackhole.inbound(buf[:n])
+			reorder.inbound(buf[:n])
 
 			packetCount++
 
-			if err := device.WritePacket(buf[:n]); err != nil {
-				l.Error("error writing to TUN device", "error", err, "packet_size", n)
-				// Brief pause to avoid flooding TUN device with failed writes
-				time.Sleep(10 * time.Millisecond)
-			}
+			deliver(buf[:n])
 		}
 	}()
 
+	go opts.history.run(ctx, func() masque.Quality {
+		adapterMutex.RLock()
+		defer adapterMutex.RUnlock()
+		return adapter.Quality()
+	})
+
 	// Connection health monitoring goroutine
 	go func() {
 		healthTicker := time.NewTicker(HealthCheckInterval)
@@ -459,7 +470,7 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 
 					// Create a new MASQUE adapter from scratch
 					l.Info("Creating new MASQUE adapter with fresh handshake")
-					newAdapter, err := factory()
+					newAdapter, err := opts.factory()
 					if err != nil {
 						l.Warn("Failed to create new MASQUE adapter", "attempt", attempt, "error", err)
 						adapterMutex.Unlock()
@@ -492,12 +503,16 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 					// Test connectivity with fallback approach during recovery
 					var connectivityOK bool
 
-					// Try DNS-independent test first (most reliable)
-					if err := dnsIndependentConnectivityTest(testCtx, l, tnet); err != nil {
+					// Try DNS-independent test first (most reliable). Kernel TUN mode
+					// has no userspace stack to probe from, so the test is skipped there.
+					if opts.tnet == nil {
+						l.Debug("Skipping connectivity test in TUN mode")
+						connectivityOK = true
+					} else if err := dnsIndependentConnectivityTest(testCtx, l, opts.tnet.DialContext, opts.probeTargets); err != nil {
 						l.Debug("DNS-independent test failed, trying HTTP test", "error", err)
 
 						// Fallback to basic HTTP connectivity test
-						if err := usermodeTunTest(testCtx, l, tnet, testURL); err != nil {
+						if err := usermodeTunTest(testCtx, l, opts.tnet, opts.testURLs); err != nil {
 							l.Warn("HTTP connectivity test failed during recovery", "error", err)
 							// Accept established tunnel even if HTTP tests fail
 							l.Info("Accepting established MASQUE tunnel")
@@ -521,6 +536,8 @@ func maintainMasqueTunnel(ctx context.Context, l *slog.Logger, adapter *masque.M
 					// Accept recovery if tunnel established successfully
 					successfulRecovery = true
 					lastRecoveryTime.Store(time.Now().Unix())
+					opts.stats.AddReconnect()
+					opts.history.record(qualityReconnected, newAdapter.Quality())
 					l.Info("Connection recovery completed successfully", "attempt", attempt)
 					break
 				}
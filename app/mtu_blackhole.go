@@ -0,0 +1,273 @@
+package app
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mtuBlackholeMargin marks packets within this many bytes of the MTU as near-MTU
+	mtuBlackholeMargin = 128
+	// mtuBlackholeTimeout is how long a TCP segment may go unacknowledged before it counts as lost
+	mtuBlackholeTimeout = 3 * time.Second
+	// mtuBlackholeLosses is how many near-MTU segments must be lost, with no
+	// near-MTU segment acknowledged, before the path is reported
+	mtuBlackholeLosses = 5
+	// mtuBlackholeMaxFlows and mtuBlackholeMaxPending bound the tracking state
+	mtuBlackholeMaxFlows   = 1024
+	mtuBlackholeMaxPending = 32
+	// mtuBlackholeShards is how many independently locked parts the flows are
+	// split into, so forwarding workers rarely wait on each other
+	mtuBlackholeShards = 16
+)
+
+// tcpFlow identifies an outbound TCP flow through the tunnel
+type tcpFlow struct {
+	src, dst netip.AddrPort
+}
+
+// shard returns the index of the detector shard tracking the flow
+func (f tcpFlow) shard() int {
+	return int(f.src.Port()^f.dst.Port()) % mtuBlackholeShards
+}
+
+// pendingSegment is an outbound TCP segment waiting for its acknowledgment
+type pendingSegment struct {
+	end   uint32 // Sequence number after the segment's last byte
+	sent  time.Time
+	large bool
+}
+
+// mtuBlackholeDetector watches TCP through the tunnel for a path that drops
+// near-MTU packets: large segments are never acknowledged while small ones
+// are. Connections then hang without any error, so it logs a warning once.
+// Flows are tracked in shards and the totals kept in atomics, so packets of
+// different flows don't contend for one lock.
+type mtuBlackholeDetector struct {
+	l         *slog.Logger
+	largeSize int
+	now       func() time.Time
+	shards    [mtuBlackholeShards]blackholeShard
+
+	lastExpire atomic.Int64 // UnixNano of the last expiry sweep
+	lostLarge  atomic.Int64 // Near-MTU segments lost since one was last acknowledged
+	ackedSmall atomic.Int64
+	warned     atomic.Bool
+}
+
+// blackholeShard holds the pending segments of the flows of one shard
+type blackholeShard struct {
+	mu    sync.Mutex
+	flows map[tcpFlow][]pendingSegment
+}
+
+func newMTUBlackholeDetector(l *slog.Logger, mtu int) *mtuBlackholeDetector {
+	d := &mtuBlackholeDetector{
+		l:         l,
+		largeSize: mtu - mtuBlackholeMargin,
+		now:       time.Now,
+	}
+	for i := range d.shards {
+		d.shards[i].flows = make(map[tcpFlow][]pendingSegment)
+	}
+	return d
+}
+
+// outbound records a packet written into the tunnel
+func (d *mtuBlackholeDetector) outbound(pkt []byte) {
+	seg, ok := parseTCPSegment(pkt)
+	if !ok || seg.payload == 0 {
+		return
+	}
+
+	now := d.now()
+	s := &d.shards[seg.flow.shard()]
+	s.mu.Lock()
+	pending, tracked := s.flows[seg.flow]
+	if tracked || len(s.flows) < mtuBlackholeMaxFlows/mtuBlackholeShards {
+		if len(pending) >= mtuBlackholeMaxPending {
+			pending = pending[1:]
+		}
+		s.flows[seg.flow] = append(pending, pendingSegment{
+			end:   seg.seq + uint32(seg.payload),
+			sent:  now,
+			large: len(pkt) >= d.largeSize,
+		})
+	}
+	s.mu.Unlock()
+
+	d.expire(now)
+}
+
+// inbound records a packet read from the tunnel
+func (d *mtuBlackholeDetector) inbound(pkt []byte) {
+	seg, ok := parseTCPSegment(pkt)
+	if !ok || !seg.hasACK {
+		return
+	}
+	flow := tcpFlow{src: seg.flow.dst, dst: seg.flow.src}
+
+	s := &d.shards[flow.shard()]
+	s.mu.Lock()
+	pending, tracked := s.flows[flow]
+	if !tracked {
+		s.mu.Unlock()
+		return
+	}
+	ackedLarge, ackedSmall := false, 0
+	kept := pending[:0]
+	for _, p := range pending {
+		// Sequence numbers wrap, compare them as a signed distance
+		if int32(seg.ack-p.end) < 0 {
+			kept = append(kept, p)
+			continue
+		}
+		if p.large {
+			ackedLarge = true
+		} else {
+			ackedSmall++
+		}
+	}
+	if len(kept) == 0 {
+		delete(s.flows, flow)
+	} else {
+		s.flows[flow] = kept
+	}
+	s.mu.Unlock()
+
+	d.record(ackedLarge, ackedSmall, 0)
+	d.expire(d.now())
+}
+
+// record adds the acknowledged and lost segments to the totals and warns once
+// when only near-MTU segments are getting lost
+func (d *mtuBlackholeDetector) record(ackedLarge bool, ackedSmall, lostLarge int) {
+	if ackedLarge {
+		// The path carries near-MTU packets after all
+		d.lostLarge.Store(0)
+	}
+	if ackedSmall > 0 {
+		d.ackedSmall.Add(int64(ackedSmall))
+	}
+	if lostLarge > 0 {
+		d.lostLarge.Add(int64(lostLarge))
+	}
+
+	if d.warned.Load() || d.lostLarge.Load() < mtuBlackholeLosses || d.ackedSmall.Load() == 0 {
+		return
+	}
+	if d.warned.CompareAndSwap(false, true) {
+		d.l.Warn("possible MTU black hole: near-MTU TCP segments through the tunnel are never acknowledged while small ones are",
+			"lost_large_segments", d.lostLarge.Load(),
+			"large_packet_size", d.largeSize,
+			"hint", "enable TCP MSS clamping or MTU probing (e.g. sysctl net.ipv4.tcp_mtu_probing=1), or lower the tunnel MTU")
+	}
+}
+
+// expire counts segments unacknowledged for longer than mtuBlackholeTimeout
+// as lost, sweeping every shard at most once a second. Flows that went
+// silent, as those hung on a black hole do, are swept by the packets of the
+// others.
+func (d *mtuBlackholeDetector) expire(now time.Time) {
+	last := d.lastExpire.Load()
+	if now.UnixNano()-last < int64(time.Second) || !d.lastExpire.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	lost := 0
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.mu.Lock()
+		lost += s.expire(now)
+		s.mu.Unlock()
+	}
+	d.record(false, 0, lost)
+}
+
+// expire drops the segments of the shard unacknowledged for longer than
+// mtuBlackholeTimeout and returns how many of them were near-MTU
+func (s *blackholeShard) expire(now time.Time) (lostLarge int) {
+	for flow, pending := range s.flows {
+		kept := pending[:0]
+		for _, p := range pending {
+			if now.Sub(p.sent) < mtuBlackholeTimeout {
+				kept = append(kept, p)
+			} else if p.large {
+				lostLarge++
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.flows, flow)
+		} else {
+			s.flows[flow] = kept
+		}
+	}
+	return lostLarge
+}
+
+// tcpSegment is the part of a TCP/IP packet the detector looks at
+type tcpSegment struct {
+	flow     tcpFlow
+	seq, ack uint32
+	hasACK   bool
+	payload  int
+}
+
+// parseTCPSegment parses an IPv4 or IPv6 TCP packet. IPv6 packets with
+// extension headers are not recognized.
+func parseTCPSegment(pkt []byte) (tcpSegment, bool) {
+	var seg tcpSegment
+	var src, dst netip.Addr
+	var tcp []byte
+
+	if len(pkt) < 1 {
+		return seg, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return seg, false
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if ihl < 20 || total < ihl || total > len(pkt) {
+			return seg, false
+		}
+		src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		tcp = pkt[ihl:total]
+	case 6:
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return seg, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(pkt[4:6]))
+		if total > len(pkt) {
+			return seg, false
+		}
+		src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+		tcp = pkt[40:total]
+	default:
+		return seg, false
+	}
+
+	if len(tcp) < 20 {
+		return seg, false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return seg, false
+	}
+	seg.flow = tcpFlow{
+		src: netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:2])),
+		dst: netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:4])),
+	}
+	seg.seq = binary.BigEndian.Uint32(tcp[4:8])
+	seg.ack = binary.BigEndian.Uint32(tcp[8:12])
+	seg.hasACK = tcp[13]&0x10 != 0
+	seg.payload = len(tcp) - dataOffset
+	return seg, true
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPacket builds an IPv4 TCP packet of the given total size
+func tcpPacket(src, dst netip.AddrPort, seq, ack uint32, flags byte, size int) []byte {
+	pkt := make([]byte, max(size, 40))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 6
+	copy(pkt[12:16], src.Addr().AsSlice())
+	copy(pkt[16:20], dst.Addr().AsSlice())
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return pkt
+}
+
+const tcpACK = 0x10
+
+// blackholePath sends small and near-MTU segments through d, acknowledging
+// the small ones and the large ones only if largeDelivered, and advances the
+// clock past the loss timeout between rounds
+func blackholePath(d *mtuBlackholeDetector, clock *time.Time, rounds int, largeDelivered bool) {
+	client := netip.MustParseAddrPort("172.16.0.2:40000")
+	server := netip.MustParseAddrPort("93.184.216.34:443")
+	seq := uint32(1000)
+
+	for i := 0; i < rounds; i++ {
+		small := tcpPacket(client, server, seq, 1, tcpACK, 140)
+		d.outbound(small)
+		seq += 100
+		d.inbound(tcpPacket(server, client, 1, seq, tcpACK, 40))
+
+		large := tcpPacket(client, server, seq, 1, tcpACK, 1280)
+		d.outbound(large)
+		seq += 1240
+		if largeDelivered {
+			d.inbound(tcpPacket(server, client, 1, seq, tcpACK, 40))
+		}
+
+		*clock = clock.Add(mtuBlackholeTimeout + time.Second)
+	}
+	// Flush the last round's expiry
+	d.outbound(tcpPacket(client, server, seq, 1, tcpACK, 140))
+}
+
+func newTestBlackholeDetector(logs *bytes.Buffer) (*mtuBlackholeDetector, *time.Time) {
+	clock := time.Unix(1700000000, 0)
+	d := newMTUBlackholeDetector(slog.New(slog.NewTextHandler(logs, nil)), 1280)
+	d.now = func() time.Time { return clock }
+	return d, &clock
+}
+
+func TestMTUBlackholeDetected(t *testing.T) {
+	var logs bytes.Buffer
+	d, clock := newTestBlackholeDetector(&logs)
+
+	blackholePath(d, clock, mtuBlackholeLosses+1, false)
+
+	if !strings.Contains(logs.String(), "possible MTU black hole") {
+		t.Fatalf("no MTU black hole warning after losing every near-MTU segment, log:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "MSS clamping") {
+		t.Errorf("warning does not suggest MSS clamping: %s", logs.String())
+	}
+	if n := strings.Count(logs.String(), "possible MTU black hole"); n != 1 {
+		t.Errorf("warned %d times, want once", n)
+	}
+}
+
+func TestMTUBlackholeHealthyPath(t *testing.T) {
+	var logs bytes.Buffer
+	d, clock := newTestBlackholeDetector(&logs)
+
+	blackholePath(d, clock, mtuBlackholeLosses+1, true)
+
+	if logs.Len() != 0 {
+		t.Fatalf("warning on a path that delivers near-MTU segments:\n%s", logs.String())
+	}
+}
+
+func TestParseTCPSegment(t *testing.T) {
+	src := netip.MustParseAddrPort("172.16.0.2:40000")
+	dst := netip.MustParseAddrPort("1.1.1.1:443")
+	seg, ok := parseTCPSegment(tcpPacket(src, dst, 7, 9, tcpACK, 100))
+	if !ok {
+		t.Fatal("parseTCPSegment rejected a TCP packet")
+	}
+	if seg.flow != (tcpFlow{src: src, dst: dst}) || seg.seq != 7 || seg.ack != 9 || !seg.hasACK || seg.payload != 60 {
+		t.Fatalf("parsed %+v", seg)
+	}
+
+	udp := tcpPacket(src, dst, 0, 0, 0, 100)
+	udp[9] = 17
+	if _, ok := parseTCPSegment(udp); ok {
+		t.Fatal("parseTCPSegment accepted a UDP packet")
+	}
+}
+
+func TestMTUBlackholeSilentFlow(t *testing.T) {
+	var logs bytes.Buffer
+	d, clock := newTestBlackholeDetector(&logs)
+	client := netip.MustParseAddrPort("172.16.0.2:40000")
+	other := netip.MustParseAddrPort("172.16.0.2:40001")
+	server := netip.MustParseAddrPort("93.184.216.34:443")
+	if (tcpFlow{client, server}).shard() == (tcpFlow{other, server}).shard() {
+		t.Fatal("test flows share a shard")
+	}
+
+	// The flow hangs on its near-MTU segments and sends nothing more
+	d.outbound(tcpPacket(client, server, 1000, 1, tcpACK, 140))
+	d.inbound(tcpPacket(server, client, 1, 1100, tcpACK, 40))
+	seq := uint32(1100)
+	for i := 0; i < mtuBlackholeLosses; i++ {
+		d.outbound(tcpPacket(client, server, seq, 1, tcpACK, 1280))
+		seq += 1240
+	}
+
+	// Traffic of a flow in another shard still counts its losses
+	*clock = clock.Add(mtuBlackholeTimeout + time.Second)
+	d.outbound(tcpPacket(other, server, 1, 1, tcpACK, 140))
+
+	if !strings.Contains(logs.String(), "possible MTU black hole") {
+		t.Fatalf("no warning for a flow that went silent on lost near-MTU segments, log:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+)
+
+// autoNoizePresets are the MASQUE noize presets tried by BenchmarkNoizePresets
+// and compared by BenchmarkPresetThroughput, lightest first
+var autoNoizePresets = []string{"none", "light", "medium", "heavy", "stealth", "gfw"}
+
+const (
+	// autoNoizeAttempts is how many test tunnels a preset must bring up in a row to count as reliable
+	autoNoizeAttempts = 3
+	// autoNoizeTrialTimeout bounds a single test tunnel
+	autoNoizeTrialTimeout = 20 * time.Second
+)
+
+// PresetResult is the outcome of the test tunnels brought up with one noize preset
+type PresetResult struct {
+	Preset    string
+	Attempts  int
+	Successes int
+	Latency   time.Duration // Mean handshake latency of the successful attempts
+	Err       error         // Last failure, if any
+}
+
+// Reliable reports whether every attempt with the preset connected
+func (r PresetResult) Reliable() bool {
+	return r.Attempts > 0 && r.Successes == r.Attempts
+}
+
+// presetTrial brings up one test tunnel with preset and returns its handshake latency
+type presetTrial func(ctx context.Context, preset string) (time.Duration, error)
+
+// benchmarkPresets runs attempts trials per preset in order and stops at the
+// first preset that is reliable. It returns the results of every preset tried
+// and the recommended preset, which is empty when none was reliable.
+func benchmarkPresets(ctx context.Context, l *slog.Logger, presets []string, attempts int, trial presetTrial) ([]PresetResult, string) {
+	var results []PresetResult
+	for _, preset := range presets {
+		r := PresetResult{Preset: preset}
+		var total time.Duration
+		for i := 0; i < attempts && ctx.Err() == nil; i++ {
+			r.Attempts++
+			latency, err := trial(ctx, preset)
+			if err != nil {
+				r.Err = err
+				l.Debug("noize preset trial failed", "preset", preset, "attempt", i+1, "error", err)
+				// A preset that failed once is not reliable, skip its remaining attempts
+				break
+			}
+			r.Successes++
+			total += latency
+		}
+		if r.Successes > 0 {
+			r.Latency = total / time.Duration(r.Successes)
+		}
+		if r.Attempts == 0 {
+			break
+		}
+		results = append(results, r)
+		l.Info("noize preset benchmarked", "preset", preset, "connected", fmt.Sprintf("%d/%d", r.Successes, r.Attempts), "latency", r.Latency)
+
+		if r.Reliable() {
+			return results, preset
+		}
+	}
+	return results, ""
+}
+
+// BenchmarkNoizePresets brings up test MASQUE tunnels to endpoint with each
+// noize preset, lightest first, and returns the results together with the
+// lightest preset that connected on every attempt.
+func BenchmarkNoizePresets(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) ([]PresetResult, string, error) {
+	masqueEndpoint := masqueEndpointFor(endpoint)
+	configPath, err := MasqueConfigPath(opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	trial := func(ctx context.Context, preset string) (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(ctx, autoNoizeTrialTimeout)
+		defer cancel()
+
+		cfg := masqueAdapterConfig(l, opts, configPath, masqueEndpoint)
+		cfg.NoizeConfig = getMASQUEPresetConfig(preset, l)
+		start := time.Now()
+		adapter, err := masque.NewMasqueAdapter(ctx, cfg)
+		if err != nil {
+			return 0, err
+		}
+		latency := time.Since(start)
+		adapter.Close()
+		return latency, nil
+	}
+
+	l.Info("benchmarking MASQUE noize presets", "endpoint", masqueEndpoint, "presets", autoNoizePresets)
+	results, preset := benchmarkPresets(ctx, l, autoNoizePresets, autoNoizeAttempts, trial)
+	if err := ctx.Err(); err != nil {
+		return results, "", err
+	}
+	if preset == "" {
+		return results, "", errors.New("no noize preset connected reliably")
+	}
+	return results, preset, nil
+}
+
+// masqueEndpointFor returns endpoint with its port replaced by the MASQUE port
+// 443. An empty endpoint stays empty, so the MASQUE adapter rotates through
+// the endpoints stored with the device.
+func masqueEndpointFor(endpoint string) string {
+	if endpoint == "" {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(endpoint, "443")
+}
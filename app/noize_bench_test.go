@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// scriptedTrial replays per-preset outcomes, one entry per attempt
+type scriptedTrial struct {
+	outcomes map[string][]error
+	calls    map[string]int
+}
+
+func (s *scriptedTrial) run(ctx context.Context, preset string) (time.Duration, error) {
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	i := s.calls[preset]
+	s.calls[preset]++
+	outcomes := s.outcomes[preset]
+	if i < len(outcomes) && outcomes[i] != nil {
+		return 0, outcomes[i]
+	}
+	return time.Duration(i+1) * 10 * time.Millisecond, nil
+}
+
+func TestBenchmarkPresetsPicksLightestReliable(t *testing.T) {
+	errBlocked := errors.New("handshake timed out")
+	trial := &scriptedTrial{outcomes: map[string][]error{
+		"none":  {errBlocked},
+		"light": {nil, errBlocked},
+	}}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	results, preset := benchmarkPresets(context.Background(), l, autoNoizePresets, 3, trial.run)
+	if preset != "medium" {
+		t.Fatalf("recommended preset = %q, want medium", preset)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3 (none, light, medium)", len(results))
+	}
+	if r := results[0]; r.Preset != "none" || r.Attempts != 1 || r.Successes != 0 || !errors.Is(r.Err, errBlocked) {
+		t.Errorf("none result = %+v", r)
+	}
+	if r := results[1]; r.Preset != "light" || r.Attempts != 2 || r.Successes != 1 || r.Reliable() {
+		t.Errorf("light result = %+v", r)
+	}
+	if r := results[2]; !r.Reliable() || r.Latency != 20*time.Millisecond {
+		t.Errorf("medium result = %+v, want reliable with 20ms mean latency", r)
+	}
+	if trial.calls["heavy"] != 0 {
+		t.Errorf("heavy was tried after medium was already reliable")
+	}
+}
+
+func TestBenchmarkPresetsNoneReliable(t *testing.T) {
+	errBlocked := errors.New("handshake timed out")
+	outcomes := make(map[string][]error)
+	for _, p := range autoNoizePresets {
+		outcomes[p] = []error{errBlocked}
+	}
+	trial := &scriptedTrial{outcomes: outcomes}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	results, preset := benchmarkPresets(context.Background(), l, autoNoizePresets, 3, trial.run)
+	if preset != "" {
+		t.Fatalf("recommended preset = %q, want none", preset)
+	}
+	if len(results) != len(autoNoizePresets) {
+		t.Fatalf("got %d results, want %d", len(results), len(autoNoizePresets))
+	}
+}
+
+func TestBenchmarkPresetsStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	trial := func(ctx context.Context, preset string) (time.Duration, error) {
+		cancel()
+		return 0, ctx.Err()
+	}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	results, preset := benchmarkPresets(ctx, l, autoNoizePresets, 3, trial)
+	if preset != "" || len(results) != 1 {
+		t.Fatalf("got %d results and preset %q after cancel, want 1 and none", len(results), preset)
+	}
+}
+
+func TestMasqueAdapterConfigDialOptions(t *testing.T) {
+	opts := WarpOptions{
+		EgressIface:      "eth1",
+		SourcePortRange:  [2]int{40000, 41000},
+		StableSourcePort: true,
+	}
+	cfg := masqueAdapterConfig(slog.Default(), opts, "masque.json", "162.159.198.1:443")
+	if cfg.EgressInterface != "eth1" || cfg.SourcePortRange != opts.SourcePortRange || !cfg.StableSourcePort {
+		t.Errorf("bench tunnel does not dial like the tunnel: %+v", cfg)
+	}
+	if cfg.NoizeConfig != nil {
+		t.Error("bench tunnel config has noize before a preset is applied")
+	}
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+const (
+	// DefaultWriteQueueDepth is how many packets may wait between the netstack and a stalled MASQUE write
+	DefaultWriteQueueDepth = 256
+	// writeQueueBlock is how long a TUN read waits for room in a full queue before the packet is dropped
+	writeQueueBlock = 50 * time.Millisecond
+)
+
+// packetQueue is a bounded FIFO of packets between the TUN reader and the
+// MASQUE writer. A full queue blocks the reader for up to block before it
+// drops the packet, pushing back on the stack instead of dropping on every
+// short write stall.
+type packetQueue struct {
+	ch    chan []byte
+	pool  sync.Pool
+	block time.Duration
+	stats *wiresocks.Stats
+}
+
+func newPacketQueue(depth, mtu int, block time.Duration, stats *wiresocks.Stats) *packetQueue {
+	if depth <= 0 {
+		depth = DefaultWriteQueueDepth
+	}
+	return &packetQueue{
+		ch:    make(chan []byte, depth),
+		pool:  sync.Pool{New: func() any { return make([]byte, mtu) }},
+		block: block,
+		stats: stats,
+	}
+}
+
+// push queues a copy of pkt and reports whether it was queued
+func (q *packetQueue) push(ctx context.Context, pkt []byte) bool {
+	buf := q.pool.Get().([]byte)
+	if cap(buf) < len(pkt) {
+		buf = make([]byte, len(pkt))
+	}
+	buf = buf[:copy(buf[:cap(buf)], pkt)]
+
+	select {
+	case q.ch <- buf:
+	default:
+		timer := time.NewTimer(q.block)
+		defer timer.Stop()
+		select {
+		case q.ch <- buf:
+		case <-timer.C:
+			q.release(buf)
+			q.stats.AddPacketDrop()
+			return false
+		case <-ctx.Done():
+			q.release(buf)
+			return false
+		}
+	}
+	q.stats.ObserveQueueDepth(len(q.ch))
+	return true
+}
+
+// pop returns the oldest queued packet, which must be handed back with
+// release, or false once ctx is done
+func (q *packetQueue) pop(ctx context.Context) ([]byte, bool) {
+	select {
+	case pkt := <-q.ch:
+		return pkt, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// release returns a popped packet buffer to the pool
+func (q *packetQueue) release(pkt []byte) {
+	q.pool.Put(pkt[:cap(pkt)])
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+func TestPacketQueueAbsorbsWriteStall(t *testing.T) {
+	const depth = 8
+	stats := &wiresocks.Stats{}
+	q := newPacketQueue(depth, 1280, 10*time.Millisecond, stats)
+	ctx := context.Background()
+
+	// The writer is stalled: nothing pops while depth packets arrive
+	for i := 0; i < depth; i++ {
+		if !q.push(ctx, []byte{byte(i), 0xaa}) {
+			t.Fatalf("packet %d dropped within the queue depth", i)
+		}
+	}
+	if snap := stats.Snapshot(); snap.Drops != 0 || snap.HighWater != depth {
+		t.Fatalf("stats after filling = %+v, want no drops and high-water %d", snap, depth)
+	}
+
+	// One more than the queue holds blocks briefly, then drops
+	start := time.Now()
+	if q.push(ctx, []byte{0xff}) {
+		t.Fatal("packet beyond the queue depth was queued")
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Errorf("full queue dropped after %s, want it to block for the backpressure window first", waited)
+	}
+	if snap := stats.Snapshot(); snap.Drops != 1 {
+		t.Fatalf("drops = %d, want 1", snap.Drops)
+	}
+
+	// The writer recovers and gets every queued packet in order
+	for i := 0; i < depth; i++ {
+		pkt, ok := q.pop(ctx)
+		if !ok {
+			t.Fatal("pop failed")
+		}
+		if want := []byte{byte(i), 0xaa}; !bytes.Equal(pkt, want) {
+			t.Fatalf("packet %d = %x, want %x", i, pkt, want)
+		}
+		q.release(pkt)
+	}
+}
+
+func TestPacketQueueBackpressureUnblocks(t *testing.T) {
+	stats := &wiresocks.Stats{}
+	q := newPacketQueue(1, 1280, time.Second, stats)
+	ctx := context.Background()
+
+	q.push(ctx, []byte{1})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pkt, _ := q.pop(ctx)
+		q.release(pkt)
+	}()
+
+	// The reader waits for the writer to make room instead of dropping
+	if !q.push(ctx, []byte{2}) {
+		t.Fatal("packet dropped although the writer freed a slot within the backpressure window")
+	}
+	if pkt, _ := q.pop(ctx); !bytes.Equal(pkt, []byte{2}) {
+		t.Fatalf("queued packet = %x, want 02", pkt)
+	}
+	if snap := stats.Snapshot(); snap.Drops != 0 {
+		t.Fatalf("drops = %d, want 0", snap.Drops)
+	}
+}
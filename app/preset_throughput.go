@@ -0,0 +1,258 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+	masquenoize "github.com/voidr3aper-anon/Vwarp/masque/noize"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+const (
+	// throughputUploadBytes is the size of the upload through each test tunnel
+	throughputUploadBytes = 2 << 20
+	// throughputTrialTimeout bounds one preset's tunnel, download and upload
+	throughputTrialTimeout = 90 * time.Second
+)
+
+// ThroughputOptions are the transfers BenchmarkPresetThroughput times through
+// each test tunnel
+type ThroughputOptions struct {
+	DownloadURL string // Downloaded to the end
+	UploadURL   string // Receives an upload of throughputUploadBytes, no upload if empty
+}
+
+// PresetMeasurement is what one test tunnel with a noize preset measured
+type PresetMeasurement struct {
+	ConnectTime  time.Duration // Time to bring up the tunnel
+	Downloaded   int64         // Payload bytes downloaded
+	DownloadTime time.Duration
+	Uploaded     int64 // Payload bytes uploaded
+	UploadTime   time.Duration
+	WireBytes    int64 // UDP payload bytes sent and received by the tunnel, junk packets included
+}
+
+// PresetThroughput is one row of the noize preset throughput comparison
+type PresetThroughput struct {
+	Preset       string        `json:"preset"`
+	ConnectTime  time.Duration `json:"connect_time"`
+	DownloadMbps float64       `json:"download_mbps"`
+	UploadMbps   float64       `json:"upload_mbps"`
+	// Overhead is the share of wire bytes beyond the payload: QUIC, Connect-IP and noize
+	Overhead float64 `json:"overhead"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// presetMeasure brings up one test tunnel with preset and measures it
+type presetMeasure func(ctx context.Context, preset string) (PresetMeasurement, error)
+
+// benchmarkPresetThroughput measures every preset in order and returns one
+// row per preset measured; a preset that fails gets a row with its error
+func benchmarkPresetThroughput(ctx context.Context, l *slog.Logger, presets []string, measure presetMeasure) []PresetThroughput {
+	var rows []PresetThroughput
+	for _, preset := range presets {
+		if ctx.Err() != nil {
+			break
+		}
+		m, err := measure(ctx, preset)
+		row := summarizePresetThroughput(preset, m, err)
+		rows = append(rows, row)
+		l.Info("noize preset throughput measured", "preset", preset, "connect", row.ConnectTime, "down_mbps", row.DownloadMbps, "up_mbps", row.UploadMbps, "error", row.Error)
+	}
+	return rows
+}
+
+// summarizePresetThroughput turns a measurement into a comparison row
+func summarizePresetThroughput(preset string, m PresetMeasurement, err error) PresetThroughput {
+	row := PresetThroughput{
+		Preset:       preset,
+		ConnectTime:  m.ConnectTime,
+		DownloadMbps: mbps(m.Downloaded, m.DownloadTime),
+		UploadMbps:   mbps(m.Uploaded, m.UploadTime),
+	}
+	if payload := m.Downloaded + m.Uploaded; payload > 0 && m.WireBytes > payload {
+		row.Overhead = float64(m.WireBytes-payload) / float64(payload)
+	}
+	if err != nil {
+		row.Error = err.Error()
+	}
+	return row
+}
+
+// mbps returns the rate of n bytes in d in megabits per second
+func mbps(n int64, d time.Duration) float64 {
+	if n <= 0 || d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
+
+// BenchmarkPresetThroughput brings up a test MASQUE tunnel to endpoint with
+// each noize preset, times the transfers through it, and returns the connect
+// time, throughput and overhead of every preset. The "none" preset runs on
+// the plain socket, as a tunnel without noize does.
+func BenchmarkPresetThroughput(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string, transfers ThroughputOptions) ([]PresetThroughput, error) {
+	if transfers.DownloadURL == "" {
+		return nil, errors.New("no download URL to time")
+	}
+	masqueEndpoint := masqueEndpointFor(endpoint)
+	configPath, err := MasqueConfigPath(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	measure := func(ctx context.Context, preset string) (PresetMeasurement, error) {
+		ctx, cancel := context.WithTimeout(ctx, throughputTrialTimeout)
+		defer cancel()
+
+		cfg := masqueAdapterConfig(l, opts, configPath, masqueEndpoint)
+		var obfuscator *masquenoize.Obfuscator
+		if config := getMASQUEPresetConfig(preset, l); config != nil {
+			obfuscator = masquenoize.NewObfuscator(config, l)
+			cfg.Obfuscator = obfuscator
+		}
+
+		var m PresetMeasurement
+		start := time.Now()
+		adapter, err := masque.NewMasqueAdapter(ctx, cfg)
+		if err != nil {
+			return m, err
+		}
+		m.ConnectTime = time.Since(start)
+
+		tnet, stop, err := tunnelNet(ctx, l, adapter, cfg, opts)
+		if err != nil {
+			adapter.Close()
+			return m, err
+		}
+		defer stop()
+		client := &http.Client{Transport: &http.Transport{DialContext: tnet.DialContext, DisableCompression: true}}
+
+		if m.Downloaded, m.DownloadTime, err = timedDownload(ctx, client, transfers.DownloadURL); err != nil {
+			return m, fmt.Errorf("download: %w", err)
+		}
+		if transfers.UploadURL != "" {
+			if m.Uploaded, m.UploadTime, err = timedUpload(ctx, client, transfers.UploadURL, throughputUploadBytes); err != nil {
+				return m, fmt.Errorf("upload: %w", err)
+			}
+		}
+		// Without noize nothing sits on the socket to count it, so QUIC's own count is used
+		if obfuscator != nil {
+			m.WireBytes = obfuscator.WireBytes()
+		} else {
+			m.WireBytes = int64(adapter.Quality().WireBytes)
+		}
+		return m, nil
+	}
+
+	l.Info("benchmarking MASQUE noize preset throughput", "endpoint", masqueEndpoint, "presets", autoNoizePresets)
+	rows := benchmarkPresetThroughput(ctx, l, autoNoizePresets, measure)
+	return rows, ctx.Err()
+}
+
+// tunnelNet returns a netstack on adapter, forwarded by the tunnel
+// maintenance loop of a normal run, and a function that tears both down. The
+// loop reconnects with cfg and checks the tunnel with the test URLs and probe
+// targets of opts.
+func tunnelNet(ctx context.Context, l *slog.Logger, adapter *masque.MasqueAdapter, cfg masque.AdapterConfig, opts WarpOptions) (*netstack.Net, func(), error) {
+	addrs := masqueTunnelAddrs(l, adapter)
+	if len(addrs) == 0 {
+		return nil, nil, errors.New("no valid tunnel addresses received from MASQUE")
+	}
+	dns := opts.DnsAddr
+	if !dns.IsValid() {
+		dns = netip.MustParseAddr("1.1.1.1")
+	}
+	tunDev, tnet, _, err := createNetstack(l, addrs, []netip.Addr{dns}, singleMTU)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create netstack: %w", err)
+	}
+	dev := &netstackTunAdapter{
+		dev:             tunDev,
+		tunnelBufPool:   &sync.Pool{New: func() interface{} { buf := make([][]byte, 1); return &buf }},
+		tunnelSizesPool: &sync.Pool{New: func() interface{} { sizes := make([]int, 1); return &sizes }},
+	}
+
+	// The loop closes the adapters it replaces, the last one is closed here
+	var mu sync.Mutex
+	current := adapter
+	factory := func() (*masque.MasqueAdapter, error) {
+		fresh, err := masque.NewMasqueAdapter(ctx, cfg)
+		if err == nil {
+			mu.Lock()
+			current = fresh
+			mu.Unlock()
+		}
+		return fresh, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go maintainMasqueTunnel(ctx, l, adapter, masqueTunnelOptions{
+		factory:      factory,
+		device:       dev,
+		mtu:          singleMTU,
+		tnet:         tnet,
+		testURLs:     newTestURLs(opts),
+		probeTargets: opts.ProbeTargets,
+		queueDepth:   opts.WriteQueue,
+		stats:        &wiresocks.Stats{},
+	})
+
+	stop := func() {
+		cancel()
+		tunDev.Close()
+		mu.Lock()
+		current.Close()
+		mu.Unlock()
+	}
+	return tnet, stop, nil
+}
+
+// timedDownload downloads url to the end and returns how many bytes arrived
+// and how long it took
+func timedDownload(ctx context.Context, client *http.Client, url string) (int64, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	return n, time.Since(start), err
+}
+
+// timedUpload uploads size bytes to url and returns how many were sent and
+// how long it took
+func timedUpload(ctx context.Context, client *http.Client, url string, size int) (int64, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(strings.Repeat("0", size)))
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return int64(size), time.Since(start), nil
+}
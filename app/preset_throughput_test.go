@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkPresetThroughputAggregates(t *testing.T) {
+	errBlocked := errors.New("handshake timed out")
+	measurements := map[string]PresetMeasurement{
+		"none": {
+			ConnectTime: 200 * time.Millisecond,
+			Downloaded:  10_000_000, DownloadTime: 2 * time.Second,
+			Uploaded: 2_000_000, UploadTime: time.Second,
+			WireBytes: 13_200_000,
+		},
+		"heavy": {
+			ConnectTime: 900 * time.Millisecond,
+			Downloaded:  10_000_000, DownloadTime: 4 * time.Second,
+			Uploaded: 2_000_000, UploadTime: 2 * time.Second,
+			WireBytes: 15_000_000,
+		},
+		// Connected but the download failed
+		"gfw": {ConnectTime: time.Second},
+	}
+	measure := func(ctx context.Context, preset string) (PresetMeasurement, error) {
+		switch preset {
+		case "stealth", "gfw":
+			return measurements[preset], errBlocked
+		}
+		return measurements[preset], nil
+	}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	rows := benchmarkPresetThroughput(context.Background(), l, []string{"none", "heavy", "stealth", "gfw"}, measure)
+	if len(rows) != 4 {
+		t.Fatalf("got %d rows, want one per preset", len(rows))
+	}
+
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	none, heavy, stealth, gfw := rows[0], rows[1], rows[2], rows[3]
+	if none.Preset != "none" || none.ConnectTime != 200*time.Millisecond || !near(none.DownloadMbps, 40) || !near(none.UploadMbps, 16) || !near(none.Overhead, 0.1) || none.Error != "" {
+		t.Errorf("none row = %+v", none)
+	}
+	if heavy.Preset != "heavy" || !near(heavy.DownloadMbps, 20) || !near(heavy.UploadMbps, 8) || !near(heavy.Overhead, 0.25) {
+		t.Errorf("heavy row = %+v", heavy)
+	}
+	if stealth.Error != errBlocked.Error() || stealth.DownloadMbps != 0 || stealth.Overhead != 0 {
+		t.Errorf("failed preset row = %+v", stealth)
+	}
+	if gfw.ConnectTime != time.Second || gfw.Error == "" || gfw.DownloadMbps != 0 {
+		t.Errorf("partially measured preset row = %+v", gfw)
+	}
+}
+
+func TestBenchmarkPresetThroughputStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var measured []string
+	measure := func(ctx context.Context, preset string) (PresetMeasurement, error) {
+		measured = append(measured, preset)
+		cancel()
+		return PresetMeasurement{}, ctx.Err()
+	}
+
+	rows := benchmarkPresetThroughput(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), autoNoizePresets, measure)
+	if len(rows) != 1 || len(measured) != 1 {
+		t.Fatalf("measured %v after cancel, want only the first preset", measured)
+	}
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+)
+
+const (
+	// DefaultQualityInterval is how often the quality history is sampled when
+	// WarpOptions.QualityInterval is not set
+	DefaultQualityInterval = 30 * time.Second
+	// qualityHistoryMaxSize is how large the history file may grow before it
+	// is rotated to a single ".1" backup, bounding it to twice this on disk
+	qualityHistoryMaxSize = 10 << 20
+)
+
+// Quality history events
+const (
+	qualitySampled     = "sample"
+	qualityReconnected = "reconnect"
+)
+
+// qualitySample is one line of the quality history file
+type qualitySample struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Endpoint   string    `json:"endpoint"`
+	RTTMillis  float64   `json:"rtt_ms"`
+	LossPct    float64   `json:"loss_pct"`   // Packets lost since the previous line, in percent of those sent
+	Reconnects uint64    `json:"reconnects"` // Tunnel reconnects since the history was opened
+}
+
+// qualityHistory appends tunnel quality samples as JSON lines to a file over
+// the life of the tunnel, so intermittent drops can be matched with the time
+// of day or network events afterwards. A nil history records nothing.
+type qualityHistory struct {
+	mu         sync.Mutex
+	l          *slog.Logger
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	now        func() time.Time
+	f          *os.File
+	size       int64
+	prev       masque.Quality // Counters of the previous line, for the loss since then
+	reconnects uint64
+	failed     bool // A write failed and was logged; later failures are not
+}
+
+// openQualityHistory opens the history file at path for appending, to be
+// sampled every interval (DefaultQualityInterval if zero), or returns nil if
+// path is empty
+func openQualityHistory(l *slog.Logger, path string, interval time.Duration) (*qualityHistory, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if interval <= 0 {
+		interval = DefaultQualityInterval
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &qualityHistory{
+		l:        l,
+		path:     path,
+		maxSize:  qualityHistoryMaxSize,
+		interval: interval,
+		now:      time.Now,
+		f:        f,
+		size:     info.Size(),
+	}, nil
+}
+
+// run records a sample of quality every interval and closes the file when
+// ctx is done
+func (h *qualityHistory) run(ctx context.Context, quality func() masque.Quality) {
+	if h == nil {
+		return
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.close()
+			return
+		case <-ticker.C:
+			h.record(qualitySampled, quality())
+		}
+	}
+}
+
+// record appends a line for event with the state q of the tunnel
+func (h *qualityHistory) record(event string, q masque.Quality) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return
+	}
+
+	if event == qualityReconnected {
+		h.reconnects++
+	}
+	// A new tunnel counts its packets from zero
+	prev := h.prev
+	if q.PacketsSent < prev.PacketsSent || q.PacketsLost < prev.PacketsLost {
+		prev = masque.Quality{}
+	}
+	var loss float64
+	if sent := q.PacketsSent - prev.PacketsSent; sent > 0 {
+		loss = float64(q.PacketsLost-prev.PacketsLost) / float64(sent) * 100
+	}
+	h.prev = q
+
+	line, err := json.Marshal(qualitySample{
+		Time:       h.now(),
+		Event:      event,
+		Endpoint:   q.Endpoint,
+		RTTMillis:  float64(q.RTT.Microseconds()) / 1000,
+		LossPct:    math.Round(loss*100) / 100,
+		Reconnects: h.reconnects,
+	})
+	if err != nil {
+		h.writeFailed(err)
+		return
+	}
+	line = append(line, '\n')
+
+	if h.size > 0 && h.size+int64(len(line)) > h.maxSize {
+		if err := h.rotate(); err != nil {
+			h.writeFailed(err)
+			return
+		}
+	}
+	n, err := h.f.Write(line)
+	h.size += int64(n)
+	if err != nil {
+		h.writeFailed(err)
+	}
+}
+
+// rotate moves the history file to its ".1" backup, replacing an older one,
+// and starts a new file. h.mu must be held.
+func (h *qualityHistory) rotate() error {
+	h.f.Close()
+	h.f = nil
+	if err := os.Rename(h.path, h.path+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	h.f, h.size = f, 0
+	return nil
+}
+
+// writeFailed logs the first error writing the history. h.mu must be held.
+func (h *qualityHistory) writeFailed(err error) {
+	if !h.failed {
+		h.failed = true
+		h.l.Warn("failed to write quality history", "path", h.path, "error", err)
+	}
+}
+
+func (h *qualityHistory) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f != nil {
+		h.f.Close()
+		h.f = nil
+	}
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+)
+
+func readQualityHistory(t *testing.T, path string) []qualitySample {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var samples []qualitySample
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s qualitySample
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatalf("history line %q: %v", scanner.Text(), err)
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+func TestQualityHistoryRecordsReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quality.jsonl")
+	h, err := openQualityHistory(slog.New(slog.DiscardHandler), path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tunnel loses 5 of 100 packets, then reconnects to another endpoint
+	// whose counters start over
+	var mu sync.Mutex
+	current := masque.Quality{Endpoint: "162.159.198.1:443", RTT: 42 * time.Millisecond, PacketsSent: 100, PacketsLost: 5}
+	quality := func() masque.Quality {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.run(ctx, quality)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	current = masque.Quality{Endpoint: "162.159.198.2:443", RTT: 80 * time.Millisecond, PacketsSent: 10}
+	reconnected := current
+	mu.Unlock()
+	before := time.Now()
+	h.record(qualityReconnected, reconnected)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	samples := readQualityHistory(t, path)
+	var sawSample bool
+	var reconnect *qualitySample
+	for i, s := range samples {
+		switch s.Event {
+		case qualitySampled:
+			if reconnect == nil && !sawSample {
+				sawSample = true
+				if s.Endpoint != "162.159.198.1:443" || s.RTTMillis != 42 || s.LossPct != 5 || s.Reconnects != 0 {
+					t.Errorf("first sample = %+v", s)
+				}
+			}
+		case qualityReconnected:
+			if reconnect != nil {
+				t.Errorf("reconnect recorded twice: %+v", s)
+			}
+			reconnect = &samples[i]
+		default:
+			t.Errorf("unknown event in %+v", s)
+		}
+	}
+	if !sawSample {
+		t.Fatalf("no sample before the reconnect: %+v", samples)
+	}
+	if reconnect == nil {
+		t.Fatalf("reconnect not recorded: %+v", samples)
+	}
+	if reconnect.Endpoint != "162.159.198.2:443" || reconnect.RTTMillis != 80 || reconnect.LossPct != 0 || reconnect.Reconnects != 1 {
+		t.Errorf("reconnect = %+v", *reconnect)
+	}
+	if reconnect.Time.Before(before) || reconnect.Time.After(time.Now()) {
+		t.Errorf("reconnect time %v outside the test run", reconnect.Time)
+	}
+	if last := samples[len(samples)-1]; last.Event == qualitySampled && last.Reconnects != 1 {
+		t.Errorf("sample after the reconnect = %+v", last)
+	}
+}
+
+func TestQualityHistoryRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quality.jsonl")
+	h, err := openQualityHistory(slog.New(slog.DiscardHandler), path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	h.maxSize = 300
+
+	for range 10 {
+		h.record(qualitySampled, masque.Quality{Endpoint: "162.159.198.1:443"})
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 || info.Size() > h.maxSize {
+			t.Errorf("%s is %d bytes, want at most %d", p, info.Size(), h.maxSize)
+		}
+	}
+	if n := len(readQualityHistory(t, path)) + len(readQualityHistory(t, path+".1")); n >= 10 {
+		t.Errorf("%d lines kept after rotating, want the oldest dropped", n)
+	}
+}
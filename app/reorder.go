@@ -0,0 +1,81 @@
+package app
+
+import (
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+const (
+	// reorderMaxFlows is how many TCP flows read from the tunnel are sampled
+	// for reordering at once; segments of other flows are skipped
+	reorderMaxFlows = 64
+	// reorderFlowIdle is how long a sampled flow may go quiet before a new
+	// flow takes its place
+	reorderFlowIdle = 30 * time.Second
+)
+
+// sampledFlow is the ordering state of one sampled TCP flow
+type sampledFlow struct {
+	next uint32 // Sequence number after the furthest byte received
+	seen time.Time
+}
+
+// reorderSampler measures out-of-order delivery of the TCP segments read
+// from the tunnel. It follows a bounded sample of flows and counts a data
+// segment as reordered when it starts before the furthest byte already
+// received on its flow, which includes retransmissions. It is only used by
+// the tunnel reader goroutine.
+type reorderSampler struct {
+	stats *wiresocks.Stats
+	now   func() time.Time
+	flows map[tcpFlow]*sampledFlow
+}
+
+func newReorderSampler(stats *wiresocks.Stats) *reorderSampler {
+	return &reorderSampler{
+		stats: stats,
+		now:   time.Now,
+		flows: make(map[tcpFlow]*sampledFlow),
+	}
+}
+
+// inbound records a packet read from the tunnel
+func (r *reorderSampler) inbound(pkt []byte) {
+	seg, ok := parseTCPSegment(pkt)
+	if !ok || seg.payload == 0 {
+		return
+	}
+	end := seg.seq + uint32(seg.payload)
+	now := r.now()
+
+	f, tracked := r.flows[seg.flow]
+	if !tracked {
+		if len(r.flows) >= reorderMaxFlows && !r.evictIdle(now) {
+			return
+		}
+		r.flows[seg.flow] = &sampledFlow{next: end, seen: now}
+		return
+	}
+	f.seen = now
+
+	// Sequence numbers wrap, compare them as a signed distance
+	reordered := int32(seg.seq-f.next) < 0
+	if int32(end-f.next) > 0 {
+		f.next = end
+	}
+	r.stats.AddReorderSample(reordered)
+}
+
+// evictIdle forgets the flows idle for longer than reorderFlowIdle and
+// reports whether any was
+func (r *reorderSampler) evictIdle(now time.Time) bool {
+	evicted := false
+	for flow, f := range r.flows {
+		if now.Sub(f.seen) > reorderFlowIdle {
+			delete(r.flows, flow)
+			evicted = true
+		}
+	}
+	return evicted
+}
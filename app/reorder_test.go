@@ -0,0 +1,85 @@
+package app
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+func TestReorderSamplerRate(t *testing.T) {
+	stats := &wiresocks.Stats{}
+	r := newReorderSampler(stats)
+	server := netip.MustParseAddrPort("93.184.216.34:443")
+	client := netip.MustParseAddrPort("172.16.0.2:40000")
+
+	// Swap every tenth pair of 1000 segments, starting near the top of the
+	// sequence space so the stream wraps
+	const segments, payload = 1000, 100
+	order := make([]int, segments)
+	for i := range order {
+		order[i] = i
+	}
+	for i := 0; i+1 < segments; i += 20 {
+		order[i], order[i+1] = order[i+1], order[i]
+	}
+	start := uint32(math.MaxUint32 - 50*payload)
+	for _, i := range order {
+		r.inbound(tcpPacket(server, client, start+uint32(i*payload), 1, tcpACK, 40+payload))
+	}
+	// Pure ACKs carry no data and aren't sampled
+	r.inbound(tcpPacket(server, client, start, 1, tcpACK, 40))
+
+	snap := stats.Snapshot()
+	// The first segment only starts following the flow
+	if snap.ReorderSamples != segments-1 || snap.Reordered != segments/20 {
+		t.Fatalf("samples %d reordered %d, want %d and %d", snap.ReorderSamples, snap.Reordered, segments-1, segments/20)
+	}
+	if rate := snap.ReorderRate(); math.Abs(rate-0.05) > 0.001 {
+		t.Errorf("ReorderRate = %.4f, want 0.05", rate)
+	}
+}
+
+func TestReorderSamplerInOrder(t *testing.T) {
+	stats := &wiresocks.Stats{}
+	r := newReorderSampler(stats)
+	client := netip.MustParseAddrPort("172.16.0.2:40000")
+
+	// Interleaved flows don't count as reordering of each other
+	for seq := uint32(0); seq < 10000; seq += 500 {
+		for port := uint16(1); port <= 3; port++ {
+			r.inbound(tcpPacket(netip.AddrPortFrom(netip.MustParseAddr("93.184.216.34"), port), client, uint32(port)*1_000_000+seq, 1, tcpACK, 540))
+		}
+	}
+	if snap := stats.Snapshot(); snap.Reordered != 0 || snap.ReorderSamples == 0 {
+		t.Errorf("in-order stream: samples %d reordered %d", snap.ReorderSamples, snap.Reordered)
+	}
+}
+
+func TestReorderSamplerFlowLimit(t *testing.T) {
+	stats := &wiresocks.Stats{}
+	r := newReorderSampler(stats)
+	clock := time.Unix(0, 0)
+	r.now = func() time.Time { return clock }
+	server := netip.MustParseAddrPort("93.184.216.34:443")
+
+	flow := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.MustParseAddr("172.16.0.2"), uint16(40000+i))
+	}
+	for i := range reorderMaxFlows + 1 {
+		r.inbound(tcpPacket(server, flow(i), 1000, 1, tcpACK, 140))
+	}
+	if len(r.flows) != reorderMaxFlows {
+		t.Fatalf("%d flows sampled, want at most %d", len(r.flows), reorderMaxFlows)
+	}
+
+	// Once the sampled flows go idle a new one replaces them
+	clock = clock.Add(reorderFlowIdle + time.Second)
+	r.inbound(tcpPacket(server, flow(reorderMaxFlows), 1000, 1, tcpACK, 140))
+	r.inbound(tcpPacket(server, flow(reorderMaxFlows), 900, 1, tcpACK, 140))
+	if snap := stats.Snapshot(); snap.ReorderSamples != 1 || snap.Reordered != 1 {
+		t.Errorf("after eviction: samples %d reordered %d, want 1 and 1", snap.ReorderSamples, snap.Reordered)
+	}
+}
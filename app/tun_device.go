@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun"
+)
+
+// packetDevice is the packet I/O surface used by the MASQUE forwarding loop.
+// It is implemented by netstackTunAdapter (userspace netstack) and
+// kernelTunAdapter (OS TUN device).
+type packetDevice interface {
+	ReadPacket(buf []byte) (int, error)
+	WritePacket(pkt []byte) error
+}
+
+// kernelTunOffset is the headroom reserved in front of every packet handed to an
+// OS TUN device. Linux needs room for the virtio-net header and macOS for the
+// 4-byte address family prefix.
+const kernelTunOffset = 16
+
+// kernelTunMaxSegment is the largest packet (or GSO super-packet) a kernel TUN
+// device may return from a single read.
+const kernelTunMaxSegment = 65535
+
+// kernelTunAdapter wraps an OS TUN device, handling read batching and the
+// header offset the platform drivers require.
+type kernelTunAdapter struct {
+	dev tun.Device
+
+	readMu  sync.Mutex
+	bufs    [][]byte
+	sizes   []int
+	pending [][]byte
+}
+
+func newKernelTunAdapter(dev tun.Device) *kernelTunAdapter {
+	batch := dev.BatchSize()
+	if batch < 1 {
+		batch = 1
+	}
+	bufs := make([][]byte, batch)
+	for i := range bufs {
+		bufs[i] = make([]byte, kernelTunOffset+kernelTunMaxSegment)
+	}
+	return &kernelTunAdapter{
+		dev:   dev,
+		bufs:  bufs,
+		sizes: make([]int, batch),
+	}
+}
+
+func (k *kernelTunAdapter) ReadPacket(buf []byte) (int, error) {
+	k.readMu.Lock()
+	defer k.readMu.Unlock()
+
+	for len(k.pending) == 0 {
+		n, err := k.dev.Read(k.bufs, k.sizes, kernelTunOffset)
+		if err != nil {
+			return 0, err
+		}
+		for i := 0; i < n; i++ {
+			k.pending = append(k.pending, k.bufs[i][kernelTunOffset:kernelTunOffset+k.sizes[i]])
+		}
+	}
+
+	pkt := k.pending[0]
+	k.pending[0] = nil
+	k.pending = k.pending[1:]
+
+	if len(pkt) > len(buf) {
+		return 0, fmt.Errorf("packet of %d bytes exceeds buffer of %d bytes", len(pkt), len(buf))
+	}
+	return copy(buf, pkt), nil
+}
+
+func (k *kernelTunAdapter) WritePacket(pkt []byte) error {
+	buf := make([]byte, kernelTunOffset+len(pkt))
+	copy(buf[kernelTunOffset:], pkt)
+	_, err := k.dev.Write([][]byte{buf}, kernelTunOffset)
+	return err
+}
+
+// errTunUnsupported is returned on platforms where TUN mode is not implemented.
+var errTunUnsupported = errors.New("TUN mode is not supported on this platform")
+
+// systemTun is an OS TUN device attached to the MASQUE tunnel, together with a
+// cleanup function that removes any routes installed for it.
+type systemTun struct {
+	dev     tun.Device
+	cleanup func()
+}
+
+// Close removes the installed routes and closes the device.
+func (s *systemTun) Close() {
+	if s.cleanup != nil {
+		s.cleanup()
+	}
+	_ = s.dev.Close()
+}
+
+// openSystemTun creates the named OS TUN device, assigns the tunnel addresses and
+// routes traffic except the MASQUE endpoint through it: the server-advertised
+// routes if any, all traffic otherwise.
+func openSystemTun(ctx context.Context, l *slog.Logger, name string, mtu int, addrs []netip.Addr, routes []netip.Prefix, endpoint netip.Addr) (*systemTun, error) {
+	dev, err := createSystemTun(name, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN device %s: %w", name, err)
+	}
+
+	realName, err := dev.Name()
+	if err != nil {
+		_ = dev.Close()
+		return nil, fmt.Errorf("failed to get TUN device name: %w", err)
+	}
+
+	cleanup, err := configureSystemTun(ctx, l, realName, mtu, addrs, routes, endpoint)
+	if err != nil {
+		_ = dev.Close()
+		return nil, fmt.Errorf("failed to configure TUN device %s: %w", realName, err)
+	}
+
+	l.Info("TUN device configured", "name", realName, "addresses", addrs, "mtu", mtu)
+	return &systemTun{dev: dev, cleanup: cleanup}, nil
+}
+
+// tunRoutes returns the prefixes to route through the TUN device: advertised,
+// or the default routes if it is empty, limited to the families the device
+// has an address for. Default routes are split into two /1 halves so they
+// take precedence over the system default route without replacing it.
+func tunRoutes(advertised []netip.Prefix, hasV4, hasV6 bool) []netip.Prefix {
+	if len(advertised) == 0 {
+		advertised = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	}
+	var routes []netip.Prefix
+	for _, p := range advertised {
+		if (p.Addr().Is4() && !hasV4) || (p.Addr().Is6() && !hasV6) {
+			continue
+		}
+		if p.Bits() == 0 {
+			half := netip.PrefixFrom(p.Addr(), 1)
+			upper := half.Addr().AsSlice()
+			upper[0] = 0x80
+			high, _ := netip.AddrFromSlice(upper)
+			routes = append(routes, half, netip.PrefixFrom(high, 1))
+			continue
+		}
+		routes = append(routes, p.Masked())
+	}
+	return routes
+}
+
+// runCommand executes a system networking command, including its output in the
+// returned error to make failures diagnosable.
+func runCommand(ctx context.Context, l *slog.Logger, name string, args ...string) (string, error) {
+	l.Debug("running command", "cmd", name, "args", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
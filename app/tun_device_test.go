@@ -0,0 +1,106 @@
+package app
+
+import (
+	"bytes"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/tuntest"
+)
+
+func TestKernelTunAdapterForwarding(t *testing.T) {
+	ch := tuntest.NewChannelTUN()
+	adapter := newKernelTunAdapter(ch.TUN())
+	defer ch.TUN().Close()
+
+	src := netip.MustParseAddr("172.16.0.2")
+	dst := netip.MustParseAddr("1.1.1.1")
+
+	// Packets written by the OS into the TUN device come out of ReadPacket
+	outbound := tuntest.Ping(dst, src)
+	go func() { ch.Outbound <- outbound }()
+
+	buf := make([]byte, 1500)
+	n, err := adapter.ReadPacket(buf)
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	if !bytes.Equal(buf[:n], outbound) {
+		t.Fatalf("ReadPacket returned %x, want %x", buf[:n], outbound)
+	}
+
+	// Packets from the tunnel written with WritePacket reach the OS unchanged
+	inbound := tuntest.Ping(src, dst)
+	errc := make(chan error, 1)
+	go func() { errc <- adapter.WritePacket(inbound) }()
+
+	if got := <-ch.Inbound; !bytes.Equal(got, inbound) {
+		t.Fatalf("device received %x, want %x", got, inbound)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+}
+
+// batchTun returns all queued packets from a single Read call
+type batchTun struct {
+	tun.Device
+	packets [][]byte
+}
+
+func (b *batchTun) BatchSize() int { return 4 }
+
+func (b *batchTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for ; n < len(b.packets) && n < len(bufs); n++ {
+		sizes[n] = copy(bufs[n][offset:], b.packets[n])
+	}
+	b.packets = b.packets[n:]
+	return n, nil
+}
+
+func TestKernelTunAdapterBatchedRead(t *testing.T) {
+	packets := [][]byte{{1}, {2, 2}, {3, 3, 3}}
+	adapter := newKernelTunAdapter(&batchTun{packets: append([][]byte(nil), packets...)})
+
+	buf := make([]byte, 16)
+	for i, want := range packets {
+		n, err := adapter.ReadPacket(buf)
+		if err != nil {
+			t.Fatalf("ReadPacket %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("packet %d = %x, want %x", i, buf[:n], want)
+		}
+	}
+}
+
+func TestTunRoutes(t *testing.T) {
+	tests := []struct {
+		name         string
+		advertised   []string
+		hasV4, hasV6 bool
+		want         []string
+	}{
+		{"defaults", nil, true, true, []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"}},
+		{"defaults v4 only", nil, true, false, []string{"0.0.0.0/1", "128.0.0.0/1"}},
+		{"advertised split", []string{"10.0.0.0/8", "2001:db8::/32"}, true, true, []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{"advertised default", []string{"::/0"}, true, true, []string{"::/1", "8000::/1"}},
+		{"family without address", []string{"10.0.0.0/8", "2001:db8::/32"}, false, true, []string{"2001:db8::/32"}},
+	}
+	for _, tt := range tests {
+		var advertised []netip.Prefix
+		for _, p := range tt.advertised {
+			advertised = append(advertised, netip.MustParsePrefix(p))
+		}
+		var got []string
+		for _, p := range tunRoutes(advertised, tt.hasV4, tt.hasV6) {
+			got = append(got, p.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: tunRoutes() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
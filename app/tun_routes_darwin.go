@@ -0,0 +1,87 @@
+//go:build darwin
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun"
+)
+
+func createSystemTun(name string, mtu int) (tun.Device, error) {
+	return tun.CreateTUN(name, mtu)
+}
+
+// configureSystemTun assigns the tunnel addresses to the utun interface and
+// installs the routes through it, split default routes unless the server
+// advertised narrower ones. A host route keeps the MASQUE
+// endpoint on the original gateway so the tunnel does not loop into itself.
+func configureSystemTun(ctx context.Context, l *slog.Logger, name string, mtu int, addrs []netip.Addr, routes []netip.Prefix, endpoint netip.Addr) (func(), error) {
+	hasV4, hasV6 := false, false
+	for _, addr := range addrs {
+		var err error
+		if addr.Is4() {
+			hasV4 = true
+			_, err = runCommand(ctx, l, "ifconfig", name, "inet", addr.String(), addr.String(), "mtu", strconv.Itoa(mtu), "up")
+		} else {
+			hasV6 = true
+			_, err = runCommand(ctx, l, "ifconfig", name, "inet6", addr.String(), "prefixlen", "128")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cleanup := func() {}
+	if endpoint.IsValid() {
+		family := "-inet"
+		if endpoint.Is6() {
+			family = "-inet6"
+		}
+		out, err := runCommand(ctx, l, "route", "-n", "get", family, endpoint.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up route to MASQUE endpoint: %w", err)
+		}
+		gateway := parseRouteGetGateway(out)
+		if gateway == "" {
+			return nil, fmt.Errorf("no gateway found for MASQUE endpoint %s", endpoint)
+		}
+		if _, err := runCommand(ctx, l, "route", "-n", "add", family, "-host", endpoint.String(), gateway); err != nil {
+			return nil, err
+		}
+		cleanup = func() {
+			if _, err := runCommand(context.Background(), l, "route", "-n", "delete", family, "-host", endpoint.String()); err != nil {
+				l.Warn("failed to remove MASQUE endpoint route", "error", err)
+			}
+		}
+	}
+
+	for _, route := range tunRoutes(routes, hasV4, hasV6) {
+		family := "-inet"
+		if route.Addr().Is6() {
+			family = "-inet6"
+		}
+		if _, err := runCommand(ctx, l, "route", "-n", "add", family, "-net", route.String(), "-interface", name); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	return cleanup, nil
+}
+
+// parseRouteGetGateway extracts the gateway from `route -n get` output.
+func parseRouteGetGateway(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && key == "gateway" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+//go:build linux
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun"
+)
+
+func createSystemTun(name string, mtu int) (tun.Device, error) {
+	return tun.CreateTUN(name, mtu)
+}
+
+// configureSystemTun brings the device up with the tunnel addresses and installs
+// the routes through it, split default routes (0.0.0.0/1 + 128.0.0.0/1 and
+// ::/1 + 8000::/1) unless the server advertised narrower ones.
+// A host route keeps the MASQUE endpoint on the original uplink so the tunnel
+// does not loop into itself.
+func configureSystemTun(ctx context.Context, l *slog.Logger, name string, mtu int, addrs []netip.Addr, routes []netip.Prefix, endpoint netip.Addr) (func(), error) {
+	if _, err := runCommand(ctx, l, "ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up"); err != nil {
+		return nil, err
+	}
+
+	hasV4, hasV6 := false, false
+	for _, addr := range addrs {
+		prefix := netip.PrefixFrom(addr, addr.BitLen())
+		family := "-4"
+		if addr.Is4() {
+			hasV4 = true
+		} else {
+			hasV6 = true
+			family = "-6"
+		}
+		if _, err := runCommand(ctx, l, "ip", family, "addr", "add", prefix.String(), "dev", name); err != nil {
+			return nil, err
+		}
+	}
+
+	cleanup := func() {}
+	if endpoint.IsValid() {
+		family := "-4"
+		if endpoint.Is6() {
+			family = "-6"
+		}
+		out, err := runCommand(ctx, l, "ip", family, "route", "get", endpoint.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up route to MASQUE endpoint: %w", err)
+		}
+		via, dev := parseIPRouteGet(out)
+		if dev == "" {
+			return nil, fmt.Errorf("no route to MASQUE endpoint %s", endpoint)
+		}
+
+		hostRoute := netip.PrefixFrom(endpoint, endpoint.BitLen()).String()
+		args := []string{family, "route", "replace", hostRoute}
+		if via != "" {
+			args = append(args, "via", via)
+		}
+		args = append(args, "dev", dev)
+		if _, err := runCommand(ctx, l, "ip", args...); err != nil {
+			return nil, err
+		}
+		cleanup = func() {
+			if _, err := runCommand(context.Background(), l, "ip", family, "route", "del", hostRoute); err != nil {
+				l.Warn("failed to remove MASQUE endpoint route", "error", err)
+			}
+		}
+	}
+
+	for _, route := range tunRoutes(routes, hasV4, hasV6) {
+		if _, err := runCommand(ctx, l, "ip", "route", "add", route.String(), "dev", name); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	return cleanup, nil
+}
+
+// parseIPRouteGet extracts the gateway and output device from `ip route get` output.
+func parseIPRouteGet(out string) (via, dev string) {
+	fields := strings.Fields(out)
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			via = fields[i+1]
+		case "dev":
+			dev = fields[i+1]
+		}
+	}
+	return via, dev
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun"
+)
+
+func createSystemTun(name string, mtu int) (tun.Device, error) {
+	return nil, errTunUnsupported
+}
+
+func configureSystemTun(ctx context.Context, l *slog.Logger, name string, mtu int, addrs []netip.Addr, routes []netip.Prefix, endpoint netip.Addr) (func(), error) {
+	return nil, errTunUnsupported
+}
@@ -4,14 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/voidr3aper-anon/Vwarp/neterr"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
@@ -20,86 +24,188 @@ import (
 	"github.com/voidr3aper-anon/Vwarp/wiresocks"
 )
 
-func usermodeTunTest(ctx context.Context, l *slog.Logger, tnet *netstack.Net, url string) error {
+// defaultTestURLs are tried by the HTTP connectivity test when no test URLs
+// are configured; the alternates keep one blocked host from failing the test
+var defaultTestURLs = []string{
+	"http://connectivity.cloudflareclient.com/cdn-cgi/trace",
+	"http://cp.cloudflare.com/",
+	"http://www.gstatic.com/generate_204",
+}
+
+// testURLs rotates the HTTP connectivity test through several URLs. Each
+// test starts from the URL that answered last, so a host blocked in the
+// user's region costs one failed request rather than one per test.
+type testURLs struct {
+	urls []string
+	last atomic.Int32
+}
+
+// newTestURLs returns opts.TestURL followed by opts.TestURLs, or by
+// defaultTestURLs when no alternates are configured
+func newTestURLs(opts WarpOptions) *testURLs {
+	alternates := opts.TestURLs
+	if len(alternates) == 0 {
+		alternates = defaultTestURLs
+	}
+	t := &testURLs{}
+	for _, url := range append([]string{opts.TestURL}, alternates...) {
+		if url != "" && !slices.Contains(t.urls, url) {
+			t.urls = append(t.urls, url)
+		}
+	}
+	return t
+}
+
+// singleTestURL wraps one URL for callers that test a fixed host
+func singleTestURL(url string) *testURLs {
+	return &testURLs{urls: []string{url}}
+}
+
+func usermodeTunTest(ctx context.Context, l *slog.Logger, tnet *netstack.Net, urls *testURLs) error {
 	// Wait a bit after handshake to ensure connection is stable
 	time.Sleep(2 * time.Second)
 
-	l.Info("testing connectivity", "url", url)
+	return httpConnectivityTest(ctx, l, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Try tunnel DNS first
+		conn, err := tnet.DialContext(ctx, network, addr)
+		if err != nil {
+			// Log DNS issues but don't fail immediately
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && neterr.IsTimeout(err) {
+				l.Debug("DNS lookup timeout via tunnel", "address", addr, "error", err)
+			}
+		}
+		return conn, err
+	}, urls)
+}
 
+// httpConnectivityTest fetches the test URLs through dial in rotation and
+// passes as soon as one of them answers
+func httpConnectivityTest(ctx context.Context, l *slog.Logger, dial func(ctx context.Context, network, address string) (net.Conn, error), urls *testURLs) error {
 	// Create HTTP client with appropriate timeouts
 	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			// Try tunnel DNS first
-			conn, err := tnet.DialContext(ctx, network, addr)
-			if err != nil {
-				// Log DNS issues but don't fail immediately
-				if strings.Contains(err.Error(), "lookup") && strings.Contains(err.Error(), "timeout") {
-					l.Debug("DNS lookup timeout via tunnel", "address", addr, "error", err)
-				}
-			}
-			return conn, err
-		},
+		DialContext:           dial,
 		MaxIdleConns:          10,
 		IdleConnTimeout:       30 * time.Second,
 		DisableKeepAlives:     false,
 		TLSHandshakeTimeout:   15 * time.Second,
 		ResponseHeaderTimeout: 20 * time.Second,
 	}
+	defer transport.CloseIdleConnections()
 
 	client := http.Client{
 		Timeout:   10 * time.Second,
 		Transport: transport,
 	}
 
-	resp, err := client.Get(url)
-	if err != nil {
-		l.Error("connectivity test failed", "error", err, "url", url)
-		return err
+	if len(urls.urls) == 0 {
+		return errors.New("no connectivity test URLs configured")
 	}
-	defer resp.Body.Close()
+	start := int(urls.last.Load())
+	var errs []error
+	for i := range urls.urls {
+		idx := (start + i) % len(urls.urls)
+		url := urls.urls[idx]
+		l.Info("testing connectivity", "url", url)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			l.Warn("connectivity test failed", "error", err, "url", url)
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		resp.Body.Close()
 
-	l.Info("connectivity test completed successfully", "status", resp.StatusCode, "url", url)
+		urls.last.Store(int32(idx))
+		l.Info("connectivity test completed successfully", "status", resp.StatusCode, "url", url)
+		return nil
+	}
+
+	l.Error("connectivity test failed for every test URL", "tried", len(errs))
+	return fmt.Errorf("all connectivity test URLs failed: %w", errors.Join(errs...))
+}
+
+// enableDoH switches tnet to DNS-over-HTTPS when dohURL is set
+func enableDoH(l *slog.Logger, tnet *netstack.Net, dohURL string) error {
+	if dohURL == "" {
+		return nil
+	}
+	if err := tnet.EnableDoH(dohURL); err != nil {
+		return fmt.Errorf("failed to enable DNS-over-HTTPS: %w", err)
+	}
+	l.Info("resolving through the tunnel with DNS-over-HTTPS", "url", dohURL)
 	return nil
 }
 
-// dnsIndependentConnectivityTest performs a connectivity test without requiring DNS resolution
-func dnsIndependentConnectivityTest(ctx context.Context, l *slog.Logger, tnet *netstack.Net) error {
+// defaultConnectivityTargets are dialed by dnsIndependentConnectivityTest when
+// no targets are configured
+var defaultConnectivityTargets = []string{
+	"1.1.1.1:443",        // Cloudflare DNS
+	"8.8.8.8:443",        // Google DNS
+	"104.16.132.229:443", // Cloudflare CDN
+	"172.67.74.226:443",  // Another Cloudflare IP
+	"104.21.2.20:443",    // Alternative Cloudflare IP
+}
+
+const (
+	// connectivityProbeTimeout bounds each TCP dial of the DNS-independent test
+	connectivityProbeTimeout = 5 * time.Second
+	// connectivitySuccessThreshold successful dials end the test early
+	connectivitySuccessThreshold = 2
+)
+
+// dnsIndependentConnectivityTest performs a connectivity test without requiring DNS resolution.
+// It dials all targets (ip:port) concurrently and returns once enough of them connect,
+// cancelling the remaining dials.
+func dnsIndependentConnectivityTest(ctx context.Context, l *slog.Logger, dial func(ctx context.Context, network, address string) (net.Conn, error), targets []string) error {
 	l.Info("performing DNS-independent connectivity test")
 
-	// Test basic network connectivity by trying to establish a TCP connection
-	// to a known Cloudflare IP address
-	testIPs := []string{
-		"1.1.1.1:443",        // Cloudflare DNS
-		"8.8.8.8:443",        // Google DNS
-		"104.16.132.229:443", // Cloudflare CDN
-		"172.67.74.226:443",  // Another Cloudflare IP
-		"104.21.2.20:443",    // Alternative Cloudflare IP
+	if len(targets) == 0 {
+		targets = defaultConnectivityTargets
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan error, len(targets))
+	for _, addr := range targets {
+		go func() {
+			testCtx, cancel := context.WithTimeout(ctx, connectivityProbeTimeout)
+			defer cancel()
+			conn, err := dial(testCtx, "tcp", addr)
+			if err != nil {
+				l.Debug("TCP connectivity test failed", "address", addr, "error", err)
+				results <- err
+				return
+			}
+			conn.Close()
+			l.Debug("TCP connectivity test succeeded", "address", addr)
+			results <- nil
+		}()
 	}
 
 	successCount := 0
-	for _, addr := range testIPs {
-		testCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		conn, err := tnet.DialContext(testCtx, "tcp", addr)
-		cancel()
-		if err != nil {
-			l.Debug("TCP connectivity test failed", "address", addr, "error", err)
+	for range targets {
+		if err := <-results; err != nil {
 			continue
 		}
-
-		// Successfully connected
-		conn.Close()
 		successCount++
-		l.Debug("TCP connectivity test succeeded", "address", addr)
-
-		// If we get at least 2 successful connections, consider it working
-		if successCount >= 2 {
+		if successCount >= connectivitySuccessThreshold {
 			l.Info("DNS-independent connectivity test passed", "successful_connections", successCount)
 			return nil
 		}
 	}
 
 	if successCount > 0 {
-		l.Info("Partial connectivity detected", "successful_connections", successCount, "total_tested", len(testIPs))
+		l.Info("Partial connectivity detected", "successful_connections", successCount, "total_tested", len(targets))
 		return nil // Accept partial connectivity
 	}
 
@@ -112,7 +218,7 @@ func enhancedConnectivityTest(ctx context.Context, l *slog.Logger, tnet *netstac
 
 	// First try the original test with reasonable timeout
 	testCtx, cancel := context.WithTimeout(ctx, 12*time.Second)
-	if err := usermodeTunTest(testCtx, l, tnet, url); err == nil {
+	if err := usermodeTunTest(testCtx, l, tnet, singleTestURL(url)); err == nil {
 		cancel()
 		return nil
 	}
@@ -131,7 +237,7 @@ func enhancedConnectivityTest(ctx context.Context, l *slog.Logger, tnet *netstac
 	passedTests := 0
 	for _, test := range directTests {
 		testCtx, cancel := context.WithTimeout(ctx, 12*time.Second)
-		if err := usermodeTunTest(testCtx, l, tnet, test.url); err == nil {
+		if err := usermodeTunTest(testCtx, l, tnet, singleTestURL(test.url)); err == nil {
 			cancel()
 			l.Info("Enhanced connectivity test passed", "test", test.name)
 			passedTests++
@@ -148,6 +254,66 @@ func enhancedConnectivityTest(ctx context.Context, l *slog.Logger, tnet *netstac
 	return fmt.Errorf("all enhanced connectivity tests failed")
 }
 
+// DefaultHandshakeTimeout is how long establishWireguard waits for the first
+// handshake when WarpOptions.HandshakeTimeout is not set
+const DefaultHandshakeTimeout = 15 * time.Second
+
+// heavyNoizePresets delay the handshake enough with junk packets that the
+// default handshake timeout is multiplied by heavyNoizeTimeoutFactor
+var heavyNoizePresets = []string{"heavy", "stealth", "gfw"}
+
+const heavyNoizeTimeoutFactor = 2
+
+// HandshakeTimeout returns how long to wait for the WireGuard handshake: the
+// configured timeout, or DefaultHandshakeTimeout scaled up for heavy noize presets
+func HandshakeTimeout(opts WarpOptions) time.Duration {
+	if opts.HandshakeTimeout > 0 {
+		return opts.HandshakeTimeout
+	}
+	if c := opts.UnifiedNoizeConfig; c != nil && c.IsWireGuardEnabled() && slices.Contains(heavyNoizePresets, c.GetWireGuardPreset()) {
+		return heavyNoizeTimeoutFactor * DefaultHandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+// DefaultTricks are the WireGuard handshake tricks tried, in order, when
+// WarpOptions.Tricks is not set
+var DefaultTricks = []string{"t1", "t2"}
+
+// validTricks are the tricks the WireGuard device understands; t0 sends the
+// handshake unchanged
+var validTricks = []string{"t0", "t1", "t2"}
+
+// ValidateTricks reports an error for tricks the WireGuard device doesn't know
+func ValidateTricks(tricks []string) error {
+	for _, t := range tricks {
+		if !slices.Contains(validTricks, t) {
+			return fmt.Errorf("invalid WireGuard trick %q: must be one of %s", t, strings.Join(validTricks, ", "))
+		}
+	}
+	return nil
+}
+
+// tryTricks calls attempt with each trick in turn, DefaultTricks if tricks is
+// empty, until one succeeds. Every outcome is logged so users on hostile
+// networks can see which trick gets through. It returns the trick that
+// worked, or the error of the last one.
+func tryTricks(l *slog.Logger, tricks []string, attempt func(trick string) error) (string, error) {
+	if len(tricks) == 0 {
+		tricks = DefaultTricks
+	}
+	var err error
+	for i, t := range tricks {
+		if err = attempt(t); err != nil {
+			l.Warn("WireGuard trick failed", "trick", t, "attempt", i+1, "of", len(tricks), "error", err)
+			continue
+		}
+		l.Info("WireGuard trick succeeded", "trick", t, "attempt", i+1)
+		return t, nil
+	}
+	return "", err
+}
+
 func waitHandshake(ctx context.Context, l *slog.Logger, dev *device.Device) error {
 	lastHandshakeSecs := "0"
 	for {
@@ -190,7 +356,7 @@ func waitHandshake(ctx context.Context, l *slog.Logger, dev *device.Device) erro
 	return nil
 }
 
-func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wgtun.Device, fwmark uint32, t string, AtomicNoizeConfig *preflightbind.AtomicNoizeConfig, proxyAddress string) error {
+func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wgtun.Device, fwmark uint32, t string, AtomicNoizeConfig *preflightbind.AtomicNoizeConfig, proxyAddress string, timeout time.Duration) error {
 	// create the IPC message to establish the wireguard conn
 	var request bytes.Buffer
 
@@ -252,6 +418,7 @@ func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wg
 			AtomicNoizeConfig,
 			preflightPort,        // extracted port for preflight packets
 			100*time.Millisecond, // minimum interval between preflights (reduced from 1 second)
+			l,
 		)
 		if err != nil {
 			l.Error("failed to create AtomicNoize bind", "error", err)
@@ -274,7 +441,7 @@ func establishWireguard(l *slog.Logger, conf *wiresocks.Configuration, tunDev wg
 		return err
 	}
 
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	if err := waitHandshake(ctx, l, dev); err != nil {
 		dev.BindClose()
@@ -0,0 +1,242 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/config/noize"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+	"github.com/voidr3aper-anon/Vwarp/wiresocks"
+)
+
+func TestDNSIndependentConnectivityTestConcurrent(t *testing.T) {
+	reachable := map[string]bool{"10.0.0.1:443": true, "10.0.0.2:443": true}
+	targets := []string{"10.0.0.9:443", "10.0.0.1:443", "10.0.0.8:443", "10.0.0.2:443"}
+
+	cancelled := make(chan string, len(targets))
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if reachable[address] {
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		// Unreachable targets hang until the test gives up on them
+		<-ctx.Done()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			cancelled <- address
+		}
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	err := dnsIndependentConnectivityTest(t.Context(), slog.New(slog.DiscardHandler), dial, targets)
+	if err != nil {
+		t.Fatalf("dnsIndependentConnectivityTest: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= connectivityProbeTimeout {
+		t.Fatalf("test waited %s for unreachable targets", elapsed)
+	}
+
+	for range 2 {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("dials to unreachable targets were not cancelled")
+		}
+	}
+}
+
+func TestDNSIndependentConnectivityTestAllFail(t *testing.T) {
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	err := dnsIndependentConnectivityTest(t.Context(), slog.New(slog.DiscardHandler), dial, []string{"10.0.0.1:443", "10.0.0.2:443"})
+	if err == nil {
+		t.Fatal("connectivity test passed with no reachable target")
+	}
+}
+
+func TestHTTPConnectivityTestRotatesPastFailedURL(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// A port nothing listens on stands in for a host blocked in the user's region
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := "http://" + closed.Addr().String() + "/"
+	closed.Close()
+
+	var dialer net.Dialer
+	l := slog.New(slog.DiscardHandler)
+	urls := newTestURLs(WarpOptions{TestURL: blocked, TestURLs: []string{blocked + "also", srv.URL}})
+	if len(urls.urls) != 3 {
+		t.Fatalf("test URLs = %v, want 3 distinct", urls.urls)
+	}
+
+	if err := httpConnectivityTest(t.Context(), l, dialer.DialContext, urls); err != nil {
+		t.Fatalf("httpConnectivityTest = %v, want pass via %s", err, srv.URL)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("working URL hit %d times, want 1", hits.Load())
+	}
+
+	// The next test starts from the URL that answered
+	if err := httpConnectivityTest(t.Context(), l, dialer.DialContext, urls); err != nil {
+		t.Fatalf("second httpConnectivityTest = %v", err)
+	}
+	if got := urls.urls[urls.last.Load()]; got != srv.URL {
+		t.Fatalf("rotation starts at %s, want %s", got, srv.URL)
+	}
+
+	srv.Close()
+	if err := httpConnectivityTest(t.Context(), l, dialer.DialContext, urls); err == nil {
+		t.Fatal("httpConnectivityTest passed with every URL down")
+	}
+}
+
+func TestNewTestURLsDefaults(t *testing.T) {
+	urls := newTestURLs(WarpOptions{TestURL: defaultTestURLs[0]})
+	if !slices.Equal(urls.urls, defaultTestURLs) {
+		t.Fatalf("test URLs = %v, want %v", urls.urls, defaultTestURLs)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	heavy := &noize.UnifiedNoizeConfig{}
+	heavy.EnableWireGuard("stealth")
+	light := &noize.UnifiedNoizeConfig{}
+	light.EnableWireGuard("light")
+
+	tests := []struct {
+		name string
+		opts WarpOptions
+		want time.Duration
+	}{
+		{"default", WarpOptions{}, DefaultHandshakeTimeout},
+		{"light preset", WarpOptions{UnifiedNoizeConfig: light}, DefaultHandshakeTimeout},
+		{"heavy preset", WarpOptions{UnifiedNoizeConfig: heavy}, heavyNoizeTimeoutFactor * DefaultHandshakeTimeout},
+		{"configured", WarpOptions{HandshakeTimeout: 40 * time.Second}, 40 * time.Second},
+		{"configured with heavy preset", WarpOptions{HandshakeTimeout: 5 * time.Second, UnifiedNoizeConfig: heavy}, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := HandshakeTimeout(tt.opts); got != tt.want {
+			t.Errorf("%s: HandshakeTimeout = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTryTricksHonorsOrderAndLogsOutcomes(t *testing.T) {
+	var logs strings.Builder
+	l := slog.New(slog.NewTextHandler(&logs, nil))
+
+	var tried []string
+	trick, err := tryTricks(l, []string{"t2", "t1", "t0"}, func(trick string) error {
+		tried = append(tried, trick)
+		if trick == "t2" {
+			return errors.New("handshake did not complete")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tryTricks: %v", err)
+	}
+	if trick != "t1" {
+		t.Errorf("trick = %q, want t1", trick)
+	}
+	if want := []string{"t2", "t1"}; !slices.Equal(tried, want) {
+		t.Errorf("tried %v, want %v", tried, want)
+	}
+	for _, want := range []string{
+		`msg="WireGuard trick failed" trick=t2 attempt=1 of=3 error="handshake did not complete"`,
+		`msg="WireGuard trick succeeded" trick=t1 attempt=2`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log missing %s:\n%s", want, logs.String())
+		}
+	}
+
+	tried = nil
+	_, err = tryTricks(slog.New(slog.DiscardHandler), nil, func(trick string) error {
+		tried = append(tried, trick)
+		return errors.New("blocked")
+	})
+	if err == nil || err.Error() != "blocked" {
+		t.Errorf("err = %v, want the last trick's error", err)
+	}
+	if !slices.Equal(tried, DefaultTricks) {
+		t.Errorf("tried %v, want the default %v", tried, DefaultTricks)
+	}
+}
+
+func TestValidateTricks(t *testing.T) {
+	if err := ValidateTricks([]string{"t0", "t2", "t1"}); err != nil {
+		t.Errorf("ValidateTricks: %v", err)
+	}
+	if err := ValidateTricks([]string{"t1", "t3"}); err == nil {
+		t.Error("ValidateTricks accepted t3")
+	}
+}
+
+func TestEstablishWireguardHandshakeTimeout(t *testing.T) {
+	// The peer never answers, so only the configured timeout ends the wait
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &wiresocks.Configuration{
+		Interface: &wiresocks.InterfaceConfig{
+			PrivateKey: hex.EncodeToString(privKey.Bytes()),
+			Addresses:  []netip.Addr{netip.MustParseAddr("172.16.0.2")},
+			MTU:        singleMTU,
+		},
+		Peers: []wiresocks.PeerConfig{{
+			PublicKey:    hex.EncodeToString(peerKey.PublicKey().Bytes()),
+			PreSharedKey: strings.Repeat("0", 64),
+			Endpoint:     peer.LocalAddr().String(),
+			AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		}},
+	}
+	tunDev, _, err := netstack.CreateNetTUN(conf.Interface.Addresses, nil, conf.Interface.MTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = establishWireguard(slog.New(slog.DiscardHandler), conf, tunDev, 0, "t0", nil, "", 200*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("establishWireguard = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// waitHandshake polls once a second
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("handshake wait took %s with a 200ms timeout", elapsed)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -169,17 +170,27 @@ func (p *SimpleProxy) handleConnection(conn net.Conn) {
 }
 
 func (p *SimpleProxy) socks5Handshake(conn net.Conn) error {
-	buf := make([]byte, 258)
-	n, err := conn.Read(buf)
-	if err != nil {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
 		return fmt.Errorf("failed to read handshake: %v", err)
 	}
 
-	if n < 3 || buf[0] != 0x05 {
+	if header[0] != 0x05 {
 		return fmt.Errorf("invalid SOCKS5 version")
 	}
 
-	_, err = conn.Write([]byte{0x05, 0x00})
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("failed to read auth methods: %v", err)
+	}
+
+	// Only no-auth (0x00) is supported; anything else, e.g. GSS-API (0x01) alone, is refused
+	if bytes.IndexByte(methods, 0x00) == -1 {
+		conn.Write([]byte{0x05, 0xff})
+		return fmt.Errorf("client offered no supported auth method: %x", methods)
+	}
+
+	_, err := conn.Write([]byte{0x05, 0x00})
 	return err
 }
 
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// adminTokenEnv is the environment variable the admin API token is read from
+const adminTokenEnv = "VWARP_ADMIN_TOKEN"
+
+// resolveAdminToken sets the admin API token from --admin-token-file,
+// VWARP_ADMIN_TOKEN or --admin-token, in that order of precedence, so it need
+// not appear in process listings
+func (c *rootConfig) resolveAdminToken() error {
+	if c.adminTokenFile != "" {
+		data, err := os.ReadFile(c.adminTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read admin token file: %w", err)
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return errors.New("admin token file is empty")
+		}
+		c.adminToken = token
+		return nil
+	}
+	if token := strings.TrimSpace(os.Getenv(adminTokenEnv)); token != "" {
+		c.adminToken = token
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveAdminTokenPrecedence(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		tokenFile string
+		env       string
+		flag      string
+		want      string
+	}{
+		{"file over env and flag", tokenFile, "env-token", "flag-token", "file-token"},
+		{"env over flag", "", "env-token", "flag-token", "env-token"},
+		{"flag", "", "", "flag-token", "flag-token"},
+		{"none", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(adminTokenEnv, tt.env)
+			c := &rootConfig{adminToken: tt.flag, adminTokenFile: tt.tokenFile}
+			if err := c.resolveAdminToken(); err != nil {
+				t.Fatalf("resolveAdminToken: %v", err)
+			}
+			if c.adminToken != tt.want {
+				t.Fatalf("admin token = %q, want %q", c.adminToken, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveAdminTokenBadFile(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, []byte(" \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, filepath.Join(t.TempDir(), "missing")} {
+		c := &rootConfig{adminToken: "flag-token", adminTokenFile: path}
+		if err := c.resolveAdminToken(); err == nil {
+			t.Errorf("resolveAdminToken accepted %s", path)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+	"github.com/voidr3aper-anon/Vwarp/config"
+)
+
+func configCmd(rootConfig *rootConfig) {
+	var jsonOutput bool
+	validateFlags := ff.NewFlagSet("validate")
+	validateFlags.AddFlag(ff.FlagConfig{
+		LongName: "json",
+		Value:    ffval.NewValueDefault(&jsonOutput, false),
+		Usage:    "print the result as JSON",
+	})
+
+	validate := &ff.Command{
+		Name:      "validate",
+		Usage:     appName + " config validate [--json] PATH",
+		ShortHelp: "checks a configuration file without connecting",
+		Flags:     validateFlags,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) != 1 {
+				return errors.New("expected exactly one configuration file")
+			}
+			report := config.ValidateFile(args[0])
+			var err error
+			if jsonOutput {
+				err = report.WriteJSON(rootConfig.out())
+			} else {
+				err = report.WriteText(rootConfig.out())
+			}
+			if err != nil {
+				return err
+			}
+			return report.Err()
+		},
+	}
+
+	command := &ff.Command{
+		Name:        "config",
+		Usage:       appName + " config SUBCOMMAND",
+		ShortHelp:   "works with unified configuration files",
+		Subcommands: []*ff.Command{validate},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidateExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	if err := os.WriteFile(valid, []byte(`{"masque": {"enabled": true}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"acl": {"allow": ["example.com:0"]}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		cfg := newRootCmd()
+		configCmd(cfg)
+		cfg.stdout = &out
+		err := cfg.command.ParseAndRun(context.Background(), append([]string{"config", "validate"}, args...))
+		return out.String(), err
+	}
+
+	if out, err := validate(valid); err != nil {
+		t.Fatalf("valid config: error = %v\n%s", err, out)
+	}
+
+	// main exits with status 1 on the error
+	out, err := validate(invalid)
+	if err == nil || !strings.Contains(err.Error(), "configuration is invalid") {
+		t.Fatalf("invalid config: error = %v, want the configuration to be rejected", err)
+	}
+	if !strings.Contains(out, "invalid") || !strings.Contains(out, "error: invalid acl") {
+		t.Errorf("invalid config report:\n%s", out)
+	}
+
+	out, err = validate("--json", invalid)
+	if err == nil {
+		t.Fatal("invalid config with --json: no error")
+	}
+	var report struct {
+		Valid  bool     `json:"valid"`
+		Errors []string `json:"errors"`
+	}
+	if jerr := json.Unmarshal([]byte(out), &report); jerr != nil || report.Valid || len(report.Errors) == 0 {
+		t.Errorf("invalid config JSON report = %+v (%v):\n%s", report, jerr, out)
+	}
+
+	if _, err := validate(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing config: no error")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+	"github.com/voidr3aper-anon/Vwarp/app"
+	"github.com/voidr3aper-anon/Vwarp/masque"
+)
+
+func connectionTestCmd(rootConfig *rootConfig) {
+	var jsonOutput, benchmarkPresets bool
+	var transfers app.ThroughputOptions
+	flags := ff.NewFlagSet("connection-test").SetParent(rootConfig.flags)
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "json",
+		Value:    ffval.NewValueDefault(&jsonOutput, false),
+		Usage:    "print results as JSON",
+	})
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "benchmark-presets",
+		Value:    ffval.NewValueDefault(&benchmarkPresets, false),
+		Usage:    "instead of the test suite, compare connect time, throughput and overhead of every noize preset",
+	})
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "download-url",
+		Value:    ffval.NewValueDefault(&transfers.DownloadURL, "https://speed.cloudflare.com/__down?bytes=10485760"),
+		Usage:    "URL downloaded through each tunnel by --benchmark-presets",
+	})
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "upload-url",
+		Value:    ffval.NewValueDefault(&transfers.UploadURL, "https://speed.cloudflare.com/__up"),
+		Usage:    "URL that receives an upload through each tunnel by --benchmark-presets, empty to skip the upload",
+	})
+
+	command := &ff.Command{
+		Name:      "connection-test",
+		Usage:     appName + " connection-test [FLAGS]",
+		ShortHelp: "brings up a MASQUE tunnel and checks addressing, routes, ICMP and MTU",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			if benchmarkPresets {
+				rows, err := rootConfig.runPresetThroughput(ctx, transfers)
+				if len(rows) > 0 {
+					var werr error
+					if jsonOutput {
+						werr = writePresetThroughputJSON(rootConfig.out(), rows)
+					} else {
+						werr = writePresetThroughputText(rootConfig.out(), rows)
+					}
+					if werr != nil {
+						return werr
+					}
+				}
+				return err
+			}
+
+			suite, err := rootConfig.runConnectionTest(ctx)
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				err = writeSuiteJSON(rootConfig.out(), suite)
+			} else {
+				err = writeSuiteText(rootConfig.out(), suite)
+			}
+			if err != nil {
+				return err
+			}
+			if !suite.Passed() {
+				return errors.New("connection test failed")
+			}
+			return nil
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
+
+// runConnectionTest runs the MASQUE connection test suite against the
+// endpoint selected by the root flags
+func (c *rootConfig) runConnectionTest(ctx context.Context) (*masque.SuiteResult, error) {
+	endpoint, err := c.connectionTestEndpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	l := c.newLogger(os.Stderr, c.logLevel())
+	closeQUICLog, err := setQUICLog(c.quicLog, l)
+	if err != nil {
+		return nil, err
+	}
+	defer closeQUICLog()
+	opts, err := c.masqueTestOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.MasqueNoize, opts.MasqueNoizePreset = c.noize, c.noizePreset
+	return app.RunMasqueTestSuite(ctx, l, opts, endpoint, masque.TestOptions{})
+}
+
+// runPresetThroughput compares the noize presets against the endpoint
+// selected by the root flags, timing transfers
+func (c *rootConfig) runPresetThroughput(ctx context.Context, transfers app.ThroughputOptions) ([]app.PresetThroughput, error) {
+	endpoint, err := c.connectionTestEndpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	l := c.newLogger(os.Stderr, c.logLevel())
+	closeQUICLog, err := setQUICLog(c.quicLog, l)
+	if err != nil {
+		return nil, err
+	}
+	defer closeQUICLog()
+	opts, err := c.masqueTestOptions()
+	if err != nil {
+		return nil, err
+	}
+	return app.BenchmarkPresetThroughput(ctx, l, opts, endpoint, transfers)
+}
+
+// connectionTestEndpoint returns the endpoint set by the root flags, or a
+// random MASQUE endpoint of the allowed address families
+func (c *rootConfig) connectionTestEndpoint() (string, error) {
+	if c.v4 && c.v6 {
+		return "", errors.New("can't force v4 and v6 at the same time")
+	}
+	if err := c.resolveLicense(); err != nil {
+		return "", err
+	}
+	v4, v6 := c.v4, c.v6
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+
+	if c.endpoint != "" {
+		return c.endpoint, nil
+	}
+	addrPort, err := randomMasqueEndpoint(v4, v6)
+	if err != nil {
+		return "", err
+	}
+	return addrPort.String(), nil
+}
+
+func writeSuiteJSON(w io.Writer, suite *masque.SuiteResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(suite)
+}
+
+func writeSuiteText(w io.Writer, suite *masque.SuiteResult) error {
+	fmt.Fprintf(w, "endpoint %s, source %s, target %s\n\n", suite.Endpoint, suite.Source, suite.Target)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAILS")
+	for _, r := range suite.Results {
+		result := "FAIL"
+		switch {
+		case r.Skipped:
+			result = "SKIP"
+		case r.Passed:
+			result = "PASS"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, result, r.Message)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nfinished in %s\n", suite.Duration.Round(time.Millisecond))
+	return err
+}
+
+func writePresetThroughputJSON(w io.Writer, rows []app.PresetThroughput) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+func writePresetThroughputText(w io.Writer, rows []app.PresetThroughput) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRESET\tCONNECT\tDOWN (Mbps)\tUP (Mbps)\tOVERHEAD\tERROR")
+	for _, r := range rows {
+		errText := "-"
+		if r.Error != "" {
+			errText = r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\t%.1f\t%.1f%%\t%s\n", r.Preset, r.ConnectTime.Round(time.Millisecond), r.DownloadMbps, r.UploadMbps, r.Overhead*100, errText)
+	}
+	return tw.Flush()
+}
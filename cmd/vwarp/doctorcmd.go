@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffval"
+	"github.com/voidr3aper-anon/Vwarp/app"
+	"github.com/voidr3aper-anon/Vwarp/doctor"
+	"github.com/voidr3aper-anon/Vwarp/iputils"
+	"github.com/voidr3aper-anon/Vwarp/masque"
+)
+
+func doctorCmd(rootConfig *rootConfig) {
+	var jsonOutput bool
+	flags := ff.NewFlagSet("doctor").SetParent(rootConfig.flags)
+	flags.AddFlag(ff.FlagConfig{
+		LongName: "json",
+		Value:    ffval.NewValueDefault(&jsonOutput, false),
+		Usage:    "print findings as JSON",
+	})
+
+	command := &ff.Command{
+		Name:      "doctor",
+		Usage:     appName + " doctor [FLAGS]",
+		ShortHelp: "diagnoses common setup problems",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			findings, err := rootConfig.runDoctor(ctx)
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				err = doctor.WriteJSON(rootConfig.out(), findings)
+			} else {
+				err = doctor.WriteText(rootConfig.out(), findings)
+			}
+			if err != nil {
+				return err
+			}
+			if !doctor.Healthy(findings) {
+				return errors.New("doctor found critical problems")
+			}
+			return nil
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
+
+// runDoctor probes the endpoint, resolver and local setup selected by the root flags
+func (c *rootConfig) runDoctor(ctx context.Context) ([]doctor.Finding, error) {
+	if c.v4 && c.v6 {
+		return nil, errors.New("can't force v4 and v6 at the same time")
+	}
+	if err := c.resolveLicense(); err != nil {
+		return nil, err
+	}
+	v4, v6 := c.v4, c.v6
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+
+	// MASQUE always uses port 443, whatever port was given for WireGuard
+	endpoint := c.endpoint
+	if endpoint == "" {
+		addrPort, err := randomMasqueEndpoint(v4, v6)
+		if err != nil {
+			return nil, err
+		}
+		endpoint = addrPort.String()
+	} else if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		endpoint = net.JoinHostPort(host, "443")
+	} else {
+		endpoint = net.JoinHostPort(endpoint, "443")
+	}
+
+	opts := doctor.Options{
+		ConfigPath: c.config,
+		Endpoint:   endpoint,
+		SNI:        masque.DefaultMasqueSNI,
+		DNS:        net.JoinHostPort(c.dns, "53"),
+		DNSName:    masque.DefaultMasqueSNI,
+		MTUProbe: func() (int, error) {
+			minMTU, _, _, err := iputils.DetectNetworkMTU()
+			return minMTU, err
+		},
+	}
+	if v6 {
+		opts.IPv6Target = "[2606:4700:4700::1111]:53"
+	}
+
+	warpOpts, err := c.masqueTestOptions()
+	if err != nil {
+		return nil, err
+	}
+	configPath, err := app.MasqueConfigPath(warpOpts)
+	if err != nil {
+		return nil, err
+	}
+	// Checked before the test tunnel registers a device
+	masqueConfig := checkMasqueConfig(configPath)
+
+	// The DNS check resolves through a test tunnel, and fails when it doesn't come up
+	l := c.newLogger(os.Stderr, c.logLevel())
+	dial, stop, err := app.DialMasqueTunnel(ctx, l, warpOpts, endpoint)
+	if err != nil {
+		tunnelErr := err
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, tunnelErr
+		}
+	} else {
+		defer stop()
+	}
+	opts.TunnelDial = dial
+
+	findings := doctor.Run(ctx, opts)
+	findings = append(findings, masqueConfig)
+	if app.QUICBlocked(warpOpts) {
+		findings = append(findings, doctor.Finding{
+			Check:    "quic-block",
+			Severity: doctor.SeverityWarning,
+			Message:  "this network is remembered as blocking QUIC, so --masque-preferred skips MASQUE",
+			Fix:      "run with --reset-quic-block to probe MASQUE again",
+		})
+	}
+
+	doctor.Sort(findings)
+	return findings, nil
+}
+
+// checkMasqueConfig reports whether the stored MASQUE registration is usable
+func checkMasqueConfig(configPath string) doctor.Finding {
+	f := doctor.Finding{Check: "masque-config"}
+
+	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
+		f.Severity = doctor.SeverityInfo
+		f.Message = "no MASQUE registration yet; one is created on the first MASQUE run"
+		return f
+	}
+	if _, _, err := masque.KeyFingerprints(configPath); err != nil {
+		f.Severity = doctor.SeverityCritical
+		f.Message = fmt.Sprintf("%s is unusable: %v", configPath, err)
+		f.Fix = fmt.Sprintf("delete %s so a fresh MASQUE registration is created", configPath)
+		return f
+	}
+
+	f.Severity = doctor.SeverityOK
+	f.Message = fmt.Sprintf("%s holds a valid MASQUE registration", configPath)
+	return f
+}
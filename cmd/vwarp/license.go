@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// licenseEnv is the environment variable the WARP license key is read from
+const licenseEnv = "WARP_LICENSE"
+
+// redactedKey replaces the license key in log output
+const redactedKey = "[REDACTED]"
+
+// resolveLicense sets the license key from --key-file, WARP_LICENSE or --key,
+// in that order of precedence, so it need not appear in process listings
+func (c *rootConfig) resolveLicense() error {
+	if c.keyFile != "" {
+		data, err := os.ReadFile(c.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read key file: %w", err)
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return errors.New("key file is empty")
+		}
+		c.key = key
+		return nil
+	}
+	if key := strings.TrimSpace(os.Getenv(licenseEnv)); key != "" {
+		c.key = key
+	}
+	return nil
+}
+
+// newLogger returns a text logger writing to w that redacts the license key,
+// and installs it as the slog default so that library code logging through
+// the global logger is redacted too
+func (c *rootConfig) newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	l := slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: c.redactKey,
+	}))
+	slog.SetDefault(l)
+	return l
+}
+
+// redactKey replaces the license key wherever it appears in a log attribute,
+// including the message and formatted errors
+func (c *rootConfig) redactKey(_ []string, a slog.Attr) slog.Attr {
+	if c.key == "" || a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	if s := a.Value.String(); strings.Contains(s, c.key) {
+		a.Value = slog.StringValue(strings.ReplaceAll(s, c.key, redactedKey))
+	}
+	return a
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveLicensePrecedence(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "license")
+	if err := os.WriteFile(keyFile, []byte("file-key-1234\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keyFile string
+		env     string
+		flag    string
+		want    string
+	}{
+		{"file over env and flag", keyFile, "env-key", "flag-key", "file-key-1234"},
+		{"env over flag", "", "env-key", "flag-key", "env-key"},
+		{"flag", "", "", "flag-key", "flag-key"},
+		{"none", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(licenseEnv, tt.env)
+			c := &rootConfig{key: tt.flag, keyFile: tt.keyFile}
+			if err := c.resolveLicense(); err != nil {
+				t.Fatalf("resolveLicense: %v", err)
+			}
+			if c.key != tt.want {
+				t.Fatalf("key = %q, want %q", c.key, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveLicenseBadFile(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, []byte(" \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, filepath.Join(t.TempDir(), "missing")} {
+		c := &rootConfig{key: "flag-key", keyFile: path}
+		if err := c.resolveLicense(); err == nil {
+			t.Errorf("resolveLicense accepted %s", path)
+		}
+	}
+}
+
+func TestLoggerRedactsLicense(t *testing.T) {
+	const key = "x1Y2z3W4-a5B6c7D8-e9F0g1H2"
+	keyFile := filepath.Join(t.TempDir(), "license")
+	if err := os.WriteFile(keyFile, []byte(key), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &rootConfig{keyFile: keyFile}
+	if err := c.resolveLicense(); err != nil {
+		t.Fatalf("resolveLicense: %v", err)
+	}
+
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	var out bytes.Buffer
+	l := c.newLogger(&out, slog.LevelDebug)
+	l.Info("updating license " + key)
+	slog.Info("library", "license", key) // Through the global logger
+	l.Debug("account", "license", key, "error", fmt.Errorf("update %s: %w", key, errors.New("denied")))
+	l.WithGroup("warp").Warn("retry", "body", `{"license":"`+key+`"}`)
+	l.With("key", key).Error("failed")
+
+	if strings.Contains(out.String(), key) {
+		t.Fatalf("license key in log output:\n%s", out.String())
+	}
+	if got := strings.Count(out.String(), redactedKey); got != 6 {
+		t.Fatalf("%d redactions, want 6:\n%s", got, out.String())
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -16,67 +15,24 @@ import (
 
 const appName = "vwarp"
 
-// customLogWriter intercepts standard log output and reformats it as structured logs
-type customLogWriter struct {
-	logger *slog.Logger
-}
-
-func (w *customLogWriter) Write(p []byte) (n int, err error) {
-	msg := string(p)
-	// Remove trailing newline
-	if len(msg) > 0 && msg[len(msg)-1] == '\n' {
-		msg = msg[:len(msg)-1]
-	}
-
-	// Check for common QUIC/HTTP3 messages and categorize them
-	switch {
-	case contains(msg, "handling stream failed"):
-		if contains(msg, "H3_NO_ERROR") {
-			w.logger.Debug("QUIC stream closed gracefully", "details", msg)
-		} else {
-			w.logger.Warn("QUIC stream failed", "details", msg)
-		}
-	case contains(msg, "writing to stream failed"):
-		w.logger.Debug("Stream write failed during connection cleanup", "details", msg)
-	case contains(msg, "failed to increase receive buffer size"):
-		w.logger.Debug("UDP buffer size notice", "details", msg)
-	default:
-		// For any other QUIC library messages
-		w.logger.Debug("QUIC library message", "details", msg)
-	}
-
-	return len(p), nil
-}
-
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr ||
-		(len(s) > len(substr) &&
-			(s[:len(substr)] == substr ||
-				findInString(s, substr))))
-}
-
-func findInString(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
-		}
-	}
-	return false
-}
-
 func main() {
 	// Set up structured logging
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}))
 
-	// Intercept standard log output (used by QUIC library) and format it nicely
-	log.SetOutput(&customLogWriter{logger: logger})
+	// Intercept standard log output (used by QUIC library) and format it
+	// nicely until the command sets it up according to --quic-log
+	_, _ = setQUICLog("", logger)
 
 	args := os.Args[1:]
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	rootCmd := newRootCmd()
 	versionCmd(rootCmd)
+	doctorCmd(rootCmd)
+	configCmd(rootCmd)
+	noizeBenchCmd(rootCmd)
+	connectionTestCmd(rootCmd)
 	err := rootCmd.command.Parse(args)
 
 	switch {
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/voidr3aper-anon/Vwarp/app"
+)
+
+func noizeBenchCmd(rootConfig *rootConfig) {
+	flags := ff.NewFlagSet("noize-bench").SetParent(rootConfig.flags)
+
+	command := &ff.Command{
+		Name:      "noize-bench",
+		Usage:     appName + " noize-bench [FLAGS]",
+		ShortHelp: "finds the lightest MASQUE noize preset that reliably connects",
+		Flags:     flags,
+		Exec: func(ctx context.Context, args []string) error {
+			return rootConfig.runNoizeBench(ctx, rootConfig.out())
+		},
+	}
+	rootConfig.command.Subcommands = append(rootConfig.command.Subcommands, command)
+}
+
+// runNoizeBench benchmarks the noize presets against the endpoint selected by
+// the root flags and writes the results and recommendation to w
+func (c *rootConfig) runNoizeBench(ctx context.Context, w io.Writer) error {
+	if c.v4 && c.v6 {
+		return errors.New("can't force v4 and v6 at the same time")
+	}
+	if err := c.resolveLicense(); err != nil {
+		return err
+	}
+	opts, err := c.masqueTestOptions()
+	if err != nil {
+		return err
+	}
+	v4, v6 := c.v4, c.v6
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+
+	endpoint := c.endpoint
+	if endpoint == "" {
+		addrPort, err := randomMasqueEndpoint(v4, v6)
+		if err != nil {
+			return err
+		}
+		endpoint = addrPort.String()
+	}
+
+	l := c.newLogger(os.Stderr, c.logLevel())
+	closeQUICLog, err := setQUICLog(c.quicLog, l)
+	if err != nil {
+		return err
+	}
+	defer closeQUICLog()
+	results, preset, err := app.BenchmarkNoizePresets(ctx, l, opts, endpoint)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRESET\tCONNECTED\tLATENCY\tLAST ERROR")
+	for _, r := range results {
+		lastErr := "-"
+		if r.Err != nil {
+			lastErr = r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%s\n", r.Preset, r.Successes, r.Attempts, r.Latency, lastErr)
+	}
+	if ferr := tw.Flush(); ferr != nil {
+		return ferr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nrecommended preset: %s (run with --masque --noize --noize-preset %s, or --auto-noize)\n", preset, preset)
+	return nil
+}
+
+// masqueTestOptions returns the MASQUE connection settings of the root flags
+// for the test tunnels of the diagnostic subcommands, so they dial the way
+// the tunnel would
+func (c *rootConfig) masqueTestOptions() (app.WarpOptions, error) {
+	sourcePortRange, err := c.sourcePortRange()
+	if err != nil {
+		return app.WarpOptions{}, err
+	}
+	return app.WarpOptions{
+		License:          c.key,
+		CacheDir:         c.resolveCacheDir(),
+		Profile:          c.profile,
+		MasqueALPN:       c.alpn,
+		ConnectURI:       c.connectURI,
+		EgressIface:      c.egressIface,
+		SourcePort:       c.sourcePort,
+		SourcePortRange:  sourcePortRange,
+		StableSourcePort: c.stableSourcePort,
+		CertValidity:     c.certValidity,
+		CertName:         c.certName,
+		CertSANs:         c.certSANs,
+		ConnectURIs:      c.connectURIs,
+		ConnectProtocol:  c.connectProto,
+	}, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/voidr3aper-anon/Vwarp/masque"
+)
+
+// quicLogStderr as --quic-log passes the QUIC library's log output to stderr verbatim
+const quicLogStderr = "stderr"
+
+// customLogWriter intercepts standard log output and reformats it as structured logs
+type customLogWriter struct {
+	logger *slog.Logger
+}
+
+func (w *customLogWriter) Write(p []byte) (n int, err error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+
+	// Check for common QUIC/HTTP3 messages and categorize them
+	switch {
+	case strings.Contains(msg, "handling stream failed"):
+		if strings.Contains(msg, "H3_NO_ERROR") {
+			w.logger.Debug("QUIC stream closed gracefully", "details", msg)
+		} else {
+			w.logger.Warn("QUIC stream failed", "details", msg)
+		}
+	case strings.Contains(msg, "writing to stream failed"):
+		w.logger.Debug("Stream write failed during connection cleanup", "details", msg)
+	case strings.Contains(msg, "receive buffer size"), strings.Contains(msg, "send buffer size"):
+		// Also "failed to sufficiently increase ..." when the kernel caps the size
+		w.logger.Debug("UDP buffer size notice", "details", msg)
+		masque.WarnUDPBufferLimit(w.logger, "details", msg)
+	case strings.Contains(msg, "invalid IPv4 packet info"), strings.Contains(msg, "invalid IPv6 packet info"):
+		w.logger.Warn("QUIC packet info notice", "details", msg)
+	default:
+		// Unrecognized messages may matter, keep them visible
+		w.logger.Info("QUIC library message", "details", msg)
+	}
+
+	return len(p), nil
+}
+
+// setQUICLog routes standard log output, which the QUIC library writes to:
+// through l, categorized, when dest is empty, verbatim to stderr when it is
+// quicLogStderr, or else verbatim to the file dest. The returned func closes
+// the file.
+func setQUICLog(dest string, l *slog.Logger) (func(), error) {
+	switch dest {
+	case "":
+		// The structured logger adds its own timestamp
+		log.SetFlags(0)
+		log.SetOutput(&customLogWriter{logger: l})
+		return func() {}, nil
+	case quicLogStderr:
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open QUIC log file: %w", err)
+	}
+	log.SetFlags(log.LstdFlags)
+	log.SetOutput(f)
+	return func() {
+		log.SetOutput(io.Discard)
+		_ = f.Close()
+	}, nil
+}
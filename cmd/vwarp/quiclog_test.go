@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// restoreStdLog puts the standard logger back as it was after the test
+func restoreStdLog(t *testing.T) {
+	t.Helper()
+	w, flags := log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	})
+}
+
+const quicBufferMsg = "failed to sufficiently increase receive buffer size (was: 208 kiB, wanted: 7168 kiB, got: 416 kiB). See https://github.com/quic-go/quic-go/wiki/UDP-Buffer-Sizes for details."
+
+func TestQUICLogPassthrough(t *testing.T) {
+	restoreStdLog(t)
+	dest := filepath.Join(t.TempDir(), "quic.log")
+
+	closeLog, err := setQUICLog(dest, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("setQUICLog: %v", err)
+	}
+	log.Printf("%s", quicBufferMsg)
+	log.Printf("handling stream failed: %s", "H3_NO_ERROR")
+	closeLog()
+
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " "+quicBufferMsg) || !strings.HasSuffix(lines[1], " handling stream failed: H3_NO_ERROR") {
+		t.Fatalf("QUIC log file =\n%s", data)
+	}
+}
+
+func TestQUICLogCategorized(t *testing.T) {
+	restoreStdLog(t)
+	var out bytes.Buffer
+	if _, err := setQUICLog("", slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))); err != nil {
+		t.Fatalf("setQUICLog: %v", err)
+	}
+
+	for _, tt := range []struct {
+		msg, want string
+	}{
+		{quicBufferMsg, `level=DEBUG msg="UDP buffer size notice"`},
+		{"failed to increase send buffer size (wanted: 7168 kiB, got 416 kiB)", `level=DEBUG msg="UDP buffer size notice"`},
+		{"handling stream failed: H3_NO_ERROR", `level=DEBUG msg="QUIC stream closed gracefully"`},
+		{"handling stream failed: timeout: no recent network activity", `level=WARN msg="QUIC stream failed"`},
+		{"something new", `level=INFO msg="QUIC library message" details="something new"`},
+	} {
+		out.Reset()
+		log.Print(tt.msg)
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%q logged as %q, want %s", tt.msg, out.String(), tt.want)
+		}
+	}
+}
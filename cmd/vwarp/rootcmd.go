@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/netip"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,8 +22,11 @@ import (
 	"github.com/voidr3aper-anon/Vwarp/app"
 	"github.com/voidr3aper-anon/Vwarp/config"
 	"github.com/voidr3aper-anon/Vwarp/config/noize"
+	"github.com/voidr3aper-anon/Vwarp/iputils"
+	"github.com/voidr3aper-anon/Vwarp/masque"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
 	p "github.com/voidr3aper-anon/Vwarp/psiphon"
-	"github.com/voidr3aper-anon/Vwarp/warp"
 	"github.com/voidr3aper-anon/Vwarp/wiresocks"
 )
 
@@ -27,36 +35,125 @@ type rootConfig struct {
 	command *ff.Command
 
 	verbose         bool
+	quiet           bool
+	quicLog         string // Where the QUIC library's log goes, see setQUICLog
 	v4              bool
 	v6              bool
 	bind            string
 	endpoint        string
 	key             string
+	keyFile         string
+	acceptTOS       bool // Accept the Cloudflare terms of service when registering
+	requireTOS      bool // Fail registration unless acceptTOS is set
+	clockCheck      bool // Warn about a skewed local clock at startup
 	dns             string
+	dnsMode         string
+	dohURL          string
 	gool            bool
 	psiphon         bool
 	masque          bool
 	masquePreferred bool
 	country         string
 	scan            bool
+	scanProbeOnly   bool
 	rtt             time.Duration
 	cacheDir        string
+	profile         string
 	fwmark          uint32
 	reserved        string
 	wgConf          string
 	testUrl         string
 	config          string
+	dryRun          bool
+	printConfig     bool
 
 	// Unified Noize configuration
 	noize       bool   // Enable noize for active protocol(s)
 	noizePreset string // Unified preset for both WireGuard and MASQUE (minimal, light, medium, heavy, stealth, gfw, firewall)
 	noizeExport string // Export preset to file path
+	autoNoize   bool   // Benchmark MASQUE presets and use the lightest that reliably connects
 
 	// Deprecated MASQUE Noize configuration (for backward compatibility)
 	masqueNoizeConfigOld string // Deprecated: use unified config file
 
 	// SOCKS proxy configuration
 	proxyAddress string
+
+	// OS TUN device name for full VPN mode (MASQUE only)
+	tun string
+
+	resetQUICBlock bool // Forget networks previously detected as blocking QUIC
+
+	transparent string // Transparent proxy bind address for iptables REDIRECT/TPROXY (MASQUE only, linux)
+	dnsListen   string // Bind address of the local DNS server resolving through the tunnel
+
+	sourcePorts      string // Local port range for the MASQUE QUIC socket, e.g. 40000-41000
+	sourcePort       int    // Fixed local port for the MASQUE QUIC socket, for firewall rules
+	stableSourcePort bool   // Reuse the MASQUE QUIC source port across reconnects
+	randomFallback   bool   // Try a random address of Cloudflare's MASQUE ranges when the endpoint fails
+	sessionTickets   bool   // Persist MASQUE TLS session tickets across restarts
+	skipReachability bool   // Dial MASQUE without the QUIC reachability probe
+	requireMasque    bool   // Fail instead of falling back to WireGuard
+	failClosed       bool   // Don't serve the proxy before the tunnel is confirmed up
+	egressIface      string // Interface the MASQUE socket is bound to on multihomed hosts
+
+	alpn []string // TLS ALPN offered to the MASQUE server
+
+	certValidity time.Duration // Lifetime of the generated MASQUE client certificate
+	certName     string        // Subject common name of the generated MASQUE client certificate
+	certSANs     []string      // DNS subject alternative names of the generated MASQUE client certificate
+
+	connectURI   string            // Connect-IP URI template
+	connectURIs  map[string]string // Per-endpoint Connect-IP URI templates (config file only)
+	connectProto string            // Connect-IP :protocol
+
+	initialPacketSize uint16 // Size MASQUE QUIC Initial datagrams are padded to
+	initialPadPattern string // Hex bytes the Initial padding is filled with
+
+	keepAlive        time.Duration // QUIC keepalive interval of the MASQUE tunnel
+	handshakeTimeout time.Duration // WireGuard handshake wait, zero picks the default
+	relayKeepAlive   time.Duration // Tunnel nudge interval while a proxied connection is idle
+	breakerThreshold int           // Proxy dials in a row to a destination that may time out before new ones fail fast
+	breakerCooldown  time.Duration // How long new proxy dials to a destination fail fast once its breaker trips
+	tunnelBreaker    int           // Different destinations in a row whose proxy dials may time out before all new ones fail fast
+	tunnelCooldown   time.Duration // How long all new proxy dials fail fast once the tunnel breaker trips
+	statsInterval    time.Duration // How often proxy totals are logged
+	writeQueue       int           // Packets buffered ahead of MASQUE writes
+	forwardWorkers   int           // Goroutines forwarding MASQUE packets in each direction
+
+	initialStreamWindow     uint64 // QUIC stream receive window a connection starts with, zero keeps the quic-go default
+	maxStreamWindow         uint64 // Largest QUIC stream receive window, zero keeps the quic-go default
+	initialConnectionWindow uint64 // QUIC connection receive window a connection starts with, zero keeps the quic-go default
+	maxConnectionWindow     uint64 // Largest QUIC connection receive window, zero keeps the quic-go default
+
+	endpointDNSTTL time.Duration // How long MASQUE reconnects reuse the endpoint hostname lookup
+
+	logRequests     bool // Log the method and host of each proxied request
+	logRequestsFull bool // Also log the URL of plain HTTP requests
+
+	probeTargets []string // ip:port targets of the DNS-independent connectivity test
+	testURLs     []string // Alternate URLs of the HTTP connectivity test
+
+	tricks []string // WireGuard handshake tricks in the order they are tried
+
+	qualityHistory  string        // JSON lines file MASQUE tunnel quality samples are appended to
+	qualityInterval time.Duration // How often the quality history is sampled
+
+	tlsCert string // PEM certificate the proxy listener serves TLS with
+	tlsKey  string // PEM private key of tlsCert
+
+	adminListen    string // Bind address of the admin API over the proxy connections
+	adminToken     string // Bearer token the admin API requires
+	adminTokenFile string // File adminToken is read from
+
+	// Proxy destination ACL
+	allow []string
+	deny  []string
+
+	// dryRunFunc replaces app.DryRun in tests
+	dryRunFunc func(context.Context, *slog.Logger, app.WarpOptions) (app.DryRunResult, error)
+	// stdout is where results such as --print-config are written, os.Stdout if nil
+	stdout io.Writer
 }
 
 func newRootCmd() *rootConfig {
@@ -69,6 +166,16 @@ func newRootCmd() *rootConfig {
 		Usage:     "enable verbose logging",
 		NoDefault: true,
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quiet",
+		Value:    ffval.NewValueDefault(&cfg.quiet, false),
+		Usage:    "keep stdout for results only: log warnings and errors to stderr and skip informational messages",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quic-log",
+		Value:    ffval.NewValueDefault(&cfg.quicLog, ""),
+		Usage:    "pass the QUIC library's log through verbatim to stderr or to this file, instead of categorizing it (stderr or a path)",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		ShortName: '4',
 		LongName:  "ipv4",
@@ -86,6 +193,31 @@ func newRootCmd() *rootConfig {
 		Value:     ffval.NewValueDefault(&cfg.bind, "127.0.0.1:8086"),
 		Usage:     "socks bind address",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tls-cert",
+		Value:    ffval.NewValueDefault(&cfg.tlsCert, ""),
+		Usage:    "serve the SOCKS/HTTP proxy over TLS with this PEM certificate (requires --tls-key)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tls-key",
+		Value:    ffval.NewValueDefault(&cfg.tlsKey, ""),
+		Usage:    "PEM private key of --tls-cert",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "admin-listen",
+		Value:    ffval.NewValueDefault(&cfg.adminListen, ""),
+		Usage:    "serve an HTTP API listing and closing active proxy connections on this loopback address (e.g., 127.0.0.1:8087, requires an admin token)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "admin-token",
+		Value:    ffval.NewValueDefault(&cfg.adminToken, ""),
+		Usage:    "bearer token admin API requests must carry in their Authorization header (visible in process listings, prefer --admin-token-file or " + adminTokenEnv + ")",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "admin-token-file",
+		Value:    ffval.NewValueDefault(&cfg.adminTokenFile, ""),
+		Usage:    "read the admin API token from this file, taking precedence over " + adminTokenEnv + " and --admin-token",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		ShortName: 'e',
 		LongName:  "endpoint",
@@ -96,13 +228,43 @@ func newRootCmd() *rootConfig {
 		ShortName: 'k',
 		LongName:  "key",
 		Value:     ffval.NewValueDefault(&cfg.key, ""),
-		Usage:     "warp key",
+		Usage:     "warp key (visible in process listings, prefer --key-file or " + licenseEnv + ")",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "key-file",
+		Value:    ffval.NewValueDefault(&cfg.keyFile, ""),
+		Usage:    "read the warp key from this file, taking precedence over " + licenseEnv + " and --key",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "accept-tos",
+		Value:    ffval.NewValueDefault(&cfg.acceptTOS, false),
+		Usage:    "accept the Cloudflare terms of service (https://www.cloudflare.com/application/terms/) when registering a new device",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "require-tos",
+		Value:    ffval.NewValueDefault(&cfg.requireTOS, false),
+		Usage:    "fail instead of registering a new device unless --accept-tos is given, which is otherwise implied",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "clock-check",
+		Value:    ffval.NewValueDefault(&cfg.clockCheck, false),
+		Usage:    "warn at startup if the local clock is off, checked with a plain HTTP request to cp.cloudflare.com outside the tunnel",
 	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "dns",
 		Value:    ffval.NewValueDefault(&cfg.dns, "1.1.1.1"),
 		Usage:    "DNS address",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dns-mode",
+		Value:    ffval.NewEnum(&cfg.dnsMode, "plain", "doh"),
+		Usage:    "how names are resolved inside the tunnel: plain or doh (DNS-over-HTTPS)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "doh-url",
+		Value:    ffval.NewValueDefault(&cfg.dohURL, "https://1.1.1.1/dns-query"),
+		Usage:    "DNS-over-HTTPS endpoint used with --dns-mode doh",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "gool",
 		Value:    ffval.NewValueDefault(&cfg.gool, false),
@@ -134,6 +296,11 @@ func newRootCmd() *rootConfig {
 		Value:    ffval.NewValueDefault(&cfg.noizeExport, ""),
 		Usage:    "export preset to JSON file (e.g., --noize-export medium:config.json)",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "auto-noize",
+		Value:    ffval.NewValueDefault(&cfg.autoNoize, false),
+		Usage:    "try MASQUE noize presets lightest first and use the first that reliably connects",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "cfon",
 		Value:    ffval.NewValueDefault(&cfg.psiphon, false),
@@ -149,6 +316,11 @@ func newRootCmd() *rootConfig {
 		Value:    ffval.NewValueDefault(&cfg.scan, false),
 		Usage:    "enable warp scanning",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "scan-probe-only",
+		Value:    ffval.NewValueDefault(&cfg.scanProbeOnly, false),
+		Usage:    "scan with a keyless QUIC reachability probe on port 443 instead of a WARP handshake, without registering a device; endpoints are reported with the probed port",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "rtt",
 		Value:    ffval.NewValueDefault(&cfg.rtt, 1000*time.Millisecond),
@@ -157,6 +329,11 @@ func newRootCmd() *rootConfig {
 		LongName: "cache-dir",
 		Value:    ffval.NewValueDefault(&cfg.cacheDir, ""),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "profile",
+		Value:    ffval.NewValueDefault(&cfg.profile, ""),
+		Usage:    "named device profile in the cache directory, with its own MASQUE config and WireGuard identities, registered on first use (default the unnamed device)",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "fwmark",
 		Value:    ffval.NewValueDefault(&cfg.fwmark, 0x0),
@@ -173,17 +350,252 @@ func newRootCmd() *rootConfig {
 		LongName: "test-url",
 		Value:    ffval.NewValueDefault(&cfg.testUrl, "http://connectivity.cloudflareclient.com/cdn-cgi/trace"),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "alt-test-url",
+		Value:    ffval.NewList(&cfg.testURLs),
+		Usage:    "URL tried when the test URL fails the connectivity check (repeatable, built-in alternates if unset)",
+	})
 	cfg.flags.AddFlag(ff.FlagConfig{
 		ShortName: 'c',
 		LongName:  "config",
 		Value:     ffval.NewValueDefault(&cfg.config, ""),
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dry-run",
+		Value:    ffval.NewValueDefault(&cfg.dryRun, false),
+		Usage:    "validate the setup, register if needed and check the endpoint answers, then exit without serving the proxy",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "print-config",
+		Value:    ffval.NewValueDefault(&cfg.printConfig, false),
+		Usage:    "print the configuration resolved from flags, --config and presets as JSON (secrets redacted) and exit",
+	})
 
 	cfg.flags.AddFlag(ff.FlagConfig{
 		LongName: "proxy",
 		Value:    ffval.NewValueDefault(&cfg.proxyAddress, ""),
 		Usage:    "SOCKS5 proxy address to route WireGuard traffic through (e.g., socks5://127.0.0.1:1080)",
 	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tun",
+		Value:    ffval.NewValueDefault(&cfg.tun, ""),
+		Usage:    "route all traffic through an OS TUN device with this name instead of serving a proxy (MASQUE only, without the WireGuard fallback of masque-preferred; requires root)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "reset-quic-block",
+		Value:    ffval.NewValueDefault(&cfg.resetQUICBlock, false),
+		Usage:    "forget networks previously detected as blocking QUIC and probe MASQUE again",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "transparent",
+		Value:    ffval.NewValueDefault(&cfg.transparent, ""),
+		Usage:    "transparent proxy bind address for iptables REDIRECT/TPROXY traffic (e.g., 0.0.0.0:12345, MASQUE only, linux)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dns-listen",
+		Value:    ffval.NewValueDefault(&cfg.dnsListen, ""),
+		Usage:    "serve DNS resolved through the tunnel on this address over UDP and TCP, to point the OS resolver at (e.g., 127.0.0.1:5353)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "source-ports",
+		Value:    ffval.NewValueDefault(&cfg.sourcePorts, ""),
+		Usage:    "bind the MASQUE QUIC socket to a random port in this range (e.g., 40000-41000)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "source-port",
+		Value:    ffval.NewValueDefault(&cfg.sourcePort, 0),
+		Usage:    "bind the MASQUE QUIC socket to this port on every connect, for egress firewall rules",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "stable-source-port",
+		Value:    ffval.NewValueDefault(&cfg.stableSourcePort, false),
+		Usage:    "reuse the same MASQUE QUIC source port across reconnects (NAT pinning)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "masque-random-fallback",
+		Value:    ffval.NewValueDefault(&cfg.randomFallback, false),
+		Usage:    "try a random address of Cloudflare's MASQUE ranges when the MASQUE endpoint fails",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "session-tickets",
+		Value:    ffval.NewValueDefault(&cfg.sessionTickets, false),
+		Usage:    "save MASQUE TLS session tickets in the cache directory to resume the session after a restart",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "skip-reachability-check",
+		Value:    ffval.NewValueDefault(&cfg.skipReachability, false),
+		Usage:    "dial MASQUE directly instead of probing the endpoint over QUIC first (slower WireGuard fallback when UDP is blocked)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "egress-iface",
+		Value:    ffval.NewValueDefault(&cfg.egressIface, ""),
+		Usage:    "bind the MASQUE QUIC socket to this network interface's address, to pick the uplink on multihomed hosts",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "require-masque",
+		Value:    ffval.NewValueDefault(&cfg.requireMasque, false),
+		Usage:    "exit with an error if MASQUE can't be established instead of falling back to WireGuard",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "fail-closed",
+		Value:    ffval.NewValueDefault(&cfg.failClosed, false),
+		Usage:    "don't serve the proxy until the tunnel passes the connectivity test",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "connect-uri",
+		Value:    ffval.NewValueDefault(&cfg.connectURI, ""),
+		Usage:    "Connect-IP URI template for alternate MASQUE servers, {target_host} and {target_port} expand to the endpoint",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "connect-protocol",
+		Value:    ffval.NewValueDefault(&cfg.connectProto, ""),
+		Usage:    "Connect-IP protocol of the MASQUE request, connect-ip for RFC 9484 servers (default cf-connect-ip)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "initial-packet-size",
+		Value:    ffval.NewValueDefault(&cfg.initialPacketSize, 0),
+		Usage:    fmt.Sprintf("size MASQUE QUIC Initial datagrams are padded to, at least 1200 (default %d, like the WARP client)", masque.DefaultInitialPacketSize),
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "initial-pad-pattern",
+		Value:    ffval.NewValueDefault(&cfg.initialPadPattern, ""),
+		Usage:    "hex bytes the MASQUE Initial padding is filled with, repeated (default QUIC PADDING frames)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "alpn",
+		Value:    ffval.NewList(&cfg.alpn),
+		Usage:    "TLS ALPN protocol offered to the MASQUE server, for non-Cloudflare servers (default h3, repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "cert-validity",
+		Value:    ffval.NewValueDefault(&cfg.certValidity, masque.DefaultCertValidity),
+		Usage:    "lifetime of the generated MASQUE client certificate",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "cert-name",
+		Value:    ffval.NewValueDefault(&cfg.certName, ""),
+		Usage:    "subject common name of the generated MASQUE client certificate (default empty, like the WARP client)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "cert-san",
+		Value:    ffval.NewList(&cfg.certSANs),
+		Usage:    "DNS subject alternative name of the generated MASQUE client certificate (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "keepalive",
+		Value:    ffval.NewValueDefault(&cfg.keepAlive, masque.DefaultKeepAlivePeriod),
+		Usage:    "QUIC keepalive interval of the MASQUE tunnel, below the 60s idle timeout",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "handshake-timeout",
+		Value:    ffval.NewValueDefault(&cfg.handshakeTimeout, time.Duration(0)),
+		Usage:    "how long to wait for the WireGuard handshake (default 15s, 30s with the heavy, stealth and gfw noize presets)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "wg-trick",
+		Value:    ffval.NewList(&cfg.tricks),
+		Usage:    "WireGuard handshake trick to try, in the order given until one connects: t0 (none), t1 or t2 (repeatable, default t1 then t2)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "relay-keepalive",
+		Value:    ffval.NewValueDefault(&cfg.relayKeepAlive, time.Duration(0)),
+		Usage:    "send traffic through the tunnel at this interval while a proxied connection is idle (e.g., 25s, 0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dial-breaker",
+		Value:    ffval.NewValueDefault(&cfg.breakerThreshold, 0),
+		Usage:    "fail new proxy connections to a destination immediately after this many tunnel dials in a row to it time out (0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "dial-breaker-cooldown",
+		Value:    ffval.NewValueDefault(&cfg.breakerCooldown, wiresocks.DefaultDialBreakerCooldown),
+		Usage:    "how long new proxy connections to a destination fail immediately once its dial breaker trips, before one is let through to probe it",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tunnel-breaker",
+		Value:    ffval.NewValueDefault(&cfg.tunnelBreaker, wiresocks.DefaultTunnelBreakerThreshold),
+		Usage:    "fail all new proxy connections immediately after tunnel dials to this many different destinations in a row time out, as while the tunnel reconnects (0 disables)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "tunnel-breaker-cooldown",
+		Value:    ffval.NewValueDefault(&cfg.tunnelCooldown, wiresocks.DefaultTunnelBreakerCooldown),
+		Usage:    "how long all new proxy connections fail immediately once the tunnel breaker trips, before one is let through to probe the tunnel",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "stats-interval",
+		Value:    ffval.NewValueDefault(&cfg.statsInterval, time.Duration(0)),
+		Usage:    "log proxy totals (connections, bytes, reconnects) at this interval (e.g., 1m, 0 logs them only at shutdown)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quality-history",
+		Value:    ffval.NewValueDefault(&cfg.qualityHistory, ""),
+		Usage:    "append MASQUE tunnel quality samples (RTT, loss, reconnects, endpoint) to this file as JSON lines, rotated at 10MB",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quality-interval",
+		Value:    ffval.NewValueDefault(&cfg.qualityInterval, app.DefaultQualityInterval),
+		Usage:    "how often the quality history is sampled",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "log-requests",
+		Value:    ffval.NewValueDefault(&cfg.logRequests, false),
+		Usage:    "log the method and host of each HTTP request and the target of each SOCKS command",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "log-requests-full",
+		Value:    ffval.NewValueDefault(&cfg.logRequestsFull, false),
+		Usage:    "like log-requests, also logging the full URL of plain HTTP requests (credentials are still left out)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "write-queue",
+		Value:    ffval.NewValueDefault(&cfg.writeQueue, app.DefaultWriteQueueDepth),
+		Usage:    "packets buffered ahead of MASQUE writes so short stalls don't drop traffic",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "forward-workers",
+		Value:    ffval.NewValueDefault(&cfg.forwardWorkers, 1),
+		Usage:    "goroutines forwarding MASQUE packets in each direction, sharded by flow so each flow stays in order (raise on multicore hosts with high packet rates)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quic-initial-stream-window",
+		Value:    ffval.NewValueDefault(&cfg.initialStreamWindow, uint64(0)),
+		Usage:    "QUIC stream receive window in bytes a MASQUE tunnel starts with (default 0 keeps the quic-go 512KB; tunneled packets are datagrams, which no window limits)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quic-max-stream-window",
+		Value:    ffval.NewValueDefault(&cfg.maxStreamWindow, uint64(0)),
+		Usage:    "largest QUIC stream receive window in bytes of the MASQUE tunnel (default 0 keeps the quic-go 6MB)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quic-initial-connection-window",
+		Value:    ffval.NewValueDefault(&cfg.initialConnectionWindow, uint64(0)),
+		Usage:    "QUIC connection receive window in bytes a MASQUE tunnel starts with (default 0 keeps the quic-go 768KB)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "quic-max-connection-window",
+		Value:    ffval.NewValueDefault(&cfg.maxConnectionWindow, uint64(0)),
+		Usage:    "largest QUIC connection receive window in bytes of the MASQUE tunnel (default 0 keeps the quic-go 15MB)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "endpoint-dns-ttl",
+		Value:    ffval.NewValueDefault(&cfg.endpointDNSTTL, masque.DefaultResolveCacheTTL),
+		Usage:    "reuse the MASQUE endpoint hostname lookup across reconnects for this long (0 looks it up on every reconnect)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "probe-target",
+		Value:    ffval.NewList(&cfg.probeTargets),
+		Usage:    "ip:port dialed through the tunnel to check connectivity after MASQUE reconnects (repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "allow",
+		Value:    ffval.NewList(&cfg.allow),
+		Usage:    "only let proxy clients connect to these destinations (CIDR, domain suffix, :port or :low-high; repeatable)",
+	})
+	cfg.flags.AddFlag(ff.FlagConfig{
+		LongName: "deny",
+		Value:    ffval.NewList(&cfg.deny),
+		Usage:    "refuse proxy connections to these destinations, taking precedence over --allow (repeatable)",
+	})
 	cfg.command = &ff.Command{
 		Name:  appName,
 		Flags: cfg.flags,
@@ -193,10 +605,23 @@ func newRootCmd() *rootConfig {
 }
 
 func (c *rootConfig) exec(ctx context.Context, args []string) error {
-	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	// Keep stdout clean for the printed config
+	logOut := io.Writer(os.Stdout)
+	if c.printConfig || c.quiet {
+		logOut = os.Stderr
+	}
+	l := c.newLogger(logOut, c.logLevel())
+	closeQUICLog, err := setQUICLog(c.quicLog, l)
+	if err != nil {
+		fatal(l, err)
+	}
+	defer closeQUICLog()
 
-	if c.verbose {
-		l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err := c.resolveLicense(); err != nil {
+		fatal(l, err)
+	}
+	if err := c.resolveAdminToken(); err != nil {
+		fatal(l, err)
 	}
 
 	// Handle noize export functionality
@@ -249,6 +674,10 @@ func (c *rootConfig) exec(ctx context.Context, args []string) error {
 		fatal(l, errors.New("can't use masque-preferred and cfon at the same time"))
 	}
 
+	if c.tun != "" && !c.masque && !c.masquePreferred {
+		fatal(l, errors.New("tun mode requires masque or masque-preferred"))
+	}
+
 	if c.masque && c.endpoint == "" {
 		// If no endpoint is provided in MASQUE mode, scan for one
 		l.Info("no endpoint specified, scanning for endpoints...")
@@ -260,7 +689,15 @@ func (c *rootConfig) exec(ctx context.Context, args []string) error {
 	}
 
 	if !c.v4 && !c.v6 {
-		c.v4, c.v6 = true, true
+		// Not forced: use the families the host can route, both if it routes neither
+		c.v4, c.v6 = iputils.HostFamilies()
+		if !c.v4 && !c.v6 {
+			c.v4, c.v6 = true, true
+		} else if !c.v4 {
+			l.Info("no IPv4 route, using IPv6 endpoints")
+		} else if !c.v6 {
+			l.Debug("no IPv6 route, using IPv4 endpoints")
+		}
 	}
 
 	bindAddrPort, err := netip.ParseAddrPort(c.bind)
@@ -273,35 +710,238 @@ func (c *rootConfig) exec(ctx context.Context, args []string) error {
 		fatal(l, fmt.Errorf("invalid DNS address: %w", err))
 	}
 
+	var dohURL string
+	if c.dnsMode == "doh" {
+		dohURL = c.dohURL
+	}
+
+	if c.autoNoize && !c.masque && !c.masquePreferred {
+		fatal(l, errors.New("auto-noize requires masque or masque-preferred"))
+	}
+	if c.autoNoize && (c.isSet("noize-preset") || os.Getenv(noize.EnvPreset) != "") {
+		fatal(l, errors.New("can't use --auto-noize with an explicit noize preset"))
+	}
+
+	var transparentAddrPort netip.AddrPort
+	if c.transparent != "" {
+		if !c.masque && !c.masquePreferred {
+			fatal(l, errors.New("transparent mode requires masque or masque-preferred"))
+		}
+		transparentAddrPort, err = netip.ParseAddrPort(c.transparent)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid transparent bind address: %w", err))
+		}
+	}
+
+	var dnsListen netip.AddrPort
+	if c.dnsListen != "" {
+		if c.tun != "" {
+			fatal(l, errors.New("dns-listen can't be used with tun, which routes DNS through the tunnel already"))
+		}
+		dnsListen, err = netip.ParseAddrPort(c.dnsListen)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid DNS listen address: %w", err))
+		}
+	}
+
+	var adminListen netip.AddrPort
+	if c.adminListen != "" {
+		if c.adminToken == "" {
+			fatal(l, errors.New("admin-listen requires admin-token, admin-token-file or "+adminTokenEnv))
+		}
+		adminListen, err = netip.ParseAddrPort(c.adminListen)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid admin listen address: %w", err))
+		}
+		if !adminListen.Addr().IsLoopback() {
+			fatal(l, errors.New("admin-listen must be a loopback address, the admin API serves plain HTTP"))
+		}
+	}
+
+	if c.requireMasque && !c.masque && !c.masquePreferred {
+		fatal(l, errors.New("require-masque requires masque or masque-preferred"))
+	}
+
+	if c.egressIface != "" {
+		if !c.masque && !c.masquePreferred {
+			fatal(l, errors.New("egress-iface requires masque or masque-preferred"))
+		}
+		if _, err := net.InterfaceByName(c.egressIface); err != nil {
+			fatal(l, fmt.Errorf("invalid egress interface: %w", err))
+		}
+	}
+
+	if c.profile != "" {
+		if _, err := masque.ProfileConfigPath("", c.profile); err != nil {
+			fatal(l, err)
+		}
+	}
+
+	if c.certValidity <= 0 {
+		fatal(l, errors.New("cert-validity must be positive"))
+	}
+
+	initialPadPattern, err := hex.DecodeString(c.initialPadPattern)
+	if err != nil {
+		fatal(l, fmt.Errorf("invalid initial pad pattern: %w", err))
+	}
+
+	if c.scanProbeOnly && !c.scan {
+		fatal(l, errors.New("scan-probe-only requires scan"))
+	}
+
+	if c.qualityHistory != "" && c.qualityInterval <= 0 {
+		fatal(l, errors.New("quality-interval must be positive"))
+	}
+
+	if err := app.ValidateTricks(c.tricks); err != nil {
+		fatal(l, err)
+	}
+
+	if c.writeQueue < 1 {
+		fatal(l, fmt.Errorf("invalid write queue depth %d: must be at least 1", c.writeQueue))
+	}
+
+	if c.forwardWorkers < 1 {
+		fatal(l, fmt.Errorf("invalid forward workers %d: must be at least 1", c.forwardWorkers))
+	}
+
+	receiveWindows := c.receiveWindows()
+	if err := receiveWindows.Validate(); err != nil {
+		fatal(l, err)
+	}
+
+	if c.endpointDNSTTL < 0 {
+		fatal(l, errors.New("endpoint-dns-ttl must not be negative"))
+	}
+
+	if c.breakerThreshold < 0 || c.breakerCooldown <= 0 {
+		fatal(l, errors.New("dial-breaker must not be negative and dial-breaker-cooldown must be positive"))
+	}
+
+	if c.tunnelBreaker < 0 || c.tunnelCooldown <= 0 {
+		fatal(l, errors.New("tunnel-breaker must not be negative and tunnel-breaker-cooldown must be positive"))
+	}
+
+	sourcePortRange, err := c.sourcePortRange()
+	if err != nil {
+		fatal(l, err)
+	}
+
+	var rules *acl.ACL
+	if len(c.allow) > 0 || len(c.deny) > 0 {
+		rules, err = acl.New(c.allow, c.deny)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid ACL: %w", err))
+		}
+		l.Info("proxy ACL enabled", "allow", len(rules.Allow), "deny", len(rules.Deny))
+	}
+
+	var proxyTLS *tls.Config
+	if c.tlsCert != "" || c.tlsKey != "" {
+		if c.tlsCert == "" || c.tlsKey == "" {
+			fatal(l, errors.New("--tls-cert and --tls-key must be used together"))
+		}
+		cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			fatal(l, fmt.Errorf("failed to load proxy TLS certificate: %w", err))
+		}
+		proxyTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		l.Info("serving the proxy over TLS", "cert", c.tlsCert)
+	}
+
+	// Environment overrides win over the config file and flags, for quick tuning
+	noizeConfig, err := noize.ApplyEnvOverrides(c.withMASQUENoize(c.buildUnifiedNoizeConfig(unifiedConfig)), c.masque || c.masquePreferred, os.Getenv)
+	if err != nil {
+		fatal(l, err)
+	}
+	if preset, jc, fragment := os.Getenv(noize.EnvPreset), os.Getenv(noize.EnvJc), os.Getenv(noize.EnvFragment); preset+jc+fragment != "" {
+		l.Info("noize config overridden from the environment", "preset", preset, "jc", jc, "fragment", fragment)
+	}
+	if err := masque.ValidateInitialPadding(c.initialPacketSize, initialPadPattern, noizeConfig.GetMASQUEConfig()); err != nil {
+		fatal(l, err)
+	}
+
 	opts := app.WarpOptions{
 		Bind:               bindAddrPort,
 		Endpoint:           c.endpoint,
+		EndpointV4:         c.v4,
+		EndpointV6:         c.v6,
 		License:            c.key,
+		AcceptTOS:          c.acceptTOS,
+		RequireTOS:         c.requireTOS,
+		ClockCheck:         c.clockCheck,
 		DnsAddr:            dnsAddr,
+		DoHURL:             dohURL,
 		Gool:               c.gool,
 		Masque:             c.masque,
 		MasquePreferred:    c.masquePreferred,
 		MasqueNoize:        c.noize && (c.masque || c.masquePreferred), // Enable if noize requested and MASQUE active
 		MasqueNoizePreset:  c.noizePreset,
 		MasqueNoizeConfig:  c.masqueNoizeConfigOld, // Keep old field for backward compatibility
+		AutoNoize:          c.autoNoize,
 		FwMark:             c.fwmark,
 		WireguardConfig:    c.wgConf,
 		Reserved:           c.reserved,
 		TestURL:            c.testUrl,
+		TestURLs:           c.testURLs,
+		Tricks:             c.tricks,
+		QualityHistory:     c.qualityHistory,
+		QualityInterval:    c.qualityInterval,
+		ProxyTLS:           proxyTLS,
+		ProxyAdmin:         adminListen,
+		ProxyAdminToken:    c.adminToken,
+		ProbeTargets:       c.probeTargets,
 		AtomicNoizeConfig:  nil, // Use unified config system instead
 		ProxyAddress:       c.proxyAddress,
-		UnifiedNoizeConfig: c.buildUnifiedNoizeConfig(unifiedConfig),
+		Profile:            c.profile,
+		Tun:                c.tun,
+		Transparent:        transparentAddrPort,
+		DNSListen:          dnsListen,
+		SourcePort:         c.sourcePort,
+		SourcePortRange:    sourcePortRange,
+		StableSourcePort:   c.stableSourcePort,
+		RandomFallback:     c.randomFallback,
+		HandshakeTimeout:   c.handshakeTimeout,
+		SessionTickets:     c.sessionTickets,
+		ACL:                rules,
+		MasqueALPN:         c.alpn,
+		ConnectURI:         c.connectURI,
+		ConnectURIs:        c.connectURIs,
+		ConnectProtocol:    c.connectProto,
+		InitialPacketSize:  c.initialPacketSize,
+		InitialPadPattern:  initialPadPattern,
+		QUICKeepAlive:      c.keepAlive,
+		RelayKeepAlive:     c.relayKeepAlive,
+		DialBreaker:        c.breakerThreshold,
+		DialCooldown:       c.breakerCooldown,
+		TunnelBreaker:      c.tunnelBreaker,
+		TunnelCooldown:     c.tunnelCooldown,
+		StatsInterval:      c.statsInterval,
+		WriteQueue:         c.writeQueue,
+		ForwardWorkers:     c.forwardWorkers,
+		QUICReceiveWindows: receiveWindows,
+		EndpointDNSTTL:     c.endpointDNSTTL,
+		SkipReachability:   c.skipReachability,
+		RequireMasque:      c.requireMasque,
+		FailClosed:         c.failClosed,
+		EgressIface:        c.egressIface,
+		CertValidity:       c.certValidity,
+		CertName:           c.certName,
+		CertSANs:           c.certSANs,
+		RequestLog:         c.requestLog(),
+		UnifiedNoizeConfig: noizeConfig,
 	}
 
-	switch {
-	case c.cacheDir != "":
-		opts.CacheDir = c.cacheDir
-	case xdg.CacheHome != "":
-		opts.CacheDir = path.Join(xdg.CacheHome, appName)
-	case os.Getenv("HOME") != "":
-		opts.CacheDir = path.Join(os.Getenv("HOME"), ".cache", appName)
-	default:
-		opts.CacheDir = "warp_plus_cache"
+	opts.CacheDir = c.resolveCacheDir()
+
+	if c.printConfig {
+		return c.writeEffectiveConfig(c.out(), opts)
+	}
+
+	if c.resetQUICBlock {
+		l.Info("resetting QUIC block detection state")
+		app.ResetQUICBlockState(opts)
 	}
 
 	if c.psiphon {
@@ -311,22 +951,14 @@ func (c *rootConfig) exec(ctx context.Context, args []string) error {
 
 	if c.scan {
 		l.Info("scanner mode enabled", "max-rtt", c.rtt)
-		opts.Scan = &wiresocks.ScanOptions{V4: c.v4, V6: c.v6, MaxRTT: c.rtt}
+		opts.Scan = &wiresocks.ScanOptions{V4: c.v4, V6: c.v6, MaxRTT: c.rtt, ProbeOnly: c.scanProbeOnly}
+		if unifiedConfig != nil && unifiedConfig.Scanner != nil {
+			applyScannerConfig(opts.Scan, unifiedConfig.Scanner)
+		}
 	}
 
-	// If the endpoint is not set, choose a random endpoint
-	if opts.Endpoint == "" {
-		var addrPort netip.AddrPort
-		var err error
-
-		// Use WireGuard endpoints for both WARP and MASQUE scanning
-		// MASQUE will convert port 2408 -> 443 in runWarpWithMasque
-		addrPort, err = warp.RandomWarpEndpoint(c.v4, c.v6)
-
-		if err != nil {
-			fatal(l, err)
-		}
-		opts.Endpoint = addrPort.String()
+	if c.dryRun {
+		return c.runDryRun(ctx, l, opts)
 	}
 
 	go func() {
@@ -340,6 +972,99 @@ func (c *rootConfig) exec(ctx context.Context, args []string) error {
 	return nil
 }
 
+// runDryRun checks what a run with opts would connect to and prints a summary
+func (c *rootConfig) runDryRun(ctx context.Context, l *slog.Logger, opts app.WarpOptions) error {
+	dryRun := c.dryRunFunc
+	if dryRun == nil {
+		dryRun = app.DryRun
+	}
+	res, err := dryRun(ctx, l, opts)
+	if err != nil {
+		return fmt.Errorf("dry run failed: %w", err)
+	}
+	if res.RTT > 0 {
+		fmt.Fprintf(c.out(), "dry run passed: %s endpoint %s answered in %s\n", res.Mode, res.Endpoint, res.RTT.Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(c.out(), "dry run passed: %s endpoint %s\n", res.Mode, res.Endpoint)
+	}
+	return nil
+}
+
+// out returns where results are written
+func (c *rootConfig) out() io.Writer {
+	if c.stdout == nil {
+		return os.Stdout
+	}
+	return c.stdout
+}
+
+// logLevel returns the log level selected by --verbose and --quiet
+func (c *rootConfig) logLevel() slog.Level {
+	switch {
+	case c.verbose:
+		return slog.LevelDebug
+	case c.quiet:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// requestLog returns how much of each proxied request the flags ask to log
+func (c *rootConfig) requestLog() statute.RequestLog {
+	switch {
+	case c.logRequestsFull:
+		return statute.RequestLogFull
+	case c.logRequests:
+		return statute.RequestLogHost
+	default:
+		return statute.RequestLogOff
+	}
+}
+
+// receiveWindows returns the QUIC receive windows the flags select
+func (c *rootConfig) receiveWindows() masque.ReceiveWindows {
+	return masque.ReceiveWindows{
+		InitialStream:     c.initialStreamWindow,
+		MaxStream:         c.maxStreamWindow,
+		InitialConnection: c.initialConnectionWindow,
+		MaxConnection:     c.maxConnectionWindow,
+	}
+}
+
+// parsePortRange parses an inclusive "LOW-HIGH" port range
+func parsePortRange(s string) ([2]int, error) {
+	low, high, ok := strings.Cut(s, "-")
+	if !ok {
+		return [2]int{}, fmt.Errorf("%q is not in LOW-HIGH form", s)
+	}
+	lowPort, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("invalid low port: %w", err)
+	}
+	highPort, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil {
+		return [2]int{}, fmt.Errorf("invalid high port: %w", err)
+	}
+	if lowPort < 1 || highPort > 65535 || lowPort > highPort {
+		return [2]int{}, fmt.Errorf("%d-%d is not a valid port range", lowPort, highPort)
+	}
+	return [2]int{lowPort, highPort}, nil
+}
+
+// resolveCacheDir returns the --cache-dir value or the platform default cache directory
+func (c *rootConfig) resolveCacheDir() string {
+	switch {
+	case c.cacheDir != "":
+		return c.cacheDir
+	case xdg.CacheHome != "":
+		return path.Join(xdg.CacheHome, appName)
+	case os.Getenv("HOME") != "":
+		return path.Join(os.Getenv("HOME"), ".cache", appName)
+	default:
+		return "warp_plus_cache"
+	}
+}
+
 // applyUnifiedConfig applies settings from the unified config file to CLI flags
 func (c *rootConfig) applyUnifiedConfig(uc *config.UnifiedConfig) {
 	// Override CLI flags with config file values (config file takes precedence)
@@ -358,9 +1083,16 @@ func (c *rootConfig) applyUnifiedConfig(uc *config.UnifiedConfig) {
 	if uc.TestURL != "" && c.testUrl == "https://cp.cloudflare.com/" {
 		c.testUrl = uc.TestURL
 	}
+	if len(uc.TestURLs) > 0 && len(c.testURLs) == 0 {
+		c.testURLs = uc.TestURLs
+	}
 	if uc.Proxy != "" && c.proxyAddress == "" {
 		c.proxyAddress = uc.Proxy
 	}
+	if uc.ACL != nil {
+		c.allow = append(c.allow, uc.ACL.Allow...)
+		c.deny = append(c.deny, uc.ACL.Deny...)
+	}
 
 	// Set protocol modes based on config
 	if uc.WireGuard != nil && uc.WireGuard.Enabled {
@@ -373,6 +1105,9 @@ func (c *rootConfig) applyUnifiedConfig(uc *config.UnifiedConfig) {
 		if uc.WireGuard.FwMark != 0 && c.fwmark == 0 {
 			c.fwmark = uc.WireGuard.FwMark
 		}
+		if len(uc.WireGuard.Tricks) > 0 && len(c.tricks) == 0 {
+			c.tricks = uc.WireGuard.Tricks
+		}
 	}
 
 	if uc.MASQUE != nil && uc.MASQUE.Enabled {
@@ -380,6 +1115,19 @@ func (c *rootConfig) applyUnifiedConfig(uc *config.UnifiedConfig) {
 		if uc.MASQUE.Preferred {
 			c.masquePreferred = true
 		}
+		if uc.MASQUE.ConnectURI != "" && c.connectURI == "" {
+			c.connectURI = uc.MASQUE.ConnectURI
+		}
+		c.connectURIs = uc.MASQUE.EndpointConnectURIs
+		if uc.MASQUE.ConnectProtocol != "" && c.connectProto == "" {
+			c.connectProto = uc.MASQUE.ConnectProtocol
+		}
+		if uc.MASQUE.InitialPacketSize != 0 && c.initialPacketSize == 0 {
+			c.initialPacketSize = uc.MASQUE.InitialPacketSize
+		}
+		if uc.MASQUE.InitialPadPattern != "" && c.initialPadPattern == "" {
+			c.initialPadPattern = uc.MASQUE.InitialPadPattern
+		}
 	}
 
 	if uc.Psiphon != nil && uc.Psiphon.Enabled {
@@ -390,6 +1138,16 @@ func (c *rootConfig) applyUnifiedConfig(uc *config.UnifiedConfig) {
 	}
 }
 
+// applyScannerConfig fills scan options from the config file's scanner section
+// (already validated by UnifiedConfig.Validate)
+func applyScannerConfig(scan *wiresocks.ScanOptions, sc *config.ScannerConfig) {
+	scan.Endpoints = strings.Join(sc.Ranges, ",")
+	scan.ScannerPorts = sc.PortList()
+	scan.ScanTimeout, _ = sc.ScanTimeout()
+	scan.Workers = sc.Workers
+	scan.Fastest = sc.Strategy == config.ScanStrategyFastest
+}
+
 // buildUnifiedNoizeConfig creates unified noize config from both CLI flags and config file
 func (c *rootConfig) buildUnifiedNoizeConfig(uc *config.UnifiedConfig) *noize.UnifiedNoizeConfig {
 	// Priority: Config file > CLI flags
@@ -427,6 +1185,57 @@ func (c *rootConfig) buildUnifiedNoizeConfig(uc *config.UnifiedConfig) *noize.Un
 	return config
 }
 
+// withMASQUENoize returns config with the MASQUE noize of --noize-preset
+// added when --noize is set in MASQUE mode and config has none, as with a
+// config file that only configures WireGuard noize. The tunnel would fall back
+// to that preset anyway; resolving it here lets the environment overrides
+// tune it.
+func (c *rootConfig) withMASQUENoize(config *noize.UnifiedNoizeConfig) *noize.UnifiedNoizeConfig {
+	if !c.noize || !(c.masque || c.masquePreferred) || (config != nil && config.IsMASQUEEnabled()) {
+		return config
+	}
+	preset := c.noizePreset
+	if preset == "" {
+		preset = "medium"
+	}
+	presetConfig, err := noize.NewConfigLoader().LoadFromPreset(preset)
+	if err != nil || presetConfig.MASQUE == nil {
+		return config
+	}
+	if config == nil {
+		config = &noize.UnifiedNoizeConfig{}
+	}
+	config.MASQUE = presetConfig.MASQUE
+	config.EnableMASQUE(preset)
+	return config
+}
+
+// isSet reports whether the flag name was given on the command line, in the
+// environment or in the config file
+func (c *rootConfig) isSet(name string) bool {
+	f, ok := c.flags.GetFlag(name)
+	return ok && f.IsSet()
+}
+
+// sourcePortRange validates the MASQUE source port flags and returns the
+// parsed --source-ports range, zero when not set
+func (c *rootConfig) sourcePortRange() ([2]int, error) {
+	var portRange [2]int
+	if c.sourcePorts != "" {
+		var err error
+		if portRange, err = parsePortRange(c.sourcePorts); err != nil {
+			return portRange, fmt.Errorf("invalid source port range: %w", err)
+		}
+	}
+	if c.sourcePort < 0 || c.sourcePort > 65535 {
+		return portRange, fmt.Errorf("invalid source port %d", c.sourcePort)
+	}
+	if c.sourcePort != 0 && c.sourcePorts != "" {
+		return portRange, errors.New("can't use --source-port and --source-ports at the same time")
+	}
+	return portRange, nil
+}
+
 // handleNoizeExport handles the --noize-export functionality
 func (c *rootConfig) handleNoizeExport(l *slog.Logger) error {
 	// Parse preset:filepath format
@@ -444,8 +1253,10 @@ func (c *rootConfig) handleNoizeExport(l *slog.Logger) error {
 	}
 
 	l.Info("exported preset configuration", "preset", presetName, "file", filePath)
-	fmt.Printf("Preset '%s' exported to '%s'\n", presetName, filePath)
-	fmt.Println("You can now customize the configuration and use it with --config")
+	if !c.quiet {
+		fmt.Fprintf(c.out(), "Preset '%s' exported to '%s'\n", presetName, filePath)
+		fmt.Fprintln(c.out(), "You can now customize the configuration and use it with --config")
+	}
 	return nil
 }
 
@@ -9,14 +9,18 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/Diniboy1123/usque/config"
 	"github.com/voidr3aper-anon/Vwarp/masque"
 )
 
 func main() {
 	var (
-		configPath = flag.String("config", "", "Path to save the configuration file")
-		deviceName = flag.String("device", "vwarp-test", "Device name for registration")
-		timeout    = flag.Duration("timeout", 30*time.Second, "Registration timeout")
+		configPath  = flag.String("config", "", "Path to save the configuration file")
+		deviceName  = flag.String("device", "vwarp-test", "Device name for registration")
+		timeout     = flag.Duration("timeout", 30*time.Second, "Key rotation timeout")
+		fingerprint = flag.Bool("fingerprint", false, "Print the client and pinned endpoint public-key fingerprints of an existing config")
+		rotateKey   = flag.Bool("rotate-key", false, "Enroll a new key on the device of an existing config, keeping its ID and license")
+		acceptTOS   = flag.Bool("accept-tos", false, "Accept the Cloudflare terms of service instead of asking for acceptance")
 	)
 	flag.Parse()
 
@@ -29,6 +33,40 @@ func main() {
 		*configPath = filepath.Join(homeDir, "AppData", "Roaming", "vwarp", "masque_config.json")
 	}
 
+	if *fingerprint {
+		client, endpoint, err := masque.KeyFingerprints(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to read fingerprints: %v", err)
+		}
+		fmt.Printf("Config: %s\n", *configPath)
+		fmt.Printf("Client public key SHA-256:   %s\n", client)
+		fmt.Printf("Endpoint public key SHA-256: %s\n", endpoint)
+		return
+	}
+
+	if *rotateKey {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		// Only rename the device when asked to
+		name := ""
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "device" {
+				name = *deviceName
+			}
+		})
+		if err := masque.RotateKey(ctx, *configPath, name); err != nil {
+			log.Fatalf("Key rotation failed: %v", err)
+		}
+		client, _, err := masque.KeyFingerprints(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to read fingerprints: %v", err)
+		}
+		fmt.Println("✅ Key rotated!")
+		fmt.Printf("Config: %s\n", *configPath)
+		fmt.Printf("New client public key SHA-256: %s\n", client)
+		return
+	}
+
 	// Ensure directory exists
 	dir := filepath.Dir(*configPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -39,30 +77,31 @@ func main() {
 	fmt.Printf("Config will be saved to: %s\n", *configPath)
 	fmt.Println()
 
-	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
-	defer cancel()
-
-	// Register and get legitimate WARP credentials
-	config, err := masque.AutoRegisterOrLoad(ctx, *configPath, *deviceName)
+	// Register and get legitimate WARP credentials; without -accept-tos the
+	// registration asks for acceptance of the terms on the terminal
+	err := masque.LoadOrRegister(masque.AdapterConfig{
+		ConfigPath: *configPath,
+		DeviceName: *deviceName,
+		AcceptTOS:  *acceptTOS,
+	})
 	if err != nil {
 		log.Fatalf("Registration failed: %v", err)
 	}
 
-	fmt.Println("✅ Registration successful!")
-	fmt.Printf("Device ID: %s\n", config.ID)
-	fmt.Printf("License: %s\n", config.License)
-	fmt.Printf("IPv4: %s\n", config.IPv4)
-	fmt.Printf("IPv6: %s\n", config.IPv6)
-	fmt.Printf("Endpoint V4: %s\n", config.EndpointV4)
-	fmt.Printf("Endpoint V6: %s\n", config.EndpointV6)
-	fmt.Printf("Config saved to: %s\n", *configPath)
-
 	// Test loading the saved config
-	fmt.Println("\nTesting config loading...")
-	loadedConfig, err := masque.LoadMasqueConfig(*configPath)
-	if err != nil {
+	if err := config.LoadConfig(*configPath); err != nil {
 		log.Fatalf("Failed to load saved config: %v", err)
 	}
+	loadedConfig := config.AppConfig
+
+	fmt.Println("✅ Registration successful!")
+	fmt.Printf("Device ID: %s\n", loadedConfig.ID)
+	fmt.Printf("License: %s\n", loadedConfig.License)
+	fmt.Printf("IPv4: %s\n", loadedConfig.IPv4)
+	fmt.Printf("IPv6: %s\n", loadedConfig.IPv6)
+	fmt.Printf("Endpoint V4: %s\n", loadedConfig.EndpointV4)
+	fmt.Printf("Endpoint V6: %s\n", loadedConfig.EndpointV6)
+	fmt.Printf("Config saved to: %s\n", *configPath)
 
 	if loadedConfig.License == "test-license-key" {
 		log.Fatalf("❌ Config still contains test values!")
@@ -16,6 +16,7 @@ import (
 	"syscall"
 	"time"
 
+	vconfig "github.com/voidr3aper-anon/Vwarp/config"
 	"github.com/voidr3aper-anon/Vwarp/ipscanner"
 	"github.com/voidr3aper-anon/Vwarp/masque"
 	"github.com/voidr3aper-anon/Vwarp/warp"
@@ -46,6 +47,7 @@ type config struct {
 	BucketSize       int
 	TestIP           string
 	AllPorts         bool
+	Ports            string
 	Concurrency      int
 	StopOnCount      int
 	ScanTimeout      time.Duration
@@ -58,6 +60,7 @@ type config struct {
 	OutputFile       string
 	OutputJSON       bool
 	ShowVersion      bool
+	ConfigFile       string
 	// MASQUE-specific options
 	EnableMasque bool
 	MasqueOnly   bool
@@ -123,6 +126,7 @@ func parseConfig(args []string, stderr io.Writer) (*config, error) {
 	fs.IntVar(&cfg.BucketSize, 0, "bucket-size", 1, "Number of random IPs to scan from each /24 or /120 subnet.")
 	fs.StringVar(&cfg.TestIP, 0, "test-ip", "", "Test all known WARP ports for a single IP address (exclusive mode).")
 	fs.BoolVar(&cfg.AllPorts, 0, "all-ports", "When used with --test-ip, tests all 65535 ports.")
+	fs.StringVar(&cfg.Ports, 0, "ports", "", "Comma-separated ports to probe on each IP (default: known WARP ports).")
 	fs.IntVar(&cfg.Concurrency, 'c', "concurrency", 100, "Number of concurrent scanners.")
 	fs.IntVar(&cfg.StopOnCount, 'n', "count", 0, "Stop after finding this many good IPs (0 for unlimited).")
 	fs.DurationVar(&cfg.ScanTimeout, 't', "timeout", 0, "Stop scan after this duration. 0 for unlimited.")
@@ -135,6 +139,7 @@ func parseConfig(args []string, stderr io.Writer) (*config, error) {
 	fs.StringVar(&cfg.OutputFile, 'o', "output", "", "Path to save the output. Prints to stdout if empty.")
 	fs.BoolVar(&cfg.OutputJSON, 0, "json", "Output results in JSON format.")
 	fs.BoolVar(&cfg.ShowVersion, 0, "version", "Display version information.")
+	fs.StringVar(&cfg.ConfigFile, 0, "config", "", "Path to a vwarp unified config; its scanner section fills any flags not given.")
 	// MASQUE flags
 	fs.BoolVar(&cfg.EnableMasque, 0, "masque", "Include MASQUE endpoints in the scan.")
 	fs.BoolVar(&cfg.MasqueOnly, 0, "masque-only", "Scan only MASQUE endpoints (excludes WireGuard endpoints).")
@@ -165,9 +170,62 @@ func parseConfig(args []string, stderr io.Writer) (*config, error) {
 		return nil, ff.ErrHelp
 	}
 
+	if cfg.ConfigFile != "" {
+		if err := applyConfigFile(cfg, fs); err != nil {
+			return nil, err
+		}
+	}
+
 	return cfg, nil
 }
 
+// applyConfigFile fills settings from the scanner section of a vwarp unified
+// config. Flags given on the command line take precedence.
+func applyConfigFile(cfg *config, fs *ff.FlagSet) error {
+	uc, err := vconfig.LoadFromFile(cfg.ConfigFile)
+	if err != nil {
+		return err
+	}
+	sc := uc.Scanner
+	if sc == nil {
+		return nil
+	}
+	if err := sc.Validate(); err != nil {
+		return fmt.Errorf("invalid scanner config: %w", err)
+	}
+
+	isSet := func(name string) bool {
+		f, ok := fs.GetFlag(name)
+		return ok && f.IsSet()
+	}
+
+	if !isSet("cidrs") && !isSet("endpoints") {
+		for _, r := range sc.Ranges {
+			if _, err := netip.ParsePrefix(r); err == nil {
+				cfg.Cidrs = append(cfg.Cidrs, r)
+			} else {
+				cfg.Endpoints = append(cfg.Endpoints, r)
+			}
+		}
+	}
+	if len(sc.Ports) > 0 && !isSet("ports") {
+		cfg.Ports = sc.PortList()
+	}
+	if sc.Workers > 0 && !isSet("concurrency") {
+		cfg.Concurrency = sc.Workers
+	}
+	if sc.Timeout != "" && !isSet("timeout") {
+		cfg.ScanTimeout, _ = sc.ScanTimeout()
+	}
+	if sc.Strategy != "" && !isSet("count") {
+		cfg.StopOnCount = 0
+		if sc.Strategy == vconfig.ScanStrategyFirst {
+			cfg.StopOnCount = 1
+		}
+	}
+	return nil
+}
+
 // canConnectIPv6 checks for basic IPv6 internet connectivity.
 func canConnectIPv6(remoteAddr netip.AddrPort) bool {
 	dialer := net.Dialer{
@@ -350,6 +408,9 @@ func buildScanner(cfg *config, logger *slog.Logger) (*ipscanner.IPScanner, error
 		// Always pass custom endpoints (if any). When endpoints are provided and no CIDRs
 		// are present, the engine will scan only those endpoints.
 		opts = append(opts, ipscanner.WithCustomEndpoints(cfg.Endpoints))
+		if cfg.Ports != "" {
+			opts = append(opts, ipscanner.WithCustomScanPorts(cfg.Ports))
+		}
 		if cfg.AllPorts {
 			logger.Warn("--all-ports flag has no effect without --test-ip.")
 		}
@@ -1,11 +1,17 @@
 package config
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/voidr3aper-anon/Vwarp/config/noize"
+	"github.com/voidr3aper-anon/Vwarp/masque/connecturi"
 )
 
 // UnifiedConfig represents the complete application configuration
@@ -16,10 +22,13 @@ type UnifiedConfig struct {
 	Key       string           `json:"key,omitempty"`
 	DNS       string           `json:"dns,omitempty"`
 	TestURL   string           `json:"test_url,omitempty"`
+	TestURLs  []string         `json:"test_urls,omitempty"`
 	Proxy     string           `json:"proxy,omitempty"`
 	WireGuard *WireGuardConfig `json:"wireguard,omitempty"`
 	MASQUE    *MASQUEConfig    `json:"masque,omitempty"`
 	Psiphon   *PsiphonConfig   `json:"psiphon,omitempty"`
+	ACL       *ACLConfig       `json:"acl,omitempty"`
+	Scanner   *ScannerConfig   `json:"scanner,omitempty"`
 	Metadata  *ConfigMetadata  `json:"metadata,omitempty"`
 }
 
@@ -29,6 +38,7 @@ type WireGuardConfig struct {
 	Config      string           `json:"config,omitempty"` // Path to WireGuard config file
 	Reserved    string           `json:"reserved,omitempty"`
 	FwMark      uint32           `json:"fwmark,omitempty"`
+	Tricks      []string         `json:"tricks,omitempty"`      // Handshake tricks tried in order, like ["t1", "t2"]
 	AtomicNoize *json.RawMessage `json:"atomicnoize,omitempty"` // AtomicNoize config
 }
 
@@ -37,6 +47,36 @@ type MASQUEConfig struct {
 	Enabled   bool             `json:"enabled"`
 	Preferred bool             `json:"preferred,omitempty"` // Prefer MASQUE over WireGuard
 	Config    *json.RawMessage `json:"config,omitempty"`    // MASQUE noize config
+
+	// ConnectURI is the Connect-IP URI template, {target_host} and {target_port}
+	// expand to the endpoint. EndpointConnectURIs overrides it per host:port or host.
+	ConnectURI          string            `json:"connect_uri,omitempty"`
+	EndpointConnectURIs map[string]string `json:"endpoint_connect_uris,omitempty"`
+	// ConnectProtocol is the :protocol of the Connect-IP request, "connect-ip"
+	// for RFC 9484 servers (Cloudflare's "cf-connect-ip" if empty)
+	ConnectProtocol string `json:"connect_protocol,omitempty"`
+	// InitialPacketSize is the size QUIC Initial datagrams are padded to, and
+	// InitialPadPattern the hex bytes the padding is filled with
+	InitialPacketSize uint16 `json:"initial_packet_size,omitempty"`
+	InitialPadPattern string `json:"initial_pad_pattern,omitempty"`
+}
+
+// Validate checks the Connect-IP URI templates and the Initial pad pattern
+func (m *MASQUEConfig) Validate() error {
+	if m.ConnectURI != "" {
+		if _, err := connecturi.Parse(m.ConnectURI); err != nil {
+			return fmt.Errorf("masque.connect_uri: %w", err)
+		}
+	}
+	for endpoint, template := range m.EndpointConnectURIs {
+		if _, err := connecturi.Parse(template); err != nil {
+			return fmt.Errorf("masque.endpoint_connect_uris[%s]: %w", endpoint, err)
+		}
+	}
+	if _, err := hex.DecodeString(m.InitialPadPattern); err != nil {
+		return fmt.Errorf("masque.initial_pad_pattern: %w", err)
+	}
+	return nil
 }
 
 // PsiphonConfig contains Psiphon-specific settings
@@ -45,6 +85,80 @@ type PsiphonConfig struct {
 	Country string `json:"country,omitempty"`
 }
 
+// ACLConfig restricts the destinations proxy clients may connect to.
+// Rules are CIDRs, domain suffixes and ports, e.g. "10.0.0.0/8", "example.com:443" or ":25".
+type ACLConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Scan strategies
+const (
+	// ScanStrategyFirst stops at the first working endpoint
+	ScanStrategyFirst = "first"
+	// ScanStrategyFastest scans until the timeout and keeps the lowest RTT
+	ScanStrategyFastest = "fastest"
+)
+
+// ScannerConfig contains endpoint scanner settings shared by vwarp --scan and warp-scan
+type ScannerConfig struct {
+	Ranges   []string `json:"ranges,omitempty"`   // CIDRs or endpoints to scan instead of the defaults
+	Ports    []int    `json:"ports,omitempty"`    // Ports to probe on each IP
+	Workers  int      `json:"workers,omitempty"`  // Concurrent scanners
+	Timeout  string   `json:"timeout,omitempty"`  // Scan duration limit, e.g. "30s"
+	Strategy string   `json:"strategy,omitempty"` // "first" (default) or "fastest"
+}
+
+// Validate checks the scanner settings
+func (s *ScannerConfig) Validate() error {
+	for _, port := range s.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid scanner port %d", port)
+		}
+	}
+	if s.Workers < 0 {
+		return fmt.Errorf("scanner workers cannot be negative, got %d", s.Workers)
+	}
+	timeout, err := s.ScanTimeout()
+	if err != nil {
+		return err
+	}
+	switch s.Strategy {
+	case "", ScanStrategyFirst:
+	case ScanStrategyFastest:
+		if timeout == 0 {
+			return errors.New("scanner strategy \"fastest\" requires a timeout")
+		}
+	default:
+		return fmt.Errorf("unknown scanner strategy %q", s.Strategy)
+	}
+	return nil
+}
+
+// ScanTimeout returns the parsed scan timeout, zero if unset
+func (s *ScannerConfig) ScanTimeout() (time.Duration, error) {
+	if s.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(s.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid scanner timeout: %w", err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("scanner timeout cannot be negative, got %s", s.Timeout)
+	}
+	return timeout, nil
+}
+
+// PortList returns the ports as a comma-separated list
+func (s *ScannerConfig) PortList() string {
+	ports := make([]string, len(s.Ports))
+	for i, port := range s.Ports {
+		ports[i] = strconv.Itoa(port)
+	}
+	return strings.Join(ports, ",")
+}
+
 // ConfigMetadata contains additional information about the configuration
 type ConfigMetadata struct {
 	Name        string `json:"name,omitempty"`
@@ -113,5 +227,17 @@ func (uc *UnifiedConfig) Validate() error {
 		return fmt.Errorf("wireguard requires either 'config' file path or 'endpoint'")
 	}
 
+	if uc.MASQUE != nil {
+		if err := uc.MASQUE.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if uc.Scanner != nil {
+		if err := uc.Scanner.Validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
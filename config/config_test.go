@@ -0,0 +1,121 @@
+package config
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadScannerConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"masque": {"enabled": true},
+		"scanner": {
+			"ranges": ["162.159.192.0/24", "2606:4700:d0::/48", "162.159.198.1:443"],
+			"ports": [443, 500, 4500],
+			"workers": 25,
+			"timeout": "45s",
+			"strategy": "fastest"
+		}
+	}`)
+
+	uc, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	if err := uc.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	sc := uc.Scanner
+	if sc == nil {
+		t.Fatal("scanner section not loaded")
+	}
+	if want := []string{"162.159.192.0/24", "2606:4700:d0::/48", "162.159.198.1:443"}; !slices.Equal(sc.Ranges, want) {
+		t.Errorf("Ranges = %v, want %v", sc.Ranges, want)
+	}
+	if got := sc.PortList(); got != "443,500,4500" {
+		t.Errorf("PortList = %q", got)
+	}
+	if sc.Workers != 25 || sc.Strategy != ScanStrategyFastest {
+		t.Errorf("Workers = %d, Strategy = %q", sc.Workers, sc.Strategy)
+	}
+	if timeout, err := sc.ScanTimeout(); err != nil || timeout != 45*time.Second {
+		t.Errorf("ScanTimeout = %v, %v", timeout, err)
+	}
+}
+
+func TestScannerConfigValidate(t *testing.T) {
+	invalid := []ScannerConfig{
+		{Ports: []int{0}},
+		{Ports: []int{65536}},
+		{Workers: -1},
+		{Timeout: "soon"},
+		{Timeout: "-5s"},
+		{Strategy: "random"},
+		{Strategy: ScanStrategyFastest},
+	}
+	for _, sc := range invalid {
+		if err := sc.Validate(); err == nil {
+			t.Errorf("%+v accepted", sc)
+		}
+	}
+
+	valid := []ScannerConfig{{}, {Strategy: ScanStrategyFirst}, {Strategy: ScanStrategyFastest, Timeout: "10s"}}
+	for _, sc := range valid {
+		if err := sc.Validate(); err != nil {
+			t.Errorf("%+v rejected: %v", sc, err)
+		}
+	}
+}
+
+func TestMASQUEConnectURIValidatedAtLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		masque string
+	}{
+		{"unclosed expression", `{"enabled": true, "connect_uri": "https://{target_host/masque"}`},
+		{"unknown variable", `{"enabled": true, "connect_uri": "https://{target}/masque"}`},
+		{"not https", `{"enabled": true, "endpoint_connect_uris": {"162.159.198.1": "http://{target_host}/masque"}}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uc, err := LoadFromFile(writeConfig(t, `{"masque": `+tc.masque+`}`))
+			if err != nil {
+				t.Fatalf("LoadFromFile: %v", err)
+			}
+			if err := uc.Validate(); err == nil {
+				t.Fatal("Validate accepted an invalid Connect-IP URI template")
+			}
+		})
+	}
+
+	uc, err := LoadFromFile(writeConfig(t, `{"masque": {"enabled": true,
+		"connect_uri": "https://{target_host}:{target_port}/.well-known/masque/ip/",
+		"endpoint_connect_uris": {"162.159.198.1:443": "https://cloudflareaccess.com"}}}`))
+	if err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	if err := uc.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestMASQUEInitialPadding(t *testing.T) {
+	uc, err := LoadFromFile(writeConfig(t, `{"masque": {"enabled": true, "initial_packet_size": 1350, "initial_pad_pattern": "deadbeef"}}`))
+	if err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	if err := uc.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if uc.MASQUE.InitialPacketSize != 1350 || uc.MASQUE.InitialPadPattern != "deadbeef" {
+		t.Errorf("initial padding = %d %q, want 1350 deadbeef", uc.MASQUE.InitialPacketSize, uc.MASQUE.InitialPadPattern)
+	}
+
+	uc, err = LoadFromFile(writeConfig(t, `{"masque": {"enabled": true, "initial_pad_pattern": "not hex"}}`))
+	if err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	if err := uc.Validate(); err == nil {
+		t.Error("Validate accepted a pad pattern that isn't hex")
+	}
+}
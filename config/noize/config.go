@@ -221,3 +221,12 @@ func (c *UnifiedNoizeConfig) GetMASQUEPreset() string {
 	}
 	return c.MASQUE.Preset
 }
+
+// GetMASQUEConfig returns the MASQUE obfuscation config, or nil if c is nil
+// or MASQUE obfuscation is not enabled
+func (c *UnifiedNoizeConfig) GetMASQUEConfig() *noize.NoizeConfig {
+	if c == nil || !c.IsMASQUEEnabled() {
+		return nil
+	}
+	return c.MASQUE.Config
+}
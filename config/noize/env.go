@@ -0,0 +1,99 @@
+package noize
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Environment variables that override the resolved noize configuration at
+// startup, to iterate on a hostile network without editing the config file.
+// They take precedence over everything else: environment, then the config
+// file, then --noize-preset.
+const (
+	EnvPreset   = "VWARP_NOIZE_PRESET"   // Replaces the configuration with this preset, before the other overrides
+	EnvJc       = "VWARP_NOIZE_JC"       // Junk packet count of both WireGuard and MASQUE
+	EnvFragment = "VWARP_NOIZE_FRAGMENT" // MASQUE fragment size in bytes, 0 disables fragmentation
+)
+
+// ApplyEnvOverrides applies the overrides that getenv (os.Getenv outside of
+// tests) returns to config and returns the result, which is a new
+// configuration when EnvPreset is set. masque enables the MASQUE side of a
+// preset as well, like --noize-preset does in MASQUE mode. Overrides of a
+// side that is not configured are ignored.
+func ApplyEnvOverrides(config *UnifiedNoizeConfig, masque bool, getenv func(string) string) (*UnifiedNoizeConfig, error) {
+	if preset := getenv(EnvPreset); preset != "" {
+		var err error
+		config, err = NewConfigLoader().LoadFromPreset(preset)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvPreset, err)
+		}
+		config.EnableWireGuard(preset)
+		if masque {
+			config.EnableMASQUE(preset)
+		}
+	}
+
+	jc, err := envInt(getenv, EnvJc)
+	if err != nil {
+		return nil, err
+	}
+	fragment, err := envInt(getenv, EnvFragment)
+	if err != nil {
+		return nil, err
+	}
+	if jc < 0 && fragment < 0 {
+		return config, nil
+	}
+	if config == nil {
+		return nil, fmt.Errorf("%s and %s need noize enabled or %s set", EnvJc, EnvFragment, EnvPreset)
+	}
+
+	if wg := config.WireGuard; wg != nil && wg.AtomicNoize != nil && jc >= 0 {
+		wg.AtomicNoize.Jc = jc
+		fitJunkCounts(jc, &wg.AtomicNoize.JcBeforeHS, &wg.AtomicNoize.JcAfterI1, &wg.AtomicNoize.JcAfterHS)
+		if err := config.validateAtomicNoizeConfig(wg.AtomicNoize); err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvJc, err)
+		}
+	}
+	if m := config.MASQUE; m != nil && m.Config != nil {
+		if jc >= 0 {
+			m.Config.Jc = jc
+			fitJunkCounts(jc, &m.Config.JcBeforeHS, &m.Config.JcAfterI1, &m.Config.JcDuringHS, &m.Config.JcAfterHS)
+		}
+		if fragment >= 0 {
+			m.Config.FragmentSize = fragment
+		}
+		if err := config.validateMASQUEConfig(m.Config); err != nil {
+			return nil, fmt.Errorf("noize environment overrides: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// envInt returns the non-negative integer in the variable name, or -1 if it
+// is not set
+func envInt(getenv func(string) string, name string) (int, error) {
+	s := getenv(name)
+	if s == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, s)
+	}
+	return n, nil
+}
+
+// fitJunkCounts lowers the per-phase junk packet counts, the last phase
+// first, until together they fit in total
+func fitJunkCounts(total int, phases ...*int) {
+	sum := 0
+	for _, p := range phases {
+		sum += *p
+	}
+	for i := len(phases) - 1; i >= 0 && sum > total; i-- {
+		cut := min(*phases[i], sum-total)
+		*phases[i] -= cut
+		sum -= cut
+	}
+}
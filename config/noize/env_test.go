@@ -0,0 +1,54 @@
+package noize
+
+import "testing"
+
+func TestApplyEnvOverridesJc(t *testing.T) {
+	env := map[string]string{EnvJc: "1", EnvFragment: "300"}
+	config, err := NewConfigLoader().LoadFromPreset("medium")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err = ApplyEnvOverrides(config, true, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("ApplyEnvOverrides: %v", err)
+	}
+	wg, m := config.WireGuard.AtomicNoize, config.MASQUE.Config
+	if wg.Jc != 1 || m.Jc != 1 {
+		t.Errorf("Jc = %d (WireGuard), %d (MASQUE), want 1", wg.Jc, m.Jc)
+	}
+	// The medium preset spreads 4 and 3 junk packets over the handshake phases
+	if sum := wg.JcBeforeHS + wg.JcAfterI1 + wg.JcAfterHS; sum > 1 {
+		t.Errorf("WireGuard phases send %d junk packets, more than Jc", sum)
+	}
+	if sum := m.JcBeforeHS + m.JcAfterI1 + m.JcDuringHS + m.JcAfterHS; sum > 1 {
+		t.Errorf("MASQUE phases send %d junk packets, more than Jc", sum)
+	}
+	if m.FragmentSize != 300 {
+		t.Errorf("FragmentSize = %d, want 300", m.FragmentSize)
+	}
+
+	// The preset replaces the configuration before Jc applies to it
+	env = map[string]string{EnvPreset: "heavy", EnvJc: "2"}
+	config, err = ApplyEnvOverrides(config, true, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("ApplyEnvOverrides: %v", err)
+	}
+	if config.GetMASQUEPreset() != "heavy" || config.MASQUE.Config.Jc != 2 || config.MASQUE.Config.FragmentSize == 300 {
+		t.Errorf("preset %q with Jc %d and fragment size %d, want heavy with Jc 2", config.GetMASQUEPreset(), config.MASQUE.Config.Jc, config.MASQUE.Config.FragmentSize)
+	}
+
+	for _, env := range []map[string]string{
+		{EnvJc: "many"},
+		{EnvJc: "21"}, // Above the MASQUE maximum
+		{EnvFragment: "-1"},
+		{EnvPreset: "nonexistent"},
+	} {
+		if _, err := ApplyEnvOverrides(config, true, func(name string) string { return env[name] }); err == nil {
+			t.Errorf("%v accepted", env)
+		}
+	}
+	if _, err := ApplyEnvOverrides(nil, false, func(name string) string { return map[string]string{EnvJc: "3"}[name] }); err == nil {
+		t.Error("Jc override accepted without a noize config")
+	}
+}
@@ -204,6 +204,12 @@ func (cl *ConfigLoader) mergeAtomicNoizeConfig(base, override *preflightbind.Ato
 	if override.HandshakeDelay != 0 {
 		base.HandshakeDelay = override.HandshakeDelay
 	}
+	if override.MaxJunkPPS != 0 {
+		base.MaxJunkPPS = override.MaxJunkPPS
+	}
+	if override.MaxOverheadBytes != 0 {
+		base.MaxOverheadBytes = override.MaxOverheadBytes
+	}
 }
 
 // mergeNoizeConfig merges MASQUE Noize configurations
@@ -230,6 +236,15 @@ func (cl *ConfigLoader) mergeNoizeConfig(base, override *noize.NoizeConfig) {
 	if override.FragmentDelay != 0 {
 		base.FragmentDelay = override.FragmentDelay
 	}
+	if override.CoalesceSize != 0 {
+		base.CoalesceSize = override.CoalesceSize
+	}
+	if override.CoalesceWindow != 0 {
+		base.CoalesceWindow = override.CoalesceWindow
+	}
+	if override.MaxDatagramSize != 0 {
+		base.MaxDatagramSize = override.MaxDatagramSize
+	}
 	if override.PaddingMin != 0 {
 		base.PaddingMin = override.PaddingMin
 	}
@@ -262,6 +277,12 @@ func (cl *ConfigLoader) mergeNoizeConfig(base, override *noize.NoizeConfig) {
 		base.JunkInterval = override.JunkInterval
 	}
 	base.JunkRandom = override.JunkRandom
+	if override.MaxJunkPPS != 0 {
+		base.MaxJunkPPS = override.MaxJunkPPS
+	}
+	if override.MaxOverheadBytes != 0 {
+		base.MaxOverheadBytes = override.MaxOverheadBytes
+	}
 	if override.MimicProtocol != "" {
 		base.MimicProtocol = override.MimicProtocol
 	}
@@ -269,6 +290,7 @@ func (cl *ConfigLoader) mergeNoizeConfig(base, override *noize.NoizeConfig) {
 	if override.HandshakeDelay != 0 {
 		base.HandshakeDelay = override.HandshakeDelay
 	}
+	base.SyncPreflight = override.SyncPreflight
 	if override.PacketDelay != 0 {
 		base.PacketDelay = override.PacketDelay
 	}
@@ -286,8 +308,14 @@ func (cl *ConfigLoader) mergeNoizeConfig(base, override *noize.NoizeConfig) {
 	if len(override.FakeALPN) > 0 {
 		base.FakeALPN = override.FakeALPN
 	}
+	if override.HandshakeProfile != "" {
+		base.HandshakeProfile = override.HandshakeProfile
+	}
 	base.ReversedOrder = override.ReversedOrder
 	base.DuplicatePackets = override.DuplicatePackets
+	if override.DuplicateCount != 0 {
+		base.DuplicateCount = override.DuplicateCount
+	}
 	base.AllowZeroSize = override.AllowZeroSize
 	base.UseTimestamp = override.UseTimestamp
 	base.UseNonce = override.UseNonce
@@ -153,6 +153,12 @@ func (cv *ConfigValidator) ValidateAtomicNoizeConfig(config *preflightbind.Atomi
 	if config.HandshakeDelay > 10*time.Second {
 		return fmt.Errorf("handshake delay should not exceed 10 seconds to avoid timeouts")
 	}
+	if config.MaxJunkPPS < 0 {
+		return fmt.Errorf("junk packet rate cannot be negative, got %d", config.MaxJunkPPS)
+	}
+	if err := validateOverheadCap(config.MaxOverheadBytes, config.JcAfterI1+config.JcBeforeHS, config.Jmin); err != nil {
+		return err
+	}
 
 	// Validate signature packets format (basic validation)
 	signatures := []string{config.I1, config.I2, config.I3, config.I4, config.I5}
@@ -223,6 +229,17 @@ func (cv *ConfigValidator) ValidateNoizeConfig(config *noize.NoizeConfig) error
 		return fmt.Errorf("fragment delay cannot be negative")
 	}
 
+	// Validate coalescing settings
+	if config.CoalesceSize < 0 || config.MaxDatagramSize < 0 {
+		return fmt.Errorf("coalesce and maximum datagram sizes cannot be negative")
+	}
+	if config.MaxDatagramSize > 0 && config.CoalesceSize > config.MaxDatagramSize {
+		return fmt.Errorf("coalesce size (%d) cannot exceed the maximum datagram size (%d)", config.CoalesceSize, config.MaxDatagramSize)
+	}
+	if config.CoalesceWindow < 0 || config.CoalesceWindow > 100*time.Millisecond {
+		return fmt.Errorf("coalesce window must be between 0 and 100ms, got %v", config.CoalesceWindow)
+	}
+
 	// Validate padding settings
 	if config.PaddingMin < 0 {
 		return fmt.Errorf("minimum padding cannot be negative, got %d", config.PaddingMin)
@@ -247,6 +264,12 @@ func (cv *ConfigValidator) ValidateNoizeConfig(config *noize.NoizeConfig) error
 	if config.HandshakeDelay > 10*time.Second {
 		return fmt.Errorf("handshake delay should not exceed 10 seconds")
 	}
+	if config.MaxJunkPPS < 0 {
+		return fmt.Errorf("junk packet rate cannot be negative, got %d", config.MaxJunkPPS)
+	}
+	if err := validateOverheadCap(config.MaxOverheadBytes, config.JcBeforeHS+config.JcAfterI1+config.JcDuringHS, config.Jmin); err != nil {
+		return err
+	}
 	if config.PacketDelay < 0 {
 		return fmt.Errorf("packet delay cannot be negative")
 	}
@@ -270,6 +293,18 @@ func (cv *ConfigValidator) ValidateNoizeConfig(config *noize.NoizeConfig) error
 		return fmt.Errorf("SNI fragment size should be at least 8 bytes if enabled")
 	}
 
+	// Validate handshake shaping
+	if config.HandshakeProfile != "" {
+		if _, ok := noize.HandshakeProfiles[config.HandshakeProfile]; !ok {
+			return fmt.Errorf("invalid handshake profile %s, must be one of: %v", config.HandshakeProfile, noize.HandshakeProfileNames())
+		}
+	}
+
+	// Validate packet duplication
+	if config.DuplicateCount < 0 || config.DuplicateCount > 5 {
+		return fmt.Errorf("duplicate count must be between 0 and 5, got %d", config.DuplicateCount)
+	}
+
 	// Validate fake loss ratio
 	if config.FakeLoss < 0 || config.FakeLoss > 1.0 {
 		return fmt.Errorf("fake loss ratio must be between 0.0 and 1.0, got %f", config.FakeLoss)
@@ -326,6 +361,18 @@ func (cv *ConfigValidator) isValidPreset(preset string) bool {
 	return cv.stringInSlice(preset, validPresets)
 }
 
+// validateOverheadCap checks MaxOverheadBytes against the pre-handshake junk:
+// a cap smaller than a single junk packet would silently disable all junk
+func validateOverheadCap(maxOverhead, preHandshakeJunk, jmin int) error {
+	if maxOverhead < 0 {
+		return fmt.Errorf("overhead cap cannot be negative, got %d", maxOverhead)
+	}
+	if maxOverhead > 0 && preHandshakeJunk > 0 && maxOverhead < jmin {
+		return fmt.Errorf("overhead cap (%d bytes) is smaller than one junk packet (%d bytes)", maxOverhead, jmin)
+	}
+	return nil
+}
+
 // stringInSlice checks if a string is in a slice
 func (cv *ConfigValidator) stringInSlice(str string, slice []string) bool {
 	for _, s := range slice {
@@ -354,6 +401,9 @@ func (cv *ConfigValidator) ValidateAndSuggestFixes(config *UnifiedNoizeConfig) (
 		if atomic.HandshakeDelay > 100*time.Millisecond {
 			suggestions = append(suggestions, fmt.Sprintf("WireGuard handshake delay (%v) is high, may cause connection timeouts", atomic.HandshakeDelay))
 		}
+		if junk := (atomic.JcAfterI1 + atomic.JcBeforeHS) * atomic.Jmax; atomic.MaxOverheadBytes > 0 && atomic.MaxOverheadBytes < junk {
+			suggestions = append(suggestions, fmt.Sprintf("WireGuard overhead cap (%d bytes) is below the configured pre-handshake junk (up to %d bytes), junk will be truncated", atomic.MaxOverheadBytes, junk))
+		}
 	}
 
 	if config.IsMASQUEEnabled() && config.MASQUE.Config != nil {
@@ -364,6 +414,9 @@ func (cv *ConfigValidator) ValidateAndSuggestFixes(config *UnifiedNoizeConfig) (
 		if masque.HandshakeDelay > 200*time.Millisecond {
 			suggestions = append(suggestions, fmt.Sprintf("MASQUE handshake delay (%v) is high, may cause connection timeouts", masque.HandshakeDelay))
 		}
+		if junk := (masque.JcBeforeHS + masque.JcAfterI1 + masque.JcDuringHS) * masque.Jmax; masque.MaxOverheadBytes > 0 && masque.MaxOverheadBytes < junk {
+			suggestions = append(suggestions, fmt.Sprintf("MASQUE overhead cap (%d bytes) is below the configured pre-handshake junk (up to %d bytes), junk will be truncated", masque.MaxOverheadBytes, junk))
+		}
 		if masque.PaddingMax > 200 {
 			suggestions = append(suggestions, fmt.Sprintf("MASQUE padding (%d bytes) is high, consider reducing for lower overhead", masque.PaddingMax))
 		}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/voidr3aper-anon/Vwarp/config/noize"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
+)
+
+// Report is the result of checking a configuration file without connecting
+type Report struct {
+	Path        string   `json:"path"`
+	Valid       bool     `json:"valid"`
+	Errors      []string `json:"errors,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// ValidateFile loads and validates the configuration at path, collecting hard
+// errors and performance/security suggestions for its noize settings
+func ValidateFile(path string) Report {
+	r := Report{Path: path}
+
+	uc, err := LoadFromFile(path)
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+		return r
+	}
+
+	if err := uc.Validate(); err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	}
+
+	if uc.ACL != nil {
+		if _, err := acl.New(uc.ACL.Allow, uc.ACL.Deny); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("invalid acl: %v", err))
+		}
+	}
+
+	noizeConfig, err := uc.GetNoizeConfig()
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	} else if noizeConfig.IsWireGuardEnabled() || noizeConfig.IsMASQUEEnabled() {
+		suggestions, err := noize.NewConfigValidator().ValidateAndSuggestFixes(noizeConfig)
+		if err != nil {
+			r.Errors = append(r.Errors, err.Error())
+		}
+		r.Suggestions = suggestions
+	}
+
+	r.Valid = len(r.Errors) == 0
+	return r
+}
+
+// Err returns an error if the configuration has hard errors
+func (r Report) Err() error {
+	if r.Valid {
+		return nil
+	}
+	return errors.New("configuration is invalid")
+}
+
+// WriteText prints the report for humans
+func (r Report) WriteText(w io.Writer) error {
+	status := "valid"
+	if !r.Valid {
+		status = "invalid"
+	}
+	if _, err := fmt.Fprintf(w, "%s: %s\n", r.Path, status); err != nil {
+		return err
+	}
+	for _, e := range r.Errors {
+		if _, err := fmt.Fprintf(w, "  error: %s\n", e); err != nil {
+			return err
+		}
+	}
+	for _, s := range r.Suggestions {
+		if _, err := fmt.Fprintf(w, "  suggestion: %s\n", s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON prints the report as indented JSON
+func (r Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
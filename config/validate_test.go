@@ -0,0 +1,76 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestValidateFileSuggestionsOnly(t *testing.T) {
+	path := writeConfig(t, `{
+		"masque": {"enabled": true, "config": {"Jc": 12, "Jmin": 40, "Jmax": 70}},
+		"acl": {"deny": ["10.0.0.0/8", ":25"]}
+	}`)
+
+	r := ValidateFile(path)
+	if err := r.Err(); err != nil {
+		t.Fatalf("valid config rejected: %v (%v)", err, r.Errors)
+	}
+	if len(r.Suggestions) == 0 {
+		t.Fatal("expected a suggestion for the high junk packet count")
+	}
+
+	var out bytes.Buffer
+	if err := r.WriteText(&out); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	if !strings.Contains(out.String(), "valid") || !strings.Contains(out.String(), "suggestion: MASQUE junk packet count") {
+		t.Fatalf("unexpected text report:\n%s", out.String())
+	}
+}
+
+func TestValidateFileHardError(t *testing.T) {
+	path := writeConfig(t, `{
+		"masque": {"enabled": true, "config": {"Jc": 2, "Jmin": 100, "Jmax": 50}},
+		"acl": {"allow": ["example.com:0"]}
+	}`)
+
+	r := ValidateFile(path)
+	if r.Err() == nil {
+		t.Fatal("invalid config accepted")
+	}
+	if len(r.Errors) != 2 {
+		t.Fatalf("errors = %q, want the ACL and junk size errors", r.Errors)
+	}
+
+	var out bytes.Buffer
+	if err := r.WriteJSON(&out); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("report is not JSON: %v", err)
+	}
+	if decoded.Valid || len(decoded.Errors) != 2 {
+		t.Fatalf("decoded report = %+v", decoded)
+	}
+}
+
+func TestValidateFileUnreadable(t *testing.T) {
+	r := ValidateFile(writeConfig(t, "{not json"))
+	if r.Valid || len(r.Errors) != 1 {
+		t.Fatalf("report = %+v", r)
+	}
+}
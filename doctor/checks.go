@@ -0,0 +1,204 @@
+package doctor
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/config"
+	"github.com/voidr3aper-anon/Vwarp/preflight"
+)
+
+const (
+	// minMasqueMTU is the smallest MTU that carries a full QUIC datagram plus headers
+	minMasqueMTU = 1280
+	// recommendedMasqueMTU matches the threshold iputils warns about
+	recommendedMasqueMTU = 1300
+)
+
+func checkConfig(path string) Finding {
+	f := Finding{Check: "config"}
+
+	uc, err := config.LoadFromFile(path)
+	if err != nil {
+		f.Severity = SeverityCritical
+		f.Message = err.Error()
+		f.Fix = "fix the JSON syntax or regenerate the file with --noize-export"
+		return f
+	}
+	if err := uc.Validate(); err != nil {
+		f.Severity = SeverityCritical
+		f.Message = fmt.Sprintf("invalid configuration: %v", err)
+		f.Fix = "enable a 'wireguard' or 'masque' section with the required fields"
+		return f
+	}
+	noizeConfig, err := uc.GetNoizeConfig()
+	if err == nil {
+		err = noizeConfig.Validate()
+	}
+	if err != nil {
+		f.Severity = SeverityCritical
+		f.Message = fmt.Sprintf("invalid noize settings: %v", err)
+		f.Fix = "start from a preset with --noize-export and adjust it"
+		return f
+	}
+
+	f.Severity = SeverityOK
+	f.Message = fmt.Sprintf("%s is valid", path)
+	return f
+}
+
+func checkQUIC(ctx context.Context, endpoint string, timeout time.Duration) Finding {
+	f := Finding{Check: "quic"}
+
+	versions, err := preflight.ProbeQUIC(ctx, endpoint, timeout)
+	switch {
+	case errors.Is(err, preflight.ErrNoQUICResponse):
+		f.Severity = SeverityCritical
+		f.Message = fmt.Sprintf("no reply to a QUIC probe from %s within %s; UDP/QUIC is likely blocked", endpoint, timeout)
+		f.Fix = "use --masque-preferred to fall back to WireGuard automatically, or try another endpoint with --scan"
+		return f
+	case errors.Is(err, preflight.ErrUnexpectedQUICResponse):
+		f.Severity = SeverityWarning
+		f.Message = fmt.Sprintf("%s answered the QUIC probe with an unexpected packet", endpoint)
+		f.Fix = "a middlebox may be tampering with QUIC; try enabling --noize"
+		return f
+	case err != nil:
+		f.Severity = SeverityCritical
+		f.Message = fmt.Sprintf("QUIC probe to %s failed: %v", endpoint, err)
+		f.Fix = "check the endpoint address and your network connection"
+		return f
+	}
+
+	for _, v := range versions {
+		if v == preflight.QUICVersion1 {
+			f.Severity = SeverityOK
+			f.Message = fmt.Sprintf("%s speaks QUIC v1 (HTTP/3 available)", endpoint)
+			return f
+		}
+	}
+	f.Severity = SeverityWarning
+	f.Message = fmt.Sprintf("%s answered over QUIC but does not offer QUIC v1", endpoint)
+	f.Fix = "this does not look like a MASQUE endpoint; pick another with --endpoint"
+	return f
+}
+
+func checkTLS(ctx context.Context, endpoint, sni string, timeout time.Duration) Finding {
+	f := Finding{Check: "http2"}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d := tls.Dialer{Config: &tls.Config{
+		ServerName: sni,
+		NextProtos: []string{"h2", "http/1.1"},
+		// Only reachability is probed; nothing is sent over this connection
+		InsecureSkipVerify: true,
+	}}
+	conn, err := d.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		f.Severity = SeverityWarning
+		f.Message = fmt.Sprintf("TLS over TCP to %s failed: %v", endpoint, err)
+		f.Fix = "TCP/443 appears filtered; only UDP-based modes can work on this network"
+		return f
+	}
+	defer conn.Close()
+
+	if proto := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; proto != "h2" {
+		f.Severity = SeverityInfo
+		f.Message = fmt.Sprintf("%s accepted TLS over TCP but did not negotiate HTTP/2 (got %q)", endpoint, proto)
+		return f
+	}
+	f.Severity = SeverityOK
+	f.Message = fmt.Sprintf("%s accepts TLS over TCP with HTTP/2", endpoint)
+	return f
+}
+
+func checkIPv6(ctx context.Context, target string, timeout time.Duration) Finding {
+	f := Finding{Check: "ipv6"}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Connecting a UDP socket only consults the routing table
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp6", target)
+	if err != nil {
+		f.Severity = SeverityInfo
+		f.Message = "no IPv6 route is available"
+		f.Fix = "pass -4 so only IPv4 endpoints are used"
+		return f
+	}
+	conn.Close()
+
+	f.Severity = SeverityOK
+	f.Message = "an IPv6 route is available"
+	return f
+}
+
+func checkMTU(probe func() (int, error)) Finding {
+	f := Finding{Check: "mtu"}
+
+	mtu, err := probe()
+	if err != nil {
+		f.Severity = SeverityWarning
+		f.Message = fmt.Sprintf("failed to detect the network MTU: %v", err)
+		return f
+	}
+
+	switch {
+	case mtu < minMasqueMTU:
+		f.Severity = SeverityCritical
+		f.Message = fmt.Sprintf("interface MTU %d is below %d; QUIC packets will not fit", mtu, minMasqueMTU)
+		f.Fix = "raise the interface MTU to at least 1300 or use WireGuard mode"
+	case mtu < recommendedMasqueMTU:
+		f.Severity = SeverityWarning
+		f.Message = fmt.Sprintf("interface MTU %d is below the recommended %d", mtu, recommendedMasqueMTU)
+		f.Fix = "raise the interface MTU to at least 1300 to avoid MASQUE timeouts"
+	default:
+		f.Severity = SeverityOK
+		f.Message = fmt.Sprintf("interface MTU %d is sufficient", mtu)
+	}
+	return f
+}
+
+func checkDNS(ctx context.Context, server, name string, tunnelDial func(ctx context.Context, network, address string) (net.Conn, error), timeout time.Duration) Finding {
+	f := Finding{Check: "dns"}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	via := server
+	dial := tunnelDial
+	if dial != nil {
+		via += " through the tunnel"
+	} else {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dial(ctx, "udp", server)
+		},
+	}
+	addrs, err := resolver.LookupHost(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		f.Severity = SeverityCritical
+		f.Message = fmt.Sprintf("resolving %s via %s failed: %v", name, via, err)
+		f.Fix = "pick a reachable resolver with --dns, or pass an IP address to --endpoint"
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			f.Severity = SeverityWarning
+			f.Fix = "the resolver may be filtering Cloudflare names; pick another with --dns"
+		}
+		return f
+	}
+
+	f.Severity = SeverityOK
+	f.Message = fmt.Sprintf("%s resolves via %s (%d addresses)", name, via, len(addrs))
+	return f
+}
@@ -0,0 +1,156 @@
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the per-probe timeout used when Options.Timeout is zero
+const DefaultTimeout = 3 * time.Second
+
+// Severity ranks how urgently a finding needs attention
+type Severity int
+
+const (
+	SeverityOK Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityOK:
+		return "ok"
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// MarshalText encodes the severity by name so JSON output stays readable
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding is the outcome of a single diagnostic check
+type Finding struct {
+	Check    string   `json:"check"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	Fix      string   `json:"fix,omitempty"`
+}
+
+// Options selects what the doctor probes. Empty fields skip the corresponding check.
+type Options struct {
+	// ConfigPath is a unified configuration file to validate
+	ConfigPath string
+	// Endpoint is the MASQUE endpoint (host:port) probed over QUIC and TLS/TCP
+	Endpoint string
+	// SNI is sent in the TLS/TCP probe
+	SNI string
+	// DNS is the resolver (host:port) used for the DNS check
+	DNS string
+	// DNSName is the name resolved by the DNS check
+	DNSName string
+	// TunnelDial dials through the tunnel. The DNS check reaches the resolver
+	// through it when set, so it fails when the tunnel's DNS does, and from
+	// the host otherwise.
+	TunnelDial func(ctx context.Context, network, address string) (net.Conn, error)
+	// IPv6Target is dialed over UDP to check for an IPv6 route; no packet is sent
+	IPv6Target string
+	// MTUProbe returns the smallest MTU of the active interfaces
+	MTUProbe func() (int, error)
+	// Timeout bounds each network probe
+	Timeout time.Duration
+}
+
+// Run executes every configured check and returns the findings, most severe first
+func Run(ctx context.Context, opts Options) []Finding {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	var findings []Finding
+	if opts.ConfigPath != "" {
+		findings = append(findings, checkConfig(opts.ConfigPath))
+	}
+	if opts.Endpoint != "" {
+		quic := checkQUIC(ctx, opts.Endpoint, opts.Timeout)
+		tls := checkTLS(ctx, opts.Endpoint, opts.SNI, opts.Timeout)
+		findings = append(findings, quic, tls)
+		if quic.Severity == SeverityCritical && tls.Severity != SeverityOK {
+			findings = append(findings, Finding{
+				Check:    "endpoint",
+				Severity: SeverityCritical,
+				Message:  fmt.Sprintf("%s is unreachable over both UDP and TCP", opts.Endpoint),
+				Fix:      "pick another endpoint with --endpoint or let vwarp find one with --scan",
+			})
+		}
+	}
+	if opts.IPv6Target != "" {
+		findings = append(findings, checkIPv6(ctx, opts.IPv6Target, opts.Timeout))
+	}
+	if opts.MTUProbe != nil {
+		findings = append(findings, checkMTU(opts.MTUProbe))
+	}
+	if opts.DNS != "" && opts.DNSName != "" {
+		findings = append(findings, checkDNS(ctx, opts.DNS, opts.DNSName, opts.TunnelDial, opts.Timeout))
+	}
+
+	Sort(findings)
+	return findings
+}
+
+// Sort orders findings by descending severity, keeping check order within a level
+func Sort(findings []Finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+}
+
+// WriteText prints findings as a human-readable list
+func WriteText(w io.Writer, findings []Finding) error {
+	for _, f := range findings {
+		if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", strings.ToUpper(f.Severity.String()), f.Check, f.Message); err != nil {
+			return err
+		}
+		if f.Fix != "" {
+			if _, err := fmt.Fprintf(w, "    fix: %s\n", f.Fix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteJSON prints findings as an indented JSON array
+func WriteJSON(w io.Writer, findings []Finding) error {
+	if findings == nil {
+		findings = []Finding{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(findings)
+}
+
+// Healthy reports whether none of the findings is critical
+func Healthy(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityCritical {
+			return false
+		}
+	}
+	return true
+}
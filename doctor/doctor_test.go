@@ -0,0 +1,271 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/preflight"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer is an in-process stand-in for a MASQUE endpoint and a resolver
+type testServer struct {
+	endpoint string // QUIC (UDP) and TLS (TCP) on the same port
+	dns      string
+}
+
+// startTestServer starts the fake endpoint. Each fault disables one service
+// while keeping its port bound, so probes see a silent or closed peer.
+func startTestServer(t *testing.T, blockQUIC, blockTCP, blockDNS bool) testServer {
+	t.Helper()
+
+	tlsServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	t.Cleanup(tlsServer.Close)
+	tcpAddr := tlsServer.Listener.Addr().(*net.TCPAddr)
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port})
+	if err != nil {
+		t.Skipf("UDP port %d is taken: %v", tcpAddr.Port, err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	if !blockQUIC {
+		go serveVersionNegotiation(udp)
+	}
+
+	if blockTCP {
+		tlsServer.Close()
+	}
+
+	dns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { dns.Close() })
+	if !blockDNS {
+		go serveDNS(dns)
+	}
+
+	return testServer{endpoint: tcpAddr.String(), dns: dns.LocalAddr().String()}
+}
+
+// serveVersionNegotiation answers every datagram like a QUIC v1 server
+func serveVersionNegotiation(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 6 || n < 6+int(buf[5]) {
+			continue
+		}
+		dcid := buf[6 : 6+int(buf[5])]
+		resp := []byte{0x80, 0, 0, 0, 0}
+		resp = append(resp, 0) // echo of the empty source connection ID
+		resp = append(resp, byte(len(dcid)))
+		resp = append(resp, dcid...)
+		resp = binary.BigEndian.AppendUint32(resp, preflight.QUICVersion1)
+		_, _ = conn.WriteToUDP(resp, addr)
+	}
+}
+
+// serveDNS answers A queries with 192.0.2.1 and everything else with no records
+func serveDNS(conn *net.UDPConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+			continue
+		}
+		msg.Header.Response = true
+		msg.Header.RecursionAvailable = true
+		q := msg.Questions[0]
+		if q.Type == dnsmessage.TypeA {
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			}}
+		}
+		resp, err := msg.Pack()
+		if err != nil {
+			continue
+		}
+		_, _ = conn.WriteToUDP(resp, addr)
+	}
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func severities(findings []Finding) map[string]Severity {
+	m := make(map[string]Severity)
+	for _, f := range findings {
+		m[f.Check] = f.Severity
+	}
+	return m
+}
+
+func TestDoctorHealthy(t *testing.T) {
+	srv := startTestServer(t, false, false, false)
+	findings := Run(t.Context(), Options{
+		ConfigPath: writeConfig(t, `{"masque": {"enabled": true}}`),
+		Endpoint:   srv.endpoint,
+		SNI:        "example.com",
+		DNS:        srv.dns,
+		DNSName:    "engage.cloudflareclient.com",
+		MTUProbe:   func() (int, error) { return 1500, nil },
+		Timeout:    time.Second,
+	})
+
+	for _, f := range findings {
+		if f.Severity != SeverityOK {
+			t.Errorf("%s: %s %q", f.Check, f.Severity, f.Message)
+		}
+	}
+	got := severities(findings)
+	for _, check := range []string{"config", "quic", "http2", "mtu", "dns"} {
+		if _, ok := got[check]; !ok {
+			t.Errorf("missing %s finding", check)
+		}
+	}
+	if !Healthy(findings) {
+		t.Error("expected a healthy report")
+	}
+}
+
+func TestDoctorInjectedFaults(t *testing.T) {
+	srv := startTestServer(t, true, true, true)
+	findings := Run(t.Context(), Options{
+		ConfigPath: writeConfig(t, `{"masque": {"enabled": true`),
+		Endpoint:   srv.endpoint,
+		SNI:        "example.com",
+		DNS:        srv.dns,
+		DNSName:    "engage.cloudflareclient.com",
+		MTUProbe:   func() (int, error) { return 1290, nil },
+		Timeout:    300 * time.Millisecond,
+	})
+
+	want := map[string]Severity{
+		"config":   SeverityCritical,
+		"quic":     SeverityCritical,
+		"endpoint": SeverityCritical,
+		"dns":      SeverityCritical,
+		"http2":    SeverityWarning,
+		"mtu":      SeverityWarning,
+	}
+	got := severities(findings)
+	for check, severity := range want {
+		if got[check] != severity {
+			t.Errorf("%s: severity %s, want %s", check, got[check], severity)
+		}
+	}
+	for _, f := range findings {
+		if f.Severity >= SeverityWarning && f.Check != "mtu" && f.Fix == "" {
+			t.Errorf("%s: missing suggested fix", f.Check)
+		}
+	}
+
+	// Findings are prioritized: every critical comes before every warning
+	for i := 1; i < len(findings); i++ {
+		if findings[i].Severity > findings[i-1].Severity {
+			t.Fatalf("finding %d (%s) is more severe than finding %d (%s)", i, findings[i].Severity, i-1, findings[i-1].Severity)
+		}
+	}
+	if Healthy(findings) {
+		t.Error("expected an unhealthy report")
+	}
+}
+
+func TestDoctorMTUProbeError(t *testing.T) {
+	findings := Run(t.Context(), Options{
+		MTUProbe: func() (int, error) { return 0, errors.New("no interfaces") },
+	})
+	if len(findings) != 1 || findings[0].Severity != SeverityWarning {
+		t.Fatalf("findings = %+v", findings)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	findings := []Finding{
+		{Check: "quic", Severity: SeverityCritical, Message: "blocked", Fix: "use --masque-preferred"},
+		{Check: "mtu", Severity: SeverityOK, Message: "fine"},
+	}
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, findings); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	var decoded []map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if len(decoded) != 2 || decoded[0]["severity"] != "critical" || decoded[1]["fix"] != "" {
+		t.Errorf("decoded = %v", decoded)
+	}
+
+	buf.Reset()
+	if err := WriteJSON(&buf, nil); err != nil || buf.String() != "[]\n" {
+		t.Errorf("empty report = %q, %v", buf.String(), err)
+	}
+}
+
+func TestDoctorDNSThroughTunnel(t *testing.T) {
+	srv := startTestServer(t, false, false, false)
+
+	var dials atomic.Int32
+	tunnelDial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	findings := Run(t.Context(), Options{
+		DNS:        srv.dns,
+		DNSName:    "engage.cloudflareclient.com",
+		TunnelDial: tunnelDial,
+		Timeout:    time.Second,
+	})
+	if len(findings) != 1 || findings[0].Severity != SeverityOK {
+		t.Fatalf("findings = %+v", findings)
+	}
+	if dials.Load() == 0 {
+		t.Error("DNS check did not resolve through the tunnel")
+	}
+
+	// The host reaches the resolver, the tunnel doesn't
+	down := errors.New("MASQUE tunnel is down")
+	findings = Run(t.Context(), Options{
+		DNS:     srv.dns,
+		DNSName: "engage.cloudflareclient.com",
+		TunnelDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, down
+		},
+		Timeout: time.Second,
+	})
+	if len(findings) != 1 || findings[0].Severity != SeverityCritical || !strings.Contains(findings[0].Message, "through the tunnel") {
+		t.Fatalf("findings = %+v", findings)
+	}
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/voidr3aper-anon/Vwarp/ipscanner/statute"
+)
+
+// canonicalAddr returns the form endpoints are deduplicated by: resolvers
+// hand out IPv4 addresses as IPv4-mapped IPv6, which probe the same host
+func canonicalAddr(addr netip.Addr) netip.Addr {
+	return addr.Unmap()
+}
+
+// candidateEndpoints merges the addresses sampled from the CIDR ranges with
+// the custom endpoints so that every ip:port is probed once. Sampled
+// addresses get port 0, a random WARP port at probe time, unless the address
+// also has explicit ports, which then stand for it.
+func candidateEndpoints(sampled []netip.Addr, custom []netip.AddrPort) []statute.IPInfo {
+	var order []netip.Addr
+	ports := make(map[netip.Addr][]uint16)
+	add := func(addr netip.Addr, port uint16) {
+		addr = canonicalAddr(addr)
+		known, seen := ports[addr]
+		if !seen {
+			order = append(order, addr)
+		}
+		if !slices.Contains(known, port) {
+			ports[addr] = append(known, port)
+		}
+	}
+	for _, ap := range custom {
+		add(ap.Addr(), ap.Port())
+	}
+	for _, addr := range sampled {
+		if _, ok := ports[canonicalAddr(addr)]; !ok {
+			add(addr, 0)
+		}
+	}
+
+	candidates := make([]statute.IPInfo, 0, len(order))
+	for _, addr := range order {
+		for _, port := range ports[addr] {
+			candidates = append(candidates, statute.IPInfo{AddrPort: netip.AddrPortFrom(addr, port)})
+		}
+	}
+	return candidates
+}
+
+// portScanTargets returns the ports to test per address with duplicate
+// addresses and ports merged
+func portScanTargets(targets map[netip.Addr][]uint16) map[netip.Addr][]uint16 {
+	merged := make(map[netip.Addr][]uint16, len(targets))
+	for addr, ports := range targets {
+		addr = canonicalAddr(addr)
+		for _, port := range ports {
+			if !slices.Contains(merged[addr], port) {
+				merged[addr] = append(merged[addr], port)
+			}
+		}
+	}
+	return merged
+}
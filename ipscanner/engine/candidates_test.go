@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestCandidateEndpoints(t *testing.T) {
+	sampled := []netip.Addr{
+		netip.MustParseAddr("::1"),
+		netip.MustParseAddr("0:0:0:0:0:0:0:1"),
+		netip.MustParseAddr("162.159.192.7"),
+		netip.MustParseAddr("::ffff:162.159.192.7"),
+		netip.MustParseAddr("162.159.192.9"),
+	}
+	custom := []netip.AddrPort{
+		netip.MustParseAddrPort("[::ffff:162.159.192.9]:2408"),
+		netip.MustParseAddrPort("162.159.192.9:2408"),
+		netip.MustParseAddrPort("162.159.192.9:500"),
+	}
+
+	var got []netip.AddrPort
+	for _, c := range candidateEndpoints(sampled, custom) {
+		got = append(got, c.AddrPort)
+	}
+	want := []netip.AddrPort{
+		netip.MustParseAddrPort("162.159.192.9:2408"),
+		netip.MustParseAddrPort("162.159.192.9:500"),
+		netip.MustParseAddrPort("[::1]:0"),
+		netip.MustParseAddrPort("162.159.192.7:0"),
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+}
+
+func TestPortScanTargets(t *testing.T) {
+	got := portScanTargets(map[netip.Addr][]uint16{
+		netip.MustParseAddr("162.159.192.1"):        {2408, 2408, 500},
+		netip.MustParseAddr("::ffff:162.159.192.1"): {500, 1701},
+	})
+	ports := got[netip.MustParseAddr("162.159.192.1")]
+	slices.Sort(ports)
+	if len(got) != 1 || !slices.Equal(ports, []uint16{500, 1701, 2408}) {
+		t.Fatalf("targets = %v, want 162.159.192.1 with ports [500 1701 2408]", got)
+	}
+}
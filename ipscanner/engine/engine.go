@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"math/rand/v2"
 	"net/netip"
 	"sync"
 
@@ -39,7 +40,7 @@ func (e *Engine) runPortScan(ctx context.Context, cancel context.CancelFunc) {
 	e.log.Info("Starting dedicated port scan.")
 	var wg sync.WaitGroup
 
-	for ip, ports := range e.opts.TestPortsForIPs {
+	for ip, ports := range portScanTargets(e.opts.TestPortsForIPs) {
 		ipCopy, portsCopy := ip, ports
 		for _, port := range portsCopy {
 			if ctx.Err() != nil {
@@ -58,7 +59,7 @@ func (e *Engine) runPortScan(ctx context.Context, cancel context.CancelFunc) {
 
 				addrWithPort := netip.AddrPortFrom(ip, port)
 				e.log.Debug("Testing port", "endpoint", addrWithPort)
-				warpInfo, err := pinger.WarpPing(ctx, ip)
+				warpInfo, err := e.endpointPing(ctx, pinger, ip)
 				if err == nil {
 					e.log.Debug("WARP port scan success", "addr", warpInfo.AddrPort, "rtt", warpInfo.RTT)
 					e.ipQueue.Enqueue(warpInfo)
@@ -85,43 +86,16 @@ func (e *Engine) Run(parentCtx context.Context) {
 
 	e.log.Debug("[1] Generating candidate IPs and endpoints")
 
-	candidatePorts := make(map[netip.Addr][]uint16)
-
-	appendIfMissing := func(slice []uint16, v uint16) []uint16 {
-		for _, x := range slice {
-			if x == v {
-				return slice
-			}
-		}
-		return append(slice, v)
-	}
-
 	generator := iterator.NewIterator(e.opts)
 	cidrIPs, err := generator.Generate()
 	if err != nil {
 		e.log.Debug("Could not generate IPs from CIDR ranges", "reason", err)
-	} else {
-		for _, ip := range cidrIPs {
-			candidatePorts[ip] = appendIfMissing(candidatePorts[ip], 0)
-		}
-	}
-
-	for _, ep := range e.opts.CustomEndpoints {
-		ip := ep.Addr()
-		port := ep.Port()
-		candidatePorts[ip] = appendIfMissing(candidatePorts[ip], port)
-	}
-
-	allCandidateIPInfos := make([]statute.IPInfo, 0)
-	for ip, ports := range candidatePorts {
-		if len(ports) == 0 {
-			allCandidateIPInfos = append(allCandidateIPInfos, statute.IPInfo{AddrPort: netip.AddrPortFrom(ip, 0)})
-			continue
-		}
-		for _, p := range ports {
-			allCandidateIPInfos = append(allCandidateIPInfos, statute.IPInfo{AddrPort: netip.AddrPortFrom(ip, p)})
-		}
 	}
+	allCandidateIPInfos := candidateEndpoints(cidrIPs, e.opts.CustomEndpoints)
+	// Probe in random order rather than subnet by subnet
+	rand.Shuffle(len(allCandidateIPInfos), func(i, j int) {
+		allCandidateIPInfos[i], allCandidateIPInfos[j] = allCandidateIPInfos[j], allCandidateIPInfos[i]
+	})
 	e.log.Info("IP generation complete", "count", len(allCandidateIPInfos))
 	if len(allCandidateIPInfos) == 0 {
 		e.log.Warn("No candidate IPs were generated or provided, stopping scan.")
@@ -241,7 +215,7 @@ func (e *Engine) Run(parentCtx context.Context) {
 							localOpts.Port = e.opts.Port
 						}
 						pinger := ping.Ping{Options: &localOpts}
-						warpInfo, err := pinger.WarpPing(ctx, ipInfo.AddrPort.Addr())
+						warpInfo, err := e.endpointPing(ctx, pinger, ipInfo.AddrPort.Addr())
 						if err == nil {
 							e.log.Debug("WARP ping success", "addr", warpInfo.AddrPort, "rtt", warpInfo.RTT)
 							e.ipQueue.Enqueue(warpInfo)
@@ -265,6 +239,16 @@ func (e *Engine) Run(parentCtx context.Context) {
 	e.log.Info("Scan pipeline complete.", "found_count", e.ipQueue.Size())
 }
 
+// endpointPing runs the final endpoint check: a WARP handshake, or a keyless
+// QUIC reachability probe in probe-only and MASQUE modes. The probe must get
+// an answer on the probe port itself, which the result then carries.
+func (e *Engine) endpointPing(ctx context.Context, pinger ping.Ping, ip netip.Addr) (statute.IPInfo, error) {
+	if e.opts.MasqueOnly || e.opts.ProbeOnly {
+		return pinger.QuicPing(ctx, ip)
+	}
+	return pinger.WarpPing(ctx, ip)
+}
+
 // runFilterStage a generic helper function for creating a pipeline filter stage
 // It creates a pool of workers that read from inChan, process items using filterFunc,
 // and write successful results to outChan.
@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
 
 	"github.com/voidr3aper-anon/Vwarp/ipscanner/statute"
@@ -360,13 +361,44 @@ func shuffleSubnetsIpRange(subnets []ipRange) error {
 	return nil
 }
 
+// normalizePrefixes returns prefixes masked, with IPv4-mapped IPv6 prefixes
+// as IPv4, and without the prefixes another one already covers, so
+// overlapping ranges are not sampled twice
+func normalizePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	normalized := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if !p.IsValid() {
+			continue
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		normalized = append(normalized, p.Masked())
+	}
+
+	// Widest first, so a prefix is only kept if no kept one contains it
+	slices.SortStableFunc(normalized, func(a, b netip.Prefix) int {
+		return a.Bits() - b.Bits()
+	})
+	var kept []netip.Prefix
+	for _, p := range normalized {
+		covered := slices.ContainsFunc(kept, func(k netip.Prefix) bool {
+			return k.Contains(p.Addr())
+		})
+		if !covered {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
 func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
 	g := &IpGenerator{
 		ipRanges: make([]ipRange, 0),
 		opts:     opts,
 	}
 
-	for _, cidr := range opts.CidrList {
+	for _, cidr := range normalizePrefixes(opts.CidrList) {
 		if !opts.UseIPv6 && cidr.Addr().Is6() {
 			continue
 		}
@@ -21,6 +21,11 @@ func (p *Ping) WarpPing(ctx context.Context, ip netip.Addr) (statute.IPInfo, err
 	return p.calc(ctx, NewWarpPing(ip, p.Options))
 }
 
+// QuicPing performs a keyless QUIC reachability test on the given IP address.
+func (p *Ping) QuicPing(ctx context.Context, ip netip.Addr) (statute.IPInfo, error) {
+	return p.calc(ctx, NewQuicPing(ip, p.Options))
+}
+
 // TcpPing performs a TCP connection test on the given IP address.
 func (p *Ping) TcpPing(ctx context.Context, ip netip.Addr) (statute.IPInfo, error) {
 	return p.calc(ctx,
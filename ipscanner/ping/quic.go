@@ -0,0 +1,80 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/ipscanner/statute"
+	"github.com/voidr3aper-anon/Vwarp/preflight"
+)
+
+// quicProbePort is probed when ScannerOptions.ProbePort is not set
+const quicProbePort = 443
+
+type QuicPingResult struct {
+	AddrPort netip.AddrPort
+	RTT      time.Duration
+	Err      error
+}
+
+func (q *QuicPingResult) Result() statute.IPInfo {
+	return statute.IPInfo{AddrPort: q.AddrPort, RTT: q.RTT, CreatedAt: time.Now()}
+}
+
+func (q *QuicPingResult) Error() error {
+	return q.Err
+}
+
+func (q *QuicPingResult) String() string {
+	if q.Err != nil {
+		return fmt.Sprintf("%s", q.Err)
+	} else {
+		return fmt.Sprintf("%s: protocol=%s, time=%d ms", q.AddrPort, "quic", q.RTT)
+	}
+}
+
+// QuicPing checks UDP/QUIC reachability without any keys: it sends a QUIC
+// Initial with an unsupported version to the probe port and waits for Version
+// Negotiation. The result carries the probe port, the only one the probe
+// vouches for.
+type QuicPing struct {
+	IP netip.Addr
+
+	opts statute.ScannerOptions
+}
+
+func (q *QuicPing) Ping() statute.IPingResult {
+	return q.PingContext(context.Background())
+}
+
+func (q *QuicPing) PingContext(ctx context.Context) statute.IPingResult {
+	port := q.opts.ProbePort
+	if port == 0 {
+		port = quicProbePort
+	}
+	addr := netip.AddrPortFrom(q.IP, port)
+
+	timeout := q.opts.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	t0 := time.Now()
+	if _, err := preflight.ProbeQUIC(ctx, addr.String(), timeout); err != nil {
+		return &QuicPingResult{AddrPort: addr, Err: err}
+	}
+	return &QuicPingResult{AddrPort: addr, RTT: time.Since(t0)}
+}
+
+func NewQuicPing(ip netip.Addr, opts *statute.ScannerOptions) *QuicPing {
+	return &QuicPing{
+		IP:   ip,
+		opts: *opts,
+	}
+}
+
+var (
+	_ statute.IPing       = (*QuicPing)(nil)
+	_ statute.IPingResult = (*QuicPingResult)(nil)
+)
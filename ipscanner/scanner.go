@@ -610,11 +610,34 @@ func WithEnableMasqueScanning(enable bool) Option {
 	}
 }
 
-// WithMasqueOnly scans only MASQUE endpoints (excludes WireGuard)
+// WithProbeOnly replaces the WARP handshake with a keyless QUIC reachability
+// probe on the probe port (WithProbePort, default 443), so no device has to be
+// registered to get keys. IPs are returned with the probe port. The TCP ping
+// filter is skipped as the probe already checks reachability.
+func WithProbeOnly(probeOnly bool) Option {
+	return func(i *IPScanner) {
+		i.options.ProbeOnly = probeOnly
+		if probeOnly {
+			i.options.TcpPing = false
+		}
+	}
+}
+
+// WithProbePort sets the UDP port probed in probe-only and MASQUE-only modes (default 443)
+func WithProbePort(port uint16) Option {
+	return func(i *IPScanner) {
+		i.options.ProbePort = port
+	}
+}
+
+// WithMasqueOnly scans only MASQUE endpoints (excludes WireGuard): instead of
+// the WARP handshake, each IP must answer a keyless QUIC probe on the MASQUE
+// port (WithProbePort, default 443), and is returned with that port
 func WithMasqueOnly(masqueOnly bool) Option {
 	return func(i *IPScanner) {
 		i.options.MasqueOnly = masqueOnly
 		if masqueOnly {
+			i.options.TcpPing = false
 			i.options.EnableMasqueScanning = true
 			if len(i.options.MasqueScanPorts) == 0 {
 				i.options.MasqueScanPorts = i.options.GetDefaultMasquePorts()
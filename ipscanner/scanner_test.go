@@ -0,0 +1,171 @@
+package ipscanner
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveVersionNegotiation answers QUIC long header packets on conn with
+// Version Negotiation, like any QUIC server does for an unknown version,
+// counting them in probes if set
+func serveVersionNegotiation(conn *net.UDPConn, probes *atomic.Int32) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkt := buf[:n]
+		if n < 7 || pkt[0]&0x80 == 0 {
+			continue
+		}
+		if probes != nil {
+			probes.Add(1)
+		}
+		dcidLen := int(pkt[5])
+		if n < 7+dcidLen || n < 7+dcidLen+int(pkt[6+dcidLen]) {
+			continue
+		}
+		dcid := pkt[6 : 6+dcidLen]
+		scid := pkt[7+dcidLen : 7+dcidLen+int(pkt[6+dcidLen])]
+
+		reply := []byte{0x80, 0, 0, 0, 0, byte(len(scid))}
+		reply = append(reply, scid...)
+		reply = append(reply, byte(len(dcid)))
+		reply = append(reply, dcid...)
+		reply = binary.BigEndian.AppendUint32(reply, 1)
+		conn.WriteToUDP(reply, addr)
+	}
+}
+
+func probeOnlyScan(t *testing.T, probePort uint16) []netip.AddrPort {
+	t.Helper()
+	scanner := NewScanner(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithUseIPv6(false),
+		WithProbeOnly(true),
+		WithProbePort(probePort),
+		WithAppendCustomEndpoint("127.0.0.1:2408"),
+		WithStopOnFirstGoodIPs(1),
+		WithScanTimeout(5*time.Second),
+	)
+	if scanner.options.WarpPrivateKey != "" || scanner.options.WarpPeerPublicKey != "" {
+		t.Fatal("probe-only scanner was given WARP keys")
+	}
+	scanner.Run(context.Background())
+
+	var found []netip.AddrPort
+	for _, ip := range scanner.GetAvailableIPs() {
+		found = append(found, ip.AddrPort)
+	}
+	return found
+}
+
+func TestProbeOnlyScanWithoutKeys(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveVersionNegotiation(conn, nil)
+
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	found := probeOnlyScan(t, port)
+	// Reported with the port that answered, not the endpoint's WARP port
+	want := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+	if len(found) != 1 || found[0] != want {
+		t.Fatalf("probe-only scan found %v, want [%v]", found, want)
+	}
+}
+
+func TestProbeOnlyScanUnreachable(t *testing.T) {
+	// A bound socket that never answers
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if found := probeOnlyScan(t, uint16(conn.LocalAddr().(*net.UDPAddr).Port)); len(found) != 0 {
+		t.Fatalf("probe-only scan found %v behind a silent port", found)
+	}
+}
+
+func TestScanProbesEachEndpointOnce(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var probes atomic.Int32
+	go serveVersionNegotiation(conn, &probes)
+
+	// Overlapping ranges and the same endpoint in several spellings
+	scanner := NewScanner(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithUseIPv6(false),
+		WithProbeOnly(true),
+		WithProbePort(uint16(conn.LocalAddr().(*net.UDPAddr).Port)),
+		WithCidrList([]netip.Prefix{
+			netip.MustParsePrefix("127.0.0.1/32"),
+			netip.MustParsePrefix("127.0.0.0/31"),
+			netip.MustParsePrefix("::ffff:127.0.0.1/128"),
+		}),
+		WithCustomEndpoints([]string{"127.0.0.1:2408", "[::ffff:127.0.0.1]:2408", "127.0.0.1:2408"}),
+		WithScanTimeout(5*time.Second),
+	)
+	scanner.Run(context.Background())
+
+	found := scanner.GetAvailableIPs()
+	want := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(conn.LocalAddr().(*net.UDPAddr).Port))
+	if len(found) != 1 || found[0].AddrPort != want {
+		t.Fatalf("scan found %v, want only %v", found, want)
+	}
+	if got := probes.Load(); got != 1 {
+		t.Fatalf("127.0.0.1 was probed %d times, want once", got)
+	}
+}
+
+func TestMasqueScanKeepsOnly443Reachable(t *testing.T) {
+	reachable, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reachable.Close()
+	go serveVersionNegotiation(reachable, nil)
+	// Stands in for 443: the MASQUE port of each candidate
+	port := reachable.LocalAddr().(*net.UDPAddr).Port
+
+	// The same port on another address, bound but never answering
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port})
+	if err != nil {
+		t.Skipf("can't bind 127.0.0.2: %v", err)
+	}
+	defer silent.Close()
+
+	scanner := NewScanner(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithUseIPv6(false),
+		WithMasqueOnly(true),
+		WithProbePort(uint16(port)),
+		WithCustomEndpoints([]string{"127.0.0.1:2408", "127.0.0.2:2408"}),
+		WithScanTimeout(5*time.Second),
+	)
+	if scanner.options.TcpPing {
+		t.Error("MASQUE scan still filters on TCP ping")
+	}
+	scanner.Run(context.Background())
+
+	found := scanner.GetAvailableIPs()
+	want := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(port))
+	if len(found) != 1 || found[0].AddrPort != want {
+		t.Fatalf("MASQUE scan found %v, want only %v", found, want)
+	}
+}
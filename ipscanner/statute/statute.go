@@ -65,6 +65,8 @@ type ScannerOptions struct {
 	ConcurrentScanners    int
 	ScanTimeout           time.Duration
 	StopOnFirstGoodIPs    int
+	ProbeOnly             bool   // Check QUIC reachability instead of a WARP handshake, no keys needed
+	ProbePort             uint16 // UDP port of the probe-only and MASQUE-only QUIC check, 443 if zero
 }
 
 func (e *ScannerOptions) GetRandomWarpPort() uint16 {
@@ -111,3 +111,55 @@ func ParseResolveAddressPort(hostname string, includev6 bool, dnsServer string)
 
 	return netip.AddrPort{}, errors.New("no valid IP addresses found")
 }
+
+// InterfaceAddr returns the first IPv4 (or, with v6 set, IPv6) address of the
+// named network interface that a socket can be bound to, skipping IPv6
+// link-local addresses, which need a zone.
+func InterfaceAddr(name string, v6 bool) (netip.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to list addresses of %s: %w", name, err)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.Is6() == v6 && !addr.IsLinkLocalUnicast() {
+			return addr, nil
+		}
+	}
+	family := "IPv4"
+	if v6 {
+		family = "IPv6"
+	}
+	return netip.Addr{}, fmt.Errorf("interface %s has no usable %s address", name, family)
+}
+
+// familyProbeAddrs are public addresses whose routes tell whether the host
+// can reach the IPv4 and the IPv6 Internet
+var familyProbeAddrs = [2]string{"1.1.1.1:443", "[2606:4700:4700::1111]:443"}
+
+// HostFamilies reports whether the host has a route to the IPv4 and to the
+// IPv6 Internet. It only connects UDP sockets, which sends no packets.
+func HostFamilies() (v4, v6 bool) {
+	return hasRoute("udp4", familyProbeAddrs[0]), hasRoute("udp6", familyProbeAddrs[1])
+}
+
+func hasRoute(network, address string) bool {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
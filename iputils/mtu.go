@@ -114,7 +114,7 @@ func getSystemMTU() map[string]int {
 func DetectAndCheckMTUForMasque(logger *slog.Logger) {
 	logger.Info("Starting MASQUE MTU compatibility check")
 
-	minMTU, maxMTU, interfaces, err := detectNetworkMTU()
+	minMTU, maxMTU, interfaces, err := DetectNetworkMTU()
 	if err != nil {
 		logger.Error("Failed to detect network MTU", "error", err)
 		logger.Warn("Using default MTU assumption", "default_mtu", 1396)
@@ -146,8 +146,8 @@ func DetectAndCheckMTUForMasque(logger *slog.Logger) {
 	}
 }
 
-// detectNetworkMTU detects the MTU of active network interfaces using system commands when possible
-func detectNetworkMTU() (minMTU int, maxMTU int, interfaceInfo []string, err error) {
+// DetectNetworkMTU detects the MTU of active network interfaces using system commands when possible
+func DetectNetworkMTU() (minMTU int, maxMTU int, interfaceInfo []string, err error) {
 	// First try to get system MTU values using appropriate commands
 	systemMTU := getSystemMTU()
 
@@ -0,0 +1,92 @@
+// Package junkbudget bounds the junk and signature packets the MASQUE and
+// WireGuard obfuscators send around a handshake: a Limiter paces junk to a
+// packet rate, and an OverheadCap limits the bytes of one sequence.
+package junkbudget
+
+import (
+	"log/slog"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter paces junk packets. A nil Limiter is unlimited.
+type Limiter struct {
+	limiter *rate.Limiter
+}
+
+// NewLimiter returns a Limiter allowing pps junk packets per second, or nil
+// when pps is 0 or less
+func NewLimiter(pps int) *Limiter {
+	if pps <= 0 {
+		return nil
+	}
+	return &Limiter{limiter: rate.NewLimiter(rate.Limit(pps), 1)}
+}
+
+// Wait waits until the next junk packet may go out. With a budget the wait
+// is taken from it, and Wait returns false without waiting when the budget
+// can't cover it, so junk never holds the handshake past its delay.
+func (l *Limiter) Wait(budget *time.Duration) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	r := l.limiter.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if budget != nil {
+		if delay > *budget {
+			r.CancelAt(now)
+			return false
+		}
+		*budget -= delay
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// OverheadCap counts the bytes of one obfuscation sequence against a limit.
+// A nil OverheadCap allows everything.
+type OverheadCap struct {
+	limit     int
+	sent      int
+	truncated bool
+	logger    *slog.Logger
+}
+
+// NewOverheadCap returns a cap of limit bytes that reports truncation to
+// logger, or nil when limit is 0 or less
+func NewOverheadCap(limit int, logger *slog.Logger) *OverheadCap {
+	if limit <= 0 {
+		return nil
+	}
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	return &OverheadCap{limit: limit, logger: logger}
+}
+
+// Fits reports whether n more bytes fit under the cap. Once a packet doesn't
+// fit, the rest of the sequence is dropped too. Fits charges nothing: call
+// Sent once the packet is actually written.
+func (c *OverheadCap) Fits(n int) bool {
+	if c == nil {
+		return true
+	}
+	if c.truncated {
+		return false
+	}
+	if c.sent+n > c.limit {
+		c.truncated = true
+		c.logger.Info("obfuscation overhead cap reached, truncating sequence", "sent", c.sent, "limit", c.limit)
+		return false
+	}
+	return true
+}
+
+// Sent charges n bytes that were written against the cap
+func (c *OverheadCap) Sent(n int) {
+	if c != nil {
+		c.sent += n
+	}
+}
@@ -0,0 +1,60 @@
+package junkbudget
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverheadCap(t *testing.T) {
+	var logs bytes.Buffer
+	c := NewOverheadCap(100, slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// Checking a packet that is then not sent charges nothing
+	for range 3 {
+		if !c.Fits(60) {
+			t.Fatal("60 bytes rejected by an empty 100 byte cap")
+		}
+	}
+	c.Sent(60)
+	if !c.Fits(40) {
+		t.Error("40 bytes rejected with 60 of 100 sent")
+	}
+	if c.Fits(41) {
+		t.Error("41 bytes accepted with 60 of 100 sent")
+	}
+	// The sequence stays truncated after the first packet that didn't fit
+	if c.Fits(1) {
+		t.Error("1 byte accepted after the cap truncated the sequence")
+	}
+	if !strings.Contains(logs.String(), "overhead cap reached") {
+		t.Errorf("truncation not logged to the injected logger: %q", logs.String())
+	}
+
+	unlimited := NewOverheadCap(0, nil)
+	if !unlimited.Fits(1 << 20) {
+		t.Error("cap of 0 bytes is not unlimited")
+	}
+	unlimited.Sent(1 << 20)
+}
+
+func TestLimiterBudget(t *testing.T) {
+	l := NewLimiter(10)
+	budget := 50 * time.Millisecond
+	if !l.Wait(&budget) {
+		t.Fatal("first packet held back")
+	}
+	// The next packet needs 100ms, more than is left of the budget
+	if l.Wait(&budget) {
+		t.Error("packet sent past the budget")
+	}
+	if budget != 50*time.Millisecond {
+		t.Errorf("skipped packet took %v from the budget", 50*time.Millisecond-budget)
+	}
+
+	if !NewLimiter(0).Wait(nil) {
+		t.Error("limiter of 0 pps held a packet back")
+	}
+}
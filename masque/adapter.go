@@ -7,18 +7,24 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/big"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/voidr3aper-anon/Vwarp/masque/connecturi"
 	"github.com/voidr3aper-anon/Vwarp/masque/noize"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
@@ -26,6 +32,7 @@ import (
 	"github.com/Diniboy1123/usque/config"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/logging"
 )
 
 const (
@@ -37,17 +44,70 @@ const (
 	ConnectURI = "https://cloudflareaccess.com"
 )
 
+// DefaultTunnelMTU is the MTU of the Connect-IP tunnel when AdapterConfig.MTU is not set
+const DefaultTunnelMTU = 1280
+
+// DefaultCertValidity is how long the generated client certificate is valid
+// when AdapterConfig.CertValidity is not set
+const DefaultCertValidity = 24 * time.Hour
+
+// ErrPacketTooLarge is returned by Write for packets the tunnel cannot carry
+var ErrPacketTooLarge = errors.New("packet too large for the MASQUE tunnel")
+
+// ErrEndpointKeyMismatch is wrapped by handshake errors from an endpoint that
+// doesn't present the pinned public key
+var ErrEndpointKeyMismatch = errors.New("endpoint public key doesn't match the pinned key")
+
+// ErrTOSNotAccepted is returned when a new device would be registered with
+// AdapterConfig.RequireTOS set but AcceptTOS not
+var ErrTOSNotAccepted = errors.New("registering a device requires accepting the Cloudflare terms of service")
+
+// registerDevice registers a new device account, replaced in tests
+var registerDevice = api.Register
+
+// TunnelRejectedError is returned when the endpoint answers the Connect-IP
+// request with a status other than 200
+type TunnelRejectedError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *TunnelRejectedError) Error() string {
+	return "MASQUE tunnel connection failed: " + e.Status
+}
+
+// DefaultALPN is the protocol list offered on the MASQUE TLS handshake
+var DefaultALPN = []string{http3.NextProtoH3}
+
+// ipPacketConn is the packet interface of a Connect-IP session (*connectip.Conn)
+type ipPacketConn interface {
+	ReadPacket(b []byte, allowAny bool) (int, error)
+	WritePacket(b []byte) ([]byte, error)
+	Close() error
+}
+
 // MasqueAdapter bridges usque library to vwarp's infrastructure
 type MasqueAdapter struct {
+	mu        sync.RWMutex // guards the tunnel fields below against Reconnect
 	config    *config.Config
-	conn      interface{} // *net.UDPConn (HTTP/3) or net.Conn (HTTP/2)
-	ipConn    *connectip.Conn
+	conn      interface{}       // *net.UDPConn (HTTP/3) or net.Conn (HTTP/2)
+	quic      *http3.ClientConn // The HTTP/3 connection over conn, nil over HTTP/2
+	ipConn    ipPacketConn
+	connect   func(context.Context) (*MasqueAdapter, error) // establishes a fresh tunnel for Reconnect
+	rebind    bool                                          // connect binds the old tunnel's source port again
+	reconnect sync.Mutex                                    // serializes Reconnect calls
 	logger    *slog.Logger
 	endpoint  string
 	sni       string
 	useIPv6   bool
 	localIPv4 string
 	localIPv6 string
+	mtu       int
+	workers   int
+	path      *pathQuality // RTT and loss of the tunnel's QUIC connection
+
+	assignedV4, assignedV6 netip.Addr     // Connect-IP ADDRESS_ASSIGN, invalid if not sent
+	routes                 []netip.Prefix // Connect-IP ROUTE_ADVERTISEMENT, nil if not sent
 }
 
 // AdapterConfig holds configuration for creating a MASQUE adapter
@@ -61,6 +121,7 @@ type AdapterConfig struct {
 	// SNI override (optional, uses DefaultMasqueSNI if not set)
 	SNI string
 	// UseIPv6 determines whether to use IPv6 endpoint
+	// (if not set, IPv6 is still preferred on hosts without an IPv4 route)
 	UseIPv6 bool
 	// Logger for debug/info logging
 	Logger *slog.Logger
@@ -68,6 +129,79 @@ type AdapterConfig struct {
 	License string
 	// NoizeConfig for QUIC obfuscation (optional)
 	NoizeConfig *noize.NoizeConfig
+	// Obfuscator is a custom QUIC obfuscation scheme (optional, takes precedence over NoizeConfig)
+	Obfuscator Obfuscator
+	// ConnectHeaders are extra headers sent on the Connect-IP request (optional)
+	ConnectHeaders http.Header
+	// EgressInterface binds the QUIC socket to this interface's address (optional)
+	EgressInterface string
+	// SourcePortRange restricts the local QUIC port to an inclusive range (optional, ephemeral if zero)
+	SourcePortRange [2]int
+	// StableSourcePort reuses the previous local QUIC port across reconnects (NAT pinning)
+	StableSourcePort bool
+	// FixedLocalPort binds the QUIC socket to this local port on every connect,
+	// so egress firewall rules can match it (optional, exclusive with SourcePortRange)
+	FixedLocalPort int
+	// ALPN overrides the TLS protocol list for non-Cloudflare servers (optional, DefaultALPN if empty)
+	ALPN []string
+	// RandomFallback tries a random address from the default MASQUE ranges when
+	// Endpoint, or the stored endpoints without it, fail
+	RandomFallback bool
+	// MTU is the largest IP packet Write accepts (optional, DefaultTunnelMTU if zero)
+	MTU int
+	// InitialPacketSize is the size QUIC Initial datagrams are padded to
+	// (optional, DefaultInitialPacketSize if zero, at least 1200)
+	InitialPacketSize uint16
+	// InitialPadPattern fills Initial datagrams up to InitialPacketSize with
+	// this pattern after the QUIC packet, instead of QUIC PADDING frames (optional)
+	InitialPadPattern []byte
+	// KeepAlivePeriod is how often QUIC PINGs an idle tunnel
+	// (optional, DefaultKeepAlivePeriod if zero, below the 60s idle timeout)
+	KeepAlivePeriod time.Duration
+	// ConnectURI is the Connect-IP URI template (optional, ConnectURI if empty).
+	// {target_host} and {target_port} expand to the endpoint being dialed.
+	ConnectURI string
+	// EndpointConnectURIs overrides ConnectURI for endpoints keyed by host:port or host (optional)
+	EndpointConnectURIs map[string]string
+	// ConnectIPProtocol is the :protocol of the Connect-IP request, "connect-ip"
+	// for RFC 9484 servers (optional, DefaultConnectIPProtocol if empty)
+	ConnectIPProtocol string
+	// ConnectIPRetries is how many times a Connect-IP request rejected with a
+	// transient status or timeout is repeated on the same QUIC connection
+	// (optional, DefaultConnectIPRetries if zero, negative disables)
+	ConnectIPRetries int
+	// CertValidity is how long the generated client certificate is valid
+	// (optional, DefaultCertValidity if zero)
+	CertValidity time.Duration
+	// CertSubject is the subject of the generated client certificate
+	// (optional, empty like the usque certificate if zero)
+	CertSubject pkix.Name
+	// CertDNSNames are the subject alternative names of the generated client certificate (optional)
+	CertDNSNames []string
+	// SessionCache resumes the TLS session when reconnecting to the same endpoint
+	// (optional, an in-memory cache shared by the adapter's reconnects if nil)
+	SessionCache tls.ClientSessionCache
+	// DisableSessionResumption always runs a full TLS handshake
+	DisableSessionResumption bool
+	// ForwardWorkers is how many goroutines forward packets in each direction
+	// of the tunnel, sharded by flow so every flow stays in order (optional, 1 if zero)
+	ForwardWorkers int
+	// ReceiveWindows sets the QUIC flow control receive windows (optional,
+	// the quic-go defaults if zero)
+	ReceiveWindows ReceiveWindows
+	// ResolveCache reuses endpoint hostname lookups across reconnects
+	// (optional, every dial looks the endpoint up if nil)
+	ResolveCache *ResolveCache
+	// Assignments reuses the Connect-IP addresses and routes of the first
+	// tunnel across adapters (optional, shared by the reconnects of this
+	// adapter only if nil)
+	Assignments *TunnelAssignments
+	// AcceptTOS accepts the Cloudflare terms of service for a new
+	// registration, which otherwise asks for acceptance on the terminal
+	AcceptTOS bool
+	// RequireTOS fails a new registration unless AcceptTOS is set, instead of
+	// asking on the terminal
+	RequireTOS bool
 }
 
 // NewMasqueAdapter creates a new MASQUE adapter using usque library
@@ -75,12 +209,116 @@ func NewMasqueAdapter(ctx context.Context, cfg AdapterConfig) (*MasqueAdapter, e
 	if cfg.Logger == nil {
 		cfg.Logger = slog.Default()
 	}
+	if cfg.Assignments == nil {
+		cfg.Assignments = &TunnelAssignments{}
+	}
+	if err := validateConnectURIs(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateFixedLocalPort(cfg); err != nil {
+		return nil, err
+	}
 
-	// Ensure config directory exists
 	if cfg.ConfigPath == "" {
 		cfg.ConfigPath = GetDefaultConfigPath()
 	}
+	usqueConfig, err := loadOrRegisterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Determine SNI
+	sni := cfg.SNI
+	if sni == "" {
+		sni = DefaultMasqueSNI
+	}
+
+	// Get keys from config
+	privKey, err := usqueConfig.GetEcPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private key: %w", err)
+	}
+
+	peerPubKey, err := usqueConfig.GetEcEndpointPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peer public key: %w", err)
+	}
+
+	// Generate self-signed certificate for authentication
+	certDER, err := generateSelfSignedCert(privKey, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+
+	alpn := cfg.ALPN
+	if len(alpn) == 0 {
+		alpn = DefaultALPN
+	}
+	if err := validateALPN(alpn); err != nil {
+		return nil, err
+	}
+	if err := validateInitialPacketSize(cfg.InitialPacketSize); err != nil {
+		return nil, err
+	}
+	if err := validateHandshakeProfile(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateKeepAlivePeriod(cfg.KeepAlivePeriod); err != nil {
+		return nil, err
+	}
+	if err := cfg.ReceiveWindows.Validate(); err != nil {
+		return nil, err
+	}
+
+	endpoints, err := endpointCandidates(cfg, usqueConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reconnect reuses cfg, so sessions cached here are resumed by it
+	if cfg.SessionCache == nil && !cfg.DisableSessionResumption {
+		cfg.SessionCache = NewSessionCache("")
+	}
+
+	return dialEndpoints(ctx, cfg.Logger, endpoints, func(ctx context.Context, endpointAddr string) (*MasqueAdapter, error) {
+		return dialMasque(ctx, cfg, usqueConfig, endpointAddr, sni, privKey, peerPubKey, certDER, alpn)
+	})
+}
+
+// LoadOrRegister loads the MASQUE device config at cfg.ConfigPath, registering
+// and enrolling a new device when there is no valid one, without dialing the
+// tunnel. NewMasqueAdapter does the same before it connects.
+func LoadOrRegister(cfg AdapterConfig) error {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.ConfigPath == "" {
+		cfg.ConfigPath = GetDefaultConfigPath()
+	}
+	_, err := loadOrRegisterConfig(cfg)
+	return err
+}
+
+// EndpointCandidates loads or registers the device like LoadOrRegister and
+// returns the endpoints NewMasqueAdapter tries with cfg, in order
+func EndpointCandidates(cfg AdapterConfig) ([]string, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.ConfigPath == "" {
+		cfg.ConfigPath = GetDefaultConfigPath()
+	}
+	usqueConfig, err := loadOrRegisterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return endpointCandidates(cfg, usqueConfig)
+}
 
+// loadOrRegisterConfig returns the device config at cfg.ConfigPath, replacing
+// a missing, unreadable or incomplete one with a fresh registration
+func loadOrRegisterConfig(cfg AdapterConfig) (*config.Config, error) {
+	// Ensure config directory exists
 	dir := filepath.Dir(cfg.ConfigPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create config directory: %w", err)
@@ -104,6 +342,9 @@ func NewMasqueAdapter(ctx context.Context, cfg AdapterConfig) (*MasqueAdapter, e
 	}
 
 	if !configExists {
+		if cfg.RequireTOS && !cfg.AcceptTOS {
+			return nil, ErrTOSNotAccepted
+		}
 		cfg.Logger.Info("No valid MASQUE config found, registering new device", "path", cfg.ConfigPath)
 
 		deviceName := cfg.DeviceName
@@ -112,7 +353,7 @@ func NewMasqueAdapter(ctx context.Context, cfg AdapterConfig) (*MasqueAdapter, e
 		}
 
 		// Register using usque API
-		accountData, err := api.Register("PC", "en_US", "", true)
+		accountData, err := registerDevice("PC", "en_US", "", cfg.AcceptTOS)
 		if err != nil {
 			return nil, fmt.Errorf("failed to register device: %w", err)
 		}
@@ -174,87 +415,109 @@ func NewMasqueAdapter(ctx context.Context, cfg AdapterConfig) (*MasqueAdapter, e
 		)
 	}
 
-	// Determine endpoint
-	var endpointAddr string
+	return usqueConfig, nil
+}
+
+// endpointCandidates returns the endpoints NewMasqueAdapter tries in order: the
+// override when set, otherwise the stored endpoint of the preferred family, then
+// the other family. With RandomFallback, a random address from the default
+// ranges of the preferred family comes last.
+// IPv6 is preferred with UseIPv6 or when the host has no IPv4 route.
+func endpointCandidates(cfg AdapterConfig, c *config.Config) ([]string, error) {
+	useIPv6 := cfg.UseIPv6
+	if !useIPv6 {
+		// Prefer IPv6 on IPv6-only hosts, where every IPv4 dial times out
+		v4, v6 := hostFamilies()
+		useIPv6 = !v4 && v6
+	}
+
+	var endpoints []string
 	if cfg.Endpoint != "" {
-		endpointAddr = cfg.Endpoint
+		endpoints = append(endpoints, withDefaultPort(cfg.Endpoint))
 	} else {
-		if cfg.UseIPv6 {
-			endpointAddr = usqueConfig.EndpointV6
-		} else {
-			endpointAddr = usqueConfig.EndpointV4
+		stored := []string{c.EndpointV4, c.EndpointV6}
+		if useIPv6 {
+			stored[0], stored[1] = stored[1], stored[0]
+		}
+		for _, e := range stored {
+			if e != "" {
+				endpoints = append(endpoints, withDefaultPort(e))
+			}
 		}
 	}
 
-	// Add port if not specified
-	if !strings.Contains(endpointAddr, ":") {
-		endpointAddr = fmt.Sprintf("%s:443", endpointAddr)
+	if cfg.RandomFallback {
+		e, err := randomMasqueEndpoint(useIPv6)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick fallback endpoint: %w", err)
+		}
+		endpoints = append(endpoints, e)
 	}
 
-	// Determine SNI
-	sni := cfg.SNI
-	if sni == "" {
-		sni = DefaultMasqueSNI
+	if len(endpoints) == 0 {
+		return nil, errors.New("no MASQUE endpoint configured")
 	}
+	return endpoints, nil
+}
 
-	cfg.Logger.Info("Establishing MASQUE connection", "endpoint", endpointAddr, "sni", sni)
-
-	// Get keys from config
-	privKey, err := usqueConfig.GetEcPrivateKey()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get private key: %w", err)
+// withDefaultPort adds the MASQUE port to an endpoint given without one
+func withDefaultPort(endpoint string) string {
+	if _, _, err := net.SplitHostPort(endpoint); err == nil {
+		return endpoint
 	}
+	host := strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(int(DefaultMasquePort())))
+}
 
-	peerPubKey, err := usqueConfig.GetEcEndpointPublicKey()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get peer public key: %w", err)
+// dialEndpoints tries each endpoint in turn and returns the first tunnel that
+// comes up, or every attempt's error if none does
+func dialEndpoints(ctx context.Context, logger *slog.Logger, endpoints []string, dial func(context.Context, string) (*MasqueAdapter, error)) (*MasqueAdapter, error) {
+	var errs []error
+	for i, endpoint := range endpoints {
+		adapter, err := dial(ctx, endpoint)
+		if err == nil {
+			return adapter, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", endpoint, err))
+
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(endpoints)-1 {
+			logger.Warn("MASQUE endpoint failed, trying next", "endpoint", endpoint, "next", endpoints[i+1], "error", err)
+		}
 	}
 
-	// Generate self-signed certificate for authentication
-	certDER, err := generateSelfSignedCert(privKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate certificate: %w", err)
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0])
 	}
+	return nil, fmt.Errorf("all MASQUE endpoints failed: %w", errors.Join(errs...))
+}
 
-	// Check if using a custom endpoint (different from registered)
+// dialMasque establishes a MASQUE tunnel to a single endpoint
+func dialMasque(ctx context.Context, cfg AdapterConfig, usqueConfig *config.Config, endpointAddr, sni string, privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, certDER []byte, alpn []string) (*MasqueAdapter, error) {
+	cfg.Logger.Info("Establishing MASQUE connection", "endpoint", endpointAddr, "sni", sni)
+
+	// Check if using a custom endpoint (neither registered nor Cloudflare's,
+	// which all present the registered public key)
 	usingCustomEndpoint := false
-	if cfg.Endpoint != "" {
-		registeredEndpoint := usqueConfig.EndpointV4
-		if cfg.UseIPv6 && usqueConfig.EndpointV6 != "" {
-			registeredEndpoint = usqueConfig.EndpointV6
-		}
-		customHost, _, _ := net.SplitHostPort(endpointAddr)
-		if customHost != registeredEndpoint {
-			usingCustomEndpoint = true
-			cfg.Logger.Warn("Using custom endpoint - disabling public key pinning", "custom", customHost, "registered", registeredEndpoint)
-		}
+	customHost, _, _ := net.SplitHostPort(endpointAddr)
+	if customHost != usqueConfig.EndpointV4 && customHost != usqueConfig.EndpointV6 && !inDefaultMasqueRanges(customHost) {
+		usingCustomEndpoint = true
+		cfg.Logger.Warn("Using custom endpoint - disabling public key pinning", "custom", customHost, "registered", usqueConfig.EndpointV4)
 	}
 
-	// Prepare TLS config
-	var tlsConfig *tls.Config
-	if usingCustomEndpoint {
-		// Skip peer verification for custom endpoints
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{
-				{
-					Certificate: [][]byte{certDER},
-					PrivateKey:  privKey,
-				},
-			},
-			ServerName:         sni,
-			NextProtos:         []string{"h3"},
-			InsecureSkipVerify: true, // Accept any Cloudflare cert
-		}
-	} else {
-		// Use normal verification with public key pinning
-		tlsConfig, err = api.PrepareTlsConfig(privKey, peerPubKey, [][]byte{certDER}, sni)
-		if err != nil {
-			return nil, fmt.Errorf("failed to prepare TLS config: %w", err)
-		}
+	// Prepare TLS config, skipping peer verification for custom endpoints
+	tlsConfig, err := prepareTLSConfig(privKey, peerPubKey, certDER, sni, alpn, !usingCustomEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare TLS config: %w", err)
+	}
+	if cfg.SessionCache != nil && !cfg.DisableSessionResumption {
+		tlsConfig.ClientSessionCache = scopeSessionCache(cfg.SessionCache, endpointAddr, privKey, !usingCustomEndpoint)
 	}
 
 	// Parse endpoint
-	udpAddr, err := net.ResolveUDPAddr("udp", endpointAddr)
+	udpAddr, err := resolveEndpoint(cfg, endpointAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve endpoint: %w", err)
 	}
@@ -270,17 +533,24 @@ func NewMasqueAdapter(ctx context.Context, cfg AdapterConfig) (*MasqueAdapter, e
 	testConn.Close()
 	cfg.Logger.Debug("UDP connectivity test successful")
 
-	// Create QUIC config - slightly longer handshake timeout to reduce retransmissions
-	quicConfig := &quic.Config{
-		EnableDatagrams:       true,
-		InitialPacketSize:     1242, // CRITICAL: Required for MASQUE - matches Cloudflare WARP implementation
-		KeepAlivePeriod:       30 * time.Second,
-		MaxIdleTimeout:        60 * time.Second,
-		HandshakeIdleTimeout:  20 * time.Second, // Slightly longer to reduce aggressive retransmissions
-		MaxIncomingStreams:    10,
-		MaxIncomingUniStreams: 5,
+	// Create QUIC config
+	pad := InitialPadding{Size: int(cfg.InitialPacketSize), Pattern: cfg.InitialPadPattern}
+	if pad.Size == 0 {
+		pad.Size = DefaultInitialPacketSize
+	}
+	quicConfig := newQUICConfig(pad, cfg.KeepAlivePeriod, cfg.ReceiveWindows)
+	if cfg.Obfuscator == nil && cfg.NoizeConfig != nil && cfg.NoizeConfig.HandshakeProfile != "" {
+		// The handshake profile sizes the Initials, which it can only do for
+		// packets that leave it room. validateHandshakeProfile made sure no
+		// Initial padding was configured besides it.
+		quicConfig.InitialPacketSize = minInitialPacketSize
 	}
-	cfg.Logger.Debug("QUIC config created", "keepAlive", quicConfig.KeepAlivePeriod, "maxIdle", quicConfig.MaxIdleTimeout, "handshakeTimeout", quicConfig.HandshakeIdleTimeout, "initialPacketSize", quicConfig.InitialPacketSize)
+	watch, path := newNATWatch(cfg.Logger), &pathQuality{}
+	quicConfig.Tracer = func(ctx context.Context, p logging.Perspective, id quic.ConnectionID) *logging.ConnectionTracer {
+		return logging.NewMultiplexedConnectionTracer(watch.tracer(ctx, p, id), path.tracer(ctx, p, id))
+	}
+	cfg.Logger.Debug("QUIC config created", "keepAlive", quicConfig.KeepAlivePeriod, "maxIdle", quicConfig.MaxIdleTimeout, "handshakeTimeout", quicConfig.HandshakeIdleTimeout, "initialPacketSize", quicConfig.InitialPacketSize,
+		"maxStreamWindow", quicConfig.MaxStreamReceiveWindow, "maxConnectionWindow", quicConfig.MaxConnectionReceiveWindow)
 
 	// Create a timeout context for the connection attempt
 	connCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
@@ -296,21 +566,57 @@ func NewMasqueAdapter(ctx context.Context, cfg AdapterConfig) (*MasqueAdapter, e
 
 	// Establish tunnel - use custom function with noize if configured
 	var conn *net.UDPConn
-	var transport *http3.Transport
+	var h3conn *http3.ClientConn
 	var ipConn *connectip.Conn
 	var rsp *http.Response
 
-	if cfg.NoizeConfig != nil {
-		cfg.Logger.Info("Using noize obfuscation for MASQUE connection")
-		conn, transport, ipConn, rsp, err = ConnectTunnelWithNoize(connCtx, tlsConfig, quicConfig, ConnectURI, udpAddr, cfg.NoizeConfig, cfg.Logger)
+	template, err := connecturi.Parse(connectURIFor(cfg, endpointAddr))
+	if err != nil {
+		return nil, err
+	}
+	connectURI, err := connecturi.Expand(template, endpointAddr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Logger.Debug("Connect-IP URI", "uri", connectURI)
+
+	obfuscator := cfg.Obfuscator
+	if obfuscator == nil && cfg.NoizeConfig != nil {
+		obfuscator = noize.NewObfuscator(cfg.NoizeConfig, cfg.Logger)
+	}
+
+	sourcePortRange := cfg.SourcePortRange
+	if cfg.FixedLocalPort != 0 {
+		sourcePortRange = [2]int{cfg.FixedLocalPort, cfg.FixedLocalPort}
+	}
+
+	dialOpts := TunnelDialOptions{
+		ConnectProtocol:  connectIPProtocol(cfg),
+		EgressInterface:  cfg.EgressInterface,
+		SourcePortRange:  sourcePortRange,
+		StableSourcePort: cfg.StableSourcePort,
+		InitialPadding:   pad,
+		ConnectHeaders:   cfg.ConnectHeaders,
+		ConnectRetries:   connectIPRetries(cfg),
+		Logger:           cfg.Logger,
+	}
+	if obfuscator != nil {
+		cfg.Logger.Info("Using obfuscation for MASQUE connection", "obfuscator", fmt.Sprintf("%T", obfuscator))
+		conn, h3conn, ipConn, rsp, err = ConnectTunnelWithNoize(connCtx, tlsConfig, quicConfig, connectURI, udpAddr, obfuscator, dialOpts)
 	} else {
-		conn, transport, ipConn, rsp, err = ConnectTunnelOptimized(connCtx, tlsConfig, quicConfig, ConnectURI, udpAddr, cfg.Logger)
+		conn, h3conn, ipConn, rsp, err = ConnectTunnelOptimized(connCtx, tlsConfig, quicConfig, connectURI, udpAddr, dialOpts)
 	}
 
 	if err != nil {
 		cfg.Logger.Error("QUIC connection failed", "error", err, "endpoint", udpAddr.String(), "errorType", fmt.Sprintf("%T", err))
+		if cfg.ResolveCache != nil {
+			cfg.ResolveCache.ConnectFailed(endpointAddr)
+		}
 		return nil, fmt.Errorf("failed to establish MASQUE tunnel: %w", err)
 	}
+	if cfg.ResolveCache != nil {
+		cfg.ResolveCache.ConnectSucceeded(endpointAddr)
+	}
 
 	// Check response status
 	if rsp != nil && rsp.StatusCode != 200 {
@@ -318,64 +624,189 @@ func NewMasqueAdapter(ctx context.Context, cfg AdapterConfig) (*MasqueAdapter, e
 		if ipConn != nil {
 			ipConn.Close()
 		}
+		if h3conn != nil {
+			h3conn.CloseWithError(http3.ErrCodeNoError, "")
+		}
 		if conn != nil {
 			conn.Close()
 		}
-		if transport != nil {
-			transport.Close()
-		}
-		return nil, fmt.Errorf("MASQUE tunnel connection failed: %s", rsp.Status)
+		return nil, &TunnelRejectedError{StatusCode: rsp.StatusCode, Status: rsp.Status}
 	}
 
-	cfg.Logger.Debug("QUIC connection established", "conn", conn != nil, "transport", transport != nil, "ipConn", ipConn != nil)
-
-	// Store connection type for proper cleanup
-	var actualConn interface{}
-	if conn != nil {
-		actualConn = conn
-	} else if transport != nil {
-		// HTTP/2 fallback - get underlying connection
-		actualConn = transport
-	}
+	cfg.Logger.Debug("QUIC connection established", "conn", conn != nil, "quic", h3conn != nil, "ipConn", ipConn != nil)
 
 	cfg.Logger.Info("MASQUE tunnel established successfully")
 
+	var assignedV4, assignedV6 netip.Addr
+	var routes []netip.Prefix
+	if ipConn != nil {
+		assignedV4, assignedV6, routes = cfg.Assignments.get(ctx, ipConn, assignedAddrsTimeout)
+	}
+	cfg.Logger.Debug("Connect-IP assignments", "ipv4", assignedV4, "ipv6", assignedV6, "routes", routes)
+
 	return &MasqueAdapter{
 		config:    usqueConfig,
-		conn:      actualConn,
+		conn:      conn,
+		quic:      h3conn,
 		ipConn:    ipConn,
+		connect:   func(ctx context.Context) (*MasqueAdapter, error) { return NewMasqueAdapter(ctx, cfg) },
+		rebind:    cfg.StableSourcePort || cfg.FixedLocalPort != 0,
 		logger:    cfg.Logger,
 		endpoint:  endpointAddr,
 		sni:       sni,
 		useIPv6:   cfg.UseIPv6,
 		localIPv4: usqueConfig.IPv4,
 		localIPv6: usqueConfig.IPv6,
+		mtu:       cfg.MTU,
+		workers:   cfg.ForwardWorkers,
+		path:      path,
+
+		assignedV4: assignedV4,
+		assignedV6: assignedV6,
+		routes:     routes,
 	}, nil
 }
 
+// currentIPConn returns the Connect-IP session of the current tunnel
+func (m *MasqueAdapter) currentIPConn() ipPacketConn {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ipConn
+}
+
 // Read reads IP packets from the MASQUE tunnel
 func (m *MasqueAdapter) Read(buf []byte) (int, error) {
-	return m.ipConn.ReadPacket(buf, true)
+	return m.currentIPConn().ReadPacket(buf, true)
 }
 
-// Write writes IP packets to the MASQUE tunnel
+// Write writes an IP packet to the MASQUE tunnel. Packets larger than the
+// tunnel MTU, or that the tunnel answers with an ICMP Packet Too Big, are not
+// sent and fail with ErrPacketTooLarge; use WriteWithICMP to relay the ICMP
+// reply instead.
 func (m *MasqueAdapter) Write(pkt []byte) (int, error) {
-	icmp, err := m.ipConn.WritePacket(pkt)
+	if mtu := m.tunnelMTU(); len(pkt) > mtu {
+		return 0, fmt.Errorf("%w: %d bytes exceeds MTU %d", ErrPacketTooLarge, len(pkt), mtu)
+	}
+	icmp, err := m.writePacket(pkt)
 	if err != nil {
 		return 0, err
 	}
-	// Ignore ICMP for simple Write
-	_ = icmp
+	// connect-ip reports datagrams QUIC can't fit as an ICMP reply rather than an error
+	if len(icmp) > 0 {
+		return 0, fmt.Errorf("%w: %d bytes rejected by the tunnel", ErrPacketTooLarge, len(pkt))
+	}
 	return len(pkt), nil
 }
 
-// WriteWithICMP writes IP packets and returns any ICMP response
+// tunnelMTU returns the configured tunnel MTU or DefaultTunnelMTU
+func (m *MasqueAdapter) tunnelMTU() int {
+	if m.mtu > 0 {
+		return m.mtu
+	}
+	return DefaultTunnelMTU
+}
+
+// ForwardWorkers returns how many goroutines should forward packets in each
+// direction of the tunnel, at least 1
+func (m *MasqueAdapter) ForwardWorkers() int {
+	return max(m.workers, 1)
+}
+
+// WriteWithICMP writes IP packets and returns any ICMP response. A packet
+// that failed to write is left as it was, so it can be retried.
 func (m *MasqueAdapter) WriteWithICMP(pkt []byte) ([]byte, error) {
-	return m.ipConn.WritePacket(pkt)
+	return m.writePacket(pkt)
+}
+
+// writePacket writes pkt to the current Connect-IP session. connect-ip
+// decrements the TTL or hop limit of pkt in place before sending it, so the
+// header is restored when the write fails: a retried packet loses one hop,
+// not one per attempt.
+func (m *MasqueAdapter) writePacket(pkt []byte) ([]byte, error) {
+	var header [12]byte // Through the IPv4 TTL and header checksum
+	n := copy(header[:], pkt)
+	icmp, err := m.currentIPConn().WritePacket(pkt)
+	if err != nil {
+		copy(pkt, header[:n])
+	}
+	return icmp, err
+}
+
+// Reconnect closes the current tunnel and establishes a new one with the
+// configuration the adapter was created with. Reads and writes in flight on
+// the old tunnel fail; calls made afterwards use the new one. The new tunnel
+// is dialed without holding the tunnel lock, so packets keep flowing over the
+// old one meanwhile unless it has to close first to free its source port.
+func (m *MasqueAdapter) Reconnect(ctx context.Context) error {
+	if m.connect == nil {
+		return errors.New("MASQUE adapter does not support reconnecting")
+	}
+
+	m.reconnect.Lock()
+	defer m.reconnect.Unlock()
+
+	if m.rebind {
+		// Close first so a stable source port is free to be bound again
+		m.closeCurrent()
+	}
+
+	m.logger.Info("Reconnecting MASQUE tunnel", "endpoint", m.Endpoint())
+	fresh, err := m.connect(ctx)
+	if err != nil {
+		if !m.rebind {
+			m.closeCurrent()
+		}
+		return fmt.Errorf("failed to reconnect MASQUE tunnel: %w", err)
+	}
+
+	m.mu.Lock()
+	old := &MasqueAdapter{conn: m.conn, quic: m.quic, ipConn: m.ipConn}
+	m.config = fresh.config
+	m.conn = fresh.conn
+	m.quic = fresh.quic
+	m.ipConn = fresh.ipConn
+	m.endpoint = fresh.endpoint
+	m.localIPv4 = fresh.localIPv4
+	m.localIPv6 = fresh.localIPv6
+	m.assignedV4 = fresh.assignedV4
+	m.assignedV6 = fresh.assignedV6
+	m.routes = fresh.routes
+	m.path = fresh.path
+	m.mu.Unlock()
+
+	if !m.rebind {
+		if err := old.closeTunnel(); err != nil {
+			m.logger.Debug("Error closing previous MASQUE tunnel", "error", err)
+		}
+	}
+	return nil
+}
+
+// closeCurrent closes the current tunnel, leaving its fields in place so
+// calls on it fail until Reconnect swaps in a new one
+func (m *MasqueAdapter) closeCurrent() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if err := m.closeTunnel(); err != nil {
+		m.logger.Debug("Error closing previous MASQUE tunnel", "error", err)
+	}
+}
+
+// Endpoint returns the endpoint the current tunnel is connected to
+func (m *MasqueAdapter) Endpoint() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.endpoint
 }
 
 // Close closes the MASQUE connection
 func (m *MasqueAdapter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closeTunnel()
+}
+
+func (m *MasqueAdapter) closeTunnel() error {
 	var errs []error
 
 	if m.ipConn != nil {
@@ -384,6 +815,14 @@ func (m *MasqueAdapter) Close() error {
 		}
 	}
 
+	// The QUIC connection goes before its socket, so nothing of the old
+	// tunnel still holds the source port when a reconnect binds it again
+	if m.quic != nil {
+		if err := m.quic.CloseWithError(http3.ErrCodeNoError, ""); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close QUIC connection: %w", err))
+		}
+	}
+
 	if m.conn != nil {
 		// Handle different connection types
 		switch c := m.conn.(type) {
@@ -395,10 +834,6 @@ func (m *MasqueAdapter) Close() error {
 			if err := c.Close(); err != nil {
 				errs = append(errs, fmt.Errorf("failed to close connection: %w", err))
 			}
-		case *http3.Transport:
-			if err := c.Close(); err != nil {
-				errs = append(errs, fmt.Errorf("failed to close HTTP/3 transport: %w", err))
-			}
 		}
 	}
 
@@ -411,11 +846,15 @@ func (m *MasqueAdapter) Close() error {
 
 // GetLocalAddresses returns the assigned IPv4 and IPv6 addresses
 func (m *MasqueAdapter) GetLocalAddresses() (ipv4, ipv6 string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.localIPv4, m.localIPv6
 }
 
 // GetConfig returns the underlying usque config
 func (m *MasqueAdapter) GetConfig() *config.Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return m.config
 }
 
@@ -439,14 +878,73 @@ func stripPortSuffix(endpoint string) string {
 	return endpoint
 }
 
-// generateSelfSignedCert generates a self-signed certificate for Connect-IP authentication
-func generateSelfSignedCert(privKey *ecdsa.PrivateKey) ([]byte, error) {
+// validateALPN rejects protocol lists no server could negotiate
+func validateALPN(alpn []string) error {
+	if len(alpn) == 0 {
+		return fmt.Errorf("ALPN list must not be empty")
+	}
+	for _, proto := range alpn {
+		if proto == "" || len(proto) > 255 {
+			return fmt.Errorf("invalid ALPN protocol %q", proto)
+		}
+	}
+	return nil
+}
+
+// prepareTLSConfig builds the client TLS config for the tunnel. With pin set the
+// server must present peerPubKey, otherwise any certificate is accepted.
+func prepareTLSConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, certDER []byte, sni string, alpn []string, pin bool) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if pin {
+		var err error
+		tlsConfig, err = api.PrepareTlsConfig(privKey, peerPubKey, [][]byte{certDER}, sni)
+		if err != nil {
+			return nil, err
+		}
+		if verify := tlsConfig.VerifyPeerCertificate; verify != nil {
+			tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+				if err := verify(rawCerts, chains); err != nil {
+					return fmt.Errorf("%w: %w", ErrEndpointKeyMismatch, err)
+				}
+				return nil
+			}
+		}
+	} else {
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{
+				{
+					Certificate: [][]byte{certDER},
+					PrivateKey:  privKey,
+				},
+			},
+			ServerName:         sni,
+			InsecureSkipVerify: true, // Accept any Cloudflare cert
+		}
+	}
+	tlsConfig.NextProtos = append([]string(nil), alpn...)
+	return tlsConfig, nil
+}
+
+// generateSelfSignedCert generates a self-signed certificate for Connect-IP
+// authentication, valid for cfg.CertValidity with cfg.CertSubject and cfg.CertDNSNames
+func generateSelfSignedCert(privKey *ecdsa.PrivateKey, cfg AdapterConfig) ([]byte, error) {
+	validity := cfg.CertValidity
+	if validity == 0 {
+		validity = DefaultCertValidity
+	}
+	if validity < 0 {
+		return nil, fmt.Errorf("certificate validity %s is negative", validity)
+	}
+
 	// Use minimal certificate template to match usque implementation
 	// Cloudflare's MASQUE servers expect a simple self-signed cert
+	now := time.Now()
 	template := &x509.Certificate{
 		SerialNumber: big.NewInt(0),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(1 * 24 * time.Hour),
+		Subject:      cfg.CertSubject,
+		DNSNames:     cfg.CertDNSNames,
+		NotBefore:    now,
+		NotAfter:     now.Add(validity),
 	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &privKey.PublicKey, privKey)
@@ -481,7 +979,8 @@ func generateEcKeyPair() ([]byte, []byte, error) {
 
 // saveConfigFile saves config to file with atomic write for robustness
 func saveConfigFile(configPath string, cfg *config.Config) error {
-	file, err := os.Create(configPath)
+	// Only the owner may read the device private key
+	file, err := os.OpenFile(configPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to create config file: %w", err)
 	}
@@ -493,5 +992,5 @@ func saveConfigFile(configPath string, cfg *config.Config) error {
 		return fmt.Errorf("failed to encode config: %w", err)
 	}
 
-	return nil
+	return file.Close()
 }
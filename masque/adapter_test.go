@@ -0,0 +1,576 @@
+package masque
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/models"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestPrepareTLSConfigALPN(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	certDER, err := generateSelfSignedCert(privKey, AdapterConfig{})
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert: %v", err)
+	}
+
+	alpns := [][]string{DefaultALPN, {"h3", "h3-29"}, {"masque"}}
+	for _, alpn := range alpns {
+		for _, pin := range []bool{true, false} {
+			tlsConfig, err := prepareTLSConfig(privKey, &privKey.PublicKey, certDER, DefaultMasqueSNI, alpn, pin)
+			if err != nil {
+				t.Fatalf("prepareTLSConfig(%v, pin=%v): %v", alpn, pin, err)
+			}
+			if !slices.Equal(tlsConfig.NextProtos, alpn) {
+				t.Errorf("pin=%v: NextProtos = %v, want %v", pin, tlsConfig.NextProtos, alpn)
+			}
+			if tlsConfig.ServerName != DefaultMasqueSNI {
+				t.Errorf("pin=%v: ServerName = %q", pin, tlsConfig.ServerName)
+			}
+		}
+	}
+}
+
+func TestGenerateSelfSignedCert(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	before := time.Now().Truncate(time.Second)
+	certDER, err := generateSelfSignedCert(privKey, AdapterConfig{
+		CertValidity: 90 * 24 * time.Hour,
+		CertSubject:  pkix.Name{CommonName: "vwarp", Organization: []string{"Cloudflare"}},
+		CertDNSNames: []string{"client.example"},
+	})
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	if cert.Subject.CommonName != "vwarp" || !slices.Equal(cert.Subject.Organization, []string{"Cloudflare"}) {
+		t.Errorf("Subject = %v", cert.Subject)
+	}
+	if !slices.Equal(cert.DNSNames, []string{"client.example"}) {
+		t.Errorf("DNSNames = %v", cert.DNSNames)
+	}
+	if got := cert.NotAfter.Sub(cert.NotBefore); got != 90*24*time.Hour {
+		t.Errorf("validity = %s, want 2160h", got)
+	}
+	if cert.NotBefore.Before(before) || cert.NotAfter.Before(before.Add(90*24*time.Hour)) {
+		t.Errorf("NotBefore %s NotAfter %s, want from %s", cert.NotBefore, cert.NotAfter, before)
+	}
+
+	certDER, err = generateSelfSignedCert(privKey, AdapterConfig{})
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert: %v", err)
+	}
+	if cert, err = x509.ParseCertificate(certDER); err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	if got := cert.NotAfter.Sub(cert.NotBefore); got != DefaultCertValidity || cert.Subject.String() != "" {
+		t.Errorf("default cert valid for %s with subject %q", got, cert.Subject)
+	}
+
+	if _, err := generateSelfSignedCert(privKey, AdapterConfig{CertValidity: -time.Hour}); err == nil {
+		t.Error("negative validity accepted")
+	}
+}
+
+func TestValidateALPN(t *testing.T) {
+	if err := validateALPN(DefaultALPN); err != nil {
+		t.Errorf("default ALPN rejected: %v", err)
+	}
+	for _, alpn := range [][]string{nil, {}, {""}, {"h3", ""}} {
+		if err := validateALPN(alpn); err == nil {
+			t.Errorf("validateALPN(%q) accepted", alpn)
+		}
+	}
+}
+
+// fakeIPConn is an in-memory Connect-IP session
+type fakeIPConn struct {
+	packets chan []byte
+	reading chan struct{} // signalled when a read starts
+	closed  chan struct{}
+}
+
+func newFakeIPConn() *fakeIPConn {
+	return &fakeIPConn{packets: make(chan []byte, 1), reading: make(chan struct{}, 1), closed: make(chan struct{})}
+}
+
+func (c *fakeIPConn) ReadPacket(b []byte, _ bool) (int, error) {
+	select {
+	case c.reading <- struct{}{}:
+	default:
+	}
+	select {
+	case pkt := <-c.packets:
+		return copy(b, pkt), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *fakeIPConn) WritePacket(b []byte) ([]byte, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	c.packets <- append([]byte(nil), b...)
+	return nil, nil
+}
+
+func (c *fakeIPConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestReconnectSwapsTunnel(t *testing.T) {
+	listenUDP := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP: %v", err)
+		}
+		return conn
+	}
+
+	oldUDP, oldIP := listenUDP(), newFakeIPConn()
+	newUDP, newIP := listenUDP(), newFakeIPConn()
+	defer newUDP.Close()
+
+	adapter := &MasqueAdapter{
+		conn:      oldUDP,
+		ipConn:    oldIP,
+		logger:    slog.New(slog.DiscardHandler),
+		localIPv4: "172.16.0.2",
+		connect: func(context.Context) (*MasqueAdapter, error) {
+			return &MasqueAdapter{conn: newUDP, ipConn: newIP, localIPv4: "172.16.0.3"}, nil
+		},
+	}
+
+	// A read blocked on the old tunnel fails once it is replaced
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := adapter.Read(make([]byte, 1500))
+		readErr <- err
+	}()
+	<-oldIP.reading
+
+	if err := adapter.Reconnect(t.Context()); err != nil {
+		t.Fatalf("Reconnect: %v", err)
+	}
+	if err := <-readErr; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("in-flight read error = %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := oldUDP.Write([]byte{0}); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("old UDP socket still open: %v", err)
+	}
+
+	pkt := []byte{0x45, 0, 0, 20}
+	if _, err := adapter.Write(pkt); err != nil {
+		t.Fatalf("Write after Reconnect: %v", err)
+	}
+	buf := make([]byte, 1500)
+	n, err := adapter.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Fatalf("Read after Reconnect = %x, %v", buf[:n], err)
+	}
+	if ipv4, _ := adapter.GetLocalAddresses(); ipv4 != "172.16.0.3" {
+		t.Errorf("local IPv4 = %s after Reconnect", ipv4)
+	}
+}
+
+func TestReconnectKeepsOldTunnelWhileDialing(t *testing.T) {
+	oldIP, newIP := newFakeIPConn(), newFakeIPConn()
+	dialing, release := make(chan struct{}), make(chan struct{})
+	adapter := &MasqueAdapter{
+		ipConn: oldIP,
+		logger: slog.New(slog.DiscardHandler),
+		connect: func(context.Context) (*MasqueAdapter, error) {
+			close(dialing)
+			<-release
+			return &MasqueAdapter{ipConn: newIP}, nil
+		},
+	}
+
+	reconnected := make(chan error, 1)
+	go func() { reconnected <- adapter.Reconnect(t.Context()) }()
+	<-dialing
+
+	// The old tunnel still carries packets while the new one is dialed
+	pkt := []byte{0x45, 0, 0, 20}
+	if _, err := adapter.Write(pkt); err != nil {
+		t.Fatalf("Write during Reconnect: %v", err)
+	}
+	buf := make([]byte, 1500)
+	if n, err := adapter.Read(buf); err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Fatalf("Read during Reconnect = %x, %v", buf[:n], err)
+	}
+
+	close(release)
+	if err := <-reconnected; err != nil {
+		t.Fatalf("Reconnect: %v", err)
+	}
+	select {
+	case <-oldIP.closed:
+	default:
+		t.Error("old tunnel still open after Reconnect")
+	}
+	if got := adapter.currentIPConn(); got != newIP {
+		t.Error("Reconnect did not swap in the new tunnel")
+	}
+}
+
+func TestReconnectFailure(t *testing.T) {
+	oldIP := newFakeIPConn()
+	adapter := &MasqueAdapter{
+		ipConn: oldIP,
+		logger: slog.New(slog.DiscardHandler),
+		connect: func(context.Context) (*MasqueAdapter, error) {
+			return nil, errors.New("handshake timeout")
+		},
+	}
+	if err := adapter.Reconnect(t.Context()); err == nil {
+		t.Fatal("Reconnect succeeded with a failing dial")
+	}
+	if _, err := adapter.Write([]byte{0x45}); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write on the closed tunnel = %v", err)
+	}
+}
+
+func TestReconnectRebindsFixedPort(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", serveTestMasque(t, key, http.StatusOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freeUDPPort(t)
+
+	dial := func(ctx context.Context) (*MasqueAdapter, error) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		conn, h3conn, ipConn, _, err := ConnectTunnelOptimized(ctx,
+			&tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+			&quic.Config{EnableDatagrams: true}, ConnectURI,
+			endpoint, TunnelDialOptions{SourcePortRange: [2]int{port, port}})
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, err
+		}
+		return &MasqueAdapter{conn: conn, quic: h3conn, ipConn: ipConn}, nil
+	}
+	adapter, err := dial(t.Context())
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	adapter.logger = slog.New(slog.DiscardHandler)
+	adapter.connect = dial
+	adapter.rebind = true
+	defer adapter.Close()
+	old := adapter.quic
+
+	// The port is only free again once the old tunnel is gone
+	if err := adapter.Reconnect(t.Context()); err != nil {
+		t.Fatalf("Reconnect with a fixed port: %v", err)
+	}
+	select {
+	case <-old.Context().Done():
+	default:
+		t.Error("old QUIC connection still open after Reconnect")
+	}
+	if got := boundPort(adapter.conn.(*net.UDPConn)); got != port {
+		t.Errorf("reconnected from port %d, want the fixed port %d", got, port)
+	}
+}
+
+// stubHostFamilies makes endpointCandidates see a host routing only the given families
+func stubHostFamilies(t *testing.T, v4, v6 bool) {
+	t.Helper()
+	old := hostFamilies
+	hostFamilies = func() (bool, bool) { return v4, v6 }
+	t.Cleanup(func() { hostFamilies = old })
+}
+
+func TestEndpointCandidates(t *testing.T) {
+	stubHostFamilies(t, true, true)
+	stored := &config.Config{EndpointV4: "162.159.198.1", EndpointV6: "2606:4700:103::1"}
+
+	tests := []struct {
+		name string
+		cfg  AdapterConfig
+		want []string
+	}{
+		{"v4 first", AdapterConfig{}, []string{"162.159.198.1:443", "[2606:4700:103::1]:443"}},
+		{"v6 first", AdapterConfig{UseIPv6: true}, []string{"[2606:4700:103::1]:443", "162.159.198.1:443"}},
+		{"override", AdapterConfig{Endpoint: "162.159.192.5:8443"}, []string{"162.159.192.5:8443"}},
+		{"override without port", AdapterConfig{Endpoint: "2606:4700:d0::a"}, []string{"[2606:4700:d0::a]:443"}},
+	}
+	for _, tt := range tests {
+		got, err := endpointCandidates(tt.cfg, stored)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	got, err := endpointCandidates(AdapterConfig{RandomFallback: true}, &config.Config{EndpointV4: "162.159.198.1"})
+	if err != nil {
+		t.Fatalf("fallback: %v", err)
+	}
+	if len(got) != 2 || got[0] != "162.159.198.1:443" {
+		t.Fatalf("fallback: got %v", got)
+	}
+	addr, err := netip.ParseAddrPort(got[1])
+	if err != nil {
+		t.Fatalf("fallback endpoint %q: %v", got[1], err)
+	}
+	inRange := false
+	for _, cidr := range DefaultMasqueV4CIDRs() {
+		inRange = inRange || netip.MustParsePrefix(cidr).Contains(addr.Addr())
+	}
+	if !inRange || addr.Port() != DefaultMasquePort() {
+		t.Errorf("fallback endpoint %s is outside the default ranges", addr)
+	}
+
+	// The fallback follows an override too
+	got, err = endpointCandidates(AdapterConfig{Endpoint: "162.159.192.5:8443", RandomFallback: true}, stored)
+	if err != nil {
+		t.Fatalf("override with fallback: %v", err)
+	}
+	if len(got) != 2 || got[0] != "162.159.192.5:8443" || !inDefaultMasqueRanges(strings.Split(got[1], ":")[0]) {
+		t.Errorf("override with fallback: got %v, want the override then a random default address", got)
+	}
+
+	if _, err := endpointCandidates(AdapterConfig{}, &config.Config{}); err == nil {
+		t.Error("no stored endpoints accepted")
+	}
+}
+
+func TestInDefaultMasqueRanges(t *testing.T) {
+	for host, want := range map[string]bool{
+		"162.159.198.7":               true,
+		"::ffff:162.159.192.1":        true,
+		"2606:4700:d1::1234":          true,
+		"162.159.197.1":               false, // Between the default ranges
+		"203.0.113.5":                 false,
+		"2606:4700:103::1":            false,
+		"engage.cloudflareclient.com": false,
+	} {
+		if got := inDefaultMasqueRanges(host); got != want {
+			t.Errorf("inDefaultMasqueRanges(%s) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestEndpointCandidatesIPv6OnlyHost(t *testing.T) {
+	stored := &config.Config{EndpointV4: "162.159.198.1", EndpointV6: "2606:4700:103::1"}
+
+	stubHostFamilies(t, false, true)
+	got, err := endpointCandidates(AdapterConfig{RandomFallback: true}, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != "[2606:4700:103::1]:443" || got[1] != "162.159.198.1:443" {
+		t.Fatalf("got %v, want the IPv6 endpoint first", got)
+	}
+	if addr, err := netip.ParseAddrPort(got[2]); err != nil || !addr.Addr().Is6() {
+		t.Errorf("random fallback %q is not IPv6", got[2])
+	}
+
+	// Without any route the configured order is kept
+	stubHostFamilies(t, false, false)
+	if got, _ := endpointCandidates(AdapterConfig{}, stored); got[0] != "162.159.198.1:443" {
+		t.Errorf("no routes: got %v, want the IPv4 endpoint first", got)
+	}
+}
+
+func TestDialEndpointsFallsBackToIPv6(t *testing.T) {
+	endpoints := []string{"162.159.198.1:443", "[2606:4700:103::1]:443"}
+	want := &MasqueAdapter{endpoint: endpoints[1]}
+
+	var tried []string
+	adapter, err := dialEndpoints(t.Context(), slog.New(slog.DiscardHandler), endpoints, func(_ context.Context, endpoint string) (*MasqueAdapter, error) {
+		tried = append(tried, endpoint)
+		if endpoint == endpoints[0] {
+			return nil, errors.New("UDP connectivity test failed")
+		}
+		return want, nil
+	})
+	if err != nil {
+		t.Fatalf("dialEndpoints: %v", err)
+	}
+	if adapter != want {
+		t.Errorf("got adapter for %s, want %s", adapter.endpoint, want.endpoint)
+	}
+	if !slices.Equal(tried, endpoints) {
+		t.Errorf("tried %v, want %v", tried, endpoints)
+	}
+}
+
+func TestDialEndpointsAllFail(t *testing.T) {
+	errDead := errors.New("handshake timeout")
+	endpoints := []string{"162.159.198.1:443", "[2606:4700:103::1]:443"}
+
+	adapter, err := dialEndpoints(t.Context(), slog.New(slog.DiscardHandler), endpoints, func(context.Context, string) (*MasqueAdapter, error) {
+		return nil, errDead
+	})
+	if adapter != nil {
+		t.Error("dialEndpoints returned an adapter when every endpoint failed")
+	}
+	if !errors.Is(err, errDead) {
+		t.Fatalf("error = %v, want %v", err, errDead)
+	}
+	for _, endpoint := range endpoints {
+		if !strings.Contains(err.Error(), endpoint) {
+			t.Errorf("error %q does not name %s", err, endpoint)
+		}
+	}
+
+	// A canceled context stops the rotation after the failed attempt
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	calls := 0
+	adapter, err = dialEndpoints(ctx, slog.New(slog.DiscardHandler), endpoints, func(context.Context, string) (*MasqueAdapter, error) {
+		calls++
+		return nil, context.Canceled
+	})
+	if adapter != nil {
+		t.Error("dialEndpoints returned an adapter after cancel")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error after cancel = %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("dialed %d endpoints after cancel, want 1", calls)
+	}
+}
+
+// tooLargeIPConn answers every packet the way connect-ip does when QUIC
+// can't fit the datagram: an ICMP Packet Too Big and no error
+type tooLargeIPConn struct{ fakeIPConn }
+
+func (c *tooLargeIPConn) WritePacket(b []byte) ([]byte, error) {
+	return []byte{0x45, 0x00}, nil
+}
+
+func TestWriteRejectsOversizedPacket(t *testing.T) {
+	ipConn := newFakeIPConn()
+	m := &MasqueAdapter{ipConn: ipConn, mtu: 1280}
+
+	n, err := m.Write(make([]byte, 1281))
+	if !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("Write error = %v, want %v", err, ErrPacketTooLarge)
+	}
+	if n != 0 {
+		t.Fatalf("Write reported %d bytes for a packet that was not sent", n)
+	}
+	select {
+	case <-ipConn.packets:
+		t.Fatal("oversized packet reached the tunnel")
+	default:
+	}
+
+	if n, err := m.Write(make([]byte, 1280)); err != nil || n != 1280 {
+		t.Fatalf("Write at MTU = %d, %v; want 1280, nil", n, err)
+	}
+}
+
+func TestWriteReportsTunnelRejection(t *testing.T) {
+	m := &MasqueAdapter{ipConn: &tooLargeIPConn{}}
+
+	n, err := m.Write(make([]byte, 1200))
+	if !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("Write error = %v, want %v", err, ErrPacketTooLarge)
+	}
+	if n != 0 {
+		t.Fatalf("Write reported %d bytes for a packet the tunnel rejected", n)
+	}
+}
+
+func TestRegistrationRequiresTOSAcceptance(t *testing.T) {
+	calls, accepted := 0, false
+	old := registerDevice
+	registerDevice = func(model, locale, jwt string, acceptTos bool) (models.AccountData, error) {
+		calls++
+		accepted = acceptTos
+		return models.AccountData{}, errors.New("registration API unavailable")
+	}
+	t.Cleanup(func() { registerDevice = old })
+
+	cfg := AdapterConfig{
+		ConfigPath: filepath.Join(t.TempDir(), "masque.json"),
+		Logger:     slog.New(slog.DiscardHandler),
+		RequireTOS: true,
+	}
+	if err := LoadOrRegister(cfg); !errors.Is(err, ErrTOSNotAccepted) {
+		t.Fatalf("LoadOrRegister without accepting the terms = %v, want ErrTOSNotAccepted", err)
+	}
+	if calls != 0 {
+		t.Fatalf("registration API called %d times before the terms were accepted", calls)
+	}
+
+	cfg.AcceptTOS = true
+	if err := LoadOrRegister(cfg); err == nil || errors.Is(err, ErrTOSNotAccepted) {
+		t.Fatalf("LoadOrRegister with the terms accepted = %v, want the API error", err)
+	}
+	if calls != 1 || !accepted {
+		t.Fatalf("registration API called %d times after accepting the terms (accepted %v), want once accepted", calls, accepted)
+	}
+}
+
+// failingIPConn decrements the TTL of every packet like connect-ip does, then
+// fails to send it
+type failingIPConn struct{ fakeIPConn }
+
+func (c *failingIPConn) WritePacket(b []byte) ([]byte, error) {
+	b[8]--
+	return nil, net.ErrClosed
+}
+
+func TestFailedWriteKeepsTTL(t *testing.T) {
+	m := &MasqueAdapter{ipConn: &failingIPConn{}}
+	pkt := make([]byte, 28)
+	pkt[0], pkt[8] = 0x45, 64
+
+	for range 3 {
+		if _, err := m.WriteWithICMP(pkt); err == nil {
+			t.Fatal("WriteWithICMP succeeded on a failing session")
+		}
+	}
+	if pkt[8] != 64 {
+		t.Errorf("TTL = %d after failed writes, want 64 so the retry decrements it once", pkt[8])
+	}
+}
@@ -14,7 +14,7 @@ import (
 // Linux: ~/.config/vwarp
 func GetDefaultConfigPath() string {
 	configDir := GetConfigDirectory()
-	return filepath.Join(configDir, "masque_config.json")
+	return filepath.Join(configDir, ConfigFileName)
 }
 
 // GetConfigDirectory returns the platform-specific config directory
@@ -87,7 +87,7 @@ func GetConfigPathWithFallback() string {
 	dir := filepath.Dir(defaultPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		// If we can't create the directory, fall back to current directory
-		return "masque_config.json"
+		return ConfigFileName
 	}
 
 	return defaultPath
@@ -100,5 +100,5 @@ func GetMobileConfigPath(appDataDir string) string {
 	if appDataDir == "" {
 		return GetDefaultConfigPath()
 	}
-	return filepath.Join(appDataDir, "masque_config.json")
+	return filepath.Join(appDataDir, ConfigFileName)
 }
@@ -0,0 +1,110 @@
+package masque
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/voidr3aper-anon/Vwarp/neterr"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+const (
+	// DefaultConnectIPRetries is how many times a Connect-IP request that
+	// failed transiently is repeated on the same QUIC connection
+	DefaultConnectIPRetries = 2
+	// connectIPAttemptTimeout bounds each Connect-IP attempt, so a retry still
+	// fits in the caller's deadline
+	connectIPAttemptTimeout = 5 * time.Second
+	// connectIPRetryDelay is the pause before the first retry, doubled after each
+	connectIPRetryDelay = 250 * time.Millisecond
+	// DefaultConnectIPProtocol is the :protocol of Cloudflare's Connect-IP
+	// requests; RFC 9484 servers expect "connect-ip"
+	DefaultConnectIPProtocol = "cf-connect-ip"
+)
+
+// connectIPRetryable reports whether a failed Connect-IP request may succeed
+// when repeated: the server answered with a transient status, or the request
+// timed out without taking the QUIC connection down
+func connectIPRetryable(rsp *http.Response, err error) bool {
+	if rsp != nil {
+		switch rsp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return neterr.IsTimeout(err)
+}
+
+// dialConnectIP sends the Connect-IP request for protocol over hconn,
+// repeating it up to retries times on transient failures before giving up.
+// Retries reuse the QUIC connection; once it is gone there is nothing left
+// to retry on.
+func dialConnectIP(ctx context.Context, hconn *http3.ClientConn, template *uritemplate.Template, protocol string, headers http.Header, retries int, logger *slog.Logger) (*connectip.Conn, *http.Response, error) {
+	delay := connectIPRetryDelay
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, connectIPAttemptTimeout)
+		ipConn, rsp, err := connectip.Dial(attemptCtx, hconn, template, protocol, headers, true)
+		cancel()
+		if err == nil || attempt >= retries || !connectIPRetryable(rsp, err) {
+			return ipConn, rsp, connectIPError(rsp, err)
+		}
+		if ctx.Err() != nil || hconn.Context().Err() != nil {
+			return ipConn, rsp, connectIPError(rsp, err)
+		}
+
+		status := 0
+		if rsp != nil {
+			status = rsp.StatusCode
+			// Release the rejected request stream before opening another
+			if rsp.Body != nil {
+				rsp.Body.Close()
+			}
+		}
+		if logger != nil {
+			logger.Warn("Connect-IP request failed, retrying on the same QUIC connection", "attempt", attempt+1, "status", status, "error", err, "delay", delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, rsp, connectIPError(rsp, err)
+		case <-hconn.Context().Done():
+			return nil, rsp, connectIPError(rsp, err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// connectIPError returns err of a failed Connect-IP request as a
+// *TunnelRejectedError when the server answered it, so callers can tell a
+// refused request from a failed connection
+func connectIPError(rsp *http.Response, err error) error {
+	if err == nil || rsp == nil {
+		return err
+	}
+	return &TunnelRejectedError{StatusCode: rsp.StatusCode, Status: rsp.Status}
+}
+
+// connectIPRetries returns the Connect-IP retry budget of cfg
+func connectIPRetries(cfg AdapterConfig) int {
+	switch {
+	case cfg.ConnectIPRetries < 0:
+		return 0
+	case cfg.ConnectIPRetries == 0:
+		return DefaultConnectIPRetries
+	}
+	return cfg.ConnectIPRetries
+}
+
+// connectIPProtocol returns the Connect-IP :protocol of cfg
+func connectIPProtocol(cfg AdapterConfig) string {
+	if cfg.ConnectIPProtocol == "" {
+		return DefaultConnectIPProtocol
+	}
+	return cfg.ConnectIPProtocol
+}
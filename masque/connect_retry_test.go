@@ -0,0 +1,115 @@
+package masque
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// flakyConnectIP is a Connect-IP server that answers the first failures
+// requests with status and proxies the rest
+type flakyConnectIP struct {
+	addr     *net.UDPAddr
+	template *uritemplate.Template
+	requests atomic.Int32 // Connect-IP requests received
+	conns    atomic.Int32 // QUIC connections accepted
+}
+
+func serveFlakyConnectIP(t *testing.T, failures int32, status int) *flakyConnectIP {
+	t.Helper()
+
+	f := &flakyConnectIP{}
+	var template *uritemplate.Template
+	requests, conns := &f.requests, &f.conns
+	proxy := &connectip.Proxy{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect-ip", func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		req, err := connectip.ParseRequest(r, template, "cf-connect-ip")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, err := proxy.Proxy(w, req)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+	})
+	f.addr = serveTestH3(t, mux, func() { conns.Add(1) })
+	template = uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/connect-ip", f.addr.Port))
+	f.template = template
+	return f
+}
+
+func TestDialConnectIPRetriesTransientStatus(t *testing.T) {
+	server := serveFlakyConnectIP(t, 1, http.StatusServiceUnavailable)
+	hconn := dialTestH3(t, server.addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ipConn, rsp, err := dialConnectIP(ctx, hconn, server.template, DefaultConnectIPProtocol, http.Header{}, DefaultConnectIPRetries, nil)
+	if err != nil {
+		t.Fatalf("dialConnectIP: %v", err)
+	}
+	defer ipConn.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s, want 200", rsp.Status)
+	}
+	if got := server.requests.Load(); got != 2 {
+		t.Fatalf("server saw %d Connect-IP requests, want 2", got)
+	}
+	if got := server.conns.Load(); got != 1 {
+		t.Fatalf("server saw %d QUIC connections, want the retry to reuse 1", got)
+	}
+}
+
+func TestDialConnectIPRetryLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		retries  int
+		requests int32
+	}{
+		{"budget exhausted", http.StatusServiceUnavailable, 2, 3},
+		{"retries disabled", http.StatusServiceUnavailable, 0, 1},
+		{"permanent status", http.StatusForbidden, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := serveFlakyConnectIP(t, 10, tt.status)
+			hconn := dialTestH3(t, server.addr)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, rsp, err := dialConnectIP(ctx, hconn, server.template, DefaultConnectIPProtocol, http.Header{}, tt.retries, nil)
+			if err == nil {
+				t.Fatal("dialConnectIP succeeded against a failing server")
+			}
+			if rsp == nil || rsp.StatusCode != tt.status {
+				t.Fatalf("response = %v, want status %d", rsp, tt.status)
+			}
+			if got := server.requests.Load(); got != tt.requests {
+				t.Fatalf("server saw %d Connect-IP requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestConnectIPRetries(t *testing.T) {
+	for _, tt := range []struct{ cfg, want int }{{0, DefaultConnectIPRetries}, {-1, 0}, {5, 5}} {
+		if got := connectIPRetries(AdapterConfig{ConnectIPRetries: tt.cfg}); got != tt.want {
+			t.Errorf("connectIPRetries(%d) = %d, want %d", tt.cfg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package masque
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/voidr3aper-anon/Vwarp/masque/connecturi"
+)
+
+// connectURIFor returns the Connect-IP URI template for endpoint: a per-endpoint
+// template matched by host:port or host, then cfg.ConnectURI, then ConnectURI
+func connectURIFor(cfg AdapterConfig, endpoint string) string {
+	if t, ok := cfg.EndpointConnectURIs[endpoint]; ok {
+		return t
+	}
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		if t, ok := cfg.EndpointConnectURIs[host]; ok {
+			return t
+		}
+	}
+	if cfg.ConnectURI != "" {
+		return cfg.ConnectURI
+	}
+	return ConnectURI
+}
+
+// validateConnectURIs parses every Connect-IP URI template in cfg
+func validateConnectURIs(cfg AdapterConfig) error {
+	if cfg.ConnectURI != "" {
+		if _, err := connecturi.Parse(cfg.ConnectURI); err != nil {
+			return err
+		}
+	}
+	for endpoint, template := range cfg.EndpointConnectURIs {
+		if _, err := connecturi.Parse(template); err != nil {
+			return fmt.Errorf("endpoint %s: %w", endpoint, err)
+		}
+	}
+	return nil
+}
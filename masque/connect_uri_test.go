@@ -0,0 +1,25 @@
+package masque
+
+import "testing"
+
+func TestConnectURIFor(t *testing.T) {
+	cfg := AdapterConfig{
+		ConnectURI: "https://default.example/",
+		EndpointConnectURIs: map[string]string{
+			"203.0.113.7:8443": "https://exact.example/",
+			"203.0.113.7":      "https://host.example/",
+		},
+	}
+	for endpoint, want := range map[string]string{
+		"203.0.113.7:8443": "https://exact.example/",
+		"203.0.113.7:443":  "https://host.example/",
+		"198.51.100.1:443": "https://default.example/",
+	} {
+		if got := connectURIFor(cfg, endpoint); got != want {
+			t.Errorf("connectURIFor(%s) = %q, want %q", endpoint, got, want)
+		}
+	}
+	if got := connectURIFor(AdapterConfig{}, "198.51.100.1:443"); got != ConnectURI {
+		t.Errorf("connectURIFor without templates = %q, want %q", got, ConnectURI)
+	}
+}
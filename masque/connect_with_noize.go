@@ -8,7 +8,6 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
-	"os"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
 	"github.com/quic-go/quic-go"
@@ -17,60 +16,48 @@ import (
 	"github.com/yosida95/uritemplate/v3"
 )
 
-// ConnectTunnelWithNoize connects to MASQUE server with optional noize obfuscation
+// TunnelDialOptions holds the optional settings of ConnectTunnelWithNoize and
+// ConnectTunnelOptimized. The zero value dials like usque's ConnectTunnel.
+type TunnelDialOptions struct {
+	ConnectProtocol  string         // :protocol of the Connect-IP request (DefaultConnectIPProtocol if empty)
+	EgressInterface  string         // Interface the socket is bound to (any if empty)
+	SourcePortRange  [2]int         // Inclusive range the source port is picked from (any if zero)
+	StableSourcePort bool           // Reuse the source port across dials
+	InitialPadding   InitialPadding // Padding of the QUIC Initial packets
+	ConnectHeaders   http.Header    // Headers added to the Connect-IP request
+	ConnectRetries   int            // Times a transiently failed Connect-IP request is repeated
+	Logger           *slog.Logger   // Nothing is logged if nil
+}
+
+// connectProtocol returns the :protocol of the Connect-IP request
+func (o TunnelDialOptions) connectProtocol() string {
+	if o.ConnectProtocol == "" {
+		return DefaultConnectIPProtocol
+	}
+	return o.ConnectProtocol
+}
+
+// ConnectTunnelWithNoize connects to MASQUE server with optional obfuscation
 // This is a modified version of usque's ConnectTunnel that supports UDP connection wrapping
-// Note: Noize obfuscation is automatically disabled after successful tunnel establishment
+// Note: obfuscation is disabled after successful tunnel establishment when the wrapped socket supports it
 func ConnectTunnelWithNoize(
 	ctx context.Context,
 	tlsConfig *tls.Config,
 	quicConfig *quic.Config,
 	connectUri string,
 	endpoint *net.UDPAddr,
-	noizeConfig *noize.NoizeConfig,
-	logger *slog.Logger,
-) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	obfuscator Obfuscator,
+	opts TunnelDialOptions,
+) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error) {
+	logger := opts.Logger
 
 	// Create UDP connection
-	var udpConn *net.UDPConn
-	var err error
-	if endpoint.IP.To4() == nil {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: 0,
-		})
-	} else {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: 0,
-		})
-	}
+	udpConn, err := listenQUICSocket(endpoint, opts.EgressInterface, opts.SourcePortRange, opts.StableSourcePort)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	// Wrap UDP connection with noize if config is provided
-	var quicConn net.PacketConn = udpConn
-	var noizeConn *noize.NoizeUDPConn
-	if noizeConfig != nil {
-		noizeConn = noize.WrapUDPConn(udpConn, noizeConfig)
-		quicConn = noizeConn
-
-		if logger != nil {
-			logger.Info("Noize wrapper created", "jcBeforeHS", noizeConfig.JcBeforeHS, "jcAfterI1", noizeConfig.JcAfterI1)
-		}
-
-		// Enable debug logging only if explicitly requested via environment
-		if os.Getenv("VWARP_NOIZE_DEBUG") == "1" {
-			noizeConn.EnableDebugPadding()
-		}
-	} else {
-		if logger != nil {
-			logger.Warn("No noize config provided - using plain UDP connection")
-		}
-	}
-
 	// Configure UDP socket buffers for optimal QUIC performance
-	// Note: Apply this after noize wrapping to ensure compatibility
 	if logger != nil {
 		if bufferErr := configureUDPBuffer(udpConn, logger); bufferErr != nil {
 			logger.Warn("Failed to optimize UDP buffer settings", "error", bufferErr)
@@ -78,35 +65,24 @@ func ConnectTunnelWithNoize(
 		}
 	}
 
-	// Dial QUIC connection
-	if logger != nil {
-		logger.Info("About to call quic.Dial", "packetConnType", fmt.Sprintf("%T", quicConn), "hasNoize", noizeConn != nil)
-	}
-
-	// Send initial junk packets proactively before QUIC dial
-	// This ensures obfuscation happens before the real handshake begins
-	if noizeConn != nil {
-		if logger != nil {
-			logger.Info("Sending pre-handshake obfuscation before QUIC dial")
-		}
-		// Trigger pre-handshake sequence directly
-		testData := []byte("init")
-		if _, err := quicConn.WriteTo(testData, endpoint); err != nil {
-			if logger != nil {
-				logger.Warn("Pre-handshake trigger failed", "error", err)
-			}
-		}
+	quicConn := obfuscatePacketConn(udpConn, endpoint, obfuscator, logger)
+	dialConn := padInitialPackets(quicConn, opts.InitialPadding)
+	if c, ok := obfuscator.(tlsConfigurer); ok {
+		tlsConfig = c.ConfigureTLS(tlsConfig)
 	}
 
 	conn, err := quic.Dial(
 		ctx,
-		quicConn,
+		dialConn,
 		endpoint,
 		tlsConfig,
 		quicConfig,
 	)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		return udpConn, nil, nil, nil, &HandshakeError{Err: err}
+	}
+	if logger != nil {
+		logger.Debug("QUIC handshake complete", "resumed", conn.ConnectionState().TLS.DidResume)
 	}
 
 	// Create HTTP/3 transport
@@ -121,29 +97,57 @@ func ConnectTunnelWithNoize(
 
 	hconn := tr.NewClientConn(conn)
 
-	additionalHeaders := http.Header{
-		"User-Agent": []string{""},
-	}
+	additionalHeaders := buildConnectHeaders(opts.ConnectHeaders)
 
 	template := uritemplate.MustNew(connectUri)
-	ipConn, rsp, err := connectip.Dial(ctx, hconn, template, "cf-connect-ip", additionalHeaders, true)
+	ipConn, rsp, err := dialConnectIP(ctx, hconn, template, opts.connectProtocol(), additionalHeaders, opts.ConnectRetries, logger)
 	if err != nil {
+		conn.CloseWithError(0, "")
 		if err.Error() == "CRYPTO_ERROR 0x131 (remote): tls: access denied" {
 			return udpConn, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
 		}
-		return udpConn, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
+		return udpConn, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %w", err)
 	}
 
-	// IMPORTANT: Disable noize obfuscation after successful tunnel establishment
+	// IMPORTANT: Disable obfuscation after successful tunnel establishment
 	// Noize is only needed during connection setup - sending junk through established tunnel wastes bandwidth
-	if noizeConn != nil {
-		noizeConn.DisableObfuscation()
+	if finisher, ok := quicConn.(handshakeFinisher); ok {
+		finisher.DisableObfuscation()
 		if logger != nil {
-			logger.Info("Noize obfuscation disabled after successful tunnel establishment")
+			logger.Info("Obfuscation disabled after successful tunnel establishment")
 		}
 	}
 
-	return udpConn, tr, ipConn, rsp, nil
+	return udpConn, hconn, ipConn, rsp, nil
+}
+
+// obfuscatePacketConn wraps udpConn with obfuscator and runs its pre-handshake
+// step, returning the socket QUIC should dial on
+func obfuscatePacketConn(udpConn *net.UDPConn, endpoint *net.UDPAddr, obfuscator Obfuscator, logger *slog.Logger) net.PacketConn {
+	if obfuscator == nil {
+		if logger != nil {
+			logger.Warn("No obfuscator provided - using plain UDP connection")
+		}
+		return udpConn
+	}
+
+	quicConn := obfuscator.WrapPacketConn(udpConn)
+	if logger != nil {
+		if n, ok := obfuscator.(*noize.Obfuscator); ok {
+			logger.Info("Noize wrapper created", "jcBeforeHS", n.Config().JcBeforeHS, "jcAfterI1", n.Config().JcAfterI1)
+		}
+		logger.Info("Running pre-handshake obfuscation before QUIC dial", "packetConnType", fmt.Sprintf("%T", quicConn))
+	}
+
+	// Run the pre-handshake step before the QUIC dial
+	err := obfuscator.PreHandshake(func(b []byte) error {
+		_, err := quicConn.WriteTo(b, endpoint)
+		return err
+	})
+	if err != nil && logger != nil {
+		logger.Warn("Pre-handshake trigger failed", "error", err)
+	}
+	return quicConn
 }
 
 // ConnectTunnelOptimized is an enhanced version of api.ConnectTunnel that applies UDP buffer optimizations
@@ -154,23 +158,12 @@ func ConnectTunnelOptimized(
 	quicConfig *quic.Config,
 	connectUri string,
 	endpoint *net.UDPAddr,
-	logger *slog.Logger,
-) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	opts TunnelDialOptions,
+) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error) {
+	logger := opts.Logger
 
 	// Create UDP connection
-	var udpConn *net.UDPConn
-	var err error
-	if endpoint.IP.To4() == nil {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: 0,
-		})
-	} else {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: 0,
-		})
-	}
+	udpConn, err := listenQUICSocket(endpoint, opts.EgressInterface, opts.SourcePortRange, opts.StableSourcePort)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
@@ -186,13 +179,16 @@ func ConnectTunnelOptimized(
 	// Dial QUIC connection
 	conn, err := quic.Dial(
 		ctx,
-		udpConn,
+		padInitialPackets(udpConn, opts.InitialPadding),
 		endpoint,
 		tlsConfig,
 		quicConfig,
 	)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		return udpConn, nil, nil, nil, &HandshakeError{Err: err}
+	}
+	if logger != nil {
+		logger.Debug("QUIC handshake complete", "resumed", conn.ConnectionState().TLS.DidResume)
 	}
 
 	// Create HTTP/3 transport
@@ -207,18 +203,30 @@ func ConnectTunnelOptimized(
 
 	hconn := tr.NewClientConn(conn)
 
-	additionalHeaders := http.Header{
-		"User-Agent": []string{""},
-	}
+	additionalHeaders := buildConnectHeaders(opts.ConnectHeaders)
 
 	template := uritemplate.MustNew(connectUri)
-	ipConn, rsp, err := connectip.Dial(ctx, hconn, template, "cf-connect-ip", additionalHeaders, true)
+	ipConn, rsp, err := dialConnectIP(ctx, hconn, template, opts.connectProtocol(), additionalHeaders, opts.ConnectRetries, logger)
 	if err != nil {
+		conn.CloseWithError(0, "")
 		if err.Error() == "CRYPTO_ERROR 0x131 (remote): tls: access denied" {
 			return udpConn, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
 		}
-		return udpConn, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %v", err)
+		return udpConn, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %w", err)
 	}
 
-	return udpConn, tr, ipConn, rsp, nil
+	return udpConn, hconn, ipConn, rsp, nil
+}
+
+// buildConnectHeaders returns the headers sent with the Connect-IP request.
+// The User-Agent defaults to empty to match usque; any header in extra
+// overrides or extends the defaults.
+func buildConnectHeaders(extra http.Header) http.Header {
+	headers := http.Header{
+		"User-Agent": []string{""},
+	}
+	for key, values := range extra {
+		headers[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	return headers
 }
@@ -0,0 +1,173 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+func TestBuildConnectHeaders(t *testing.T) {
+	t.Run("default empty user agent", func(t *testing.T) {
+		headers := buildConnectHeaders(nil)
+		values, ok := headers["User-Agent"]
+		if !ok || len(values) != 1 || values[0] != "" {
+			t.Fatalf("expected empty User-Agent, got %v", headers)
+		}
+	})
+
+	t.Run("configured headers are merged", func(t *testing.T) {
+		extra := http.Header{}
+		extra.Set("User-Agent", "WARP for Android")
+		extra.Set("cf-client-version", "a-6.30-3596")
+
+		headers := buildConnectHeaders(extra)
+		if got := headers.Get("User-Agent"); got != "WARP for Android" {
+			t.Errorf("User-Agent = %q, want %q", got, "WARP for Android")
+		}
+		if got := headers.Get("Cf-Client-Version"); got != "a-6.30-3596" {
+			t.Errorf("Cf-Client-Version = %q, want %q", got, "a-6.30-3596")
+		}
+
+		// The caller's header map must not be aliased
+		headers.Set("User-Agent", "changed")
+		if got := extra.Get("User-Agent"); got != "WARP for Android" {
+			t.Errorf("caller headers were modified: %q", got)
+		}
+	})
+}
+
+func TestConnectTunnelProtocol(t *testing.T) {
+	const protocol = "connect-ip" // RFC 9484, instead of DefaultConnectIPProtocol
+	var template *uritemplate.Template
+	var got atomic.Value
+	proxy := &connectip.Proxy{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect-ip", func(w http.ResponseWriter, r *http.Request) {
+		got.Store(r.Proto)
+		req, err := connectip.ParseRequest(r, template, protocol)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, err := proxy.Proxy(w, req)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+	})
+	addr := serveTestH3(t, mux, nil)
+	uri := fmt.Sprintf("https://localhost:%d/connect-ip", addr.Port)
+	template = uritemplate.MustNew(uri)
+
+	type connectFunc func(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error)
+	for name, connect := range map[string]connectFunc{
+		"plain": func(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error) {
+			return ConnectTunnelOptimized(ctx, tlsConfig, quicConfig, uri, addr, TunnelDialOptions{ConnectProtocol: protocol})
+		},
+		"obfuscated": func(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error) {
+			return ConnectTunnelWithNoize(ctx, tlsConfig, quicConfig, uri, addr, nil, TunnelDialOptions{ConnectProtocol: protocol})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got.Store("")
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			udpConn, h3conn, ipConn, rsp, err := connect(ctx,
+				&tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+				&quic.Config{EnableDatagrams: true})
+			if udpConn != nil {
+				defer udpConn.Close()
+			}
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			defer h3conn.CloseWithError(http3.ErrCodeNoError, "")
+			defer ipConn.Close()
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %s, want 200", rsp.Status)
+			}
+			if p := got.Load(); p != protocol {
+				t.Fatalf("Connect-IP request :protocol = %q, want %q", p, protocol)
+			}
+		})
+	}
+}
+
+func TestConnectTunnelSendsConfiguredHeaders(t *testing.T) {
+	var template *uritemplate.Template
+	var got atomic.Pointer[http.Header]
+	proxy := &connectip.Proxy{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect-ip", func(w http.ResponseWriter, r *http.Request) {
+		headers := r.Header.Clone()
+		got.Store(&headers)
+		req, err := connectip.ParseRequest(r, template, DefaultConnectIPProtocol)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, err := proxy.Proxy(w, req)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+	})
+	addr := serveTestH3(t, mux, nil)
+	uri := fmt.Sprintf("https://localhost:%d/connect-ip", addr.Port)
+	template = uritemplate.MustNew(uri)
+
+	extra := http.Header{}
+	extra.Set("User-Agent", "WARP for Android")
+	extra.Set("cf-client-version", "a-6.30-3596")
+	opts := TunnelDialOptions{ConnectHeaders: extra}
+
+	type connectFunc func(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error)
+	for name, connect := range map[string]connectFunc{
+		"plain": func(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error) {
+			return ConnectTunnelOptimized(ctx, tlsConfig, quicConfig, uri, addr, opts)
+		},
+		"obfuscated": func(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config) (*net.UDPConn, *http3.ClientConn, *connectip.Conn, *http.Response, error) {
+			return ConnectTunnelWithNoize(ctx, tlsConfig, quicConfig, uri, addr, nil, opts)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got.Store(nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			udpConn, h3conn, ipConn, rsp, err := connect(ctx,
+				&tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+				&quic.Config{EnableDatagrams: true})
+			if udpConn != nil {
+				defer udpConn.Close()
+			}
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			defer h3conn.CloseWithError(http3.ErrCodeNoError, "")
+			defer ipConn.Close()
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %s, want 200", rsp.Status)
+			}
+			headers := got.Load()
+			if headers == nil {
+				t.Fatal("server saw no Connect-IP request")
+			}
+			if ua := headers.Get("User-Agent"); ua != "WARP for Android" {
+				t.Errorf("Connect-IP request User-Agent = %q, want %q", ua, "WARP for Android")
+			}
+			if v := headers.Get("Cf-Client-Version"); v != "a-6.30-3596" {
+				t.Errorf("Connect-IP request Cf-Client-Version = %q, want %q", v, "a-6.30-3596")
+			}
+		})
+	}
+}
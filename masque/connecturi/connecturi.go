@@ -0,0 +1,105 @@
+// Package connecturi parses and expands Connect-IP URI templates. It has no
+// dependencies on the rest of vwarp, so configuration code can validate
+// templates without importing the MASQUE client.
+package connecturi
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// Template variables, expanded with the endpoint being dialed
+const (
+	TargetHostVar = "target_host"
+	TargetPortVar = "target_port"
+)
+
+// hostPlaceholder stands in for {target_host} while expanding, so the host can
+// be written bracketed where it lands in the authority. It only holds
+// unreserved characters, which every expansion keeps as they are.
+const hostPlaceholder = "vwarp-target-host"
+
+// hostTemplate encodes the host like {target_host} would
+var hostTemplate = uritemplate.MustNew("{h}")
+
+// Parse validates a Connect-IP URI template. Besides a fixed URI, templates
+// may use {target_host} and {target_port}, which are filled in with the
+// MASQUE endpoint when connecting.
+func Parse(template string) (*uritemplate.Template, error) {
+	t, err := uritemplate.New(template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Connect-IP URI template %q: %w", template, err)
+	}
+	for _, name := range t.Varnames() {
+		if name != TargetHostVar && name != TargetPortVar {
+			return nil, fmt.Errorf("invalid Connect-IP URI template %q: unsupported variable {%s}", template, name)
+		}
+	}
+	// Expanding with placeholder endpoints of both families catches templates
+	// that can never form a usable URI
+	for _, endpoint := range []string{"192.0.2.1:443", "[2001:db8::1]:443"} {
+		if _, err := Expand(t, endpoint); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Expand fills in the template variables for endpoint (host:port) and returns
+// the variable-free URI connect-ip expects. An IPv6 host is bracketed where it
+// forms the URI authority and percent-encoded anywhere else.
+func Expand(t *uritemplate.Template, endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	values := uritemplate.Values{}
+	values.Set(TargetHostVar, uritemplate.String(hostPlaceholder))
+	values.Set(TargetPortVar, uritemplate.String(port))
+	expanded, err := t.Expand(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand Connect-IP URI template %q: %w", t.Raw(), err)
+	}
+
+	authorityHost := host
+	if strings.Contains(host, ":") {
+		authorityHost = "[" + host + "]"
+	}
+	// The rest of the URI gets the host as the template would have encoded it
+	encoded, err := hostTemplate.Expand(uritemplate.Values{"h": uritemplate.String(host)})
+	if err != nil {
+		return "", err
+	}
+	start, end := authoritySpan(expanded)
+	expanded = strings.ReplaceAll(expanded[:start], hostPlaceholder, encoded) +
+		strings.ReplaceAll(expanded[start:end], hostPlaceholder, authorityHost) +
+		strings.ReplaceAll(expanded[end:], hostPlaceholder, encoded)
+
+	u, err := url.Parse(expanded)
+	if err != nil {
+		return "", fmt.Errorf("invalid Connect-IP URI template %q: %w", t.Raw(), err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid Connect-IP URI template %q: must expand to an https:// URI", t.Raw())
+	}
+	return expanded, nil
+}
+
+// authoritySpan returns the bounds of the authority of the URI s, empty if it
+// has none
+func authoritySpan(s string) (int, int) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return 0, 0
+	}
+	start := i + len("://")
+	end := len(s)
+	if j := strings.IndexAny(s[start:], "/?#"); j >= 0 {
+		end = start + j
+	}
+	return start, end
+}
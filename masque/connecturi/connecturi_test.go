@@ -0,0 +1,40 @@
+package connecturi
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	for _, tc := range []struct {
+		template, endpoint, want string
+	}{
+		{"https://cloudflareaccess.com", "162.159.198.1:443", "https://cloudflareaccess.com"},
+		{"https://{target_host}:{target_port}/.well-known/masque/ip/", "203.0.113.7:8443", "https://203.0.113.7:8443/.well-known/masque/ip/"},
+		{"https://masque.example/{target_host}/{target_port}", "[2606:4700:103::1]:443", "https://masque.example/2606%3A4700%3A103%3A%3A1/443"},
+		{"https://{target_host}:{target_port}/masque?h={target_host}", "[2606:4700:103::1]:443", "https://[2606:4700:103::1]:443/masque?h=2606%3A4700%3A103%3A%3A1"},
+		{"https://{target_host}/", "[2606:4700:103::1]:443", "https://[2606:4700:103::1]/"},
+	} {
+		tmpl, err := Parse(tc.template)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.template, err)
+		}
+		got, err := Expand(tmpl, tc.endpoint)
+		if err != nil {
+			t.Fatalf("Expand(%q, %s): %v", tc.template, tc.endpoint, err)
+		}
+		if got != tc.want {
+			t.Errorf("Expand(%q, %s) = %q, want %q", tc.template, tc.endpoint, got, tc.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, template := range []string{
+		"https://{target_host/masque",
+		"https://{target}/{ipproto}/",
+		"http://{target_host}/",
+		"/.well-known/masque/ip/",
+	} {
+		if _, err := Parse(template); err == nil {
+			t.Errorf("Parse(%q) accepted", template)
+		}
+	}
+}
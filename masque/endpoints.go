@@ -1,5 +1,18 @@
 package masque
 
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/voidr3aper-anon/Vwarp/iputils"
+)
+
+// hostFamilies reports the address families the host can route, replaced in tests
+var hostFamilies = iputils.HostFamilies
+
 // DefaultMasqueV4CIDRs returns the default IPv4 CIDR ranges for MASQUE endpoints
 func DefaultMasqueV4CIDRs() []string {
 	return []string{
@@ -23,3 +36,37 @@ func DefaultMasqueV6CIDRs() []string {
 func DefaultMasquePort() uint16 {
 	return 443
 }
+
+// randomMasqueEndpoint picks a random address from the default MASQUE ranges
+func randomMasqueEndpoint(useIPv6 bool) (string, error) {
+	cidrs := DefaultMasqueV4CIDRs()
+	if useIPv6 {
+		cidrs = DefaultMasqueV6CIDRs()
+	}
+
+	prefix, err := netip.ParsePrefix(cidrs[rand.Intn(len(cidrs))])
+	if err != nil {
+		return "", fmt.Errorf("invalid MASQUE range: %w", err)
+	}
+	addr, err := iputils.RandomIPFromPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addr.String(), strconv.Itoa(int(DefaultMasquePort()))), nil
+}
+
+// inDefaultMasqueRanges reports whether host is an address in the default
+// MASQUE ranges
+func inDefaultMasqueRanges(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, cidr := range append(DefaultMasqueV4CIDRs(), DefaultMasqueV6CIDRs()...) {
+		if netip.MustParsePrefix(cidr).Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
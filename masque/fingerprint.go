@@ -0,0 +1,51 @@
+package masque
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/Diniboy1123/usque/config"
+)
+
+// KeyFingerprints loads the MASQUE config at configPath and returns the hex
+// SHA-256 fingerprints of the client public key and the pinned endpoint public key
+func KeyFingerprints(configPath string) (client string, endpoint string, err error) {
+	if err := config.LoadConfig(configPath); err != nil {
+		return "", "", fmt.Errorf("failed to load config: %w", err)
+	}
+
+	privKey, err := config.AppConfig.GetEcPrivateKey()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get private key: %w", err)
+	}
+
+	peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get peer public key: %w", err)
+	}
+
+	client, err = publicKeyFingerprint(&privKey.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	endpoint, err = publicKeyFingerprint(peerPubKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	return client, endpoint, nil
+}
+
+// publicKeyFingerprint returns the hex SHA-256 of the PKIX DER encoding of pub
+func publicKeyFingerprint(pub *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,20 @@
+package masque
+
+import "testing"
+
+func TestKeyFingerprints(t *testing.T) {
+	client, endpoint, err := KeyFingerprints("testdata/fingerprint_config.json")
+	if err != nil {
+		t.Fatalf("KeyFingerprints() error = %v", err)
+	}
+
+	const wantClient = "4d42c9ace3817af6da16a0f888c2e0550c8d96256a8b5b2af05490760c2c29fe"
+	const wantEndpoint = "763f01a40328a984c670219f7d7f2952bcec441b5831da73a23fc2882e87293d"
+
+	if client != wantClient {
+		t.Errorf("client fingerprint = %s, want %s", client, wantClient)
+	}
+	if endpoint != wantEndpoint {
+		t.Errorf("endpoint fingerprint = %s, want %s", endpoint, wantEndpoint)
+	}
+}
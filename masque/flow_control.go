@@ -0,0 +1,40 @@
+package masque
+
+import (
+	"fmt"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ReceiveWindows sets the QUIC flow control receive windows of a MASQUE
+// tunnel. Zero fields keep the quic-go defaults.
+//
+// The windows bound stream data such as the Connect-IP request and its
+// capsules. The tunneled packets travel as QUIC datagrams, which flow control
+// doesn't cover: only quic-go's CUBIC congestion controller, which can't be
+// replaced, limits them.
+type ReceiveWindows struct {
+	InitialStream     uint64 // Stream receive window a connection starts with
+	MaxStream         uint64 // Largest stream receive window auto-tuning may grow to
+	InitialConnection uint64 // Connection receive window a connection starts with
+	MaxConnection     uint64 // Largest connection receive window auto-tuning may grow to
+}
+
+// Validate rejects initial windows above their maximum
+func (rw ReceiveWindows) Validate() error {
+	if rw.MaxStream != 0 && rw.InitialStream > rw.MaxStream {
+		return fmt.Errorf("initial stream window %d exceeds the maximum of %d", rw.InitialStream, rw.MaxStream)
+	}
+	if rw.MaxConnection != 0 && rw.InitialConnection > rw.MaxConnection {
+		return fmt.Errorf("initial connection window %d exceeds the maximum of %d", rw.InitialConnection, rw.MaxConnection)
+	}
+	return nil
+}
+
+// apply sets the receive windows of rw on qc
+func (rw ReceiveWindows) apply(qc *quic.Config) {
+	qc.InitialStreamReceiveWindow = rw.InitialStream
+	qc.MaxStreamReceiveWindow = rw.MaxStream
+	qc.InitialConnectionReceiveWindow = rw.InitialConnection
+	qc.MaxConnectionReceiveWindow = rw.MaxConnection
+}
@@ -0,0 +1,52 @@
+package masque
+
+import "testing"
+
+func TestQUICConfigReceiveWindows(t *testing.T) {
+	pad := InitialPadding{Size: DefaultInitialPacketSize}
+
+	def := newQUICConfig(pad, 0, ReceiveWindows{})
+	if def.InitialStreamReceiveWindow != 0 || def.MaxStreamReceiveWindow != 0 ||
+		def.InitialConnectionReceiveWindow != 0 || def.MaxConnectionReceiveWindow != 0 {
+		t.Errorf("zero ReceiveWindows set windows %+v, want the quic-go defaults", def)
+	}
+
+	rw := ReceiveWindows{
+		InitialStream:     1 << 20,
+		MaxStream:         32 << 20,
+		InitialConnection: 2 << 20,
+		MaxConnection:     64 << 20,
+	}
+	if err := rw.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	qc := newQUICConfig(pad, 0, rw)
+	if qc.InitialStreamReceiveWindow != rw.InitialStream || qc.MaxStreamReceiveWindow != rw.MaxStream {
+		t.Errorf("stream windows = %d/%d, want %d/%d", qc.InitialStreamReceiveWindow, qc.MaxStreamReceiveWindow, rw.InitialStream, rw.MaxStream)
+	}
+	if qc.InitialConnectionReceiveWindow != rw.InitialConnection || qc.MaxConnectionReceiveWindow != rw.MaxConnection {
+		t.Errorf("connection windows = %d/%d, want %d/%d", qc.InitialConnectionReceiveWindow, qc.MaxConnectionReceiveWindow, rw.InitialConnection, rw.MaxConnection)
+	}
+	if !qc.EnableDatagrams || qc.KeepAlivePeriod != DefaultKeepAlivePeriod {
+		t.Error("receive windows replaced the rest of the QUIC config")
+	}
+}
+
+func TestReceiveWindowsValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		rw   ReceiveWindows
+		ok   bool
+	}{
+		{"default", ReceiveWindows{}, true},
+		{"initial only", ReceiveWindows{InitialStream: 2 << 20, InitialConnection: 4 << 20}, true},
+		{"stream window above max", ReceiveWindows{InitialStream: 2 << 20, MaxStream: 1 << 20}, false},
+		{"connection window above max", ReceiveWindows{InitialConnection: 2 << 20, MaxConnection: 1 << 20}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rw.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package masque
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/voidr3aper-anon/Vwarp/masque/noize"
+)
+
+const (
+	// DefaultInitialPacketSize is the QUIC Initial datagram size of the Cloudflare WARP client
+	DefaultInitialPacketSize = 1242
+	// minInitialPacketSize is the smallest Initial datagram QUIC allows (RFC 9000, section 14.1)
+	minInitialPacketSize = 1200
+)
+
+// InitialPadding describes how client Initial datagrams are padded
+type InitialPadding struct {
+	Size    int    // Target datagram size
+	Pattern []byte // Trailing fill after the QUIC packet, QUIC PADDING frames if empty
+}
+
+// validateInitialPacketSize rejects sizes QUIC would silently raise to the minimum
+func validateInitialPacketSize(size uint16) error {
+	if size != 0 && size < minInitialPacketSize {
+		return fmt.Errorf("initial packet size %d is below the QUIC minimum of %d", size, minInitialPacketSize)
+	}
+	return nil
+}
+
+// validateHandshakeProfile rejects Initial padding settings next to a noize
+// handshake profile, which sizes the Initial datagrams itself from packets
+// QUIC packs at the minimum size
+func validateHandshakeProfile(cfg AdapterConfig) error {
+	if cfg.Obfuscator != nil || cfg.NoizeConfig == nil || cfg.NoizeConfig.HandshakeProfile == "" {
+		return nil
+	}
+	if cfg.InitialPacketSize != 0 || len(cfg.InitialPadPattern) > 0 {
+		return fmt.Errorf("noize handshake profile %q sizes the Initial datagrams and can't be combined with an initial packet size or pad pattern", cfg.NoizeConfig.HandshakeProfile)
+	}
+	return nil
+}
+
+// ValidateInitialPadding checks an Initial packet size and pad pattern as
+// NewMasqueAdapter does, next to the MASQUE noize config they run with
+func ValidateInitialPadding(size uint16, pattern []byte, noizeConfig *noize.NoizeConfig) error {
+	if err := validateInitialPacketSize(size); err != nil {
+		return err
+	}
+	return validateHandshakeProfile(AdapterConfig{InitialPacketSize: size, InitialPadPattern: pattern, NoizeConfig: noizeConfig})
+}
+
+// newQUICConfig returns the QUIC config of a MASQUE tunnel. With a pad pattern
+// QUIC packs its Initial at the minimum size and initialPadConn fills the rest.
+// A zero keepAlive means DefaultKeepAlivePeriod.
+func newQUICConfig(pad InitialPadding, keepAlive time.Duration, rw ReceiveWindows) *quic.Config {
+	size := pad.Size
+	if len(pad.Pattern) > 0 {
+		size = minInitialPacketSize
+	}
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlivePeriod
+	}
+	qc := &quic.Config{
+		EnableDatagrams:       true,
+		InitialPacketSize:     uint16(size),
+		KeepAlivePeriod:       keepAlive,
+		MaxIdleTimeout:        maxIdleTimeout,
+		HandshakeIdleTimeout:  20 * time.Second, // Slightly longer to reduce aggressive retransmissions
+		MaxIncomingStreams:    10,
+		MaxIncomingUniStreams: 5,
+	}
+	rw.apply(qc)
+	return qc
+}
+
+// padInitialPackets wraps conn with initialPadConn when pad has a pattern
+func padInitialPackets(conn net.PacketConn, pad InitialPadding) net.PacketConn {
+	if len(pad.Pattern) == 0 {
+		return conn
+	}
+	return &initialPadConn{PacketConn: conn, pad: pad}
+}
+
+// initialPadConn extends QUIC v1 Initial datagrams to the configured size with
+// a byte pattern. Receivers ignore trailing bytes that don't parse as a
+// coalesced packet (RFC 9000, section 12.2).
+type initialPadConn struct {
+	net.PacketConn
+	pad InitialPadding
+}
+
+func (c *initialPadConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// Long header, fixed bit and packet type Initial
+	if len(b) == 0 || b[0]&0xf0 != 0xc0 || len(b) >= c.pad.Size {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	padded := make([]byte, c.pad.Size)
+	copy(padded, b)
+	for i := len(b); i < len(padded); i += len(c.pad.Pattern) {
+		copy(padded[i:], c.pad.Pattern)
+	}
+	if _, err := c.PacketConn.WriteTo(padded, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
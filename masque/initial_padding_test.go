@@ -0,0 +1,97 @@
+package masque
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/voidr3aper-anon/Vwarp/masque/noize"
+)
+
+// firstDatagram dials QUIC from conn to server with pad applied and returns
+// the first datagram the server receives
+func firstDatagram(t *testing.T, pad InitialPadding) []byte {
+	t.Helper()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer client.Close()
+
+	// Nothing answers, so the dial only has to get its Initial onto the wire
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: DefaultALPN}
+	go quic.Dial(ctx, padInitialPackets(client, pad), server.LocalAddr(), tlsConfig, newQUICConfig(pad, 0, ReceiveWindows{}))
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading Initial: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestInitialPacketSize(t *testing.T) {
+	for _, size := range []int{DefaultInitialPacketSize, 1350} {
+		if got := len(firstDatagram(t, InitialPadding{Size: size})); got != size {
+			t.Errorf("Initial datagram is %d bytes, want %d", got, size)
+		}
+	}
+}
+
+func TestInitialPadPattern(t *testing.T) {
+	pattern := []byte{0xde, 0xad, 0xbe, 0xef}
+	b := firstDatagram(t, InitialPadding{Size: DefaultInitialPacketSize, Pattern: pattern})
+
+	if len(b) != DefaultInitialPacketSize {
+		t.Fatalf("Initial datagram is %d bytes, want %d", len(b), DefaultInitialPacketSize)
+	}
+	tail := b[minInitialPacketSize:]
+	want := bytes.Repeat(pattern, len(tail)/len(pattern)+1)[:len(tail)]
+	if !bytes.Equal(tail, want) {
+		t.Fatalf("padding after the QUIC packet = %x, want the pattern repeated", tail)
+	}
+}
+
+func TestValidateInitialPacketSize(t *testing.T) {
+	for _, size := range []uint16{0, 1200, DefaultInitialPacketSize} {
+		if err := validateInitialPacketSize(size); err != nil {
+			t.Errorf("validateInitialPacketSize(%d) = %v", size, err)
+		}
+	}
+	if err := validateInitialPacketSize(1199); err == nil {
+		t.Error("validateInitialPacketSize(1199) accepted a size below the QUIC minimum")
+	}
+}
+
+func TestValidateHandshakeProfile(t *testing.T) {
+	profile := &noize.NoizeConfig{HandshakeProfile: "chrome"}
+	for name, cfg := range map[string]AdapterConfig{
+		"profile alone":     {NoizeConfig: profile},
+		"padding alone":     {InitialPacketSize: 1350, InitialPadPattern: []byte{0xff}},
+		"custom obfuscator": {NoizeConfig: profile, Obfuscator: noize.NewObfuscator(profile, nil), InitialPacketSize: 1350},
+	} {
+		if err := validateHandshakeProfile(cfg); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	for name, cfg := range map[string]AdapterConfig{
+		"with a packet size": {NoizeConfig: profile, InitialPacketSize: 1350},
+		"with a pad pattern": {NoizeConfig: profile, InitialPadPattern: []byte{0xff}},
+	} {
+		if err := validateHandshakeProfile(cfg); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
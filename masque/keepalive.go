@@ -0,0 +1,22 @@
+package masque
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultKeepAlivePeriod is how often an idle tunnel sends QUIC PINGs
+	DefaultKeepAlivePeriod = 30 * time.Second
+	// maxIdleTimeout closes a tunnel that heard nothing from the peer for this long
+	maxIdleTimeout = 60 * time.Second
+)
+
+// validateKeepAlivePeriod rejects periods that would let the tunnel idle out
+// between two PINGs
+func validateKeepAlivePeriod(period time.Duration) error {
+	if period < 0 || period >= maxIdleTimeout {
+		return fmt.Errorf("keepalive period %s must be between 0 and the %s idle timeout", period, maxIdleTimeout)
+	}
+	return nil
+}
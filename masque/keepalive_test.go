@@ -0,0 +1,21 @@
+package masque
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQUICKeepAlivePeriod(t *testing.T) {
+	pad := InitialPadding{Size: DefaultInitialPacketSize}
+	if got := newQUICConfig(pad, 0, ReceiveWindows{}).KeepAlivePeriod; got != DefaultKeepAlivePeriod {
+		t.Errorf("default keepalive = %s, want %s", got, DefaultKeepAlivePeriod)
+	}
+	if got := newQUICConfig(pad, 10*time.Second, ReceiveWindows{}).KeepAlivePeriod; got != 10*time.Second {
+		t.Errorf("keepalive = %s, want 10s", got)
+	}
+	for _, period := range []time.Duration{-time.Second, maxIdleTimeout, 2 * time.Minute} {
+		if err := validateKeepAlivePeriod(period); err == nil {
+			t.Errorf("validateKeepAlivePeriod(%s) succeeded, want error", period)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package masque
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// rebindWindow is how long the PATH_CHALLENGEs after a warned rebind count as
+// the same rebind. Every challenge of a path validation carries fresh data,
+// and the endpoint retries them for about three PTOs.
+const rebindWindow = 5 * time.Second
+
+// natWatch warns when the endpoint starts validating a new path to an
+// established tunnel. The client never migrates on its own, so a
+// PATH_CHALLENGE means packets from our socket reached the endpoint from a
+// new address: a NAT on the way remapped the source port. QUIC survives a
+// rebinding, but NATs that keep doing it (symmetric or double NAT) tend to
+// break long-lived tunnels, which the warning points support at.
+type natWatch struct {
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	local      net.Addr  // Our side of the observed 4-tuple
+	remote     net.Addr  // Endpoint side of the observed 4-tuple
+	lastWarned time.Time // When the last rebind was warned about
+	rebinds    int       // Distinct path validations seen on the connection
+}
+
+// newNATWatch returns a natWatch logging to logger
+func newNATWatch(logger *slog.Logger) *natWatch {
+	return &natWatch{logger: logger}
+}
+
+// tracer is a quic.Config Tracer that feeds the connection's events to w
+func (w *natWatch) tracer(_ context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		StartedConnection: func(local, remote net.Addr, _, _ logging.ConnectionID) {
+			w.mu.Lock()
+			w.local, w.remote = local, remote
+			w.mu.Unlock()
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, _ logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+			for _, f := range frames {
+				if _, ok := f.(*logging.PathChallengeFrame); ok {
+					w.pathChallenged(time.Now())
+				}
+			}
+		},
+	}
+}
+
+// pathChallenged logs a warning for a PATH_CHALLENGE received at now, unless
+// it is within rebindWindow of the last one warned about
+func (w *natWatch) pathChallenged(now time.Time) {
+	w.mu.Lock()
+	if w.rebinds > 0 && now.Sub(w.lastWarned) < rebindWindow {
+		w.mu.Unlock()
+		return
+	}
+	w.lastWarned = now
+	w.rebinds++
+	rebinds, local, remote := w.rebinds, w.local, w.remote
+	w.mu.Unlock()
+
+	w.logger.Warn("MASQUE endpoint saw the tunnel's source address change mid-connection; a NAT remapped the source port, which symmetric or double NAT does and can drop the tunnel",
+		"local", local, "endpoint", remote, "rebinds", rebinds)
+}
@@ -0,0 +1,219 @@
+package masque
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testNAT relays UDP between a client and server like a NAT, from an
+// outside socket whose port rebind changes
+type testNAT struct {
+	inside *net.UDPConn
+	server *net.UDPAddr
+
+	mu      sync.Mutex
+	outside *net.UDPConn
+	client  net.Addr
+}
+
+func newTestNAT(t *testing.T, server *net.UDPAddr) *testNAT {
+	t.Helper()
+	inside, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testNAT{inside: inside, server: server}
+	t.Cleanup(func() {
+		inside.Close()
+		n.mu.Lock()
+		n.outside.Close()
+		n.mu.Unlock()
+	})
+	n.rebind(t)
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			k, from, err := inside.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.client = from
+			outside := n.outside
+			n.mu.Unlock()
+			outside.WriteTo(buf[:k], server)
+		}
+	}()
+	return n
+}
+
+// rebind moves the mapping to a new outside port, as a NAT remapping the
+// source port does
+func (n *testNAT) rebind(t *testing.T) {
+	t.Helper()
+	outside, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.mu.Lock()
+	old := n.outside
+	n.outside = outside
+	n.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			k, _, err := outside.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			client := n.client
+			n.mu.Unlock()
+			n.inside.WriteTo(buf[:k], client)
+		}
+	}()
+}
+
+// serveTestQUICEcho runs a QUIC server echoing every stream back
+func serveTestQUICEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := generateSelfSignedCert(key, AdapterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		NextProtos:   []string{"nat-test"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					str, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go io.Copy(str, str)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.UDPAddr)
+}
+
+func TestNATWatchWarnsOnSourcePortChange(t *testing.T) {
+	nat := newTestNAT(t, serveTestQUICEcho(t))
+
+	var logs syncBuffer
+	watch := newNATWatch(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, nat.inside.LocalAddr().String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"nat-test"}},
+		&quic.Config{Tracer: watch.tracer})
+	if err != nil {
+		t.Fatalf("quic dial: %v", err)
+	}
+	defer conn.CloseWithError(0, "")
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := str.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(str, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	echo("before")
+	if strings.Contains(logs.String(), "source address change") {
+		t.Fatalf("warned before the NAT rebound:\n%s", logs.String())
+	}
+
+	nat.rebind(t)
+	echo("after")
+	for !strings.Contains(logs.String(), "source address change") {
+		if ctx.Err() != nil {
+			t.Fatalf("no warning after the source port changed:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "rebinds=1") {
+		t.Errorf("warning doesn't count the rebind:\n%s", logs.String())
+	}
+}
+
+func TestNATWatchCountsRebindsByTime(t *testing.T) {
+	var logs syncBuffer
+	watch := newNATWatch(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// Path validation retries with fresh data, which must not count again
+	start := time.Now()
+	watch.pathChallenged(start)
+	watch.pathChallenged(start.Add(time.Second))
+	watch.pathChallenged(start.Add(rebindWindow - time.Millisecond))
+	if watch.rebinds != 1 {
+		t.Fatalf("counted %d rebinds for one path validation, want 1", watch.rebinds)
+	}
+
+	watch.pathChallenged(start.Add(2 * rebindWindow))
+	if watch.rebinds != 2 || !strings.Contains(logs.String(), "rebinds=2") {
+		t.Errorf("counted %d rebinds after a later rebind, want 2:\n%s", watch.rebinds, logs.String())
+	}
+}
@@ -0,0 +1,157 @@
+package noize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultCoalesceWindow is how long a coalesced datagram waits for more
+// packets when NoizeConfig.CoalesceWindow is zero
+const defaultCoalesceWindow = time.Millisecond
+
+// coalescer holds packets waiting to go out together in one datagram.
+//
+// QUIC allows several packets in one datagram only if every packet but the
+// last has a long header, whose Length field marks where the next one starts,
+// and all of them carry the same destination connection ID (RFC 9000,
+// section 12.2). So only writes made of whole long-header packets are held
+// back; any other write to the same connection may join them as the last
+// packet, and everything else flushes them and goes out alone.
+type coalescer struct {
+	mu      sync.Mutex
+	pending []byte
+	addr    *net.UDPAddr
+	dcid    []byte
+	gen     uint64 // Bumped on every flush so a stale timer flushes nothing
+}
+
+// coalesce queues b to share a datagram with the writes around it, sending
+// whatever can't wait
+func (c *NoizeUDPConn) coalesce(b []byte, addr *net.UDPAddr) (int, error) {
+	config := c.noize.config
+	co := &c.coalescer
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	dcid, held := longHeaderDCID(b)
+	if len(co.pending) > 0 {
+		fits := co.addr.String() == addr.String() && len(co.pending)+len(b) <= config.CoalesceSize
+		switch {
+		case fits && held && bytes.Equal(dcid, co.dcid):
+		case fits && isShortHeader(b, co.dcid):
+			// The last packet of the datagram
+			co.pending = append(co.pending, b...)
+			return len(b), c.flushLocked()
+		default:
+			if err := c.flushLocked(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if !held || len(b) >= config.CoalesceSize {
+		return c.writeDatagram(b, addr)
+	}
+	if len(co.pending) == 0 {
+		co.addr, co.dcid = addr, dcid
+		window := config.CoalesceWindow
+		if window == 0 {
+			window = defaultCoalesceWindow
+		}
+		gen := co.gen
+		time.AfterFunc(window, func() {
+			co.mu.Lock()
+			defer co.mu.Unlock()
+			if co.gen == gen {
+				_ = c.flushLocked()
+			}
+		})
+	}
+	co.pending = append(co.pending, b...)
+	return len(b), nil
+}
+
+// flushLocked sends the held packets as one datagram; c.coalescer.mu must be held
+func (c *NoizeUDPConn) flushLocked() error {
+	co := &c.coalescer
+	co.gen++
+	if len(co.pending) == 0 {
+		return nil
+	}
+	datagram := co.pending
+	co.pending = nil
+	_, err := c.writeDatagram(datagram, co.addr)
+	return err
+}
+
+// longHeaderDCID reports whether datagram is made only of complete QUIC v1
+// Initial, 0-RTT and Handshake packets sharing a destination connection ID,
+// which is returned
+func longHeaderDCID(datagram []byte) ([]byte, bool) {
+	var dcid []byte
+	for len(datagram) > 0 {
+		b := datagram
+		// Header form and fixed bits, then a version 1 that isn't Retry
+		if len(b) < 7 || b[0]&0xc0 != 0xc0 || binary.BigEndian.Uint32(b[1:5]) != 1 || (b[0]>>4)&0x03 == 0x03 {
+			return nil, false
+		}
+		packetType := (b[0] >> 4) & 0x03
+		b = b[5:]
+
+		dcidLen := int(b[0])
+		if dcidLen > 20 || len(b) < 1+dcidLen+1 {
+			return nil, false
+		}
+		id := b[1 : 1+dcidLen]
+		if dcid != nil && !bytes.Equal(id, dcid) {
+			return nil, false
+		}
+		dcid = id
+		b = b[1+dcidLen:]
+
+		scidLen := int(b[0])
+		if scidLen > 20 || len(b) < 1+scidLen {
+			return nil, false
+		}
+		b = b[1+scidLen:]
+
+		if packetType == 0x00 {
+			tokenLen, n := quicVarint(b)
+			if n == 0 || uint64(len(b)-n) < tokenLen {
+				return nil, false
+			}
+			b = b[n+int(tokenLen):]
+		}
+		length, n := quicVarint(b)
+		if n == 0 || length == 0 || uint64(len(b)-n) < length {
+			return nil, false
+		}
+		datagram = b[n+int(length):]
+	}
+	return dcid, dcid != nil
+}
+
+// isShortHeader reports whether b looks like a 1-RTT packet to dcid
+func isShortHeader(b, dcid []byte) bool {
+	return len(b) > 1+len(dcid) && b[0]&0xc0 == 0x40 && bytes.HasPrefix(b[1:], dcid)
+}
+
+// quicVarint decodes a QUIC variable-length integer, returning its size in
+// bytes or 0 when b is too short
+func quicVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
@@ -0,0 +1,88 @@
+package noize
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshakePacket returns a QUIC v1 Handshake packet to dcid of size bytes
+func handshakePacket(dcid []byte, size int, fill byte) []byte {
+	p := []byte{0xe0, 0, 0, 0, 1, byte(len(dcid))}
+	p = append(p, dcid...)
+	p = append(p, 0)            // Empty source connection ID
+	length := size - len(p) - 2 // After a two-byte Length field
+	p = append(p, 0x40|byte(length>>8), byte(length))
+	return append(p, bytes.Repeat([]byte{fill}, length)...)
+}
+
+func TestLongHeaderDCID(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4}
+	two := append(handshakePacket(dcid, 60, 0xaa), handshakePacket(dcid, 80, 0xbb)...)
+	if got, ok := longHeaderDCID(two); !ok || !bytes.Equal(got, dcid) {
+		t.Errorf("two coalesced packets = %x, %v", got, ok)
+	}
+
+	for name, datagram := range map[string][]byte{
+		"short header":  append([]byte{0x40}, dcid...),
+		"truncated":     handshakePacket(dcid, 60, 0xaa)[:50],
+		"trailing junk": append(handshakePacket(dcid, 60, 0xaa), 0x40, 1),
+		"mixed DCIDs":   append(handshakePacket(dcid, 60, 0xaa), handshakePacket([]byte{9}, 60, 0xbb)...),
+	} {
+		if _, ok := longHeaderDCID(datagram); ok {
+			t.Errorf("%s: held back for coalescing", name)
+		}
+	}
+}
+
+func TestCoalesceSmallWrites(t *testing.T) {
+	const window = 50 * time.Millisecond
+	client, receiver := newLoopbackPair(t)
+	conn := WrapUDPConn(client, &NoizeConfig{CoalesceSize: 1000, CoalesceWindow: window})
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// Three small packets within the window share one datagram
+	var want []byte
+	for i := 0; i < 3; i++ {
+		p := handshakePacket(dcid, 100, byte(i))
+		want = append(want, p...)
+		if n, err := conn.WriteToUDP(p, addr); err != nil || n != len(p) {
+			t.Fatalf("write %d = %d, %v", i, n, err)
+		}
+	}
+	packets := receiveAll(t, receiver, 4*window)
+	if len(packets) != 1 || !bytes.Equal(packets[0], want) {
+		t.Fatalf("got %d datagrams for three small packets, want them coalesced into one", len(packets))
+	}
+
+	// An oversized packet flushes the held one and goes out alone
+	small, big := handshakePacket(dcid, 100, 0xaa), handshakePacket(dcid, 1100, 0xbb)
+	for _, p := range [][]byte{small, big} {
+		if _, err := conn.WriteToUDP(p, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packets = receiveAll(t, receiver, 4*window)
+	if len(packets) != 2 || !bytes.Equal(packets[0], small) || !bytes.Equal(packets[1], big) {
+		t.Fatalf("got %d datagrams for a small and an oversized packet, want each sent alone", len(packets))
+	}
+
+	// A 1-RTT packet may only end a datagram, so it flushes at once
+	short := append(append([]byte{0x40}, dcid...), bytes.Repeat([]byte{0xcc}, 40)...)
+	for _, p := range [][]byte{small, short} {
+		if _, err := conn.WriteToUDP(p, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = receiver.SetReadDeadline(time.Now().Add(window / 2))
+	buf := make([]byte, 2048)
+	n, _, err := receiver.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("1-RTT packet waited for the window: %v", err)
+	}
+	if !bytes.Equal(buf[:n], append(append([]byte(nil), small...), short...)) {
+		t.Fatalf("datagram = %x, want the held packet followed by the 1-RTT one", buf[:n])
+	}
+}
@@ -1,7 +1,6 @@
 package noize
 
 import (
-	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -14,6 +13,8 @@ type NoizeUDPConn struct {
 	mu      sync.RWMutex
 	enabled bool
 	addrMap map[string]*net.UDPAddr
+
+	coalescer coalescer // Packets held for a shared datagram (CoalesceSize)
 }
 
 // WrapUDPConn wraps a UDP connection with noize obfuscation
@@ -32,19 +33,25 @@ func WrapUDPConn(conn *net.UDPConn, config *NoizeConfig) *NoizeUDPConn {
 // WriteToUDP writes obfuscated data to UDP
 func (c *NoizeUDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	if c.noize != nil && c.noize.debugPadding {
-		fmt.Printf("NOIZE_DEBUG: WriteToUDP called - size:%d, enabled:%t, addr:%s\n", len(b), c.enabled, addr.String())
+		c.noize.debugf("WriteToUDP called - size:%d, enabled:%t, addr:%s", len(b), c.enabled, addr.String())
 	}
 
 	if !c.enabled || c.noize == nil {
-		return c.UDPConn.WriteToUDP(b, addr)
+		return c.writeToUDP(b, addr)
+	}
+
+	if c.noize.config.CoalesceSize > 0 && len(b) > 0 {
+		return c.coalesce(b, addr)
 	}
+	return c.writeDatagram(b, addr)
+}
 
+// writeDatagram obfuscates b and sends it as one datagram
+func (c *NoizeUDPConn) writeDatagram(b []byte, addr *net.UDPAddr) (int, error) {
 	// Check if all obfuscation is disabled
 	config := c.noize.config
-	if config.Jc == 0 && config.JcBeforeHS == 0 && config.JcAfterI1 == 0 &&
-		config.JcDuringHS == 0 && config.JcAfterHS == 0 && config.PaddingMax == 0 &&
-		!config.FragmentInitial && config.I1 == "" && config.I2 == "" {
-		return c.UDPConn.WriteToUDP(b, addr)
+	if !config.transformsWrites() {
+		return c.writeToUDP(b, addr)
 	}
 
 	// Obfuscate the packet
@@ -52,45 +59,91 @@ func (c *NoizeUDPConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if config.MaxDatagramSize > 0 && len(obfuscated) > config.MaxDatagramSize && len(b) <= config.MaxDatagramSize {
+		// Padding or wrapping pushed the datagram past the path MTU. Sending b
+		// instead would put it on the wire unobfuscated, so drop it like the
+		// path would and let QUIC retransmit it with fresh padding.
+		c.noize.logger.Debug("dropping datagram grown past the maximum size by obfuscation",
+			"size", len(b), "obfuscated", len(obfuscated), "max", config.MaxDatagramSize)
+		return len(b), nil
+	}
 
 	// Write obfuscated packet
-	return c.UDPConn.WriteToUDP(obfuscated, addr)
+	return c.writeToUDP(obfuscated, addr)
+}
+
+// writeToUDP writes b to the socket as it is, counting it
+func (c *NoizeUDPConn) writeToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, err := c.UDPConn.WriteToUDP(b, addr)
+	c.count(n)
+	return n, err
+}
+
+// write writes b to the connected socket as it is, counting it
+func (c *NoizeUDPConn) write(b []byte) (int, error) {
+	n, err := c.UDPConn.Write(b)
+	c.count(n)
+	return n, err
+}
+
+// count adds n socket bytes to the noize counter
+func (c *NoizeUDPConn) count(n int) {
+	if c.noize != nil {
+		c.noize.count(n)
+	}
+}
+
+// transformsWrites reports whether the configuration changes, delays or adds
+// to the datagrams written through the socket at all
+func (c *NoizeConfig) transformsWrites() bool {
+	return c.Jc > 0 || c.JcBeforeHS > 0 || c.JcAfterI1 > 0 || c.JcDuringHS > 0 || c.JcAfterHS > 0 ||
+		c.I1 != "" || c.I2 != "" || c.I3 != "" || c.I4 != "" || c.I5 != "" ||
+		(c.FragmentInitial && c.FragmentSize > 0) || c.CoalesceSize > 0 ||
+		c.PaddingMin > 0 || c.PaddingMax > 0 || c.MimicProtocol != "" ||
+		(c.SNIFragmentation && c.SNIFragment > 0) || c.HandshakeProfile != "" ||
+		c.HandshakeDelay > 0 || c.PacketDelay > 0 || c.RandomDelay
 }
 
 // WriteTo implements the WriterTo interface (used by QUIC)
 func (c *NoizeUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	if c.noize != nil && c.noize.debugPadding {
-		fmt.Printf("NOIZE_DEBUG: WriteTo called - size:%d, addr:%s, addr_type:%T\n", len(b), addr.String(), addr)
+		c.noize.debugf("WriteTo called - size:%d, addr:%s, addr_type:%T", len(b), addr.String(), addr)
 	}
 
 	udpAddr, ok := addr.(*net.UDPAddr)
 	if !ok {
 		if c.noize != nil && c.noize.debugPadding {
-			fmt.Printf("NOIZE_DEBUG: WriteTo - not UDP addr, falling back to direct write\n")
+			c.noize.debugf("WriteTo - not UDP addr, falling back to direct write")
 		}
-		return c.UDPConn.WriteTo(b, addr)
+		n, err := c.UDPConn.WriteTo(b, addr)
+		c.count(n)
+		return n, err
 	}
 
 	if c.noize != nil && c.noize.debugPadding {
-		fmt.Printf("NOIZE_DEBUG: WriteTo - delegating to WriteToUDP\n")
+		c.noize.debugf("WriteTo - delegating to WriteToUDP")
 	}
 	return c.WriteToUDP(b, udpAddr)
 }
 
 // ReadFrom implements the ReaderFrom interface (used by QUIC)
 func (c *NoizeUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	return c.UDPConn.ReadFrom(b)
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	c.count(n)
+	return n, addr, err
 }
 
 // ReadFromUDP reads from UDP (no de-obfuscation needed)
 func (c *NoizeUDPConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
-	return c.UDPConn.ReadFromUDP(b)
+	n, addr, err := c.UDPConn.ReadFromUDP(b)
+	c.count(n)
+	return n, addr, err
 }
 
 // Write writes obfuscated data (requires prior Connect or stored addr)
 func (c *NoizeUDPConn) Write(b []byte) (int, error) {
 	if !c.enabled || c.noize == nil {
-		return c.UDPConn.Write(b)
+		return c.write(b)
 	}
 
 	// Get remote address - try stored address first for better WiFi compatibility
@@ -110,12 +163,12 @@ func (c *NoizeUDPConn) Write(b []byte) (int, error) {
 	}
 
 	if remoteAddr == nil {
-		return c.UDPConn.Write(b)
+		return c.write(b)
 	}
 
 	udpAddr, ok := remoteAddr.(*net.UDPAddr)
 	if !ok {
-		return c.UDPConn.Write(b)
+		return c.write(b)
 	}
 
 	return c.WriteToUDP(b, udpAddr)
@@ -0,0 +1,96 @@
+package noize
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Handshake shaping for QUIC Initial packets.
+//
+// Besides the SNI, DPI can tell QUIC stacks apart by how their first flight
+// is laid out: the size of the Initial datagrams and of the CRYPTO frames the
+// TLS ClientHello is cut into. shapeInitial decrypts a client Initial,
+// re-encodes its CRYPTO frames in pieces of the profile's size, pads or trims
+// the PADDING so the datagram has the profile's size, rewrites the Length
+// field and re-encrypts the packet with the same packet number.
+
+// HandshakeProfile is the layout of a browser's client Initial datagrams
+type HandshakeProfile struct {
+	DatagramSize int // Size of each Initial datagram, at least the QUIC minimum of 1200
+	CryptoFrame  int // Largest CRYPTO frame the ClientHello is split into (0 = the frames QUIC sent)
+}
+
+// HandshakeProfiles are the profiles NoizeConfig.HandshakeProfile names. The
+// sizes approximate what the browsers' QUIC stacks send to IPv4 servers.
+var HandshakeProfiles = map[string]HandshakeProfile{
+	"chrome":  {DatagramSize: 1250, CryptoFrame: 256},
+	"firefox": {DatagramSize: 1357},
+}
+
+// HandshakeProfileNames returns the names of HandshakeProfiles, sorted
+func HandshakeProfileNames() []string {
+	names := make([]string, 0, len(HandshakeProfiles))
+	for name := range HandshakeProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shapeInitial rewrites a client Initial datagram to the layout of profile.
+// Packets that cannot be safely rewritten, or whose CRYPTO data doesn't fit
+// in the profile's datagram size, are returned unchanged, so QUIC should pack
+// its Initials at the 1200 byte minimum.
+func shapeInitial(datagram []byte, profile HandshakeProfile) []byte {
+	pkt, keys, err := openInitial(datagram)
+	if err != nil {
+		return datagram
+	}
+	frames, ping, err := parseInitialFrames(pkt.plaintext)
+	if err != nil || len(frames) == 0 {
+		return datagram
+	}
+
+	// QUIC may already scatter the ClientHello over frames in any order and
+	// across packets, so each frame is split on its own
+	sort.Slice(frames, func(i, j int) bool { return frames[i].offset < frames[j].offset })
+	var payload []byte
+	if ping {
+		payload = append(payload, quicFramePing)
+	}
+	for _, f := range frames {
+		chunk := profile.CryptoFrame
+		if chunk <= 0 {
+			chunk = len(f.data)
+		}
+		for off := 0; off < len(f.data); off += chunk {
+			end := min(off+chunk, len(f.data))
+			payload = append(payload, quicFrameCrypto)
+			payload = appendVarint(payload, f.offset+uint64(off))
+			payload = appendVarint(payload, uint64(end-off))
+			payload = append(payload, f.data[off:end]...)
+		}
+	}
+
+	// Pad so the datagram, with any packets coalesced after this one, has
+	// the profile's size
+	overhead := len(pkt.header) + keys.aead.Overhead() + len(pkt.rest)
+	pad := profile.DatagramSize - overhead - len(payload)
+	if pad < 0 {
+		return datagram
+	}
+	payload = append(payload, make([]byte, pad)...)
+
+	// quic-go writes the Length as a two-byte varint, which the new length
+	// must fit as well
+	pnLen := int(pkt.header[0]&0x03) + 1
+	lengthField := pkt.header[pkt.lengthOffset : len(pkt.header)-pnLen]
+	length := pnLen + len(payload) + keys.aead.Overhead()
+	if len(lengthField) != 2 || length >= 1<<14 {
+		return datagram
+	}
+	binary.BigEndian.PutUint16(lengthField, 0x4000|uint16(length))
+
+	pkt.plaintext = payload
+	return sealInitial(pkt, keys)
+}
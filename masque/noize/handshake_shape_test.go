@@ -0,0 +1,76 @@
+package noize
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestHandshakeProfileShapesFirstDatagram(t *testing.T) {
+	for name, profile := range HandshakeProfiles {
+		client, receiver := newLoopbackPair(t)
+		conn := NewObfuscator(&NoizeConfig{HandshakeProfile: name}, nil).WrapPacketConn(client)
+
+		// Nothing answers, so the dial only has to get its Initial onto the
+		// wire. Like the MASQUE dial, QUIC packs it at the minimum size.
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		go quic.Dial(ctx, conn, receiver.LocalAddr(), &tls.Config{ServerName: "example.com", NextProtos: []string{"h3"}}, &quic.Config{InitialPacketSize: 1200})
+
+		_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 2048)
+		n, _, err := receiver.ReadFromUDP(buf)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: reading Initial: %v", name, err)
+		}
+		if n != profile.DatagramSize {
+			t.Errorf("%s: first datagram is %d bytes, want %d", name, n, profile.DatagramSize)
+		}
+
+		pkt, _, err := openInitial(buf[:n])
+		if err != nil {
+			t.Fatalf("%s: openInitial: %v", name, err)
+		}
+		frames, _, err := parseInitialFrames(pkt.plaintext)
+		if err != nil {
+			t.Fatalf("%s: parseInitialFrames: %v", name, err)
+		}
+		if profile.CryptoFrame > 0 && len(frames) < 2 {
+			t.Errorf("%s: ClientHello carried in %d CRYPTO frame, want it split", name, len(frames))
+		}
+		for _, f := range frames {
+			if profile.CryptoFrame > 0 && len(f.data) > profile.CryptoFrame {
+				t.Errorf("%s: CRYPTO frame of %d bytes, want at most %d", name, len(f.data), profile.CryptoFrame)
+			}
+		}
+	}
+}
+
+func TestShapeInitialKeepsClientHello(t *testing.T) {
+	hello := captureClientHello(t, "engage.cloudflareclient.com")
+	datagram := buildInitial(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, hello)
+
+	for _, size := range []int{1200, 1400} {
+		shaped := shapeInitial(datagram, HandshakeProfile{DatagramSize: size, CryptoFrame: 100})
+		if len(shaped) != size {
+			t.Errorf("shaped datagram is %d bytes, want %d", len(shaped), size)
+		}
+		pkt, _, err := openInitial(shaped)
+		if err != nil {
+			t.Fatalf("openInitial(shaped): %v", err)
+		}
+		if !bytes.Equal(reassembleCrypto(t, pkt.plaintext), hello) {
+			t.Fatal("reassembled CRYPTO stream does not match the original ClientHello")
+		}
+	}
+
+	// Non-Initial packets are returned unchanged
+	shortHeader := []byte{0x40, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	if got := shapeInitial(shortHeader, HandshakeProfiles["chrome"]); !bytes.Equal(got, shortHeader) {
+		t.Error("short header packet was modified")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	mathrand "math/rand"
 	"net"
 	"os"
@@ -13,7 +14,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/junkbudget"
 )
 
 var rng = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
@@ -32,6 +36,11 @@ type NoizeConfig struct {
 	FragmentInitial bool          `json:"fragment_initial,omitempty"` // Fragment QUIC Initial packets specifically
 	FragmentDelay   time.Duration // Delay between fragments
 
+	// === Datagram Coalescing ===
+	CoalesceSize    int           // Coalesce small consecutive long-header packets into datagrams up to this size (0 = off)
+	CoalesceWindow  time.Duration // How long a coalesced datagram waits for more packets (default 1ms)
+	MaxDatagramSize int           // Drop datagrams that padding and wrapping grow past this size (0 = unlimited)
+
 	// === Padding & Obfuscation ===
 	PaddingMin    int  // Minimum padding bytes per packet
 	PaddingMax    int  // Maximum padding bytes per packet
@@ -49,6 +58,11 @@ type NoizeConfig struct {
 	JcAfterHS    int           // Junk packets after handshake complete
 	JunkInterval time.Duration // Interval between junk packets
 	JunkRandom   bool          // Randomize junk timing
+	MaxJunkPPS   int           // Cap on junk packets per second, smoothing bursts (0 = unlimited)
+
+	// MaxOverheadBytes caps the junk and signature bytes sent before each
+	// handshake; the rest of the sequence is dropped once it is reached (0 = unlimited)
+	MaxOverheadBytes int
 
 	// === Protocol Mimicry ===
 	MimicProtocol string // Protocol to mimic: "dns", "https", "h3", "dtls", "stun"
@@ -56,6 +70,7 @@ type NoizeConfig struct {
 
 	// === Timing Obfuscation ===
 	HandshakeDelay time.Duration // Delay before actual QUIC handshake
+	SyncPreflight  bool          // Finish the pre-handshake sequence before the first packet, like WireGuard
 	PacketDelay    time.Duration // Delay between packets
 	RandomDelay    bool          // Randomize packet delays
 	DelayMin       time.Duration // Minimum random delay
@@ -66,9 +81,13 @@ type NoizeConfig struct {
 	SNIFragment      int      // SNI fragment size
 	FakeALPN         []string // Fake ALPN protocols to advertise
 
+	// === Handshake Shaping ===
+	HandshakeProfile string // Lay out the Initial datagrams like a browser: "chrome", "firefox" (empty = as QUIC sends them)
+
 	// === Advanced Features ===
-	ReversedOrder    bool // Send packets in reversed order
-	DuplicatePackets bool // Duplicate certain packets
+	ReversedOrder    bool // Send the I1-I5 signature sequence in reversed order
+	DuplicatePackets bool // Duplicate junk and signature packets
+	DuplicateCount   int  // Extra copies of each duplicated packet (default 1)
 	AllowZeroSize    bool // Allow zero-size junk packets
 
 	// === Anti-Replay ===
@@ -88,7 +107,10 @@ type Noize struct {
 	lastSent     map[string]time.Time
 	hsState      map[string]*handshakeState
 	seqNum       uint32
-	debugPadding bool // Debug flag for padding operations
+	debugPadding bool                // Debug flag for padding operations
+	junkLimiter  *junkbudget.Limiter // Paces junk to MaxJunkPPS (nil = unlimited)
+	logger       *slog.Logger
+	wire         *atomic.Int64 // Counts the bytes written and read on the socket (nil = not counted)
 }
 
 type handshakeState struct {
@@ -103,11 +125,14 @@ func New(config *NoizeConfig) *Noize {
 	if config == nil {
 		config = DefaultConfig()
 	}
-	return &Noize{
-		config:   config,
-		lastSent: make(map[string]time.Time),
-		hsState:  make(map[string]*handshakeState),
+	n := &Noize{
+		config:      config,
+		lastSent:    make(map[string]time.Time),
+		hsState:     make(map[string]*handshakeState),
+		junkLimiter: junkbudget.NewLimiter(config.MaxJunkPPS),
+		logger:      slog.New(slog.DiscardHandler),
 	}
+	return n
 }
 
 // DefaultConfig returns default obfuscation configuration
@@ -173,16 +198,21 @@ func (n *Noize) DisableDebugPadding() {
 	n.debugPadding = false
 }
 
+// debugf logs a debug message enabled by EnableDebugPadding
+func (n *Noize) debugf(format string, args ...any) {
+	n.logger.Debug(fmt.Sprintf(format, args...))
+}
+
 // ObfuscateWrite obfuscates outgoing QUIC packets
 func (n *Noize) ObfuscateWrite(packet []byte, addr *net.UDPAddr) ([]byte, error) {
 	// ALWAYS log this to see if it's being called
 	if n.debugPadding {
-		fmt.Printf("NOIZE_DEBUG: ObfuscateWrite called - size:%d, addr:%s\n", len(packet), addr.String())
+		n.debugf("ObfuscateWrite called - size:%d, addr:%s", len(packet), addr.String())
 	}
 
 	if len(packet) == 0 {
 		if n.debugPadding {
-			fmt.Printf("NOIZE_DEBUG: Empty packet, returning as-is\n")
+			n.debugf("Empty packet, returning as-is")
 		}
 		return packet, nil
 	}
@@ -207,7 +237,7 @@ func (n *Noize) ObfuscateWrite(packet []byte, addr *net.UDPAddr) ([]byte, error)
 		default:
 			packetTypeStr = "Unknown"
 		}
-		fmt.Printf("NOIZE_DEBUG: ObfuscateWrite called - packet type: %s, size: %d bytes, addr: %s\n", packetTypeStr, len(packet), addr.String())
+		n.debugf("ObfuscateWrite called - packet type: %s, size: %d bytes, addr: %s", packetTypeStr, len(packet), addr.String())
 	}
 
 	addrKey := addr.String()
@@ -228,16 +258,33 @@ func (n *Noize) ObfuscateWrite(packet []byte, addr *net.UDPAddr) ([]byte, error)
 	// Execute pre-handshake obfuscation sequence for first packet
 	if isFirstPacket {
 		if n.debugPadding {
-			fmt.Printf("NOIZE_DEBUG: First packet detected, executing pre-handshake sequence\n")
+			n.debugf("First packet detected, executing pre-handshake sequence")
 		}
 
-		// Execute pre-handshake obfuscation sequence asynchronously
-		// This allows the first packet to proceed while junk packets are sent
-		go n.executePreHandshake(addr)
+		if n.config.SyncPreflight {
+			// Send the sequence from this socket before the Initial goes out,
+			// with limiter waits taken out of the handshake delay
+			budget := n.config.HandshakeDelay
+			n.executePreHandshake(addr, &budget)
+			if budget > 0 {
+				time.Sleep(budget)
+			}
+		} else {
+			// Execute pre-handshake obfuscation sequence asynchronously
+			// This allows the first packet to proceed while junk packets are sent
+			go n.executePreHandshake(addr, nil)
+		}
 	}
 
 	// Handle Initial packets specially (in addition to first packet logic above)
 	if packetType == QUICInitial {
+		// Shape first, SNI fragmentation then re-splits the frames within the shaped size
+		if profile, ok := HandshakeProfiles[n.config.HandshakeProfile]; ok {
+			packet = shapeInitial(packet, profile)
+		}
+		if n.config.SNIFragmentation && n.config.SNIFragment > 0 {
+			packet = fragmentInitialSNI(packet, n.config.SNIFragment)
+		}
 		if n.config.FragmentInitial && n.config.FragmentSize > 0 && len(packet) > n.config.FragmentSize {
 			return n.fragmentInitialPacket(packet, addr), nil
 		}
@@ -271,76 +318,83 @@ func (n *Noize) ObfuscateWrite(packet []byte, addr *net.UDPAddr) ([]byte, error)
 	return packet, nil
 }
 
-// executePreHandshake sends signature and junk packets before handshake
-func (n *Noize) executePreHandshake(addr *net.UDPAddr) {
+// executePreHandshake sends signature and junk packets before handshake. A
+// non-nil budget bounds how long junk may wait for the MaxJunkPPS limiter.
+func (n *Noize) executePreHandshake(addr *net.UDPAddr, budget *time.Duration) {
 	if n.conn == nil {
 		if n.debugPadding {
-			fmt.Printf("NOIZE_DEBUG: executePreHandshake called but n.conn is nil\n")
+			n.debugf("executePreHandshake called but n.conn is nil")
 		}
 		return
 	}
 
 	if n.debugPadding {
-		fmt.Printf("NOIZE_DEBUG: executePreHandshake started for %s\n", addr.String())
+		n.debugf("executePreHandshake started for %s", addr.String())
 	}
 
 	if n.debugPadding {
-		fmt.Printf("NOIZE_DEBUG: executePreHandshake called for %s, JcBeforeHS=%d, I1='%s'\n",
+		n.debugf("executePreHandshake called for %s, JcBeforeHS=%d, I1='%s'",
 			addr.String(), n.config.JcBeforeHS, n.config.I1)
 	}
 
-	if n.config.JcBeforeHS > 0 {
-		for i := 0; i < n.config.JcBeforeHS; i++ {
-			junk := n.generateJunkPacket()
-			if len(junk) > 0 {
-				n.conn.WriteToUDP(junk, addr)
-			}
-			n.applyJunkDelay()
-		}
-	}
+	ov := junkbudget.NewOverheadCap(n.config.MaxOverheadBytes, n.logger)
 
-	// Send I1 signature packet
-	if n.config.I1 != "" {
-		i1Packet, err := parseCPSPacket(n.config.I1)
-		if err == nil && len(i1Packet) > 0 {
-			n.conn.WriteToUDP(i1Packet, addr)
-			time.Sleep(2 * time.Millisecond)
+	// Same order as the WireGuard preflight: the leading signature (I1, or I5
+	// reversed) with its after-I1 junk, the before-handshake junk, then the
+	// rest of the signatures
+	order := []int{0, 1, 2, 3, 4}
+	if n.config.ReversedOrder {
+		order = []int{4, 3, 2, 1, 0}
+	}
+	n.sendSignature(order[0], addr, budget, ov)
+	for i := 0; i < n.config.JcBeforeHS; i++ {
+		junk := n.generateJunkPacket()
+		if len(junk) > 0 {
+			n.writeJunk(junk, addr, budget, ov)
 		}
+		n.applyJunkDelay()
+	}
+	for _, idx := range order[1:] {
+		n.sendSignature(idx, addr, budget, ov)
 	}
 
-	if n.config.JcAfterI1 > 0 {
-		for i := 0; i < n.config.JcAfterI1; i++ {
+	if n.config.JcDuringHS > 0 {
+		for i := 0; i < n.config.JcDuringHS; i++ {
 			junk := n.generateJunkPacket()
 			if len(junk) > 0 {
-				n.conn.WriteToUDP(junk, addr)
+				n.writeJunk(junk, addr, budget, ov)
 			}
 			n.applyJunkDelay()
 		}
 	}
 
-	// Send I2-I5 signature packets
-	signatures := []string{n.config.I2, n.config.I3, n.config.I4, n.config.I5}
-	for _, sig := range signatures {
-		if sig == "" {
-			continue
-		}
-		packet, err := parseCPSPacket(sig)
+}
+
+// sendSignature sends signature packet I<idx+1> if it is configured,
+// followed by the after-I1 junk for I1
+func (n *Noize) sendSignature(idx int, addr *net.UDPAddr, budget *time.Duration, ov *junkbudget.OverheadCap) {
+	signature := [...]string{n.config.I1, n.config.I2, n.config.I3, n.config.I4, n.config.I5}[idx]
+	if signature != "" {
+		packet, err := parseCPSPacket(signature)
 		if err == nil && len(packet) > 0 {
-			n.conn.WriteToUDP(packet, addr)
-			time.Sleep(1 * time.Millisecond)
+			n.writeSignature(packet, addr, ov)
+			if idx == 0 {
+				time.Sleep(2 * time.Millisecond)
+			} else {
+				time.Sleep(1 * time.Millisecond)
+			}
 		}
 	}
 
-	if n.config.JcDuringHS > 0 {
-		for i := 0; i < n.config.JcDuringHS; i++ {
+	if idx == 0 {
+		for i := 0; i < n.config.JcAfterI1; i++ {
 			junk := n.generateJunkPacket()
 			if len(junk) > 0 {
-				n.conn.WriteToUDP(junk, addr)
+				n.writeJunk(junk, addr, budget, ov)
 			}
 			n.applyJunkDelay()
 		}
 	}
-
 }
 
 func (n *Noize) executePostHandshake(addr *net.UDPAddr) {
@@ -353,7 +407,7 @@ func (n *Noize) executePostHandshake(addr *net.UDPAddr) {
 	if n.config.JcAfterHS > 0 {
 		for i := 0; i < n.config.JcAfterHS; i++ {
 			junk := n.generateJunkPacket()
-			n.conn.WriteToUDP(junk, addr)
+			n.writeJunk(junk, addr, nil, nil)
 			n.applyJunkDelay()
 		}
 	}
@@ -375,7 +429,7 @@ func (n *Noize) fragmentInitialPacket(packet []byte, addr *net.UDPAddr) []byte {
 				}
 
 				fragment := packet[offset:end]
-				n.conn.WriteToUDP(fragment, addr)
+				n.writeToUDP(fragment, addr)
 
 				if n.config.FragmentDelay > 0 {
 					time.Sleep(n.config.FragmentDelay)
@@ -407,7 +461,7 @@ func (n *Noize) fragmentPacket(packet []byte, addr *net.UDPAddr) []byte {
 				}
 
 				fragment := packet[offset:end]
-				n.conn.WriteToUDP(fragment, addr)
+				n.writeToUDP(fragment, addr)
 
 				if n.config.FragmentDelay > 0 {
 					time.Sleep(n.config.FragmentDelay)
@@ -502,6 +556,65 @@ func (n *Noize) generateJunkPacket() []byte {
 	return junk
 }
 
+// writeToUDP writes a packet noize adds, such as junk or a signature, to the
+// socket and counts it
+func (n *Noize) writeToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	written, err := n.conn.WriteToUDP(b, addr)
+	n.count(written)
+	return written, err
+}
+
+// count adds written socket bytes to the wire counter, if there is one
+func (n *Noize) count(written int) {
+	if n.wire != nil {
+		n.wire.Add(int64(written))
+	}
+}
+
+// writeJunk sends a junk packet, plus duplicates if enabled, unless FakeLoss
+// drops it. Only junk goes through here, so handshake and data packets are
+// never lost.
+func (n *Noize) writeJunk(junk []byte, addr *net.UDPAddr, budget *time.Duration, ov *junkbudget.OverheadCap) {
+	for i := 0; i <= n.duplicateCount(); i++ {
+		if n.dropJunk() || !ov.Fits(len(junk)) || !n.junkLimiter.Wait(budget) {
+			continue
+		}
+		if _, err := n.writeToUDP(junk, addr); err == nil {
+			ov.Sent(len(junk))
+		}
+	}
+}
+
+// writeSignature sends a signature packet, plus duplicates if enabled
+func (n *Noize) writeSignature(packet []byte, addr *net.UDPAddr, ov *junkbudget.OverheadCap) {
+	for i := 0; i <= n.duplicateCount(); i++ {
+		if !ov.Fits(len(packet)) {
+			return
+		}
+		if _, err := n.writeToUDP(packet, addr); err == nil {
+			ov.Sent(len(packet))
+		}
+	}
+}
+
+// duplicateCount returns how many extra copies of junk and signature packets
+// to send
+func (n *Noize) duplicateCount() int {
+	if !n.config.DuplicatePackets {
+		return 0
+	}
+	if n.config.DuplicateCount <= 0 {
+		return 1
+	}
+	return n.config.DuplicateCount
+}
+
+// dropJunk reports whether the next junk packet should be dropped to mimic a
+// lossy UDP flow, with probability FakeLoss
+func (n *Noize) dropJunk() bool {
+	return n.config.FakeLoss > 0 && mathrand.Float32() < n.config.FakeLoss
+}
+
 // applyDelay applies configured delay
 func (n *Noize) applyDelay() {
 	if n.config.RandomDelay {
@@ -820,11 +933,15 @@ func (c *NoizeConfig) SaveConfigToFile(filepath string) error {
 		"JcDuringHS":       c.JcDuringHS,
 		"JcAfterHS":        c.JcAfterHS,
 		"JunkRandom":       c.JunkRandom,
+		"MaxJunkPPS":       c.MaxJunkPPS,
+		"MaxOverheadBytes": c.MaxOverheadBytes,
 		"MimicProtocol":    c.MimicProtocol,
 		"CustomWrapper":    c.CustomWrapper,
 		"RandomDelay":      c.RandomDelay,
+		"SyncPreflight":    c.SyncPreflight,
 		"ReversedOrder":    c.ReversedOrder,
 		"DuplicatePackets": c.DuplicatePackets,
+		"DuplicateCount":   c.DuplicateCount,
 		"AllowZeroSize":    c.AllowZeroSize,
 		"UseTimestamp":     c.UseTimestamp,
 		"UseNonce":         c.UseNonce,
@@ -832,6 +949,7 @@ func (c *NoizeConfig) SaveConfigToFile(filepath string) error {
 		"FakeLoss":         c.FakeLoss,
 		"SNIFragmentation": c.SNIFragmentation,
 		"SNIFragment":      c.SNIFragment,
+		"HandshakeProfile": c.HandshakeProfile,
 	}
 
 	// Add duration fields as strings (include zero values too)
@@ -0,0 +1,335 @@
+package noize
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// newLoopbackPair returns a client UDP socket and a receiving socket on loopback
+func newLoopbackPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	_ = receiver.SetReadBuffer(4 << 20)
+	t.Cleanup(func() { receiver.Close() })
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, receiver
+}
+
+// receiveAll reads packets until the socket has been idle for the given duration
+func receiveAll(t *testing.T, conn *net.UDPConn, idle time.Duration) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	buf := make([]byte, 2048)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idle))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, append([]byte(nil), buf[:n]...))
+	}
+}
+
+func TestFakeLossOnlyDropsJunk(t *testing.T) {
+	const (
+		junkCount = 400
+		junkSize  = 50
+		realCount = 20
+	)
+
+	client, receiver := newLoopbackPair(t)
+	conn := WrapUDPConn(client, &NoizeConfig{
+		JcBeforeHS: junkCount,
+		Jmin:       junkSize,
+		Jmax:       junkSize,
+		FakeLoss:   0.5,
+	})
+
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	real := bytes.Repeat([]byte{0xAB}, 20)
+	for i := 0; i < realCount; i++ {
+		if _, err := conn.WriteToUDP(real, addr); err != nil {
+			t.Fatalf("WriteToUDP: %v", err)
+		}
+	}
+
+	var junk, delivered int
+	for _, pkt := range receiveAll(t, receiver, 500*time.Millisecond) {
+		switch {
+		case bytes.Equal(pkt, real):
+			delivered++
+		case len(pkt) == junkSize:
+			junk++
+		}
+	}
+
+	if delivered != realCount {
+		t.Errorf("delivered %d real packets, want %d", delivered, realCount)
+	}
+	// Expect roughly half the junk to be dropped
+	if junk < junkCount*3/10 || junk > junkCount*7/10 {
+		t.Errorf("received %d of %d junk packets, want roughly half", junk, junkCount)
+	}
+}
+
+// signatureSequence sends one real packet and returns the received one-byte
+// signature packets in arrival order
+func signatureSequence(t *testing.T, config *NoizeConfig) []byte {
+	t.Helper()
+	client, receiver := newLoopbackPair(t)
+	conn := WrapUDPConn(client, config)
+
+	real := bytes.Repeat([]byte{0xAB}, 20)
+	if _, err := conn.WriteToUDP(real, receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	var seq []byte
+	for _, pkt := range receiveAll(t, receiver, 300*time.Millisecond) {
+		if len(pkt) == 1 {
+			seq = append(seq, pkt[0])
+		}
+	}
+	return seq
+}
+
+func signatureConfig() *NoizeConfig {
+	return &NoizeConfig{
+		I1: "<b 01>",
+		I2: "<b 02>",
+		I3: "<b 03>",
+		I4: "<b 04>",
+		I5: "<b 05>",
+	}
+}
+
+func TestSignatureOrder(t *testing.T) {
+	if got := signatureSequence(t, signatureConfig()); !bytes.Equal(got, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("signature order = %v, want [1 2 3 4 5]", got)
+	}
+
+	config := signatureConfig()
+	config.ReversedOrder = true
+	if got := signatureSequence(t, config); !bytes.Equal(got, []byte{5, 4, 3, 2, 1}) {
+		t.Errorf("reversed signature order = %v, want [5 4 3 2 1]", got)
+	}
+}
+
+func TestDuplicatePackets(t *testing.T) {
+	config := signatureConfig()
+	config.DuplicatePackets = true
+	config.DuplicateCount = 2
+	want := []byte{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4, 5, 5, 5}
+	if got := signatureSequence(t, config); !bytes.Equal(got, want) {
+		t.Errorf("signature sequence = %v, want %v", got, want)
+	}
+
+	// Junk packets are duplicated too
+	client, receiver := newLoopbackPair(t)
+	conn := WrapUDPConn(client, &NoizeConfig{
+		JcBeforeHS:       3,
+		Jmin:             50,
+		Jmax:             50,
+		DuplicatePackets: true,
+	})
+	if _, err := conn.WriteToUDP([]byte("real payload"), receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	var junk [][]byte
+	for _, pkt := range receiveAll(t, receiver, 300*time.Millisecond) {
+		if len(pkt) == 50 {
+			junk = append(junk, pkt)
+		}
+	}
+	if len(junk) != 6 {
+		t.Fatalf("received %d junk packets, want 6", len(junk))
+	}
+	for i := 0; i < len(junk); i += 2 {
+		if !bytes.Equal(junk[i], junk[i+1]) {
+			t.Errorf("junk packet %d was not duplicated", i/2)
+		}
+	}
+}
+
+func TestMaxDatagramSizeDropsOversized(t *testing.T) {
+	client, receiver := newLoopbackPair(t)
+	conn := WrapUDPConn(client, &NoizeConfig{PaddingMax: 100, MaxDatagramSize: 120})
+
+	// Padding grows the packet to 150 bytes, which must not go out padded or bare
+	packet := bytes.Repeat([]byte{0xAB}, 50)
+	if n, err := conn.WriteToUDP(packet, receiver.LocalAddr().(*net.UDPAddr)); err != nil || n != len(packet) {
+		t.Fatalf("WriteToUDP = %d, %v, want the packet reported written", n, err)
+	}
+	if got := receiveAll(t, receiver, 200*time.Millisecond); len(got) != 0 {
+		t.Errorf("received %d datagrams of %d bytes, want the oversized one dropped", len(got), len(got[0]))
+	}
+}
+
+func TestMaxJunkPPS(t *testing.T) {
+	const (
+		pps       = 50
+		junkCount = 10
+		junkSize  = 50
+	)
+
+	client, receiver := newLoopbackPair(t)
+	conn := WrapUDPConn(client, &NoizeConfig{
+		Jc:         junkCount,
+		JcBeforeHS: junkCount,
+		Jmin:       junkSize,
+		Jmax:       junkSize,
+		MaxJunkPPS: pps,
+	})
+
+	// The real packet goes out without waiting for the paced junk
+	start := time.Now()
+	if _, err := conn.WriteToUDP([]byte("real payload"), receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("real packet held for %v", elapsed)
+	}
+
+	var arrivals []time.Time
+	buf := make([]byte, 2048)
+	for {
+		_ = receiver.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, _, err := receiver.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if n == junkSize {
+			arrivals = append(arrivals, time.Now())
+		}
+	}
+
+	if len(arrivals) != junkCount {
+		t.Fatalf("received %d junk packets, want %d", len(arrivals), junkCount)
+	}
+	span := arrivals[len(arrivals)-1].Sub(arrivals[0])
+	if rate := float64(len(arrivals)-1) / span.Seconds(); rate > pps*1.1 {
+		t.Errorf("junk rate %.0f pps exceeds %d", rate, pps)
+	}
+}
+
+func TestSyncPreflightPrecedesInitial(t *testing.T) {
+	const junkSize = 50
+
+	client, receiver := newLoopbackPair(t)
+	config := signatureConfig()
+	config.JcBeforeHS = 2
+	config.Jmin = junkSize
+	config.Jmax = junkSize
+	config.SyncPreflight = true
+	conn := WrapUDPConn(client, config)
+
+	// Long header, type Initial, QUIC v1
+	initial := append([]byte{0xc0, 0x00, 0x00, 0x00, 0x01}, bytes.Repeat([]byte{0xAB}, 40)...)
+	if _, err := conn.WriteToUDP(initial, receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	packets := receiveAll(t, receiver, 300*time.Millisecond)
+	if len(packets) != 8 {
+		t.Fatalf("received %d packets, want 8", len(packets))
+	}
+	// I1, the junk, then I2-I5, as the WireGuard preflight sends them
+	if !bytes.Equal(packets[0], []byte{1}) {
+		t.Errorf("packet 0 = %x, want signature I1", packets[0])
+	}
+	for i, pkt := range packets[1:3] {
+		if len(pkt) != junkSize {
+			t.Errorf("packet %d is %d bytes, want junk", i+1, len(pkt))
+		}
+	}
+	for i, pkt := range packets[3:7] {
+		if !bytes.Equal(pkt, []byte{byte(i + 2)}) {
+			t.Errorf("packet %d = %x, want signature I%d", i+3, pkt, i+2)
+		}
+	}
+	if !bytes.Equal(packets[7], initial) {
+		t.Errorf("last packet = %x, want the QUIC Initial", packets[7])
+	}
+}
+
+func TestMaxOverheadBytes(t *testing.T) {
+	const limit = 120
+
+	client, receiver := newLoopbackPair(t)
+	config := signatureConfig()
+	config.JcBeforeHS = 10
+	config.Jmin = 50
+	config.Jmax = 50
+	config.MaxOverheadBytes = limit
+	conn := WrapUDPConn(client, config)
+
+	real := bytes.Repeat([]byte{0xAB}, 20)
+	if _, err := conn.WriteToUDP(real, receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	var overhead, junk, signatures int
+	for _, pkt := range receiveAll(t, receiver, 300*time.Millisecond) {
+		if bytes.Equal(pkt, real) {
+			continue
+		}
+		overhead += len(pkt)
+		switch len(pkt) {
+		case 50:
+			junk++
+		case 1:
+			signatures++
+		}
+	}
+	if overhead > limit {
+		t.Errorf("sent %d overhead bytes, cap is %d", overhead, limit)
+	}
+	// I1 and two junk packets fit; the third hits the cap and I2-I5 after it are dropped
+	if junk != 2 || signatures != 1 {
+		t.Errorf("sent %d junk and %d signature packets, want 2 and 1", junk, signatures)
+	}
+}
+
+func TestMaxOverheadBytesSkippedJunk(t *testing.T) {
+	const limit = 120
+
+	client, receiver := newLoopbackPair(t)
+	config := signatureConfig()
+	config.JcBeforeHS = 5
+	config.Jmin = 50
+	config.Jmax = 50
+	config.MaxJunkPPS = 1
+	config.SyncPreflight = true // No handshake delay, so junk the limiter holds back is skipped
+	config.MaxOverheadBytes = limit
+	conn := WrapUDPConn(client, config)
+
+	real := bytes.Repeat([]byte{0xAB}, 20)
+	if _, err := conn.WriteToUDP(real, receiver.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	var junk, signatures int
+	for _, pkt := range receiveAll(t, receiver, 300*time.Millisecond) {
+		switch len(pkt) {
+		case 50:
+			junk++
+		case 1:
+			signatures++
+		}
+	}
+	// Only the first junk packet is sent, and the skipped ones leave room for the signatures
+	if junk != 1 || signatures != 5 {
+		t.Errorf("sent %d junk and %d signature packets, want 1 and 5", junk, signatures)
+	}
+}
@@ -0,0 +1,98 @@
+package noize
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// Obfuscator applies a NoizeConfig to a MASQUE QUIC socket. It implements
+// masque.Obfuscator.
+type Obfuscator struct {
+	config *NoizeConfig
+	logger *slog.Logger
+	wire   atomic.Int64
+}
+
+// NewObfuscator returns an Obfuscator for config that logs to logger, or
+// nowhere if logger is nil
+func NewObfuscator(config *NoizeConfig, logger *slog.Logger) *Obfuscator {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	return &Obfuscator{config: config, logger: logger}
+}
+
+// WireBytes returns the bytes written and read on the sockets the obfuscator
+// wrapped, including the junk and signature packets it added
+func (o *Obfuscator) WireBytes() int64 {
+	return o.wire.Load()
+}
+
+// Config returns the noize configuration the obfuscator applies
+func (o *Obfuscator) Config() *NoizeConfig {
+	return o.config
+}
+
+// ConfigureTLS returns the TLS configuration to dial with. SNI fragmentation
+// needs the whole ClientHello in the first Initial with padding to spare, but
+// the X25519MLKEM768 key share Go offers by default spreads it over two full
+// Initials, so the key exchange is pinned to X25519 while it is enabled.
+func (o *Obfuscator) ConfigureTLS(conf *tls.Config) *tls.Config {
+	if !o.config.SNIFragmentation || o.config.SNIFragment <= 0 {
+		return conf
+	}
+	conf = conf.Clone()
+	conf.CurvePreferences = []tls.CurveID{tls.X25519}
+	return conf
+}
+
+// WrapPacketConn wraps conn in a NoizeUDPConn. Sockets other than
+// *net.UDPConn, and every socket when the configuration leaves writes alone,
+// are returned unchanged.
+//
+// The wrapped socket hides the UDPConn methods QUIC writes through, so the
+// connection loses GSO and ECN for its whole lifetime, even after
+// DisableObfuscation: quic-go picks its write path once, when it dials.
+func (o *Obfuscator) WrapPacketConn(conn net.PacketConn) net.PacketConn {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok || !o.config.transformsWrites() {
+		return conn
+	}
+	wrapped := WrapUDPConn(udpConn, o.config)
+	wrapped.noize.logger = o.logger
+	wrapped.noize.wire = &o.wire
+	// Enable debug logging only if explicitly requested via environment
+	if os.Getenv("VWARP_NOIZE_DEBUG") == "1" {
+		wrapped.EnableDebugPadding()
+	}
+	return &quicSocket{PacketConn: wrapped, conn: wrapped}
+}
+
+// quicSocket hands a NoizeUDPConn to QUIC without its ReadMsgUDP and
+// WriteMsgUDP: quic-go writes through WriteMsgUDP on sockets that have it,
+// which would skip the obfuscation in WriteTo, and batches datagrams with
+// GSO that noize could no longer tell apart. The buffer methods quic-go
+// sizes the socket with are kept.
+type quicSocket struct {
+	net.PacketConn
+	conn *NoizeUDPConn
+}
+
+func (s *quicSocket) SetReadBuffer(bytes int) error  { return s.conn.SetReadBuffer(bytes) }
+func (s *quicSocket) SetWriteBuffer(bytes int) error { return s.conn.SetWriteBuffer(bytes) }
+
+func (s *quicSocket) SyscallConn() (syscall.RawConn, error) { return s.conn.SyscallConn() }
+
+// DisableObfuscation stops obfuscating once the tunnel is established
+func (s *quicSocket) DisableObfuscation() { s.conn.DisableObfuscation() }
+
+// PreHandshake sends nothing: the wrapped socket sends the pre-handshake junk
+// and signature sequence ahead of the QUIC Initial, and a trigger datagram
+// of its own would go out in the clear on an unwrapped socket
+func (o *Obfuscator) PreHandshake(send func([]byte) error) error {
+	return nil
+}
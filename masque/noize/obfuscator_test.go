@@ -0,0 +1,162 @@
+package noize
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// recordingConn keeps a copy of every datagram a QUIC server reads
+type recordingConn struct {
+	net.PacketConn
+	mu        sync.Mutex
+	datagrams [][]byte
+}
+
+func (c *recordingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.mu.Lock()
+		c.datagrams = append(c.datagrams, append([]byte(nil), b[:n]...))
+		c.mu.Unlock()
+	}
+	return n, addr, err
+}
+
+func (c *recordingConn) received() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.datagrams
+}
+
+// serveTestQUIC accepts QUIC connections on a loopback port, recording the
+// datagrams it reads
+func serveTestQUIC(t *testing.T) (*net.UDPAddr, *recordingConn) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	conn := &recordingConn{PacketConn: udpConn}
+	ln, err := quic.Listen(conn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h3"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("quic.Listen: %v", err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		udpConn.Close()
+	})
+	go func() {
+		for {
+			if _, err := ln.Accept(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+	return udpConn.LocalAddr().(*net.UDPAddr), conn
+}
+
+func TestObfuscatorAppliesToRealDial(t *testing.T) {
+	addr, server := serveTestQUIC(t)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer client.Close()
+
+	// quic-go writes through WriteMsgUDP when the socket has it, which
+	// would send the Initial without the signature ahead of it
+	signature := []byte("vwarp-noize-signature")
+	obfuscator := NewObfuscator(&NoizeConfig{I1: "<b 76776172702d6e6f697a652d7369676e6174757265>", SyncPreflight: true}, nil)
+	conn := obfuscator.WrapPacketConn(client)
+	if conn == net.PacketConn(client) {
+		t.Fatal("socket left unwrapped with a signature configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qconn, err := quic.Dial(ctx, conn, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3"}}, nil)
+	if err != nil {
+		t.Fatalf("handshake through the obfuscated socket: %v", err)
+	}
+	qconn.CloseWithError(0, "")
+
+	datagrams := server.received()
+	if len(datagrams) == 0 {
+		t.Fatal("server received nothing")
+	}
+	if !bytes.Equal(datagrams[0], signature) {
+		t.Fatalf("server's first datagram is %d bytes starting %x, want the I1 signature %q", len(datagrams[0]), datagrams[0][:min(8, len(datagrams[0]))], signature)
+	}
+}
+
+func TestObfuscatorLeavesPlainConfigUnwrapped(t *testing.T) {
+	client, _ := newLoopbackPair(t)
+	// Without any transformation the socket keeps quic-go's GSO and ECN path
+	if conn := NewObfuscator(NoObfuscationConfig(), nil).WrapPacketConn(client); conn != net.PacketConn(client) {
+		t.Fatalf("plain configuration wrapped the socket in %T", conn)
+	}
+}
+
+func TestObfuscatorPreHandshakeSendsNothing(t *testing.T) {
+	for _, config := range []*NoizeConfig{NoObfuscationConfig(), {I1: "<b 0x01>", SyncPreflight: true}} {
+		err := NewObfuscator(config, nil).PreHandshake(func(b []byte) error {
+			t.Errorf("PreHandshake sent %q", b)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("PreHandshake: %v", err)
+		}
+	}
+}
+
+func TestObfuscatorCountsWireBytes(t *testing.T) {
+	client, receiver := newLoopbackPair(t)
+	obfuscator := NewObfuscator(&NoizeConfig{JcBeforeHS: 2, Jmin: 50, Jmax: 50, SyncPreflight: true}, nil)
+	conn := obfuscator.WrapPacketConn(client)
+
+	real := bytes.Repeat([]byte{0xAB}, 20)
+	if _, err := conn.WriteTo(real, receiver.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if _, err := receiver.WriteToUDP([]byte("reply"), client.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, 100)); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+
+	// Two junk packets, the real packet and the reply
+	if got, want := obfuscator.WireBytes(), int64(2*50+len(real)+len("reply")); got != want {
+		t.Errorf("WireBytes = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,439 @@
+package noize
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// SNI fragmentation for QUIC Initial packets.
+//
+// The client Initial packet is only protected with keys derived from its
+// Destination Connection ID, so any middlebox can decrypt it and read the SNI
+// from the ClientHello carried in its CRYPTO frames. fragmentInitialSNI
+// decrypts the packet, re-encodes the CRYPTO data so the server_name is split
+// into SNIFragment-sized CRYPTO frames emitted in reverse offset order, takes
+// the extra frame overhead out of the PADDING, and re-encrypts the packet with
+// the same packet number. The peer reassembles CRYPTO data by offset, so the
+// handshake is unchanged while the hostname never appears contiguously.
+//
+// Only a ClientHello that fits in the first Initial is fragmented; a
+// post-quantum key share makes it span several, and Obfuscator.ConfigureTLS
+// pins the key exchange to X25519 to avoid that.
+
+// quicV1InitialSalt is the Initial salt for QUIC version 1 (RFC 9001, 5.2)
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+const (
+	quicVersion1     = 0x00000001
+	quicFramePadding = 0x00
+	quicFramePing    = 0x01
+	quicFrameCrypto  = 0x06
+)
+
+var errNotFragmentable = errors.New("packet cannot be SNI fragmented")
+
+// initialKeys holds the client Initial packet protection keys
+type initialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from TLS 1.3 with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// newClientInitialKeys derives the client Initial keys for a destination connection ID
+func newClientInitialKeys(dcid []byte) (*initialKeys, error) {
+	initialSecret, err := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdfExpandLabel(clientSecret, "quic key", 16)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdfExpandLabel(clientSecret, "quic iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	hpKey, err := hkdfExpandLabel(clientSecret, "quic hp", 16)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	return &initialKeys{aead: aead, iv: iv, hp: hp}, nil
+}
+
+func (k *initialKeys) nonce(pn uint64) []byte {
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// headerMask returns the header protection mask for a ciphertext sample
+func (k *initialKeys) headerMask(sample []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+	return mask
+}
+
+// readVarint decodes a QUIC variable-length integer
+func readVarint(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	length := 1 << (b[0] >> 6)
+	if len(b) < length {
+		return 0, 0, false
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, length, true
+}
+
+// appendVarint encodes a QUIC variable-length integer
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// initialPacket is a decrypted client Initial packet
+type initialPacket struct {
+	header       []byte // unprotected header including the packet number
+	lengthOffset int    // offset of the Length field in header
+	pn           uint64
+	plaintext    []byte
+	rest         []byte // coalesced packets following this one
+}
+
+// parseInitialHeader returns the offsets of the Length and packet number
+// fields and the end of the packet (from the Length field)
+func parseInitialHeader(datagram []byte) (dcid []byte, lengthOffset, pnOffset, end int, err error) {
+	if len(datagram) < 7 || datagram[0]&0x80 == 0 || (datagram[0]>>4)&0x03 != 0x00 {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+	if binary.BigEndian.Uint32(datagram[1:5]) != quicVersion1 {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+
+	pos := 5
+	dcidLen := int(datagram[pos])
+	pos++
+	if pos+dcidLen >= len(datagram) {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+	dcid = datagram[pos : pos+dcidLen]
+	pos += dcidLen
+
+	scidLen := int(datagram[pos])
+	pos += 1 + scidLen
+	if pos >= len(datagram) {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+
+	tokenLen, n, ok := readVarint(datagram[pos:])
+	if !ok {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+	pos += n + int(tokenLen)
+	if pos >= len(datagram) {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+
+	lengthOffset = pos
+	length, n, ok := readVarint(datagram[pos:])
+	if !ok {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+	pos += n
+	end = pos + int(length)
+	if end > len(datagram) || pos+4+aes.BlockSize > end {
+		return nil, 0, 0, 0, errNotFragmentable
+	}
+
+	return dcid, lengthOffset, pos, end, nil
+}
+
+// openInitial removes header protection and decrypts a client Initial packet
+func openInitial(datagram []byte) (*initialPacket, *initialKeys, error) {
+	dcid, lengthOffset, pnOffset, end, err := parseInitialHeader(datagram)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := newClientInitialKeys(dcid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := append([]byte(nil), datagram[:pnOffset+4]...)
+	mask := keys.headerMask(datagram[pnOffset+4 : pnOffset+4+aes.BlockSize])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	plaintext, err := keys.aead.Open(nil, keys.nonce(pn), datagram[pnOffset+pnLen:end], header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &initialPacket{
+		header:       header,
+		lengthOffset: lengthOffset,
+		pn:           pn,
+		plaintext:    plaintext,
+		rest:         datagram[end:],
+	}, keys, nil
+}
+
+// sealInitial encrypts and header-protects a client Initial packet
+func sealInitial(p *initialPacket, keys *initialKeys) []byte {
+	pnLen := int(p.header[0]&0x03) + 1
+	pnOffset := len(p.header) - pnLen
+
+	out := append([]byte(nil), p.header...)
+	out = keys.aead.Seal(out, keys.nonce(p.pn), p.plaintext, p.header)
+
+	mask := keys.headerMask(out[pnOffset+4 : pnOffset+4+aes.BlockSize])
+	out[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		out[pnOffset+i] ^= mask[1+i]
+	}
+
+	return append(out, p.rest...)
+}
+
+// cryptoFrame is a CRYPTO frame carrying part of the TLS handshake stream
+type cryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// parseInitialFrames extracts CRYPTO frames from an Initial packet payload.
+// Only PADDING, PING and CRYPTO frames are supported, which is what a client
+// sends in its first flight.
+func parseInitialFrames(payload []byte) (frames []cryptoFrame, ping bool, err error) {
+	for pos := 0; pos < len(payload); {
+		switch payload[pos] {
+		case quicFramePadding:
+			pos++
+		case quicFramePing:
+			ping = true
+			pos++
+		case quicFrameCrypto:
+			pos++
+			offset, n, ok := readVarint(payload[pos:])
+			if !ok {
+				return nil, false, errNotFragmentable
+			}
+			pos += n
+			length, n, ok := readVarint(payload[pos:])
+			if !ok || pos+n+int(length) > len(payload) {
+				return nil, false, errNotFragmentable
+			}
+			pos += n
+			frames = append(frames, cryptoFrame{offset: offset, data: payload[pos : pos+int(length)]})
+			pos += int(length)
+		default:
+			return nil, false, errNotFragmentable
+		}
+	}
+	return frames, ping, nil
+}
+
+// cryptoStream reassembles the CRYPTO data carried by frames, returning the
+// stream offset it starts at. ok is false unless the data is contiguous.
+func cryptoStream(frames []cryptoFrame) (base uint64, stream []byte, ok bool) {
+	sort.Slice(frames, func(i, j int) bool { return frames[i].offset < frames[j].offset })
+	base = frames[0].offset
+	covered := base
+	for _, f := range frames {
+		if f.offset > covered {
+			return 0, nil, false
+		}
+		if end := f.offset + uint64(len(f.data)); end > covered {
+			covered = end
+		}
+	}
+	for _, f := range frames {
+		end := int(f.offset-base) + len(f.data)
+		if end > len(stream) {
+			stream = append(stream, make([]byte, end-len(stream))...)
+		}
+		copy(stream[f.offset-base:], f.data)
+	}
+	return base, stream, true
+}
+
+// findSNI returns the start and end offsets of the server_name host in a TLS
+// ClientHello handshake message
+func findSNI(hello []byte) (int, int, bool) {
+	// Handshake header (4) + legacy_version (2) + random (32)
+	pos := 4 + 2 + 32
+	if len(hello) < pos+1 || hello[0] != 0x01 {
+		return 0, 0, false
+	}
+
+	// legacy_session_id
+	pos += 1 + int(hello[pos])
+	// cipher_suites
+	if len(hello) < pos+2 {
+		return 0, 0, false
+	}
+	pos += 2 + int(binary.BigEndian.Uint16(hello[pos:]))
+	// legacy_compression_methods
+	if len(hello) < pos+1 {
+		return 0, 0, false
+	}
+	pos += 1 + int(hello[pos])
+	// extensions
+	if len(hello) < pos+2 {
+		return 0, 0, false
+	}
+	extEnd := pos + 2 + int(binary.BigEndian.Uint16(hello[pos:]))
+	pos += 2
+	if extEnd > len(hello) {
+		extEnd = len(hello)
+	}
+
+	for pos+4 <= extEnd {
+		extType := binary.BigEndian.Uint16(hello[pos:])
+		extLen := int(binary.BigEndian.Uint16(hello[pos+2:]))
+		pos += 4
+		if pos+extLen > extEnd {
+			return 0, 0, false
+		}
+		if extType == 0x0000 {
+			// server_name_list length (2), name_type (1), host_name length (2)
+			if extLen < 5 || hello[pos+2] != 0x00 {
+				return 0, 0, false
+			}
+			nameLen := int(binary.BigEndian.Uint16(hello[pos+3:]))
+			start := pos + 5
+			if start+nameLen > pos+extLen {
+				return 0, 0, false
+			}
+			return start, start + nameLen, true
+		}
+		pos += extLen
+	}
+	return 0, 0, false
+}
+
+// fragmentInitialSNI rewrites a client Initial datagram so that the SNI in its
+// ClientHello is split across CRYPTO frames of at most chunk bytes. Packets
+// that cannot be safely rewritten are returned unchanged.
+func fragmentInitialSNI(datagram []byte, chunk int) []byte {
+	if chunk <= 0 {
+		return datagram
+	}
+
+	pkt, keys, err := openInitial(datagram)
+	if err != nil {
+		return datagram
+	}
+
+	frames, ping, err := parseInitialFrames(pkt.plaintext)
+	if err != nil || len(frames) == 0 {
+		return datagram
+	}
+
+	// The ClientHello must start in this packet for the SNI to be located
+	base, stream, ok := cryptoStream(frames)
+	if !ok || base != 0 {
+		return datagram
+	}
+	sniStart, sniEnd, ok := findSNI(stream)
+	if !ok || sniEnd > len(stream) {
+		return datagram
+	}
+
+	// Split the stream into pieces: before the SNI, SNI chunks, after the SNI
+	type piece struct{ start, end int }
+	pieces := []piece{{0, sniStart}}
+	for off := sniStart; off < sniEnd; off += chunk {
+		end := off + chunk
+		if end > sniEnd {
+			end = sniEnd
+		}
+		pieces = append(pieces, piece{off, end})
+	}
+	pieces = append(pieces, piece{sniEnd, len(stream)})
+
+	// Emit the frames in reverse order so that neighbouring SNI chunks are
+	// separated by frame headers and other data
+	var payload []byte
+	if ping {
+		payload = append(payload, quicFramePing)
+	}
+	for i := len(pieces) - 1; i >= 0; i-- {
+		p := pieces[i]
+		if p.end <= p.start {
+			continue
+		}
+		payload = append(payload, quicFrameCrypto)
+		payload = appendVarint(payload, base+uint64(p.start))
+		payload = appendVarint(payload, uint64(p.end-p.start))
+		payload = append(payload, stream[p.start:p.end]...)
+	}
+
+	// Keep the packet the same size by shrinking the PADDING
+	if len(payload) > len(pkt.plaintext) {
+		return datagram
+	}
+	payload = append(payload, make([]byte, len(pkt.plaintext)-len(payload))...)
+
+	pkt.plaintext = payload
+	return sealInitial(pkt, keys)
+}
@@ -0,0 +1,175 @@
+package noize
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// captureClientHello returns a real TLS ClientHello handshake message for sni
+func captureClientHello(t *testing.T, sni string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{
+			ServerName:       sni,
+			NextProtos:       []string{"h3"},
+			CurvePreferences: []tls.CurveID{tls.X25519}, // keep the hello within one Initial
+		}).Handshake()
+		client.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	return record
+}
+
+// buildInitial creates a padded client Initial datagram carrying hello
+func buildInitial(t *testing.T, dcid, hello []byte) []byte {
+	t.Helper()
+	keys, err := newClientInitialKeys(dcid)
+	if err != nil {
+		t.Fatalf("newClientInitialKeys: %v", err)
+	}
+
+	var plaintext []byte
+	plaintext = append(plaintext, quicFrameCrypto, 0)
+	plaintext = appendVarint(plaintext, uint64(len(hello)))
+	plaintext = append(plaintext, hello...)
+	plaintext = append(plaintext, make([]byte, 1100-len(plaintext))...)
+
+	const pnLen = 2
+	header := []byte{0xc0 | (pnLen - 1), 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, 0) // empty source connection ID
+	header = append(header, 0) // no token
+	header = appendVarint(header, uint64(pnLen+len(plaintext)+16))
+	header = append(header, 0, 0) // packet number 0
+
+	return sealInitial(&initialPacket{header: header, plaintext: plaintext}, keys)
+}
+
+// reassembleCrypto returns the CRYPTO stream of a decrypted Initial payload
+func reassembleCrypto(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	frames, _, err := parseInitialFrames(payload)
+	if err != nil {
+		t.Fatalf("parseInitialFrames: %v", err)
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].offset < frames[j].offset })
+	var stream []byte
+	for _, f := range frames {
+		if int(f.offset) != len(stream) {
+			t.Fatalf("CRYPTO stream gap at offset %d", f.offset)
+		}
+		stream = append(stream, f.data...)
+	}
+	return stream
+}
+
+func TestClientInitialKeysRFC9001(t *testing.T) {
+	// RFC 9001, Appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	keys, err := newClientInitialKeys(dcid)
+	if err != nil {
+		t.Fatalf("newClientInitialKeys: %v", err)
+	}
+
+	if got := hex.EncodeToString(keys.iv); got != "fa044b2f42a3fd3b46fb255c" {
+		t.Errorf("iv = %s", got)
+	}
+	sample, _ := hex.DecodeString("d1b1c98dd7689fb8ec11d242b123dc9b")
+	if got := hex.EncodeToString(keys.headerMask(sample)[:5]); got != "437b9aec36" {
+		t.Errorf("header protection mask = %s", got)
+	}
+}
+
+func TestFragmentInitialSNI(t *testing.T) {
+	const sni = "engage.cloudflareclient.com"
+	hello := captureClientHello(t, sni)
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	datagram := buildInitial(t, dcid, hello)
+
+	// Sanity check: without fragmentation the SNI is readable after decryption
+	original, _, err := openInitial(datagram)
+	if err != nil {
+		t.Fatalf("openInitial: %v", err)
+	}
+	if !bytes.Contains(original.plaintext, []byte(sni)) {
+		t.Fatal("expected SNI in unfragmented Initial")
+	}
+
+	fragmented := fragmentInitialSNI(datagram, 8)
+	if len(fragmented) != len(datagram) {
+		t.Fatalf("fragmented datagram is %d bytes, want %d", len(fragmented), len(datagram))
+	}
+	if bytes.Contains(fragmented, []byte(sni)) {
+		t.Fatal("SNI appears in the raw datagram")
+	}
+
+	pkt, _, err := openInitial(fragmented)
+	if err != nil {
+		t.Fatalf("openInitial(fragmented): %v", err)
+	}
+	if bytes.Contains(pkt.plaintext, []byte(sni)) {
+		t.Fatal("SNI appears contiguously in the decrypted Initial")
+	}
+	if !bytes.Equal(reassembleCrypto(t, pkt.plaintext), hello) {
+		t.Fatal("reassembled CRYPTO stream does not match the original ClientHello")
+	}
+}
+
+func TestFragmentInitialSNIPassthrough(t *testing.T) {
+	// Non-Initial packets are returned unchanged
+	shortHeader := []byte{0x40, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	if got := fragmentInitialSNI(shortHeader, 8); !bytes.Equal(got, shortHeader) {
+		t.Error("short header packet was modified")
+	}
+}
+
+func TestSNIFragmentationWithDefaultCurves(t *testing.T) {
+	const sni = "engage.cloudflareclient.com"
+	client, receiver := newLoopbackPair(t)
+	obfuscator := NewObfuscator(&NoizeConfig{SNIFragmentation: true, SNIFragment: 8}, nil)
+	conn := obfuscator.WrapPacketConn(client)
+
+	// No CurvePreferences: Go would offer the X25519MLKEM768 key share that
+	// pushes the ClientHello past the first Initial
+	tlsConfig := obfuscator.ConfigureTLS(&tls.Config{ServerName: sni, NextProtos: []string{"h3"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go quic.Dial(ctx, conn, receiver.LocalAddr(), tlsConfig, &quic.Config{InitialPacketSize: 1200})
+
+	_ = receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := receiver.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("reading Initial: %v", err)
+	}
+	pkt, _, err := openInitial(buf[:n])
+	if err != nil {
+		t.Fatalf("openInitial: %v", err)
+	}
+	if bytes.Contains(pkt.plaintext, []byte(sni)) {
+		t.Fatal("SNI appears contiguously in the decrypted Initial")
+	}
+	if !bytes.Contains(reassembleCrypto(t, pkt.plaintext), []byte(sni)) {
+		t.Fatal("first Initial does not carry the SNI")
+	}
+}
@@ -0,0 +1,36 @@
+package masque
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/voidr3aper-anon/Vwarp/masque/noize"
+)
+
+// Obfuscator disguises the QUIC traffic of a MASQUE tunnel. noize.Obfuscator
+// is the built-in implementation; other DPI-evasion schemes can be plugged in
+// through AdapterConfig.Obfuscator without changes to this package.
+type Obfuscator interface {
+	// WrapPacketConn returns the socket QUIC runs on, wrapping conn
+	WrapPacketConn(conn net.PacketConn) net.PacketConn
+	// PreHandshake runs before the QUIC dial; send writes a datagram to the
+	// server through the wrapped socket
+	PreHandshake(send func([]byte) error) error
+}
+
+// handshakeFinisher is implemented by wrapped sockets that stop obfuscating
+// once the tunnel is established
+type handshakeFinisher interface {
+	DisableObfuscation()
+}
+
+// tlsConfigurer is implemented by obfuscators that depend on the shape of the
+// ClientHello, to adjust the TLS configuration of the dial
+type tlsConfigurer interface {
+	ConfigureTLS(conf *tls.Config) *tls.Config
+}
+
+var (
+	_ Obfuscator    = (*noize.Obfuscator)(nil)
+	_ tlsConfigurer = (*noize.Obfuscator)(nil)
+)
@@ -0,0 +1,98 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const xorKey = 0x5a
+
+func xorBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ xorKey
+	}
+	return out
+}
+
+// xorObfuscator XORs every datagram with a fixed key
+type xorObfuscator struct {
+	writes atomic.Int32
+}
+
+func (o *xorObfuscator) WrapPacketConn(conn net.PacketConn) net.PacketConn {
+	return &xorConn{PacketConn: conn, obf: o}
+}
+
+func (o *xorObfuscator) PreHandshake(send func([]byte) error) error {
+	return send([]byte("xor-hello"))
+}
+
+type xorConn struct {
+	net.PacketConn
+	obf *xorObfuscator
+}
+
+func (c *xorConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.obf.writes.Add(1)
+	return c.PacketConn.WriteTo(xorBytes(b), addr)
+}
+
+func (c *xorConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	copy(b, xorBytes(b[:n]))
+	return n, addr, err
+}
+
+func TestCustomObfuscatorWrapsQUICSocket(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer client.Close()
+
+	obf := &xorObfuscator{}
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	quicConn := obfuscatePacketConn(client, serverAddr, obf, nil)
+
+	// Nothing answers, so the dial only has to get its Initial onto the wire
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go quic.Dial(ctx, quicConn, serverAddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3"}}, nil)
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading pre-handshake datagram: %v", err)
+	}
+	if got := string(xorBytes(buf[:n])); got != "xor-hello" {
+		t.Fatalf("pre-handshake datagram = %q, want xor-hello", got)
+	}
+
+	n, _, err = server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading QUIC Initial: %v", err)
+	}
+	if buf[0]&0xc0 == 0xc0 {
+		t.Fatalf("QUIC Initial reached the wire without obfuscation (first byte %#x)", buf[0])
+	}
+	if first := buf[0] ^ xorKey; first&0xc0 != 0xc0 {
+		t.Fatalf("decoded datagram is not a QUIC long header packet (first byte %#x)", first)
+	}
+	if obf.writes.Load() < 2 {
+		t.Fatalf("obfuscated socket saw %d writes, want the pre-handshake and the Initial", obf.writes.Load())
+	}
+}
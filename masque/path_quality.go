@@ -0,0 +1,69 @@
+package masque
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Quality is the state of a MASQUE tunnel's QUIC path at one point in time
+type Quality struct {
+	Endpoint    string        // Endpoint the tunnel is connected to
+	RTT         time.Duration // Smoothed round trip time, zero before the first sample
+	PacketsSent uint64        // QUIC packets sent since the tunnel was established
+	PacketsLost uint64        // Sent packets QUIC declared lost
+	WireBytes   uint64        // Bytes of the QUIC packets sent and received since the tunnel was established
+}
+
+// pathQuality counts the RTT, packet loss and bytes of a tunnel's QUIC
+// connection from its tracer events
+type pathQuality struct {
+	rtt   atomic.Int64 // A time.Duration
+	sent  atomic.Uint64
+	lost  atomic.Uint64
+	bytes atomic.Uint64
+}
+
+// tracer is a quic.Config Tracer that feeds the connection's metrics to p
+func (p *pathQuality) tracer(_ context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		UpdatedMetrics: func(rttStats *logging.RTTStats, _, _ logging.ByteCount, _ int) {
+			p.rtt.Store(int64(rttStats.SmoothedRTT()))
+		},
+		SentLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			p.sent.Add(1)
+			p.bytes.Add(uint64(size))
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			p.sent.Add(1)
+			p.bytes.Add(uint64(size))
+		},
+		ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			p.bytes.Add(uint64(size))
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			p.bytes.Add(uint64(size))
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			p.lost.Add(1)
+		},
+	}
+}
+
+// Quality returns the RTT and packet counts of the current tunnel. The
+// counts start over when the adapter reconnects.
+func (m *MasqueAdapter) Quality() Quality {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	q := Quality{Endpoint: m.endpoint}
+	if m.path != nil {
+		q.RTT = time.Duration(m.path.rtt.Load())
+		q.PacketsSent = m.path.sent.Load()
+		q.PacketsLost = m.path.lost.Load()
+		q.WireBytes = m.path.bytes.Load()
+	}
+	return q
+}
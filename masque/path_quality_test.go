@@ -0,0 +1,55 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestPathQualityTracksRTTAndPackets(t *testing.T) {
+	addr := serveTestQUICEcho(t)
+	path := &pathQuality{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr.String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"nat-test"}},
+		&quic.Config{Tracer: path.tracer})
+	if err != nil {
+		t.Fatalf("quic dial: %v", err)
+	}
+	defer conn.CloseWithError(0, "")
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(str, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &MasqueAdapter{endpoint: addr.String(), path: path}
+	q := m.Quality()
+	if q.Endpoint != addr.String() {
+		t.Errorf("endpoint = %q, want %q", q.Endpoint, addr)
+	}
+	if q.RTT <= 0 {
+		t.Errorf("RTT = %v, want a sample", q.RTT)
+	}
+	if q.PacketsSent == 0 {
+		t.Error("no packets counted as sent")
+	}
+	// At least the stream data went both ways
+	if q.WireBytes < 8 {
+		t.Errorf("%d wire bytes counted", q.WireBytes)
+	}
+	if q.PacketsLost != 0 {
+		t.Errorf("%d packets lost on loopback", q.PacketsLost)
+	}
+}
@@ -0,0 +1,79 @@
+package masque
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Diniboy1123/usque/config"
+)
+
+// ConfigFileName is the name of the MASQUE device config in a config or profile directory
+const ConfigFileName = "masque_config.json"
+
+// ProfilesDir is the subdirectory of a config directory holding the named
+// device profiles, one subdirectory with a ConfigFileName per profile
+const ProfilesDir = "profiles"
+
+// ProfileConfigPath returns the path of the device config of profile name
+// under dir. The config need not exist yet; NewMasqueAdapter registers a
+// device there on first use.
+func ProfileConfigPath(dir, name string) (string, error) {
+	if err := validateProfileName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ProfilesDir, name, ConfigFileName), nil
+}
+
+// ListProfiles returns the names of the profiles under dir that hold a
+// device config, sorted. A dir without profiles returns none.
+func ListProfiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, ProfilesDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list profiles: %w", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() || validateProfileName(e.Name()) != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, ProfilesDir, e.Name(), ConfigFileName)); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// LoadProfile reads the device config of profile name under dir
+func LoadProfile(dir, name string) (*config.Config, error) {
+	configPath, err := ProfileConfigPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile %q: %w", name, err)
+	}
+	var c config.Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode profile %q: %w", name, err)
+	}
+	return &c, nil
+}
+
+// validateProfileName rejects names that would escape the profiles directory
+func validateProfileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	return nil
+}
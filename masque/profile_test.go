@@ -0,0 +1,66 @@
+package masque
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Diniboy1123/usque/config"
+)
+
+// writeProfile saves a device config with id as profile name under dir
+func writeProfile(t *testing.T, dir, name, id string) {
+	t.Helper()
+	configPath, err := ProfileConfigPath(dir, name)
+	if err != nil {
+		t.Fatalf("ProfileConfigPath(%q): %v", name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveConfigFile(configPath, &config.Config{ID: id, EndpointV4: "162.159.198.1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	dir := t.TempDir()
+	if names, err := ListProfiles(dir); err != nil || names != nil {
+		t.Fatalf("ListProfiles on an empty dir = %v, %v", names, err)
+	}
+
+	writeProfile(t, dir, "work", "device-work")
+	writeProfile(t, dir, "eu", "device-eu")
+	// A profile directory without a config isn't a profile
+	if err := os.MkdirAll(filepath.Join(dir, ProfilesDir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := ListProfiles(dir)
+	if err != nil {
+		t.Fatalf("ListProfiles: %v", err)
+	}
+	if !slices.Equal(names, []string{"eu", "work"}) {
+		t.Fatalf("ListProfiles = %v, want [eu work]", names)
+	}
+
+	for _, name := range names {
+		c, err := LoadProfile(dir, name)
+		if err != nil {
+			t.Fatalf("LoadProfile(%q): %v", name, err)
+		}
+		if c.ID != "device-"+name {
+			t.Errorf("LoadProfile(%q) loaded device %q", name, c.ID)
+		}
+	}
+
+	if _, err := LoadProfile(dir, "empty"); err == nil {
+		t.Error("LoadProfile loaded a profile without a config")
+	}
+	for _, name := range []string{"", ".", "..", "../work", `eu\work`} {
+		if _, err := ProfileConfigPath(dir, name); err == nil {
+			t.Errorf("ProfileConfigPath accepted %q", name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package masque
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQUICBlockThreshold is the number of consecutive QUIC failures after
+	// which a network is considered to block QUIC
+	DefaultQUICBlockThreshold = 3
+	// DefaultQUICBlockCooldown is how long QUIC is skipped on a blocked network
+	// before it is probed again
+	DefaultQUICBlockCooldown = 30 * time.Minute
+)
+
+// HandshakeError is a QUIC handshake with a MASQUE endpoint that did not
+// complete, as opposed to a failure before the dial or after the handshake
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return "QUIC handshake failed: " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// IsQUICBlockError reports whether err, from setting up a MASQUE tunnel, is a
+// QUIC handshake failure or timeout and so counts towards blocking QUIC on the
+// network. Cancellation, configuration, pinning and Connect-IP errors don't.
+func IsQUICBlockError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrEndpointKeyMismatch) {
+		return false
+	}
+	var handshake *HandshakeError
+	return errors.As(err, &handshake)
+}
+
+// quicNetworkState tracks QUIC health for a single network
+type quicNetworkState struct {
+	Failures     int       `json:"failures"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+}
+
+// QUICBlockDetector remembers networks on which QUIC handshakes keep failing so
+// that callers can go straight to a non-QUIC transport instead of waiting for
+// the QUIC handshake timeout on every connect. Once the cooldown expires a single
+// QUIC probe is allowed; if it fails the network is blocked again.
+type QUICBlockDetector struct {
+	// Threshold is the number of consecutive failures that marks a network as blocked
+	Threshold int
+	// Cooldown is how long a blocked network skips QUIC before re-probing
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	path     string
+	networks map[string]*quicNetworkState
+	now      func() time.Time
+}
+
+// NewQUICBlockDetector creates a detector with default settings. If statePath is
+// not empty, state is loaded from and persisted to that file so it survives
+// restarts.
+func NewQUICBlockDetector(statePath string) *QUICBlockDetector {
+	d := &QUICBlockDetector{
+		Threshold: DefaultQUICBlockThreshold,
+		Cooldown:  DefaultQUICBlockCooldown,
+		path:      statePath,
+		networks:  make(map[string]*quicNetworkState),
+		now:       time.Now,
+	}
+
+	if statePath != "" {
+		if data, err := os.ReadFile(statePath); err == nil {
+			_ = json.Unmarshal(data, &d.networks)
+		}
+	}
+
+	return d
+}
+
+// Blocked reports whether QUIC should be skipped on the given network
+func (d *QUICBlockDetector) Blocked(network string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.networks[network]
+	if !ok {
+		return false
+	}
+	return d.now().Before(state.BlockedUntil)
+}
+
+// RecordFailure records a failed QUIC connection attempt on the given network
+func (d *QUICBlockDetector) RecordFailure(network string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.networks[network]
+	if !ok {
+		state = &quicNetworkState{}
+		d.networks[network] = state
+	}
+
+	state.Failures++
+	if state.Failures >= d.Threshold {
+		state.BlockedUntil = d.now().Add(d.Cooldown)
+	}
+	d.save()
+}
+
+// RecordSuccess records a successful QUIC connection on the given network,
+// clearing any failure history
+func (d *QUICBlockDetector) RecordSuccess(network string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.networks[network]; !ok {
+		return
+	}
+	delete(d.networks, network)
+	d.save()
+}
+
+// Reset forgets all recorded failures on every network
+func (d *QUICBlockDetector) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.networks = make(map[string]*quicNetworkState)
+	d.save()
+}
+
+// save persists the current state; callers must hold d.mu
+func (d *QUICBlockDetector) save() {
+	if d.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(d.networks)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(d.path), 0o755); err != nil {
+		return
+	}
+	_ = os.WriteFile(d.path, data, 0o644)
+}
+
+// NetworkSignature returns a short identifier for the network the host is
+// currently attached to, derived from its active non-loopback interface
+// addresses. It changes when the host moves between networks.
+func NetworkSignature() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "unknown"
+	}
+
+	var entries []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			// Use the network prefix so DHCP address changes within the same
+			// network keep the same signature
+			entries = append(entries, iface.Name+"="+ipNet.IP.Mask(ipNet.Mask).String())
+		}
+	}
+
+	if len(entries) == 0 {
+		return "unknown"
+	}
+
+	sort.Strings(entries)
+	sum := sha256.Sum256([]byte(strings.Join(entries, ",")))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,115 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestQUICBlockDetector(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := NewQUICBlockDetector(filepath.Join(t.TempDir(), "quic_block.json"))
+	d.now = func() time.Time { return now }
+
+	const network = "test-network"
+	quicAttempts := 0
+	fallbackAttempts := 0
+
+	// connect mirrors the MASQUE-preferred flow: QUIC unless blocked, else fallback
+	connect := func() {
+		if d.Blocked(network) {
+			fallbackAttempts++
+			return
+		}
+		quicAttempts++
+		d.RecordFailure(network)
+	}
+
+	for i := 0; i < DefaultQUICBlockThreshold; i++ {
+		connect()
+	}
+	if quicAttempts != DefaultQUICBlockThreshold || fallbackAttempts != 0 {
+		t.Fatalf("quic=%d fallback=%d after initial failures", quicAttempts, fallbackAttempts)
+	}
+
+	// The next connect must skip QUIC entirely
+	connect()
+	if quicAttempts != DefaultQUICBlockThreshold || fallbackAttempts != 1 {
+		t.Fatalf("expected direct fallback, got quic=%d fallback=%d", quicAttempts, fallbackAttempts)
+	}
+
+	// State survives a restart
+	reloaded := NewQUICBlockDetector(d.path)
+	reloaded.now = d.now
+	if !reloaded.Blocked(network) {
+		t.Fatal("expected blocked state to be persisted")
+	}
+
+	// After the cooldown a single probe is allowed, and a failed probe re-blocks
+	now = now.Add(DefaultQUICBlockCooldown + time.Second)
+	connect()
+	if quicAttempts != DefaultQUICBlockThreshold+1 {
+		t.Fatalf("expected re-probe after cooldown, got quic=%d", quicAttempts)
+	}
+	if !d.Blocked(network) {
+		t.Fatal("expected failed re-probe to block again")
+	}
+
+	// A success clears the history
+	d.RecordSuccess(network)
+	if d.Blocked(network) {
+		t.Fatal("expected success to clear blocked state")
+	}
+
+	// Reset forgets every network
+	for i := 0; i < DefaultQUICBlockThreshold; i++ {
+		d.RecordFailure(network)
+	}
+	d.Reset()
+	if d.Blocked(network) {
+		t.Fatal("expected reset to clear blocked state")
+	}
+	if NewQUICBlockDetector(d.path).Blocked(network) {
+		t.Fatal("expected reset to be persisted")
+	}
+}
+
+func TestIsQUICBlockError(t *testing.T) {
+	// A silent endpoint times the handshake out
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	udpConn, _, _, _, err := ConnectTunnelOptimized(ctx,
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true}, "https://localhost/connect-ip", silent.LocalAddr().(*net.UDPAddr), TunnelDialOptions{})
+	if udpConn != nil {
+		udpConn.Close()
+	}
+	if !IsQUICBlockError(fmt.Errorf("failed to establish MASQUE tunnel: %w", err)) {
+		t.Errorf("handshake timeout %v does not count", err)
+	}
+
+	for _, err := range []error{
+		&HandshakeError{Err: context.Canceled},
+		&HandshakeError{Err: ErrEndpointKeyMismatch},
+		fmt.Errorf("failed to dial connect-ip: %w", context.DeadlineExceeded),
+		errors.New("failed to load config"),
+		nil,
+	} {
+		if IsQUICBlockError(err) {
+			t.Errorf("%v counts as a QUIC block", err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package masque
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultResolveCacheTTL is how long a ResolveCache reuses an endpoint lookup
+	DefaultResolveCacheTTL = 5 * time.Minute
+	// resolveCacheMaxFailures is how many connects in a row may fail on a
+	// cached address before the endpoint is looked up again, in case it moved
+	resolveCacheMaxFailures = 2
+)
+
+// resolvedEndpoint is a cached lookup of an endpoint hostname
+type resolvedEndpoint struct {
+	addr     *net.UDPAddr
+	expires  time.Time
+	failures int // Consecutive failed connects to addr
+}
+
+// ResolveCache caches the addresses of endpoint hostnames so reconnects to
+// the same endpoint skip the DNS lookup. An entry is looked up again once its
+// TTL passes or after repeated connects to the cached address fail.
+// Endpoints that are IP literals are never cached.
+type ResolveCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*resolvedEndpoint
+	now     func() time.Time
+	resolve func(network, address string) (*net.UDPAddr, error)
+}
+
+// NewResolveCache creates an empty cache whose lookups live for ttl
+// (DefaultResolveCacheTTL if zero)
+func NewResolveCache(ttl time.Duration) *ResolveCache {
+	if ttl == 0 {
+		ttl = DefaultResolveCacheTTL
+	}
+	return &ResolveCache{
+		ttl:     ttl,
+		entries: make(map[string]*resolvedEndpoint),
+		now:     time.Now,
+		resolve: net.ResolveUDPAddr,
+	}
+}
+
+// Resolve returns the UDP address of endpoint, a host:port, from the cache
+// or a fresh lookup
+func (c *ResolveCache) Resolve(endpoint string) (*net.UDPAddr, error) {
+	if isIPEndpoint(endpoint) {
+		return net.ResolveUDPAddr("udp", endpoint)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if e, ok := c.entries[endpoint]; ok && now.Before(e.expires) && e.failures < resolveCacheMaxFailures {
+		return e.addr, nil
+	}
+	addr, err := c.resolve("udp", endpoint)
+	if err != nil {
+		delete(c.entries, endpoint)
+		return nil, err
+	}
+	c.entries[endpoint] = &resolvedEndpoint{addr: addr, expires: now.Add(c.ttl)}
+	return addr, nil
+}
+
+// ConnectFailed records a failed connect to the cached address of endpoint
+func (c *ResolveCache) ConnectFailed(endpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[endpoint]; ok {
+		e.failures++
+	}
+}
+
+// ConnectSucceeded clears the failed connects recorded for endpoint
+func (c *ResolveCache) ConnectSucceeded(endpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[endpoint]; ok {
+		e.failures = 0
+	}
+}
+
+// isIPEndpoint reports whether the host of a host:port endpoint is an IP literal
+func isIPEndpoint(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	_, err = netip.ParseAddr(host)
+	return err == nil
+}
+
+// resolveEndpoint resolves endpoint through cfg.ResolveCache when there is one
+func resolveEndpoint(cfg AdapterConfig, endpoint string) (*net.UDPAddr, error) {
+	if cfg.ResolveCache == nil {
+		return net.ResolveUDPAddr("udp", endpoint)
+	}
+	return cfg.ResolveCache.Resolve(endpoint)
+}
@@ -0,0 +1,86 @@
+package masque
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// countingResolveCache returns a cache whose lookups are counted and always
+// answer 192.0.2.1, with a clock the test advances
+func countingResolveCache(ttl time.Duration) (c *ResolveCache, lookups *int, now *time.Time) {
+	lookups = new(int)
+	now = new(time.Time)
+	*now = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c = NewResolveCache(ttl)
+	c.now = func() time.Time { return *now }
+	c.resolve = func(network, address string) (*net.UDPAddr, error) {
+		*lookups++
+		return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, nil
+	}
+	return c, lookups, now
+}
+
+func TestResolveCacheReusesLookupWithinTTL(t *testing.T) {
+	c, lookups, now := countingResolveCache(time.Minute)
+	const endpoint = "engage.example.com:443"
+
+	for i := 0; i < 2; i++ {
+		addr, err := c.Resolve(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != "192.0.2.1:443" {
+			t.Fatalf("Resolve() = %s", addr)
+		}
+		c.ConnectSucceeded(endpoint)
+	}
+	if *lookups != 1 {
+		t.Fatalf("second connect within the TTL did %d lookups, want 1", *lookups)
+	}
+
+	*now = now.Add(time.Minute)
+	if _, err := c.Resolve(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if *lookups != 2 {
+		t.Fatalf("connect after the TTL did %d lookups, want 2", *lookups)
+	}
+}
+
+func TestResolveCacheRelooksUpAfterFailedConnects(t *testing.T) {
+	c, lookups, _ := countingResolveCache(time.Hour)
+	const endpoint = "engage.example.com:443"
+
+	for i := 0; i < resolveCacheMaxFailures; i++ {
+		if _, err := c.Resolve(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		c.ConnectFailed(endpoint)
+	}
+	if *lookups != 1 {
+		t.Fatalf("did %d lookups before the failure limit, want 1", *lookups)
+	}
+	if _, err := c.Resolve(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if *lookups != 2 {
+		t.Fatalf("did %d lookups after %d failed connects, want 2", *lookups, resolveCacheMaxFailures)
+	}
+}
+
+func TestResolveCacheSkipsIPEndpoints(t *testing.T) {
+	c, lookups, _ := countingResolveCache(time.Hour)
+	for _, endpoint := range []string{"162.159.198.1:443", "[2606:4700:103::1]:443"} {
+		addr, err := c.Resolve(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != endpoint {
+			t.Errorf("Resolve(%s) = %s", endpoint, addr)
+		}
+	}
+	if *lookups != 0 || len(c.entries) != 0 {
+		t.Errorf("IP endpoints were looked up %d times and cached %d times", *lookups, len(c.entries))
+	}
+}
@@ -0,0 +1,91 @@
+package masque
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// RotateKey replaces the MASQUE key of the device whose config is at
+// configPath without registering a new device: it enrolls a fresh ECDSA key
+// on the existing registration and saves it to the config. The device ID and
+// license are kept, and the tunnel addresses too unless the API changes them.
+// deviceName renames the device when not empty.
+func RotateKey(ctx context.Context, configPath, deviceName string) error {
+	if err := config.LoadConfig(configPath); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	cfg := config.AppConfig
+	if cfg.ID == "" || cfg.AccessToken == "" {
+		return fmt.Errorf("config %s has no device ID or access token to rotate the key of", configPath)
+	}
+
+	privKey, pubKey, err := generateEcKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate key pair: %w", err)
+	}
+	device, err := enrollKey(ctx, models.AccountData{ID: cfg.ID, Token: cfg.AccessToken}, pubKey, deviceName)
+	if err != nil {
+		return err
+	}
+	if device.ID != "" && device.ID != cfg.ID {
+		return fmt.Errorf("key enrolled on device %s instead of %s", device.ID, cfg.ID)
+	}
+
+	cfg.PrivateKey = base64.StdEncoding.EncodeToString(privKey)
+	if len(device.Config.Peers) > 0 && device.Config.Peers[0].PublicKey != "" {
+		cfg.EndpointPubKey = device.Config.Peers[0].PublicKey
+	}
+	if addrs := device.Config.Interface.Addresses; addrs.V4 != "" {
+		cfg.IPv4, cfg.IPv6 = addrs.V4, addrs.V6
+	}
+
+	// The old key no longer works, so never leave a half-written config behind
+	tmp := configPath + ".tmp"
+	os.Remove(tmp) // A leftover would keep its permissions
+	if err := saveConfigFile(tmp, &cfg); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	if err := os.Rename(tmp, configPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	config.AppConfig = cfg
+	return nil
+}
+
+// enrollKey enrolls pubKey, a PKIX DER ECDSA key, on the device of account
+// through the usque API, giving up when ctx is done. usque sends the request
+// without a context, so an abandoned one may still replace the key; the
+// access token still authorizes another rotation then.
+func enrollKey(ctx context.Context, account models.AccountData, pubKey []byte, deviceName string) (*models.AccountData, error) {
+	type result struct {
+		device models.AccountData
+		apiErr *models.APIError
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		device, apiErr, err := api.EnrollKey(account, pubKey, deviceName)
+		done <- result{device, apiErr, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			if r.apiErr != nil {
+				return nil, fmt.Errorf("failed to enroll key: %w (API errors: %s)", r.err, r.apiErr.ErrorsAsString("; "))
+			}
+			return nil, fmt.Errorf("failed to enroll key: %w", r.err)
+		}
+		return &r.device, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("key enrollment did not finish, rotate the key again: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,117 @@
+package masque
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/models"
+)
+
+func TestRotateKey(t *testing.T) {
+	const id, token = "00000000-0000-0000-0000-000000000000", "access-token"
+
+	var enrolled struct {
+		pubKey []byte
+		name   string
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/v0a4471/reg/"+id {
+			t.Errorf("request %s %s, want PATCH /v0a4471/reg/%s", r.Method, r.URL.Path, id)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer "+token {
+			t.Errorf("Authorization = %q", got)
+		}
+		var body struct {
+			Key  string `json:"key"`
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode request body: %v", err)
+		}
+		pubKey, err := base64.StdEncoding.DecodeString(body.Key)
+		if err != nil {
+			t.Errorf("key %q is not base64: %v", body.Key, err)
+		}
+		enrolled.pubKey, enrolled.name = pubKey, body.Name
+
+		var device models.AccountData
+		device.ID = id
+		device.Config.Interface.Addresses.V4 = "172.16.0.2"
+		device.Config.Interface.Addresses.V6 = "2606:4700:110:8a36::1"
+		json.NewEncoder(w).Encode(device)
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// usque talks to the real API through the default client
+	http.DefaultClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	t.Cleanup(func() { http.DefaultClient.Transport = nil })
+
+	// A registered device, from the fingerprint fixture plus a token and license
+	if err := config.LoadConfig("testdata/fingerprint_config.json"); err != nil {
+		t.Fatal(err)
+	}
+	device := config.AppConfig
+	device.AccessToken, device.License = token, "license-key"
+	path := filepath.Join(t.TempDir(), "masque_config.json")
+	if err := saveConfigFile(path, &device); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RotateKey(t.Context(), path, "laptop"); err != nil {
+		t.Fatalf("RotateKey() error = %v", err)
+	}
+
+	if enrolled.name != "laptop" {
+		t.Errorf("enrolled with name %q, want laptop", enrolled.name)
+	}
+	if err := config.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	rotated := config.AppConfig
+	if rotated.PrivateKey == device.PrivateKey {
+		t.Fatal("config still holds the old key")
+	}
+	privKey, err := rotated.GetEcPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enrolled.pubKey, pubKey) {
+		t.Errorf("enrolled key %s is not the public key of the saved private key", base64.StdEncoding.EncodeToString(enrolled.pubKey))
+	}
+	if rotated.ID != device.ID || rotated.License != device.License || rotated.IPv4 != device.IPv4 ||
+		rotated.EndpointPubKey != device.EndpointPubKey || rotated.AccessToken != device.AccessToken {
+		t.Errorf("rotation changed the device: %+v", rotated)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary config left behind: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("rotated config has mode %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
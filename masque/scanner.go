@@ -3,15 +3,23 @@ package masque
 import (
 	"context"
 	"crypto/ecdsa"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net"
+	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
-	// "github.com/Diniboy1123/usque/api" // Temporarily disabled - API needs update
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/voidr3aper-anon/Vwarp/neterr"
 )
 
 // ScanResult represents the result of scanning a single endpoint
@@ -24,6 +32,80 @@ type ScanResult struct {
 	Error       error
 	PingTime    time.Duration
 	HandshakeOK bool
+	// Transports records which transports the endpoint answered on
+	Transports Transport
+	// ErrorCategory is why the endpoint failed (empty on success)
+	ErrorCategory ErrorCategory
+}
+
+// ErrorCategory classifies the failure of a scanned endpoint, so a report can
+// tell endpoints that are blocked from ones that are down
+type ErrorCategory string
+
+const (
+	// CategoryTimeout means the endpoint never answered in time, as when
+	// its traffic is silently dropped
+	CategoryTimeout ErrorCategory = "timeout"
+	// CategoryRefused means the endpoint host refused the connection
+	CategoryRefused ErrorCategory = "refused"
+	// CategoryPinMismatch means the endpoint didn't present the pinned
+	// public key, as when the TLS connection is intercepted
+	CategoryPinMismatch ErrorCategory = "tls-pin-mismatch"
+	// CategoryConnectIP403 means the endpoint refused the Connect-IP
+	// request, as when the device key isn't enrolled
+	CategoryConnectIP403 ErrorCategory = "connect-ip-403"
+	// CategoryUnreachable means there is no route to the endpoint
+	CategoryUnreachable ErrorCategory = "unreachable"
+	// CategoryOther is any other failure
+	CategoryOther ErrorCategory = "other"
+)
+
+// categorizeError returns the ErrorCategory of a scan failure, or "" for nil
+func categorizeError(err error) ErrorCategory {
+	var rejected *TunnelRejectedError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrEndpointKeyMismatch):
+		return CategoryPinMismatch
+	case errors.As(err, &rejected) && rejected.StatusCode == http.StatusForbidden:
+		return CategoryConnectIP403
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CategoryRefused
+	case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH):
+		return CategoryUnreachable
+	case neterr.IsTimeout(err):
+		return CategoryTimeout
+	}
+	return CategoryOther
+}
+
+// Transport is a set of transports an endpoint is reachable over
+type Transport uint8
+
+const (
+	// TransportQUIC is MASQUE over HTTP/3 (UDP)
+	TransportQUIC Transport = 1 << iota
+	// TransportHTTP2 is the MASQUE HTTP/2 fallback (TCP:443)
+	TransportHTTP2
+)
+
+// Has reports whether t includes all transports in other
+func (t Transport) Has(other Transport) bool {
+	return t&other == other
+}
+
+func (t Transport) String() string {
+	switch t {
+	case TransportQUIC | TransportHTTP2:
+		return "quic+h2"
+	case TransportQUIC:
+		return "quic"
+	case TransportHTTP2:
+		return "h2"
+	default:
+		return "none"
+	}
 }
 
 // ScannerConfig holds configuration for the MASQUE endpoint scanner
@@ -40,10 +122,14 @@ type ScannerConfig struct {
 	ScanTimeout time.Duration
 	// Workers is the number of concurrent scanning workers
 	Workers int
-	// PingEnabled enables TCP ping before connection attempt
+	// PingEnabled pings all candidates concurrently before any connection
+	// attempt, drops the unreachable ones and tests the rest fastest first
 	PingEnabled bool
 	// PingTimeout is the timeout for ping attempts
 	PingTimeout time.Duration
+	// HandshakeCandidates caps how many of the fastest-pinging endpoints get a
+	// full connection test (0 tests all that answered; requires PingEnabled)
+	HandshakeCandidates int
 	// Ordered scans endpoints in CIDR order (no shuffle)
 	Ordered bool
 	// TunnelFailLimit is the number of tunnel failures before skipping endpoint
@@ -63,6 +149,10 @@ type ScannerConfig struct {
 	EarlyExit bool
 	// VerboseChild prints connection logs during scan
 	VerboseChild bool
+	// ProbeTCP also probes TCP:443 on every tested endpoint and records in
+	// ScanResult.Transports whether the HTTP/2 fallback answered. Only the
+	// QUIC test decides whether an endpoint succeeded.
+	ProbeTCP bool
 }
 
 // DefaultIPv4Ranges returns default Cloudflare MASQUE IPv4 ranges
@@ -99,6 +189,14 @@ type Scanner struct {
 	logger    *slog.Logger
 	stopChan  chan struct{}
 	stopped   atomic.Bool
+	workers   sync.WaitGroup
+
+	// testFunc tests a single endpoint; overridable in tests
+	testFunc func(ctx context.Context, endpoint string) ScanResult
+	// pingFunc pings a single endpoint; overridable in tests
+	pingFunc func(ctx context.Context, endpoint string) (time.Duration, error)
+	// tcpProbeFunc probes the HTTP/2 fallback of an endpoint; overridable in tests
+	tcpProbeFunc func(ctx context.Context, endpoint string) (time.Duration, error)
 }
 
 // NewScanner creates a new MASQUE endpoint scanner
@@ -129,11 +227,15 @@ func NewScanner(config ScannerConfig) *Scanner {
 		config.SNI = DefaultMasqueSNI
 	}
 
-	return &Scanner{
+	s := &Scanner{
 		config:   config,
 		logger:   config.Logger,
 		stopChan: make(chan struct{}),
 	}
+	s.testFunc = s.testEndpoint
+	s.pingFunc = s.pingEndpoint
+	s.tcpProbeFunc = s.probeTCP
+	return s
 }
 
 // generateCandidates generates IP candidates from CIDR ranges and custom endpoints
@@ -273,7 +375,121 @@ func (s *Scanner) pingEndpoint(ctx context.Context, endpoint string) (time.Durat
 	return time.Since(start), nil
 }
 
-// testEndpoint tests a single endpoint for MASQUE connectivity
+// probeTCP dials TCP:443 on the endpoint's host to test whether the HTTP/2
+// fallback is reachable
+func (s *Scanner) probeTCP(ctx context.Context, endpoint string) (time.Duration, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return 0, fmt.Errorf("invalid endpoint format: %w", err)
+	}
+
+	start := time.Now()
+	dialer := &net.Dialer{Timeout: s.config.ScanTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, "443"))
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+
+	return time.Since(start), nil
+}
+
+// probeTransports records the transports the endpoint answered on. TCP:443
+// answering is only reported, it doesn't make a failed endpoint usable.
+func (s *Scanner) probeTransports(ctx context.Context, result *ScanResult) {
+	if result.Success {
+		result.Transports |= TransportQUIC
+	}
+	if !s.config.ProbeTCP {
+		return
+	}
+
+	if _, err := s.tcpProbeFunc(ctx, result.Endpoint); err != nil {
+		if s.config.VerboseChild {
+			s.logger.Debug("TCP probe failed", "endpoint", result.Endpoint, "error", err)
+		}
+		return
+	}
+	result.Transports |= TransportHTTP2
+	if !result.Success && s.config.VerboseChild {
+		s.logger.Debug("QUIC failed, TCP:443 reachable", "endpoint", result.Endpoint, "error", result.Error)
+	}
+}
+
+// betterResult orders successful results: with ping enabled endpoints that
+// answered ping first, then by latency
+func betterResult(a, b ScanResult, pingEnabled bool) bool {
+	if pingEnabled {
+		if ap, bp := a.PingTime > 0, b.PingTime > 0; ap != bp {
+			return ap
+		}
+	}
+	return a.Latency < b.Latency
+}
+
+// preRank pings candidates concurrently, at most Workers at a time, and
+// returns the ones that answered sorted by ping time and capped to
+// HandshakeCandidates, their ping times, and a failed result for every
+// endpoint that did not answer
+func (s *Scanner) preRank(ctx context.Context, candidates []string) ([]string, map[string]time.Duration, []ScanResult) {
+	type ping struct {
+		endpoint string
+		rtt      time.Duration
+		err      error
+	}
+	pings := make([]ping, len(candidates))
+	sem := make(chan struct{}, s.config.Workers)
+	var wg sync.WaitGroup
+	for i, endpoint := range candidates {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			pings[i] = ping{endpoint: endpoint, err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			rtt, err := s.pingFunc(ctx, endpoint)
+			pings[i] = ping{endpoint: endpoint, rtt: rtt, err: err}
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	var reachable []ping
+	var failed []ScanResult
+	for _, p := range pings {
+		if p.err != nil {
+			if s.config.VerboseChild {
+				s.logger.Debug("ping failed", "endpoint", p.endpoint, "error", p.err)
+			}
+			failed = append(failed, ScanResult{
+				Endpoint:      p.endpoint,
+				Error:         fmt.Errorf("ping failed: %w", p.err),
+				ErrorCategory: categorizeError(p.err),
+			})
+			continue
+		}
+		reachable = append(reachable, p)
+	}
+	sort.SliceStable(reachable, func(i, j int) bool { return reachable[i].rtt < reachable[j].rtt })
+	if n := s.config.HandshakeCandidates; n > 0 && len(reachable) > n {
+		reachable = reachable[:n]
+	}
+
+	ranked := make([]string, len(reachable))
+	rtts := make(map[string]time.Duration, len(reachable))
+	for i, p := range reachable {
+		ranked[i] = p.endpoint
+		rtts[p.endpoint] = p.rtt
+	}
+	return ranked, rtts, failed
+}
+
+// testEndpoint tests a single endpoint for MASQUE connectivity: a QUIC
+// handshake that pins the endpoint key, then a Connect-IP request with the
+// device key
 func (s *Scanner) testEndpoint(ctx context.Context, endpoint string) ScanResult {
 	// Parse endpoint to get IP and port
 	host, portStr, err := net.SplitHostPort(endpoint)
@@ -292,8 +508,13 @@ func (s *Scanner) testEndpoint(ctx context.Context, endpoint string) ScanResult
 		}
 	}
 
-	var port int
-	fmt.Sscanf(portStr, "%d", &port)
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return ScanResult{
+			Endpoint: endpoint,
+			Error:    fmt.Errorf("invalid port: %s", portStr),
+		}
+	}
 
 	result := ScanResult{
 		Endpoint: endpoint,
@@ -301,39 +522,59 @@ func (s *Scanner) testEndpoint(ctx context.Context, endpoint string) ScanResult
 		Port:     port,
 	}
 
-	// Optional TCP ping test
-	if s.config.PingEnabled {
-		pingTime, err := s.pingEndpoint(ctx, endpoint)
-		result.PingTime = pingTime
-		if err != nil {
-			if s.config.VerboseChild {
-				s.logger.Debug("ping failed", "endpoint", endpoint, "error", err)
-			}
-			result.Error = fmt.Errorf("ping failed: %w", err)
-			return result
-		}
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		result.Error = err
+		return result
 	}
 
-	// Test MASQUE connection
-	start := time.Now()
-
 	// Scanner doesn't use noize obfuscation (for speed)
-	// Use placeholder IPs since scanner only tests connection, not data transfer
-	// TODO: Fix this - CreateMasqueClient function doesn't exist in current usque API
-	// The MASQUE scanner is temporarily disabled until the API is updated
-	_ = start // prevent unused warning
+	var logger *slog.Logger
+	if s.config.VerboseChild {
+		logger = s.logger
+	}
+	pad := InitialPadding{Size: DefaultInitialPacketSize}
 
-	result.Latency = time.Since(start)
-	result.Error = fmt.Errorf("MASQUE scanner is temporarily disabled - API needs update")
-	result.Success = false
+	ctx, cancel := context.WithTimeout(ctx, s.config.ScanTimeout)
+	defer cancel()
 
-	if s.config.VerboseChild {
-		s.logger.Debug("MASQUE scanner disabled", "endpoint", endpoint)
+	start := time.Now()
+	conn, h3conn, ipConn, _, err := ConnectTunnelOptimized(ctx, tlsConfig, newQUICConfig(pad, 0, ReceiveWindows{}), ConnectURI,
+		&net.UDPAddr{IP: ip, Port: port}, TunnelDialOptions{InitialPadding: pad, Logger: logger})
+	result.Latency = time.Since(start)
+	if ipConn != nil {
+		ipConn.Close()
+	}
+	if h3conn != nil {
+		h3conn.CloseWithError(http3.ErrCodeNoError, "")
+	}
+	if conn != nil {
+		conn.Close()
 	}
 
+	var rejected *TunnelRejectedError
+	result.HandshakeOK = err == nil || errors.As(err, &rejected)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	result.Success = true
 	return result
 }
 
+// tlsConfig returns the client TLS config of an endpoint test, which
+// authenticates with PrivKey and requires the endpoint to present PeerPubKey
+func (s *Scanner) tlsConfig() (*tls.Config, error) {
+	if s.config.PrivKey == nil || s.config.PeerPubKey == nil {
+		return nil, errors.New("testing MASQUE endpoints requires the device private key and endpoint public key")
+	}
+	certDER, err := generateSelfSignedCert(s.config.PrivKey, AdapterConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	return prepareTLSConfig(s.config.PrivKey, s.config.PeerPubKey, certDER, s.config.SNI, DefaultALPN, true)
+}
+
 // Scan performs the endpoint scan and returns the best endpoint
 func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 	candidates := s.generateCandidates()
@@ -348,6 +589,34 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 		"ping", s.config.PingEnabled,
 	)
 
+	// Cancel in-flight endpoint tests when the scan is stopped or closed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Ping everything up front so only the fastest endpoints get the
+	// expensive connection test, in ping order
+	var pingTimes map[string]time.Duration
+	if s.config.PingEnabled {
+		pinged := len(candidates)
+		var failedPings []ScanResult
+		candidates, pingTimes, failedPings = s.preRank(ctx, candidates)
+		s.resultsMu.Lock()
+		s.results = append(s.results, failedPings...)
+		s.resultsMu.Unlock()
+
+		s.logger.Info("Ping phase complete", "pinged", pinged, "reachable", pinged-len(failedPings), "handshake_candidates", len(candidates))
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("no endpoint answered ping (tried %d)", pinged)
+		}
+	}
+
 	// Create work queue
 	jobs := make(chan string, len(candidates))
 	results := make(chan ScanResult, s.config.Workers)
@@ -356,11 +625,10 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 	var tested, successful, failed atomic.Int32
 
 	// Start workers
-	var wg sync.WaitGroup
 	for i := 0; i < s.config.Workers; i++ {
-		wg.Add(1)
+		s.workers.Add(1)
 		go func(workerID int) {
-			defer wg.Done()
+			defer s.workers.Done()
 			for {
 				select {
 				case endpoint, ok := <-jobs:
@@ -369,7 +637,12 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 					}
 
 					tested.Add(1)
-					result := s.testEndpoint(ctx, endpoint)
+					result := s.testFunc(ctx, endpoint)
+					s.probeTransports(ctx, &result)
+					result.ErrorCategory = categorizeError(result.Error)
+					if rtt, ok := pingTimes[endpoint]; ok {
+						result.PingTime = rtt
+					}
 
 					select {
 					case results <- result:
@@ -390,21 +663,19 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 
 	// Send jobs
 	go func() {
+		defer close(jobs)
 		for _, endpoint := range candidates {
 			select {
 			case jobs <- endpoint:
-			case <-s.stopChan:
-				break
 			case <-ctx.Done():
-				break
+				return
 			}
 		}
-		close(jobs)
 	}()
 
 	// Collect results
 	go func() {
-		wg.Wait()
+		s.workers.Wait()
 		close(results)
 	}()
 
@@ -425,6 +696,7 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 				"endpoint", result.Endpoint,
 				"latency", result.Latency,
 				"ping", result.PingTime,
+				"transports", result.Transports,
 				"tested", tested.Load(),
 			)
 
@@ -432,13 +704,14 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 			if s.config.EarlyExit && !foundWorking {
 				foundWorking = true
 				s.logger.Info("Early exit enabled, stopping scan")
-				close(s.stopChan)
+				s.Stop()
 			}
 		} else {
 			failed.Add(1)
 			if s.config.VerboseChild {
 				s.logger.Debug("✗ Endpoint failed",
 					"endpoint", result.Endpoint,
+					"category", result.ErrorCategory,
 					"error", result.Error,
 					"latency", result.Latency,
 				)
@@ -453,6 +726,7 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 	s.logger.Info("Scan complete",
 		"successful", totalSuccess,
 		"failed", totalFailed,
+		"failures", s.failureCounts(),
 		"tested", totalTested,
 		"total_candidates", len(candidates),
 	)
@@ -463,17 +737,7 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 
 	// Sort by latency and return best
 	sort.Slice(successfulResults, func(i, j int) bool {
-		// Prefer endpoints with successful ping if ping is enabled
-		if s.config.PingEnabled {
-			if successfulResults[i].PingTime > 0 && successfulResults[j].PingTime == 0 {
-				return true
-			}
-			if successfulResults[i].PingTime == 0 && successfulResults[j].PingTime > 0 {
-				return false
-			}
-		}
-		// Sort by connection latency
-		return successfulResults[i].Latency < successfulResults[j].Latency
+		return betterResult(successfulResults[i], successfulResults[j], s.config.PingEnabled)
 	})
 
 	best := successfulResults[0]
@@ -481,6 +745,7 @@ func (s *Scanner) Scan(ctx context.Context) (*ScanResult, error) {
 		"endpoint", best.Endpoint,
 		"latency", best.Latency,
 		"ping", best.PingTime,
+		"transports", best.Transports,
 	)
 
 	return &best, nil
@@ -493,6 +758,14 @@ func (s *Scanner) Stop() {
 	}
 }
 
+// Close stops an ongoing scan and waits for all workers to exit, cancelling
+// any endpoint tests still in flight. It is safe to call more than once.
+func (s *Scanner) Close() error {
+	s.Stop()
+	s.workers.Wait()
+	return nil
+}
+
 // GetResults returns all scan results
 func (s *Scanner) GetResults() []ScanResult {
 	s.resultsMu.Lock()
@@ -500,6 +773,26 @@ func (s *Scanner) GetResults() []ScanResult {
 	return append([]ScanResult{}, s.results...)
 }
 
+// failureCounts summarizes the failed results by category, e.g.
+// "timeout=12 refused=1", to tell an all-blocked scan from an all-down one
+func (s *Scanner) failureCounts() string {
+	s.resultsMu.Lock()
+	defer s.resultsMu.Unlock()
+	counts := make(map[ErrorCategory]int)
+	for _, r := range s.results {
+		if r.ErrorCategory != "" {
+			counts[r.ErrorCategory]++
+		}
+	}
+	var parts []string
+	for _, category := range []ErrorCategory{CategoryTimeout, CategoryRefused, CategoryPinMismatch, CategoryConnectIP403, CategoryUnreachable, CategoryOther} {
+		if counts[category] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", category, counts[category]))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
 // GetSuccessfulResults returns only successful scan results sorted by latency
 func (s *Scanner) GetSuccessfulResults() []ScanResult {
 	s.resultsMu.Lock()
@@ -513,7 +806,7 @@ func (s *Scanner) GetSuccessfulResults() []ScanResult {
 	}
 
 	sort.Slice(successful, func(i, j int) bool {
-		return successful[i].Latency < successful[j].Latency
+		return betterResult(successful[i], successful[j], false)
 	})
 
 	return successful
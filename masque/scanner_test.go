@@ -0,0 +1,395 @@
+package masque
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+func newTestScanner(endpoints []string, test func(ctx context.Context, endpoint string) ScanResult) *Scanner {
+	s := NewScanner(ScannerConfig{
+		CustomEndpoints: endpoints,
+		MaxEndpoints:    len(endpoints),
+		Workers:         4,
+		EarlyExit:       true,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	s.testFunc = test
+	return s
+}
+
+// waitForGoroutines waits until the goroutine count drops back to baseline
+func waitForGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leak: %d running, want <= %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScannerEarlyExitReleasesWorkers(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	endpoints := []string{"192.0.2.1:443", "192.0.2.2:443", "192.0.2.3:443", "192.0.2.4:443", "192.0.2.5:443"}
+	s := newTestScanner(endpoints, func(ctx context.Context, endpoint string) ScanResult {
+		if endpoint == endpoints[0] {
+			return ScanResult{Endpoint: endpoint, Success: true, Latency: time.Millisecond}
+		}
+		// Slow endpoints block until the scan tears them down
+		<-ctx.Done()
+		return ScanResult{Endpoint: endpoint, Error: ctx.Err()}
+	})
+
+	best, err := s.Scan(context.Background())
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if best.Endpoint != endpoints[0] {
+		t.Fatalf("best endpoint = %s, want %s", best.Endpoint, endpoints[0])
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestScannerCloseCancelsScan(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	started := make(chan struct{}, 4)
+	s := newTestScanner([]string{"192.0.2.1:443", "192.0.2.2:443"}, func(ctx context.Context, endpoint string) ScanResult {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ScanResult{Endpoint: endpoint, Error: ctx.Err()}
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Scan(context.Background())
+		done <- err
+	}()
+
+	<-started
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error from a cancelled scan")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Scan did not return after Close")
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestScannerPingPreRankCapsHandshakes(t *testing.T) {
+	rtts := map[string]time.Duration{
+		"192.0.2.1:443": 40 * time.Millisecond,
+		"192.0.2.2:443": 10 * time.Millisecond,
+		"192.0.2.3:443": 0, // unreachable
+		"192.0.2.4:443": 30 * time.Millisecond,
+		"192.0.2.5:443": 20 * time.Millisecond,
+		"192.0.2.6:443": 50 * time.Millisecond,
+	}
+	var endpoints []string
+	for i := 1; i <= len(rtts); i++ {
+		endpoints = append(endpoints, fmt.Sprintf("192.0.2.%d:443", i))
+	}
+
+	var handshakes sync.Map
+	var count atomic.Int32
+	s := newTestScanner(endpoints, func(ctx context.Context, endpoint string) ScanResult {
+		count.Add(1)
+		handshakes.Store(endpoint, true)
+		return ScanResult{Endpoint: endpoint, Success: true, Latency: time.Millisecond}
+	})
+	s.config.EarlyExit = false
+	s.config.PingEnabled = true
+	s.config.HandshakeCandidates = 2
+	var pinged atomic.Int32
+	s.pingFunc = func(ctx context.Context, endpoint string) (time.Duration, error) {
+		pinged.Add(1)
+		if rtts[endpoint] == 0 {
+			return 0, errors.New("connection refused")
+		}
+		return rtts[endpoint], nil
+	}
+
+	best, err := s.Scan(context.Background())
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if pinged.Load() != int32(len(endpoints)) {
+		t.Fatalf("pinged %d endpoints, want all %d", pinged.Load(), len(endpoints))
+	}
+	if count.Load() != 2 {
+		t.Fatalf("ran %d full handshakes, want 2", count.Load())
+	}
+	for _, want := range []string{"192.0.2.2:443", "192.0.2.5:443"} {
+		if _, ok := handshakes.Load(want); !ok {
+			t.Errorf("fastest-pinging endpoint %s was not tested", want)
+		}
+	}
+	if best.PingTime != 10*time.Millisecond && best.PingTime != 20*time.Millisecond {
+		t.Errorf("best endpoint ping time = %s, want one of the two fastest", best.PingTime)
+	}
+
+	var pingFailures int
+	for _, r := range s.GetResults() {
+		if r.Endpoint == "192.0.2.3:443" && r.Error != nil {
+			pingFailures++
+		}
+	}
+	if pingFailures != 1 {
+		t.Errorf("unreachable endpoint recorded %d times, want 1", pingFailures)
+	}
+}
+
+func TestScannerPingAllUnreachable(t *testing.T) {
+	var count atomic.Int32
+	s := newTestScanner([]string{"192.0.2.1:443", "192.0.2.2:443"}, func(ctx context.Context, endpoint string) ScanResult {
+		count.Add(1)
+		return ScanResult{Endpoint: endpoint, Success: true}
+	})
+	s.config.PingEnabled = true
+	s.pingFunc = func(ctx context.Context, endpoint string) (time.Duration, error) {
+		return 0, errors.New("timeout")
+	}
+
+	if _, err := s.Scan(context.Background()); err == nil {
+		t.Fatal("expected an error when no endpoint answers ping")
+	}
+	if count.Load() != 0 {
+		t.Fatalf("ran %d handshakes against unreachable endpoints", count.Load())
+	}
+}
+
+func TestScannerProbeTCPRecordsTransports(t *testing.T) {
+	const (
+		quic    = "192.0.2.1:443"
+		tcpOnly = "192.0.2.2:443"
+		dead    = "192.0.2.3:443"
+	)
+	s := newTestScanner([]string{quic, tcpOnly, dead}, func(ctx context.Context, endpoint string) ScanResult {
+		if endpoint == quic {
+			return ScanResult{Endpoint: endpoint, Success: true, Latency: 50 * time.Millisecond}
+		}
+		return ScanResult{Endpoint: endpoint, Error: errors.New("quic handshake timeout")}
+	})
+	s.config.EarlyExit = false
+	s.config.ProbeTCP = true
+	s.tcpProbeFunc = func(ctx context.Context, endpoint string) (time.Duration, error) {
+		if endpoint == dead {
+			return 0, errors.New("connection refused")
+		}
+		return 5 * time.Millisecond, nil
+	}
+
+	best, err := s.Scan(context.Background())
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if best.Endpoint != quic {
+		t.Fatalf("best endpoint = %s, want %s", best.Endpoint, quic)
+	}
+	if best.Transports != TransportQUIC|TransportHTTP2 {
+		t.Errorf("best transports = %s, want quic+h2", best.Transports)
+	}
+
+	// An endpoint that only answers on TCP:443 has no working tunnel
+	if successful := s.GetSuccessfulResults(); len(successful) != 1 {
+		t.Fatalf("got %d successful results, want 1", len(successful))
+	}
+	for _, r := range s.GetResults() {
+		switch r.Endpoint {
+		case tcpOnly:
+			if r.Success || r.Error == nil || r.Transports != TransportHTTP2 {
+				t.Errorf("TCP-only endpoint recorded as %+v", r)
+			}
+		case dead:
+			if r.Success || r.Transports != 0 {
+				t.Errorf("unreachable endpoint recorded as %+v", r)
+			}
+		}
+	}
+}
+
+// serveTestMasque runs a Connect-IP server on a loopback port that presents
+// a certificate for key and answers Connect-IP requests with status, or
+// accepts them if status is 200
+func serveTestMasque(t *testing.T, key *ecdsa.PrivateKey, status int) string {
+	t.Helper()
+
+	template := uritemplate.MustNew(ConnectURI)
+	proxy := &connectip.Proxy{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := connectip.ParseRequest(r, template, DefaultConnectIPProtocol)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		conn, err := proxy.Proxy(w, req)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+	})
+	return serveTestH3WithKey(t, key, handler, nil).String()
+}
+
+func TestScannerTestsConnectIP(t *testing.T) {
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpointKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	working := serveTestMasque(t, endpointKey, http.StatusOK)
+
+	s := NewScanner(ScannerConfig{
+		CustomEndpoints: []string{working},
+		MaxEndpoints:    1,
+		ScanTimeout:     5 * time.Second,
+		PrivKey:         deviceKey,
+		PeerPubKey:      &endpointKey.PublicKey,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	best, err := s.Scan(context.Background())
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if best.Endpoint != working || !best.HandshakeOK || best.Transports != TransportQUIC || best.Latency <= 0 {
+		t.Errorf("best = %+v, want a working QUIC endpoint %s", best, working)
+	}
+}
+
+func TestScannerCategorizesDialErrors(t *testing.T) {
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpointKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forbidden := serveTestMasque(t, endpointKey, http.StatusForbidden)
+	intercepted := serveTestMasque(t, otherKey, http.StatusOK)
+
+	s := NewScanner(ScannerConfig{
+		CustomEndpoints: []string{forbidden, intercepted},
+		MaxEndpoints:    2,
+		ScanTimeout:     5 * time.Second,
+		PrivKey:         deviceKey,
+		PeerPubKey:      &endpointKey.PublicKey,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if _, err := s.Scan(context.Background()); err == nil {
+		t.Fatal("Scan succeeded without a usable endpoint")
+	}
+	want := map[string]ErrorCategory{forbidden: CategoryConnectIP403, intercepted: CategoryPinMismatch}
+	results := s.GetResults()
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for _, r := range results {
+		if r.ErrorCategory != want[r.Endpoint] {
+			t.Errorf("%s (%v): category %q, want %q", r.Endpoint, r.Error, r.ErrorCategory, want[r.Endpoint])
+		}
+		// The QUIC handshake completes before the Connect-IP request is refused
+		if handshake := r.Endpoint == forbidden; r.HandshakeOK != handshake {
+			t.Errorf("%s: HandshakeOK = %v, want %v", r.Endpoint, r.HandshakeOK, handshake)
+		}
+	}
+}
+
+func TestScannerErrorCategories(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "udp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	failures := map[string]error{
+		"192.0.2.1:443": fmt.Errorf("failed to establish MASQUE tunnel: %w", &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}),
+		"192.0.2.2:443": fmt.Errorf("failed to establish MASQUE tunnel: %w", refused),
+		"192.0.2.3:443": fmt.Errorf("failed to establish MASQUE tunnel: %w",
+			fmt.Errorf("%w: %w", ErrEndpointKeyMismatch, errors.New("remote endpoint has a different public key"))),
+		"192.0.2.4:443": &TunnelRejectedError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"},
+		"192.0.2.5:443": &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)},
+		"192.0.2.6:443": &TunnelRejectedError{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error"},
+		"192.0.2.7:443": nil,
+	}
+	want := map[string]ErrorCategory{
+		"192.0.2.1:443": CategoryTimeout,
+		"192.0.2.2:443": CategoryRefused,
+		"192.0.2.3:443": CategoryPinMismatch,
+		"192.0.2.4:443": CategoryConnectIP403,
+		"192.0.2.5:443": CategoryUnreachable,
+		"192.0.2.6:443": CategoryOther,
+		"192.0.2.7:443": "",
+		// Fails the ping phase instead
+		"192.0.2.8:443": CategoryRefused,
+	}
+
+	var endpoints []string
+	for endpoint := range want {
+		endpoints = append(endpoints, endpoint)
+	}
+	s := newTestScanner(endpoints, func(ctx context.Context, endpoint string) ScanResult {
+		err := failures[endpoint]
+		return ScanResult{Endpoint: endpoint, Success: err == nil, Error: err}
+	})
+	s.config.EarlyExit = false
+	s.config.PingEnabled = true
+	s.pingFunc = func(ctx context.Context, endpoint string) (time.Duration, error) {
+		if endpoint == "192.0.2.8:443" {
+			return 0, refused
+		}
+		return time.Millisecond, nil
+	}
+
+	if _, err := s.Scan(context.Background()); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	results := s.GetResults()
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for _, r := range results {
+		if r.ErrorCategory != want[r.Endpoint] {
+			t.Errorf("%s (%v): category %q, want %q", r.Endpoint, r.Error, r.ErrorCategory, want[r.Endpoint])
+		}
+	}
+	if got, want := s.failureCounts(), "timeout=1 refused=2 tls-pin-mismatch=1 connect-ip-403=1 unreachable=1 other=1"; got != want {
+		t.Errorf("failureCounts() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+package masque
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSessionCacheSize is how many TLS sessions a SessionCache keeps
+const DefaultSessionCacheSize = 32
+
+// savedSession is a session ticket as persisted by SessionCache
+type savedSession struct {
+	Ticket  []byte    `json:"ticket"`
+	State   []byte    `json:"state"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// SessionCache is a TLS client session cache for MASQUE tunnels, so a
+// reconnect to the same endpoint resumes the previous TLS session instead of
+// running a full handshake. If it has a path, tickets are loaded from and
+// persisted to that file so resumption also works across restarts.
+//
+// Tunnels are dialed with quic.Dial, which returns only once the handshake is
+// complete, so the Connect-IP request is never sent as replayable 0-RTT data.
+type SessionCache struct {
+	mu       sync.Mutex
+	path     string
+	sessions tls.ClientSessionCache
+	saved    map[string]savedSession
+	now      func() time.Time
+}
+
+// NewSessionCache creates an empty session cache. If statePath is not empty,
+// tickets are loaded from and persisted to that file.
+func NewSessionCache(statePath string) *SessionCache {
+	c := &SessionCache{
+		path:     statePath,
+		sessions: tls.NewLRUClientSessionCache(DefaultSessionCacheSize),
+		saved:    make(map[string]savedSession),
+		now:      time.Now,
+	}
+
+	if statePath != "" {
+		if data, err := os.ReadFile(statePath); err == nil {
+			_ = json.Unmarshal(data, &c.saved)
+		}
+		for key, s := range c.saved {
+			state, err := tls.ParseSessionState(s.State)
+			if err != nil {
+				delete(c.saved, key)
+				continue
+			}
+			cs, err := tls.NewResumptionState(s.Ticket, state)
+			if err != nil {
+				delete(c.saved, key)
+				continue
+			}
+			c.sessions.Put(key, cs)
+		}
+	}
+
+	return c
+}
+
+// Get implements tls.ClientSessionCache
+func (c *SessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessions.Get(sessionKey)
+}
+
+// Put implements tls.ClientSessionCache; a nil cs removes the session
+func (c *SessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sessions.Put(sessionKey, cs)
+	if c.path == "" {
+		return
+	}
+
+	if cs == nil {
+		delete(c.saved, sessionKey)
+	} else if s, ok := encodeSession(cs); ok {
+		s.SavedAt = c.now()
+		c.saved[sessionKey] = s
+		c.evict()
+	}
+	c.save()
+}
+
+// encodeSession serializes a session for persisting
+func encodeSession(cs *tls.ClientSessionState) (savedSession, bool) {
+	ticket, state, err := cs.ResumptionState()
+	if err != nil || state == nil {
+		return savedSession{}, false
+	}
+	data, err := state.Bytes()
+	if err != nil {
+		return savedSession{}, false
+	}
+	return savedSession{Ticket: ticket, State: data}, true
+}
+
+// evict drops the oldest persisted sessions beyond DefaultSessionCacheSize;
+// callers must hold c.mu
+func (c *SessionCache) evict() {
+	if len(c.saved) <= DefaultSessionCacheSize {
+		return
+	}
+	keys := make([]string, 0, len(c.saved))
+	for key := range c.saved {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.saved[keys[i]].SavedAt.Before(c.saved[keys[j]].SavedAt) })
+	for _, key := range keys[:len(keys)-DefaultSessionCacheSize] {
+		delete(c.saved, key)
+	}
+}
+
+// save persists the saved sessions; callers must hold c.mu
+func (c *SessionCache) save() {
+	data, err := json.Marshal(c.saved)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return
+	}
+	// Tickets carry the resumption secret, keep them private
+	_ = os.WriteFile(c.path, data, 0o600)
+}
+
+// endpointSessionCache scopes a session cache to one endpoint, client key and
+// pinning mode. TLS keys sessions by SNI, which every MASQUE endpoint shares;
+// a resumed session keeps the client identity it was established with; and a
+// session established without public key pinning must never be resumed on a
+// pinned connection, since resumption skips the certificate check.
+type endpointSessionCache struct {
+	cache tls.ClientSessionCache
+	scope string
+}
+
+// scopeSessionCache returns cache scoped to endpoint, the client key and pin
+func scopeSessionCache(cache tls.ClientSessionCache, endpoint string, clientKey *ecdsa.PrivateKey, pin bool) tls.ClientSessionCache {
+	var keyID string
+	if der, err := x509.MarshalPKIXPublicKey(&clientKey.PublicKey); err == nil {
+		sum := sha256.Sum256(der)
+		keyID = hex.EncodeToString(sum[:8])
+	}
+	return endpointSessionCache{cache: cache, scope: endpoint + "|" + keyID + "|pin=" + strconv.FormatBool(pin) + "|"}
+}
+
+func (c endpointSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.scope + sessionKey)
+}
+
+func (c endpointSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.scope+sessionKey, cs)
+}
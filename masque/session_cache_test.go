@@ -0,0 +1,89 @@
+package masque
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// dialResumable opens a QUIC connection to addr through cache, waits until
+// the server's session ticket is cached and reports whether the handshake
+// resumed a previous session
+func dialResumable(t *testing.T, addr *net.UDPAddr, cache tls.ClientSessionCache) bool {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr.String(), &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "localhost",
+		NextProtos:         []string{http3.NextProtoH3},
+		ClientSessionCache: cache,
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("quic dial: %v", err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	// The ticket arrives after the handshake
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := cache.Get("localhost"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no session ticket was cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conn.ConnectionState().TLS.DidResume
+}
+
+func TestSessionCacheResumesSession(t *testing.T) {
+	addr := serveTestH3(t, http.NotFoundHandler(), nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "session_tickets.json")
+
+	cache := NewSessionCache(path)
+	scoped := scopeSessionCache(cache, addr.String(), key, true)
+	if dialResumable(t, addr, scoped) {
+		t.Fatal("first connection resumed a session")
+	}
+	if !dialResumable(t, addr, scoped) {
+		t.Error("second connection did not resume the cached session")
+	}
+
+	// A fresh cache on the same file resumes the persisted ticket
+	restarted := scopeSessionCache(NewSessionCache(path), addr.String(), key, true)
+	if !dialResumable(t, addr, restarted) {
+		t.Error("connection after restart did not resume the persisted session")
+	}
+
+	// Sessions are not shared across endpoints, client keys or pinning modes
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]tls.ClientSessionCache{
+		"endpoint":   scopeSessionCache(cache, "192.0.2.1:443", key, true),
+		"client key": scopeSessionCache(cache, addr.String(), other, true),
+		"unpinned":   scopeSessionCache(cache, addr.String(), key, false),
+	} {
+		if _, ok := c.Get("localhost"); ok {
+			t.Errorf("session shared with a different %s", name)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/voidr3aper-anon/Vwarp/iputils"
+)
+
+// maxSourcePortAttempts bounds how many ports of a range are tried before giving up
+const maxSourcePortAttempts = 64
+
+// lastStableSourcePort remembers the port of the last QUIC socket bound with
+// StableSourcePort so reconnects come from the same port (NAT pinning)
+var lastStableSourcePort atomic.Int32
+
+// validateSourcePortRange checks an inclusive [low, high] port range.
+// The zero range means "any ephemeral port".
+func validateSourcePortRange(portRange [2]int) error {
+	if portRange == [2]int{} {
+		return nil
+	}
+	low, high := portRange[0], portRange[1]
+	if low < 1 || high > 65535 || low > high {
+		return fmt.Errorf("invalid source port range %d-%d", low, high)
+	}
+	return nil
+}
+
+func portInRange(port int, portRange [2]int) bool {
+	return portRange == [2]int{} || (port >= portRange[0] && port <= portRange[1])
+}
+
+// validateFixedLocalPort checks cfg.FixedLocalPort, which must be free in
+// both address families: the endpoint, and so the family of the socket, is
+// only known once the adapter connects
+func validateFixedLocalPort(cfg AdapterConfig) error {
+	port := cfg.FixedLocalPort
+	if port == 0 {
+		return nil
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid fixed local port %d", port)
+	}
+	if cfg.SourcePortRange != ([2]int{}) {
+		return errors.New("a fixed local port and a source port range can't be used together")
+	}
+	for _, ip := range []net.IP{net.IPv4zero, net.IPv6zero} {
+		conn, err := listenQUICSocket(&net.UDPAddr{IP: ip}, "", [2]int{port, port}, false)
+		if err != nil {
+			if ip.To4() == nil && !ipv6Available() {
+				continue
+			}
+			return fmt.Errorf("fixed local port %d is not available: %w", port, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// ipv6Available reports whether the host can bind IPv6 UDP sockets at all
+func ipv6Available() bool {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// listenQUICSocket binds the local UDP socket used to reach endpoint.
+// With egressIface set, it is bound to that interface's address of the
+// endpoint's family, so the tunnel leaves through that uplink.
+// Its buffers are enlarged for QUIC before it is bound.
+// With a port range, a random free port inside it is used. A port in use is
+// never shared: a reconnect gets a fixed port back because the previous
+// tunnel is closed first. With stable set, the port bound last time is reused
+// when it is still free and in range.
+func listenQUICSocket(endpoint *net.UDPAddr, egressIface string, portRange [2]int, stable bool) (*net.UDPConn, error) {
+	if err := validateSourcePortRange(portRange); err != nil {
+		return nil, err
+	}
+
+	v6 := endpoint.IP.To4() == nil
+	ip := net.IPv4zero
+	if v6 {
+		ip = net.IPv6zero
+	}
+	if egressIface != "" {
+		// Resolved on every bind, so a reconnect follows an address change
+		addr, err := iputils.InterfaceAddr(egressIface, v6)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind egress interface: %w", err)
+		}
+		ip = addr.AsSlice()
+	}
+	lc := quicListenConfig()
+	listen := func(port int) (*net.UDPConn, error) {
+		conn, err := lc.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.UDPConn), nil
+	}
+
+	var conn *net.UDPConn
+	if stable {
+		if port := int(lastStableSourcePort.Load()); port != 0 && portInRange(port, portRange) {
+			conn, _ = listen(port)
+		}
+	}
+
+	if conn == nil && portRange == [2]int{} {
+		var err error
+		if conn, err = listen(0); err != nil {
+			return nil, err
+		}
+	}
+
+	if conn == nil {
+		size := portRange[1] - portRange[0] + 1
+		offset := rand.Intn(size)
+		var err error
+		for i := 0; i < size && i < maxSourcePortAttempts; i++ {
+			port := portRange[0] + (offset+i)%size
+			if conn, err = listen(port); err == nil {
+				break
+			}
+		}
+		if conn == nil {
+			return nil, fmt.Errorf("failed to bind a source port in %d-%d: %w", portRange[0], portRange[1], err)
+		}
+	}
+
+	if stable {
+		lastStableSourcePort.Store(int32(conn.LocalAddr().(*net.UDPAddr).Port))
+	}
+	return conn, nil
+}
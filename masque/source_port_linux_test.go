@@ -0,0 +1,82 @@
+package masque
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/voidr3aper-anon/Vwarp/iputils"
+)
+
+func TestListenQUICSocketEgressInterface(t *testing.T) {
+	want, err := iputils.InterfaceAddr("lo", false)
+	if err != nil {
+		t.Skipf("no IPv4 loopback interface: %v", err)
+	}
+
+	conn, err := listenQUICSocket(loopbackEndpoint, "lo", [2]int{}, false)
+	if err != nil {
+		t.Fatalf("listenQUICSocket: %v", err)
+	}
+	defer conn.Close()
+	got, _ := netip.AddrFromSlice(conn.LocalAddr().(*net.UDPAddr).IP)
+	if got.Unmap() != want {
+		t.Fatalf("socket bound to %s, want the lo address %s", got, want)
+	}
+}
+
+func TestListenQUICSocketUnknownEgressInterface(t *testing.T) {
+	if conn, err := listenQUICSocket(loopbackEndpoint, "vwarp-missing0", [2]int{}, false); err == nil {
+		conn.Close()
+		t.Fatal("listenQUICSocket bound a socket for a missing interface")
+	}
+}
+
+func TestListenQUICSocketFixedPortWhileOldSocketOpen(t *testing.T) {
+	port := freeUDPPort(t)
+	old, err := listenQUICSocket(loopbackEndpoint, "", [2]int{port, port}, false)
+	if err != nil {
+		t.Fatalf("listenQUICSocket: %v", err)
+	}
+	defer old.Close()
+
+	// Sharing the port would split the old connection's datagrams between
+	// the two sockets, a reconnect must close the old one first
+	if fresh, err := listenQUICSocket(loopbackEndpoint, "", [2]int{port, port}, false); err == nil {
+		fresh.Close()
+		t.Fatal("bound the fixed port while the old socket still holds it")
+	}
+}
+
+func TestListenQUICSocketRequestsUDPBuffers(t *testing.T) {
+	// Without CAP_NET_ADMIN the kernel caps the request at *mem_max, and
+	// reports double what it keeps for its own bookkeeping
+	want := udpBufferSize
+	for _, sysctl := range []string{"rmem_max", "wmem_max"} {
+		b, err := os.ReadFile("/proc/sys/net/core/" + sysctl)
+		if err != nil {
+			t.Skipf("can't read net.core.%s: %v", sysctl, err)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = min(want, limit)
+	}
+
+	conn, err := listenQUICSocket(loopbackEndpoint, "", [2]int{}, false)
+	if err != nil {
+		t.Fatalf("listenQUICSocket: %v", err)
+	}
+	defer conn.Close()
+	rcv, snd, err := udpBufferSizes(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcv < 2*want || snd < 2*want {
+		t.Fatalf("socket buffers receive %d, send %d, want at least %d", rcv, snd, 2*want)
+	}
+}
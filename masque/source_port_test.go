@@ -0,0 +1,151 @@
+package masque
+
+import (
+	"net"
+	"testing"
+)
+
+var loopbackEndpoint = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+
+func boundPort(conn *net.UDPConn) int {
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestListenQUICSocketPortRange(t *testing.T) {
+	portRange := [2]int{42000, 42015}
+	for i := 0; i < 8; i++ {
+		conn, err := listenQUICSocket(loopbackEndpoint, "", portRange, false)
+		if err != nil {
+			t.Fatalf("listenQUICSocket: %v", err)
+		}
+		port := boundPort(conn)
+		conn.Close()
+		if port < portRange[0] || port > portRange[1] {
+			t.Fatalf("bound port %d outside %v", port, portRange)
+		}
+	}
+}
+
+func TestListenQUICSocketRangeExhausted(t *testing.T) {
+	// Occupy the only port in the range
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer busy.Close()
+	port := boundPort(busy)
+
+	if conn, err := listenQUICSocket(loopbackEndpoint, "", [2]int{port, port}, false); err == nil {
+		conn.Close()
+		t.Fatal("expected an error when every port in the range is taken")
+	}
+}
+
+func TestListenQUICSocketStablePort(t *testing.T) {
+	lastStableSourcePort.Store(0)
+	t.Cleanup(func() { lastStableSourcePort.Store(0) })
+
+	first, err := listenQUICSocket(loopbackEndpoint, "", [2]int{}, true)
+	if err != nil {
+		t.Fatalf("listenQUICSocket: %v", err)
+	}
+	port := boundPort(first)
+	first.Close()
+
+	// A reconnect reuses the previous port
+	second, err := listenQUICSocket(loopbackEndpoint, "", [2]int{}, true)
+	if err != nil {
+		t.Fatalf("listenQUICSocket: %v", err)
+	}
+	defer second.Close()
+	if got := boundPort(second); got != port {
+		t.Fatalf("reconnect bound port %d, want %d", got, port)
+	}
+
+	// While the port is still held, a fresh one is chosen instead of failing
+	third, err := listenQUICSocket(loopbackEndpoint, "", [2]int{}, true)
+	if err != nil {
+		t.Fatalf("listenQUICSocket: %v", err)
+	}
+	third.Close()
+}
+
+// freeUDPPort returns a port nothing is bound to right now
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	return boundPort(conn)
+}
+
+func TestListenQUICSocketFixedPort(t *testing.T) {
+	port := freeUDPPort(t)
+	cfg := AdapterConfig{FixedLocalPort: port}
+	if err := validateFixedLocalPort(cfg); err != nil {
+		t.Fatalf("validateFixedLocalPort: %v", err)
+	}
+
+	first, err := listenQUICSocket(loopbackEndpoint, "", [2]int{port, port}, false)
+	if err != nil {
+		t.Fatalf("listenQUICSocket: %v", err)
+	}
+	if got := boundPort(first); got != port {
+		t.Fatalf("bound port %d, want the fixed port %d", got, port)
+	}
+	first.Close()
+
+	// A reconnect binds the same port again
+	second, err := listenQUICSocket(loopbackEndpoint, "", [2]int{port, port}, false)
+	if err != nil {
+		t.Fatalf("listenQUICSocket after reconnect: %v", err)
+	}
+	defer second.Close()
+	if got := boundPort(second); got != port {
+		t.Fatalf("reconnect bound port %d, want the fixed port %d", got, port)
+	}
+}
+
+func TestValidateFixedLocalPort(t *testing.T) {
+	// Held by a socket that doesn't allow reuse
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer busy.Close()
+
+	cases := map[string]AdapterConfig{
+		"out of range":    {FixedLocalPort: 70000},
+		"negative":        {FixedLocalPort: -1},
+		"with a range":    {FixedLocalPort: 42000, SourcePortRange: [2]int{42000, 42010}},
+		"taken, no reuse": {FixedLocalPort: boundPort(busy)},
+	}
+	// The endpoint may turn out to be IPv6, so the port must be free there too
+	if busy6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err == nil {
+		defer busy6.Close()
+		cases["taken over IPv6"] = AdapterConfig{FixedLocalPort: boundPort(busy6)}
+	}
+	for name, cfg := range cases {
+		if err := validateFixedLocalPort(cfg); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if err := validateFixedLocalPort(AdapterConfig{}); err != nil {
+		t.Errorf("no fixed port rejected: %v", err)
+	}
+}
+
+func TestValidateSourcePortRange(t *testing.T) {
+	for _, r := range [][2]int{{0, 100}, {2000, 1000}, {1000, 70000}} {
+		if err := validateSourcePortRange(r); err == nil {
+			t.Errorf("range %v accepted", r)
+		}
+	}
+	for _, r := range [][2]int{{}, {1, 65535}, {5000, 5000}} {
+		if err := validateSourcePortRange(r); err != nil {
+			t.Errorf("range %v rejected: %v", r, err)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package masque
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+)
+
+const (
+	// DefaultTestTimeout bounds each check of RunTestSuite waiting for a reply
+	DefaultTestTimeout = 3 * time.Second
+	// testEchoPayload is the payload size of the plain ICMP echo check
+	testEchoPayload = 56
+)
+
+// DefaultTestPingTarget is the address RunTestSuite echoes through the tunnel
+var DefaultTestPingTarget = netip.MustParseAddr("1.1.1.1")
+
+// TestOptions configures RunTestSuite
+type TestOptions struct {
+	// PingTarget is the IPv4 address echoed through the tunnel
+	// (optional, DefaultTestPingTarget if not set)
+	PingTarget netip.Addr
+	// Timeout bounds each check waiting for a reply (optional, DefaultTestTimeout if zero)
+	Timeout time.Duration
+}
+
+// TestResult is the outcome of one check of the connection test suite
+type TestResult struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Message  string        `json:"message,omitempty"`
+}
+
+// SuiteResult is the outcome of RunTestSuite
+type SuiteResult struct {
+	Endpoint string        `json:"endpoint"`
+	Source   netip.Addr    `json:"source"`
+	Target   netip.Addr    `json:"target"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Results  []TestResult  `json:"results"`
+}
+
+// Passed reports whether no check of the suite failed
+func (s *SuiteResult) Passed() bool {
+	for _, r := range s.Results {
+		if !r.Passed && !r.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// RunTestSuite checks an established MASQUE tunnel: the addresses and routes
+// the server assigned, an ICMP echo through the tunnel and an echo padded to
+// the tunnel MTU. A failing check is recorded in the result, not returned;
+// the error is only set if the suite could not run or ctx ended.
+//
+// The suite reads packets from m, so it should get an adapter of its own. A
+// read left pending when it returns ends when the adapter is closed.
+func RunTestSuite(ctx context.Context, m *MasqueAdapter, opts TestOptions) (*SuiteResult, error) {
+	if m == nil {
+		return nil, errors.New("no MASQUE adapter to test")
+	}
+	if !opts.PingTarget.IsValid() {
+		opts.PingTarget = DefaultTestPingTarget
+	}
+	if !opts.PingTarget.Is4() {
+		return nil, fmt.Errorf("ping target %s is not an IPv4 address", opts.PingTarget)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTestTimeout
+	}
+
+	m.mu.RLock()
+	endpoint := m.endpoint
+	m.mu.RUnlock()
+
+	suite := &SuiteResult{Endpoint: endpoint, Target: opts.PingTarget, Started: time.Now()}
+	defer func() { suite.Duration = time.Since(suite.Started) }()
+
+	var addrs TestResult
+	suite.Source, addrs = checkTunnelAddrs(m)
+	suite.Results = append(suite.Results, addrs, checkRoutes(m, opts.PingTarget))
+	if !suite.Source.IsValid() {
+		suite.Results = append(suite.Results,
+			skipped("icmp-echo", "no IPv4 tunnel address"),
+			skipped("mtu", "no IPv4 tunnel address"))
+		return suite, nil
+	}
+
+	p := newEchoPinger(m, suite.Source, opts.PingTarget)
+	defer p.stop()
+
+	echo := p.check(ctx, "icmp-echo", testEchoPayload, opts.Timeout)
+	suite.Results = append(suite.Results, echo)
+	if !echo.Passed {
+		suite.Results = append(suite.Results, skipped("mtu", "ICMP echo failed"))
+	} else {
+		mtu := m.tunnelMTU()
+		suite.Results = append(suite.Results, p.check(ctx, "mtu", mtu-ipv4HeaderLen-icmpHeaderLen, opts.Timeout))
+	}
+	return suite, ctx.Err()
+}
+
+func skipped(name, message string) TestResult {
+	return TestResult{Name: name, Skipped: true, Message: message}
+}
+
+// checkTunnelAddrs returns the IPv4 source address of the tunnel, preferring
+// the one the server assigned over the one in the config
+func checkTunnelAddrs(m *MasqueAdapter) (netip.Addr, TestResult) {
+	result := TestResult{Name: "tunnel-addresses"}
+	if v4, v6, ok := m.LocalTunnelAddrs(); ok {
+		result.Passed = true
+		result.Message = fmt.Sprintf("assigned by server: %s %s", v4, v6)
+		return v4, result
+	}
+
+	v4str, v6str := m.GetLocalAddresses()
+	v4, err := netip.ParseAddr(v4str)
+	if err != nil {
+		result.Message = "server assigned no address and the config has no IPv4 address"
+		return netip.Addr{}, result
+	}
+	result.Passed = true
+	result.Message = fmt.Sprintf("from config, server assigned none: %s %s", v4str, v6str)
+	return v4, result
+}
+
+// checkRoutes checks that the advertised routes, if any, cover target
+func checkRoutes(m *MasqueAdapter, target netip.Addr) TestResult {
+	routes := m.AssignedRoutes()
+	if routes == nil {
+		return skipped("routes", "server advertised no routes")
+	}
+	for _, r := range routes {
+		if r.Contains(target) {
+			return TestResult{Name: "routes", Passed: true, Message: fmt.Sprintf("%d routes, %s covers %s", len(routes), r, target)}
+		}
+	}
+	return TestResult{Name: "routes", Message: fmt.Sprintf("none of %d advertised routes covers %s", len(routes), target)}
+}
+
+const (
+	ipv4HeaderLen = 20
+	icmpHeaderLen = 8
+	icmpEcho      = 8
+	icmpEchoReply = 0
+)
+
+// echoPinger sends ICMP echo requests through the tunnel and matches the
+// replies a single reader goroutine collects
+type echoPinger struct {
+	m        *MasqueAdapter
+	src, dst netip.Addr
+	id, seq  uint16
+	replies  chan []byte
+	done     chan struct{}
+}
+
+func newEchoPinger(m *MasqueAdapter, src, dst netip.Addr) *echoPinger {
+	p := &echoPinger{
+		m:       m,
+		src:     src,
+		dst:     dst,
+		id:      uint16(rand.Uint32()),
+		replies: make(chan []byte, 16),
+		done:    make(chan struct{}),
+	}
+	go p.read()
+	return p
+}
+
+func (p *echoPinger) read() {
+	for {
+		buf := make([]byte, 65535)
+		n, err := p.m.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case p.replies <- buf[:n]:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *echoPinger) stop() {
+	close(p.done)
+}
+
+// check sends one echo request with size bytes of payload and waits for its reply
+func (p *echoPinger) check(ctx context.Context, name string, size int, timeout time.Duration) TestResult {
+	result := TestResult{Name: name}
+	p.seq++
+	pkt := p.echoRequest(size)
+
+	start := time.Now()
+	if _, err := p.m.Write(pkt); err != nil {
+		result.Message = fmt.Sprintf("failed to send %d byte echo: %v", len(pkt), err)
+		return result
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case reply := <-p.replies:
+			if !p.isReply(reply) {
+				continue
+			}
+			result.Duration = time.Since(start)
+			result.Passed = true
+			result.Message = fmt.Sprintf("%d byte echo answered by %s in %s", len(pkt), p.dst, result.Duration.Round(time.Millisecond))
+			return result
+		case <-timer.C:
+			result.Message = fmt.Sprintf("no reply to %d byte echo within %s", len(pkt), timeout)
+			return result
+		case <-ctx.Done():
+			result.Message = ctx.Err().Error()
+			return result
+		}
+	}
+}
+
+// echoRequest builds an IPv4 ICMP echo request from src to dst
+func (p *echoPinger) echoRequest(size int) []byte {
+	pkt := make([]byte, ipv4HeaderLen+icmpHeaderLen+size)
+	pkt[0] = 0x45 // version 4, 5 word header
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[6:], 0x4000) // don't fragment
+	pkt[8] = 64                                 // TTL, decremented by connect-ip
+	pkt[9] = 1                                  // ICMP
+	src, dst := p.src.As4(), p.dst.As4()
+	copy(pkt[12:16], src[:])
+	copy(pkt[16:20], dst[:])
+	binary.BigEndian.PutUint16(pkt[10:], inetChecksum(pkt[:ipv4HeaderLen]))
+
+	icmp := pkt[ipv4HeaderLen:]
+	icmp[0] = icmpEcho
+	binary.BigEndian.PutUint16(icmp[4:], p.id)
+	binary.BigEndian.PutUint16(icmp[6:], p.seq)
+	for i := range size {
+		icmp[icmpHeaderLen+i] = byte(i)
+	}
+	binary.BigEndian.PutUint16(icmp[2:], inetChecksum(icmp))
+	return pkt
+}
+
+// isReply reports whether pkt answers the last echo request
+func (p *echoPinger) isReply(pkt []byte) bool {
+	if len(pkt) < ipv4HeaderLen+icmpHeaderLen || pkt[0]>>4 != 4 || pkt[9] != 1 {
+		return false
+	}
+	hlen := int(pkt[0]&0x0f) * 4
+	if len(pkt) < hlen+icmpHeaderLen || netip.AddrFrom4([4]byte(pkt[12:16])) != p.dst {
+		return false
+	}
+	icmp := pkt[hlen:]
+	return icmp[0] == icmpEchoReply &&
+		binary.BigEndian.Uint16(icmp[4:]) == p.id &&
+		binary.BigEndian.Uint16(icmp[6:]) == p.seq
+}
+
+// inetChecksum is the RFC 1071 Internet checksum of b
+func inetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,138 @@
+package masque
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+)
+
+// echoICMP answers the ICMP echo requests a client sends over conn, as a
+// Connect-IP server routing to a pingable Internet would
+func echoICMP(conn *connectip.Conn) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.ReadPacket(buf, true)
+		if err != nil {
+			return
+		}
+		pkt := buf[:n]
+		if n < ipv4HeaderLen+icmpHeaderLen || pkt[9] != 1 || pkt[ipv4HeaderLen] != icmpEcho {
+			continue
+		}
+		var src [4]byte
+		copy(src[:], pkt[12:16])
+		copy(pkt[12:16], pkt[16:20])
+		copy(pkt[16:20], src[:])
+		pkt[8] = 64
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:], inetChecksum(pkt[:ipv4HeaderLen]))
+
+		icmp := pkt[ipv4HeaderLen:]
+		icmp[0] = icmpEchoReply
+		icmp[2], icmp[3] = 0, 0
+		binary.BigEndian.PutUint16(icmp[2:], inetChecksum(icmp))
+		if _, err := conn.WritePacket(pkt); err != nil {
+			return
+		}
+	}
+}
+
+func testSuiteAdapter(t *testing.T, serve func(*connectip.Conn)) *MasqueAdapter {
+	t.Helper()
+	ipConn := dialTestConnectIP(t,
+		[]netip.Prefix{netip.MustParsePrefix("172.16.0.2/32")},
+		[]connectip.IPRoute{{StartIP: netip.MustParseAddr("0.0.0.0"), EndIP: netip.MustParseAddr("255.255.255.255")}},
+		serve)
+	ctx := context.Background()
+	v4, v6 := assignedTunnelAddrs(ctx, ipConn, 5*time.Second)
+	return &MasqueAdapter{
+		ipConn:     ipConn,
+		endpoint:   "test",
+		mtu:        1000,
+		assignedV4: v4,
+		assignedV6: v6,
+		routes:     advertisedRoutes(ctx, ipConn, 5*time.Second),
+	}
+}
+
+func resultsByName(suite *SuiteResult) map[string]TestResult {
+	results := make(map[string]TestResult)
+	for _, r := range suite.Results {
+		results[r.Name] = r
+	}
+	return results
+}
+
+func TestRunTestSuite(t *testing.T) {
+	m := testSuiteAdapter(t, echoICMP)
+
+	suite, err := RunTestSuite(context.Background(), m, TestOptions{})
+	if err != nil {
+		t.Fatalf("RunTestSuite: %v", err)
+	}
+	if !suite.Passed() {
+		t.Fatalf("suite failed: %+v", suite.Results)
+	}
+	if suite.Endpoint != "test" || suite.Source != netip.MustParseAddr("172.16.0.2") || suite.Target != DefaultTestPingTarget {
+		t.Errorf("suite = endpoint %s source %s target %s", suite.Endpoint, suite.Source, suite.Target)
+	}
+
+	results := resultsByName(suite)
+	for _, name := range []string{"tunnel-addresses", "routes", "icmp-echo", "mtu"} {
+		r, ok := results[name]
+		if !ok || !r.Passed || r.Skipped {
+			t.Errorf("%s = %+v, want passed", name, r)
+		}
+	}
+	if results["icmp-echo"].Duration <= 0 {
+		t.Error("icmp-echo recorded no round trip time")
+	}
+}
+
+func TestRunTestSuiteNoReply(t *testing.T) {
+	m := testSuiteAdapter(t, nil)
+
+	suite, err := RunTestSuite(context.Background(), m, TestOptions{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("RunTestSuite: %v", err)
+	}
+	if suite.Passed() {
+		t.Fatal("suite passed without echo replies")
+	}
+	results := resultsByName(suite)
+	if r := results["icmp-echo"]; r.Passed || r.Skipped {
+		t.Errorf("icmp-echo = %+v, want failed", r)
+	}
+	if r := results["mtu"]; !r.Skipped {
+		t.Errorf("mtu = %+v, want skipped after the echo failed", r)
+	}
+}
+
+func TestRunTestSuiteRoutes(t *testing.T) {
+	m := testSuiteAdapter(t, echoICMP)
+
+	suite, err := RunTestSuite(context.Background(), m, TestOptions{PingTarget: netip.MustParseAddr("10.0.0.1")})
+	if err != nil {
+		t.Fatalf("RunTestSuite: %v", err)
+	}
+	if r := resultsByName(suite)["routes"]; !r.Passed {
+		t.Errorf("routes = %+v, want 10.0.0.1 covered by 0.0.0.0/0", r)
+	}
+
+	m.routes = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	suite, err = RunTestSuite(context.Background(), m, TestOptions{})
+	if err != nil {
+		t.Fatalf("RunTestSuite: %v", err)
+	}
+	if r := resultsByName(suite)["routes"]; r.Passed || r.Skipped {
+		t.Errorf("routes = %+v, want failed for %s", r, DefaultTestPingTarget)
+	}
+
+	if _, err := RunTestSuite(context.Background(), m, TestOptions{PingTarget: netip.MustParseAddr("2606:4700::1111")}); err == nil {
+		t.Error("RunTestSuite accepted an IPv6 ping target")
+	}
+}
@@ -0,0 +1,147 @@
+package masque
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+)
+
+// assignedAddrsTimeout bounds the wait for the server's ADDRESS_ASSIGN and
+// ROUTE_ADVERTISEMENT capsules
+const assignedAddrsTimeout = time.Second
+
+// prefixAssigner is implemented by *connectip.Conn
+type prefixAssigner interface {
+	LocalPrefixes(ctx context.Context) ([]netip.Prefix, error)
+	Routes(ctx context.Context) ([]connectip.IPRoute, error)
+}
+
+// assignedTunnelAddrs waits up to timeout for the prefixes the server assigns
+// with ADDRESS_ASSIGN and returns the first IPv4 and IPv6 address among them.
+// Both are invalid if the server sent no assignment in time.
+func assignedTunnelAddrs(ctx context.Context, conn prefixAssigner, timeout time.Duration) (v4, v6 netip.Addr) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	prefixes, err := conn.LocalPrefixes(ctx)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}
+	}
+	for _, p := range prefixes {
+		addr := p.Addr().Unmap()
+		switch {
+		case addr.Is4() && !v4.IsValid():
+			v4 = addr
+		case addr.Is6() && !v6.IsValid():
+			v6 = addr
+		}
+	}
+	return v4, v6
+}
+
+// advertisedRoutes waits up to timeout for the routes the server advertises
+// with ROUTE_ADVERTISEMENT and returns them as prefixes, nil if none came.
+func advertisedRoutes(ctx context.Context, conn prefixAssigner, timeout time.Duration) []netip.Prefix {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	routes, err := conn.Routes(ctx)
+	if err != nil {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	for _, r := range routes {
+		prefixes = append(prefixes, rangePrefixes(r.StartIP, r.EndIP)...)
+	}
+	return prefixes
+}
+
+// TunnelAssignments keeps the Connect-IP addresses and routes of the first
+// tunnel that comes up, so later tunnels of the same device use them instead
+// of waiting for the capsules again. The server assigns a device the same
+// addresses on every tunnel. The zero value is ready to use.
+type TunnelAssignments struct {
+	mu     sync.Mutex
+	known  bool
+	v4, v6 netip.Addr
+	routes []netip.Prefix
+}
+
+// get returns the cached assignments, or waits up to timeout for the ones
+// the server sends on conn and caches them. Once a tunnel came up without
+// assignments, later ones aren't waited for either.
+func (a *TunnelAssignments) get(ctx context.Context, conn prefixAssigner, timeout time.Duration) (v4, v6 netip.Addr, routes []netip.Prefix) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.known {
+		return a.v4, a.v6, a.routes
+	}
+
+	// The capsules arrive independently, wait for both at once
+	routesDone := make(chan struct{})
+	go func() {
+		routes = advertisedRoutes(ctx, conn, timeout)
+		close(routesDone)
+	}()
+	v4, v6 = assignedTunnelAddrs(ctx, conn, timeout)
+	<-routesDone
+	if ctx.Err() == nil {
+		a.known, a.v4, a.v6, a.routes = true, v4, v6, routes
+	}
+	return v4, v6, routes
+}
+
+// rangePrefixes returns the smallest set of prefixes covering start-end
+func rangePrefixes(start, end netip.Addr) []netip.Prefix {
+	if !start.IsValid() || start.BitLen() != end.BitLen() || end.Less(start) {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	for {
+		// Grow the prefix at start while it stays aligned and within the range
+		bits := start.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(start, bits-1).Masked()
+			if p.Addr() != start || end.Less(lastAddr(p)) {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, p)
+
+		last := lastAddr(p)
+		if last == end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr returns the highest address in p
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// AssignedRoutes returns the routes the server advertised during the
+// Connect-IP handshake, nil if it advertised none
+func (m *MasqueAdapter) AssignedRoutes() []netip.Prefix {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.routes
+}
+
+// LocalTunnelAddrs returns the tunnel addresses the server assigned during the
+// Connect-IP handshake. They are more authoritative than the addresses in the
+// config (GetLocalAddresses); ok is false if the server assigned none.
+func (m *MasqueAdapter) LocalTunnelAddrs() (v4, v6 netip.Addr, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.assignedV4, m.assignedV6, m.assignedV4.IsValid() || m.assignedV6.IsValid()
+}
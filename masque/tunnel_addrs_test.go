@@ -0,0 +1,227 @@
+package masque
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// dialTestConnectIP runs an in-process Connect-IP server that assigns
+// prefixes and advertises routes (none if nil) and returns a client session
+// to it. serve, if set, then handles the server side of the session.
+func dialTestConnectIP(t *testing.T, prefixes []netip.Prefix, routes []connectip.IPRoute, serve func(*connectip.Conn)) *connectip.Conn {
+	t.Helper()
+
+	var template *uritemplate.Template
+	proxy := &connectip.Proxy{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect-ip", func(w http.ResponseWriter, r *http.Request) {
+		req, err := connectip.ParseRequest(r, template, "connect-ip")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, err := proxy.Proxy(w, req)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		if prefixes != nil {
+			if err := conn.AssignAddresses(r.Context(), prefixes); err != nil {
+				t.Errorf("AssignAddresses: %v", err)
+			}
+		}
+		if routes != nil {
+			if err := conn.AdvertiseRoute(r.Context(), routes); err != nil {
+				t.Errorf("AdvertiseRoute: %v", err)
+			}
+		}
+		if serve != nil {
+			go serve(conn)
+		}
+	})
+	addr := serveTestH3(t, mux, nil)
+	template = uritemplate.MustNew(fmt.Sprintf("https://localhost:%d/connect-ip", addr.Port))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ipConn, rsp, err := connectip.Dial(ctx, dialTestH3(t, addr), template, "connect-ip", http.Header{}, false)
+	if err != nil {
+		t.Fatalf("connect-ip dial: %v", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("connect-ip status = %s", rsp.Status)
+	}
+	t.Cleanup(func() { ipConn.Close() })
+	return ipConn
+}
+
+// serveTestH3 runs an HTTP/3 server with datagrams enabled on a loopback
+// port, calling onConn (if set) for every QUIC connection it accepts
+func serveTestH3(t *testing.T, handler http.Handler, onConn func()) *net.UDPAddr {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTestH3WithKey(t, key, handler, onConn)
+}
+
+// serveTestH3WithKey is serveTestH3 with a certificate for key
+func serveTestH3WithKey(t *testing.T, key *ecdsa.PrivateKey, handler http.Handler, onConn func()) *net.UDPAddr {
+	t.Helper()
+
+	certDER, err := generateSelfSignedCert(key, AdapterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverConn.Close() })
+
+	server := &http3.Server{
+		Handler:         handler,
+		EnableDatagrams: true,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		}),
+		ConnContext: func(ctx context.Context, _ *quic.Conn) context.Context {
+			if onConn != nil {
+				onConn()
+			}
+			return ctx
+		},
+	}
+	go server.Serve(serverConn)
+	t.Cleanup(func() { server.Close() })
+	return serverConn.LocalAddr().(*net.UDPAddr)
+}
+
+// dialTestH3 opens an HTTP/3 client connection to a serveTestH3 server
+func dialTestH3(t *testing.T, addr *net.UDPAddr) *http3.ClientConn {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qconn, err := quic.DialAddr(ctx, addr.String(),
+		&tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+		&quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("quic dial: %v", err)
+	}
+	t.Cleanup(func() { qconn.CloseWithError(0, "") })
+
+	transport := &http3.Transport{EnableDatagrams: true}
+	t.Cleanup(func() { transport.Close() })
+	return transport.NewClientConn(qconn)
+}
+
+func TestAssignedTunnelAddrs(t *testing.T) {
+	ipConn := dialTestConnectIP(t, []netip.Prefix{
+		netip.MustParsePrefix("172.16.0.9/32"),
+		netip.MustParsePrefix("2606:4700:110:8a1::9/128"),
+		netip.MustParsePrefix("172.16.0.10/32"),
+	}, nil, nil)
+
+	v4, v6 := assignedTunnelAddrs(context.Background(), ipConn, 5*time.Second)
+	if want := netip.MustParseAddr("172.16.0.9"); v4 != want {
+		t.Errorf("v4 = %v, want %v", v4, want)
+	}
+	if want := netip.MustParseAddr("2606:4700:110:8a1::9"); v6 != want {
+		t.Errorf("v6 = %v, want %v", v6, want)
+	}
+
+	m := &MasqueAdapter{assignedV4: v4, assignedV6: v6}
+	if gotV4, gotV6, ok := m.LocalTunnelAddrs(); !ok || gotV4 != v4 || gotV6 != v6 {
+		t.Errorf("LocalTunnelAddrs() = %v, %v, %v", gotV4, gotV6, ok)
+	}
+}
+
+func TestAssignedTunnelAddrsNoAssignment(t *testing.T) {
+	ipConn := dialTestConnectIP(t, nil, nil, nil)
+
+	v4, v6 := assignedTunnelAddrs(context.Background(), ipConn, 100*time.Millisecond)
+	if v4.IsValid() || v6.IsValid() {
+		t.Fatalf("got %v, %v from a server that assigned nothing", v4, v6)
+	}
+	if _, _, ok := (&MasqueAdapter{}).LocalTunnelAddrs(); ok {
+		t.Fatal("LocalTunnelAddrs() ok without assigned addresses")
+	}
+}
+
+func TestTunnelAssignmentsCached(t *testing.T) {
+	assigned := dialTestConnectIP(t, []netip.Prefix{netip.MustParsePrefix("172.16.0.9/32")}, nil, nil)
+	var cache TunnelAssignments
+	if v4, _, _ := cache.get(context.Background(), assigned, 500*time.Millisecond); v4 != netip.MustParseAddr("172.16.0.9") {
+		t.Fatalf("first tunnel v4 = %v, want the assigned address", v4)
+	}
+
+	// A later tunnel takes the cached address without waiting for capsules
+	silent := dialTestConnectIP(t, nil, nil, nil)
+	start := time.Now()
+	v4, _, _ := cache.get(context.Background(), silent, 5*time.Second)
+	if v4 != netip.MustParseAddr("172.16.0.9") {
+		t.Errorf("later tunnel v4 = %v, want the cached address", v4)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("later tunnel waited %s for assignments", elapsed)
+	}
+}
+
+func TestAdvertisedRoutes(t *testing.T) {
+	ipConn := dialTestConnectIP(t, nil, []connectip.IPRoute{
+		{StartIP: netip.MustParseAddr("10.0.0.0"), EndIP: netip.MustParseAddr("10.0.255.255")},
+		{StartIP: netip.MustParseAddr("2001:db8::"), EndIP: netip.MustParseAddr("2001:db8::ffff:ffff:ffff:ffff")},
+	}, nil)
+
+	routes := advertisedRoutes(context.Background(), ipConn, 5*time.Second)
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16"), netip.MustParsePrefix("2001:db8::/64")}
+	if !slices.Equal(routes, want) {
+		t.Fatalf("routes = %v, want %v", routes, want)
+	}
+
+	m := &MasqueAdapter{routes: routes}
+	if got := m.AssignedRoutes(); !slices.Equal(got, want) {
+		t.Fatalf("AssignedRoutes() = %v, want %v", got, want)
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	tests := []struct {
+		start, end string
+		want       []string
+	}{
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"10.0.0.1", "10.0.0.1", []string{"10.0.0.1/32"}},
+		{"10.0.0.1", "10.0.0.6", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		{"10.0.0.2", "10.0.0.1", nil},
+	}
+	for _, tt := range tests {
+		var want []netip.Prefix
+		for _, p := range tt.want {
+			want = append(want, netip.MustParsePrefix(p))
+		}
+		if got := rangePrefixes(netip.MustParseAddr(tt.start), netip.MustParseAddr(tt.end)); !slices.Equal(got, want) {
+			t.Errorf("rangePrefixes(%s, %s) = %v, want %v", tt.start, tt.end, got, want)
+		}
+	}
+}
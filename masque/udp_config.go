@@ -1,30 +1,62 @@
 package masque
 
 import (
+	"errors"
 	"log/slog"
 	"net"
-	"runtime"
+	"sync"
+	"syscall"
 )
 
 // udpBufferSize is the optimal UDP buffer size for QUIC connections (7MB)
 // This matches the buffer size used by WireGuard for optimal performance
 const udpBufferSize = 7 << 20 // 7MB
 
-// configureUDPBuffer applies optimal UDP socket buffer settings for QUIC
-// This function is a no-op on platforms other than Linux/Unix where the
-// QUIC buffer warnings are not an issue
+// udpBufferWarning makes sure the advice to raise the kernel's buffer limit
+// is given only once, however many sockets or QUIC messages hit it
+var udpBufferWarning sync.Once
+
+// quicListenConfig returns the ListenConfig for QUIC sockets. Their buffers
+// are enlarged before binding, as the QUIC library would do too late on a
+// wrapped socket.
+func quicListenConfig() net.ListenConfig {
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				setUDPBufferSizes(fd)
+			})
+		},
+	}
+}
+
+// configureUDPBuffer checks the buffers the kernel actually gave conn, and
+// warns once when they are too small to keep up with QUIC under load
 func configureUDPBuffer(conn *net.UDPConn, logger *slog.Logger) error {
 	if conn == nil {
 		return nil
 	}
-
-	// Only apply buffer configuration on Linux where QUIC buffer warnings occur
-	if runtime.GOOS != "linux" {
+	rcv, snd, err := udpBufferSizes(conn)
+	if errors.Is(err, errors.ErrUnsupported) {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	logger.Debug("UDP socket buffers", "receive", rcv, "send", snd, "requested", udpBufferSize)
+	if rcv < udpBufferSize/2 || snd < udpBufferSize/2 { // Allow some system overhead
+		WarnUDPBufferLimit(logger, "receive", rcv, "send", snd, "requested", udpBufferSize)
+	}
+	return nil
+}
 
-	logger.Debug("Configuring UDP socket buffers for optimal QUIC performance", "bufferSize", udpBufferSize)
-
-	// Apply platform-specific buffer configuration
-	return configureUDPBufferPlatform(conn, logger)
+// WarnUDPBufferLimit warns, once per process, that UDP buffers are smaller
+// than QUIC needs, with the command raising the limit where it is known.
+// args are added to the warning, like the sizes or the QUIC library's message.
+func WarnUDPBufferLimit(logger *slog.Logger, args ...any) {
+	udpBufferWarning.Do(func() {
+		if udpBufferHint != "" {
+			args = append(args, "fix", udpBufferHint)
+		}
+		logger.Warn("UDP buffers are smaller than QUIC needs, expect packet loss under load", args...)
+	})
 }
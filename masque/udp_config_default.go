@@ -3,13 +3,18 @@
 package masque
 
 import (
-	"log/slog"
+	"errors"
 	"net"
 )
 
-// configureUDPBufferPlatform is a no-op on non-Linux platforms
+// udpBufferHint is empty where no single command raises the limit
+const udpBufferHint = ""
+
+// setUDPBufferSizes is a no-op on non-Linux platforms
 // where QUIC UDP buffer warnings are typically not an issue
-func configureUDPBufferPlatform(conn *net.UDPConn, logger *slog.Logger) error {
-	logger.Debug("UDP buffer configuration not required on this platform")
-	return nil
+func setUDPBufferSizes(fd uintptr) {}
+
+// udpBufferSizes is not supported on non-Linux platforms
+func udpBufferSizes(conn *net.UDPConn) (rcv, snd int, err error) {
+	return 0, 0, errors.ErrUnsupported
 }
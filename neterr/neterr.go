@@ -0,0 +1,125 @@
+package neterr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+)
+
+// transientErrnos are socket errors that mean the path or the peer went away,
+// not that the caller did something wrong
+var transientErrnos = []syscall.Errno{
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.ECONNREFUSED,
+	syscall.EPIPE,
+	syscall.ENETUNREACH,
+	syscall.ENETDOWN,
+	syscall.EHOSTUNREACH,
+	syscall.ENOTCONN,
+	syscall.ETIMEDOUT,
+	// Android and other sandboxed platforms report a revoked network with these
+	syscall.EPERM,
+	syscall.EACCES,
+	syscall.EAFNOSUPPORT,
+	syscall.EPROTONOSUPPORT,
+	syscall.ENOPROTOOPT,
+}
+
+// transientPatterns are matched against the error text only when nothing in
+// the chain could be classified by type, e.g. errors that crossed a library
+// boundary as plain strings
+var transientPatterns = []string{
+	"use of closed network connection",
+	"connection reset by peer",
+	"broken pipe",
+	"network is unreachable",
+	"no route to host",
+	"connection refused",
+	"connection aborted",
+	"transport endpoint is not connected",
+	"socket is not connected",
+	"network interface is down",
+	"permission denied",
+	"operation not permitted",
+	"protocol not available",
+	"address family not supported",
+	"network protocol is not available",
+	"forcibly closed by the remote host",
+	"established connection was aborted",
+}
+
+// timeoutPatterns are the string fallback for IsTimeout
+var timeoutPatterns = []string{
+	"timeout",
+	"timed out",
+	"deadline exceeded",
+}
+
+// IsTimeout reports whether err is a deadline or timeout anywhere in its chain
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return containsAny(err, timeoutPatterns)
+}
+
+// IsTransient reports whether err means the connection or the network path
+// broke and the operation may succeed on a fresh connection
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if IsTimeout(err) {
+		return true
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	// The QUIC connection under a MASQUE tunnel was closed or reset
+	var (
+		appErr       *quic.ApplicationError
+		transportErr *quic.TransportError
+		resetErr     *quic.StatelessResetError
+	)
+	if errors.As(err, &appErr) || errors.As(err, &transportErr) || errors.As(err, &resetErr) {
+		return true
+	}
+
+	// A syscall failure with an errno not listed above (EMSGSIZE, EINVAL...)
+	// won't go away by reconnecting, so don't let its text say otherwise
+	var sysErr *os.SyscallError
+	if errors.As(err, &sysErr) {
+		return false
+	}
+	return containsAny(err, transientPatterns)
+}
+
+func containsAny(err error, patterns []string) bool {
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range patterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package neterr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Err: os.NewSyscallError(op, err)}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"reset", opError("read", syscall.ECONNRESET), true},
+		{"wrapped refused", fmt.Errorf("failed to dial: %w", opError("dial", syscall.ECONNREFUSED)), true},
+		{"broken pipe", opError("write", syscall.EPIPE), true},
+		{"unreachable", opError("write", syscall.ENETUNREACH), true},
+		{"android revoked", opError("write", syscall.EPERM), true},
+		{"closed", fmt.Errorf("read packet: %w", net.ErrClosed), true},
+		{"eof", io.EOF, true},
+		{"canceled", context.Canceled, true},
+		{"deadline", os.ErrDeadlineExceeded, true},
+		{"quic idle", &quic.IdleTimeoutError{}, true},
+		{"quic closed", fmt.Errorf("tunnel: %w", &quic.ApplicationError{Remote: true}), true},
+		{"string only", errors.New("write: connection reset by peer"), true},
+		{"message too long", opError("write", syscall.EMSGSIZE), false},
+		{"unrelated errno text", os.NewSyscallError("setsockopt", errors.New("broken pipe")), false},
+		{"plain", errors.New("invalid packet"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, readErr := conn.Read(make([]byte, 1))
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"read deadline", readErr, true},
+		{"wrapped read deadline", fmt.Errorf("failed to read: %w", readErr), true},
+		{"context", fmt.Errorf("probe: %w", context.DeadlineExceeded), true},
+		{"etimedout", opError("connect", syscall.ETIMEDOUT), true},
+		{"dns", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, true},
+		{"quic idle", &quic.IdleTimeoutError{}, true},
+		{"string only", errors.New("handshake did not complete: timed out"), true},
+		{"reset", opError("read", syscall.ECONNRESET), false},
+		{"closed", net.ErrClosed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTimeout(tt.err); got != tt.want {
+				t.Errorf("IsTimeout(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package preflight
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// quicProbeVersion is a reserved version (RFC 9000 §15) that forces a
+	// compliant server to answer with a Version Negotiation packet
+	quicProbeVersion = 0x1a2a3a4a
+	// QUICVersion1 is the version number of QUIC v1 (RFC 9000)
+	QUICVersion1 = 0x00000001
+	// quicProbeSize matches the minimum client Initial datagram size; servers
+	// only answer unknown versions in datagrams at least this large
+	quicProbeSize = 1200
+)
+
+var (
+	// ErrNoQUICResponse means the endpoint did not answer the probe in time
+	ErrNoQUICResponse = errors.New("no response to QUIC probe")
+	// ErrUnexpectedQUICResponse means something answered, but not with Version Negotiation
+	ErrUnexpectedQUICResponse = errors.New("unexpected response to QUIC probe")
+)
+
+// ProbeQUIC sends a single padded Initial-sized packet with a reserved
+// version to endpoint (host:port) and returns the QUIC versions listed in
+// the server's Version Negotiation reply.
+func ProbeQUIC(ctx context.Context, endpoint string, timeout time.Duration) ([]uint32, error) {
+	return ProbeQUICFrom(ctx, netip.AddrPort{}, endpoint, timeout)
+}
+
+// ProbeQUICFrom is ProbeQUIC with the probe sent from source. The system
+// picks the address if source's is not valid, and the port if it is 0.
+func ProbeQUICFrom(ctx context.Context, source netip.AddrPort, endpoint string, timeout time.Duration) ([]uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	if source.Addr().IsValid() || source.Port() != 0 {
+		local := &net.UDPAddr{Port: int(source.Port())}
+		if source.Addr().IsValid() {
+			local.IP = source.Addr().AsSlice()
+		}
+		d.LocalAddr = local
+	}
+	conn, err := d.DialContext(ctx, "udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(quicProbePacket()); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w from %s within %s", ErrNoQUICResponse, endpoint, timeout)
+		}
+		return nil, err
+	}
+
+	versions, ok := parseVersionNegotiation(buf[:n])
+	if !ok {
+		return nil, fmt.Errorf("%w from %s", ErrUnexpectedQUICResponse, endpoint)
+	}
+	return versions, nil
+}
+
+// quicProbePacket builds a padded long-header packet with a reserved version
+func quicProbePacket() []byte {
+	dcid := make([]byte, 8)
+	_, _ = rand.Read(dcid)
+
+	pkt := make([]byte, 0, quicProbeSize)
+	pkt = append(pkt, 0xc0)
+	pkt = binary.BigEndian.AppendUint32(pkt, quicProbeVersion)
+	pkt = append(pkt, byte(len(dcid)))
+	pkt = append(pkt, dcid...)
+	pkt = append(pkt, 0)       // empty source connection ID
+	return pkt[:quicProbeSize] // zero padding up to the minimum Initial size
+}
+
+// parseVersionNegotiation returns the versions listed in a Version Negotiation packet
+func parseVersionNegotiation(pkt []byte) ([]uint32, bool) {
+	if len(pkt) < 7 || pkt[0]&0x80 == 0 || binary.BigEndian.Uint32(pkt[1:5]) != 0 {
+		return nil, false
+	}
+	pos := 5
+	for i := 0; i < 2; i++ { // destination and source connection IDs
+		if pos >= len(pkt) {
+			return nil, false
+		}
+		pos += 1 + int(pkt[pos])
+	}
+	if pos > len(pkt) {
+		return nil, false
+	}
+
+	var versions []uint32
+	for ; pos+4 <= len(pkt); pos += 4 {
+		versions = append(versions, binary.BigEndian.Uint32(pkt[pos:]))
+	}
+	return versions, true
+}
@@ -0,0 +1,98 @@
+package preflight
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeQUICUnreachableFailsFast(t *testing.T) {
+	// A bound socket that never answers behaves like a filtered endpoint
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer silent.Close()
+
+	const timeout = 300 * time.Millisecond
+	start := time.Now()
+	_, err = ProbeQUIC(t.Context(), silent.LocalAddr().String(), timeout)
+	if !errors.Is(err, ErrNoQUICResponse) {
+		t.Fatalf("ProbeQUIC error = %v, want %v", err, ErrNoQUICResponse)
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Fatalf("ProbeQUIC took %s, want about %s", elapsed, timeout)
+	}
+}
+
+func TestProbeQUICVersionNegotiation(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer server.Close()
+
+	go func() {
+		buf := make([]byte, 2048)
+		n, addr, err := server.ReadFromUDP(buf)
+		if err != nil || n != quicProbeSize {
+			return
+		}
+		dcid := buf[6 : 6+int(buf[5])]
+		resp := []byte{0x80, 0, 0, 0, 0, 0, byte(len(dcid))}
+		resp = append(resp, dcid...)
+		resp = binary.BigEndian.AppendUint32(resp, QUICVersion1)
+		_, _ = server.WriteToUDP(resp, addr)
+	}()
+
+	versions, err := ProbeQUIC(t.Context(), server.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("ProbeQUIC: %v", err)
+	}
+	if len(versions) != 1 || versions[0] != QUICVersion1 {
+		t.Fatalf("versions = %v", versions)
+	}
+}
+
+func TestProbeQUICFromSourcePort(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer server.Close()
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	source := free.LocalAddr().(*net.UDPAddr).AddrPort()
+	free.Close()
+
+	_, _ = ProbeQUICFrom(t.Context(), source, server.LocalAddr().String(), 100*time.Millisecond)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := server.ReadFromUDPAddrPort(make([]byte, 2048))
+	if err != nil {
+		t.Fatalf("no probe received: %v", err)
+	}
+	if from != source {
+		t.Fatalf("probe sent from %s, want %s", from, source)
+	}
+}
+
+func TestParseVersionNegotiation(t *testing.T) {
+	pkt := []byte{0x80, 0, 0, 0, 0, 0, 2, 0xaa, 0xbb}
+	pkt = binary.BigEndian.AppendUint32(pkt, QUICVersion1)
+	pkt = binary.BigEndian.AppendUint32(pkt, 0x6b3343cf)
+	versions, ok := parseVersionNegotiation(pkt)
+	if !ok || len(versions) != 2 || versions[0] != QUICVersion1 {
+		t.Fatalf("versions = %v, ok = %v", versions, ok)
+	}
+
+	if _, ok := parseVersionNegotiation(quicProbePacket()); ok {
+		t.Error("a long header with a non-zero version is not Version Negotiation")
+	}
+	if _, ok := parseVersionNegotiation([]byte{0x80, 0, 0, 0, 0, 0, 200}); ok {
+		t.Error("truncated connection ID accepted")
+	}
+}
@@ -0,0 +1,221 @@
+// Package acl restricts which destinations proxy clients may connect to.
+//
+// A rule is a host pattern with an optional port or port range:
+//
+//	10.0.0.0/8          an IPv4 or IPv6 CIDR (or a single address)
+//	example.com         a domain and all of its subdomains
+//	example.com:443     a domain on one port
+//	[::1]:1000-2000     a bracketed IPv6 address on a port range
+//	:25 or *:25         any host on a port
+//	*                   any destination
+//
+// Domain rules only match requests made by name and CIDR rules match
+// requests made by address. A request made by name is also refused when the
+// name resolves to an address a deny rule covers, so a name can't reach a
+// denied range; allow rules only ever match what the client asked for.
+package acl
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Rule matches destinations by host and port
+type Rule struct {
+	prefix netip.Prefix // IP rules
+	domain string       // domain suffix rules, lower case without a trailing dot
+	ports  [2]int       // inclusive port range, zero for any port
+}
+
+// ParseRule parses a single rule
+func ParseRule(s string) (Rule, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Rule{}, fmt.Errorf("empty ACL rule")
+	}
+
+	// Bare CIDRs and addresses, including unbracketed IPv6
+	if prefix, ok := parsePrefix(s); ok {
+		return Rule{prefix: prefix}, nil
+	}
+
+	host, ports, hasPorts := s, "", false
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return Rule{}, fmt.Errorf("invalid ACL rule %q: missing ']'", s)
+		}
+		host = s[1:end]
+		if rest := s[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return Rule{}, fmt.Errorf("invalid ACL rule %q", s)
+			}
+			ports, hasPorts = rest[1:], true
+		}
+	} else if i := strings.LastIndex(s, ":"); i >= 0 {
+		host, ports, hasPorts = s[:i], s[i+1:], true
+	}
+
+	var r Rule
+	if hasPorts {
+		var err error
+		if r.ports, err = parsePorts(ports); err != nil {
+			return Rule{}, fmt.Errorf("invalid ACL rule %q: %w", s, err)
+		}
+	}
+
+	switch {
+	case host == "" || host == "*":
+		// any host
+	default:
+		if prefix, ok := parsePrefix(host); ok {
+			r.prefix = prefix
+			break
+		}
+		domain := strings.TrimSuffix(strings.ToLower(host), ".")
+		domain = strings.TrimPrefix(strings.TrimPrefix(domain, "*"), ".")
+		if domain == "" || strings.ContainsAny(domain, "/:*[] ") {
+			return Rule{}, fmt.Errorf("invalid ACL rule %q: bad host %q", s, host)
+		}
+		r.domain = domain
+	}
+	return r, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+func parsePorts(s string) ([2]int, error) {
+	low, high, isRange := strings.Cut(s, "-")
+	lowPort, err := strconv.Atoi(low)
+	if err != nil {
+		return [2]int{}, fmt.Errorf("bad port %q", s)
+	}
+	highPort := lowPort
+	if isRange {
+		if highPort, err = strconv.Atoi(high); err != nil {
+			return [2]int{}, fmt.Errorf("bad port %q", s)
+		}
+	}
+	if lowPort < 1 || highPort > 65535 || lowPort > highPort {
+		return [2]int{}, fmt.Errorf("bad port range %q", s)
+	}
+	return [2]int{lowPort, highPort}, nil
+}
+
+// Match reports whether the rule covers host:port
+func (r Rule) Match(host string, port int) bool {
+	if r.ports != [2]int{} && (port < r.ports[0] || port > r.ports[1]) {
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ".")
+	switch {
+	case r.prefix.IsValid():
+		addr, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(addr.Unmap())
+	case r.domain != "":
+		host = strings.ToLower(host)
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	default:
+		return true
+	}
+}
+
+func (r Rule) String() string {
+	var host string
+	switch {
+	case r.prefix.IsValid():
+		host = r.prefix.String()
+		if r.ports != [2]int{} && r.prefix.Addr().Is6() {
+			host = "[" + host + "]"
+		}
+	case r.domain != "":
+		host = r.domain
+	default:
+		host = "*"
+	}
+	switch {
+	case r.ports == [2]int{}:
+		return host
+	case r.ports[0] == r.ports[1]:
+		return fmt.Sprintf("%s:%d", host, r.ports[0])
+	default:
+		return fmt.Sprintf("%s:%d-%d", host, r.ports[0], r.ports[1])
+	}
+}
+
+// ACL decides whether a destination may be dialed. Deny rules win over allow
+// rules; with no allow rules everything not denied is allowed. A nil ACL
+// allows everything.
+type ACL struct {
+	Allow []Rule
+	Deny  []Rule
+}
+
+// New parses allow and deny rules into an ACL
+func New(allow, deny []string) (*ACL, error) {
+	a := &ACL{}
+	for _, s := range allow {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		a.Allow = append(a.Allow, r)
+	}
+	for _, s := range deny {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		a.Deny = append(a.Deny, r)
+	}
+	return a, nil
+}
+
+// Allowed reports whether clients may connect to host:port
+func (a *ACL) Allowed(host string, port int) bool {
+	if a == nil {
+		return true
+	}
+	for _, r := range a.Deny {
+		if r.Match(host, port) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, r := range a.Allow {
+		if r.Match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedResolved reports whether clients that were allowed to connect to a
+// name may connect to addr:port, an address it resolved to. Only deny rules
+// apply, as allow rules were already matched against the name.
+func (a *ACL) AllowedResolved(addr netip.Addr, port int) bool {
+	if a == nil {
+		return true
+	}
+	host := addr.Unmap().String()
+	for _, r := range a.Deny {
+		if r.prefix.IsValid() && r.Match(host, port) {
+			return false
+		}
+	}
+	return true
+}
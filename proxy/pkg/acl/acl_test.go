@@ -0,0 +1,144 @@
+package acl
+
+import (
+	"net/netip"
+	"testing"
+)
+
+type target struct {
+	host string
+	port int
+}
+
+func mustNew(t *testing.T, allow, deny []string) *ACL {
+	t.Helper()
+	a, err := New(allow, deny)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return a
+}
+
+func checkAllowed(t *testing.T, a *ACL, want map[target]bool) {
+	t.Helper()
+	for dst, allowed := range want {
+		if got := a.Allowed(dst.host, dst.port); got != allowed {
+			t.Errorf("Allowed(%s, %d) = %v, want %v", dst.host, dst.port, got, allowed)
+		}
+	}
+}
+
+func TestDomainRules(t *testing.T) {
+	a := mustNew(t, nil, []string{"example.com", "*.tracker.net:443"})
+	checkAllowed(t, a, map[target]bool{
+		{"example.com", 443}:          false,
+		{"WWW.Example.COM.", 80}:      false,
+		{"notexample.com", 443}:       true,
+		{"example.com.evil.org", 443}: true,
+		{"ads.tracker.net", 443}:      false,
+		{"ads.tracker.net", 80}:       true,
+		{"93.184.216.34", 443}:        true, // names are not resolved
+	})
+}
+
+func TestCIDRRules(t *testing.T) {
+	a := mustNew(t, nil, []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8", "[2001:db8::1]:22"})
+	checkAllowed(t, a, map[target]bool{
+		{"10.1.2.3", 80}:         false,
+		{"11.0.0.1", 80}:         true,
+		{"192.168.1.1", 80}:      false,
+		{"192.168.1.2", 80}:      true,
+		{"::ffff:10.0.0.1", 80}:  false,
+		{"fd12::1", 443}:         false,
+		{"[fd12::1]", 443}:       false,
+		{"2001:db8::1", 22}:      false,
+		{"2001:db8::1", 443}:     true,
+		{"internal.example", 80}: true,
+	})
+}
+
+func TestPortRules(t *testing.T) {
+	a := mustNew(t, []string{":443", "*:8000-8100"}, nil)
+	checkAllowed(t, a, map[target]bool{
+		{"example.com", 443}:  true,
+		{"1.1.1.1", 443}:      true,
+		{"example.com", 8050}: true,
+		{"example.com", 8100}: true,
+		{"example.com", 8101}: false,
+		{"example.com", 25}:   false,
+	})
+}
+
+func TestDenyOverridesAllow(t *testing.T) {
+	a := mustNew(t,
+		[]string{"example.com", "10.0.0.0/8"},
+		[]string{"admin.example.com", "10.0.0.1", ":25"},
+	)
+	checkAllowed(t, a, map[target]bool{
+		{"www.example.com", 443}:   true,
+		{"admin.example.com", 443}: false,
+		{"example.com", 25}:        false,
+		{"10.0.0.2", 80}:           true,
+		{"10.0.0.1", 80}:           false,
+		{"other.org", 443}:         false, // not on the allow list
+	})
+}
+
+func TestAllowedResolved(t *testing.T) {
+	a := mustNew(t, []string{"example.com"}, []string{"10.0.0.0/8", "[fd00::1]:22", "tracker.net"})
+	for addr, want := range map[netip.AddrPort]bool{
+		netip.MustParseAddrPort("10.1.2.3:443"):         false,
+		netip.MustParseAddrPort("[::ffff:10.1.2.3]:80"): false,
+		netip.MustParseAddrPort("[fd00::1]:22"):         false,
+		netip.MustParseAddrPort("[fd00::1]:443"):        true,
+		netip.MustParseAddrPort("93.184.216.34:443"):    true, // Not on the allow list, but the name was
+	} {
+		if got := a.AllowedResolved(addr.Addr(), int(addr.Port())); got != want {
+			t.Errorf("AllowedResolved(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	var nilACL *ACL
+	if !nilACL.AllowedResolved(netip.MustParseAddr("10.0.0.1"), 80) {
+		t.Error("nil ACL must allow everything")
+	}
+}
+
+func TestDefaultAllow(t *testing.T) {
+	var nilACL *ACL
+	if !nilACL.Allowed("example.com", 443) {
+		t.Error("nil ACL must allow everything")
+	}
+	if !mustNew(t, nil, nil).Allowed("example.com", 443) {
+		t.Error("empty ACL must allow everything")
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	valid := map[string]string{
+		"example.com":      "example.com",
+		".Example.com":     "example.com",
+		"*.example.com:80": "example.com:80",
+		"10.0.0.0/8":       "10.0.0.0/8",
+		"10.1.2.3/8":       "10.0.0.0/8",
+		"2001:db8::/32":    "2001:db8::/32",
+		"[2001:db8::1]:22": "[2001:db8::1/128]:22",
+		":1000-2000":       "*:1000-2000",
+		"*":                "*",
+	}
+	for in, want := range valid {
+		r, err := ParseRule(in)
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", in, err)
+			continue
+		}
+		if got := r.String(); got != want {
+			t.Errorf("ParseRule(%q) = %s, want %s", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"", "example.com:", "example.com:0", ":2000-1000", ":70000", "[::1", "[::1]x", "a/b"} {
+		if _, err := ParseRule(in); err == nil {
+			t.Errorf("ParseRule(%q) accepted", in)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"net"
@@ -55,6 +56,18 @@ func (rw *responseWriter) Write(data []byte) (int, error) {
 	return rw.conn.Write(data)
 }
 
+// bufferedConn serves bytes the request parser read ahead before reading
+// from the connection, so data pipelined after the request headers (such as a
+// TLS ClientHello following CONNECT) reaches the tunnel unchanged
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
 type customConn struct {
 	net.Conn
 	req         *http.Request
@@ -72,12 +85,14 @@ func (c *customConn) Read(p []byte) (n int, err error) {
 		}
 		c.initialData = buf.Bytes()
 	})
+	if err != nil {
+		return 0, err
+	}
 
 	if len(c.initialData) > 0 {
-		copy(p, c.initialData)
-		n = len(p)
-		c.initialData = nil
-		return
+		n = copy(p, c.initialData)
+		c.initialData = c.initialData[n:]
+		return n, nil
 	}
 
 	return c.Conn.Read(p)
@@ -3,15 +3,24 @@ package http
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
 	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
 )
 
+var (
+	errDestinationDenied = errors.New("destination not allowed by ACL")
+	errBadRequest        = errors.New("bad request")
+)
+
 type Server struct {
 	// bind is the address to listen on
 	Bind string
@@ -29,6 +38,13 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// ACL restricts the destinations clients may connect to (nil allows all)
+	ACL *acl.ACL
+	// Upstreams caches origin connections of plain HTTP requests; when set,
+	// those requests are forwarded over ProxyDial even with UserConnectHandle
+	Upstreams *ConnCache
+	// RequestLog selects how much of each request is logged (off by default)
+	RequestLog statute.RequestLog
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -129,17 +145,109 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithACL(a *acl.ACL) ServerOption {
+	return func(s *Server) {
+		s.ACL = a
+	}
+}
+
+func WithConnCache(cache *ConnCache) ServerOption {
+	return func(s *Server) {
+		s.Upstreams = cache
+	}
+}
+
+func WithRequestLog(mode statute.RequestLog) ServerOption {
+	return func(s *Server) {
+		s.RequestLog = mode
+	}
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
 	reader := bufio.NewReader(conn)
-	req, err := http.ReadRequest(reader)
+	req, err := readRequest(conn, reader)
 	if err != nil {
 		return err
 	}
+	if reader.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, reader: reader}
+	}
 
 	return s.handleHTTP(conn, req, req.Method == http.MethodConnect)
 }
 
+// readRequest reads the next request on conn and resolves its target. A
+// malformed request is answered with 400 Bad Request and its error wraps
+// errBadRequest; any other error is the connection's.
+func readRequest(conn net.Conn, reader *bufio.Reader) (*http.Request, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		// Not net.Error: *url.Error implements it for unparsable targets
+		var opErr *net.OpError
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+			errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &opErr) {
+			return nil, err
+		}
+		err = fmt.Errorf("%w: %w", errBadRequest, err)
+	} else {
+		err = resolveRequestTarget(req, req.Method == http.MethodConnect)
+	}
+	if err != nil {
+		http.Error(NewHTTPResponseWriter(conn), err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+	return req, nil
+}
+
+// resolveRequestTarget checks the request-target form of req (RFC 7230,
+// section 5.3) and points req.URL at the origin. CONNECT takes the
+// authority-form. Other methods take the absolute-form, whose host replaces
+// the Host header, or the origin-form (or asterisk-form), which names the
+// origin only in the Host header. req.Write forwards either in origin-form.
+func resolveRequestTarget(req *http.Request, isConnectMethod bool) error {
+	u := req.URL
+	switch {
+	case isConnectMethod:
+		if u.Host == "" || u.Path != "" {
+			return fmt.Errorf("%w: CONNECT needs host:port, got %q", errBadRequest, req.RequestURI)
+		}
+	case u.Opaque != "" || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https"):
+		// An authority-form target only parses this way, and only CONNECT may use it
+		return fmt.Errorf("%w: %q", errBadRequest, req.RequestURI)
+	case u.IsAbs():
+		if u.Host == "" {
+			return fmt.Errorf("%w: %q has no host", errBadRequest, req.RequestURI)
+		}
+		req.Host = u.Host
+	default:
+		if req.Host == "" {
+			return fmt.Errorf("%w: %q without a Host header", errBadRequest, req.RequestURI)
+		}
+		u.Scheme = "http"
+		u.Host = req.Host
+	}
+	return nil
+}
+
 func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
+	host, portStr := splitTarget(req, isConnectMethod)
+	portInt, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err // Handle the error if the port string is not a valid integer.
+	}
+	s.logRequest(req, isConnectMethod)
+	if !s.ACL.Allowed(host, portInt) {
+		http.Error(
+			NewHTTPResponseWriter(conn),
+			errDestinationDenied.Error(),
+			http.StatusForbidden,
+		)
+		return fmt.Errorf("connect to %s: %w", net.JoinHostPort(host, portStr), errDestinationDenied)
+	}
+
+	if !isConnectMethod && s.Upstreams != nil {
+		return s.forwardHTTP(conn, req)
+	}
 	if s.UserConnectHandle == nil {
 		return s.embedHandleHTTP(conn, req, isConnectMethod)
 	}
@@ -157,22 +265,7 @@ func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bo
 		conn = cConn
 	}
 
-	targetAddr := req.URL.Host
-	host, portStr, err := net.SplitHostPort(targetAddr)
-	if err != nil {
-		host = targetAddr
-		if req.URL.Scheme == "https" || isConnectMethod {
-			portStr = "443"
-		} else {
-			portStr = "80"
-		}
-		targetAddr = net.JoinHostPort(host, portStr)
-	}
-
-	portInt, err := strconv.Atoi(portStr)
-	if err != nil {
-		return err // Handle the error if the port string is not a valid integer.
-	}
+	targetAddr := net.JoinHostPort(host, portStr)
 	port := int32(portInt)
 
 	proxyReq := &statute.ProxyRequest{
@@ -193,15 +286,7 @@ func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMeth
 		_ = conn.Close()
 	}()
 
-	host, portStr, err := net.SplitHostPort(req.URL.Host)
-	if err != nil {
-		host = req.URL.Host
-		if req.URL.Scheme == "https" || isConnectMethod {
-			portStr = "443"
-		} else {
-			portStr = "80"
-		}
-	}
+	host, portStr := splitTarget(req, isConnectMethod)
 	targetAddr := net.JoinHostPort(host, portStr)
 
 	target, err := s.ProxyDial(s.Context, "tcp", targetAddr)
@@ -243,3 +328,35 @@ func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMeth
 	}
 	return statute.Tunnel(s.Context, target, conn, buf1, buf2)
 }
+
+// splitTarget returns the destination host and port of a proxy request,
+// defaulting the port from the scheme when the request omits it. IPv6
+// literals come back without brackets, ready for net.JoinHostPort.
+func splitTarget(req *http.Request, isConnectMethod bool) (string, string) {
+	host, portStr := req.URL.Hostname(), req.URL.Port()
+	if portStr == "" {
+		if req.URL.Scheme == "https" || isConnectMethod {
+			portStr = "443"
+		} else {
+			portStr = "80"
+		}
+	}
+	return host, portStr
+}
+
+// logRequest logs req as selected by s.RequestLog. Only the method, the
+// destination and, in full mode, the URL without its userinfo are logged;
+// headers such as Proxy-Authorization never are.
+func (s *Server) logRequest(req *http.Request, isConnectMethod bool) {
+	if s.RequestLog == statute.RequestLogOff {
+		return
+	}
+	host, port := splitTarget(req, isConnectMethod)
+	attrs := []any{"protocol", "http", "method", req.Method, "host", net.JoinHostPort(host, port)}
+	if s.RequestLog == statute.RequestLogFull && !isConnectMethod {
+		u := *req.URL
+		u.User = nil
+		attrs = append(attrs, "url", u.String())
+	}
+	s.Logger.Info("proxy request", attrs...)
+}
@@ -0,0 +1,222 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpstreamIdleTimeout is how long an unused upstream connection
+	// stays cached when NewConnCache is given zero
+	DefaultUpstreamIdleTimeout = 90 * time.Second
+	// maxIdlePerHost caps the cached connections to one host:port
+	maxIdlePerHost = 4
+)
+
+// upstreamConn is an origin connection with the reader its responses are
+// parsed from, so bytes read ahead stay with the connection
+type upstreamConn struct {
+	net.Conn
+	reader *bufio.Reader
+	evict  *time.Timer
+}
+
+// ConnCache keeps idle upstream connections of plain HTTP requests keyed by
+// host:port, so successive requests to one origin skip the tunnel dial.
+// Connections unused for the idle timeout are closed.
+type ConnCache struct {
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*upstreamConn
+}
+
+// NewConnCache returns an empty cache evicting connections idle for
+// idleTimeout, DefaultUpstreamIdleTimeout if zero
+func NewConnCache(idleTimeout time.Duration) *ConnCache {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUpstreamIdleTimeout
+	}
+	return &ConnCache{
+		idleTimeout: idleTimeout,
+		idle:        make(map[string][]*upstreamConn),
+	}
+}
+
+// get takes the most recently used idle connection to key, or nil
+func (c *ConnCache) get(key string) *upstreamConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[key]
+	for len(conns) > 0 {
+		uc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		// A stopped timer means the connection was not evicted yet
+		if uc.evict.Stop() {
+			c.setIdle(key, conns)
+			return uc
+		}
+	}
+	c.setIdle(key, conns)
+	return nil
+}
+
+// put caches uc for reuse by the next request to key
+func (c *ConnCache) put(key string, uc *upstreamConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[key]) >= maxIdlePerHost {
+		_ = uc.Close()
+		return
+	}
+	uc.evict = time.AfterFunc(c.idleTimeout, func() {
+		c.remove(key, uc)
+		_ = uc.Close()
+	})
+	c.idle[key] = append(c.idle[key], uc)
+}
+
+func (c *ConnCache) remove(key string, uc *upstreamConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[key]
+	for i, cached := range conns {
+		if cached == uc {
+			c.setIdle(key, append(conns[:i], conns[i+1:]...))
+			return
+		}
+	}
+}
+
+func (c *ConnCache) setIdle(key string, conns []*upstreamConn) {
+	if len(conns) == 0 {
+		delete(c.idle, key)
+		return
+	}
+	c.idle[key] = conns
+}
+
+// Close closes every idle connection in the cache
+func (c *ConnCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, uc := range conns {
+			uc.evict.Stop()
+			_ = uc.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+// forwardHTTP serves plain HTTP requests on conn, starting with req, over
+// cached upstream connections until either side asks to close. A CONNECT on
+// the same connection is handed to handleHTTP.
+func (s *Server) forwardHTTP(conn net.Conn, req *http.Request) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		host, portStr := splitTarget(req, false)
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return err
+		}
+		if !s.ACL.Allowed(host, port) {
+			http.Error(NewHTTPResponseWriter(conn), errDestinationDenied.Error(), http.StatusForbidden)
+			return fmt.Errorf("connect to %s: %w", net.JoinHostPort(host, portStr), errDestinationDenied)
+		}
+
+		done, err := s.roundTrip(conn, req, net.JoinHostPort(host, portStr))
+		if err != nil || done {
+			return err
+		}
+
+		req, err = readRequest(conn, reader)
+		if errors.Is(err, errBadRequest) {
+			return err
+		}
+		if err != nil {
+			// The client closed its keep-alive connection
+			return nil
+		}
+		if req.Method == http.MethodConnect {
+			if reader.Buffered() > 0 {
+				conn = &bufferedConn{Conn: conn, reader: reader}
+			}
+			return s.handleHTTP(conn, req, true)
+		}
+		s.logRequest(req, false)
+	}
+}
+
+// roundTrip relays one request to target and its response back to the
+// client, caching the upstream connection if both sides keep it alive.
+// done reports that the client connection must not carry another request.
+func (s *Server) roundTrip(client net.Conn, req *http.Request, target string) (done bool, err error) {
+	// The client's proxy hop ends here
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+
+	uc, resp, err := s.sendUpstream(req, target)
+	if err != nil {
+		http.Error(NewHTTPResponseWriter(client), err.Error(), http.StatusServiceUnavailable)
+		return true, err
+	}
+
+	// resp.Write goes straight to the unbuffered client connection and
+	// copies the body as it is read, so chunked and close-delimited
+	// streams such as server-sent events reach the client chunk by chunk.
+	// A chunked body is re-chunked as it was received, Transfer-Encoding
+	// and Content-Length are passed through unchanged.
+	err = resp.Write(client)
+	_ = resp.Body.Close()
+	if err != nil || req.Close || resp.Close || uc.reader.Buffered() > 0 {
+		_ = uc.Close()
+		return true, err
+	}
+	s.Upstreams.put(target, uc)
+	return false, nil
+}
+
+// sendUpstream writes req to a cached connection to target, or a new one.
+// A cached connection the origin already closed is replaced once, provided
+// the request has no body that could have been consumed.
+func (s *Server) sendUpstream(req *http.Request, target string) (*upstreamConn, *http.Response, error) {
+	if uc := s.Upstreams.get(target); uc != nil {
+		if resp, err := exchange(uc, req); err == nil {
+			return uc, resp, nil
+		}
+		_ = uc.Close()
+		if req.Body != nil && req.Body != http.NoBody {
+			return nil, nil, fmt.Errorf("reused connection to %s failed", target)
+		}
+	}
+
+	conn, err := s.ProxyDial(s.Context, "tcp", target)
+	if err != nil {
+		return nil, nil, err
+	}
+	uc := &upstreamConn{Conn: conn, reader: bufio.NewReader(conn)}
+	resp, err := exchange(uc, req)
+	if err != nil {
+		_ = uc.Close()
+		return nil, nil, err
+	}
+	return uc, resp, nil
+}
+
+func exchange(uc *upstreamConn, req *http.Request) (*http.Response, error) {
+	if err := req.Write(uc); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(uc.reader, req)
+}
@@ -0,0 +1,279 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingOrigin is an HTTP server that counts the connections it accepts
+func countingOrigin(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.Start()
+	t.Cleanup(origin.Close)
+	return origin, &conns
+}
+
+func cachingProxy(t *testing.T, idle time.Duration) (*Server, *atomic.Int32) {
+	t.Helper()
+	var dials atomic.Int32
+	cache := NewConnCache(idle)
+	t.Cleanup(cache.Close)
+	var dialer net.Dialer
+	return NewServer(
+		WithContext(t.Context()),
+		WithConnCache(cache),
+		WithProxyDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials.Add(1)
+			return dialer.DialContext(ctx, network, address)
+		}),
+	), &dials
+}
+
+// get sends a proxied GET for path on client and returns the response body
+func get(t *testing.T, client net.Conn, reader *bufio.Reader, origin, path, extra string) string {
+	t.Helper()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	request := fmt.Sprintf("GET %s%s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n%s\r\n", origin, path, strings.TrimPrefix(origin, "http://"), extra)
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return string(body)
+}
+
+func idleConns(c *ConnCache) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, conns := range c.idle {
+		n += len(conns)
+	}
+	return n
+}
+
+// waitIdle waits for the proxy to return the last upstream connection to
+// the cache, which happens just after the response reaches the client
+func waitIdle(t *testing.T, c *ConnCache) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); idleConns(c) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream connection was never cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// openClient starts serving a new client connection on proxy
+func openClient(t *testing.T, proxy *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() { _ = proxy.ServeConn(server) }()
+	return client, bufio.NewReader(client)
+}
+
+func TestConnCacheReusesUpstream(t *testing.T) {
+	origin, conns := countingOrigin(t)
+	proxy, dials := cachingProxy(t, time.Minute)
+
+	// Two requests on one keep-alive client connection
+	client, reader := openClient(t, proxy)
+	if body := get(t, client, reader, origin.URL, "/one", ""); body != "/one" {
+		t.Fatalf("first body = %q", body)
+	}
+	if body := get(t, client, reader, origin.URL, "/two", ""); body != "/two" {
+		t.Fatalf("second body = %q", body)
+	}
+
+	// And one from a fresh client connection, as browsers open several
+	waitIdle(t, proxy.Upstreams)
+	client, reader = openClient(t, proxy)
+	if body := get(t, client, reader, origin.URL, "/three", ""); body != "/three" {
+		t.Fatalf("third body = %q", body)
+	}
+
+	if dials.Load() != 1 || conns.Load() != 1 {
+		t.Fatalf("%d dials and %d origin connections for three requests, want 1 of each", dials.Load(), conns.Load())
+	}
+}
+
+func TestConnCacheRespectsConnectionClose(t *testing.T) {
+	origin, conns := countingOrigin(t)
+	proxy, _ := cachingProxy(t, time.Minute)
+
+	client, reader := openClient(t, proxy)
+	get(t, client, reader, origin.URL, "/one", "Connection: close\r\n")
+	time.Sleep(50 * time.Millisecond)
+	if idleConns(proxy.Upstreams) != 0 {
+		t.Fatal("connection of a Connection: close request was cached")
+	}
+
+	client, reader = openClient(t, proxy)
+	get(t, client, reader, origin.URL, "/two", "")
+
+	if got := conns.Load(); got != 2 {
+		t.Fatalf("origin saw %d connections, want the closed one not reused", got)
+	}
+}
+
+func TestConnCacheEvictsIdle(t *testing.T) {
+	origin, conns := countingOrigin(t)
+	proxy, _ := cachingProxy(t, 50*time.Millisecond)
+
+	client, reader := openClient(t, proxy)
+	get(t, client, reader, origin.URL, "/one", "")
+	time.Sleep(200 * time.Millisecond)
+	get(t, client, reader, origin.URL, "/two", "")
+
+	if got := conns.Load(); got != 2 {
+		t.Fatalf("origin saw %d connections, want the idle one evicted", got)
+	}
+}
+
+func TestConnCacheRedialsStaleUpstream(t *testing.T) {
+	origin, conns := countingOrigin(t)
+	proxy, _ := cachingProxy(t, time.Minute)
+
+	client, reader := openClient(t, proxy)
+	get(t, client, reader, origin.URL, "/one", "")
+	waitIdle(t, proxy.Upstreams)
+	// The origin drops its idle keep-alive connections
+	origin.CloseClientConnections()
+	if body := get(t, client, reader, origin.URL, "/two", ""); body != "/two" {
+		t.Fatalf("body after the origin closed the cached connection = %q", body)
+	}
+	if got := conns.Load(); got != 2 {
+		t.Fatalf("origin saw %d connections, want 2", got)
+	}
+}
+
+func TestForwardStreamsChunkedResponse(t *testing.T) {
+	const events = 3
+	next := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range events {
+			if i > 0 {
+				// The next event is only sent once the client got this one
+				select {
+				case <-next:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(origin.Close)
+	proxy, _ := cachingProxy(t, time.Minute)
+
+	client, reader := openClient(t, proxy)
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	host := strings.TrimPrefix(origin.URL, "http://")
+	if _, err := fmt.Fprintf(client, "GET %s/events HTTP/1.1\r\nHost: %s\r\n\r\n", origin.URL, host); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" || resp.ContentLength != -1 {
+		t.Fatalf("Transfer-Encoding %v Content-Length %d, want chunked without a length", resp.TransferEncoding, resp.ContentLength)
+	}
+
+	body := bufio.NewReader(resp.Body)
+	for i := range events {
+		event, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event %d not streamed: %v", i, err)
+		}
+		if want := fmt.Sprintf("data: %d\n", i); event != want {
+			t.Fatalf("event %d = %q, want %q", i, event, want)
+		}
+		if _, err := body.ReadString('\n'); err != nil {
+			t.Fatalf("event %d terminator: %v", i, err)
+		}
+		if i < events-1 {
+			next <- struct{}{}
+		}
+	}
+	if rest, err := io.ReadAll(body); err != nil || len(rest) != 0 {
+		t.Fatalf("after the last event: %q, %v", rest, err)
+	}
+}
+
+func TestForwardStreamsCloseDelimitedResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	next := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		// No length and no chunking: the body ends when the origin closes
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\ndata: 0\n\n")
+		<-next
+		_, _ = io.WriteString(conn, "data: 1\n\n")
+	}()
+	proxy, _ := cachingProxy(t, time.Minute)
+
+	client, reader := openClient(t, proxy)
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	origin := ln.Addr().String()
+	if _, err := fmt.Fprintf(client, "GET http://%s/events HTTP/1.1\r\nHost: %s\r\n\r\n", origin, origin); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if !resp.Close || len(resp.TransferEncoding) != 0 {
+		t.Fatalf("Close %v Transfer-Encoding %v, want a close-delimited body", resp.Close, resp.TransferEncoding)
+	}
+
+	first := make([]byte, len("data: 0\n\n"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "data: 0\n\n" {
+		t.Fatalf("first event %q not streamed: %v", first, err)
+	}
+	close(next)
+	if rest, err := io.ReadAll(resp.Body); err != nil || string(rest) != "data: 1\n\n" {
+		t.Fatalf("rest of the stream = %q, %v", rest, err)
+	}
+}
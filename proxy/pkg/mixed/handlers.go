@@ -5,6 +5,8 @@ import (
 	"log/slog"
 	"net"
 
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/http"
 	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
 )
 
@@ -98,3 +100,34 @@ func WithBytesPool(bytesPool statute.BytesPool) Option {
 		p.httpProxy.BytesPool = bytesPool
 	}
 }
+
+func WithACL(a *acl.ACL) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ACL = a
+		p.socks4Proxy.ACL = a
+		p.httpProxy.ACL = a
+	}
+}
+
+// WithRequestLog logs each HTTP request and SOCKS command as selected by mode
+func WithRequestLog(mode statute.RequestLog) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.RequestLog = mode
+		p.socks4Proxy.RequestLog = mode
+		p.httpProxy.RequestLog = mode
+	}
+}
+
+func WithResolver(resolver statute.Resolver) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.Resolver = resolver
+	}
+}
+
+// WithHTTPConnCache lets the HTTP proxy reuse upstream connections of plain
+// HTTP requests; they are dialed with the user dial function
+func WithHTTPConnCache(cache *http.ConnCache) Option {
+	return func(p *Proxy) {
+		p.httpProxy.Upstreams = cache
+	}
+}
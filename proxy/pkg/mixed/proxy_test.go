@@ -0,0 +1,212 @@
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
+)
+
+// dialRecorder is a ProxyDialFunc that records the address it was asked to
+// dial and connects to a local sink instead
+type dialRecorder struct {
+	addrs chan string
+	sink  net.Listener
+}
+
+func newDialRecorder(t *testing.T) *dialRecorder {
+	t.Helper()
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return &dialRecorder{addrs: make(chan string, 1), sink: sink}
+}
+
+func (d *dialRecorder) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	d.addrs <- address
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, d.sink.Addr().String())
+}
+
+// serve runs one client connection through the mixed proxy and returns the
+// address the proxy dialed for it
+func serve(t *testing.T, request []byte, readReply func(net.Conn) error) string {
+	t.Helper()
+	dialed := newDialRecorder(t)
+	p := NewProxy(
+		WithLogger(slog.New(slog.DiscardHandler)),
+		WithUserDialFunc(dialed.dial),
+	)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		_ = p.handleConnection(server)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	go func() { _, _ = client.Write(request) }()
+	if err := readReply(client); err != nil {
+		t.Fatalf("read proxy reply: %v", err)
+	}
+
+	select {
+	case addr := <-dialed.addrs:
+		return addr
+	case <-time.After(2 * time.Second):
+		t.Fatal("proxy never dialed the target")
+		return ""
+	}
+}
+
+func readHTTPReply(conn net.Conn) error {
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func readSocks4Reply(conn net.Conn) error {
+	_, err := io.ReadFull(conn, make([]byte, 8))
+	return err
+}
+
+func readSocks5Reply(conn net.Conn) error {
+	// Method selection, then VER REP RSV ATYP and an IPv4 or IPv6 bind address
+	head := make([]byte, 2+4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	addrLen := net.IPv4len
+	if head[5] == 0x04 {
+		addrLen = net.IPv6len
+	}
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func socks4aRequest(host string, port uint16) []byte {
+	req := []byte{0x04, 0x01, 0, 0, 0, 0, 0, 1, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+	return append(append(req, host...), 0)
+}
+
+func socks5Request(atyp byte, addr []byte, port uint16) []byte {
+	req := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, atyp}
+	if atyp == 0x03 {
+		req = append(req, byte(len(addr)))
+	}
+	req = append(req, addr...)
+	return binary.BigEndian.AppendUint16(req, port)
+}
+
+func TestIPv6Targets(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		reply   func(net.Conn) error
+		want    string
+	}{
+		{
+			name:    "http connect",
+			request: []byte("CONNECT [::1]:8443 HTTP/1.1\r\nHost: [::1]:8443\r\n\r\n"),
+			reply:   readHTTPReply,
+			want:    "[::1]:8443",
+		},
+		{
+			name:    "http connect without port",
+			request: []byte("CONNECT [2001:db8::1] HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n"),
+			reply:   readHTTPReply,
+			want:    "[2001:db8::1]:443",
+		},
+		{
+			name:    "http absolute url without port",
+			request: []byte("GET http://[::1]/ HTTP/1.1\r\nHost: [::1]\r\n\r\n"),
+			reply:   func(net.Conn) error { return nil },
+			want:    "[::1]:80",
+		},
+		{
+			name:    "socks4a hostname",
+			request: socks4aRequest("v6only.example", 8080),
+			reply:   readSocks4Reply,
+			want:    "v6only.example:8080",
+		},
+		{
+			name:    "socks4a bracketed literal",
+			request: socks4aRequest("[2001:db8::1]", 8080),
+			reply:   readSocks4Reply,
+			want:    "[2001:db8::1]:8080",
+		},
+		{
+			name:    "socks5 ipv6",
+			request: socks5Request(0x04, net.ParseIP("2001:db8::1"), 443),
+			reply:   readSocks5Reply,
+			want:    "[2001:db8::1]:443",
+		},
+		{
+			name:    "socks5 bracketed literal as domain",
+			request: socks5Request(0x03, []byte("[::1]"), 443),
+			reply:   readSocks5Reply,
+			want:    "[::1]:443",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(t, tt.request, tt.reply); got != tt.want {
+				t.Fatalf("proxy dialed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPv6TargetsUserHandler(t *testing.T) {
+	requests := make(chan *statute.ProxyRequest, 1)
+	p := NewProxy(
+		WithLogger(slog.New(slog.DiscardHandler)),
+		WithUserHandler(func(req *statute.ProxyRequest) error {
+			requests <- req
+			return nil
+		}),
+	)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		_ = p.handleConnection(server)
+	}()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	go func() { _, _ = client.Write([]byte("CONNECT [::1]:8443 HTTP/1.1\r\nHost: [::1]:8443\r\n\r\n")) }()
+	if err := readHTTPReply(client); err != nil {
+		t.Fatalf("read CONNECT reply: %v", err)
+	}
+
+	req := <-requests
+	if req.Destination != "[::1]:8443" || req.DestHost != "::1" || req.DestPort != 8443 {
+		t.Fatalf("request = %s host %s port %d, want [::1]:8443 host ::1 port 8443", req.Destination, req.DestHost, req.DestPort)
+	}
+}
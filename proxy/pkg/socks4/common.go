@@ -3,14 +3,18 @@ package socks4
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 )
 
 var (
 	isSocks4a = []byte{0, 0, 0, 1}
 	isNone    = []byte{0, 0, 0, 0}
+
+	errDestinationDenied = errors.New("destination not allowed by ACL")
 )
 
 const (
@@ -137,7 +141,12 @@ func readAddrAndUser(r io.Reader) (*AddrAnfUser, error) {
 		if err != nil {
 			return nil, err
 		}
-		address.Name = string(hostname)
+		// SOCKS4a is the only way to reach an IPv6 literal, often sent bracketed
+		if ip := net.ParseIP(strings.Trim(string(hostname), "[]")); ip != nil {
+			address.IP = ip
+		} else {
+			address.Name = string(hostname)
+		}
 	} else {
 		address.IP = ip
 	}
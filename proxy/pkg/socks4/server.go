@@ -6,7 +6,9 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"time"
 
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
 	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
 )
 
@@ -28,6 +30,10 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// ACL restricts the destinations clients may connect to (nil allows all)
+	ACL *acl.ACL
+	// RequestLog selects how much of each request is logged (off by default)
+	RequestLog statute.RequestLog
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -127,6 +133,18 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithACL(a *acl.ACL) ServerOption {
+	return func(s *Server) {
+		s.ACL = a
+	}
+}
+
+func WithRequestLog(mode statute.RequestLog) ServerOption {
+	return func(s *Server) {
+		s.RequestLog = mode
+	}
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
 	version, err := readByte(conn)
 	if err != nil {
@@ -155,10 +173,12 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 	req.DestinationAddr = &addr.address
 	req.Username = addr.Username
+	req.Received = time.Now()
 	return s.handle(req)
 }
 
 func (s *Server) handle(req *request) error {
+	s.logRequest(req)
 	switch req.Command {
 	case ConnectCommand:
 		return s.handleConnect(req)
@@ -171,6 +191,17 @@ func (s *Server) handle(req *request) error {
 }
 
 func (s *Server) handleConnect(req *request) error {
+	host := req.DestinationAddr.IP.String()
+	if req.DestinationAddr.Name != "" {
+		host = req.DestinationAddr.Name
+	}
+	if !s.ACL.Allowed(host, req.DestinationAddr.Port) {
+		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("connect to %v: %w", req.DestinationAddr, errDestinationDenied)
+	}
+
 	if s.UserConnectHandle == nil {
 		return s.embedHandleConnect(req)
 	}
@@ -178,10 +209,6 @@ func (s *Server) handleConnect(req *request) error {
 	if err := sendReply(req.Conn, grantedReply, nil); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
-	host := req.DestinationAddr.IP.String()
-	if req.DestinationAddr.Name != "" {
-		host = req.DestinationAddr.Name
-	}
 
 	proxyReq := &statute.ProxyRequest{
 		Conn:        req.Conn,
@@ -191,6 +218,7 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+		Received:    req.Received,
 	}
 
 	return s.UserConnectHandle(proxyReq)
@@ -246,4 +274,14 @@ type request struct {
 	DestinationAddr *address
 	Username        string
 	Conn            net.Conn
+	Received        time.Time // When the request was read
+}
+
+// logRequest logs the command and destination of req if s.RequestLog is set;
+// the user ID of the client are never logged
+func (s *Server) logRequest(req *request) {
+	if s.RequestLog == statute.RequestLogOff {
+		return
+	}
+	s.Logger.Info("proxy request", "protocol", "socks4", "command", req.Command.String(), "host", req.DestinationAddr.String())
 }
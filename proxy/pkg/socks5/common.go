@@ -10,16 +10,20 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	errStringTooLong        = errors.New("string too long")
 	errNoSupportedAuth      = errors.New("no supported authentication mechanism")
 	errUnrecognizedAddrType = errors.New("unrecognized address type")
+	errDestinationDenied    = errors.New("destination not allowed by ACL")
 )
 
 const (
 	maxUdpPacket = 2048
+	// resolveTimeout bounds RESOLVE and RESOLVE_PTR lookups
+	resolveTimeout = 10 * time.Second
 )
 
 const (
@@ -29,6 +33,9 @@ const (
 const (
 	ConnectCommand   Command = 0x01
 	AssociateCommand Command = 0x03
+	// ResolveCommand and ResolvePTRCommand are the Tor name lookup extensions
+	ResolveCommand    Command = 0xf0
+	ResolvePTRCommand Command = 0xf1
 )
 
 // Command is a SOCKS Command.
@@ -40,6 +47,10 @@ func (cmd Command) String() string {
 		return "socks connect"
 	case AssociateCommand:
 		return "socks associate"
+	case ResolveCommand:
+		return "socks resolve"
+	case ResolvePTRCommand:
+		return "socks resolve ptr"
 	default:
 		return "socks " + strconv.Itoa(int(cmd))
 	}
@@ -122,6 +133,14 @@ func (a *address) String() string {
 	return a.Address()
 }
 
+// host returns the domain name if set, otherwise the IP
+func (a address) host() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.IP.String()
+}
+
 // Address returns a string suitable to dial; prefer returning IP-based
 // address, fallback to Name
 func (a address) Address() string {
@@ -142,7 +161,7 @@ const (
 
 func readBytes(r io.Reader) ([]byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return nil, err
 	}
@@ -165,7 +184,7 @@ func readBytes(r io.Reader) ([]byte, error) {
 
 func readByte(r io.Reader) (byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return 0, err
 	}
@@ -202,7 +221,12 @@ func readAddr(r io.Reader) (*address, error) {
 		if _, err := io.ReadFull(r, fqdn); err != nil {
 			return nil, err
 		}
-		address.Name = string(fqdn)
+		// Some clients send IP literals, bracketed IPv6 included, as a domain name
+		if ip := net.ParseIP(strings.Trim(string(fqdn), "[]")); ip != nil {
+			address.IP = ip
+		} else {
+			address.Name = string(fqdn)
+		}
 	default:
 		return nil, errUnrecognizedAddrType
 	}
@@ -3,11 +3,15 @@ package socks5
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"strings"
+	"time"
 
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
 	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
 )
 
@@ -36,6 +40,13 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// ACL restricts the destinations clients may connect to (nil allows all)
+	ACL *acl.ACL
+	// RequestLog selects how much of each request is logged (off by default)
+	RequestLog statute.RequestLog
+	// Resolver answers RESOLVE and RESOLVE_PTR requests; nil rejects them so
+	// lookups never bypass the tunnel
+	Resolver statute.Resolver
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -156,6 +167,46 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithACL(a *acl.ACL) ServerOption {
+	return func(s *Server) {
+		s.ACL = a
+	}
+}
+
+func WithRequestLog(mode statute.RequestLog) ServerOption {
+	return func(s *Server) {
+		s.RequestLog = mode
+	}
+}
+
+func WithResolver(resolver statute.Resolver) ServerOption {
+	return func(s *Server) {
+		s.Resolver = resolver
+	}
+}
+
+// selectMethod reads the client's METHODS list and selects no-auth, the only
+// method the server supports. A client that doesn't offer it, e.g. one
+// offering only GSS-API, gets 0xFF and the connection is closed.
+func selectMethod(conn net.Conn) error {
+	methods, err := readBytes(conn)
+	if err != nil {
+		return err
+	}
+
+	if bytes.IndexByte(methods, byte(noAuth)) == -1 {
+		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
+		_ = conn.Close()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: offered %x", errNoSupportedAuth, methods)
+	}
+
+	_, err = conn.Write([]byte{socks5Version, byte(noAuth)})
+	return err
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
 	version, err := readByte(conn)
 	if err != nil {
@@ -170,24 +221,10 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		Conn:    conn,
 	}
 
-	methods, err := readBytes(conn)
-	if err != nil {
+	if err := selectMethod(conn); err != nil {
 		return err
 	}
 
-	if bytes.IndexByte(methods, byte(noAuth)) != -1 {
-		_, err := conn.Write([]byte{socks5Version, byte(noAuth)})
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
-		if err != nil {
-			return err
-		}
-		return errNoSupportedAuth
-	}
-
 	var header [3]byte
 	_, err = io.ReadFull(conn, header[:])
 	if err != nil {
@@ -211,6 +248,7 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 	req.DestinationAddr = dest
+	req.Received = time.Now()
 	err = s.handle(req)
 	if err != nil {
 		return err
@@ -220,20 +258,103 @@ func (s *Server) ServeConn(conn net.Conn) error {
 }
 
 func (s *Server) handle(req *request) error {
+	s.logRequest(req)
 	switch req.Command {
 	case ConnectCommand:
 		return s.handleConnect(req)
 	case AssociateCommand:
 		return s.handleAssociate(req)
-	default:
-		if err := sendReply(req.Conn, commandNotSupported, nil); err != nil {
-			return err
+	case ResolveCommand, ResolvePTRCommand:
+		if s.Resolver != nil {
+			return s.handleResolve(req)
 		}
-		return fmt.Errorf("unsupported Command: %v", req.Command)
 	}
+	if err := sendReply(req.Conn, commandNotSupported, nil); err != nil {
+		return err
+	}
+	return fmt.Errorf("unsupported Command: %v", req.Command)
+}
+
+func (s *Server) handleResolve(req *request) error {
+	defer func() {
+		_ = req.Conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(s.Context, resolveTimeout)
+	defer cancel()
+
+	var answer *address
+	var err error
+	if req.Command == ResolveCommand {
+		answer, err = s.resolve(ctx, req.DestinationAddr)
+	} else {
+		answer, err = s.resolvePTR(ctx, req.DestinationAddr)
+	}
+	if err != nil {
+		if err := sendReply(req.Conn, hostUnreachable, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("%v %s failed: %w", req.Command, req.DestinationAddr.host(), err)
+	}
+
+	if err := sendReply(req.Conn, successReply, answer); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	return nil
+}
+
+// resolve looks up the address of a name, preferring IPv4 since some clients
+// only accept IPv4 answers
+func (s *Server) resolve(ctx context.Context, dest *address) (*address, error) {
+	if dest.Name == "" {
+		return &address{IP: dest.IP}, nil
+	}
+	addrs, err := s.Resolver.LookupHost(ctx, dest.Name)
+	if err != nil {
+		return nil, err
+	}
+	var answer net.IP
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			return &address{IP: ip}, nil
+		}
+		if answer == nil {
+			answer = ip
+		}
+	}
+	if answer == nil {
+		return nil, fmt.Errorf("no address found for %s", dest.Name)
+	}
+	return &address{IP: answer}, nil
+}
+
+// resolvePTR looks up the name of an address
+func (s *Server) resolvePTR(ctx context.Context, dest *address) (*address, error) {
+	if dest.Name != "" {
+		return nil, errors.New("RESOLVE_PTR needs an IP address")
+	}
+	names, err := s.Resolver.LookupAddr(ctx, dest.IP.String())
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no name found for %s", dest.IP)
+	}
+	return &address{Name: strings.TrimSuffix(names[0], ".")}, nil
 }
 
 func (s *Server) handleConnect(req *request) error {
+	if !s.ACL.Allowed(req.DestinationAddr.host(), req.DestinationAddr.Port) {
+		if err := sendReply(req.Conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("connect to %v: %w", req.DestinationAddr, errDestinationDenied)
+	}
+
 	if s.UserConnectHandle == nil {
 		return s.embedHandleConnect(req)
 	}
@@ -241,19 +362,15 @@ func (s *Server) handleConnect(req *request) error {
 	if err := sendReply(req.Conn, successReply, nil); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
-	host := req.DestinationAddr.IP.String()
-	if req.DestinationAddr.Name != "" {
-		host = req.DestinationAddr.Name
-	}
-
 	proxyReq := &statute.ProxyRequest{
 		Conn:        req.Conn,
 		Reader:      io.Reader(req.Conn),
 		Writer:      io.Writer(req.Conn),
 		Network:     "tcp",
 		Destination: req.DestinationAddr.String(),
-		DestHost:    host,
+		DestHost:    req.DestinationAddr.host(),
 		DestPort:    int32(req.DestinationAddr.Port),
+		Received:    req.Received,
 	}
 
 	return s.UserConnectHandle(proxyReq)
@@ -445,6 +562,7 @@ type request struct {
 	Username        string
 	Password        string
 	Conn            net.Conn
+	Received        time.Time // When the request was read
 }
 
 func defaultReplyPacketForwardAddress(_ context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (net.IP, int, error) {
@@ -461,3 +579,12 @@ func defaultReplyPacketForwardAddress(_ context.Context, destinationAddr string,
 	}
 	return tcpLocalAddr.IP, udpLocalAddr.Port, nil
 }
+
+// logRequest logs the command and destination of req if s.RequestLog is set;
+// the credentials of the client are never logged
+func (s *Server) logRequest(req *request) {
+	if s.RequestLog == statute.RequestLogOff {
+		return
+	}
+	s.Logger.Info("proxy request", "protocol", "socks5", "command", req.Command.String(), "host", req.DestinationAddr.String())
+}
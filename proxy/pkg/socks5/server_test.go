@@ -0,0 +1,179 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers from fixed tables
+type fakeResolver struct {
+	hosts map[string][]string
+	addrs map[string][]string
+}
+
+func (r fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if names, ok := r.addrs[addr]; ok {
+		return names, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+var testResolver = fakeResolver{
+	hosts: map[string][]string{
+		"example.com": {"2606:2800:220:1:248:1893:25c8:1946", "93.184.216.34"},
+		"v6.example":  {"2001:db8::1"},
+	},
+	addrs: map[string][]string{
+		"1.1.1.1": {"one.one.one.one."},
+	},
+}
+
+// roundTrip sends a no-auth greeting and a request for cmd with dest, and
+// returns the reply code and the address in the reply
+func roundTrip(t *testing.T, s *Server, cmd Command, dest *address) (reply, *address) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _ = s.ServeConn(server) }()
+
+	var req bytes.Buffer
+	req.Write([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(cmd), 0})
+	if err := writeAddr(&req, dest); err != nil {
+		t.Fatalf("writeAddr: %v", err)
+	}
+	go func() { _, _ = client.Write(req.Bytes()) }()
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var head [5]byte
+	if _, err := io.ReadFull(client, head[:]); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if head[0] != socks5Version || head[1] != byte(noAuth) {
+		t.Fatalf("unexpected method selection %x", head[:2])
+	}
+	addr, err := readAddr(client)
+	if err != nil {
+		t.Fatalf("read reply address: %v", err)
+	}
+	return reply(head[3]), addr
+}
+
+func TestResolve(t *testing.T) {
+	s := NewServer(WithResolver(testResolver))
+
+	code, addr := roundTrip(t, s, ResolveCommand, &address{Name: "example.com"})
+	if code != successReply || !addr.IP.Equal(net.ParseIP("93.184.216.34")) {
+		t.Fatalf("RESOLVE example.com = %v %v, want the IPv4 address", code, addr)
+	}
+
+	code, addr = roundTrip(t, s, ResolveCommand, &address{Name: "v6.example"})
+	if code != successReply || !addr.IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("RESOLVE v6.example = %v %v", code, addr)
+	}
+
+	code, _ = roundTrip(t, s, ResolveCommand, &address{Name: "missing.example"})
+	if code != hostUnreachable {
+		t.Fatalf("RESOLVE of an unknown name = %v, want %v", code, hostUnreachable)
+	}
+}
+
+func TestResolvePTR(t *testing.T) {
+	s := NewServer(WithResolver(testResolver))
+
+	code, addr := roundTrip(t, s, ResolvePTRCommand, &address{IP: net.ParseIP("1.1.1.1")})
+	if code != successReply || addr.Name != "one.one.one.one" {
+		t.Fatalf("RESOLVE_PTR 1.1.1.1 = %v %v", code, addr)
+	}
+}
+
+func TestResolveWithoutResolver(t *testing.T) {
+	code, _ := roundTrip(t, NewServer(), ResolveCommand, &address{Name: "example.com"})
+	if code != commandNotSupported {
+		t.Fatalf("RESOLVE without a resolver = %v, want %v", code, commandNotSupported)
+	}
+}
+
+// greet sends a greeting offering methods and returns the selected method
+// and the error ServeConn returned
+func greet(t *testing.T, methods ...byte) (byte, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- NewServer().ServeConn(server) }()
+
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	go func() { _, _ = client.Write(greeting) }()
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var selection [2]byte
+	if _, err := io.ReadFull(client, selection[:]); err != nil {
+		t.Fatalf("read method selection: %v", err)
+	}
+	if selection[0] != socks5Version {
+		t.Fatalf("method selection version = %d, want %d", selection[0], socks5Version)
+	}
+	if authMethod(selection[1]) != noAuth {
+		return selection[1], <-served
+	}
+	return selection[1], nil
+}
+
+func TestMethodSelectionRejectsGSSAPIOnly(t *testing.T) {
+	method, err := greet(t, 0x01)
+	if method != byte(noAcceptable) {
+		t.Fatalf("selected method %#x, want %#x", method, byte(noAcceptable))
+	}
+	if !errors.Is(err, errNoSupportedAuth) {
+		t.Fatalf("ServeConn error = %v, want %v", err, errNoSupportedAuth)
+	}
+}
+
+func TestMethodSelectionClosesAfterRefusal(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- NewServer().ServeConn(server) }()
+	go func() { _, _ = client.Write([]byte{socks5Version, 1, 0x01}) }()
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var selection [2]byte
+	if _, err := io.ReadFull(client, selection[:]); err != nil {
+		t.Fatalf("read method selection: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after refusal = %v, want %v", err, io.EOF)
+	}
+	if err := <-served; !errors.Is(err, errNoSupportedAuth) {
+		t.Fatalf("ServeConn error = %v, want %v", err, errNoSupportedAuth)
+	}
+}
+
+func TestMethodSelectionRejectsEmptyList(t *testing.T) {
+	method, err := greet(t)
+	if method != byte(noAcceptable) {
+		t.Fatalf("selected method %#x, want %#x", method, byte(noAcceptable))
+	}
+	if !errors.Is(err, errNoSupportedAuth) {
+		t.Fatalf("ServeConn error = %v, want %v", err, errNoSupportedAuth)
+	}
+}
+
+func TestMethodSelectionPicksNoAuth(t *testing.T) {
+	method, _ := greet(t, 0x01, byte(noAuth))
+	if method != byte(noAuth) {
+		t.Fatalf("selected method %#x, want %#x", method, byte(noAuth))
+	}
+}
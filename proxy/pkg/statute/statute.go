@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"time"
 )
 
 type Logger interface {
@@ -12,14 +14,15 @@ type Logger interface {
 	Error(v ...interface{})
 }
 
+// DefaultLogger writes to stderr, leaving stdout to programs embedding the proxy
 type DefaultLogger struct{}
 
 func (l DefaultLogger) Debug(v ...interface{}) {
-	fmt.Println(v...)
+	fmt.Fprintln(os.Stderr, v...)
 }
 
 func (l DefaultLogger) Error(v ...interface{}) {
-	fmt.Println(v...)
+	fmt.Fprintln(os.Stderr, v...)
 }
 
 type ProxyRequest struct {
@@ -30,6 +33,9 @@ type ProxyRequest struct {
 	Destination string
 	DestHost    string
 	DestPort    int32
+	// Received is when the proxy finished reading the request, zero if
+	// the server doesn't record it; connection timings are measured from it
+	Received time.Time
 }
 
 // UserConnectHandler is used for socks5, socks4 and http
@@ -61,6 +67,13 @@ func DefaultProxyListenPacket() ProxyListenPacket {
 type PacketForwardAddress func(ctx context.Context, destinationAddr string,
 	packet net.PacketConn, conn net.Conn) (net.IP, int, error)
 
+// Resolver looks up names for socks5 RESOLVE and RESOLVE_PTR requests.
+// *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
 // BytesPool is an interface for getting and returning temporary
 // bytes for use by io.CopyBuffer.
 type BytesPool interface {
@@ -74,3 +87,16 @@ func DefaultContext() context.Context {
 }
 
 const DefaultBindAddress = "127.0.0.1:1080"
+
+// RequestLog selects how much of each proxied request is logged
+type RequestLog int
+
+const (
+	// RequestLogOff logs no requests
+	RequestLogOff RequestLog = iota
+	// RequestLogHost logs the method or command and the destination host:port
+	RequestLogHost
+	// RequestLogFull also logs the URL of plain HTTP requests. Credentials
+	// are never logged in either mode.
+	RequestLogFull
+)
@@ -0,0 +1,9 @@
+package transparent
+
+import "errors"
+
+var (
+	errNoHandler   = errors.New("transparent proxy requires a connect handler")
+	errUnsupported = errors.New("transparent proxy is only supported on linux")
+	errNotTCP      = errors.New("original destination requires a TCP connection")
+)
@@ -0,0 +1,96 @@
+//go:build linux
+
+package transparent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenConfig marks listening sockets IP_TRANSPARENT so they can accept
+// TPROXY-redirected connections. This needs CAP_NET_ADMIN; without it the
+// option is skipped and only REDIRECT rules work.
+func listenConfig() net.ListenConfig {
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				_ = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			})
+		},
+	}
+}
+
+// OriginalDestination returns the address a redirected connection was
+// originally sent to. Connections redirected with iptables REDIRECT/DNAT carry
+// it in SO_ORIGINAL_DST; with TPROXY the socket's local address already is the
+// original destination.
+func OriginalDestination(conn net.Conn) (netip.AddrPort, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errNotTCP
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	local := tcpConn.LocalAddr().(*net.TCPAddr).AddrPort()
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			dst, sockErr = originalDst4(int(fd))
+		} else {
+			dst, sockErr = originalDst6(int(fd))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	// No conntrack NAT entry (or conntrack not loaded): TPROXY or a direct connection
+	if errors.Is(sockErr, unix.ENOENT) || errors.Is(sockErr, unix.ENOPROTOOPT) {
+		return netip.AddrPortFrom(local.Addr().Unmap(), local.Port()), nil
+	}
+	if sockErr != nil {
+		return netip.AddrPort{}, sockErr
+	}
+	return dst, nil
+}
+
+func originalDst4(fd int) (netip.AddrPort, error) {
+	var sa unix.RawSockaddrInet4
+	size := uint32(unsafe.Sizeof(sa))
+	if err := getsockopt(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sa), &size); err != nil {
+		return netip.AddrPort{}, err
+	}
+	port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+	return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), port), nil
+}
+
+func originalDst6(fd int) (netip.AddrPort, error) {
+	var sa unix.RawSockaddrInet6
+	size := uint32(unsafe.Sizeof(sa))
+	if err := getsockopt(fd, unix.SOL_IPV6, unix.SO_ORIGINAL_DST, unsafe.Pointer(&sa), &size); err != nil {
+		return netip.AddrPort{}, err
+	}
+	port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+	return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr).Unmap(), port), nil
+}
+
+func getsockopt(fd, level, name int, val unsafe.Pointer, size *uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
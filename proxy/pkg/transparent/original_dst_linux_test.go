@@ -0,0 +1,58 @@
+package transparent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDestination(t *testing.T) {
+	ln, err := Listen(t.Context(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+
+	// Without a NAT rule there is no conntrack entry, so the original
+	// destination is the address the client dialed
+	dst, err := OriginalDestination(server)
+	if err != nil {
+		t.Fatalf("OriginalDestination: %v", err)
+	}
+
+	want := client.RemoteAddr().(*net.TCPAddr).AddrPort()
+	if dst != want {
+		t.Fatalf("OriginalDestination = %s, want %s", dst, want)
+	}
+}
+
+func TestOriginalDestinationRequiresTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := OriginalDestination(server); err != errNotTCP {
+		t.Fatalf("OriginalDestination error = %v, want %v", err, errNotTCP)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"net"
+	"net/netip"
+)
+
+func listenConfig() net.ListenConfig {
+	return net.ListenConfig{}
+}
+
+// OriginalDestination is only implemented on Linux
+func OriginalDestination(conn net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errUnsupported
+}
@@ -0,0 +1,150 @@
+package transparent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
+)
+
+// Server accepts connections redirected by the kernel (iptables REDIRECT or
+// TPROXY) and hands them to the user handler with their original destination,
+// without any proxy handshake
+type Server struct {
+	// bind is the address to listen on
+	Bind string
+
+	Listener net.Listener
+
+	// UserConnectHandle handles the intercepted TCP connections
+	UserConnectHandle statute.UserConnectHandler
+	// Logger error log
+	Logger *slog.Logger
+	// Context is default context
+	Context context.Context
+}
+
+func NewServer(options ...ServerOption) *Server {
+	s := &Server{
+		Bind:    statute.DefaultBindAddress,
+		Logger:  slog.Default(),
+		Context: statute.DefaultContext(),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+type ServerOption func(*Server)
+
+// Listen creates a listener suitable for transparent proxying. On Linux the
+// socket is marked IP_TRANSPARENT so that it can accept TPROXY traffic.
+func Listen(ctx context.Context, address string) (net.Listener, error) {
+	lc := listenConfig()
+	return lc.Listen(ctx, "tcp", address)
+}
+
+func (s *Server) ListenAndServe() error {
+	// Create a new listener
+	if s.Listener == nil {
+		ln, err := Listen(s.Context, s.Bind)
+		if err != nil {
+			return err // Return error if binding was unsuccessful
+		}
+		s.Listener = ln
+	}
+
+	s.Bind = s.Listener.Addr().(*net.TCPAddr).String()
+
+	// ensure listener will be closed
+	defer func() {
+		_ = s.Listener.Close()
+	}()
+
+	// Create a cancelable context based on s.Context
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel() // Ensure resources are cleaned up
+
+	// Start to accept connections and serve them
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			conn, err := s.Listener.Accept()
+			if err != nil {
+				s.Logger.Error(err.Error())
+				continue
+			}
+
+			// Start a new goroutine to handle each connection
+			// This way, the server can handle multiple connections concurrently
+			go func() {
+				err := s.ServeConn(conn)
+				if err != nil {
+					s.Logger.Error(err.Error()) // Log errors from ServeConn
+				}
+			}()
+		}
+	}
+}
+
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+func WithBind(bindAddress string) ServerOption {
+	return func(s *Server) {
+		s.Bind = bindAddress
+	}
+}
+
+func WithListener(ln net.Listener) ServerOption {
+	return func(s *Server) {
+		s.Listener = ln
+	}
+}
+
+func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
+	return func(s *Server) {
+		s.UserConnectHandle = handler
+	}
+}
+
+func WithContext(ctx context.Context) ServerOption {
+	return func(s *Server) {
+		s.Context = ctx
+	}
+}
+
+func (s *Server) ServeConn(conn net.Conn) error {
+	if s.UserConnectHandle == nil {
+		_ = conn.Close()
+		return errNoHandler
+	}
+
+	dst, err := OriginalDestination(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	proxyReq := &statute.ProxyRequest{
+		Conn:        conn,
+		Reader:      io.Reader(conn),
+		Writer:      io.Writer(conn),
+		Network:     "tcp",
+		Destination: dst.String(),
+		DestHost:    dst.Addr().String(),
+		DestPort:    int32(dst.Port()),
+	}
+
+	return s.UserConnectHandle(proxyReq)
+}
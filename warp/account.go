@@ -10,6 +10,10 @@ import (
 
 var identityFile = "wgcf-identity.json"
 
+// ErrTOSNotAccepted is returned when a new identity would be registered
+// without accepting the Cloudflare terms of service
+var ErrTOSNotAccepted = errors.New("registering a device requires accepting the Cloudflare terms of service")
+
 func saveIdentity(a Identity, path string) error {
 	file, err := os.Create(filepath.Join(path, identityFile))
 	if err != nil {
@@ -26,7 +30,10 @@ func saveIdentity(a Identity, path string) error {
 	return file.Close()
 }
 
-func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, error) {
+// LoadOrCreateIdentity loads the identity at path, registering a new one when
+// there is none. Registering sends the acceptance of the Cloudflare terms of
+// service and fails with ErrTOSNotAccepted unless acceptTOS is set.
+func LoadOrCreateIdentity(l *slog.Logger, path, license string, acceptTOS bool) (*Identity, error) {
 	l = l.With("subsystem", "warp/account")
 
 	warpAPI := NewWarpAPI(l)
@@ -34,6 +41,10 @@ func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, erro
 	i, err := LoadIdentity(path)
 	if err != nil {
 		l.Info("failed to load identity", "path", path, "error", err)
+		// Keep whatever is there when no new identity may replace it
+		if !acceptTOS {
+			return nil, ErrTOSNotAccepted
+		}
 		if err := os.RemoveAll(path); err != nil {
 			return nil, err
 		}
@@ -42,7 +53,7 @@ func LoadOrCreateIdentity(l *slog.Logger, path, license string) (*Identity, erro
 			return nil, err
 		}
 
-		i, err = CreateIdentity(l, warpAPI, license)
+		i, err = CreateIdentity(l, warpAPI, license, acceptTOS)
 		if err != nil {
 			return nil, err
 		}
@@ -99,7 +110,10 @@ func LoadIdentity(path string) (Identity, error) {
 	return *i, nil
 }
 
-func CreateIdentity(l *slog.Logger, warpAPI *WarpAPI, license string) (Identity, error) {
+func CreateIdentity(l *slog.Logger, warpAPI *WarpAPI, license string, acceptTOS bool) (Identity, error) {
+	if !acceptTOS {
+		return Identity{}, ErrTOSNotAccepted
+	}
 	priv, err := GeneratePrivateKey()
 	if err != nil {
 		return Identity{}, err
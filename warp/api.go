@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -14,6 +15,11 @@ import (
 
 const (
 	apiBase string = "https://api.cloudflareclient.com/v0a4005"
+
+	// apiTimeout bounds a whole API request, reading the response included
+	apiTimeout = 30 * time.Second
+	// maxAPIResponseSize caps how much of an API response is read; real ones are a few KiB
+	maxAPIResponseSize = 1 << 20
 )
 
 func defaultHeaders() map[string]string {
@@ -111,6 +117,7 @@ type License struct {
 type WarpAPI struct {
 	l      *slog.Logger
 	client *http.Client
+	base   string // API URL the endpoint paths are appended to
 }
 
 func NewWarpAPI(l *slog.Logger) *WarpAPI {
@@ -124,12 +131,40 @@ func NewWarpAPI(l *slog.Logger) *WarpAPI {
 
 	return &WarpAPI{
 		l:      l,
-		client: &http.Client{Transport: transport},
+		client: &http.Client{Transport: transport, Timeout: apiTimeout},
+		base:   apiBase,
 	}
 }
 
+// do sends req and returns the body of a successful response. A response
+// larger than maxAPIResponseSize is an error rather than read in full.
+func (w *WarpAPI) do(req *http.Request) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), apiTimeout)
+	defer cancel()
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("API request failed with status: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(nil, resp.Body, maxAPIResponseSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, fmt.Errorf("API response exceeds %d bytes: %w", tooLarge.Limit, err)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
 func (w *WarpAPI) GetAccount(authToken, deviceID string) (IdentityAccount, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account", w.base, deviceID)
 	method := "GET"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -143,19 +178,7 @@ func (w *WarpAPI) GetAccount(authToken, deviceID string) (IdentityAccount, error
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return IdentityAccount{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return IdentityAccount{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return IdentityAccount{}, err
 	}
@@ -169,7 +192,7 @@ func (w *WarpAPI) GetAccount(authToken, deviceID string) (IdentityAccount, error
 }
 
 func (w *WarpAPI) GetBoundDevices(authToken, deviceID string) ([]IdentityDevice, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account/devices", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account/devices", w.base, deviceID)
 	method := "GET"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -183,19 +206,7 @@ func (w *WarpAPI) GetBoundDevices(authToken, deviceID string) ([]IdentityDevice,
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -209,7 +220,7 @@ func (w *WarpAPI) GetBoundDevices(authToken, deviceID string) ([]IdentityDevice,
 }
 
 func (w *WarpAPI) GetSourceDevice(authToken, deviceID string) (Identity, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s", w.base, deviceID)
 	method := "GET"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -223,19 +234,7 @@ func (w *WarpAPI) GetSourceDevice(authToken, deviceID string) (Identity, error)
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return Identity{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return Identity{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return Identity{}, err
 	}
@@ -249,7 +248,7 @@ func (w *WarpAPI) GetSourceDevice(authToken, deviceID string) (Identity, error)
 }
 
 func (w *WarpAPI) Register(publicKey string) (Identity, error) {
-	reqUrl := fmt.Sprintf("%s/reg", apiBase)
+	reqUrl := fmt.Sprintf("%s/reg", w.base)
 	method := "POST"
 
 	data := map[string]interface{}{
@@ -278,19 +277,7 @@ func (w *WarpAPI) Register(publicKey string) (Identity, error) {
 		req.Header.Set(k, v)
 	}
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return Identity{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return Identity{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return Identity{}, err
 	}
@@ -304,7 +291,7 @@ func (w *WarpAPI) Register(publicKey string) (Identity, error) {
 }
 
 func (w *WarpAPI) ResetAccountLicense(authToken, deviceID string) (License, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account/license", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account/license", w.base, deviceID)
 	method := "POST"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -318,19 +305,7 @@ func (w *WarpAPI) ResetAccountLicense(authToken, deviceID string) (License, erro
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return License{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return License{}, fmt.Errorf("API request failed with response: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return License{}, err
 	}
@@ -344,7 +319,7 @@ func (w *WarpAPI) ResetAccountLicense(authToken, deviceID string) (License, erro
 }
 
 func (w *WarpAPI) UpdateAccount(authToken, deviceID, license string) (IdentityAccount, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account", w.base, deviceID)
 	method := "PUT"
 
 	jsonBody, err := json.Marshal(map[string]interface{}{"license": license})
@@ -363,19 +338,7 @@ func (w *WarpAPI) UpdateAccount(authToken, deviceID, license string) (IdentityAc
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return IdentityAccount{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return IdentityAccount{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return IdentityAccount{}, err
 	}
@@ -389,7 +352,7 @@ func (w *WarpAPI) UpdateAccount(authToken, deviceID, license string) (IdentityAc
 }
 
 func (w *WarpAPI) UpdateBoundDevice(authToken, deviceID, otherDeviceID, name string, active bool) (IdentityDevice, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s/account/reg/%s", apiBase, deviceID, otherDeviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s/account/reg/%s", w.base, deviceID, otherDeviceID)
 	method := "PATCH"
 
 	data := map[string]interface{}{
@@ -413,19 +376,7 @@ func (w *WarpAPI) UpdateBoundDevice(authToken, deviceID, otherDeviceID, name str
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return IdentityDevice{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return IdentityDevice{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return IdentityDevice{}, err
 	}
@@ -439,7 +390,7 @@ func (w *WarpAPI) UpdateBoundDevice(authToken, deviceID, otherDeviceID, name str
 }
 
 func (w *WarpAPI) UpdateSourceDevice(authToken, deviceID, publicKey string) (Identity, error) {
-	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s", w.base, deviceID)
 	method := "PATCH"
 
 	jsonBody, err := json.Marshal(map[string]interface{}{"key": publicKey})
@@ -458,19 +409,7 @@ func (w *WarpAPI) UpdateSourceDevice(authToken, deviceID, publicKey string) (Ide
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return Identity{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return Identity{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// convert response to byte array
-	responseData, err := io.ReadAll(resp.Body)
+	responseData, err := w.do(req)
 	if err != nil {
 		return Identity{}, err
 	}
@@ -484,7 +423,7 @@ func (w *WarpAPI) UpdateSourceDevice(authToken, deviceID, publicKey string) (Ide
 }
 
 func (w *WarpAPI) DeleteDevice(authToken, deviceID string) error {
-	reqUrl := fmt.Sprintf("%s/reg/%s", apiBase, deviceID)
+	reqUrl := fmt.Sprintf("%s/reg/%s", w.base, deviceID)
 	method := "DELETE"
 
 	req, err := http.NewRequest(method, reqUrl, nil)
@@ -498,16 +437,6 @@ func (w *WarpAPI) DeleteDevice(authToken, deviceID string) error {
 	}
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
-	// Create HTTP client and execute request
-	resp, err := w.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	return nil
+	_, err = w.do(req)
+	return err
 }
@@ -0,0 +1,76 @@
+package warp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestAPI(t *testing.T, handler http.HandlerFunc) *WarpAPI {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &WarpAPI{l: slog.New(slog.NewTextHandler(io.Discard, nil)), client: srv.Client(), base: srv.URL}
+}
+
+func TestRegisterCapsOversizedResponse(t *testing.T) {
+	w := newTestAPI(t, func(rw http.ResponseWriter, r *http.Request) {
+		// A valid-looking JSON string that never ends within the cap
+		rw.Header().Set("Content-Type", "application/json")
+		io.WriteString(rw, `{"id":"`+strings.Repeat("a", 4*maxAPIResponseSize))
+	})
+
+	_, err := w.Register("key")
+	if err == nil {
+		t.Fatal("Register accepted an oversized response")
+	}
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != maxAPIResponseSize {
+		t.Fatalf("Register error = %v, want a MaxBytesError at %d bytes", err, maxAPIResponseSize)
+	}
+}
+
+func TestRegisterReadsResponse(t *testing.T) {
+	w := newTestAPI(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/reg" {
+			http.NotFound(rw, r)
+			return
+		}
+		io.WriteString(rw, `{"id":"device-1","token":"t"}`)
+	})
+
+	ident, err := w.Register("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.ID != "device-1" || ident.Token != "t" {
+		t.Fatalf("Register = %+v", ident)
+	}
+}
+
+func TestCreateIdentityRequiresTOS(t *testing.T) {
+	calls := 0
+	w := newTestAPI(t, func(rw http.ResponseWriter, r *http.Request) {
+		calls++
+		io.WriteString(rw, `{"id":"device-1","token":"t"}`)
+	})
+
+	if _, err := CreateIdentity(w.l, w, "", false); !errors.Is(err, ErrTOSNotAccepted) {
+		t.Fatalf("CreateIdentity without accepting the terms = %v, want ErrTOSNotAccepted", err)
+	}
+	if calls != 0 {
+		t.Fatalf("registration API called %d times before the terms were accepted", calls)
+	}
+
+	ident, err := CreateIdentity(w.l, w, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || ident.ID != "device-1" {
+		t.Fatalf("CreateIdentity with the terms accepted = %+v after %d calls", ident, calls)
+	}
+}
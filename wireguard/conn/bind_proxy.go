@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/netip"
 	"net/url"
@@ -106,12 +107,11 @@ func (s *ProxyBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.udpConn == nil {
-		fmt.Printf("[PROXY] Establishing UDP association to %s\n", s.proxyAddr)
+		slog.Debug("establishing UDP association", "proxy", s.proxyAddr)
 		if err := s.establishUDPAssociation(); err != nil {
-			fmt.Printf("[PROXY] Failed to establish UDP association: %v\n", err)
 			return nil, 0, fmt.Errorf("proxy initialization failed: %w", err)
 		}
-		fmt.Printf("[PROXY] UDP association established, relay: %s\n", s.udpRelayAddr)
+		slog.Debug("UDP association established", "relay", s.udpRelayAddr)
 	}
 	localAddr := s.udpConn.LocalAddr().(*net.UDPAddr)
 	fns := []ReceiveFunc{s.receiveIPv4}
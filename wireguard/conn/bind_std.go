@@ -338,6 +338,23 @@ func (e ErrUDPGSODisabled) Unwrap() error {
 	return e.RetryErr
 }
 
+// setUDPAddr points ua, a pooled address with 16 bytes of IP storage, at ap
+func setUDPAddr(ua *net.UDPAddr, ap netip.AddrPort) {
+	if ap.Addr().Is6() {
+		as16 := ap.Addr().As16()
+		copy(ua.IP, as16[:])
+		ua.IP = ua.IP[:16]
+	} else {
+		as4 := ap.Addr().As4()
+		copy(ua.IP, as4[:])
+		ua.IP = ua.IP[:4]
+	}
+	// A link-local endpoint is only reachable through the interface its zone
+	// names; without it the kernel picks one or rejects the send
+	ua.Zone = ap.Addr().Zone()
+	ua.Port = int(ap.Port())
+}
+
 func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 	s.mu.Lock()
 	blackhole := s.blackhole4
@@ -365,16 +382,7 @@ func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 	defer s.putMessages(msgs)
 	ua := s.udpAddrPool.Get().(*net.UDPAddr)
 	defer s.udpAddrPool.Put(ua)
-	if is6 {
-		as16 := endpoint.DstIP().As16()
-		copy(ua.IP, as16[:])
-		ua.IP = ua.IP[:16]
-	} else {
-		as4 := endpoint.DstIP().As4()
-		copy(ua.IP, as4[:])
-		ua.IP = ua.IP[:4]
-	}
-	ua.Port = int(endpoint.(*StdNetEndpoint).Port())
+	setUDPAddr(ua, endpoint.(*StdNetEndpoint).AddrPort)
 	var (
 		retried bool
 		err     error
@@ -3,7 +3,9 @@ package conn
 import (
 	"encoding/binary"
 	"net"
+	"net/netip"
 	"testing"
+	"time"
 
 	"golang.org/x/net/ipv6"
 )
@@ -248,3 +250,119 @@ func Test_splitCoalescedMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestSetUDPAddrZone(t *testing.T) {
+	ua := &net.UDPAddr{IP: make([]byte, 16)}
+
+	setUDPAddr(ua, netip.MustParseAddrPort("[fe80::1%eth0]:51820"))
+	if got := ua.String(); got != "[fe80::1%eth0]:51820" {
+		t.Errorf("zoned endpoint = %s", got)
+	}
+	// The pooled address is reused, so a later endpoint must clear the zone
+	setUDPAddr(ua, netip.MustParseAddrPort("162.159.192.1:2408"))
+	if got := ua.String(); got != "162.159.192.1:2408" {
+		t.Errorf("endpoint after a zoned one = %s", got)
+	}
+}
+
+// linkLocalAddr returns an IPv6 link-local address of an up interface,
+// zoned with the interface name
+func linkLocalAddr(t *testing.T) netip.Addr {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(ipNet.IP); ok && addr.Is6() && addr.IsLinkLocalUnicast() {
+				return addr.WithZone(iface.Name)
+			}
+		}
+	}
+	t.Skip("no interface with an IPv6 link-local address")
+	return netip.Addr{}
+}
+
+func TestStdNetBindSendLinkLocal(t *testing.T) {
+	local := linkLocalAddr(t)
+	peer, err := net.ListenUDP("udp6", net.UDPAddrFromAddrPort(netip.AddrPortFrom(local, 0)))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", local, err)
+	}
+	defer peer.Close()
+
+	bind := NewStdNetBind().(*StdNetBind)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	ep, err := bind.ParseEndpoint(peer.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("ParseEndpoint(%s): %v", peer.LocalAddr(), err)
+	}
+	if ep.DstIP().Zone() != local.Zone() {
+		t.Fatalf("parsed endpoint %s lost zone %q", ep.DstToString(), local.Zone())
+	}
+	if err := bind.Send([][]byte{[]byte("ping")}, ep); err != nil {
+		t.Fatalf("Send to %s: %v", ep.DstToString(), err)
+	}
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, _, err := peer.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("peer read %q", buf[:n])
+	}
+
+	// The reply's source endpoint keeps the zone so WireGuard can answer it
+	if _, err := peer.WriteToUDPAddrPort([]byte("pong"), netip.AddrPortFrom(local, port)); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan Endpoint, len(fns))
+	for _, fn := range fns {
+		go func() {
+			// Receive funcs may read into any of a full batch of buffers
+			bufs := make([][]byte, bind.BatchSize())
+			for i := range bufs {
+				bufs[i] = make([]byte, 1<<16)
+			}
+			sizes := make([]int, len(bufs))
+			eps := make([]Endpoint, len(bufs))
+			for {
+				n, err := fn(bufs, sizes, eps)
+				if err != nil {
+					return
+				}
+				if n > 0 && sizes[0] > 0 {
+					got <- eps[0]
+					return
+				}
+			}
+		}()
+	}
+	select {
+	case src := <-got:
+		if src.DstToString() != ep.DstToString() {
+			t.Fatalf("reply from %s, want %s", src.DstToString(), ep.DstToString())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reply received")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"log/slog"
 	mathrand "math/rand"
 	"net/netip"
 	"regexp"
@@ -12,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/voidr3aper-anon/Vwarp/junkbudget"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
 )
@@ -45,6 +47,14 @@ type AtomicNoizeConfig struct {
 	JunkInterval   time.Duration // Interval between junk packets
 	AllowZeroSize  bool          // Allow zero-size junk packets
 	HandshakeDelay time.Duration // Delay before actual handshake after I1
+
+	// MaxJunkPPS caps junk packets per second (0 = unlimited). Pre-handshake
+	// junk only waits within HandshakeDelay and is skipped when it can't fit.
+	MaxJunkPPS int
+
+	// MaxOverheadBytes caps the I1-I5 and junk bytes sent before each
+	// handshake; the rest of the sequence is dropped once it is reached (0 = unlimited)
+	MaxOverheadBytes int
 }
 
 // Bind wraps a conn.Bind and fires QUIC-like preflight when WG sends a handshake initiation.
@@ -57,6 +67,8 @@ type Bind struct {
 	lastSent          map[netip.Addr]time.Time // rate-limit per dst IP
 	interval          time.Duration            // e.g., 1s to avoid duplicate bursts
 	postHandshakeSent map[netip.Addr]bool      // track if post-handshake junk sent per IP
+	junkLimiter       *junkbudget.Limiter      // paces junk to MaxJunkPPS (nil = unlimited)
+	logger            *slog.Logger
 }
 
 func New(inner conn.Bind, hexPayload string, port int, minInterval time.Duration) (*Bind, error) {
@@ -76,11 +88,13 @@ func New(inner conn.Bind, hexPayload string, port int, minInterval time.Duration
 		lastSent:          make(map[netip.Addr]time.Time),
 		postHandshakeSent: make(map[netip.Addr]bool),
 		interval:          minInterval,
+		logger:            slog.New(slog.DiscardHandler),
 	}, nil
 }
 
-// NewWithAtomicNoize creates a new Bind with AtomicNoize configuration
-func NewWithAtomicNoize(inner conn.Bind, AtomicNoizeConfig *AtomicNoizeConfig, port int, minInterval time.Duration) (*Bind, error) {
+// NewWithAtomicNoize creates a new Bind with AtomicNoize configuration that
+// logs to logger, or nowhere if logger is nil
+func NewWithAtomicNoize(inner conn.Bind, AtomicNoizeConfig *AtomicNoizeConfig, port int, minInterval time.Duration, logger *slog.Logger) (*Bind, error) {
 	var payload []byte
 	var err error
 
@@ -92,7 +106,7 @@ func NewWithAtomicNoize(inner conn.Bind, AtomicNoizeConfig *AtomicNoizeConfig, p
 		}
 	}
 
-	return &Bind{
+	b := &Bind{
 		inner:             inner,
 		port443:           port,
 		payload:           payload,
@@ -100,7 +114,15 @@ func NewWithAtomicNoize(inner conn.Bind, AtomicNoizeConfig *AtomicNoizeConfig, p
 		lastSent:          make(map[netip.Addr]time.Time),
 		interval:          minInterval,
 		postHandshakeSent: make(map[netip.Addr]bool),
-	}, nil
+		logger:            logger,
+	}
+	if b.logger == nil {
+		b.logger = slog.New(slog.DiscardHandler)
+	}
+	if AtomicNoizeConfig != nil {
+		b.junkLimiter = junkbudget.NewLimiter(AtomicNoizeConfig.MaxJunkPPS)
+	}
+	return b, nil
 }
 
 func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) { return b.inner.Open(port) }
@@ -368,17 +390,29 @@ func (b *Bind) maybePreflightUsingSameSocket(ep conn.Endpoint, bufs [][]byte) {
 
 	// Execute AtomicNoize sequence using the SAME socket as WireGuard
 	if b.AtomicNoizeConfig != nil {
-		b.executeAtomicNoizePreflightUsingSameSocket(ep)
+		// Waiting for the junk limiter uses up part of the handshake delay
+		budget := b.AtomicNoizeConfig.HandshakeDelay
+		b.executeAtomicNoizePreflightUsingSameSocket(ep, &budget)
 
-		// Apply handshake delay if configured
-		if b.AtomicNoizeConfig.HandshakeDelay > 0 {
-			time.Sleep(b.AtomicNoizeConfig.HandshakeDelay)
+		// Apply the rest of the handshake delay if configured
+		if budget > 0 {
+			time.Sleep(budget)
 		}
 	}
 }
 
+// sendCapped sends packet unless it would go over ov, and charges it to ov
+// once sent
+func (b *Bind) sendCapped(packet []byte, ep conn.Endpoint, ov *junkbudget.OverheadCap) bool {
+	if !ov.Fits(len(packet)) || b.inner.Send([][]byte{packet}, ep) != nil {
+		return false
+	}
+	ov.Sent(len(packet))
+	return true
+}
+
 // executeAtomicNoizePreflightUsingSameSocket sends obfuscation packets using WireGuard's socket
-func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ep conn.Endpoint) {
+func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ep conn.Endpoint, budget *time.Duration) {
 	config := b.AtomicNoizeConfig
 	if config == nil {
 		return
@@ -389,18 +423,23 @@ func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ep conn.Endpoint) {
 		junkInterval = 1 * time.Millisecond // Default to 1ms if not specified
 	}
 
+	ov := junkbudget.NewOverheadCap(config.MaxOverheadBytes, b.logger)
+
 	// Step 1: Send I1 packet with IKEv2 framing using WireGuard socket
 	if config.I1 != "" && b.payload != nil {
 		framedPayload := wrapInIKEv2Header(b.payload)
-		_ = b.inner.Send([][]byte{framedPayload}, ep)
-		time.Sleep(2 * time.Millisecond)
+		if b.sendCapped(framedPayload, ep, ov) {
+			time.Sleep(2 * time.Millisecond)
+		}
 	}
 
 	// Step 1.5: Send junk packets after I1 (if JcAfterI1 is specified)
 	if config.JcAfterI1 > 0 {
 		for i := 0; i < config.JcAfterI1; i++ {
 			junkPacket := b.generateJunkPacket()
-			_ = b.inner.Send([][]byte{junkPacket}, ep)
+			if ov.Fits(len(junkPacket)) && b.junkLimiter.Wait(budget) {
+				b.sendCapped(junkPacket, ep, ov)
+			}
 			time.Sleep(junkInterval)
 		}
 	}
@@ -409,7 +448,9 @@ func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ep conn.Endpoint) {
 	if config.JcBeforeHS > 0 {
 		for i := 0; i < config.JcBeforeHS; i++ {
 			junkPacket := b.generateJunkPacket()
-			_ = b.inner.Send([][]byte{junkPacket}, ep)
+			if ov.Fits(len(junkPacket)) && b.junkLimiter.Wait(budget) {
+				b.sendCapped(junkPacket, ep, ov)
+			}
 			time.Sleep(junkInterval)
 		}
 	}
@@ -421,8 +462,7 @@ func (b *Bind) executeAtomicNoizePreflightUsingSameSocket(ep conn.Endpoint) {
 			continue
 		}
 		packet, err := parseCPSPacket(sig)
-		if err == nil && len(packet) > 0 {
-			_ = b.inner.Send([][]byte{packet}, ep)
+		if err == nil && len(packet) > 0 && b.sendCapped(packet, ep, ov) {
 			time.Sleep(1 * time.Millisecond)
 		}
 	}
@@ -484,6 +524,7 @@ func (b *Bind) maybeSendPostHandshakeJunk(ep conn.Endpoint, bufs [][]byte) {
 			junkInterval = 1 * time.Millisecond // Default to 1ms if not specified
 		}
 		for i := 0; i < remainingJunk; i++ {
+			b.junkLimiter.Wait(nil)
 			junkPacket := b.generateJunkPacket()
 			_ = b.inner.Send([][]byte{junkPacket}, ep)
 			time.Sleep(junkInterval)
@@ -0,0 +1,141 @@
+package preflightbind
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/conn"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
+)
+
+const junkSize = 50
+
+// recordingBind records the send time of every junk packet and the total
+// bytes sent besides the handshake itself
+type recordingBind struct {
+	conn.Bind
+	mu       sync.Mutex
+	junk     []time.Time
+	overhead int
+}
+
+func (r *recordingBind) Send(bufs [][]byte, _ conn.Endpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, buf := range bufs {
+		if len(buf) == junkSize {
+			r.junk = append(r.junk, time.Now())
+		}
+		if len(buf) != device.MessageInitiationSize {
+			r.overhead += len(buf)
+		}
+	}
+	return nil
+}
+
+func (r *recordingBind) junkTimes() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time(nil), r.junk...)
+}
+
+// sendHandshake passes a handshake initiation through the bind and returns how
+// long the send was held up
+func sendHandshake(t *testing.T, config *AtomicNoizeConfig) (*recordingBind, time.Duration) {
+	t.Helper()
+	inner := &recordingBind{}
+	b, err := NewWithAtomicNoize(inner, config, 443, time.Second, nil)
+	if err != nil {
+		t.Fatalf("NewWithAtomicNoize: %v", err)
+	}
+
+	init := make([]byte, device.MessageInitiationSize)
+	init[0] = device.MessageInitiationType
+	ep := &conn.StdNetEndpoint{AddrPort: netip.MustParseAddrPort("162.159.192.1:2408")}
+
+	start := time.Now()
+	if err := b.Send([][]byte{init}, ep); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	return inner, time.Since(start)
+}
+
+func TestMaxJunkPPS(t *testing.T) {
+	const pps = 100
+	config := &AtomicNoizeConfig{
+		Jc:             10,
+		JcBeforeHS:     5,
+		Jmin:           junkSize,
+		Jmax:           junkSize,
+		JunkInterval:   time.Millisecond,
+		HandshakeDelay: 100 * time.Millisecond,
+		MaxJunkPPS:     pps,
+	}
+	inner, elapsed := sendHandshake(t, config)
+
+	// Limiter waits come out of the handshake delay instead of adding to it
+	limit := config.HandshakeDelay + time.Duration(config.JcBeforeHS)*config.JunkInterval + 50*time.Millisecond
+	if elapsed > limit {
+		t.Errorf("handshake held for %v, want at most %v", elapsed, limit)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(inner.junkTimes()) < config.Jc && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	junk := inner.junkTimes()
+	if len(junk) != config.Jc {
+		t.Fatalf("sent %d junk packets, want %d", len(junk), config.Jc)
+	}
+	span := junk[len(junk)-1].Sub(junk[0])
+	if rate := float64(len(junk)-1) / span.Seconds(); rate > pps*1.1 {
+		t.Errorf("junk rate %.0f pps exceeds %d", rate, pps)
+	}
+}
+
+func TestMaxJunkPPSWithoutHandshakeDelay(t *testing.T) {
+	config := &AtomicNoizeConfig{
+		Jc:           5,
+		JcBeforeHS:   5,
+		Jmin:         junkSize,
+		Jmax:         junkSize,
+		JunkInterval: time.Millisecond,
+		MaxJunkPPS:   10,
+	}
+	inner, elapsed := sendHandshake(t, config)
+
+	// Without a handshake delay to spend, junk that would exceed the rate is skipped
+	if elapsed > 50*time.Millisecond {
+		t.Errorf("handshake held for %v with no handshake delay", elapsed)
+	}
+	if junk := inner.junkTimes(); len(junk) != 1 {
+		t.Errorf("sent %d junk packets before the handshake, want 1", len(junk))
+	}
+}
+
+func TestMaxOverheadBytes(t *testing.T) {
+	const limit = 120
+	config := &AtomicNoizeConfig{
+		I1:               "<b 0102030405060708>",
+		I2:               "<r 40>",
+		Jc:               6,
+		JcBeforeHS:       6,
+		Jmin:             junkSize,
+		Jmax:             junkSize,
+		JunkInterval:     time.Millisecond,
+		MaxOverheadBytes: limit,
+	}
+	inner, _ := sendHandshake(t, config)
+
+	inner.mu.Lock()
+	defer inner.mu.Unlock()
+	if inner.overhead == 0 || inner.overhead > limit {
+		t.Errorf("sent %d overhead bytes, want between 1 and %d", inner.overhead, limit)
+	}
+	// Everything after the first packet that didn't fit is dropped, I2 included
+	if inner.overhead+junkSize <= limit {
+		t.Errorf("sent only %d bytes, sequence was cut too early", inner.overhead)
+	}
+}
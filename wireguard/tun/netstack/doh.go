@@ -0,0 +1,112 @@
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohMediaType is the RFC 8484 media type for DNS wire-format messages
+const dohMediaType = "application/dns-message"
+
+// plainDNSKey marks lookups that must bypass DoH, such as resolving the DoH
+// server's own hostname
+type plainDNSKey struct{}
+
+// dohResolver sends DNS queries as RFC 8484 POST requests
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+// EnableDoH switches the tunnel resolver from plain DNS to DNS-over-HTTPS
+// against rawURL. The HTTPS connections are dialed through the tunnel, and
+// the DoH server's hostname (if not an IP literal) is bootstrapped with plain
+// DNS to the configured servers.
+func (tnet *Net) EnableDoH(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid DoH URL: %w", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid DoH URL %q: must be an https:// URL", rawURL)
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tnet.DialContext(context.WithValue(ctx, plainDNSKey{}, true), network, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	tnet.doh = &dohResolver{url: rawURL, client: &http.Client{Transport: transport}}
+	return nil
+}
+
+// useDoH reports whether a lookup made with ctx should go over DoH
+func (tnet *Net) useDoH(ctx context.Context) bool {
+	return tnet.doh != nil && ctx.Value(plainDNSKey{}) == nil
+}
+
+func (d *dohResolver) exchange(ctx context.Context, id uint16, query dnsmessage.Question, msg []byte, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(msg))
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		switch {
+		case errors.Is(err, context.Canceled):
+			err = errCanceled
+		case errors.Is(err, context.DeadlineExceeded):
+			err = errTimeout
+		}
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohMediaType) {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+	}
+	q, err := p.Question()
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+	}
+	if !checkResponse(id, query, h, q) {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+	}
+	if err := p.SkipQuestion(); err != dnsmessage.ErrSectionDone {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+	}
+	return p, h, nil
+}
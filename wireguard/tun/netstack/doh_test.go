@@ -0,0 +1,114 @@
+package netstack
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestLookupContextHostDoH(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+			t.Errorf("Content-Type = %q, want %q", ct, dohMediaType)
+		}
+		if accept := r.Header.Get("Accept"); accept != dohMediaType {
+			t.Errorf("Accept = %q, want %q", accept, dohMediaType)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("read request body: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(body); err != nil {
+			t.Errorf("request body is not a DNS message: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		resp := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:                 query.Header.ID,
+				Response:           true,
+				RecursionAvailable: true,
+			},
+			Questions: query.Questions,
+		}
+		if q := query.Questions[0]; q.Type == dnsmessage.TypeA {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 7}},
+			}}
+		}
+		b, err := resp.Pack()
+		if err != nil {
+			t.Errorf("pack response: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	tnet := &Net{
+		hasV4:      true,
+		dnsServers: []netip.Addr{netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("198.51.100.2")},
+		doh:        &dohResolver{url: srv.URL, client: srv.Client()},
+	}
+
+	addrs, err := tnet.LookupContextHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("LookupContextHost: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.7" {
+		t.Fatalf("addrs = %v, want [192.0.2.7]", addrs)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("DoH requests = %d, want 1", n)
+	}
+}
+
+func TestDoHServerError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	tnet := &Net{
+		hasV4:      true,
+		dnsServers: []netip.Addr{netip.MustParseAddr("198.51.100.1")},
+		doh:        &dohResolver{url: srv.URL, client: srv.Client()},
+	}
+	if _, err := tnet.LookupContextHost(context.Background(), "example.com"); err == nil {
+		t.Fatal("expected an error from a failing DoH server")
+	}
+}
+
+func TestEnableDoHRejectsNonHTTPS(t *testing.T) {
+	tnet := &Net{}
+	for _, u := range []string{"http://1.1.1.1/dns-query", "1.1.1.1", "https://"} {
+		if err := tnet.EnableDoH(u); err == nil {
+			t.Errorf("EnableDoH(%q) succeeded, want error", u)
+		}
+	}
+	if err := tnet.EnableDoH("https://1.1.1.1/dns-query"); err != nil {
+		t.Fatalf("EnableDoH: %v", err)
+	}
+	if tnet.doh == nil {
+		t.Fatal("EnableDoH did not install a resolver")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"net/netip"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -46,11 +47,28 @@ type netTun struct {
 	incomingPacket chan *buffer.View
 	mtu            int
 	dnsServers     []netip.Addr
+	localAddresses []netip.Addr
 	hasV4, hasV6   bool
+	doh            *dohResolver
 }
 
 type Net netTun
 
+// AddressError reports a local address CreateNetTUN could not assign, such as
+// an invalid or duplicate address
+type AddressError struct {
+	Addr netip.Addr
+	Err  error
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("AddProtocolAddress(%v): %v", e.Addr, e.Err)
+}
+
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
 func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
 	opts := stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
@@ -88,13 +106,15 @@ func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device,
 		}
 		tcpipErr := dev.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{})
 		if tcpipErr != nil {
-			return nil, nil, fmt.Errorf("AddProtocolAddress(%v): %v", ip, tcpipErr)
+			dev.stack.Close()
+			return nil, nil, &AddressError{Addr: ip, Err: fmt.Errorf("%v", tcpipErr)}
 		}
 		if ip.Is4() {
 			dev.hasV4 = true
 		} else if ip.Is6() {
 			dev.hasV6 = true
 		}
+		dev.localAddresses = append(dev.localAddresses, ip)
 	}
 	if dev.hasV4 {
 		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
@@ -107,6 +127,29 @@ func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device,
 	return dev, (*Net)(dev), nil
 }
 
+// LocalAddrs returns the local addresses the stack was created with
+func (tnet *Net) LocalAddrs() []netip.Addr {
+	return slices.Clone(tnet.localAddresses)
+}
+
+// SetRoutes replaces the default routes of the stack with prefixes, so only
+// those destinations are reachable through the tunnel. Prefixes of a family
+// the stack has no address for are ignored.
+func (tnet *Net) SetRoutes(prefixes []netip.Prefix) {
+	var table []tcpip.Route
+	for _, p := range prefixes {
+		if (p.Addr().Is4() && !tnet.hasV4) || (p.Addr().Is6() && !tnet.hasV6) {
+			continue
+		}
+		subnet, err := tcpip.NewSubnet(tcpip.AddrFromSlice(p.Masked().Addr().AsSlice()), tcpip.MaskFromBytes(net.CIDRMask(p.Bits(), p.Addr().BitLen())))
+		if err != nil {
+			continue
+		}
+		table = append(table, tcpip.Route{Destination: subnet, NIC: 1})
+	}
+	tnet.stack.SetRouteTable(table)
+}
+
 func (tun *netTun) Name() (string, error) {
 	return "go", nil
 }
@@ -654,6 +697,9 @@ func (tnet *Net) exchange(ctx context.Context, server netip.Addr, q dnsmessage.Q
 	if err != nil {
 		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotMarshalDNSMessage
 	}
+	if tnet.useDoH(ctx) {
+		return tnet.doh.exchange(ctx, id, q, udpReq, timeout)
+	}
 
 	for _, useUDP := range []bool{true, false} {
 		ctx, cancel := context.WithDeadline(ctx, time.Now().Add(timeout))
@@ -754,14 +800,25 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 		Class: dnsmessage.ClassINET,
 	}
 
+	// With DoH there is a single upstream, so the server list only sets how
+	// many attempts are made
+	servers := tnet.dnsServers
+	if tnet.useDoH(ctx) {
+		servers = []netip.Addr{{}}
+	}
+
 	for i := 0; i < 2; i++ {
-		for _, server := range tnet.dnsServers {
+		for _, server := range servers {
+			serverName := server.String()
+			if tnet.useDoH(ctx) {
+				serverName = tnet.doh.url
+			}
 			p, h, err := tnet.exchange(ctx, server, q, time.Second*5)
 			if err != nil {
 				dnsErr := &net.DNSError{
 					Err:    err.Error(),
 					Name:   name,
-					Server: server.String(),
+					Server: serverName,
 				}
 				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 					dnsErr.IsTimeout = true
@@ -777,14 +834,14 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 				dnsErr := &net.DNSError{
 					Err:    err.Error(),
 					Name:   name,
-					Server: server.String(),
+					Server: serverName,
 				}
 				if err == errServerTemporarilyMisbehaving {
 					dnsErr.IsTemporary = true
 				}
 				if err == errNoSuchHost {
 					dnsErr.IsNotFound = true
-					return p, server.String(), dnsErr
+					return p, serverName, dnsErr
 				}
 				lastErr = dnsErr
 				continue
@@ -792,22 +849,47 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 
 			err = skipToAnswer(&p, qtype)
 			if err == nil {
-				return p, server.String(), nil
+				return p, serverName, nil
 			}
 			lastErr = &net.DNSError{
 				Err:    err.Error(),
 				Name:   name,
-				Server: server.String(),
+				Server: serverName,
 			}
 			if err == errNoSuchHost {
 				lastErr.(*net.DNSError).IsNotFound = true
-				return p, server.String(), lastErr
+				return p, serverName, lastErr
 			}
 		}
 	}
 	return dnsmessage.Parser{}, "", lastErr
 }
 
+// Exchange sends q to the tunnel's DNS servers, or the DoH server when
+// enabled, and returns the header and answer records of the first response.
+// A response with an error RCode such as NXDOMAIN is returned, not an error.
+func (tnet *Net) Exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Header, []dnsmessage.Resource, error) {
+	servers := tnet.dnsServers
+	if tnet.useDoH(ctx) {
+		servers = []netip.Addr{{}}
+	}
+	lastErr := errNoAnswerFromDNSServer
+	for _, server := range servers {
+		p, h, err := tnet.exchange(ctx, server, q, time.Second*5)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answers, err := p.AllAnswers()
+		if err != nil {
+			lastErr = errCannotUnmarshalDNSMessage
+			continue
+		}
+		return h, answers, nil
+	}
+	return dnsmessage.Header{}, nil, lastErr
+}
+
 func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string, error) {
 	if host == "" || (!tnet.hasV6 && !tnet.hasV4) {
 		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
@@ -930,6 +1012,66 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 	return saddrs, nil
 }
 
+// LookupContextAddr performs a reverse (PTR) lookup of addr using the tunnel's DNS servers
+func (tnet *Net) LookupContextAddr(ctx context.Context, addr string) ([]string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+
+	p, server, err := tnet.tryOneName(ctx, reverseAddr(ip.Unmap()), dnsmessage.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, &net.DNSError{Err: errCannotMarshalDNSMessage.Error(), Name: addr, Server: server}
+		}
+		if h.Type != dnsmessage.TypePTR {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, &net.DNSError{Err: errCannotMarshalDNSMessage.Error(), Name: addr, Server: server}
+			}
+			continue
+		}
+		ptr, err := p.PTRResource()
+		if err != nil {
+			return nil, &net.DNSError{Err: errCannotMarshalDNSMessage.Error(), Name: addr, Server: server}
+		}
+		names = append(names, ptr.PTR.String())
+	}
+	return names, nil
+}
+
+// reverseAddr returns the in-addr.arpa. or ip6.arpa. name of ip
+func reverseAddr(ip netip.Addr) string {
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	if ip.Is4() {
+		a := ip.As4()
+		for i := len(a) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(a[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+	a := ip.As16()
+	for i := len(a) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[a[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[a[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
 func partialDeadline(now, deadline time.Time, addrsRemaining int) (time.Time, error) {
 	if deadline.IsZero() {
 		return deadline, nil
@@ -0,0 +1,27 @@
+package netstack
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSetRoutes(t *testing.T) {
+	dev, tnet, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("172.16.0.2")}, nil, 1280)
+	if err != nil {
+		t.Fatalf("CreateNetTUN: %v", err)
+	}
+	defer dev.Close()
+
+	tnet.SetRoutes([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")})
+
+	conn, err := tnet.DialUDPAddrPort(netip.AddrPort{}, netip.MustParseAddrPort("10.1.2.3:53"))
+	if err != nil {
+		t.Fatalf("dial inside an advertised route: %v", err)
+	}
+	conn.Close()
+
+	if conn, err := tnet.DialUDPAddrPort(netip.AddrPort{}, netip.MustParseAddrPort("1.1.1.1:53")); err == nil {
+		conn.Close()
+		t.Fatal("dial outside the advertised routes succeeded")
+	}
+}
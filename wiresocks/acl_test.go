@@ -0,0 +1,98 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveTestDNS answers every A query sent to addr with answer
+func serveTestDNS(t *testing.T, tnet *netstack.Net, addr netip.AddrPort, answer netip.Addr) {
+	t.Helper()
+	conn, err := tnet.ListenUDPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(b[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			reply := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true})
+			reply.EnableCompression()
+			reply.StartQuestions()
+			reply.Question(q)
+			reply.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				reply.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+					dnsmessage.AResource{A: answer.As4()})
+			}
+			if msg, err := reply.Finish(); err == nil {
+				conn.WriteTo(msg, from)
+			}
+		}
+	}()
+}
+
+func TestACLAppliesToResolvedAddresses(t *testing.T) {
+	dnsAddr := netip.MustParseAddrPort("10.0.0.53:53")
+	target := netip.MustParseAddrPort("10.0.0.1:7")
+
+	tunnelDev, tunnelNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("172.16.0.2")}, []netip.Addr{dnsAddr.Addr()}, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelDev.Close()
+	remoteDev, remoteNet, err := netstack.CreateNetTUN([]netip.Addr{target.Addr(), dnsAddr.Addr()}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteDev.Close()
+	linkStacks(tunnelDev, remoteDev)
+	serveTestDNS(t, remoteNet, dnsAddr, target.Addr())
+	serveTCPEcho(t, remoteNet, target)
+	serveUDPEcho(t, remoteNet, target)
+
+	rules, err := acl.New(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vt := &VirtualTun{Tnet: tunnelNet, Logger: newTestLogger(t), Ctx: ctx, acl: rules}
+
+	// The name is allowed, the address it resolves to is not
+	if _, err := vt.dialTCP(ctx, "tcp", "internal.test:7"); !errors.Is(err, errDestinationDenied) {
+		t.Errorf("TCP dial by name = %v, want errDestinationDenied", err)
+	}
+	if _, err := vt.dialUDP("internal.test:7"); !errors.Is(err, errDestinationDenied) {
+		t.Errorf("UDP dial by name = %v, want errDestinationDenied", err)
+	}
+	if _, err := vt.dialUDP(target.String()); !errors.Is(err, errDestinationDenied) {
+		t.Errorf("UDP dial by address = %v, want errDestinationDenied", err)
+	}
+
+	vt.acl = nil
+	conn, err := vt.dialTCP(ctx, "tcp", "internal.test:7")
+	if err != nil {
+		t.Fatalf("TCP dial without an ACL: %v", err)
+	}
+	conn.Close()
+}
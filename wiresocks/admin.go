@@ -0,0 +1,82 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// StartAdminServer serves an HTTP API over the connections in conns on
+// bindAddress, for management UIs to kill a misbehaving connection without
+// restarting. Every request must carry token as a bearer token. The API is
+// plain HTTP, so bindAddress must be a loopback address to keep the token off
+// the network.
+//
+//	GET    /connections       lists the active connections as JSON
+//	DELETE /connections/{id}  closes one, 404 if it is not active
+func StartAdminServer(ctx context.Context, l *slog.Logger, bindAddress netip.AddrPort, conns *ConnTable, token string) (netip.AddrPort, error) {
+	if token == "" {
+		return netip.AddrPort{}, errors.New("admin API requires a token")
+	}
+	if !bindAddress.Addr().IsLoopback() {
+		return netip.AddrPort{}, fmt.Errorf("admin API serves plain HTTP, so it only binds loopback addresses, not %s", bindAddress.Addr())
+	}
+	ln, err := net.Listen("tcp", bindAddress.String())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	srv := &http.Server{
+		Handler:           adminHandler(l.With("subsystem", "admin"), conns, token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+}
+
+// adminHandler routes the admin API after checking the bearer token
+func adminHandler(l *slog.Logger, conns *ConnTable, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(conns.List())
+	})
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid connection id", http.StatusBadRequest)
+			return
+		}
+		if !conns.Close(id) {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+		l.Info("closed proxy connection", "id", id, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,181 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/neterr"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+)
+
+// adminRequest sends an admin API request with token and returns the response
+func adminRequest(t *testing.T, method, url, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminListsAndClosesConnections(t *testing.T) {
+	target := netip.MustParseAddrPort("10.0.0.1:7")
+
+	tunnelDev, tunnelNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("172.16.0.2")}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelDev.Close()
+	remoteDev, remoteNet, err := netstack.CreateNetTUN([]netip.Addr{target.Addr()}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteDev.Close()
+	linkStacks(tunnelDev, remoteDev)
+	serveTCPEcho(t, remoteNet, target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conns := &ConnTable{}
+	proxy, err := StartProxy(ctx, newTestLogger(t), tunnelNet, netip.MustParseAddrPort("127.0.0.1:0"), nil, WithConnTable(conns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := StartAdminServer(ctx, newTestLogger(t), netip.MustParseAddrPort("127.0.0.1:0"), conns, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + admin.String()
+
+	conn, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	socksConnect(t, conn, target)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+
+	if resp := adminRequest(t, http.MethodGet, base+"/connections", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp := adminRequest(t, http.MethodGet, base+"/connections", "secret")
+	var listed []ConnInfo
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatalf("decoding connections: %v", err)
+	}
+	if len(listed) != 1 {
+		t.Fatalf("listed %d connections, want 1: %+v", len(listed), listed)
+	}
+	c := listed[0]
+	if c.Protocol != "tcp" || c.Target != target.String() || c.Client != conn.LocalAddr().String() {
+		t.Errorf("listed %+v, want tcp from %s to %s", c, conn.LocalAddr(), target)
+	}
+	if c.BytesUp != 4 || c.BytesDown != 4 || c.Started.IsZero() {
+		t.Errorf("listed %+v, want 4 bytes each way and a start time", c)
+	}
+
+	if resp := adminRequest(t, http.MethodDelete, fmt.Sprintf("%s/connections/%d", base, c.ID), "secret"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("closing connection: status %d", resp.StatusCode)
+	}
+	// The relay ends, so the client sees its connection closed
+	if _, err := conn.Read(make([]byte, 1)); err == nil || neterr.IsTimeout(err) {
+		t.Errorf("read after close = %v, want the connection closed", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(conns.List()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if left := conns.List(); len(left) > 0 {
+		t.Errorf("connections still listed after close: %+v", left)
+	}
+	if resp := adminRequest(t, http.MethodDelete, fmt.Sprintf("%s/connections/%d", base, c.ID), "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("closing a closed connection: status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestAdminListsUpstreamConnections(t *testing.T) {
+	target := netip.MustParseAddrPort("10.0.0.1:80")
+
+	tunnelDev, tunnelNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("172.16.0.2")}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelDev.Close()
+	remoteDev, remoteNet, err := netstack.CreateNetTUN([]netip.Addr{target.Addr()}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteDev.Close()
+	linkStacks(tunnelDev, remoteDev)
+	ln, err := remoteNet.ListenTCPAddrPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conns := &ConnTable{}
+	proxy, err := StartProxy(ctx, newTestLogger(t), tunnelNet, netip.MustParseAddrPort("127.0.0.1:0"), nil, WithConnTable(conns))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain request goes through the proxy's upstream cache, not a relay
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxy.String()})},
+	}
+	resp, err := client.Get("http://" + target.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	listed := conns.List()
+	if len(listed) != 1 {
+		t.Fatalf("listed %d connections, want the upstream one: %+v", len(listed), listed)
+	}
+	if c := listed[0]; c.Target != target.String() || c.BytesUp == 0 || c.BytesDown == 0 {
+		t.Errorf("listed %+v, want traffic both ways to %s", c, target)
+	}
+
+	if !conns.Close(listed[0].ID) {
+		t.Fatal("upstream connection not closable")
+	}
+	if left := conns.List(); len(left) > 0 {
+		t.Errorf("connections still listed after close: %+v", left)
+	}
+}
+
+func TestAdminRefusesNonLoopback(t *testing.T) {
+	_, err := StartAdminServer(context.Background(), newTestLogger(t), netip.MustParseAddrPort("0.0.0.0:0"), &ConnTable{}, "secret")
+	if err == nil {
+		t.Fatal("admin API bound a non-loopback address")
+	}
+}
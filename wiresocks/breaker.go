@@ -0,0 +1,229 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/neterr"
+)
+
+const (
+	// DefaultDialBreakerCooldown is how long new dials to a destination fail fast once its breaker trips
+	DefaultDialBreakerCooldown = 10 * time.Second
+	// DefaultTunnelBreakerThreshold is how many different destinations in a
+	// row may time out before the tunnel breaker trips
+	DefaultTunnelBreakerThreshold = 5
+	// DefaultTunnelBreakerCooldown is how long all new dials fail fast once the tunnel breaker trips
+	DefaultTunnelBreakerCooldown = 5 * time.Second
+	// maxBreakerDestinations is how many destinations with failed dials the
+	// breaker remembers before it forgets the ones idle for a cooldown
+	maxBreakerDestinations = 1024
+)
+
+// ErrTunnelDialsFailing is returned for dials refused while the dial breaker is open
+var ErrTunnelDialsFailing = errors.New("tunnel dials to this destination are timing out, refusing new connections until the cooldown ends")
+
+// ErrTunnelUnresponsive is returned for dials refused while the tunnel breaker is open
+var ErrTunnelUnresponsive = errors.New("tunnel dials are timing out, refusing new connections until the cooldown ends")
+
+// WithDialBreaker fails new tunnel dials to a destination immediately once
+// threshold dials in a row to it have timed out, instead of letting each
+// wait out its own timeout. After cooldown a single dial is let through to
+// probe the destination; its success closes the breaker again. A zero
+// threshold disables it.
+func WithDialBreaker(threshold int, cooldown time.Duration) ProxyOption {
+	return func(vt *VirtualTun) {
+		if threshold <= 0 {
+			vt.breaker = nil
+			return
+		}
+		vt.breaker = &dialBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+	}
+}
+
+// dialBreaker is a circuit breaker on the tunnel dials of a proxy, kept per
+// destination so one unresponsive destination doesn't fail dials to the
+// others. Only timeouts count as failures: a refused or reset connection
+// means the tunnel carried the attempt and the destination answered, and a
+// dial whose context ended was given up by the client.
+type dialBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	dests map[string]*breakerState // Destinations whose last dial timed out
+}
+
+// breakerState is the breaker of a single destination
+type breakerState struct {
+	failures  int       // Consecutive timed out dials
+	last      time.Time // When the last one timed out
+	openUntil time.Time // Dials are refused before this once tripped
+	probing   bool      // A half-open probe dial is in flight
+}
+
+// dial runs dial to destination unless its breaker is open
+func (b *dialBreaker) dial(ctx context.Context, destination string, dial func() (net.Conn, error)) (net.Conn, error) {
+	probe, err := b.allow(destination)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial()
+	b.done(destination, probe, dialOutcome(ctx, err))
+	return conn, err
+}
+
+// dialOutcome returns the error a breaker records for a dial that returned
+// err: the context's error if the client gave up, which says nothing about
+// the destination or the tunnel
+func dialOutcome(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// allow reports whether a dial to destination may proceed and whether it is
+// the half-open probe
+func (b *dialBreaker) allow(destination string) (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.dests[destination]
+	if s == nil || s.failures < b.threshold {
+		return false, nil
+	}
+	if s.probing || b.now().Before(s.openUntil) {
+		return false, ErrTunnelDialsFailing
+	}
+	s.probing = true
+	return true, nil
+}
+
+// done records the outcome of a dial allow let through
+func (b *dialBreaker) done(destination string, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.dests[destination]
+	if s != nil && probe {
+		s.probing = false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	if !neterr.IsTimeout(err) {
+		delete(b.dests, destination)
+		return
+	}
+
+	now := b.now()
+	if s == nil {
+		b.forgetIdle(now)
+		if b.dests == nil {
+			b.dests = make(map[string]*breakerState)
+		}
+		s = &breakerState{}
+		b.dests[destination] = s
+	}
+	s.failures++
+	s.last = now
+	if s.failures >= b.threshold {
+		s.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// forgetIdle drops the destinations that haven't failed for a cooldown once
+// there are too many to remember
+func (b *dialBreaker) forgetIdle(now time.Time) {
+	if len(b.dests) < maxBreakerDestinations {
+		return
+	}
+	for destination, s := range b.dests {
+		if !s.probing && now.Sub(s.last) >= b.cooldown {
+			delete(b.dests, destination)
+		}
+	}
+}
+
+// WithTunnelBreaker fails every new tunnel dial immediately once dials to
+// threshold different destinations in a row have timed out, as they do while
+// the tunnel is down or reconnecting. Like WithDialBreaker it lets a single
+// probe dial through after cooldown, and any dial the tunnel carries closes
+// it again. A zero threshold disables it.
+func WithTunnelBreaker(threshold int, cooldown time.Duration) ProxyOption {
+	return func(vt *VirtualTun) {
+		if threshold <= 0 {
+			vt.tunnelBreaker = nil
+			return
+		}
+		vt.tunnelBreaker = &tunnelBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+	}
+}
+
+// tunnelBreaker is a circuit breaker on all tunnel dials of a proxy. It only
+// counts distinct destinations, so a single unresponsive destination, which
+// the per-destination dialBreaker handles, can't trip it.
+type tunnelBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failing   map[string]struct{} // Destinations timed out since the tunnel last carried a dial
+	openUntil time.Time           // Dials are refused before this once tripped
+	probing   bool                // A half-open probe dial is in flight
+}
+
+// dial runs dial to destination unless the breaker is open
+func (b *tunnelBreaker) dial(ctx context.Context, destination string, dial func() (net.Conn, error)) (net.Conn, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial()
+	b.done(destination, probe, dialOutcome(ctx, err))
+	return conn, err
+}
+
+// allow reports whether a dial may proceed and whether it is the half-open probe
+func (b *tunnelBreaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.failing) < b.threshold {
+		return false, nil
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false, ErrTunnelUnresponsive
+	}
+	b.probing = true
+	return true, nil
+}
+
+// done records the outcome of a dial allow let through
+func (b *tunnelBreaker) done(destination string, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrTunnelDialsFailing), errors.Is(err, errDestinationDenied):
+		// Never reached the tunnel, or the client gave up
+		return
+	case !neterr.IsTimeout(err):
+		b.failing = nil
+		return
+	}
+
+	if b.failing == nil {
+		b.failing = make(map[string]struct{}, b.threshold)
+	}
+	b.failing[destination] = struct{}{}
+	if len(b.failing) >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
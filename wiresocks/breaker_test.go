@@ -0,0 +1,162 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDialBreakerFailsFastUntilCooldown(t *testing.T) {
+	const threshold, cooldown = 3, 10 * time.Second
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &dialBreaker{threshold: threshold, cooldown: cooldown, now: func() time.Time { return now }}
+	ctx, dest := context.Background(), "192.0.2.1:443"
+
+	dials := 0
+	timeout := func() (net.Conn, error) {
+		dials++
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	for i := 0; i < threshold; i++ {
+		if _, err := b.dial(ctx, dest, timeout); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("dial %d = %v, want the timeout", i, err)
+		}
+	}
+
+	// Tripped: dials fail without being attempted until the cooldown elapses
+	tripped := now
+	for _, wait := range []time.Duration{0, cooldown / 2, cooldown - time.Millisecond} {
+		now = tripped.Add(wait)
+		if _, err := b.dial(ctx, dest, timeout); !errors.Is(err, ErrTunnelDialsFailing) {
+			t.Fatalf("dial during cooldown = %v, want ErrTunnelDialsFailing", err)
+		}
+	}
+	if dials != threshold {
+		t.Fatalf("breaker let %d dials through, want %d", dials, threshold)
+	}
+
+	// Half-open: one probe goes through, a failed probe reopens the breaker
+	now = tripped.Add(cooldown)
+	if _, err := b.dial(ctx, dest, timeout); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("probe dial = %v, want the timeout", err)
+	}
+	if _, err := b.dial(ctx, dest, timeout); !errors.Is(err, ErrTunnelDialsFailing) {
+		t.Fatalf("dial after a failed probe = %v, want ErrTunnelDialsFailing", err)
+	}
+
+	// A successful probe closes it
+	now = now.Add(cooldown)
+	client, server := net.Pipe()
+	defer server.Close()
+	ok := func() (net.Conn, error) { return client, nil }
+	if conn, err := b.dial(ctx, dest, ok); err != nil || conn != client {
+		t.Fatalf("probe dial = %v, %v", conn, err)
+	}
+	if _, err := b.dial(ctx, dest, timeout); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("dial after recovery = %v, want it attempted", err)
+	}
+}
+
+func TestDialBreakerIsPerDestination(t *testing.T) {
+	b := &dialBreaker{threshold: 2, cooldown: time.Minute, now: time.Now}
+	ctx := context.Background()
+	timeout := func() (net.Conn, error) { return nil, os.ErrDeadlineExceeded }
+	for i := 0; i < 2; i++ {
+		b.dial(ctx, "192.0.2.1:443", timeout)
+	}
+	if _, err := b.dial(ctx, "192.0.2.1:443", timeout); !errors.Is(err, ErrTunnelDialsFailing) {
+		t.Fatalf("dial to the failing destination = %v, want ErrTunnelDialsFailing", err)
+	}
+	if _, err := b.dial(ctx, "192.0.2.2:443", timeout); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("dial to another destination = %v, want it attempted", err)
+	}
+}
+
+func TestDialBreakerIgnoresClientDeadlines(t *testing.T) {
+	b := &dialBreaker{threshold: 2, cooldown: time.Minute, now: time.Now}
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_, err := b.dial(ctx, "192.0.2.1:443", func() (net.Conn, error) {
+			<-ctx.Done()
+			return nil, os.ErrDeadlineExceeded
+		})
+		cancel()
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("dial %d = %v, want it attempted", i, err)
+		}
+	}
+}
+
+func TestDialBreakerIgnoresRefusedConnections(t *testing.T) {
+	b := &dialBreaker{threshold: 2, cooldown: time.Minute, now: time.Now}
+	ctx, dest := context.Background(), "192.0.2.1:443"
+	refused := errors.New("connect tcp 192.0.2.1:443: connection refused")
+	for i := 0; i < 5; i++ {
+		if _, err := b.dial(ctx, dest, func() (net.Conn, error) { return nil, refused }); err != refused {
+			t.Fatalf("dial %d = %v, want it attempted", i, err)
+		}
+	}
+}
+
+func TestTunnelBreakerFailsFastUntilCooldown(t *testing.T) {
+	const threshold, cooldown = 3, 5 * time.Second
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &tunnelBreaker{threshold: threshold, cooldown: cooldown, now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	dials := 0
+	timeout := func() (net.Conn, error) {
+		dials++
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	// One unresponsive destination doesn't trip it
+	for i := 0; i < 2*threshold; i++ {
+		b.dial(ctx, "192.0.2.1:443", timeout)
+	}
+	if _, err := b.dial(ctx, "192.0.2.2:443", timeout); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("dial after one destination timed out = %v, want it attempted", err)
+	}
+
+	// Timeouts across threshold destinations do, for every destination
+	b.dial(ctx, "192.0.2.3:443", timeout)
+	tripped, attempted := now, dials
+	for _, wait := range []time.Duration{0, cooldown - time.Millisecond} {
+		now = tripped.Add(wait)
+		if _, err := b.dial(ctx, "198.51.100.1:443", timeout); !errors.Is(err, ErrTunnelUnresponsive) {
+			t.Fatalf("dial during cooldown = %v, want ErrTunnelUnresponsive", err)
+		}
+	}
+	if dials != attempted {
+		t.Fatalf("breaker let %d dials through during the cooldown", dials-attempted)
+	}
+
+	// Half-open: a probe the tunnel carries closes it
+	now = tripped.Add(cooldown)
+	refused := errors.New("connect tcp 198.51.100.1:443: connection refused")
+	if _, err := b.dial(ctx, "198.51.100.1:443", func() (net.Conn, error) { return nil, refused }); err != refused {
+		t.Fatalf("probe dial = %v, want it attempted", err)
+	}
+	if _, err := b.dial(ctx, "192.0.2.1:443", timeout); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("dial after recovery = %v, want it attempted", err)
+	}
+}
+
+func TestTunnelBreakerIgnoresDestinationBreaker(t *testing.T) {
+	b := &tunnelBreaker{threshold: 2, cooldown: time.Minute, now: time.Now}
+	ctx := context.Background()
+	timeout := func() (net.Conn, error) { return nil, os.ErrDeadlineExceeded }
+
+	// A dial refused by its destination's breaker never reached the tunnel,
+	// so it doesn't end the run of timeouts
+	b.dial(ctx, "192.0.2.1:443", timeout)
+	b.dial(ctx, "192.0.2.2:443", func() (net.Conn, error) { return nil, ErrTunnelDialsFailing })
+	b.dial(ctx, "192.0.2.3:443", timeout)
+	if _, err := b.dial(ctx, "192.0.2.4:443", timeout); !errors.Is(err, ErrTunnelUnresponsive) {
+		t.Fatalf("dial = %v, want ErrTunnelUnresponsive", err)
+	}
+}
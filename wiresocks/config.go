@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/go-ini/ini"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/preflightbind"
 )
 
 type PeerConfig struct {
@@ -33,6 +34,8 @@ type InterfaceConfig struct {
 type Configuration struct {
 	Interface *InterfaceConfig
 	Peers     []PeerConfig
+	// AtomicNoize is derived from AmneziaWG fields in [Interface], nil if there are none
+	AtomicNoize *preflightbind.AtomicNoizeConfig
 }
 
 func EncodeBase64ToHex(key string) (string, error) {
@@ -105,6 +108,66 @@ func ParseInterface(cfg *ini.File) (InterfaceConfig, error) {
 	return device, nil
 }
 
+// ParseAmnezia parses the AmneziaWG obfuscation fields (Jc, Jmin, Jmax, S1, S2,
+// H1-H4, I1-I5) of the [Interface] section. It returns nil if none are set.
+func ParseAmnezia(cfg *ini.File) (*preflightbind.AtomicNoizeConfig, error) {
+	interfaces, err := cfg.SectionsByName("Interface")
+	if len(interfaces) != 1 || err != nil {
+		return nil, errors.New("only one [Interface] is expected")
+	}
+	iface := interfaces[0]
+
+	found := false
+	intKey := func(name string, dst *int) error {
+		sectionKey, err := iface.GetKey(name)
+		if err != nil {
+			return nil
+		}
+		value, err := sectionKey.Int()
+		if err != nil || value < 0 {
+			return fmt.Errorf("'%s' is not a valid value for %s", sectionKey.String(), name)
+		}
+		*dst, found = value, true
+		return nil
+	}
+
+	c := &preflightbind.AtomicNoizeConfig{}
+	for name, dst := range map[string]*int{"Jc": &c.Jc, "Jmin": &c.Jmin, "Jmax": &c.Jmax, "S1": &c.S1, "S2": &c.S2} {
+		if err := intKey(name, dst); err != nil {
+			return nil, err
+		}
+	}
+
+	// Custom message types need a matching AmneziaWG server; WARP only speaks
+	// the standard ones, so anything else cannot work
+	for i := 1; i <= 4; i++ {
+		var header int
+		name := fmt.Sprintf("H%d", i)
+		if err := intKey(name, &header); err != nil {
+			return nil, err
+		}
+		if header != 0 && header != i {
+			return nil, fmt.Errorf("custom %s message type %d is not supported, use %d", name, header, i)
+		}
+	}
+
+	for i, dst := range []*string{&c.I1, &c.I2, &c.I3, &c.I4, &c.I5} {
+		if sectionKey, err := iface.GetKey(fmt.Sprintf("I%d", i+1)); err == nil {
+			*dst, found = sectionKey.String(), true
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+	if c.Jmin > c.Jmax {
+		return nil, fmt.Errorf("Jmin (%d) must not be greater than Jmax (%d)", c.Jmin, c.Jmax)
+	}
+	// AmneziaWG sends all junk packets before the handshake
+	c.JcBeforeHS = c.Jc
+	return c, nil
+}
+
 // ParsePeers parses the [Peer] section and extract the information into `peers`
 func ParsePeers(cfg *ini.File) ([]PeerConfig, error) {
 	sections, err := cfg.SectionsByName("Peer")
@@ -232,5 +295,10 @@ func ParseConfig(path string) (*Configuration, error) {
 		return nil, err
 	}
 
-	return &Configuration{Interface: &iface, Peers: peers}, nil
+	atomicNoize, err := ParseAmnezia(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Configuration{Interface: &iface, Peers: peers, AtomicNoize: atomicNoize}, nil
 }
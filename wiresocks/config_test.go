@@ -2,6 +2,7 @@ package wiresocks
 
 import (
 	"net/netip"
+	"strings"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -85,3 +86,70 @@ func TestParsePeers(t *testing.T) {
 	qt.Assert(t, peers, qt.CmpEquals(cmpopts.EquateComparable(netip.Prefix{})), want)
 	t.Logf("%+v", peers)
 }
+
+const amneziaConfig = `
+[Interface]
+PrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+Address = 172.16.0.2/32
+Jc = 4
+Jmin = 40
+Jmax = 70
+S1 = 0
+S2 = 0
+H1 = 1
+H2 = 2
+H3 = 3
+H4 = 4
+I1 = <b 0xc2000000011419fa4bb3599f336777de79f81ca9a8d80d91eeec0000><r 16>
+I2 = <r 32>
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0
+Endpoint = engage.cloudflareclient.com:2408
+`
+
+func loadTestConfig(t *testing.T, conf string) *ini.File {
+	t.Helper()
+	cfg, err := ini.LoadSources(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}, []byte(conf))
+	qt.Assert(t, err, qt.IsNil)
+	return cfg
+}
+
+func TestParseAmnezia(t *testing.T) {
+	c, err := ParseAmnezia(loadTestConfig(t, amneziaConfig))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, c, qt.IsNotNil)
+
+	qt.Check(t, c.Jc, qt.Equals, 4)
+	qt.Check(t, c.JcBeforeHS, qt.Equals, 4)
+	qt.Check(t, c.Jmin, qt.Equals, 40)
+	qt.Check(t, c.Jmax, qt.Equals, 70)
+	qt.Check(t, c.S1, qt.Equals, 0)
+	qt.Check(t, c.S2, qt.Equals, 0)
+	qt.Check(t, strings.HasPrefix(c.I1, "<b 0xc2000000011419fa"), qt.IsTrue)
+	qt.Check(t, c.I2, qt.Equals, "<r 32>")
+	qt.Check(t, c.I3, qt.Equals, "")
+}
+
+func TestParseAmneziaAbsent(t *testing.T) {
+	c, err := ParseAmnezia(loadTestConfig(t, testConfig))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, c, qt.IsNil)
+}
+
+func TestParseAmneziaInvalid(t *testing.T) {
+	for _, fields := range []string{
+		"Jc = -1",
+		"Jmin = 80\nJmax = 40",
+		"H1 = 1234567",
+		"S1 = abc",
+	} {
+		conf := strings.Replace(testConfig, "MTU = 1500", "MTU = 1500\n"+fields, 1)
+		_, err := ParseAmnezia(loadTestConfig(t, conf))
+		qt.Check(t, err, qt.IsNotNil, qt.Commentf("fields %q", fields))
+	}
+}
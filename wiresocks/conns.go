@@ -0,0 +1,173 @@
+package wiresocks
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a connection a proxy is relaying
+type ConnInfo struct {
+	ID        uint64    `json:"id"`
+	Protocol  string    `json:"protocol"` // tcp or udp
+	Target    string    `json:"target"`
+	Client    string    `json:"client"`
+	Started   time.Time `json:"started"`
+	BytesUp   uint64    `json:"bytes_up"`   // From the client into the tunnel
+	BytesDown uint64    `json:"bytes_down"` // From the tunnel back to the client
+}
+
+// ConnTable tracks the connections the proxies are relaying, so a single
+// misbehaving one can be listed and closed while the tunnel keeps serving the
+// rest. The zero value is ready to use.
+type ConnTable struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*tableEntry
+}
+
+// tableEntry is an active connection of a ConnTable
+type tableEntry struct {
+	info     ConnInfo // Without the byte counts
+	up, down atomic.Uint64
+	close    func()
+}
+
+// WithConnTable records the connections the proxy relays in t. A nil t
+// tracks nothing.
+func WithConnTable(t *ConnTable) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.conns = t
+	}
+}
+
+// List returns the active connections, oldest first
+func (t *ConnTable) List() []ConnInfo {
+	t.mu.Lock()
+	conns := make([]ConnInfo, 0, len(t.conns))
+	for _, e := range t.conns {
+		info := e.info
+		info.BytesUp, info.BytesDown = e.up.Load(), e.down.Load()
+		conns = append(conns, info)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(conns, func(a, b ConnInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return conns
+}
+
+// Close closes both sides of the connection with id, ending its relay, and
+// reports whether it was active
+func (t *ConnTable) Close(id uint64) bool {
+	t.mu.Lock()
+	e, ok := t.conns[id]
+	t.mu.Unlock()
+	if ok {
+		e.close()
+	}
+	return ok
+}
+
+// track adds the relay of client to conn, returning the two wrapped to count
+// their bytes and a function removing them from t again
+func (t *ConnTable) track(protocol, target string, client, conn net.Conn) (net.Conn, net.Conn, func()) {
+	e := &tableEntry{
+		info: ConnInfo{
+			Protocol: protocol,
+			Target:   target,
+			Started:  time.Now(),
+		},
+		close: func() {
+			client.Close()
+			conn.Close()
+		},
+	}
+	if addr := client.RemoteAddr(); addr != nil {
+		e.info.Client = addr.String()
+	}
+	remove := t.add(e)
+	return &tableConn{Conn: client, n: &e.up}, &tableConn{Conn: conn, n: &e.down}, remove
+}
+
+// trackUpstream adds conn, a tunnel connection the HTTP proxy keeps across
+// plain requests instead of relaying, so it has no single client. Writes to
+// the returned connection count up, reads down, and closing it removes it
+// from t.
+func (t *ConnTable) trackUpstream(protocol, target string, conn net.Conn) net.Conn {
+	e := &tableEntry{
+		info: ConnInfo{
+			Protocol: protocol,
+			Target:   target,
+			Started:  time.Now(),
+		},
+	}
+	u := &trackedUpstream{Conn: conn, entry: e}
+	e.close = func() {
+		u.Close()
+	}
+	u.remove = t.add(e)
+	return u
+}
+
+// add assigns e an ID and adds it, returning a function removing it again
+func (t *ConnTable) add(e *tableEntry) func() {
+	t.mu.Lock()
+	t.nextID++
+	e.info.ID = t.nextID
+	if t.conns == nil {
+		t.conns = make(map[uint64]*tableEntry)
+	}
+	t.conns[e.info.ID] = e
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, e.info.ID)
+		t.mu.Unlock()
+	}
+}
+
+// tableConn adds the bytes read from it to a ConnTable counter
+type tableConn struct {
+	net.Conn
+	n *atomic.Uint64
+}
+
+func (c *tableConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection
+func (c *tableConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// trackedUpstream counts an upstream connection in its ConnTable entry until
+// closed
+type trackedUpstream struct {
+	net.Conn
+	entry  *tableEntry
+	remove func()
+	once   sync.Once
+}
+
+func (c *trackedUpstream) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.entry.down.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedUpstream) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.entry.up.Add(uint64(n))
+	return n, err
+}
+
+func (c *trackedUpstream) Close() error {
+	c.once.Do(c.remove)
+	return c.Conn.Close()
+}
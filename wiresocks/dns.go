@@ -0,0 +1,336 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsCacheSize caps the answers the local DNS server caches
+	dnsCacheSize = 1024
+	// dnsNegativeTTL is how long a name error or empty answer is cached
+	dnsNegativeTTL = 30 * time.Second
+	// dnsMaxUDPSize is the largest response sent without EDNS(0)
+	dnsMaxUDPSize = 512
+	// dnsMaxEDNSSize caps the UDP payload size a client advertises with EDNS(0)
+	dnsMaxEDNSSize = 4096
+	// dnsMaxInflight caps the queries resolved at once, further ones wait
+	dnsMaxInflight = 256
+	// dnsTCPIdleTimeout closes a TCP client connection that sends no query
+	dnsTCPIdleTimeout = 10 * time.Second
+)
+
+// dnsExchanger answers DNS questions, as (*netstack.Net).Exchange does over the tunnel
+type dnsExchanger interface {
+	Exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Header, []dnsmessage.Resource, error)
+}
+
+// dnsCacheKey identifies a cached answer
+type dnsCacheKey struct {
+	name  string // Lowercased
+	qtype dnsmessage.Type
+}
+
+// dnsCacheEntry is a cached response to a question
+type dnsCacheEntry struct {
+	rcode   dnsmessage.RCode
+	answers []dnsmessage.Resource
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsServer answers A, AAAA and CNAME queries from local clients through
+// the tunnel resolver, so the OS resolver doesn't leak queries outside it
+type dnsServer struct {
+	resolver dnsExchanger
+	logger   *slog.Logger
+	now      func() time.Time
+
+	inflight chan struct{} // Semaphore of the queries being resolved
+
+	mu    sync.Mutex
+	cache map[dnsCacheKey]*dnsCacheEntry
+}
+
+// StartDNSServer serves DNS over UDP and TCP on bindAddress, resolving each
+// query through tnet (over DoH when enabled on it) and caching the answers
+// for their TTL. Only A, AAAA and CNAME queries are answered.
+func StartDNSServer(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort) (netip.AddrPort, error) {
+	return startDNSServer(ctx, l, tnet, bindAddress)
+}
+
+func startDNSServer(ctx context.Context, l *slog.Logger, resolver dnsExchanger, bindAddress netip.AddrPort) (netip.AddrPort, error) {
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(bindAddress))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	// TCP takes the same port, for clients retrying truncated answers
+	addr := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(addr))
+	if err != nil {
+		_ = conn.Close()
+		return netip.AddrPort{}, err
+	}
+
+	s := &dnsServer{
+		resolver: resolver,
+		logger:   l.With("subsystem", "dns"),
+		now:      time.Now,
+		inflight: make(chan struct{}, dnsMaxInflight),
+		cache:    make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+		_ = ln.Close()
+	}()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if !s.acquire(ctx) {
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+			go func() {
+				defer s.release()
+				if resp := s.answer(ctx, query, true); resp != nil {
+					_, _ = conn.WriteToUDPAddrPort(resp, from)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveTCP(ctx, c)
+		}
+	}()
+
+	return addr, nil
+}
+
+// acquire waits for a free query slot, reporting false if ctx is done first
+func (s *dnsServer) acquire(ctx context.Context) bool {
+	select {
+	case s.inflight <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *dnsServer) release() { <-s.inflight }
+
+// serveTCP answers the length-prefixed queries on conn in turn until the
+// client closes it or stays idle for dnsTCPIdleTimeout
+func (s *dnsServer) serveTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	var length [2]byte
+	for {
+		_ = conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		if !s.acquire(ctx) {
+			return
+		}
+		resp := s.answer(ctx, query, false)
+		s.release()
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to a DNS query, or nil to drop one that can't
+// be parsed. Responses over UDP are limited to 512 bytes or the size the
+// client advertises with EDNS(0), and truncated beyond it.
+func (s *dnsServer) answer(ctx context.Context, query []byte, udp bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	ednsSize, edns := requestEDNS(&p)
+	resp := dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	}
+
+	var answers []dnsmessage.Resource
+	switch {
+	case h.OpCode != 0 || q.Class != dnsmessage.ClassINET:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	case q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA && q.Type != dnsmessage.TypeCNAME:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	default:
+		resp.RCode, answers, err = s.resolve(ctx, q)
+		if err != nil {
+			s.logger.Debug("tunnel DNS lookup failed", "name", q.Name.String(), "type", q.Type, "error", err)
+			resp.RCode = dnsmessage.RCodeServerFailure
+		}
+	}
+
+	limit := 65535
+	if udp {
+		limit = dnsMaxUDPSize
+		if edns {
+			limit = min(max(ednsSize, dnsMaxUDPSize), dnsMaxEDNSSize)
+		}
+	}
+	msg, err := buildDNSResponse(resp, q, answers, edns)
+	if err == nil && len(msg) > limit {
+		// Let the client retry over TCP, or make do with the truncated answer
+		resp.Truncated = true
+		msg, err = buildDNSResponse(resp, q, nil, edns)
+	}
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// requestEDNS returns the UDP payload size advertised by the OPT record of
+// the query p has read the question of, and whether it has one
+func requestEDNS(p *dnsmessage.Parser) (int, bool) {
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return 0, false
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err != nil {
+			return 0, false
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			// The class of an OPT record carries the payload size
+			return int(rh.Class), true
+		}
+		if p.SkipAdditional() != nil {
+			return 0, false
+		}
+	}
+}
+
+// resolve answers q from the cache or the tunnel resolver
+func (s *dnsServer) resolve(ctx context.Context, q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource, error) {
+	key := dnsCacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type}
+	now := s.now()
+
+	s.mu.Lock()
+	if e, ok := s.cache[key]; ok && now.Before(e.expires) {
+		s.mu.Unlock()
+		return e.rcode, agedAnswers(e.answers, now.Sub(e.stored)), nil
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	h, answers, err := s.resolver.Exchange(ctx, q)
+	if err != nil {
+		return 0, nil, err
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return h.RCode, nil, nil
+	}
+
+	ttl := dnsNegativeTTL
+	if len(answers) > 0 {
+		ttl = time.Duration(answers[0].Header.TTL) * time.Second
+		for _, rr := range answers[1:] {
+			ttl = min(ttl, time.Duration(rr.Header.TTL)*time.Second)
+		}
+	}
+	if ttl > 0 {
+		s.mu.Lock()
+		if len(s.cache) >= dnsCacheSize {
+			s.evictLocked(now)
+		}
+		s.cache[key] = &dnsCacheEntry{rcode: h.RCode, answers: answers, stored: now, expires: now.Add(ttl)}
+		s.mu.Unlock()
+	}
+	return h.RCode, answers, nil
+}
+
+// evictLocked drops expired answers, and an arbitrary one if none has expired
+func (s *dnsServer) evictLocked(now time.Time) {
+	for key, e := range s.cache {
+		if !now.Before(e.expires) {
+			delete(s.cache, key)
+		}
+	}
+	for key := range s.cache {
+		if len(s.cache) < dnsCacheSize {
+			break
+		}
+		delete(s.cache, key)
+	}
+}
+
+// agedAnswers returns answers with age taken off their TTLs
+func agedAnswers(answers []dnsmessage.Resource, age time.Duration) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(answers))
+	copy(aged, answers)
+	for i := range aged {
+		ttl := aged[i].Header.TTL - uint32(age/time.Second)
+		if ttl > aged[i].Header.TTL {
+			ttl = 0
+		}
+		aged[i].Header.TTL = ttl
+	}
+	return aged
+}
+
+// buildDNSResponse packs a response to q with answers, with an OPT record
+// advertising dnsMaxEDNSSize if edns is set
+func buildDNSResponse(h dnsmessage.Header, q dnsmessage.Question, answers []dnsmessage.Resource, edns bool) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header:    h,
+		Questions: []dnsmessage.Question{q},
+		Answers:   answers,
+	}
+	if edns {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(dnsMaxEDNSSize, dnsmessage.RCodeSuccess, false); err != nil {
+			return nil, err
+		}
+		msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	return msg.Pack()
+}
@@ -0,0 +1,261 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeTunnelResolver answers every question with a CNAME to
+// edge.example.net and its address, counting the exchanges
+type fakeTunnelResolver struct {
+	exchanges atomic.Int32
+}
+
+func (r *fakeTunnelResolver) Exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Header, []dnsmessage.Resource, error) {
+	r.exchanges.Add(1)
+	target := dnsmessage.MustNewName("edge.example.net.")
+	return dnsmessage.Header{Response: true, RecursionAvailable: true}, []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.CNAMEResource{CNAME: target},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 7}},
+		},
+	}, nil
+}
+
+// queryDNS sends a query for name and qtype to server and returns the response
+func queryDNS(t *testing.T, server netip.AddrPort, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	return exchangeDNS(t, "udp", server, newDNSQuery(name, qtype))
+}
+
+// newDNSQuery returns a recursive query for name and qtype
+func newDNSQuery(name string, qtype dnsmessage.Type) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+}
+
+// exchangeDNS sends query to server over network, udp or tcp, and returns
+// the response
+func exchangeDNS(t *testing.T, network string, server netip.AddrPort, query dnsmessage.Message) dnsmessage.Message {
+	t.Helper()
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial(network, server.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if network == "tcp" {
+		b = append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+	}
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		if _, err = io.ReadFull(conn, buf[:2]); err == nil {
+			n = int(binary.BigEndian.Uint16(buf))
+			_, err = io.ReadFull(conn, buf[:n])
+		}
+	} else {
+		n, err = conn.Read(buf)
+	}
+	if err != nil {
+		t.Fatalf("no DNS response: %v", err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != query.ID || !resp.Response {
+		t.Fatalf("response header = %+v", resp.Header)
+	}
+	return resp
+}
+
+func TestDNSServerAnswersThroughTunnel(t *testing.T) {
+	resolver := &fakeTunnelResolver{}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server, err := startDNSServer(t.Context(), l, resolver, netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := queryDNS(t, server, "www.example.com.", dnsmessage.TypeA)
+		if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 2 {
+			t.Fatalf("query %d: rcode %v with %d answers", i, resp.RCode, len(resp.Answers))
+		}
+		if cname, ok := resp.Answers[0].Body.(*dnsmessage.CNAMEResource); !ok || cname.CNAME.String() != "edge.example.net." {
+			t.Errorf("query %d: first answer = %v, want the CNAME", i, resp.Answers[0].Body)
+		}
+		if a, ok := resp.Answers[1].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{192, 0, 2, 7} {
+			t.Errorf("query %d: second answer = %v, want 192.0.2.7", i, resp.Answers[1].Body)
+		}
+	}
+	if n := resolver.exchanges.Load(); n != 1 {
+		t.Errorf("tunnel resolver asked %d times for a cached answer, want 1", n)
+	}
+
+	if resp := queryDNS(t, server, "example.com.", dnsmessage.TypeMX); resp.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("MX query rcode = %v, want NotImplemented", resp.RCode)
+	}
+}
+
+func TestDNSServerAgesCachedTTLs(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &dnsServer{
+		resolver: &fakeTunnelResolver{},
+		now:      func() time.Time { return now },
+		cache:    make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if _, _, err := s.resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(20 * time.Second)
+	_, answers, err := s.resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answers[0].Header.TTL != 280 || answers[1].Header.TTL != 40 {
+		t.Errorf("cached TTLs = %d, %d, want 280, 40", answers[0].Header.TTL, answers[1].Header.TTL)
+	}
+
+	// The entry lives as long as its shortest TTL
+	now = now.Add(40 * time.Second)
+	if _, _, err := s.resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.resolver.(*fakeTunnelResolver).exchanges.Load(); n != 2 {
+		t.Errorf("%d exchanges after the shortest TTL expired, want 2", n)
+	}
+}
+
+// manyAddressesResolver answers every question with more addresses than fit
+// in 512 bytes, blocking until release is closed if it is set
+type manyAddressesResolver struct {
+	release   chan struct{}
+	exchanges atomic.Int32
+}
+
+func (r *manyAddressesResolver) Exchange(ctx context.Context, q dnsmessage.Question) (dnsmessage.Header, []dnsmessage.Resource, error) {
+	r.exchanges.Add(1)
+	if r.release != nil {
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return dnsmessage.Header{}, nil, ctx.Err()
+		}
+	}
+	var answers []dnsmessage.Resource
+	for i := range 40 {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+	return dnsmessage.Header{Response: true, RecursionAvailable: true}, answers, nil
+}
+
+func TestDNSServerTruncatesToEDNSSize(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server, err := startDNSServer(t.Context(), l, &manyAddressesResolver{}, netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := queryDNS(t, server, "many.example.com.", dnsmessage.TypeA)
+	if !resp.Truncated || len(resp.Answers) != 0 {
+		t.Errorf("plain UDP response: truncated %v with %d answers, want truncated and empty", resp.Truncated, len(resp.Answers))
+	}
+
+	// The client takes the whole answer over TCP
+	resp = exchangeDNS(t, "tcp", server, newDNSQuery("many.example.com.", dnsmessage.TypeA))
+	if resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("TCP response: truncated %v with %d answers, want all 40", resp.Truncated, len(resp.Answers))
+	}
+
+	// Or over UDP when it advertises a large enough buffer
+	query := newDNSQuery("many.example.com.", dnsmessage.TypeA)
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	query.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	resp = exchangeDNS(t, "udp", server, query)
+	if resp.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("EDNS(0) UDP response: truncated %v with %d answers, want all 40", resp.Truncated, len(resp.Answers))
+	}
+	if len(resp.Additionals) != 1 || resp.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+		t.Errorf("EDNS(0) UDP response additionals = %v, want an OPT record", resp.Additionals)
+	}
+}
+
+func TestDNSServerLimitsInflightQueries(t *testing.T) {
+	resolver := &manyAddressesResolver{release: make(chan struct{})}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server, err := startDNSServer(t.Context(), l, resolver, netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", server.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Paced to the server, so no query is lost to a full socket buffer
+	waitExchanges := func(n int32) int32 {
+		deadline := time.Now().Add(2 * time.Second)
+		for resolver.exchanges.Load() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return resolver.exchanges.Load()
+	}
+	for i := range dnsMaxInflight + 20 {
+		query := newDNSQuery(fmt.Sprintf("host%d.example.com.", i), dnsmessage.TypeA)
+		b, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if i < dnsMaxInflight {
+			waitExchanges(int32(i + 1))
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := resolver.exchanges.Load(); n != dnsMaxInflight {
+		t.Fatalf("%d queries resolving at once, want %d", n, dnsMaxInflight)
+	}
+
+	// The waiting queries are resolved as slots free up
+	close(resolver.release)
+	if n := waitExchanges(dnsMaxInflight + 20); n != dnsMaxInflight+20 {
+		t.Errorf("%d queries resolved after the slots freed up, want %d", n, dnsMaxInflight+20)
+	}
+}
@@ -0,0 +1,96 @@
+package wiresocks
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+)
+
+// keepAliveAddr is dialed through the tunnel to generate keepalive traffic. It
+// is a literal address, so the nudge doesn't depend on the tunnel's DNS.
+var keepAliveAddr = netip.MustParseAddrPort("1.1.1.1:443")
+
+// ProxyOption configures StartProxy
+type ProxyOption func(*VirtualTun)
+
+// WithRelayKeepAlive nudges the tunnel every interval while a proxied
+// connection sits idle, so a path that drops quiet flows can't let the tunnel
+// time out under a long-lived session. Zero disables it.
+func WithRelayKeepAlive(interval time.Duration) ProxyOption {
+	return func(vt *VirtualTun) {
+		if interval <= 0 {
+			vt.keepAlive = nil
+			return
+		}
+		vt.keepAlive = &tunnelKeepAlive{interval: interval, nudge: dialNudge(vt.Tnet)}
+	}
+}
+
+// dialNudge returns a nudge that opens and closes a TCP connection to
+// keepAliveAddr through tnet
+func dialNudge(tnet *netstack.Net) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := tnet.DialContextTCPAddrPort(ctx, keepAliveAddr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// tunnelKeepAlive sends tunnel traffic on behalf of idle relays. Nudges are
+// shared by all relays of the tunnel, so at most one is sent per interval.
+type tunnelKeepAlive struct {
+	interval  time.Duration
+	nudge     func(ctx context.Context) error
+	lastNudge atomic.Int64 // UnixNano of the last nudge
+}
+
+// watch nudges the tunnel whenever the relay whose last activity is tracked by
+// lastActive has been idle for an interval, until ctx is done
+func (k *tunnelKeepAlive) watch(ctx context.Context, lastActive *atomic.Int64, onError func(error)) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, lastActive.Load())) < k.interval {
+				continue
+			}
+			last := k.lastNudge.Load()
+			if now.Sub(time.Unix(0, last)) < k.interval || !k.lastNudge.CompareAndSwap(last, now.UnixNano()) {
+				continue
+			}
+			nudgeCtx, cancel := context.WithTimeout(ctx, k.interval)
+			if err := k.nudge(nudgeCtx); err != nil && ctx.Err() == nil {
+				onError(err)
+			}
+			cancel()
+		}
+	}
+}
+
+// activityConn records the time of every successful read
+type activityConn struct {
+	net.Conn
+	lastActive *atomic.Int64
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection
+func (c *activityConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,90 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+func TestIdleRelayKeepAlive(t *testing.T) {
+	var nudges atomic.Int32
+	vt := &VirtualTun{
+		Logger: newTestLogger(t),
+		Ctx:    context.Background(),
+		pool:   buf.DefaultAllocator,
+		keepAlive: &tunnelKeepAlive{
+			interval: 20 * time.Millisecond,
+			nudge: func(ctx context.Context) error {
+				nudges.Add(1)
+				return nil
+			},
+		},
+	}
+
+	app, client := net.Pipe()
+	remote, server := net.Pipe()
+	relayDone := make(chan error, 1)
+	go func() { relayDone <- vt.relay(client, remote, "", 0) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for nudges.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d keepalive nudges from an idle relay, want at least 2", nudges.Load())
+		}
+		select {
+		case <-relayDone:
+			t.Fatal("idle relay closed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// The relay must still carry data after idling
+	go app.Write([]byte("ping"))
+	got := make([]byte, 4)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "ping" {
+		t.Fatalf("read %q, %v through the relay after idling, want ping", got, err)
+	}
+
+	app.Close()
+	server.Close()
+	select {
+	case <-relayDone:
+	case <-time.After(time.Second):
+		t.Fatal("relay did not return after both ends closed")
+	}
+}
+
+func TestKeepAliveSharedAcrossRelays(t *testing.T) {
+	var nudges atomic.Int32
+	k := &tunnelKeepAlive{
+		interval: 50 * time.Millisecond,
+		nudge: func(ctx context.Context) error {
+			nudges.Add(1)
+			return nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 280*time.Millisecond)
+	defer cancel()
+
+	// Ten idle relays on one tunnel should not multiply the keepalive traffic
+	var lastActive atomic.Int64
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			k.watch(ctx, &lastActive, func(error) {})
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if n := nudges.Load(); n < 1 || n > 6 {
+		t.Fatalf("got %d nudges in 280ms at a 50ms interval, want at most one per interval", n)
+	}
+}
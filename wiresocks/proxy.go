@@ -2,17 +2,25 @@ package wiresocks
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/sagernet/sing/common/buf"
 	"io"
 	"log/slog"
 	"net"
 	"net/netip"
+	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/voidr3aper-anon/Vwarp/neterr"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/acl"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/http"
 	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/mixed"
 	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/transparent"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/device"
 	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
 )
@@ -25,12 +33,58 @@ type VirtualTun struct {
 	Ctx    context.Context
 	pool   buf.Allocator
 	//pool bufferpool.BufPool
+	keepAlive *tunnelKeepAlive // Nil unless WithRelayKeepAlive is set
+	stats     *Stats           // Nil unless WithStats is set
+	breaker   *dialBreaker     // Nil unless WithDialBreaker is set
+
+	tunnelBreaker *tunnelBreaker // Nil unless WithTunnelBreaker is set
+
+	acl        *acl.ACL           // Destinations clients may connect to, nil allows all
+	requestLog statute.RequestLog // Set by WithRequestLog, off by default
+	tlsConfig  *tls.Config        // Set by WithTLS, plain TCP if nil
+	conns      *ConnTable         // Set by WithConnTable, nil tracks nothing
 }
 
 var BuffSize = 65536
 
-// StartProxy spawns a socks5 server.
-func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort) (netip.AddrPort, error) {
+// errDestinationDenied is returned for tunnel dials the ACL refuses
+var errDestinationDenied = errors.New("destination not allowed by ACL")
+
+// WithRequestLog logs the HTTP requests and SOCKS commands of proxy clients
+// as selected by mode
+func WithRequestLog(mode statute.RequestLog) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.requestLog = mode
+	}
+}
+
+// WithTLS serves the proxy listener of StartProxy over TLS with config, so
+// clients on the local network can't read the SOCKS and HTTP proxy traffic.
+// The protocols run unchanged inside TLS; SOCKS5 UDP associations still
+// relay their datagrams in the clear. StartTransparentProxy ignores it.
+func WithTLS(config *tls.Config) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.tlsConfig = config
+	}
+}
+
+// tunnelResolver answers SOCKS5 RESOLVE requests with the tunnel's DNS servers
+type tunnelResolver struct {
+	tnet *netstack.Net
+}
+
+func (r tunnelResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.tnet.LookupContextHost(ctx, host)
+}
+
+func (r tunnelResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.tnet.LookupContextAddr(ctx, addr)
+}
+
+// StartProxy spawns a socks5 server. Destinations rejected by rules, by
+// name or by the address a name resolves to, are refused before dialing; a
+// nil ACL allows everything.
+func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort, rules *acl.ACL, opts ...ProxyOption) (netip.AddrPort, error) {
 	ln, err := net.Listen("tcp", bindAddress.String())
 	if err != nil {
 		return netip.AddrPort{}, err // Return error if binding was unsuccessful
@@ -42,15 +96,29 @@ func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAdd
 		Dev:    nil,
 		Ctx:    ctx,
 		pool:   buf.DefaultAllocator,
+		acl:    rules,
+	}
+	for _, opt := range opts {
+		opt(&vt)
+	}
+	if vt.tlsConfig != nil {
+		ln = tls.NewListener(ln, vt.tlsConfig)
 	}
 
+	upstreams := http.NewConnCache(0)
 	proxy := mixed.NewProxy(
 		mixed.WithListener(ln),
 		mixed.WithLogger(l),
 		mixed.WithContext(ctx),
+		mixed.WithACL(rules),
+		mixed.WithResolver(tunnelResolver{tnet}),
 		mixed.WithUserHandler(func(request *statute.ProxyRequest) error {
 			return vt.generalHandler(request)
 		}),
+		// Plain HTTP requests reuse tunnel connections per origin
+		mixed.WithUserDialFunc(vt.dialUpstream),
+		mixed.WithHTTPConnCache(upstreams),
+		mixed.WithRequestLog(vt.requestLog),
 	)
 	go func() {
 		_ = proxy.ListenAndServe()
@@ -59,6 +127,46 @@ func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAdd
 		<-vt.Ctx.Done()
 		vt.Stop()
 		_ = ln.Close()
+		upstreams.Close()
+	}()
+
+	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+}
+
+// StartTransparentProxy spawns a transparent proxy that forwards connections
+// redirected by iptables (REDIRECT or TPROXY) to their original destination.
+// Destinations rejected by rules are refused like by StartProxy.
+func StartTransparentProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAddress netip.AddrPort, rules *acl.ACL, opts ...ProxyOption) (netip.AddrPort, error) {
+	ln, err := transparent.Listen(ctx, bindAddress.String())
+	if err != nil {
+		return netip.AddrPort{}, err // Return error if binding was unsuccessful
+	}
+
+	vt := VirtualTun{
+		Tnet:   tnet,
+		Logger: l.With("subsystem", "vtun"),
+		Ctx:    ctx,
+		pool:   buf.DefaultAllocator,
+		acl:    rules,
+	}
+	for _, opt := range opts {
+		opt(&vt)
+	}
+
+	proxy := transparent.NewServer(
+		transparent.WithListener(ln),
+		transparent.WithLogger(l),
+		transparent.WithContext(ctx),
+		transparent.WithConnectHandle(func(request *statute.ProxyRequest) error {
+			return vt.generalHandler(request)
+		}),
+	)
+	go func() {
+		_ = proxy.ListenAndServe()
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
 	}()
 
 	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
@@ -66,7 +174,14 @@ func StartProxy(ctx context.Context, l *slog.Logger, tnet *netstack.Net, bindAdd
 
 func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
 	vt.Logger.Debug("handling connection", "protocol", req.Network, "destination", req.Destination)
-	conn, err := vt.Tnet.Dial(req.Network, req.Destination)
+	conn, err := vt.dialTunnel(vt.Ctx, req.Destination, func() (net.Conn, error) {
+		switch req.Network {
+		case "udp", "udp4", "udp6":
+			return vt.dialUDP(req.Destination)
+		default:
+			return vt.dialTCP(vt.Ctx, req.Network, req.Destination)
+		}
+	})
 	if err != nil {
 		return err
 	}
@@ -77,44 +192,236 @@ func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
 		timeout = 15 * time.Second
 	}
 
+	client := req.Conn
+	if vt.conns != nil {
+		var untrack func()
+		client, conn, untrack = vt.conns.track(req.Network, req.Destination, client, conn)
+		defer untrack()
+	}
+
+	if req.Received.IsZero() {
+		return vt.relay(client, conn, req.DestHost, timeout)
+	}
+	timings := &connTimings{received: req.Received, connect: time.Since(req.Received)}
+	err = vt.relay(client, &firstByteConn{Conn: conn, timings: timings}, req.DestHost, timeout)
+	vt.logTimings(req, timings)
+	return err
+}
+
+// dialTunnel runs dial to destination, through the tunnel and dial breakers
+// when there are any
+func (vt *VirtualTun) dialTunnel(ctx context.Context, destination string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if vt.breaker != nil {
+		next := dial
+		dial = func() (net.Conn, error) { return vt.breaker.dial(ctx, destination, next) }
+	}
+	if vt.tunnelBreaker != nil {
+		return vt.tunnelBreaker.dial(ctx, destination, dial)
+	}
+	return dial()
+}
+
+// dialUDP dials a relayed UDP destination from the tunnel address of its
+// family, so the datagrams egress with the tunnel's (WARP) address whatever
+// else the stack holds. Every association gets a socket of its own, so the
+// stack demuxes replies back to the right SOCKS client by port.
+func (vt *VirtualTun) dialUDP(destination string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP port %q", portStr)
+	}
+	addrs, err := vt.resolveAllowed(vt.Ctx, host, int(port))
+	if err != nil {
+		return nil, err
+	}
+
+	locals := vt.Tnet.LocalAddrs()
+	for _, dst := range addrs {
+		for _, src := range locals {
+			if src.Is4() == dst.Is4() {
+				return vt.Tnet.DialUDPAddrPort(netip.AddrPortFrom(src, 0), netip.AddrPortFrom(dst, uint16(port)))
+			}
+		}
+	}
+	return nil, fmt.Errorf("no tunnel address to relay UDP to %s from", destination)
+}
+
+// dialTCP dials destination through the tunnel, trying the addresses the ACL
+// allows it to resolve to in turn
+func (vt *VirtualTun) dialTCP(ctx context.Context, network, destination string) (net.Conn, error) {
+	if vt.acl == nil {
+		return vt.Tnet.DialContext(ctx, network, destination)
+	}
+	host, portStr, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TCP port %q", portStr)
+	}
+	addrs, err := vt.resolveAllowed(ctx, host, int(port))
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		// Dialing the checked address, not the name, so a second lookup
+		// can't answer differently
+		conn, err := vt.Tnet.DialContext(ctx, network, netip.AddrPortFrom(addr, uint16(port)).String())
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// resolveAllowed looks host up in the tunnel and returns its addresses,
+// refusing a host the ACL doesn't allow on port or that resolves to an
+// address it denies. Checking here covers every proxy entry point, the
+// transparent proxy and SOCKS5 UDP associations included.
+func (vt *VirtualTun) resolveAllowed(ctx context.Context, host string, port int) ([]netip.Addr, error) {
+	if !vt.acl.Allowed(host, port) {
+		return nil, fmt.Errorf("%w: %s", errDestinationDenied, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	hosts, err := vt.Tnet.LookupContextHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	for _, h := range hosts {
+		addr, err := netip.ParseAddr(h)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		if !vt.acl.AllowedResolved(addr, port) {
+			return nil, fmt.Errorf("%w: %s resolves to %s", errDestinationDenied, host, addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// dialUpstream dials through the tunnel for proxies that keep the connection
+// across requests rather than relaying it
+func (vt *VirtualTun) dialUpstream(ctx context.Context, network, address string) (net.Conn, error) {
+	vt.Logger.Debug("dialing upstream", "protocol", network, "destination", address)
+	conn, err := vt.dialTunnel(ctx, address, func() (net.Conn, error) {
+		return vt.dialTCP(ctx, network, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if vt.conns != nil {
+		conn = vt.conns.trackUpstream(network, address, conn)
+	}
+	if vt.stats != nil {
+		host, _, _ := net.SplitHostPort(address)
+		vt.stats.connOpened(host)
+		conn = &upstreamConn{Conn: conn, stats: vt.stats, host: host}
+	}
+	return conn, nil
+}
+
+// relay copies between the proxy client and the tunnel connection to host
+// until one side is done, then closes both
+func (vt *VirtualTun) relay(client, conn net.Conn, host string, timeout time.Duration) error {
 	// Close the connections when this function exits
 	defer conn.Close()
-	defer req.Conn.Close()
+	defer client.Close()
+
+	if vt.stats != nil {
+		vt.stats.connOpened(host)
+		defer vt.stats.connClosed()
+		client = &countingConn{Conn: client, stats: vt.stats, host: host, up: true}
+		conn = &countingConn{Conn: conn, stats: vt.stats, host: host}
+	}
+
+	if vt.keepAlive != nil {
+		var lastActive atomic.Int64
+		lastActive.Store(time.Now().UnixNano())
+		client = &activityConn{Conn: client, lastActive: &lastActive}
+		conn = &activityConn{Conn: conn, lastActive: &lastActive}
+
+		ctx, cancel := context.WithCancel(vt.Ctx)
+		defer cancel()
+		go vt.keepAlive.watch(ctx, &lastActive, func(err error) {
+			vt.Logger.Debug("relay keepalive failed", "error", err)
+		})
+	}
+
 	// Channel to notify when copy operation is done
 	done := make(chan error, 1)
-	// Copy data from req.Conn to conn
+	// Copy data from client to conn
 	go func() {
 		buf1 := vt.pool.Get(BuffSize)
 		defer func(pool buf.Allocator, buf []byte) {
 			_ = pool.Put(buf)
 		}(vt.pool, buf1)
-		_, err := copyConnTimeout(conn, req.Conn, buf1, timeout)
+		_, err := copyConnTimeout(conn, client, buf1, timeout)
+		closeWrite(conn)
 		if errors.Is(err, syscall.ECONNRESET) {
 			done <- nil
 			return
 		}
 		done <- err
 	}()
-	// Copy data from conn to req.Conn
+	// Copy data from conn to client
 	go func() {
 		buf2 := vt.pool.Get(BuffSize)
 		defer func(pool buf.Allocator, buf []byte) {
 			_ = pool.Put(buf)
 		}(vt.pool, buf2)
-		_, err := copyConnTimeout(req.Conn, conn, buf2, timeout)
+		_, err := copyConnTimeout(client, conn, buf2, timeout)
+		closeWrite(client)
 		done <- err
 	}()
 	// Wait for one of the copy operations to finish
-	err = <-done
-	if err != nil {
+	err := <-done
+	if neterr.IsTransient(err) {
+		vt.Logger.Debug("relay closed", "error", err)
+	} else if err != nil {
 		vt.Logger.Warn(err.Error())
 	}
 
-	// Close connections and wait for the other copy operation to finish
+	// Wait for the other copy operation to finish, the peer may still answer
+	// a half-closed connection
 	<-done
 	return nil
 }
 
+// closeWrite passes the end of a relayed direction on to c. It shuts down the
+// write side when c can half-close, so the other direction keeps flowing, and
+// closes c otherwise.
+func closeWrite(c net.Conn) {
+	for {
+		switch cc := c.(type) {
+		case interface{ CloseWrite() error }:
+			_ = cc.CloseWrite()
+			return
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		case *mixed.SwitchConn:
+			c = cc.Conn
+		default:
+			_ = c.Close()
+			return
+		}
+	}
+}
+
 func (vt *VirtualTun) Stop() {
 	if vt.Dev != nil {
 		if err := vt.Dev.Down(); err != nil {
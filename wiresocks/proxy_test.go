@@ -0,0 +1,73 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+)
+
+func TestRelayAnswersHalfClosedClient(t *testing.T) {
+	target := netip.MustParseAddrPort("10.0.0.1:7")
+
+	tunnelDev, tunnelNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("172.16.0.2")}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelDev.Close()
+	remoteDev, remoteNet, err := netstack.CreateNetTUN([]netip.Addr{target.Addr()}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteDev.Close()
+	linkStacks(tunnelDev, remoteDev)
+
+	// The server answers only once the request is complete
+	ln, err := remoteNet.ListenTCPAddrPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("got "), request...))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, err := StartProxy(ctx, newTestLogger(t), tunnelNet, netip.MustParseAddrPort("127.0.0.1:0"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	socksConnect(t, conn, target)
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading the response: %v", err)
+	}
+	if string(response) != "got request" {
+		t.Errorf("response = %q, want %q", response, "got request")
+	}
+}
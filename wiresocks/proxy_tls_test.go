@@ -0,0 +1,141 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+)
+
+// newTestTLSCert returns a self-signed certificate for 127.0.0.1 and a pool
+// trusting it
+func newTestTLSCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vwarp proxy test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// serveTCPEcho echoes every connection to addr back to its sender
+func serveTCPEcho(t *testing.T, tnet *netstack.Net, addr netip.AddrPort) {
+	t.Helper()
+	ln, err := tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+// socksConnect negotiates no authentication on conn and has the SOCKS5
+// server connect it to target by IPv4 address
+func socksConnect(t *testing.T, conn net.Conn, target netip.AddrPort) {
+	t.Helper()
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != 0 {
+		t.Fatalf("method negotiation: %v %v", method, err)
+	}
+	ip := target.Addr().As4()
+	request := append([]byte{5, 1, 0, 1}, ip[:]...)
+	request = binary.BigEndian.AppendUint16(request, target.Port())
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("CONNECT reply: %v %v", reply, err)
+	}
+}
+
+func TestSOCKS5OverTLSRelaysThroughTunnel(t *testing.T) {
+	target := netip.MustParseAddrPort("10.0.0.1:7")
+
+	tunnelDev, tunnelNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("172.16.0.2")}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelDev.Close()
+	remoteDev, remoteNet, err := netstack.CreateNetTUN([]netip.Addr{target.Addr()}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteDev.Close()
+	linkStacks(tunnelDev, remoteDev)
+	serveTCPEcho(t, remoteNet, target)
+
+	cert, pool := newTestTLSCert(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, err := StartProxy(ctx, newTestLogger(t), tunnelNet, netip.MustParseAddrPort("127.0.0.1:0"), nil,
+		WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := tls.Dial("tcp", proxy.String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("TLS handshake with the proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	socksConnect(t, conn, target)
+
+	if _, err := conn.Write([]byte("hello through the tunnel")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len("hello through the tunnel"))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if string(echo) != "hello through the tunnel" {
+		t.Errorf("echo = %q", echo)
+	}
+}
@@ -23,14 +23,31 @@ type ScanOptions struct {
 	ScanTimeout  time.Duration
 	PrivateKey   string
 	PublicKey    string
+	Workers      int  // concurrent scanners (default 10)
+	Fastest      bool // scan until ScanTimeout and keep the lowest RTT instead of the first hit
+	ProbeOnly    bool // probe QUIC reachability instead of a WARP handshake, PrivateKey and PublicKey are not needed
+	Masque       bool // keep only endpoints answering QUIC on the MASQUE port (443), PrivateKey and PublicKey are not needed
 }
 
 func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ipscanner.IPInfo, err error) {
 	scanCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Stop the scan as soon as the first good IP is found.
+	// Stop the scan as soon as the first good IP is found, unless the fastest
+	// endpoint within the timeout was asked for.
 	const desiredIPs = 1
+	stopOn := desiredIPs
+	if opts.Fastest {
+		if opts.ScanTimeout <= 0 {
+			return nil, errors.New("fastest scan requires a scan timeout")
+		}
+		stopOn = 0
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 10
+	}
 
 	// Initialize scanner options
 	scannerOptions := []ipscanner.Option{
@@ -40,11 +57,13 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 		ipscanner.WithUseIPv4(opts.V4),
 		ipscanner.WithUseIPv6(opts.V6),
 		ipscanner.WithMaxDesirableRTT(opts.MaxRTT * time.Second),
-		ipscanner.WithConcurrentScanners(10),
-		ipscanner.WithStopOnFirstGoodIPs(desiredIPs),
+		ipscanner.WithConcurrentScanners(workers),
+		ipscanner.WithStopOnFirstGoodIPs(stopOn),
 		ipscanner.WithBucketSize(1),
 		ipscanner.WithTCPPingFilterRTT(300 * time.Millisecond),
 		ipscanner.WithScanTimeout(opts.ScanTimeout),
+		ipscanner.WithProbeOnly(opts.ProbeOnly),
+		ipscanner.WithMasqueOnly(opts.Masque),
 	}
 
 	// Supports:
@@ -6,23 +6,39 @@ import (
 	"errors"
 	"log/slog"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-// testWriter is a helper that wraps t.Logf to implement the io.Writer interface.
+// testWriter is a helper that wraps t.Logf to implement the io.Writer
+// interface. Proxies log from their own goroutines, which can outlive the
+// test, so writes after the test's cleanup are dropped.
 type testWriter struct {
-	t *testing.T
+	t    *testing.T
+	mu   *sync.Mutex
+	done *bool
 }
 
 func (tw testWriter) Write(p []byte) (n int, err error) {
-	tw.t.Logf("%v\n", string(bytes.TrimSpace(p)))
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !*tw.done {
+		tw.t.Logf("%v\n", string(bytes.TrimSpace(p)))
+	}
 	return len(p), nil
 }
 
-// newTestLogger creates a logger that prints to the test's output.
+// newTestLogger creates a logger that prints to the test's output until the
+// test ends.
 func newTestLogger(t *testing.T) *slog.Logger {
-	return slog.New(slog.NewTextHandler(testWriter{t}, &slog.HandlerOptions{
+	tw := testWriter{t: t, mu: &sync.Mutex{}, done: new(bool)}
+	t.Cleanup(func() {
+		tw.mu.Lock()
+		*tw.done = true
+		tw.mu.Unlock()
+	})
+	return slog.New(slog.NewTextHandler(tw, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 }
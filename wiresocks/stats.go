@@ -0,0 +1,331 @@
+package wiresocks
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTrackedHosts caps the per-host breakdown; traffic to hosts beyond
+	// it is counted under otherHosts
+	maxTrackedHosts = 1024
+	// otherHosts collects the traffic of hosts past maxTrackedHosts
+	otherHosts = "(other)"
+	// dumpedHosts is how many of the busiest hosts a stats dump lists
+	dumpedHosts = 20
+)
+
+// Stats counts the traffic relayed by the proxies of one tunnel
+type Stats struct {
+	mu          sync.Mutex
+	connections uint64
+	active      int64
+	bytesUp     uint64
+	bytesDown   uint64
+	reconnects  uint64
+	drops       uint64
+	highWater   int
+	hosts       map[string]*HostStats
+
+	reorderSamples uint64
+	reordered      uint64
+
+	timedConns     uint64
+	connectTotal   time.Duration
+	firstByteConns uint64
+	firstByteTotal time.Duration
+}
+
+// HostStats is the traffic relayed to one destination host
+type HostStats struct {
+	Host        string
+	Connections uint64
+	BytesUp     uint64
+	BytesDown   uint64
+}
+
+// StatsSnapshot is a copy of the Stats totals at one point in time
+type StatsSnapshot struct {
+	Connections uint64 // Proxied connections since start
+	Active      int64  // Proxied connections currently open
+	BytesUp     uint64 // Bytes sent from proxy clients into the tunnel
+	BytesDown   uint64 // Bytes sent from the tunnel back to proxy clients
+	Reconnects  uint64 // Tunnel reconnects
+	Drops       uint64 // Packets dropped on the way into the tunnel
+	HighWater   int    // Deepest the tunnel write queue has been
+
+	ReorderSamples uint64 // Sampled TCP segments from the tunnel checked for ordering
+	Reordered      uint64 // Sampled segments that arrived behind a later one
+
+	TimedConnections uint64        // SOCKS connections whose timings were measured
+	AvgConnect       time.Duration // Mean time from request to tunnel connect
+	AvgFirstByte     time.Duration // Mean time from request to first byte from the destination
+}
+
+// ReorderRate returns the fraction of sampled segments that arrived out of
+// order, zero before any was sampled
+func (s StatsSnapshot) ReorderRate() float64 {
+	if s.ReorderSamples == 0 {
+		return 0
+	}
+	return float64(s.Reordered) / float64(s.ReorderSamples)
+}
+
+// WithStats counts the connections and bytes relayed by the proxy in s
+func WithStats(s *Stats) ProxyOption {
+	return func(vt *VirtualTun) {
+		vt.stats = s
+	}
+}
+
+// Snapshot returns the current totals
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var avgConnect, avgFirstByte time.Duration
+	if s.timedConns > 0 {
+		avgConnect = s.connectTotal / time.Duration(s.timedConns)
+	}
+	if s.firstByteConns > 0 {
+		avgFirstByte = s.firstByteTotal / time.Duration(s.firstByteConns)
+	}
+	return StatsSnapshot{
+		Connections: s.connections,
+		Active:      s.active,
+		BytesUp:     s.bytesUp,
+		BytesDown:   s.bytesDown,
+		Reconnects:  s.reconnects,
+		Drops:       s.drops,
+		HighWater:   s.highWater,
+
+		ReorderSamples: s.reorderSamples,
+		Reordered:      s.reordered,
+
+		TimedConnections: s.timedConns,
+		AvgConnect:       avgConnect,
+		AvgFirstByte:     avgFirstByte,
+	}
+}
+
+// AddReconnect records a reconnect of the tunnel
+func (s *Stats) AddReconnect() {
+	s.mu.Lock()
+	s.reconnects++
+	s.mu.Unlock()
+}
+
+// AddPacketDrop records a packet dropped on the way into the tunnel
+func (s *Stats) AddPacketDrop() {
+	s.mu.Lock()
+	s.drops++
+	s.mu.Unlock()
+}
+
+// ObserveQueueDepth records the depth of the tunnel write queue, keeping the
+// high-water mark
+func (s *Stats) ObserveQueueDepth(depth int) {
+	s.mu.Lock()
+	s.highWater = max(s.highWater, depth)
+	s.mu.Unlock()
+}
+
+// AddReorderSample records a sampled TCP segment read from the tunnel and
+// whether it arrived out of order
+func (s *Stats) AddReorderSample(reordered bool) {
+	s.mu.Lock()
+	s.reorderSamples++
+	if reordered {
+		s.reordered++
+	}
+	s.mu.Unlock()
+}
+
+// addTimings records the connect and first-byte times of a relayed
+// connection; a zero firstByte means the destination never sent anything
+func (s *Stats) addTimings(connect, firstByte time.Duration) {
+	s.mu.Lock()
+	s.timedConns++
+	s.connectTotal += connect
+	if firstByte > 0 {
+		s.firstByteConns++
+		s.firstByteTotal += firstByte
+	}
+	s.mu.Unlock()
+}
+
+// Hosts returns the per-host traffic, busiest first
+func (s *Stats) Hosts() []HostStats {
+	s.mu.Lock()
+	hosts := make([]HostStats, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		hosts = append(hosts, *h)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(hosts, func(a, b HostStats) int {
+		if c := cmp.Compare(b.BytesUp+b.BytesDown, a.BytesUp+a.BytesDown); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Host, b.Host)
+	})
+	return hosts
+}
+
+// Dump writes the current totals and the busiest hosts to l
+func (s *Stats) Dump(l *slog.Logger) {
+	s.Log(l, "proxy stats snapshot")
+	hosts := s.Hosts()
+	for _, h := range hosts[:min(len(hosts), dumpedHosts)] {
+		l.Info("proxy stats by host",
+			"host", h.Host,
+			"connections", h.Connections,
+			"bytes_up", h.BytesUp,
+			"bytes_down", h.BytesDown,
+		)
+	}
+}
+
+// Log writes the current totals to l
+func (s *Stats) Log(l *slog.Logger, msg string) {
+	snap := s.Snapshot()
+	l.Info(msg,
+		"connections", snap.Connections,
+		"active", snap.Active,
+		"bytes_up", snap.BytesUp,
+		"bytes_down", snap.BytesDown,
+		"reconnects", snap.Reconnects,
+		"drops", snap.Drops,
+		"queue_high_water", snap.HighWater,
+		"reordered_pct", math.Round(snap.ReorderRate()*10000)/100,
+		"avg_connect", snap.AvgConnect.Round(time.Millisecond),
+		"avg_first_byte", snap.AvgFirstByte.Round(time.Millisecond),
+	)
+}
+
+// Report logs the totals every interval, or never if interval is zero, and
+// once more when ctx is done
+func (s *Stats) Report(ctx context.Context, l *slog.Logger, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			s.Log(l, "proxy stats at shutdown")
+			return
+		case <-tick:
+			s.Log(l, "proxy stats")
+		}
+	}
+}
+
+// connOpened records a new connection, to host if it is not empty
+func (s *Stats) connOpened(host string) {
+	s.mu.Lock()
+	s.connections++
+	s.active++
+	if h := s.host(host); h != nil {
+		h.Connections++
+	}
+	s.mu.Unlock()
+}
+
+func (s *Stats) connClosed() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+}
+
+func (s *Stats) add(host string, up, down int) {
+	s.mu.Lock()
+	s.bytesUp += uint64(up)
+	s.bytesDown += uint64(down)
+	if h := s.host(host); h != nil {
+		h.BytesUp += uint64(up)
+		h.BytesDown += uint64(down)
+	}
+	s.mu.Unlock()
+}
+
+// host returns the counters of host, nil if host is empty. s.mu must be held.
+func (s *Stats) host(host string) *HostStats {
+	if host == "" {
+		return nil
+	}
+	if h, ok := s.hosts[host]; ok {
+		return h
+	}
+	if s.hosts == nil {
+		s.hosts = make(map[string]*HostStats)
+	}
+	if len(s.hosts) >= maxTrackedHosts {
+		host = otherHosts
+		if h, ok := s.hosts[host]; ok {
+			return h
+		}
+	}
+	h := &HostStats{Host: host}
+	s.hosts[host] = h
+	return h
+}
+
+// countingConn adds the bytes read from it to stats as upload or download
+// to host
+type countingConn struct {
+	net.Conn
+	stats *Stats
+	host  string
+	up    bool
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.up {
+			c.stats.add(c.host, n, 0)
+		} else {
+			c.stats.add(c.host, 0, n)
+		}
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// upstreamConn counts a tunnel connection the proxy keeps across requests
+// instead of relaying: writes are upload, reads are download, and it stays
+// active in stats until closed
+type upstreamConn struct {
+	net.Conn
+	stats *Stats
+	host  string
+	once  sync.Once
+}
+
+func (c *upstreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.add(c.host, 0, n)
+	return n, err
+}
+
+func (c *upstreamConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.add(c.host, n, 0)
+	return n, err
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(c.stats.connClosed)
+	return c.Conn.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package wiresocks
+
+import (
+	"context"
+	"log/slog"
+)
+
+// DumpOnSignal does nothing on platforms without SIGUSR1
+func (s *Stats) DumpOnSignal(ctx context.Context, l *slog.Logger) {}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package wiresocks
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// DumpOnSignal writes a stats dump to l every time the process receives
+// SIGUSR1, until ctx is done, so operators can sample a running proxy
+func (s *Stats) DumpOnSignal(ctx context.Context, l *slog.Logger) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			s.Dump(l)
+		}
+	}
+}
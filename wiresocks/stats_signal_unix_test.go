@@ -0,0 +1,93 @@
+//go:build unix
+
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+func TestStatsDumpOnSignal(t *testing.T) {
+	// Keep SIGUSR1 from killing the test binary before DumpOnSignal subscribes
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGUSR1)
+	defer signal.Stop(guard)
+
+	stats := &Stats{}
+	vt := &VirtualTun{
+		Logger: newTestLogger(t),
+		Ctx:    context.Background(),
+		pool:   buf.DefaultAllocator,
+		stats:  stats,
+	}
+
+	var out syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stats.DumpOnSignal(ctx, slog.New(slog.NewTextHandler(&out, nil)))
+
+	app, client := net.Pipe()
+	remote, server := net.Pipe()
+	defer app.Close()
+	defer server.Close()
+	go func() { _ = vt.relay(client, remote, "example.com", 0) }()
+	go func() { _, _ = io.Copy(server, server) }()
+
+	echo := func() {
+		t.Helper()
+		if _, err := app.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(app, make([]byte, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	echo()
+
+	want := `msg="proxy stats by host" host=example.com connections=1 bytes_up=5 bytes_down=5`
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(out.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no stats dump after SIGUSR1, log:\n%s", out.String())
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.Contains(out.String(), `msg="proxy stats snapshot" connections=1 active=1`) {
+		t.Errorf("dump has no totals line, log:\n%s", out.String())
+	}
+
+	// The relay keeps running after the dump
+	echo()
+	if snap := stats.Snapshot(); snap.Active != 1 || snap.BytesUp != 10 {
+		t.Fatalf("snapshot after the dump = %+v, want the relay still active", snap)
+	}
+}
+
+func TestStatsHostsOverflow(t *testing.T) {
+	stats := &Stats{}
+	for i := 0; i < maxTrackedHosts+5; i++ {
+		host := net.IPv4(10, 0, byte(i>>8), byte(i)).String()
+		stats.connOpened(host)
+		stats.add(host, 1, 0)
+	}
+	hosts := stats.Hosts()
+	if len(hosts) != maxTrackedHosts+1 {
+		t.Fatalf("%d hosts tracked, want %d and the overflow entry", len(hosts), maxTrackedHosts)
+	}
+	if hosts[0].Host != otherHosts || hosts[0].Connections != 5 || hosts[0].BytesUp != 5 {
+		t.Fatalf("busiest host = %+v, want %s with the 5 overflowed connections", hosts[0], otherHosts)
+	}
+}
@@ -0,0 +1,106 @@
+package wiresocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStatsReportWhileRelaying(t *testing.T) {
+	stats := &Stats{}
+	vt := &VirtualTun{
+		Logger: newTestLogger(t),
+		Ctx:    context.Background(),
+		pool:   buf.DefaultAllocator,
+		stats:  stats,
+	}
+
+	var out syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	reportDone := make(chan struct{})
+	go func() {
+		stats.Report(ctx, slog.New(slog.NewTextHandler(&out, nil)), 20*time.Millisecond)
+		close(reportDone)
+	}()
+
+	app, client := net.Pipe()
+	remote, server := net.Pipe()
+	relayDone := make(chan error, 1)
+	go func() { relayDone <- vt.relay(client, remote, "", 0) }()
+
+	// Echo on the server side so bytes flow both ways
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, err := server.Read(b)
+			if err != nil {
+				return
+			}
+			if _, err := server.Write(b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	reply := make([]byte, 5)
+	for i := 0; i < 5; i++ {
+		if _, err := app.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(app, reply); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+
+	if snap := stats.Snapshot(); snap.Connections != 1 || snap.Active != 1 || snap.BytesUp != 25 || snap.BytesDown != 25 {
+		t.Fatalf("snapshot while relaying = %+v, want 1 connection, 1 active, 25 bytes each way", snap)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(out.String(), `msg="proxy stats" connections=1 active=1 bytes_up=25 bytes_down=25`) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no periodic stats line with the relayed bytes, log:\n%s", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	app.Close()
+	server.Close()
+	<-relayDone
+	if snap := stats.Snapshot(); snap.Active != 0 {
+		t.Errorf("active = %d after the relay closed, want 0", snap.Active)
+	}
+
+	cancel()
+	<-reportDone
+	if !strings.Contains(out.String(), "proxy stats at shutdown") {
+		t.Errorf("no stats line at shutdown, log:\n%s", out.String())
+	}
+}
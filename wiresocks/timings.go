@@ -0,0 +1,61 @@
+package wiresocks
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
+)
+
+// connTimings measures a relayed connection from when the proxy received its
+// request: how long the tunnel took to connect to the destination, and how
+// long until the destination sent its first byte. Comparing the two shows
+// whether a slow site is waiting on the tunnel or on the remote.
+type connTimings struct {
+	received  time.Time
+	connect   time.Duration
+	firstByte atomic.Int64 // A time.Duration, zero until the destination sends
+}
+
+// firstByteConn records in timings when the first byte is read from the
+// destination connection it wraps
+type firstByteConn struct {
+	net.Conn
+	timings *connTimings
+	once    sync.Once
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() {
+			c.timings.firstByte.Store(int64(time.Since(c.timings.received)))
+		})
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection
+func (c *firstByteConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// logTimings adds the timings of the connection relayed for req to the stats
+// and, when requests are logged, writes them to the access log
+func (vt *VirtualTun) logTimings(req *statute.ProxyRequest, t *connTimings) {
+	firstByte := time.Duration(t.firstByte.Load())
+	if vt.stats != nil {
+		vt.stats.addTimings(t.connect, firstByte)
+	}
+	if vt.requestLog == statute.RequestLogOff {
+		return
+	}
+	vt.Logger.Info("proxy request timings",
+		"protocol", req.Network,
+		"host", req.Destination,
+		"connect", t.connect,
+		"first_byte", firstByte,
+	)
+}
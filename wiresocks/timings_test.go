@@ -0,0 +1,106 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/proxy/pkg/statute"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+)
+
+func TestSOCKSConnectTimings(t *testing.T) {
+	const greetingDelay = 50 * time.Millisecond
+	target := netip.MustParseAddrPort("10.0.0.1:25")
+
+	tunnelDev, tunnelNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("172.16.0.2")}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelDev.Close()
+	remoteDev, remoteNet, err := netstack.CreateNetTUN([]netip.Addr{target.Addr()}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteDev.Close()
+	linkStacks(tunnelDev, remoteDev)
+
+	// A server that speaks first, after a pause, like SMTP
+	ln, err := remoteNet.ListenTCPAddrPort(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			time.Sleep(greetingDelay)
+			_, _ = conn.Write([]byte("220 ready\r\n"))
+			_, _ = io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+
+	var out syncBuffer
+	stats := &Stats{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := slog.New(slog.NewTextHandler(&out, nil))
+	proxy, err := StartProxy(ctx, l, tunnelNet, netip.MustParseAddrPort("127.0.0.1:0"), nil,
+		WithStats(stats), WithRequestLog(statute.RequestLogHost))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	ip := target.Addr().As4()
+	request := append([]byte{5, 1, 0, 5, 1, 0, 1}, ip[:]...)
+	request = append(request, byte(target.Port()>>8), byte(target.Port()))
+	if _, err := client.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	replies := make([]byte, 2+10)
+	if _, err := io.ReadFull(client, replies); err != nil || replies[1] != 0 || replies[3] != 0 {
+		t.Fatalf("SOCKS5 replies: %v %v", replies, err)
+	}
+	greeting := make([]byte, len("220 ready\r\n"))
+	if _, err := io.ReadFull(client, greeting); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	var snap StatsSnapshot
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if snap = stats.Snapshot(); snap.TimedConnections == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no timings recorded after the relayed connection closed")
+		}
+	}
+	if snap.AvgConnect <= 0 || snap.AvgFirstByte <= 0 {
+		t.Fatalf("timings not populated: connect %v, first byte %v", snap.AvgConnect, snap.AvgFirstByte)
+	}
+	if snap.AvgConnect > snap.AvgFirstByte {
+		t.Errorf("connect %v came after the first byte %v", snap.AvgConnect, snap.AvgFirstByte)
+	}
+	if snap.AvgFirstByte < greetingDelay {
+		t.Errorf("first byte after %v, want at least the %v the server waited", snap.AvgFirstByte, greetingDelay)
+	}
+	if log := out.String(); !strings.Contains(log, `msg="proxy request timings" subsystem=vtun protocol=tcp host=10.0.0.1:25 connect=`) {
+		t.Errorf("no timings in the access log:\n%s", log)
+	}
+}
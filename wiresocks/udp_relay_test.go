@@ -0,0 +1,168 @@
+package wiresocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun"
+	"github.com/voidr3aper-anon/Vwarp/wireguard/tun/netstack"
+)
+
+// linkStacks forwards packets between two netstack devices until one is closed
+func linkStacks(a, b tun.Device) {
+	forward := func(src, dst tun.Device) {
+		bufs := [][]byte{make([]byte, 2048)}
+		sizes := []int{0}
+		for {
+			if _, err := src.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+			if _, err := dst.Write([][]byte{bufs[0][:sizes[0]]}, 0); err != nil {
+				return
+			}
+		}
+	}
+	go forward(a, b)
+	go forward(b, a)
+}
+
+// serveUDPEcho answers every datagram to addr with the payload followed by
+// the source address it arrived from
+func serveUDPEcho(t *testing.T, tnet *netstack.Net, addr netip.AddrPort) {
+	t.Helper()
+	conn, err := tnet.ListenUDPAddrPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			reply := append(append([]byte{}, b[:n]...), " from "+from.(*net.UDPAddr).IP.String()...)
+			conn.WriteTo(reply, from)
+		}
+	}()
+}
+
+// socksUDPClient is the client side of a SOCKS5 UDP association
+type socksUDPClient struct {
+	ctrl  net.Conn
+	udp   *net.UDPConn
+	relay *net.UDPAddr
+}
+
+func newSOCKSUDPClient(t *testing.T, proxy netip.AddrPort) *socksUDPClient {
+	t.Helper()
+	ctrl, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctrl.Close() })
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// No authentication, then UDP ASSOCIATE from any address
+	if _, err := ctrl.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, method); err != nil || method[1] != 0 {
+		t.Fatalf("method negotiation: %v %v", method, err)
+	}
+	if _, err := ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[1] != 0 || reply[3] != 1 {
+		t.Fatalf("UDP ASSOCIATE reply: %v %v", reply, err)
+	}
+
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	return &socksUDPClient{
+		ctrl:  ctrl,
+		udp:   udp,
+		relay: &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))},
+	}
+}
+
+// exchange sends payload to target through the association and returns the
+// source and payload of the reply
+func (c *socksUDPClient) exchange(t *testing.T, target netip.AddrPort, payload string) (netip.AddrPort, string) {
+	t.Helper()
+	ip := target.Addr().As4()
+	packet := append([]byte{0, 0, 0, 1}, ip[:]...)
+	packet = binary.BigEndian.AppendUint16(packet, target.Port())
+	packet = append(packet, payload...)
+	if _, err := c.udp.WriteTo(packet, c.relay); err != nil {
+		t.Fatal(err)
+	}
+
+	c.udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1500)
+	n, err := c.udp.Read(b)
+	if err != nil {
+		t.Fatalf("reading reply from %s: %v", target, err)
+	}
+	if n < 10 || !bytes.Equal(b[:4], []byte{0, 0, 0, 1}) {
+		t.Fatalf("malformed SOCKS5 UDP reply %v", b[:n])
+	}
+	from := netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[8:10]))
+	return from, string(b[10:n])
+}
+
+func TestSOCKSUDPRelaySourcesTunnelAddress(t *testing.T) {
+	tunnelAddr := netip.MustParseAddr("172.16.0.2")
+	targets := []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:5353"), netip.MustParseAddrPort("10.0.0.2:5353")}
+
+	// The tunnel stack the proxy relays through, and the remote side holding both targets
+	tunnelDev, tunnelNet, err := netstack.CreateNetTUN([]netip.Addr{tunnelAddr}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnelDev.Close()
+	remoteDev, remoteNet, err := netstack.CreateNetTUN([]netip.Addr{targets[0].Addr(), targets[1].Addr()}, nil, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteDev.Close()
+	linkStacks(tunnelDev, remoteDev)
+	for _, target := range targets {
+		serveUDPEcho(t, remoteNet, target)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, err := StartProxy(ctx, newTestLogger(t), tunnelNet, netip.MustParseAddrPort("127.0.0.1:0"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := []*socksUDPClient{newSOCKSUDPClient(t, proxy), newSOCKSUDPClient(t, proxy)}
+
+	// Both associations are open at once, each talking to its own target
+	for round := 0; round < 3; round++ {
+		for i, c := range clients {
+			payload := string(rune('a'+i)) + string(rune('0'+round))
+			from, reply := c.exchange(t, targets[i], payload)
+			if from != targets[i] {
+				t.Errorf("client %d got a reply from %s, want %s", i, from, targets[i])
+			}
+			if want := payload + " from " + tunnelAddr.String(); reply != want {
+				t.Errorf("client %d got %q, want %q", i, reply, want)
+			}
+		}
+	}
+}